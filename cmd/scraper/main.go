@@ -1,16 +1,59 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"scraper/internal/analysis"
 	"scraper/internal/crawler"
+	"scraper/internal/db"
 	"scraper/internal/favorites"
 	"scraper/internal/notification"
 	"scraper/pkg/config"
 	"scraper/pkg/logger"
+	"scraper/pkg/readiness"
+	"scraper/pkg/shutdown"
 
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
+// service is one of the services this binary can run
+type service struct {
+	name     string
+	start    func(context.Context)
+	shutdown func(context.Context) error
+	ready    func() <-chan struct{}
+	needs    []string // Services that must be ready before start is called
+}
+
+// services in start order; they are shut down in the reverse order, so a
+// service stops before the services it needs
+var services = []service{
+	{name: "notification", start: notification.Start, shutdown: notification.Shutdown, ready: notification.Ready},
+	{name: "crawler", start: crawler.Start, shutdown: crawler.Shutdown, ready: crawler.Ready},
+	{name: "analysis", start: analysis.Start, shutdown: analysis.Shutdown, ready: analysis.Ready, needs: []string{"notification"}},
+	{name: "favorites", start: favorites.Start, shutdown: favorites.Shutdown, ready: favorites.Ready, needs: []string{"notification"}},
+}
+
+// launch tracks the start of a service
+type launch struct {
+	done    chan struct{} // Closed once start returned or was skipped
+	started bool          // Whether start was called; read after done
+}
+
+// remoteChecks wait for a dependency that runs in another process, where
+// there is no Ready channel to wait on
+var remoteChecks = map[string]func(time.Duration) error{
+	"notification": notification.WaitReachable,
+}
+
 func main() {
 	// Initialize logger
 	logger.Init()
@@ -20,14 +63,203 @@ func main() {
 		logrus.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Start services in separate goroutines
-	go crawler.Start()
-	go analysis.Start()
-	go favorites.Start()
-	go notification.Start()
+	enabled := enabledServices()
+	timeout := startupTimeout()
+
+	// Run the schema migrations once before any service touches the database
+	go db.Setup()
+	if err := readiness.Wait("database migrations", db.Ready(), timeout); err != nil {
+		logrus.WithError(err).Fatal("Database not ready")
+	}
+
+	// The services run until the process is told to stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Start services in separate goroutines, each once its dependencies are up
+	launches := make(map[string]*launch)
+	for _, svc := range services {
+		if !enabled[svc.name] {
+			continue
+		}
+		l := &launch{done: make(chan struct{})}
+		launches[svc.name] = l
+		go func(svc service) {
+			defer close(l.done)
+			for _, dep := range serviceNeeds(svc) {
+				waitForDependency(svc.name, dep, enabled, timeout)
+			}
+			if ctx.Err() != nil {
+				return // Told to stop while waiting
+			}
+			svc.start(ctx)
+			l.started = true
+		}(svc)
+	}
 
 	logrus.Info("Application started")
+	go logWhenReady(enabled, timeout)
+
+	<-ctx.Done()
+	stop() // A second signal kills the process
+	logrus.WithField("timeout", shutdown.Timeout()).Info("Shutting down")
+
+	// Let running requests, messages, jobs and crawls finish, and cancel
+	// what is still running once the grace period is over
+	grace, cancel := context.WithTimeout(context.Background(), shutdown.Timeout())
+	defer cancel()
+	if err := stopServices(grace, launches); err != nil {
+		logrus.WithError(err).Error("Services did not stop cleanly")
+		os.Exit(1)
+	}
+	logrus.Info("Shutdown complete")
+}
+
+// stopServices shuts the started services down in the reverse start order.
+// A service still waiting for its dependencies is waited for until ctx ends.
+//
+// Parameters:
+//   - ctx: Bounds the whole shutdown
+//   - launches: Enabled services by name
+//
+// Returns:
+//   - error: The services that did not stop cleanly, joined
+func stopServices(ctx context.Context, launches map[string]*launch) error {
+	var errs []error
+	for i := len(services) - 1; i >= 0; i-- {
+		svc := services[i]
+		l, ok := launches[svc.name]
+		if !ok {
+			continue
+		}
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("%s still starting: %w", svc.name, ctx.Err()))
+			continue
+		}
+		if !l.started {
+			continue
+		}
+		if err := svc.shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// enabledServices returns the services to run in this process.
+//
+// Environment Variables:
+//   - SERVICES: Comma-separated services to run (default: all of
+//     notification, crawler, analysis, favorites)
+//
+// Returns:
+//   - map[string]bool: Enabled service names
+func enabledServices() map[string]bool {
+	enabled := make(map[string]bool)
+	names := viper.GetString("SERVICES")
+	if names == "" {
+		for _, svc := range services {
+			enabled[svc.name] = true
+		}
+		return enabled
+	}
 
-	// Keep the application running
-	select {}
-}
\ No newline at end of file
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := findService(name); !ok {
+			logrus.WithField("service", name).Fatal("Unknown service in SERVICES")
+		}
+		enabled[name] = true
+	}
+	return enabled
+}
+
+// serviceNeeds returns the services a service needs in this process's
+// configuration: the favorites service only calls the notification service
+// when it runs its consumer half.
+func serviceNeeds(svc service) []string {
+	if svc.name == "favorites" && !favorites.CurrentMode().Consumer() {
+		return nil
+	}
+	return svc.needs
+}
+
+// startupTimeout returns how long to wait for a dependency at startup.
+//
+// Environment Variables:
+//   - STARTUP_READY_TIMEOUT: Wait per dependency (default: 30s)
+func startupTimeout() time.Duration {
+	if timeout := viper.GetDuration("STARTUP_READY_TIMEOUT"); timeout > 0 {
+		return timeout
+	}
+	return 30 * time.Second
+}
+
+// findService looks up a service by name.
+func findService(name string) (service, bool) {
+	for _, svc := range services {
+		if svc.name == name {
+			return svc, true
+		}
+	}
+	return service{}, false
+}
+
+// waitForDependency blocks until dep can serve svc. A dependency running in
+// this process is awaited on its Ready channel, and not becoming ready is
+// fatal. A dependency in another process is retried over the network; if it
+// stays unreachable svc starts anyway and its client keeps reconnecting.
+//
+// Parameters:
+//   - svc: Name of the waiting service for logging
+//   - dep: Name of the dependency
+//   - enabled: Services running in this process
+//   - timeout: How long to wait
+func waitForDependency(svc, dep string, enabled map[string]bool, timeout time.Duration) {
+	fields := logrus.Fields{"service": svc, "dependency": dep}
+
+	if enabled[dep] {
+		depService, _ := findService(dep)
+		if err := readiness.Wait(dep, depService.ready(), timeout); err != nil {
+			logrus.WithFields(fields).WithError(err).Fatal("In-process dependency not ready")
+		}
+		logrus.WithFields(fields).Debug("In-process dependency ready")
+		return
+	}
+
+	check, ok := remoteChecks[dep]
+	if !ok {
+		return
+	}
+	if err := check(timeout); err != nil {
+		logrus.WithFields(fields).WithError(err).Warn("Remote dependency unreachable, starting anyway")
+		return
+	}
+	logrus.WithFields(fields).Info("Remote dependency reachable")
+}
+
+// logWhenReady logs once every enabled service is ready, or names the ones
+// that are still starting after the timeout.
+func logWhenReady(enabled map[string]bool, timeout time.Duration) {
+	// A service may spend one timeout on its dependencies before starting
+	deadline := time.Now().Add(2 * timeout)
+	var pending []string
+	for _, svc := range services {
+		if !enabled[svc.name] {
+			continue
+		}
+		if err := readiness.Wait(svc.name, svc.ready(), time.Until(deadline)); err != nil {
+			pending = append(pending, svc.name)
+		}
+	}
+	if len(pending) > 0 {
+		logrus.WithField("services", strings.Join(pending, ",")).Warn("Services still starting")
+		return
+	}
+	logrus.Info("All services ready")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"scraper/pkg/httpclient"
+)
+
+// apiError is returned when the API answers with a non-2xx status
+type apiError struct {
+	Status  int    // HTTP status code
+	Code    string // Stable error code, e.g. "user_not_found"; empty if the body had none
+	Message string // Error message from the response body
+}
+
+func (e *apiError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("API error (HTTP %d, %s): %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("API error (HTTP %d): %s", e.Status, e.Message)
+}
+
+// client calls the crawler HTTP API, which exposes every operation scraperctl
+// needs
+type client struct {
+	opts *options
+	http *http.Client
+}
+
+// newClient creates an API client from the parsed command line options.
+func newClient(opts *options) *client {
+	return &client{opts: opts, http: httpclient.MustNew(httpclient.Options{Name: "scraperctl", Timeout: opts.timeout})}
+}
+
+// do sends a request and returns the raw response body.
+//
+// Parameters:
+//   - method: HTTP method
+//   - path: Path relative to the API base URL
+//   - query: Query parameters, may be nil
+//   - body: Value encoded as the JSON request body, nil for none
+//
+// Returns:
+//   - []byte: Response body of a successful request
+//   - error: Network errors, or *apiError for non-2xx responses
+func (c *client) do(method, path string, query url.Values, body interface{}) ([]byte, error) {
+	u := strings.TrimRight(c.opts.apiURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.opts.apiKey != "" {
+		req.Header.Set("X-API-Key", c.opts.apiKey)
+	}
+	if c.opts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Handlers report failures as {"code": "...", "message": "...", "details": ...}
+		var payload struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		apiErr := &apiError{Status: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		if json.Unmarshal(data, &payload) == nil && payload.Message != "" {
+			apiErr.Code, apiErr.Message = payload.Code, payload.Message
+		}
+		return nil, apiErr
+	}
+	return data, nil
+}
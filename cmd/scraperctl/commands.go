@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"scraper/internal/audit"
+)
+
+// defaultTimeout bounds ordinary API calls
+const defaultTimeout = 30 * time.Second
+
+// crawlPollInterval is how often crawl checks the state of its fetch job
+const crawlPollInterval = 5 * time.Second
+
+// fetchJob is the part of a GET /fetch/jobs/:id response crawl prints
+type fetchJob struct {
+	ID                  string   `json:"id"`
+	State               string   `json:"state"`
+	CategoriesProcessed int      `json:"categories_processed"`
+	ProductsFetched     int      `json:"products_fetched"`
+	BudgetExhausted     bool     `json:"budget_exhausted"`
+	Errors              []string `json:"errors"`
+	ErrorCount          int      `json:"error_count"`
+	Error               string   `json:"error"`
+	Summary             *struct {
+		TotalProducts int               `json:"total_products"`
+		TotalBatches  int               `json:"total_batches"`
+		Sent          []int             `json:"sent"`
+		Failed        []json.RawMessage `json:"failed"`
+		Oversized     []uint            `json:"oversized"`
+		DryRun        bool              `json:"dry_run"`
+	} `json:"summary"`
+}
+
+// runCrawl starts a fetch job through GET /fetch, waits for it to finish and
+// prints the publish summary. With --detach it prints the job ID and returns.
+func runCrawl(args []string, stdout io.Writer) error {
+	fs, opts := newFlagSet("crawl", defaultTimeout)
+	category := fs.Int("category", 0, "only crawl this Trendyol web category")
+	wcStart := fs.Int("wc-start", 0, "first Trendyol web category to crawl")
+	wcEnd := fs.Int("wc-end", 0, "last Trendyol web category to crawl")
+	pageSize := fs.Int("page-size", 0, "products listed per category (1-200)")
+	mock := fs.Bool("mock", false, "publish the stored data.json instead of crawling")
+	dryRun := fs.Bool("dry-run", false, "count and log the batches instead of publishing them")
+	batchSize := fs.Int("batch-size", 0, "products per Kafka message (1-500)")
+	detach := fs.Bool("detach", false, "print the job ID instead of waiting for the job")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	query := url.Values{"live": {strconv.FormatBool(!*mock)}}
+	if *dryRun {
+		query.Set("dry_run", "true")
+	}
+	if *category != 0 {
+		query.Set("category", strconv.Itoa(*category))
+	}
+	if *wcStart != 0 {
+		query.Set("wc_start", strconv.Itoa(*wcStart))
+	}
+	if *wcEnd != 0 {
+		query.Set("wc_end", strconv.Itoa(*wcEnd))
+	}
+	if *pageSize != 0 {
+		query.Set("page_size", strconv.Itoa(*pageSize))
+	}
+	if *batchSize != 0 {
+		query.Set("batch_size", strconv.Itoa(*batchSize))
+	}
+	c := newClient(opts)
+	data, err := c.do(http.MethodGet, "/fetch", query, nil)
+	if err != nil {
+		return err
+	}
+	// A dry run of data.json answers with the finished job instead
+	var started struct {
+		JobID string `json:"job_id"`
+		ID    string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &started); err != nil {
+		return fmt.Errorf("unexpected response: %w", err)
+	}
+	if started.JobID == "" {
+		started.JobID = started.ID
+	}
+	if *detach {
+		if opts.json {
+			return printJSON(stdout, data)
+		}
+		fmt.Fprintln(stdout, started.JobID)
+		return nil
+	}
+
+	// Poll until the job finishes, reporting progress as it changes
+	var job fetchJob
+	progress := ""
+	for {
+		data, err = c.do(http.MethodGet, "/fetch/jobs/"+url.PathEscape(started.JobID), nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &job); err != nil {
+			return fmt.Errorf("unexpected response: %w", err)
+		}
+		if job.State == "completed" || job.State == "failed" {
+			break
+		}
+		if line := fmt.Sprintf("%s: %d categories, %d products, %d errors", job.State,
+			job.CategoriesProcessed, job.ProductsFetched, job.ErrorCount); line != progress && !opts.json {
+			fmt.Fprintln(stdout, line)
+			progress = line
+		}
+		time.Sleep(crawlPollInterval)
+	}
+	if opts.json {
+		return printJSON(stdout, data)
+	}
+
+	if job.State == "failed" {
+		return fmt.Errorf("fetch job %s failed: %s", job.ID, job.Error)
+	}
+	status := "Products fetched and sent to Kafka"
+	if job.Summary != nil && job.Summary.DryRun {
+		status = "Dry run, batches counted but not sent to Kafka"
+	}
+	if job.BudgetExhausted {
+		status = "Request budget exhausted, crawl stopped early"
+	}
+	fmt.Fprintln(stdout, status)
+	w := newTable(stdout)
+	fmt.Fprintln(w, "PRODUCTS\tBATCHES\tSENT\tFAILED\tOVERSIZED\tERRORS")
+	if job.Summary != nil {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\n", job.Summary.TotalProducts, job.Summary.TotalBatches,
+			len(job.Summary.Sent), len(job.Summary.Failed), len(job.Summary.Oversized), job.ErrorCount)
+	}
+	return w.Flush()
+}
+
+// runFavorites lists a user's favorites through GET /favorites/:user_id.
+func runFavorites(args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "list" {
+		return errUsage
+	}
+	fs, opts := newFlagSet("favorites list", defaultTimeout)
+	user := fs.Uint("user", 0, "user ID (required)")
+	source := fs.String("source", "", "only list products from this marketplace")
+	sortBy := fs.String("sort", "", "biggest_drop to list the largest drops first")
+	status := fs.String("status", "", "only list active, inactive or out_of_stock products")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if *user == 0 {
+		fmt.Fprintln(fs.Output(), "--user is required")
+		return errUsage
+	}
+
+	query := url.Values{}
+	if *source != "" {
+		query.Set("source", *source)
+	}
+	if *sortBy != "" {
+		query.Set("sort", *sortBy)
+	}
+	if *status != "" {
+		query.Set("status", *status)
+	}
+	data, err := newClient(opts).do(http.MethodGet, fmt.Sprintf("/favorites/%d", *user), query, nil)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(stdout, data)
+	}
+
+	// Products are encoded with their Go field names
+	var resp struct {
+		Favorites []struct {
+			ID                 uint      `json:"ID"`
+			Source             string    `json:"Source"`
+			Name               string    `json:"Name"`
+			Status             string    `json:"status"`
+			AddedAt            time.Time `json:"added_at"`
+			PriceWhenAdded     *float64  `json:"price_when_added"`
+			CurrentPrice       *float64  `json:"current_price"`
+			PriceChangePercent *float64  `json:"price_change_percent"`
+		} `json:"favorites"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("unexpected response: %w", err)
+	}
+	if len(resp.Favorites) == 0 {
+		fmt.Fprintln(stdout, "No favorites")
+		return nil
+	}
+	w := newTable(stdout)
+	fmt.Fprintln(w, "ID\tSOURCE\tNAME\tSTATUS\tADDED PRICE\tCURRENT PRICE\tCHANGE\tADDED")
+	for _, f := range resp.Favorites {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.ID, f.Source, truncate(f.Name, 40), f.Status,
+			formatPrice(f.PriceWhenAdded), formatPrice(f.CurrentPrice), formatPercent(f.PriceChangePercent),
+			f.AddedAt.Local().Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+// runNotify sends a test notification through POST /notifications/test.
+func runNotify(args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "test" {
+		return errUsage
+	}
+	fs, opts := newFlagSet("notify test", defaultTimeout)
+	email := fs.String("email", "", "recipient address (required)")
+	product := fs.Uint("product", 0, "product ID shown in the email (required)")
+	source := fs.String("source", "", "marketplace of the product")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if *email == "" || *product == 0 {
+		fmt.Fprintln(fs.Output(), "--email and --product are required")
+		return errUsage
+	}
+
+	data, err := newClient(opts).do(http.MethodPost, "/notifications/test", nil, map[string]interface{}{
+		"email":      *email,
+		"product_id": *product,
+		"source":     *source,
+	})
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(stdout, data)
+	}
+	fmt.Fprintf(stdout, "Test notification for product %d sent to %s\n", *product, *email)
+	return nil
+}
+
+// runScheduler pauses, resumes or shows the favorites scheduler.
+func runScheduler(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	method, path := http.MethodGet, "/scheduler"
+	switch args[0] {
+	case "status":
+	case "pause", "resume":
+		method, path = http.MethodPost, "/scheduler/"+args[0]
+	default:
+		return errUsage
+	}
+	fs, opts := newFlagSet("scheduler "+args[0], defaultTimeout)
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+
+	data, err := newClient(opts).do(method, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(stdout, data)
+	}
+
+	var state struct {
+		Name         string     `json:"name"`
+		Paused       bool       `json:"paused"`
+		LastRunAt    *time.Time `json:"last_run_at"`
+		LastRunCount int        `json:"last_run_count"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("unexpected response: %w", err)
+	}
+	status := "running"
+	if state.Paused {
+		status = "paused"
+	}
+	lastRun := "never"
+	if state.LastRunAt != nil {
+		lastRun = state.LastRunAt.Local().Format("2006-01-02 15:04:05")
+	}
+	w := newTable(stdout)
+	fmt.Fprintln(w, "SCHEDULER\tSTATUS\tLAST RUN\tPRODUCTS")
+	fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", state.Name, status, lastRun, state.LastRunCount)
+	return w.Flush()
+}
+
+// runStats prints the Trendyol request budget and the fetch retry queue
+// through GET /stats.
+func runStats(args []string, stdout io.Writer) error {
+	fs, opts := newFlagSet("stats", defaultTimeout)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	data, err := newClient(opts).do(http.MethodGet, "/stats", nil, nil)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(stdout, data)
+	}
+
+	// Failed products are encoded with their Go field names
+	var stats struct {
+		FetchRetries struct {
+			Pending        int64 `json:"pending"`
+			Failed         int64 `json:"failed"`
+			FailedProducts []struct {
+				ProductID     uint   `json:"ProductID"`
+				ProductSource string `json:"ProductSource"`
+				Attempts      int    `json:"Attempts"`
+				Error         string `json:"Error"`
+			} `json:"failed_products"`
+		} `json:"fetch_retries"`
+		RequestBudget struct {
+			Day          string `json:"day"`
+			Limit        int    `json:"limit"`
+			Used         int    `json:"used"`
+			PriorityOnly bool   `json:"priority_only"`
+			Exhausted    bool   `json:"exhausted"`
+		} `json:"request_budget"`
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return fmt.Errorf("unexpected response: %w", err)
+	}
+	budget := stats.RequestBudget
+	state := "ok"
+	switch {
+	case budget.Exhausted:
+		state = "exhausted"
+	case budget.PriorityOnly:
+		state = "priority products only"
+	}
+	fmt.Fprintf(stdout, "Trendyol requests (%s): %d of %d used, %s\n", budget.Day, budget.Used, budget.Limit, state)
+
+	retries := stats.FetchRetries
+	fmt.Fprintf(stdout, "Fetch retries: %d pending, %d failed\n", retries.Pending, retries.Failed)
+	if len(retries.FailedProducts) == 0 {
+		return nil
+	}
+	fmt.Fprintln(stdout)
+	w := newTable(stdout)
+	fmt.Fprintln(w, "PRODUCT\tSOURCE\tATTEMPTS\tERROR")
+	for _, p := range retries.FailedProducts {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\n", p.ProductID, p.ProductSource, p.Attempts, truncate(p.Error, 60))
+	}
+	return w.Flush()
+}
+
+// runAudit prints the history of a product from the audit files in a local
+// directory; it does not call the API. Each changed column is a row, and gaps
+// in the trail are shown where entries were dropped.
+func runAudit(args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "history" {
+		return errUsage
+	}
+	fs, opts := newFlagSet("audit history", defaultTimeout)
+	dir := fs.String("dir", envOr("AUDIT_DIR", "audit"), "directory of the audit files")
+	product := fs.Uint("product", 0, "product ID (required)")
+	source := fs.String("source", "", "only entries of this marketplace")
+	from := fs.String("from", "", "first day, YYYY-MM-DD")
+	to := fs.String("to", "", "last day, YYYY-MM-DD")
+	field := fs.String("field", "", "only changes of this column")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if *product == 0 {
+		fmt.Fprintln(fs.Output(), "--product is required")
+		return errUsage
+	}
+
+	q := audit.Query{ProductID: *product, Source: *source}
+	for _, day := range []struct {
+		value string
+		into  *time.Time
+		shift int
+	}{{*from, &q.From, 0}, {*to, &q.To, 1}} {
+		if day.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.DateOnly, day.value)
+		if err != nil {
+			fmt.Fprintf(fs.Output(), "invalid day %q\n", day.value)
+			return errUsage
+		}
+		*day.into = t.AddDate(0, 0, day.shift)
+	}
+
+	entries, err := audit.History(*dir, q)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		if *field != "" {
+			data, err := json.Marshal(audit.Fields(entries)[*field])
+			if err != nil {
+				return err
+			}
+			return printJSON(stdout, data)
+		}
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		return printJSON(stdout, data)
+	}
+
+	w := newTable(stdout)
+	fmt.Fprintln(w, "TIME\tSERVICE\tOP\tFIELD\tOLD\tNEW\tORIGIN")
+	for _, entry := range entries {
+		at := entry.Time.UTC().Format(time.RFC3339)
+		if entry.Op == audit.OpGap {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d entries dropped\t\t\t\n", at, entry.Service, entry.Op, entry.Dropped)
+			continue
+		}
+		if len(entry.Changes) == 0 && *field == "" {
+			fmt.Fprintf(w, "%s\t%s\t%s\t\t\t\t%s\n", at, entry.Service, entry.Op, formatOrigin(entry.Origin))
+			continue
+		}
+		columns := make([]string, 0, len(entry.Changes))
+		for column := range entry.Changes {
+			if *field == "" || column == *field {
+				columns = append(columns, column)
+			}
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			change := entry.Changes[column]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", at, entry.Service, entry.Op, column,
+				truncate(string(change.Old), 40), truncate(string(change.New), 40), formatOrigin(entry.Origin))
+		}
+	}
+	return w.Flush()
+}
+
+// formatOrigin formats the cause of an audit entry: the Kafka message and the
+// correlation ID, "-" when neither is known.
+func formatOrigin(origin audit.Origin) string {
+	var parts []string
+	if origin.Offset != nil {
+		parts = append(parts, fmt.Sprintf("%s/%d@%d", origin.Topic, origin.Partition, *origin.Offset))
+	}
+	if origin.CorrelationID != "" {
+		parts = append(parts, origin.CorrelationID)
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
+
+// newTable returns a writer that aligns tab separated columns.
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+}
+
+// printJSON writes a response body indented for reading.
+func printJSON(w io.Writer, data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		_, err = w.Write(data)
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// formatPrice formats an optional price, "-" when unknown.
+func formatPrice(price *float64) string {
+	if price == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(*price, 'f', 2, 64)
+}
+
+// formatPercent formats an optional signed percentage, "-" when unknown.
+func formatPercent(percent *float64) string {
+	if percent == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", *percent)
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
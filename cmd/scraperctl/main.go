@@ -0,0 +1,160 @@
+// Command scraperctl operates the scraper services from the terminal. It
+// calls the crawler HTTP API and prints human-readable tables, or the raw
+// JSON responses with --json.
+//
+// Usage:
+//
+//	scraperctl audit history --product N [--dir DIR] [--source S] [--from DAY] [--to DAY] [--field F]
+//	scraperctl crawl [--category N | --wc-start N --wc-end N] [--page-size N] [--mock] [--dry-run] [--batch-size N] [--detach]
+//	scraperctl favorites list --user N [--source S] [--sort biggest_drop] [--status S]
+//	scraperctl notify test --email ADDRESS --product N [--source S]
+//	scraperctl scheduler pause|resume|status
+//	scraperctl stats
+//
+// Every command accepts --api-url, --api-key, --token, --json and --timeout.
+// audit reads the audit files in a local directory instead of calling the API.
+//
+// Environment Variables:
+//   - SCRAPERCTL_API_URL: Crawler API base URL (default: http://localhost:8080)
+//   - SCRAPERCTL_API_KEY: Key sent as X-API-Key
+//   - SCRAPERCTL_TOKEN: Login token sent as a bearer token, needed for
+//     user endpoints such as favorites
+//   - AUDIT_DIR: Directory audit reads (default: audit)
+//
+// Exit status is 0 on success, 1 on API or network errors and 2 on usage errors.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1 // API or network error
+	exitUsage = 2 // Invalid command line
+)
+
+// errUsage marks command line errors; the message has already been printed
+var errUsage = errors.New("usage error")
+
+// options holds the flags shared by every command
+type options struct {
+	apiURL  string        // Crawler API base URL
+	apiKey  string        // Key sent as X-API-Key
+	token   string        // Login token sent in the Authorization header
+	json    bool          // Print raw JSON instead of tables
+	timeout time.Duration // HTTP client timeout
+}
+
+// command is a scraperctl subcommand
+type command struct {
+	usage string                                      // One-line usage shown in help
+	run   func(args []string, stdout io.Writer) error // Parses args and runs the command
+}
+
+// commands maps command names to their implementation
+var commands = map[string]command{
+	"audit":     {usage: "audit history --product N [--dir DIR] [--source S] [--from DAY] [--to DAY] [--field F]", run: runAudit},
+	"crawl":     {usage: "crawl [--category N | --wc-start N --wc-end N] [--page-size N] [--mock] [--dry-run] [--batch-size N] [--detach]", run: runCrawl},
+	"favorites": {usage: "favorites list --user N [--source S] [--sort biggest_drop] [--status S]", run: runFavorites},
+	"notify":    {usage: "notify test --email ADDRESS --product N [--source S]", run: runNotify},
+	"scheduler": {usage: "scheduler pause|resume|status", run: runScheduler},
+	"stats":     {usage: "stats", run: runStats},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run dispatches to the requested command and maps its error to an exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "scraperctl: unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return exitUsage
+	}
+
+	err := cmd.run(args[1:], stdout)
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(stderr, "usage: scraperctl %s\n", cmd.usage)
+		return exitUsage
+	default:
+		fmt.Fprintf(stderr, "scraperctl: %v\n", err)
+		return exitError
+	}
+}
+
+// printUsage lists every command.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: scraperctl <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, name := range []string{"audit", "crawl", "favorites", "notify", "scheduler", "stats"} {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "common flags: --api-url URL, --api-key KEY, --json, --timeout DURATION")
+}
+
+// newFlagSet creates a flag set for a command with the shared flags registered.
+//
+// Parameters:
+//   - name: Command name used in error messages
+//   - defaultTimeout: HTTP timeout when --timeout is not given
+//
+// Returns:
+//   - *flag.FlagSet: Flag set to register command flags on
+//   - *options: Shared options, filled in once the flag set is parsed
+func newFlagSet(name string, defaultTimeout time.Duration) (*flag.FlagSet, *options) {
+	opts := &options{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&opts.apiURL, "api-url", envOr("SCRAPERCTL_API_URL", "http://localhost:8080"), "crawler API base URL")
+	fs.StringVar(&opts.apiKey, "api-key", os.Getenv("SCRAPERCTL_API_KEY"), "API key sent as X-API-Key")
+	fs.StringVar(&opts.token, "token", os.Getenv("SCRAPERCTL_TOKEN"), "login token from POST /login, sent as a bearer token")
+	fs.BoolVar(&opts.json, "json", false, "print raw JSON responses")
+	fs.DurationVar(&opts.timeout, "timeout", defaultTimeout, "HTTP request timeout")
+	return fs, opts
+}
+
+// parseFlags parses args, reporting bad flags and stray arguments as usage errors.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected argument %q\n", fs.Arg(0))
+		return errUsage
+	}
+	return nil
+}
+
+// envOr returns the environment variable key, or fallback when it is unset.
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,87 @@
+// Package analysis implements the recording of product changes in the
+// optional audit trail
+package analysis
+
+import (
+	"scraper/internal/audit"
+	"scraper/internal/kafka"
+	"scraper/internal/models"
+)
+
+// auditor records product changes in the audit trail; nil when AUDIT_ENABLED
+// is off
+var auditor *audit.Auditor
+
+// auditSkipped are the columns every update writes, which would make every
+// sighting an audit entry
+var auditSkipped = []string{"last_seen_at", "updated_at"}
+
+// startAuditor starts the audit trail writer when it is enabled, see
+// audit.FromConfig.
+func startAuditor() {
+	auditor = audit.FromConfig("analysis")
+}
+
+// messageOrigin returns the origin of the changes made for a Kafka message.
+func messageOrigin(msg kafka.Message) audit.Origin {
+	offset := msg.Offset
+	return audit.Origin{
+		Topic:         msg.Topic,
+		Partition:     msg.Partition,
+		Offset:        &offset,
+		CorrelationID: msg.Headers[kafka.HeaderCorrelationID],
+	}
+}
+
+// auditCreate records a product stored for the first time.
+//
+// Parameters:
+//   - p: The created product
+//   - origin: What caused the change
+func auditCreate(p *models.Product, origin audit.Origin) {
+	if auditor == nil {
+		return
+	}
+	auditor.Record(audit.Entry{
+		Op:        audit.OpCreate,
+		ProductID: p.ID,
+		Source:    p.Source,
+		Changes:   audit.Diff(nil, productColumns(p)),
+		Origin:    origin,
+	})
+}
+
+// auditUpdate records the columns an update changed. Nothing is recorded when
+// it only stamped the sighting.
+//
+// Parameters:
+//   - existing: The product as stored before the update
+//   - fields: Columns the update wrote
+//   - origin: What caused the change
+func auditUpdate(existing *models.Product, fields map[string]interface{}, origin audit.Origin) {
+	if auditor == nil {
+		return
+	}
+	old := productColumns(existing)
+	old["deal_score"] = existing.DealScore
+	old["discontinued_at"] = existing.DiscontinuedAt
+	written := make(map[string]interface{}, len(fields))
+	for column, value := range fields {
+		written[column] = value
+	}
+	for _, column := range auditSkipped {
+		delete(written, column)
+	}
+
+	changes := audit.Diff(old, written)
+	if len(changes) == 0 {
+		return
+	}
+	auditor.Record(audit.Entry{
+		Op:        audit.OpUpdate,
+		ProductID: existing.ID,
+		Source:    existing.Source,
+		Changes:   changes,
+		Origin:    origin,
+	})
+}
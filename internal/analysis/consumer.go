@@ -2,160 +2,430 @@
 package analysis
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
+	"scraper/internal/audit"
+	"scraper/internal/events"
+	"scraper/internal/kafka"
+	"scraper/internal/metrics"
 	"scraper/internal/models"
+	"scraper/internal/pricing"
+	"scraper/internal/productdiff"
 )
 
 // handleProducts creates a message handler for processing product updates.
-// It analyzes incoming product data and determines whether products are:
+// It decodes the incoming batch, applies it to the database through
+// processProducts and forwards favorited products to the favorites service.
+//
+// Parameters:
+//   - db: Database connection for product operations
+//   - producer: Kafka producer for sending updates about favorited products
+//
+// Returns:
+//   - kafka.MessageHandler: Message handler function that processes product
+//     data. Malformed payloads are reported as fatal so they go to the DLQ.
+func handleProducts(db *gorm.DB, producer sarama.SyncProducer) kafka.MessageHandler {
+	return func(msg kafka.Message) error {
+		logrus.Info("Product Analysis Service received product data")
+		data := msg.Value
+
+		// Unmarshal incoming product data
+		var products []models.Product
+		if err := json.Unmarshal(data, &products); err != nil {
+			logrus.WithError(err).Error("Error unmarshaling products")
+			return kafka.Fatal(fmt.Errorf("invalid product batch: %w", err))
+		}
+		masks, err := payloadMasks(data, products)
+		if err != nil {
+			return kafka.Fatal(fmt.Errorf("invalid product batch: %w", err))
+		}
+		logrus.WithField("data", string(data)).Info("Received product data")
+
+		// Record how long the products took to reach this stage
+		for _, p := range products {
+			if p.FetchedAt != nil {
+				metrics.ObservePipelineLatency(metrics.StageAnalysis, *p.FetchedAt)
+			}
+		}
+
+		applyProducts(db, producer, products, masks, messageOrigin(msg))
+		return nil
+	}
+}
+
+// ApplyProducts stores products the way the consumer stores a batch read
+// from Kafka, for callers that received them some other way: the resync
+// endpoint and products submitted to the crawler's ingest endpoint. Price
+// changes on favorited products are forwarded to the favorites service and
+// seller, brand and back-in-stock watchers are notified. Every column of the
+// products is written.
+//
+// Parameters:
+//   - db: Database connection for product operations
+//   - producer: Kafka producer for forwarding favorited products
+//   - products: Products to create or update
+//   - origin: Request the products came from, for the audit trail
+func ApplyProducts(db *gorm.DB, producer sarama.SyncProducer, products []models.Product, origin audit.Origin) {
+	applyProducts(db, producer, products, nil, origin)
+}
+
+// applyProducts runs processProducts and acts on its result.
+func applyProducts(db *gorm.DB, producer sarama.SyncProducer, products []models.Product, masks []*updateMask, origin audit.Origin) {
+	result := processProducts(db, products, masks, origin)
+	forwardFavorited(producer, result.Favorited)
+	notifySellerWatchers(db, result)
+	notifyBackInStock(result.BackInStock)
+	recordBrandEvents(db, result)
+}
+
+// priceChange describes a price change detected while processing a product
+type priceChange struct {
+	Product  models.Product       // Product after the update
+	OldPrice float64              // Price stored before the update
+	NewPrice float64              // Incoming price
+	Changes  []productdiff.Change // What else changed; only set for favorited products
+}
+
+// processResult summarizes what processProducts found in a batch
+type processResult struct {
+	Favorited   []priceChange    // Price changes on favorited products to forward to the favorites service
+	NewProducts []models.Product // Products created for the first time
+	PriceDrops  []priceChange    // Existing products whose price decreased
+	BackInStock []backInStock    // Discontinued products listed again, with the users told they were gone
+}
+
+// processProducts analyzes incoming product data and determines whether products are:
 // 1. New products to be created
 // 2. Existing products that need updates
 // 3. Favorited products that need special handling
 // 4. Out-of-stock products that should be marked inactive
+// 5. Discontinued products that are listed again
 //
-// The handler performs the following steps for each product:
+// It performs the following steps for each product:
 // 1. Checks if the product exists in the database
 // 2. For new products:
 //   - Creates them in the database
-//   - Checks if they are favorited by any users
 // 3. For existing products:
 //   - Checks stock status and marks inactive if out of stock
-//   - Identifies if product is favorited and needs special handling
+//   - Clears the discontinued flag and notification history of reactivated products
 //   - Updates product details in the database
+//   - Records rating and review count changes in the rating history
+//   - Refreshes the deal score when the price changed
+//   - Records price changes on favorited products for the favorites service,
+//     with what else changed about them (see productdiff.Diff)
+//
+// Only the columns a product's payload carries are updated, see
+// payloadMasks; the rest keep their stored values, which the checks after
+// the update see too.
+//
+// Every creation and change is recorded in the audit trail when it is
+// enabled, with origin as its cause.
+//
+// Products are keyed on (ID, Source); a missing source means trendyol.
+// Every processed product has its LastSeenAt stamped with the current time
+// and is queued for the search index when indexing is enabled. Products the
+// product cache knows to be unchanged since the consumer last wrote them only
+// get LastSeenAt stamped, without the lookup, the diff or the index update.
+// This is the single upsert path shared by the Kafka consumer and the
+// on-demand resync endpoint.
 //
 // Parameters:
 //   - db: Database connection for product operations
-//   - producer: Kafka producer for sending updates about favorited products
+//   - products: Products to create or update
+//   - masks: Columns each product may change, in order; nil, or a nil
+//     entry, updates every column
+//   - origin: Message or request the products came from, for the audit trail
 //
 // Returns:
-//   - func([]byte): Message handler function that processes product data
-func handleProducts(db *gorm.DB, producer sarama.SyncProducer) func([]byte) {
-	return func(data []byte) {
-		logrus.Info("Product Analysis Service received product data")
+//   - processResult: Price changes on favorited products to forward plus new
+//     products and price drops detected in the batch
+func processProducts(db *gorm.DB, products []models.Product, masks []*updateMask, origin audit.Origin) processResult {
+	var result processResult
 
-		// Unmarshal incoming product data
-		var products []models.Product
-		if err := json.Unmarshal(data, &products); err != nil {
-			logrus.WithError(err).Error("Error unmarshaling products")
-			return
+	// Process each product
+	for i, p := range products {
+		var mask *updateMask
+		if i < len(masks) {
+			mask = masks[i]
+		}
+		now := time.Now()
+		p.LastSeenAt = &now
+		if p.Source == "" {
+			p.Source = models.SourceTrendyol
 		}
-		logrus.WithField("data", string(data)).Info("Received product data")
 
-		// Track products that are favorited for special handling
-		var favoritedProducts []models.Product
+		// A product the consumer wrote with the same fields only needs its
+		// sighting stamped
+		key := cacheKey{Source: p.Source, ID: p.ID}
+		var fields map[string]interface{}
+		var hash [sha256.Size]byte
+		var hashed bool
+		if cached, ok := knownProducts.get(key); ok {
+			fields = productUpdateFields(&p, mask)
+			hash, hashed = hashProductFields(fields)
+			if hashed && hash == cached.hash && touchUnchanged(db, key, cached, now) {
+				productCacheLookups.Inc("hit")
+				continue
+			}
+			productCacheLookups.Inc("stale")
+		} else if knownProducts != nil {
+			productCacheLookups.Inc("miss")
+		}
 
-		// Process each product
-		for _, p := range products {
-			var existing models.Product
-			result := db.First(&existing, p.ID)
-
-			// Handle new products
-			if result.Error != nil {
-				if result.Error == gorm.ErrRecordNotFound {
-					logrus.WithFields(logrus.Fields{
-						"name": p.Name,
-						"id":   p.ID,
-					}).Info("New product detected")
-
-					// Create new product
-					db.Create(&p)
-
-					// Check if new product is favorited
-					var favoriteCount int64
-					db.Model(&models.UserFavorite{}).Where("product_id = ?", p.ID).Count(&favoriteCount)
-					if favoriteCount > 0 && p.IsActive && p.IsFavorite {
-						favoritedProducts = append(favoritedProducts, p)
-					}
-				} else {
-					logrus.WithError(result.Error).Error("Error checking existing product")
-				}
-			} else {
-				// Handle existing products
+		var existing models.Product
+		err := db.Where("id = ? AND source = ?", p.ID, p.Source).First(&existing).Error
+		// A product merged into another one updates the product it was merged into
+		if err == gorm.ErrRecordNotFound {
+			if winnerID, ok := mergedInto(db, p.Source, p.ID); ok {
+				logrus.WithFields(logrus.Fields{
+					"id":        p.ID,
+					"winner_id": winnerID,
+				}).Info("Redirecting merged product")
+				p.ID = winnerID
+				key = cacheKey{Source: p.Source, ID: p.ID}
+				err = db.Where("id = ? AND source = ?", p.ID, p.Source).First(&existing).Error
+			}
+		}
+
+		// Handle new products
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
 				logrus.WithFields(logrus.Fields{
 					"name": p.Name,
 					"id":   p.ID,
-				}).Info("Existing product detected")
-
-				// Check stock status
-				var stockInfo map[string]interface{}
-				if err := json.Unmarshal(p.StockInfo, &stockInfo); err == nil {
-					if stock, ok := stockInfo["stock"].(float64); ok && stock == 0 {
-						logrus.WithFields(logrus.Fields{
-							"name": p.Name,
-							"id":   p.ID,
-						}).Info("Product out of stock, marking inactive")
-						p.IsActive = false
-					}
-				}
+				}).Info("New product detected")
 
-				// Check if product is favorited
-				isFavorited := false
-				if p.IsFavorite && p.IsActive {
-					var favoriteCount int64
-					db.Model(&models.UserFavorite{}).Where("product_id = ?", p.ID).Count(&favoriteCount)
-					if favoriteCount > 0 {
-						isFavorited = true
-						logrus.WithFields(logrus.Fields{
-							"name": p.Name,
-							"id":   p.ID,
-						}).Info("Favorited product, forwarding to Favorite Service")
-						favoritedProducts = append(favoritedProducts, p)
-					}
+				// Create new product; a deleted product keeps its row until it
+				// is purged, so crawling it again neither fails nor revives it.
+				// Nobody follows it locally yet, whatever Trendyol reports.
+				p.IsFavorite = false
+				created := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&p)
+				if err := created.Error; err != nil {
+					logrus.WithError(err).WithField("id", p.ID).Error("Error creating product")
+					continue
 				}
-
-				// Update regular products
-				if !isFavorited {
-					logrus.WithFields(logrus.Fields{
-						"name": p.Name,
-						"id":   p.ID,
-					}).Info("Regular product, updating in DB")
-					db.Model(&existing).Updates(map[string]interface{}{
-						"name":                p.Name,
-						"category_path":       p.CategoryPath,
-						"images":              p.Images,
-						"seller":              p.Seller,
-						"brand":               p.Brand,
-						"rating_score":        p.RatingScore,
-						"favorites_count":     p.FavoritesCount,
-						"views":               p.Views,
-						"orders":              p.Orders,
-						"stock_info":          p.StockInfo,
-						"price_info":          p.PriceInfo,
-						"attributes":          p.Attributes,
-						"is_active":           p.IsActive,
-						"is_favorite":         p.IsFavorite,
-						"comments_count":      p.CommentsCount,
-						"add_to_cart_events":  p.AddToCartEvents,
-						"size_recommendation": p.SizeRecommendation,
-						"estimated_delivery":  p.EstimatedDelivery,
-						"other_sellers":       p.OtherSellers,
-					})
+				if created.RowsAffected == 0 {
+					logrus.WithField("id", p.ID).Info("Skipping deleted product")
+					continue
 				}
+				result.NewProducts = append(result.NewProducts, p)
+				indexProduct(p.Source, p.ID)
+				auditCreate(&p, origin)
+			} else {
+				logrus.WithError(err).Error("Error checking existing product")
 			}
+			continue
 		}
 
-		if len(favoritedProducts) > 0 {
-			logrus.WithField("count", len(favoritedProducts)).Info("Forwarding favorited products to Favorite Service")
-			productsJSON, err := json.Marshal(favoritedProducts)
+		// Handle existing products
+		logrus.WithFields(logrus.Fields{
+			"name": p.Name,
+			"id":   p.ID,
+		}).Info("Existing product detected")
+
+		// Update product details in the database. IsFavorite tracks local
+		// followers and is kept; the crawled value is Trendyol's own flag.
+		p.IsFavorite = existing.IsFavorite
+		if fields == nil {
+			fields = productUpdateFields(&p, mask)
+			hash, hashed = hashProductFields(fields)
+		}
+		if mask != nil {
+			mergeUnwritten(&p, existing, fields)
+		}
+		fields["last_seen_at"] = p.LastSeenAt
+		fields["updated_at"] = now.Truncate(time.Microsecond) // Database precision, so the cache can match it
+
+		// Rate a new price against the product's recent prices; on failure
+		// the stored score is kept
+		if existing.Price != p.Price {
+			score, err := pricing.DealScore(db, p.ID, p.Source, p.Price)
 			if err != nil {
-				logrus.WithError(err).Error("Error marshaling favorited products")
+				logrus.WithError(err).WithField("id", p.ID).Error("Failed to compute deal score")
 			} else {
-				msg := &sarama.ProducerMessage{
-					Topic: "FAVORITE_PRODUCTS",
-					Value: sarama.ByteEncoder(productsJSON),
-				}
-				_, _, err := producer.SendMessage(msg)
-				if err != nil {
-					logrus.WithError(err).Error("Error sending favorited products to Kafka")
-				} else {
-					logrus.Info("Successfully forwarded favorited products")
-				}
+				fields["deal_score"] = score
+			}
+		}
+
+		// A discontinued product that is listed again may notify again later
+		reactivated := existing.DiscontinuedAt != nil && p.IsActive
+		if reactivated {
+			fields["discontinued_at"] = nil
+		}
+		// Compare ratings first: Updates copies the new values into existing
+		recordRatingChange(db, existing, p)
+		stored := existing
+		if err := db.Model(&existing).Updates(fields).Error; err != nil {
+			logrus.WithError(err).WithField("id", p.ID).Error("Error updating product")
+			knownProducts.remove(key)
+		} else {
+			auditUpdate(&stored, fields, origin)
+			if hashed {
+				knownProducts.put(key, cachedProduct{hash: hash, updatedAt: fields["updated_at"].(time.Time)})
+			}
+		}
+		indexProduct(p.Source, p.ID)
+		if reactivated {
+			if userIDs := clearDiscontinued(db, p); len(userIDs) > 0 {
+				result.BackInStock = append(result.BackInStock, backInStock{Product: p, UserIDs: userIDs})
 			}
 		}
+
+		// Track price decreases that pass the global minimum-drop floor
+		if pricing.IsSignificantDrop(existing.Price, p.Price) {
+			result.PriceDrops = append(result.PriceDrops, priceChange{Product: p, OldPrice: existing.Price, NewPrice: p.Price})
+		}
+
+		// Check if a favorited product changed price
+		if existing.IsFavorite && p.IsActive && existing.Price > 0 && existing.Price != p.Price {
+			var favoriteCount int64
+			db.Model(&models.UserFavorite{}).Where("product_id = ? AND source = ?", p.ID, p.Source).Count(&favoriteCount)
+			if favoriteCount > 0 {
+				logrus.WithFields(logrus.Fields{
+					"name": p.Name,
+					"id":   p.ID,
+				}).Info("Favorited product price changed, forwarding to Favorite Service")
+				result.Favorited = append(result.Favorited, priceChange{
+					Product:  p,
+					OldPrice: stored.Price,
+					NewPrice: p.Price,
+					Changes:  productdiff.Diff(stored, p),
+				})
+			}
+		}
+	}
+
+	return result
+}
+
+// mergedInto looks up the product a merged duplicate was merged into.
+//
+// Parameters:
+//   - db: Database connection
+//   - source: Marketplace of the product
+//   - id: ID of the product
+//
+// Returns:
+//   - uint: ID of the product it was merged into
+//   - bool: False if the product was not merged
+func mergedInto(db *gorm.DB, source string, id uint) (uint, bool) {
+	var product models.Product
+	err := db.Unscoped().Select("merged_into").
+		Where("id = ? AND source = ? AND merged_into IS NOT NULL", id, source).
+		Take(&product).Error
+	if err != nil || product.MergedInto == nil {
+		if err != nil && err != gorm.ErrRecordNotFound {
+			logrus.WithError(err).WithField("id", id).Error("Failed to look up merged product")
+		}
+		return 0, false
+	}
+	return *product.MergedInto, true
+}
+
+// productUpdateFields returns the columns processProducts writes for an
+// existing product, without the sighting time. A product reported out of
+// stock is marked inactive.
+//
+// Parameters:
+//   - p: Incoming product; IsActive is cleared when it is out of stock
+//   - mask: Columns the product's payload carries; nil for all
+//
+// Returns:
+//   - map[string]interface{}: Column values for Updates
+func productUpdateFields(p *models.Product, mask *updateMask) map[string]interface{} {
+	fields := productColumns(p)
+	for column, value := range fields {
+		if !mask.allows(column, value) {
+			delete(fields, column)
+		}
+	}
+
+	// Check stock status, if the update carries it
+	if _, ok := fields["stock_info"]; !ok {
+		return fields
+	}
+	var stockInfo map[string]interface{}
+	if err := json.Unmarshal(p.StockInfo, &stockInfo); err == nil {
+		if stock, ok := stockInfo["stock"].(float64); ok && stock == 0 {
+			logrus.WithFields(logrus.Fields{
+				"name": p.Name,
+				"id":   p.ID,
+			}).Info("Product out of stock, marking inactive")
+			p.IsActive = false
+			fields["is_active"] = false
+		}
+	}
+	return fields
+}
+
+// productColumns returns every column processProducts may write for an
+// existing product, with the product's values. is_favorite is left out: it
+// marks products with local followers and is maintained by the favorites
+// endpoints, not by crawls.
+func productColumns(p *models.Product) map[string]interface{} {
+	return map[string]interface{}{
+		"name":                p.Name,
+		"category_path":       p.CategoryPath,
+		"images":              p.Images,
+		"seller":              p.Seller,
+		"seller_id":           p.SellerID,
+		"brand":               p.Brand,
+		"brand_id":            p.BrandID,
+		"rating_score":        p.RatingScore,
+		"favorites_count":     p.FavoritesCount,
+		"views":               p.Views,
+		"orders":              p.Orders,
+		"stock_info":          p.StockInfo,
+		"price_info":          p.PriceInfo,
+		"price":               p.Price,
+		"attributes":          p.Attributes,
+		"is_active":           p.IsActive,
+		"comments_count":      p.CommentsCount,
+		"add_to_cart_events":  p.AddToCartEvents,
+		"size_recommendation": p.SizeRecommendation,
+		"estimated_delivery":  p.EstimatedDelivery,
+		"other_sellers":       p.OtherSellers,
+		"payload_truncated":   p.PayloadTruncated,
+	}
+}
+
+// forwardFavorited publishes a price_change event to the FAVORITE_PRODUCTS
+// topic for every favorited product whose price changed. The favorites
+// service resolves which users to notify.
+//
+// Parameters:
+//   - producer: Kafka producer
+//   - changes: Price changes to forward; nothing is sent if empty
+func forwardFavorited(producer sarama.SyncProducer, changes []priceChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	logrus.WithField("count", len(changes)).Info("Forwarding favorited product price changes to Favorite Service")
+	for _, change := range changes {
+		msg, err := events.NewPriceChangeMessage(events.PriceChange{
+			ProductID:   change.Product.ID,
+			Source:      change.Product.Source,
+			ProductName: change.Product.Name,
+			OldPrice:    change.OldPrice,
+			NewPrice:    change.NewPrice,
+			FetchedAt:   change.Product.FetchedAt,
+			Changes:     change.Changes,
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("product_id", change.Product.ID).Error("Error building price change event")
+			continue
+		}
+		if _, _, err := producer.SendMessage(msg); err != nil {
+			logrus.WithError(err).WithField("product_id", change.Product.ID).Error("Error sending price change to Kafka")
+		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,194 @@
+// Package analysis implements the last-seen job that marks vanished products
+// as discontinued and notifies the users who favorited them, and tells them
+// when the products are listed again
+package analysis
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/audit"
+	"scraper/internal/models"
+	"scraper/internal/proto"
+)
+
+// startLastSeenJob schedules the job that marks products as discontinued when
+// they have not been seen for PRODUCT_STALE_AFTER or their fetches returned
+// 404 at least DISCONTINUED_404_ATTEMPTS times.
+//
+// Environment Variables:
+//   - LAST_SEEN_CRON: Cron expression for the job (default: */15 * * * *)
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startLastSeenJob(db *gorm.DB) *cron.Cron {
+	spec := viper.GetString("LAST_SEEN_CRON")
+	if spec == "" {
+		spec = "*/15 * * * *" // Every 15 minutes
+	}
+
+	c := cron.New()
+	if _, err := c.AddFunc(spec, func() {
+		markDiscontinued(db)
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid last-seen cron expression")
+	}
+	c.Start()
+
+	logrus.WithField("schedule", spec).Info("Last-seen job scheduled")
+	return c
+}
+
+// markDiscontinued marks active products inactive when they:
+//  1. Have not been seen in a crawl for PRODUCT_STALE_AFTER, or
+//  2. Keep returning 404 from their marketplace
+//
+// Every user who favorited a newly discontinued product is sent a
+// "discontinued" notification. The notification service delivers it at most
+// once per (user, product) until the product is reactivated.
+//
+// Environment Variables:
+//   - PRODUCT_STALE_AFTER: How long a product may go unseen (default: 72h)
+//   - DISCONTINUED_404_ATTEMPTS: 404 responses before a product counts as
+//     discontinued (default: 3)
+//
+// Parameters:
+//   - db: Database connection
+func markDiscontinued(db *gorm.DB) {
+	staleAfter := viper.GetDuration("PRODUCT_STALE_AFTER")
+	if staleAfter <= 0 {
+		staleAfter = 72 * time.Hour
+	}
+	notFoundAttempts := viper.GetInt("DISCONTINUED_404_ATTEMPTS")
+	if notFoundAttempts <= 0 {
+		notFoundAttempts = 3
+	}
+
+	var products []models.Product
+	err := db.Where("is_active = ?", true).
+		Where("last_seen_at < ? OR EXISTS (SELECT 1 FROM fetch_retries r WHERE r.product_id = products.id AND r.product_source = products.source AND r.deleted_at IS NULL AND r.status_code = ? AND r.attempts >= ?)",
+			time.Now().Add(-staleAfter), http.StatusNotFound, notFoundAttempts).
+		Find(&products).Error
+	if err != nil {
+		logrus.WithError(err).Error("Failed to find discontinued products")
+		return
+	}
+
+	var items []*proto.NotificationRequest
+	for _, p := range products {
+		// Only the run that flips the flag notifies
+		now := time.Now()
+		result := db.Model(&models.Product{}).
+			Where("id = ? AND source = ? AND is_active = ?", p.ID, p.Source, true).
+			Updates(map[string]interface{}{"is_active": false, "discontinued_at": now})
+		if result.Error != nil {
+			logrus.WithError(result.Error).WithField("product_id", p.ID).Error("Failed to mark product discontinued")
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		knownProducts.remove(cacheKey{Source: p.Source, ID: p.ID})
+		indexProduct(p.Source, p.ID)
+		auditUpdate(&p, map[string]interface{}{"is_active": false, "discontinued_at": now}, audit.Origin{})
+		logrus.WithFields(logrus.Fields{
+			"product_id": p.ID,
+			"source":     p.Source,
+			"last_seen":  p.LastSeenAt,
+		}).Info("Product marked discontinued")
+
+		var userIDs []uint
+		if err := db.Model(&models.UserFavorite{}).Where("product_id = ? AND source = ?", p.ID, p.Source).Pluck("user_id", &userIDs).Error; err != nil {
+			logrus.WithError(err).WithField("product_id", p.ID).Error("Failed to find favorites")
+			continue
+		}
+		for _, userID := range userIDs {
+			items = append(items, &proto.NotificationRequest{
+				UserId:    fmt.Sprintf("%d", userID),
+				ProductId: uint64(p.ID),
+				Source:    p.Source,
+				Message:   fmt.Sprintf("%s appears to be discontinued", p.Name),
+				Type:      notificationTypeDiscontinued,
+			})
+		}
+	}
+
+	if len(items) > 0 {
+		logrus.WithField("count", len(items)).Info("Notifying users about discontinued products")
+		sendNotifications(items)
+	}
+}
+
+// backInStock is a discontinued product that is listed again
+type backInStock struct {
+	Product models.Product // The reactivated product
+	UserIDs []uint         // Users who were told the product was discontinued
+}
+
+// clearDiscontinued forgets the discontinued notifications sent for a product
+// that is listed again, so it can notify again if it disappears later. Only
+// the call that deletes the rows gets the users back, so two updates
+// reactivating the product at once do not both notify.
+//
+// Parameters:
+//   - db: Database connection
+//   - p: The reactivated product
+//
+// Returns:
+//   - []uint: Users who were told the product was discontinued
+func clearDiscontinued(db *gorm.DB, p models.Product) []uint {
+	var cleared []models.NotificationHistory
+	err := db.Clauses(clause.Returning{Columns: []clause.Column{{Name: "user_id"}}}).
+		Where("product_id = ? AND source = ? AND type = ?", p.ID, p.Source, notificationTypeDiscontinued).
+		Delete(&cleared).Error
+	if err != nil {
+		logrus.WithError(err).WithField("product_id", p.ID).Error("Failed to clear discontinued notifications")
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"product_id": p.ID,
+		"source":     p.Source,
+		"notified":   len(cleared),
+	}).Info("Discontinued product is listed again")
+
+	userIDs := make([]uint, len(cleared))
+	for i, row := range cleared {
+		userIDs[i] = row.UserID
+	}
+	return userIDs
+}
+
+// notifyBackInStock tells the users who were notified of a product's
+// discontinuation that it is listed again.
+//
+// Parameters:
+//   - products: Reactivated products with the users to notify
+func notifyBackInStock(products []backInStock) {
+	var items []*proto.NotificationRequest
+	for _, b := range products {
+		for _, userID := range b.UserIDs {
+			items = append(items, &proto.NotificationRequest{
+				UserId:    fmt.Sprintf("%d", userID),
+				ProductId: uint64(b.Product.ID),
+				Source:    b.Product.Source,
+				Message:   fmt.Sprintf("%s is available again", b.Product.Name),
+				Type:      notificationTypeBackInStock,
+			})
+		}
+	}
+
+	if len(items) > 0 {
+		logrus.WithField("count", len(items)).Info("Notifying users about products back in stock")
+		sendNotifications(items)
+	}
+}
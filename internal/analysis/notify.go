@@ -0,0 +1,65 @@
+// Package analysis implements notification dispatch for the analysis service
+package analysis
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"scraper/internal/proto"
+)
+
+// notifyTimeout bounds a single batch call to the notification service
+const notifyTimeout = time.Minute
+
+// notificationClient is the shared notification service client, set by Start
+// or SetNotificationClient
+var notificationClient proto.NotificationServiceClient
+
+// SetNotificationClient sets the client watcher notifications are sent
+// through, for processes that call ApplyProducts without running the
+// analysis service.
+//
+// Parameters:
+//   - client: Client for the notification service
+func SetNotificationClient(client proto.NotificationServiceClient) {
+	notificationClient = client
+}
+
+// sendNotifications delivers a batch of notifications through the
+// notification service's SendNotifications RPC. Failures are logged; the
+// analysis consumer never blocks on notification delivery.
+//
+// Parameters:
+//   - items: Notifications to send
+func sendNotifications(items []*proto.NotificationRequest) {
+	if len(items) == 0 {
+		return
+	}
+	if notificationClient == nil {
+		logrus.WithField("count", len(items)).Error("Notification client not initialized")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	resp, err := notificationClient.SendNotifications(ctx, &proto.BatchNotificationRequest{Items: items})
+	if err != nil {
+		logrus.WithError(err).WithField("count", len(items)).Error("Failed to send notifications")
+		return
+	}
+
+	for _, result := range resp.Results {
+		if !result.Success && int(result.Index) < len(items) {
+			item := items[result.Index]
+			logrus.WithFields(logrus.Fields{
+				"user_id":    item.UserId,
+				"product_id": item.ProductId,
+				"type":       item.Type,
+				"reason":     result.Error,
+			}).Warn("Notification was not delivered")
+		}
+	}
+}
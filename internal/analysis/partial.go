@@ -0,0 +1,152 @@
+// Package analysis implements partial product updates: the columns a product
+// message may change, so a payload carrying only some fields cannot wipe the
+// others
+package analysis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/gorm/schema"
+
+	"scraper/internal/models"
+)
+
+// productSchema is the parsed gorm schema of models.Product, used to map
+// payload fields to columns and to copy columns between products
+var productSchema = sync.OnceValues(func() (*schema.Schema, error) {
+	return schema.Parse(&models.Product{}, &sync.Map{}, schema.NamingStrategy{})
+})
+
+// updateMask selects the columns a product message may change. A nil mask
+// allows every column, for full products such as a resync's.
+type updateMask struct {
+	columns  map[string]bool // Columns the payload carries
+	explicit bool            // Listed in UpdatedFields, so zero values are written too
+}
+
+// allows reports whether a column is written with the given value. Without
+// an explicit list a zero value counts as missing: producers that encode a
+// whole models.Product send empty strings, zero numbers and null JSON for
+// the fields they did not set. Booleans are written whenever present, since
+// false is a real value.
+func (m *updateMask) allows(column string, value interface{}) bool {
+	if m == nil {
+		return true
+	}
+	if !m.columns[column] {
+		return false
+	}
+	return m.explicit || !isZeroValue(value)
+}
+
+// isZeroValue reports whether a column value is the zero value of its type.
+func isZeroValue(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return v == ""
+	case uint:
+		return v == 0
+	case float64:
+		return v == 0
+	case datatypes.JSON:
+		trimmed := bytes.TrimSpace(v)
+		return len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null"))
+	}
+	return false
+}
+
+// productColumn returns the column of a product field, accepting the Go
+// field name in any case or the column name itself.
+func productColumn(name string) (string, bool) {
+	s, err := productSchema()
+	if err != nil {
+		return "", false
+	}
+	normalized := strings.ToLower(strings.ReplaceAll(name, "_", ""))
+	for _, field := range s.Fields {
+		if field.DBName != "" && strings.ToLower(field.Name) == normalized {
+			return field.DBName, true
+		}
+	}
+	return "", false
+}
+
+// payloadMasks works out which columns each product of a message carries.
+// A product listing its fields in UpdatedFields changes exactly those;
+// otherwise the fields present in the payload with a non-null value count.
+//
+// Parameters:
+//   - data: The message, a JSON array of products
+//   - products: The products decoded from it
+//
+// Returns:
+//   - []*updateMask: Mask of each product, in order
+//   - error: If the message is not an array of objects
+func payloadMasks(data []byte, products []models.Product) ([]*updateMask, error) {
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	masks := make([]*updateMask, len(products))
+	for i, p := range products {
+		mask := &updateMask{columns: make(map[string]bool), explicit: len(p.UpdatedFields) > 0}
+		if mask.explicit {
+			for _, name := range p.UpdatedFields {
+				column, ok := productColumn(name)
+				if !ok {
+					logrus.WithFields(logrus.Fields{"id": p.ID, "field": name}).Warn("Ignoring unknown field in UpdatedFields")
+					continue
+				}
+				mask.columns[column] = true
+			}
+		} else if i < len(raw) {
+			for key, value := range raw[i] {
+				if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+					continue
+				}
+				if column, ok := productColumn(key); ok {
+					mask.columns[column] = true
+				}
+			}
+		}
+		masks[i] = mask
+	}
+	return masks, nil
+}
+
+// mergeUnwritten copies the columns an update leaves alone from the stored
+// product into the incoming one, so the price, rating and notification
+// checks after the update see the product as stored.
+//
+// Parameters:
+//   - p: Incoming product, completed in place
+//   - existing: The stored product
+//   - fields: Columns the update writes
+func mergeUnwritten(p *models.Product, existing models.Product, fields map[string]interface{}) {
+	s, err := productSchema()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse product schema")
+		return
+	}
+	target := reflect.ValueOf(p).Elem()
+	for column, value := range productColumns(&existing) {
+		if _, written := fields[column]; written {
+			continue
+		}
+		field := s.LookUpField(column)
+		if field == nil {
+			continue
+		}
+		if err := field.Set(context.Background(), target, value); err != nil {
+			logrus.WithError(err).WithField("column", column).Error("Failed to merge stored product column")
+		}
+	}
+}
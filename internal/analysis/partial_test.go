@@ -0,0 +1,150 @@
+package analysis
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"gorm.io/datatypes"
+
+	"scraper/internal/models"
+)
+
+// storedProduct returns a product with every updatable column populated.
+func storedProduct() models.Product {
+	return models.Product{
+		ID:                 1,
+		Source:             models.SourceTrendyol,
+		Name:               "Stored name",
+		CategoryPath:       "Home/Kitchen",
+		Images:             datatypes.JSON(`["a.jpg","b.jpg"]`),
+		Seller:             datatypes.JSON(`{"name":"Seller"}`),
+		SellerID:           10,
+		Brand:              datatypes.JSON(`{"name":"Brand"}`),
+		BrandID:            20,
+		RatingScore:        datatypes.JSON(`{"averageRating":4.5,"totalCount":12}`),
+		FavoritesCount:     "100",
+		Views:              "1000",
+		Orders:             "50",
+		StockInfo:          datatypes.JSON(`{"stock":5}`),
+		PriceInfo:          datatypes.JSON(`{"price":50}`),
+		Price:              50,
+		Attributes:         datatypes.JSON(`[{"key":"Color","value":"Red"}]`),
+		IsActive:           true,
+		IsFavorite:         true,
+		CommentsCount:      "12",
+		AddToCartEvents:    "30",
+		SizeRecommendation: "True to size",
+		EstimatedDelivery:  datatypes.JSON(`{"days":2}`),
+		OtherSellers:       datatypes.JSON(`[{"id":2}]`),
+	}
+}
+
+// applyPayload runs a message through the masks and the update fields the
+// way processProducts does, returning the written columns and the product
+// the checks after the update see.
+func applyPayload(t *testing.T, payload string) (map[string]interface{}, models.Product) {
+	t.Helper()
+	var products []models.Product
+	if err := json.Unmarshal([]byte(payload), &products); err != nil {
+		t.Fatal(err)
+	}
+	masks, err := payloadMasks([]byte(payload), products)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := products[0]
+	p.Source = models.SourceTrendyol
+	fields := productUpdateFields(&p, masks[0])
+	mergeUnwritten(&p, storedProduct(), fields)
+	return fields, p
+}
+
+func columnsOf(fields map[string]interface{}) []string {
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func TestMinimalPayloadOnlyUpdatesItsFields(t *testing.T) {
+	full, err := json.Marshal([]models.Product{{ID: 1, Price: 45, PriceInfo: datatypes.JSON(`{"price":45}`), UpdatedFields: []string{"Price", "price_info"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, payload := range map[string]string{
+		"omitted fields":       `[{"ID": 1, "Price": 45, "PriceInfo": {"price":45}}]`,
+		"null fields":          `[{"ID": 1, "Name": null, "Images": null, "Price": 45, "PriceInfo": {"price":45}}]`,
+		"encoded with a mask":  string(full),
+		"lower-case JSON keys": `[{"id": 1, "price": 45, "priceInfo": {"price":45}}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fields, merged := applyPayload(t, payload)
+			if got, want := columnsOf(fields), []string{"price", "price_info"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("written columns = %v, want %v", got, want)
+			}
+
+			want := storedProduct()
+			want.Price = 45
+			want.PriceInfo = datatypes.JSON(`{"price":45}`)
+			if got, want := productColumns(&merged), productColumns(&want); !reflect.DeepEqual(got, want) {
+				t.Errorf("merged product = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPartialPayloadSkipsZeroValues(t *testing.T) {
+	fields, merged := applyPayload(t, `[{"ID": 1, "Name": "", "SellerID": 0, "Images": [], "IsActive": false, "Price": 45}]`)
+	// Empty arrays and booleans are values; empty strings and zero numbers
+	// are what producers send for fields they did not set
+	if got, want := columnsOf(fields), []string{"images", "is_active", "price"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written columns = %v, want %v", got, want)
+	}
+	if merged.Name != "Stored name" || merged.SellerID != 10 {
+		t.Errorf("zero values overwrote the stored product: %+v", merged)
+	}
+}
+
+func TestExplicitMaskWritesZeroValues(t *testing.T) {
+	fields, _ := applyPayload(t, `[{"ID": 1, "Orders": "", "UpdatedFields": ["Orders", "NoSuchField"]}]`)
+	if got, want := columnsOf(fields), []string{"orders"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written columns = %v, want %v", got, want)
+	}
+}
+
+func TestPartialStockUpdateDeactivates(t *testing.T) {
+	fields, merged := applyPayload(t, `[{"ID": 1, "StockInfo": {"stock": 0}}]`)
+	if got, want := columnsOf(fields), []string{"is_active", "stock_info"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written columns = %v, want %v", got, want)
+	}
+	if merged.IsActive || merged.Price != 50 {
+		t.Errorf("merged product: is_active %v, price %v; want false, 50", merged.IsActive, merged.Price)
+	}
+}
+
+func TestFullProductUpdatesEveryColumn(t *testing.T) {
+	stored := storedProduct()
+	fields := productUpdateFields(&stored, nil)
+	if got, want := len(fields), len(productColumns(&stored)); got != want {
+		t.Errorf("full product writes %d columns, want %d", got, want)
+	}
+}
+
+func TestCrawlDoesNotWriteLocalFavoriteFlag(t *testing.T) {
+	// Trendyol's isPeopleLikeThisProduct arrives as IsFavorite; it must not
+	// replace the flag the favorites endpoints keep for local followers
+	crawled := storedProduct()
+	crawled.IsFavorite = false
+	if _, written := productUpdateFields(&crawled, nil)["is_favorite"]; written {
+		t.Error("a full crawl writes is_favorite")
+	}
+	fields, _ := applyPayload(t, `[{"ID": 1, "IsFavorite": true, "Price": 45}]`)
+	if _, written := fields["is_favorite"]; written {
+		t.Error("a partial payload writes is_favorite")
+	}
+}
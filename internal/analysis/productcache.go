@@ -0,0 +1,175 @@
+// Package analysis implements the product cache of the analysis consumer
+package analysis
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/metrics"
+	"scraper/internal/models"
+)
+
+// productCacheLookups counts how processProducts resolved existing products
+var productCacheLookups = metrics.NewCounter(
+	"analysis_product_cache_total",
+	"Product lookups of the analysis consumer by result (hit, miss, stale)",
+	"result",
+)
+
+// knownProducts caches the products the consumer last wrote; nil when
+// disabled
+var knownProducts *productCache
+
+// cacheKey identifies a product across marketplaces
+type cacheKey struct {
+	Source string
+	ID     uint
+}
+
+// cachedProduct is what the consumer last wrote for a product
+type cachedProduct struct {
+	hash      [sha256.Size]byte // Hash of the written fields, see hashProductFields
+	updatedAt time.Time         // updated_at written with them, at database precision
+}
+
+// cacheItem is an element of the LRU list
+type cacheItem struct {
+	key   cacheKey
+	value cachedProduct
+}
+
+// productCache is a size-bounded LRU cache of the products the consumer
+// wrote. It is safe for concurrent use by the consumer's partition workers.
+type productCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Most recently used first
+	entries map[cacheKey]*list.Element
+}
+
+// newProductCache creates a cache holding at most size products.
+func newProductCache(size int) *productCache {
+	return &productCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[cacheKey]*list.Element, size),
+	}
+}
+
+// get returns the cached product and marks it recently used.
+func (c *productCache) get(key cacheKey) (cachedProduct, bool) {
+	if c == nil {
+		return cachedProduct{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return cachedProduct{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheItem).value, true
+}
+
+// put stores a product, evicting the least recently used one when full.
+func (c *productCache) put(key cacheKey, value cachedProduct) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheItem).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheItem{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheItem).key)
+	}
+}
+
+// remove drops a product, so its next lookup goes to the database.
+func (c *productCache) remove(key cacheKey) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// startProductCache enables the product cache unless it is switched off.
+//
+// Environment Variables:
+//   - PRODUCT_CACHE_ENABLED: Cache the products the consumer wrote (default: true)
+//   - PRODUCT_CACHE_SIZE: Products cached at most (default: 10000)
+func startProductCache() {
+	if viper.IsSet("PRODUCT_CACHE_ENABLED") && !viper.GetBool("PRODUCT_CACHE_ENABLED") {
+		logrus.Info("Product cache disabled")
+		return
+	}
+	size := viper.GetInt("PRODUCT_CACHE_SIZE")
+	if size <= 0 {
+		size = 10000
+	}
+	knownProducts = newProductCache(size)
+	logrus.WithField("size", size).Info("Product cache enabled")
+}
+
+// hashProductFields hashes the fields processProducts writes for a product,
+// without the ones that change on every sighting.
+//
+// Returns:
+//   - [sha256.Size]byte: The hash
+//   - bool: False if the fields cannot be encoded
+func hashProductFields(fields map[string]interface{}) ([sha256.Size]byte, bool) {
+	data, err := json.Marshal(fields) // Map keys are sorted, so equal fields encode equally
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256(data), true
+}
+
+// touchUnchanged handles a product the consumer wrote before with the same
+// fields, skipping the lookup and diff. It stamps last_seen_at and updated_at
+// in one statement that only matches while the row still carries the
+// updated_at the consumer wrote, so changes by other writers, such as the
+// last-seen job or another service, are never overwritten.
+//
+// Parameters:
+//   - db: Database connection
+//   - key: The product
+//   - cached: What the consumer last wrote for it
+//   - now: When the product was seen
+//
+// Returns:
+//   - bool: False if the row changed since and needs the full update path
+func touchUnchanged(db *gorm.DB, key cacheKey, cached cachedProduct, now time.Time) bool {
+	updatedAt := now.Truncate(time.Microsecond)
+	result := db.Session(&gorm.Session{SkipDefaultTransaction: true}).
+		Model(&models.Product{}).
+		Where("id = ? AND source = ? AND updated_at = ?", key.ID, key.Source, cached.updatedAt).
+		UpdateColumns(map[string]interface{}{"last_seen_at": now, "updated_at": updatedAt})
+	if result.Error != nil || result.RowsAffected == 0 {
+		if result.Error != nil {
+			logrus.WithError(result.Error).WithField("id", key.ID).Warn("Failed to touch cached product")
+		}
+		knownProducts.remove(key)
+		return false
+	}
+	knownProducts.put(key, cachedProduct{hash: cached.hash, updatedAt: updatedAt})
+	return true
+}
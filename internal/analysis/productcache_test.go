@@ -0,0 +1,194 @@
+package analysis
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"scraper/internal/audit"
+	"scraper/internal/models"
+)
+
+// replayPrice is the price of every replayed product, so the replay never
+// takes the price change paths
+const replayPrice = 100
+
+// roundTrips counts the statements sent to the fake database
+var roundTrips atomic.Int64
+
+func init() {
+	sql.Register("roundtrips", countingDriver{})
+}
+
+// countingDriver is a database/sql driver that answers every statement
+// without a database and counts the round trips. Product lookups return an
+// existing product built from the query arguments and every write affects
+// one row.
+type countingDriver struct{}
+
+func (countingDriver) Open(string) (driver.Conn, error) { return countingConn{}, nil }
+
+type countingConn struct{}
+
+func (countingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepared statements are not supported")
+}
+
+func (countingConn) Close() error { return nil }
+
+func (countingConn) Begin() (driver.Tx, error) {
+	roundTrips.Add(1)
+	return countingTx{}, nil
+}
+
+func (countingConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	roundTrips.Add(1)
+	return driver.RowsAffected(1), nil
+}
+
+func (countingConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	roundTrips.Add(1)
+	if !strings.HasPrefix(query, "SELECT") || len(args) < 2 {
+		return &productRows{}, nil
+	}
+	return &productRows{row: []driver.Value{args[0].Value, args[1].Value, float64(replayPrice), true, time.Now()}}, nil
+}
+
+type countingTx struct{}
+
+func (countingTx) Commit() error {
+	roundTrips.Add(1)
+	return nil
+}
+
+func (countingTx) Rollback() error {
+	roundTrips.Add(1)
+	return nil
+}
+
+// productRows returns at most one product row
+type productRows struct {
+	row  []driver.Value
+	done bool
+}
+
+func (r *productRows) Columns() []string {
+	return []string{"id", "source", "price", "is_active", "updated_at"}
+}
+
+func (r *productRows) Close() error { return nil }
+
+func (r *productRows) Next(dest []driver.Value) error {
+	if r.row == nil || r.done {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.done = true
+	return nil
+}
+
+// openCountingDB opens a gorm connection to the counting driver.
+func openCountingDB(tb testing.TB) *gorm.DB {
+	tb.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DriverName: "roundtrips"}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// replayBatch returns a crawl of n unchanged products.
+func replayBatch(n int) []models.Product {
+	products := make([]models.Product, n)
+	for i := range products {
+		products[i] = models.Product{
+			ID:        uint(i + 1),
+			Source:    models.SourceTrendyol,
+			Name:      fmt.Sprintf("Product %d", i+1),
+			Price:     replayPrice,
+			IsActive:  true,
+			StockInfo: datatypes.JSON(`{"stock": 10}`),
+		}
+	}
+	return products
+}
+
+// BenchmarkReplay compares the database round trips of replaying 1,000
+// unchanged products with and without the product cache.
+func BenchmarkReplay(b *testing.B) {
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(io.Discard)
+	defer func(cache *productCache) { knownProducts = cache }(knownProducts)
+
+	db := openCountingDB(b)
+	products := replayBatch(1000)
+
+	for _, bc := range []struct {
+		name  string
+		cache *productCache
+	}{
+		{"without_cache", nil},
+		{"with_cache", newProductCache(len(products))},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			knownProducts = bc.cache
+			processProducts(db, products, nil, audit.Origin{}) // Warm the cache
+
+			roundTrips.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				processProducts(db, products, nil, audit.Origin{})
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(roundTrips.Load())/float64(b.N), "roundtrips/op")
+		})
+	}
+}
+
+func TestProductCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newProductCache(2)
+	first, second, third := cacheKey{"trendyol", 1}, cacheKey{"trendyol", 2}, cacheKey{"trendyol", 3}
+	cache.put(first, cachedProduct{})
+	cache.put(second, cachedProduct{})
+	cache.get(first) // Now second is the least recently used
+	cache.put(third, cachedProduct{})
+
+	if _, ok := cache.get(second); ok {
+		t.Error("least recently used product was not evicted")
+	}
+	for _, key := range []cacheKey{first, third} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("product %d was evicted", key.ID)
+		}
+	}
+}
+
+func TestProductCacheRemove(t *testing.T) {
+	cache := newProductCache(2)
+	key := cacheKey{"trendyol", 1}
+	cache.put(key, cachedProduct{})
+	cache.remove(key)
+	if _, ok := cache.get(key); ok {
+		t.Error("removed product is still cached")
+	}
+}
+
+func TestDisabledProductCache(t *testing.T) {
+	var cache *productCache
+	cache.put(cacheKey{"trendyol", 1}, cachedProduct{})
+	if _, ok := cache.get(cacheKey{"trendyol", 1}); ok {
+		t.Error("disabled cache returned a product")
+	}
+}
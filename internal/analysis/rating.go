@@ -0,0 +1,88 @@
+// Package analysis implements rating and review count change tracking
+package analysis
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+// ratingStats holds the tracked fields of a product's RatingScore
+type ratingStats struct {
+	AverageRating float64 `json:"averageRating"`
+	CommentCount  int     `json:"commentCount"`
+}
+
+// parseRating decodes a RatingScore column.
+//
+// Returns:
+//   - ratingStats: The decoded rating
+//   - bool: False if the product carries no rating
+func parseRating(raw datatypes.JSON) (ratingStats, bool) {
+	var stats ratingStats
+	if len(raw) == 0 || json.Unmarshal(raw, &stats) != nil {
+		return ratingStats{}, false
+	}
+	return stats, true
+}
+
+// ratingEpsilon returns the smallest change of the average rating that is
+// recorded.
+//
+// Environment Variables:
+//   - RATING_CHANGE_EPSILON: Minimum average rating change (default: 0.01)
+func ratingEpsilon() float64 {
+	if epsilon := viper.GetFloat64("RATING_CHANGE_EPSILON"); epsilon > 0 {
+		return epsilon
+	}
+	return 0.01
+}
+
+// recordRatingChange logs a change of the average rating or review count
+// between the stored and the incoming copy of a product. Average changes
+// smaller than RATING_CHANGE_EPSILON are treated as floating-point drift and
+// ignored unless the review count changed too. Nothing is logged when either
+// copy has no rating, since there is nothing to compare.
+//
+// Parameters:
+//   - db: Database connection
+//   - existing: Product as stored before the update
+//   - incoming: Product being applied
+func recordRatingChange(db *gorm.DB, existing, incoming models.Product) {
+	before, ok := parseRating(existing.RatingScore)
+	if !ok {
+		return
+	}
+	after, ok := parseRating(incoming.RatingScore)
+	if !ok {
+		return
+	}
+
+	averageChanged := math.Abs(after.AverageRating-before.AverageRating) >= ratingEpsilon()
+	if !averageChanged && after.CommentCount == before.CommentCount {
+		return
+	}
+
+	entry := models.RatingLog{
+		ProductID:       incoming.ID,
+		Source:          incoming.Source,
+		OldAverage:      before.AverageRating,
+		NewAverage:      after.AverageRating,
+		OldCommentCount: before.CommentCount,
+		NewCommentCount: after.CommentCount,
+		ChangeTime:      time.Now(),
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"product_id": incoming.ID,
+			"source":     incoming.Source,
+		}).Error("Failed to record rating change")
+	}
+}
@@ -0,0 +1,232 @@
+// Package analysis implements the on-demand product resync endpoint
+package analysis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/audit"
+	"scraper/internal/models"
+	"scraper/internal/proto"
+	"scraper/pkg/httpclient"
+)
+
+// resyncTimeout bounds the crawler GetProduct call made during a resync
+const resyncTimeout = 30 * time.Second
+
+// crawlerGRPCAddr returns the address the analysis service reaches the
+// crawler's gRPC server at.
+//
+// Environment Variables:
+//   - CRAWLER_GRPC_ADDR: host:port of the crawler gRPC server
+//     (default: localhost:$CRAWLER_GRPC_PORT)
+//   - CRAWLER_GRPC_PORT: Crawler gRPC port (default: 8081)
+func crawlerGRPCAddr() string {
+	if addr := viper.GetString("CRAWLER_GRPC_ADDR"); addr != "" {
+		return addr
+	}
+	if port := viper.GetString("CRAWLER_GRPC_PORT"); port != "" {
+		return "localhost:" + port
+	}
+	return "localhost:8081"
+}
+
+// dialCrawler creates the long-lived connection resyncs call the crawler
+// through. It connects lazily and gRPC re-establishes it after failures, so a
+// crawler that is down only fails the resyncs made meanwhile.
+//
+// Returns:
+//   - *grpc.ClientConn: Connection shared by all resyncs; close it on shutdown
+//   - error: If the target address is invalid
+func dialCrawler() (*grpc.ClientConn, error) {
+	addr := crawlerGRPCAddr()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid crawler service address %q: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// fieldChange describes how a single product field changed during a resync
+type fieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// handleResync creates the POST /products/:id/resync handler. It refetches a
+// product end to end and reconciles the stored copy:
+//  1. Loads the current database row (if any)
+//  2. Calls the crawler's GetProduct gRPC with force_refresh
+//  3. Upserts the fresh product through processProducts, which also resets
+//     LastSeenAt and reactivates products that are back in stock
+//  4. Records any price/stock change in the price history log
+//  5. Returns a diff of the changed fields
+//
+// The optional source query parameter selects the product's marketplace
+// (default: trendyol).
+//
+// Parameters:
+//   - db: Database connection for product operations
+//   - producer: Kafka producer for forwarding favorited products
+//   - crawler: Crawler client shared by all resyncs, see dialCrawler
+//
+// Returns:
+//   - echo.HandlerFunc: The resync handler
+func handleResync(db *gorm.DB, producer sarama.SyncProducer, crawler proto.CrawlerServiceClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Parse and validate product ID from URL
+		id, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			logrus.WithError(err).Error("Invalid product ID")
+			return apierror.Invalid("Invalid product ID")
+		}
+
+		source := c.QueryParam("source")
+		if source == "" {
+			source = models.SourceTrendyol
+		}
+
+		// Load current state before the resync
+		var before *models.Product
+		var existing models.Product
+		if err := db.Where("id = ? AND source = ?", id, source).First(&existing).Error; err == nil {
+			before = &existing
+		} else if err != gorm.ErrRecordNotFound {
+			return apierror.Internal("Failed to load product", err)
+		}
+
+		// Ask the crawler for a fresh copy of the product
+		ctx, cancel := context.WithTimeout(c.Request().Context(), resyncTimeout)
+		defer cancel()
+		resp, err := crawler.GetProduct(ctx, &proto.GetProductRequest{
+			ProductId:    uint64(id),
+			ForceRefresh: true,
+			Source:       source,
+		})
+		if code := status.Code(err); code == codes.InvalidArgument || code == codes.ResourceExhausted {
+			// Mapped to validation_failed and rate_limited with the crawler's message
+			return err
+		}
+		if err != nil {
+			return apierror.Upstream("Failed to refetch product", err)
+		}
+
+		var fresh models.Product
+		if err := json.Unmarshal(resp.Product, &fresh); err != nil {
+			return apierror.Upstream("Invalid product returned by crawler", err)
+		}
+
+		// Upsert through the shared analysis path
+		origin := audit.Origin{CorrelationID: c.Request().Header.Get(httpclient.HeaderCorrelationID)}
+		ApplyProducts(db, producer, []models.Product{fresh}, origin)
+
+		// Reload the stored product to compute the diff
+		var after models.Product
+		if err := db.Where("id = ? AND source = ?", id, source).First(&after).Error; err != nil {
+			return apierror.Internal("Failed to reload product", err)
+		}
+
+		// Record price/stock changes in the history log
+		if before != nil {
+			oldStock, _ := stockQuantity(before)
+			newStock, stockKnown := stockQuantity(&after)
+			if before.Price != after.Price || oldStock != newStock {
+				priceLog := models.PriceStockLog{
+					ProductID:  after.ID,
+					Source:     after.Source,
+					OldPrice:   fmt.Sprintf("%.2f", before.Price),
+					NewPrice:   fmt.Sprintf("%.2f", after.Price),
+					OldStock:   fmt.Sprintf("%.0f", oldStock),
+					NewStock:   fmt.Sprintf("%.0f", newStock),
+					PriceValue: &after.Price,
+					ChangeTime: time.Now(),
+				}
+				if stockKnown {
+					priceLog.StockValue = &newStock
+				}
+				if err := db.Create(&priceLog).Error; err != nil {
+					logrus.WithError(err).Error("Failed to create price log")
+				}
+			}
+		}
+
+		logrus.WithFields(logrus.Fields{"product_id": id, "source": source}).Info("Product resynced")
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"product_id": after.ID,
+			"source":     after.Source,
+			"created":    before == nil,
+			"changes":    diffProducts(before, &after),
+		})
+	}
+}
+
+// productFields returns the reconciled fields of a product keyed by name.
+// A nil product yields nil values so new products diff against nothing.
+func productFields(p *models.Product) map[string]interface{} {
+	fields := map[string]interface{}{
+		"name":          nil,
+		"category_path": nil,
+		"price":         nil,
+		"stock":         nil,
+		"is_active":     nil,
+		"is_favorite":   nil,
+		"last_seen_at":  nil,
+	}
+	if p == nil {
+		return fields
+	}
+	fields["name"] = p.Name
+	fields["category_path"] = p.CategoryPath
+	fields["price"] = p.Price
+	if stock, ok := stockQuantity(p); ok {
+		fields["stock"] = stock
+	}
+	fields["is_active"] = p.IsActive
+	fields["is_favorite"] = p.IsFavorite
+	if p.LastSeenAt != nil {
+		fields["last_seen_at"] = p.LastSeenAt.UTC().Format(time.RFC3339)
+	}
+	return fields
+}
+
+// diffProducts returns the fields whose values differ between two products.
+func diffProducts(before, after *models.Product) map[string]fieldChange {
+	oldFields := productFields(before)
+	newFields := productFields(after)
+
+	changes := make(map[string]fieldChange)
+	for name, newValue := range newFields {
+		if oldValue := oldFields[name]; oldValue != newValue {
+			changes[name] = fieldChange{Before: oldValue, After: newValue}
+		}
+	}
+	return changes
+}
+
+// stockQuantity extracts the stock quantity from a product's StockInfo JSON.
+//
+// Returns:
+//   - float64: Stock quantity
+//   - bool: false if the stock information is missing or malformed
+func stockQuantity(p *models.Product) (float64, bool) {
+	var stockInfo map[string]interface{}
+	if err := json.Unmarshal(p.StockInfo, &stockInfo); err != nil {
+		return 0, false
+	}
+	stock, ok := stockInfo["stock"].(float64)
+	return stock, ok
+}
@@ -0,0 +1,100 @@
+// Package analysis implements the optional mirroring of products into the
+// search index
+package analysis
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/IBM/sarama"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/events"
+	"scraper/internal/kafka"
+	"scraper/internal/search"
+)
+
+// searchIndexer mirrors product changes into the search index; nil when
+// SEARCH_INDEX_ENABLED is off
+var searchIndexer *search.Indexer
+
+// startSearchIndexer starts the search indexer when it is enabled.
+//
+// Environment Variables:
+//   - SEARCH_INDEX_ENABLED: Mirror products into Elasticsearch/OpenSearch (default: false)
+//
+// Parameters:
+//   - db: Database connection used to load products
+func startSearchIndexer(db *gorm.DB) {
+	if !viper.GetBool("SEARCH_INDEX_ENABLED") {
+		return
+	}
+	searchIndexer = search.NewIndexer(db)
+	searchIndexer.Start()
+}
+
+// indexProduct queues a created, updated or deleted product for the search
+// index. It returns immediately and is a no-op when indexing is disabled.
+func indexProduct(source string, productID uint) {
+	if searchIndexer != nil {
+		searchIndexer.Enqueue(source, productID)
+	}
+}
+
+// startSearchIndexConsumer consumes the products other services changed or
+// removed, such as products the crawler deleted, purged or merged, and
+// queues them for the search index. It does nothing when indexing is
+// disabled.
+//
+// Parameters:
+//   - ctx: Stops consuming once done
+//   - producer: Kafka producer for dead letters
+func startSearchIndexConsumer(ctx context.Context, producer sarama.SyncProducer) {
+	if searchIndexer == nil {
+		return
+	}
+	consumer := kafka.SetupConsumer(ctx, events.SearchIndexUpdatesTopic, handleSearchIndexUpdates, kafka.WithProducer(producer))
+	stopping.Add("search index consumer", consumer.Close)
+}
+
+// handleSearchIndexUpdates queues the products of a products_changed event
+// for the search index. Messages that break the contract are dead-lettered.
+func handleSearchIndexUpdates(data []byte) error {
+	change, err := events.DecodeProductsChanged(data)
+	if err != nil {
+		logrus.WithError(err).Error("Rejecting message that breaks the SEARCH_INDEX_UPDATES contract")
+		return kafka.Fatal(err)
+	}
+	for _, product := range change.Products {
+		indexProduct(product.Source, product.ID)
+	}
+	return nil
+}
+
+// handleReindex creates a handler that rebuilds the search index from every
+// product in the database. The reindex runs in the background; only one can
+// run at a time.
+//
+// Returns:
+//   - echo.HandlerFunc: 202 when started, 409 if a reindex is already
+//     running, 502 if the index is unreachable and 503 when indexing is disabled
+func handleReindex() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if searchIndexer == nil {
+			return apierror.New(http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Search indexing is disabled")
+		}
+
+		if err := searchIndexer.StartReindex(); err != nil {
+			if errors.Is(err, search.ErrReindexRunning) {
+				return apierror.Conflict("Reindex already running")
+			}
+			return apierror.Upstream("Failed to start search reindex", err)
+		}
+		return c.JSON(http.StatusAccepted, map[string]string{"status": "Reindex started"})
+	}
+}
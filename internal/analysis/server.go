@@ -3,36 +3,124 @@
 package analysis
 
 import (
+	"context"
 	"net/http"
 	"os"
 
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+	"scraper/internal/cors"
 	"scraper/internal/db"
+	"scraper/internal/health"
 	"scraper/internal/kafka"
+	"scraper/internal/metrics"
+	"scraper/internal/notification"
+	"scraper/internal/outbox"
+	"scraper/internal/profiling"
+	"scraper/internal/proto"
+	"scraper/internal/timeout"
+	"scraper/pkg/readiness"
+	"scraper/pkg/shutdown"
 )
 
+// ready is marked once the analysis service starts consuming products
+var ready = readiness.New()
+
+// Ready returns a channel that is closed once the analysis service is
+// consuming product messages.
+func Ready() <-chan struct{} {
+	return ready.Ready()
+}
+
+// stopping holds what Start started, stopped by Shutdown
+var stopping = shutdown.New("analysis")
+
 // Start initializes and runs the product analysis service. It:
 // 1. Sets up database connection and Kafka producer
 // 2. Initializes HTTP server with health check endpoint
-// 3. Starts consuming product messages from Kafka
+// 3. Schedules the last-seen job that marks vanished products discontinued
+// 4. Starts consuming product messages from Kafka
+// 5. With search indexing on, consumes the products other services changed
+//    or removed and re-indexes them
 //
 // The service listens on ANALYZER_PORT (default: 8085) and consumes messages
-// from KAFKA_PRODUCTS_TOPIC (default: PRODUCTS)
-func Start() {
+// from KAFKA_PRODUCTS_TOPIC (default: PRODUCTS). Consuming stops once ctx is
+// cancelled; Shutdown stops the rest.
+func Start(ctx context.Context) {
 	// Initialize database connection
 	dbConn := db.Setup()
 
 	// Set up Kafka producer for sending price drop notifications
 	producer := kafka.SetupProducer()
+	stopping.Add("Kafka producer", shutdown.Close(producer))
+
+	// Connect to the notification service for watch notifications
+	client, err := notification.Dial("analysis")
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create notification client")
+	}
+	notificationClient = client
+
+	// Skip the lookup of products that did not change since they were written
+	startProductCache()
+
+	// Take over publishing outbox events when the crawler is not running
+	relay := outbox.NewRelay(dbConn, producer)
+	relay.Start("analysis")
+	stopping.Add("outbox relay", relay.Stop)
+
+	// Mark products that vanished from their marketplace as discontinued
+	stopping.Add("last-seen job", shutdown.Cron(startLastSeenJob(dbConn)))
+
+	// Mirror products into the search index when enabled
+	startSearchIndexer(dbConn)
+
+	// Record product changes in the audit trail when enabled
+	startAuditor()
+	stopping.Add("audit trail", auditor.Stop)
 
-	// Initialize Echo HTTP server
+	// Initialize Echo HTTP server; errors are reported as {code, message, details}
 	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler()
+	e.Pre(cors.Middleware(cors.FromConfig()))
+	e.Use(timeout.Middleware(timeout.Routes{
+		"POST /products/:id/resync": timeout.Long,
+		profiling.Route:             timeout.Exempt,
+	}))
 
-	// Register health check endpoint
-	e.GET("/health", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
-	})
+	// Register liveness and readiness endpoints; /health is kept for
+	// existing probes and answers like /health/ready
+	checker := health.New().
+		Add("postgres", health.Database(dbConn)).
+		Add("kafka", health.Kafka(kafka.Brokers()))
+	checker.Register(e)
+	e.GET("/health", checker.Ready)
+
+	// Register Prometheus metrics endpoint
+	e.GET("/metrics", metrics.Handler)
+
+	// Operator endpoints take the crawler's X-API-Key keys
+	requireAPIKey := apikey.Middleware(apikey.FromConfig())
+
+	// Register pipeline latency summary (p50/p95 per stage over the last hour)
+	e.GET("/admin/pipeline-latency", metrics.PipelineLatencyHandler, requireAPIKey)
+
+	// Register profiling endpoints when DEBUG_PPROF is set
+	profiling.Register(e, "analysis")
+
+	// Register full search reindex endpoint
+	e.POST("/admin/search/reindex", handleReindex(), requireAPIKey)
+
+	// Register on-demand product resync endpoint; all resyncs share one
+	// crawler connection
+	crawlerConn, err := dialCrawler()
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create crawler client")
+	}
+	stopping.Add("crawler client", shutdown.Close(crawlerConn))
+	e.POST("/products/:id/resync", handleResync(dbConn, producer, proto.NewCrawlerServiceClient(crawlerConn)), requireAPIKey)
 
 	// Get service port from environment or use default
 	port := os.Getenv("ANALYZER_PORT")
@@ -47,6 +135,7 @@ func Start() {
 			logrus.WithError(err).Error("Analyzer service shutdown")
 		}
 	}()
+	stopping.Add("HTTP server", shutdown.HTTP(e))
 
 	// Get Kafka topic from environment or use default
 	productsTopic := os.Getenv("KAFKA_PRODUCTS_TOPIC")
@@ -56,5 +145,18 @@ func Start() {
 
 	// Start consuming product messages from Kafka
 	// handleProducts processes each message for price/stock analysis
-	kafka.SetupConsumer(productsTopic, handleProducts(dbConn, producer))
+	ready.Mark()
+	consumer := kafka.SetupMessageConsumer(ctx, productsTopic, handleProducts(dbConn, producer), kafka.WithProducer(producer), kafka.WithRetryTopics(kafka.RetryDelays()...))
+	stopping.Add("Kafka consumer", consumer.Close)
+
+	// Index the products other services changed or removed
+	startSearchIndexConsumer(ctx, producer)
+}
+
+// Shutdown stops what Start started: the consumer and the HTTP server finish
+// their running messages and requests, the jobs their running runs, then the
+// outbox relay, audit trail and producer are flushed and closed. Work still
+// running when ctx ends is cancelled.
+func Shutdown(ctx context.Context) error {
+	return stopping.Stop(ctx)
 }
\ No newline at end of file
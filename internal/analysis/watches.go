@@ -0,0 +1,145 @@
+// Package analysis implements seller watch notifications
+package analysis
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+	"scraper/internal/proto"
+)
+
+// Notification types understood by the notification service
+const (
+	notificationTypePriceDrop        = "price_drop"
+	notificationTypeNewSellerProduct = "new_seller_product"
+	notificationTypeDiscontinued     = "discontinued"
+	notificationTypeBackInStock      = "back_in_stock"
+)
+
+// notifySellerWatchers notifies users watching a seller about:
+//  1. New products listed by the seller
+//  2. Price drops of at least SELLER_WATCH_MIN_DROP_PERCENT (default: 10)
+//     on any of the seller's products
+//
+// Parameters:
+//   - db: Database connection for watch lookups
+//   - result: Outcome of processProducts for the current batch
+func notifySellerWatchers(db *gorm.DB, result processResult) {
+	minDropPercent := viper.GetFloat64("SELLER_WATCH_MIN_DROP_PERCENT")
+	if minDropPercent <= 0 {
+		minDropPercent = 10
+	}
+
+	var items []*proto.NotificationRequest
+
+	// New products from watched sellers
+	for _, p := range result.NewProducts {
+		for _, userID := range sellerWatchers(db, p.SellerID) {
+			items = append(items, &proto.NotificationRequest{
+				UserId:    fmt.Sprintf("%d", userID),
+				ProductId: uint64(p.ID),
+				Message:   fmt.Sprintf("New product from a seller you follow: %s", p.Name),
+				Type:      notificationTypeNewSellerProduct,
+			})
+		}
+	}
+
+	// Significant price drops on watched sellers' products
+	for _, drop := range result.PriceDrops {
+		percent := (drop.OldPrice - drop.NewPrice) / drop.OldPrice * 100
+		if percent < minDropPercent {
+			continue
+		}
+		for _, userID := range sellerWatchers(db, drop.Product.SellerID) {
+			items = append(items, &proto.NotificationRequest{
+				UserId:    fmt.Sprintf("%d", userID),
+				ProductId: uint64(drop.Product.ID),
+				Message:   fmt.Sprintf("Price dropped from %.2f to %.2f for %s", drop.OldPrice, drop.NewPrice, drop.Product.Name),
+				Type:      notificationTypePriceDrop,
+			})
+		}
+	}
+
+	if len(items) > 0 {
+		logrus.WithField("count", len(items)).Info("Notifying seller watchers")
+		sendNotifications(items)
+	}
+}
+
+// sellerWatchers returns the IDs of users watching a seller.
+// Products without a known seller have no watchers.
+func sellerWatchers(db *gorm.DB, sellerID uint) []uint {
+	if sellerID == 0 {
+		return nil
+	}
+	var userIDs []uint
+	if err := db.Model(&models.SellerWatch{}).Where("seller_id = ?", sellerID).Pluck("user_id", &userIDs).Error; err != nil {
+		logrus.WithError(err).WithField("seller_id", sellerID).Error("Failed to find seller watchers")
+		return nil
+	}
+	return userIDs
+}
+
+// recordBrandEvents stores new arrivals and notable price drops for brands
+// that have at least one watcher. The notification service turns these into
+// the daily brand digest.
+//
+// Environment Variables:
+//   - BRAND_WATCH_MIN_DROP_PERCENT: Minimum drop recorded for the digest (default: 10)
+//
+// Parameters:
+//   - db: Database connection
+//   - result: Outcome of processProducts for the current batch
+func recordBrandEvents(db *gorm.DB, result processResult) {
+	minDropPercent := viper.GetFloat64("BRAND_WATCH_MIN_DROP_PERCENT")
+	if minDropPercent <= 0 {
+		minDropPercent = 10
+	}
+
+	var events []models.BrandEvent
+	for _, p := range result.NewProducts {
+		if brandWatched(db, p.BrandID) {
+			events = append(events, models.BrandEvent{
+				BrandID:   p.BrandID,
+				ProductID: p.ID,
+				Type:      "new_arrival",
+				NewPrice:  p.Price,
+			})
+		}
+	}
+	for _, drop := range result.PriceDrops {
+		percent := (drop.OldPrice - drop.NewPrice) / drop.OldPrice * 100
+		if percent >= minDropPercent && brandWatched(db, drop.Product.BrandID) {
+			events = append(events, models.BrandEvent{
+				BrandID:   drop.Product.BrandID,
+				ProductID: drop.Product.ID,
+				Type:      "price_drop",
+				OldPrice:  drop.OldPrice,
+				NewPrice:  drop.NewPrice,
+			})
+		}
+	}
+
+	if len(events) == 0 {
+		return
+	}
+	if err := db.Create(&events).Error; err != nil {
+		logrus.WithError(err).Error("Failed to record brand events")
+		return
+	}
+	logrus.WithField("count", len(events)).Info("Recorded brand events")
+}
+
+// brandWatched reports whether any user watches the given brand.
+func brandWatched(db *gorm.DB, brandID uint) bool {
+	if brandID == 0 {
+		return false
+	}
+	var count int64
+	db.Model(&models.BrandWatch{}).Where("brand_id = ?", brandID).Count(&count)
+	return count > 0
+}
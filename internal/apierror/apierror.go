@@ -0,0 +1,266 @@
+// Package apierror defines the error envelope returned by every HTTP API and
+// the Echo error handler that produces it. Handlers return *Error values (or
+// plain errors) instead of writing error responses themselves, so clients can
+// rely on stable machine-readable codes rather than on message wording.
+package apierror
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// Code is a stable, machine-readable error code. Codes are part of the API
+// contract: add new ones freely, but never rename or remove one.
+type Code string
+
+// Error codes returned by the HTTP APIs
+const (
+	CodeValidationFailed      Code = "validation_failed"       // Malformed or invalid input
+	CodeUnauthorized          Code = "unauthorized"            // Missing or wrong API key or login token
+	CodeForbidden             Code = "forbidden"               // Token of another user or without the admin claim
+	CodeInvalidCredentials    Code = "invalid_credentials"     // Login with an unknown email address or a wrong password
+	CodeUserInactive          Code = "user_inactive"           // Login of a deactivated user
+	CodeNotFound              Code = "not_found"               // Route or resource does not exist
+	CodeProductNotFound       Code = "product_not_found"       // Product does not exist
+	CodeUserNotFound          Code = "user_not_found"          // User does not exist
+	CodeMethodNotAllowed      Code = "method_not_allowed"      // Route exists for other methods
+	CodeConflict              Code = "conflict"                // Resource already exists or is busy
+	CodeDuplicateFavorite     Code = "duplicate_favorite"      // Product is already a favorite of the user
+	CodeFavoritesLimitReached Code = "favorites_limit_reached" // User is at FAVORITES_LIMIT
+	CodeRateLimited           Code = "rate_limited"            // Request or fetch budget exhausted
+	CodeUpstreamError         Code = "upstream_error"          // A dependent service failed
+	CodeServiceUnavailable    Code = "service_unavailable"     // Feature disabled or service down
+	CodeTimeout               Code = "timeout"                 // Request deadline passed or request canceled
+	CodeInternal              Code = "internal_error"          // Anything else
+)
+
+// Response is the JSON body of every error response
+type Response struct {
+	Code    Code        `json:"code"`              // Stable error code
+	Message string      `json:"message"`           // Human-readable description, may change
+	Details interface{} `json:"details,omitempty"` // Optional structured context
+}
+
+// FieldError describes one invalid request field in the details of a
+// validation_failed response
+type FieldError struct {
+	Field string `json:"field"`           // JSON name of the field
+	Rule  string `json:"rule"`            // Validation rule that failed, e.g. "required"
+	Param string `json:"param,omitempty"` // Rule parameter, e.g. "3" for min=3
+}
+
+// Error is an error that knows how it is reported to clients. The cause is
+// only logged, never sent.
+type Error struct {
+	Status  int         // HTTP status code
+	Code    Code        // Stable error code
+	Message string      // Message sent to the client
+	Details interface{} // Optional structured context sent to the client
+	cause   error       // Underlying error, logged for 5xx responses
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return e.Message + ": " + e.cause.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error { return e.cause }
+
+// WithDetails returns a copy of the error carrying details.
+func (e *Error) WithDetails(details interface{}) *Error {
+	dup := *e
+	dup.Details = details
+	return &dup
+}
+
+// New creates an error with a status, code and client-facing message.
+func New(status int, code Code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// Invalid reports bad input that is not a struct validation failure, such as
+// an unparsable path parameter.
+func Invalid(message string) *Error {
+	return New(http.StatusBadRequest, CodeValidationFailed, message)
+}
+
+// InvalidFields reports a validator failure, listing each invalid field in
+// the details. Other errors are reported as an invalid request.
+func InvalidFields(err error) *Error {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return Invalid("Invalid request")
+	}
+	fields := make([]FieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		fields = append(fields, FieldError{Field: fe.Field(), Rule: fe.Tag(), Param: fe.Param()})
+	}
+	return Invalid("Request validation failed").WithDetails(fields)
+}
+
+// NotFound reports a missing resource.
+func NotFound(code Code, message string) *Error {
+	return New(http.StatusNotFound, code, message)
+}
+
+// Conflict reports a resource that already exists or is busy.
+func Conflict(message string) *Error {
+	return New(http.StatusConflict, CodeConflict, message)
+}
+
+// Internal reports a server-side failure. The message is sent to the client
+// and should describe the operation, not the cause.
+func Internal(message string, cause error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: message, cause: cause}
+}
+
+// Upstream reports a failure of a service the handler depends on.
+func Upstream(message string, cause error) *Error {
+	return &Error{Status: http.StatusBadGateway, Code: CodeUpstreamError, Message: message, cause: cause}
+}
+
+// Mapper converts a domain error into an *Error, returning nil for errors it
+// does not recognize.
+type Mapper func(err error) *Error
+
+// NewHandler returns an Echo HTTPErrorHandler that writes every error as a
+// Response. Errors are resolved in order:
+//  1. Errors caused by the request's deadline or cancellation become timeout
+//  2. *Error values are sent as they are
+//  3. The service's mappers translate its domain errors
+//  4. Echo, validator, gorm and gRPC errors are mapped by type
+//  5. Anything else becomes internal_error with a generic message
+//
+// 5xx responses are logged together with their cause.
+//
+// Parameters:
+//   - mappers: Service specific error mappings
+//
+// Returns:
+//   - echo.HTTPErrorHandler: Handler to install as e.HTTPErrorHandler
+func NewHandler(mappers ...Mapper) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed {
+			return
+		}
+
+		apiErr := requestEnded(c.Request().Context(), err)
+		if apiErr == nil {
+			apiErr = resolve(err, mappers)
+		}
+		if apiErr.Status >= http.StatusInternalServerError {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"method": c.Request().Method,
+				"path":   c.Path(),
+				"code":   apiErr.Code,
+			}).Error(apiErr.Message)
+		}
+
+		var sendErr error
+		if c.Request().Method == http.MethodHead {
+			sendErr = c.NoContent(apiErr.Status)
+		} else {
+			sendErr = c.JSON(apiErr.Status, Response{Code: apiErr.Code, Message: apiErr.Message, Details: apiErr.Details})
+		}
+		if sendErr != nil {
+			logrus.WithError(sendErr).Error("Failed to send error response")
+		}
+	}
+}
+
+// requestEnded maps errors caused by the end of the request's context, even
+// if a handler wrapped them, and returns nil for any other error. Deadlines
+// of the handler's own calls are left to the other mappings.
+func requestEnded(ctx context.Context, err error) *Error {
+	switch ctxErr := ctx.Err(); {
+	case ctxErr == nil || !errors.Is(err, ctxErr):
+		return nil
+	case ctxErr == context.DeadlineExceeded:
+		return &Error{Status: http.StatusServiceUnavailable, Code: CodeTimeout, Message: "Request timed out", cause: err}
+	default:
+		return &Error{Status: http.StatusServiceUnavailable, Code: CodeTimeout, Message: "Request canceled", cause: err}
+	}
+}
+
+// resolve maps any error to an *Error.
+func resolve(err error, mappers []Mapper) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	for _, mapper := range mappers {
+		if mapped := mapper(err); mapped != nil {
+			mapped.cause = err
+			return mapped
+		}
+	}
+
+	var httpErr *echo.HTTPError
+	var verrs validator.ValidationErrors
+	switch {
+	case errors.As(err, &httpErr):
+		message := http.StatusText(httpErr.Code)
+		if text, ok := httpErr.Message.(string); ok && httpErr.Code < http.StatusInternalServerError {
+			message = text
+		}
+		return &Error{Status: httpErr.Code, Code: codeForStatus(httpErr.Code), Message: message, cause: err}
+	case errors.As(err, &verrs):
+		return InvalidFields(err)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: "Resource not found", cause: err}
+	}
+
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.InvalidArgument:
+			return &Error{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: st.Message(), cause: err}
+		case codes.NotFound:
+			return &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: st.Message(), cause: err}
+		case codes.ResourceExhausted:
+			return &Error{Status: http.StatusTooManyRequests, Code: CodeRateLimited, Message: st.Message(), cause: err}
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return Upstream("Upstream service unavailable", err)
+		}
+	}
+
+	return Internal("Internal server error", err)
+}
+
+// codeForStatus picks the code for errors that only carry an HTTP status,
+// such as Echo's routing and binding errors.
+func codeForStatus(status int) Code {
+	switch {
+	case status == http.StatusUnauthorized:
+		return CodeUnauthorized
+	case status == http.StatusForbidden:
+		return CodeForbidden
+	case status == http.StatusNotFound:
+		return CodeNotFound
+	case status == http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case status == http.StatusConflict:
+		return CodeConflict
+	case status == http.StatusTooManyRequests:
+		return CodeRateLimited
+	case status == http.StatusBadGateway || status == http.StatusGatewayTimeout:
+		return CodeUpstreamError
+	case status == http.StatusServiceUnavailable:
+		return CodeServiceUnavailable
+	case status >= http.StatusInternalServerError:
+		return CodeInternal
+	default:
+		return CodeValidationFailed
+	}
+}
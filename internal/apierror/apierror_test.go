@@ -0,0 +1,107 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// errBusy is a domain error translated by the test mapper
+var errBusy = errors.New("busy")
+
+// serve runs a request against a route returning err through the handler
+// and decodes the envelope.
+func serve(t *testing.T, path string, err error) (int, Response) {
+	t.Helper()
+	e := echo.New()
+	e.HTTPErrorHandler = NewHandler(func(err error) *Error {
+		if errors.Is(err, errBusy) {
+			return Conflict("Resource is busy")
+		}
+		return nil
+	})
+	e.GET("/fail", func(c echo.Context) error { return err })
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var body Response
+	if decodeErr := json.Unmarshal(rec.Body.Bytes(), &body); decodeErr != nil {
+		t.Fatalf("body %q is not an envelope: %v", rec.Body.String(), decodeErr)
+	}
+	return rec.Code, body
+}
+
+func TestValidationEnvelope(t *testing.T) {
+	var req struct {
+		Email string `json:"email" validate:"required"`
+		Name  string `json:"name" validate:"min=3"`
+	}
+	req.Name = "ab"
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(f reflect.StructField) string { return f.Tag.Get("json") })
+
+	for name, err := range map[string]error{
+		"returned":  InvalidFields(validate.Struct(&req)),
+		"unwrapped": validate.Struct(&req),
+	} {
+		status, body := serve(t, "/fail", err)
+		if status != http.StatusBadRequest || body.Code != CodeValidationFailed {
+			t.Errorf("%s: %d %s, want 400 validation_failed", name, status, body.Code)
+		}
+		data, _ := json.Marshal(body.Details)
+		var fields []FieldError
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("%s: details %s are not field errors", name, data)
+		}
+		want := []FieldError{{Field: "email", Rule: "required"}, {Field: "name", Rule: "min", Param: "3"}}
+		if !reflect.DeepEqual(fields, want) {
+			t.Errorf("%s: details = %+v, want %+v", name, fields, want)
+		}
+	}
+}
+
+func TestNotFoundEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		err  error
+		code Code
+	}{
+		{"typed", "/fail", NotFound(CodeProductNotFound, "Product not found"), CodeProductNotFound},
+		{"gorm", "/fail", fmt.Errorf("load product: %w", gorm.ErrRecordNotFound), CodeNotFound},
+		{"route", "/missing", nil, CodeNotFound},
+	}
+	for _, tt := range tests {
+		status, body := serve(t, tt.path, tt.err)
+		if status != http.StatusNotFound || body.Code != tt.code || body.Message == "" {
+			t.Errorf("%s: %d %+v, want 404 %s with a message", tt.name, status, body, tt.code)
+		}
+	}
+}
+
+func TestConflictEnvelope(t *testing.T) {
+	for name, err := range map[string]error{
+		"typed":  Conflict("Already exists"),
+		"mapped": fmt.Errorf("save: %w", errBusy),
+	} {
+		status, body := serve(t, "/fail", err)
+		if status != http.StatusConflict || body.Code != CodeConflict {
+			t.Errorf("%s: %d %s, want 409 conflict", name, status, body.Code)
+		}
+	}
+}
+
+func TestInternalEnvelopeHidesCause(t *testing.T) {
+	status, body := serve(t, "/fail", errors.New("pq: password authentication failed"))
+	if status != http.StatusInternalServerError || body.Code != CodeInternal || body.Message != "Internal server error" {
+		t.Errorf("%d %+v, want 500 internal_error with a generic message", status, body)
+	}
+}
@@ -0,0 +1,214 @@
+// Package apikey implements the X-API-Key check of operator endpoints. Keys
+// come from API_KEY and API_KEYS and are reloaded when the .env file
+// changes. Each key is identified in logs by a hash prefix, never by the key.
+package apikey
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"scraper/internal/apierror"
+	"scraper/pkg/config"
+)
+
+// HeaderName is the request header carrying the key
+const HeaderName = "X-API-Key"
+
+// keyIDKey is the echo.Context key of the accepted key's ID
+const keyIDKey = "apikey.id"
+
+// Quota is the request rate limit of a key. The zero Quota means the key
+// has no limit of its own and gets the default limit of API keys.
+type Quota struct {
+	Rate  float64 // Requests per second
+	Burst int     // Requests the key may make at once
+}
+
+// key is an accepted key, stored as its SHA-256 digest
+type key struct {
+	digest [sha256.Size]byte // SHA-256 of the key
+	id     string            // Hash prefix identifying the key in logs
+	quota  Quota             // Rate limit from API_KEY_LIMITS
+}
+
+// Ring holds the accepted keys. It is safe for concurrent use; Reload swaps
+// the whole set at once.
+type Ring struct {
+	keys atomic.Pointer[[]key]
+}
+
+// FromConfig creates a ring with the configured keys that reloads them
+// whenever the .env file changes.
+//
+// Environment Variables:
+//   - API_KEY: Key required by operator endpoints; without it or API_KEYS
+//     they answer 503 (optional)
+//   - API_KEYS: Further accepted keys, comma-separated (optional)
+//   - API_KEY_LIMITS: Rate limits of keys as comma-separated
+//     <key id>=<requests per second>/<burst> entries, e.g. 3f2a9c1b7d4e=50/100
+//     (optional)
+//
+// Returns:
+//   - *Ring: The ring
+func FromConfig() *Ring {
+	r := &Ring{}
+	r.Reload()
+	config.OnChange(r.Reload)
+	return r
+}
+
+// Reload reads the keys from the configuration again.
+func (r *Ring) Reload() {
+	quotas := parseQuotas(viper.GetString("API_KEY_LIMITS"))
+	var keys []key
+	seen := make(map[string]bool)
+	for _, raw := range append([]string{viper.GetString("API_KEY")}, strings.Split(viper.GetString("API_KEYS"), ",")...) {
+		raw = strings.TrimSpace(raw)
+		if raw == "" || seen[raw] {
+			continue
+		}
+		seen[raw] = true
+		id := ID(raw)
+		keys = append(keys, key{digest: sha256.Sum256([]byte(raw)), id: id, quota: quotas[id]})
+	}
+	r.keys.Store(&keys)
+
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.id
+	}
+	logrus.WithField("key_ids", ids).Info("API keys loaded")
+}
+
+// Empty reports whether no key is configured.
+func (r *Ring) Empty() bool {
+	keys := r.keys.Load()
+	return keys == nil || len(*keys) == 0
+}
+
+// Match checks a presented key against every accepted key in constant time.
+//
+// Parameters:
+//   - presented: Key from the request
+//
+// Returns:
+//   - string: ID of the matching key
+//   - bool: False if no key matches
+func (r *Ring) Match(presented string) (string, bool) {
+	id, _, ok := r.Lookup(presented)
+	return id, ok
+}
+
+// Lookup is Match that also returns the rate limit of the matching key.
+//
+// Parameters:
+//   - presented: Key from the request
+//
+// Returns:
+//   - string: ID of the matching key
+//   - Quota: Rate limit of the key; zero if it has none of its own
+//   - bool: False if no key matches
+func (r *Ring) Lookup(presented string) (string, Quota, bool) {
+	keys := r.keys.Load()
+	if keys == nil {
+		return "", Quota{}, false
+	}
+	digest := sha256.Sum256([]byte(presented))
+	var matched *key
+	// Compare against every key, so the time taken does not reveal which
+	// key matched
+	for i, k := range *keys {
+		if subtle.ConstantTimeCompare(digest[:], k.digest[:]) == 1 {
+			matched = &(*keys)[i]
+		}
+	}
+	if matched == nil {
+		return "", Quota{}, false
+	}
+	return matched.id, matched.quota, true
+}
+
+// parseQuotas reads API_KEY_LIMITS into quotas by key ID. Malformed entries
+// are logged and skipped, so the key keeps the default limit.
+func parseQuotas(raw string) map[string]Quota {
+	quotas := make(map[string]Quota)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, limit, _ := strings.Cut(entry, "=")
+		rps, burst, _ := strings.Cut(limit, "/")
+		rate, rateErr := strconv.ParseFloat(rps, 64)
+		size, burstErr := strconv.Atoi(burst)
+		if id == "" || rateErr != nil || burstErr != nil || rate <= 0 || size < 1 {
+			logrus.WithField("entry", entry).Warn("Ignoring malformed API_KEY_LIMITS entry, want <key id>=<rps>/<burst>")
+			continue
+		}
+		quotas[strings.TrimSpace(id)] = Quota{Rate: rate, Burst: size}
+	}
+	return quotas
+}
+
+// ID returns the identifier of a key in logs: the first 12 hex digits of its
+// SHA-256. Operators compute it with `printf %s "$KEY" | sha256sum | cut -c1-12`.
+func ID(raw string) string {
+	digest := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(digest[:])[:12]
+}
+
+// Middleware rejects requests without an accepted X-API-Key header with 401
+// and logs the accepted ones with the key's ID. While no key is configured
+// every request is rejected with 503, so the routes never run unprotected.
+//
+// Parameters:
+//   - r: Accepted keys
+//
+// Returns:
+//   - echo.MiddlewareFunc: Middleware checking the key
+func Middleware(r *Ring) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if r.Empty() {
+				return apierror.New(http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "API key is not configured")
+			}
+			id, ok := r.Match(c.Request().Header.Get(HeaderName))
+			if !ok {
+				logrus.WithFields(logrus.Fields{
+					"method": c.Request().Method,
+					"path":   c.Path(),
+					"remote": c.RealIP(),
+				}).Warn("Request with an invalid API key")
+				return apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+			}
+			c.Set(keyIDKey, id)
+			logrus.WithFields(logrus.Fields{
+				"method": c.Request().Method,
+				"path":   c.Path(),
+				"key_id": id,
+			}).Info("API key request")
+			return next(c)
+		}
+	}
+}
+
+// KeyID returns the ID of the key that authenticated the request.
+//
+// Parameters:
+//   - c: Request context
+//
+// Returns:
+//   - string: The key's ID; empty on routes without the middleware
+func KeyID(c echo.Context) string {
+	id, _ := c.Get(keyIDKey).(string)
+	return id
+}
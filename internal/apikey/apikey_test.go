@@ -0,0 +1,101 @@
+package apikey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+
+	"scraper/internal/apierror"
+)
+
+func setKeys(t *testing.T, single, list string) {
+	t.Helper()
+	viper.Set("API_KEY", single)
+	viper.Set("API_KEYS", list)
+	t.Cleanup(func() {
+		viper.Set("API_KEY", nil)
+		viper.Set("API_KEYS", nil)
+	})
+}
+
+func TestRingMatchAndReload(t *testing.T) {
+	setKeys(t, "first-key", " second-key, third-key ,")
+	r := &Ring{}
+	r.Reload()
+
+	for _, key := range []string{"first-key", "second-key", "third-key"} {
+		if id, ok := r.Match(key); !ok || id != ID(key) {
+			t.Errorf("Match(%q) = %q, %v, want %q, true", key, id, ok, ID(key))
+		}
+	}
+	for _, key := range []string{"", "first-ke", "first-key ", "SECOND-KEY"} {
+		if _, ok := r.Match(key); ok {
+			t.Errorf("Match(%q) accepted", key)
+		}
+	}
+
+	// A removed key stops working on the next reload
+	setKeys(t, "", "third-key")
+	r.Reload()
+	if _, ok := r.Match("first-key"); ok {
+		t.Error("removed key still accepted after reload")
+	}
+	if _, ok := r.Match("third-key"); !ok {
+		t.Error("remaining key rejected after reload")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	setKeys(t, "secret-key", "")
+	r := &Ring{}
+	r.Reload()
+
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler()
+	e.GET("/fetch", func(c echo.Context) error {
+		return c.String(http.StatusOK, KeyID(c))
+	}, Middleware(r))
+
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret-key": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/fetch", nil)
+		if key != "" {
+			req.Header.Set(HeaderName, key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("key %q: status = %d, want %d", key, rec.Code, want)
+		}
+		if want == http.StatusOK && rec.Body.String() != ID("secret-key") {
+			t.Errorf("KeyID = %q, want %q", rec.Body.String(), ID("secret-key"))
+		}
+	}
+
+	// Without keys the routes are closed, not open
+	setKeys(t, "", "")
+	r.Reload()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fetch", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("no keys configured: status = %d, want 503", rec.Code)
+	}
+}
+
+func TestRingQuotas(t *testing.T) {
+	setKeys(t, "partner-key", "other-key")
+	viper.Set("API_KEY_LIMITS", ID("partner-key")+"=2.5/10, "+ID("other-key")+"=fast, unknown=1/1")
+	t.Cleanup(func() { viper.Set("API_KEY_LIMITS", nil) })
+	r := &Ring{}
+	r.Reload()
+
+	if _, quota, ok := r.Lookup("partner-key"); !ok || quota != (Quota{Rate: 2.5, Burst: 10}) {
+		t.Errorf("partner quota = %+v, %v; want 2.5/10", quota, ok)
+	}
+	// A malformed entry leaves the key on the default limit
+	if _, quota, ok := r.Lookup("other-key"); !ok || quota != (Quota{}) {
+		t.Errorf("other quota = %+v, %v; want none", quota, ok)
+	}
+}
@@ -0,0 +1,370 @@
+// Package audit implements the optional append-only audit trail of product
+// changes. Entries are queued without blocking the caller and written by a
+// background worker as NDJSON to gzipped files rotated daily, one set of
+// files per service.
+package audit
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"scraper/internal/metrics"
+)
+
+// Entry operations
+const (
+	OpCreate = "create" // Product stored for the first time
+	OpUpdate = "update" // Columns of a stored product changed
+	OpDelete = "delete" // Product soft-deleted
+	OpPurge  = "purge"  // Soft-deleted product removed for good
+	OpGap    = "gap"    // Entries were dropped before this one, see Entry.Dropped
+)
+
+// fileSuffix ends the name of every audit file
+const fileSuffix = ".ndjson.gz"
+
+// Audit metrics
+var (
+	entriesTotal = metrics.NewCounter(
+		"audit_entries_total",
+		"Audit entries by result (written, dropped, failed)",
+		"result",
+	)
+	queuePending = metrics.NewGauge(
+		"audit_queue_pending",
+		"Audit entries waiting to be written",
+	)
+)
+
+// Change is the old and new value of a column, as JSON
+type Change struct {
+	Old json.RawMessage `json:"old"` // null for created products and columns that were empty
+	New json.RawMessage `json:"new"`
+}
+
+// Origin is what caused a change: the Kafka message it was read from and the
+// correlation ID of the operation that published it. Every field is optional.
+type Origin struct {
+	Topic         string `json:"topic,omitempty"`
+	Partition     int32  `json:"partition,omitempty"`
+	Offset        *int64 `json:"offset,omitempty"` // Set for changes read from Kafka
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// Entry is one line of an audit file
+type Entry struct {
+	Time      time.Time         `json:"time"`
+	Service   string            `json:"service"`              // Service that made the change
+	Op        string            `json:"op"`                   // One of the Op constants
+	ProductID uint              `json:"product_id,omitempty"` // Empty for gaps
+	Source    string            `json:"source,omitempty"`
+	Changes   map[string]Change `json:"changes,omitempty"` // Changed columns by name
+	Dropped   int64             `json:"dropped,omitempty"` // Gaps only: entries lost because the queue was full
+	Origin
+}
+
+// Diff returns the columns whose values differ between two sets of column
+// values. Values are compared as normalized JSON, so a JSONB column read back
+// from the database equals the value it was written with. A column missing
+// from old counts as null.
+//
+// Parameters:
+//   - old: Column values before the change; nil for a created product
+//   - new: Column values after the change; only these columns are compared
+//
+// Returns:
+//   - map[string]Change: The changed columns, empty if nothing changed
+func Diff(old, new map[string]interface{}) map[string]Change {
+	changes := make(map[string]Change)
+	for column, value := range new {
+		after := normalize(value)
+		before := json.RawMessage("null")
+		if oldValue, ok := old[column]; ok {
+			before = normalize(oldValue)
+		}
+		if string(before) != string(after) {
+			changes[column] = Change{Old: before, New: after}
+		}
+	}
+	return changes
+}
+
+// normalize encodes a value as JSON with object keys sorted and numbers in
+// one notation. Values that cannot be encoded are reported as a string.
+func normalize(value interface{}) json.RawMessage {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		raw, _ = json.Marshal(fmt.Sprintf("unencodable: %v", err))
+		return raw
+	}
+	var decoded interface{}
+	if json.Unmarshal(raw, &decoded) != nil {
+		return raw
+	}
+	normalized, err := json.Marshal(decoded)
+	if err != nil {
+		return raw
+	}
+	return normalized
+}
+
+// Auditor writes entries behind the caller's back. A nil Auditor records
+// nothing, so callers need not check whether auditing is enabled.
+type Auditor struct {
+	service       string
+	dir           string
+	flushInterval time.Duration
+	queue         chan Entry
+	dropped       atomic.Int64     // Entries dropped since the last gap entry
+	droppedSince  atomic.Int64     // Time of the first of them, in Unix nanoseconds
+	now           func() time.Time // Clock deciding the day of the file written to
+	quit          chan struct{}    // Closed by Stop
+	done          chan struct{}    // Closed once the worker returned
+
+	// Owned by the worker
+	day  string   // UTC day of the open file
+	file *os.File // Open audit file, nil until the first entry
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+// FromConfig creates and starts the auditor of a service when auditing is
+// enabled.
+//
+// Environment Variables:
+//   - AUDIT_ENABLED: Write the audit trail (default: false)
+//   - AUDIT_DIR: Directory of the audit files (default: audit)
+//   - AUDIT_QUEUE_SIZE: Entries queued before new ones are dropped (default: 10000)
+//   - AUDIT_FLUSH_INTERVAL: How often written entries are flushed to disk (default: 1s)
+//
+// Parameters:
+//   - service: Name of the service, which prefixes its files
+//
+// Returns:
+//   - *Auditor: The started auditor; nil when auditing is disabled or the
+//     directory cannot be created
+func FromConfig(service string) *Auditor {
+	if !viper.GetBool("AUDIT_ENABLED") {
+		return nil
+	}
+	dir := viper.GetString("AUDIT_DIR")
+	if dir == "" {
+		dir = "audit"
+	}
+	queueSize := viper.GetInt("AUDIT_QUEUE_SIZE")
+	if queueSize <= 0 {
+		queueSize = 10000
+	}
+	flushInterval := viper.GetDuration("AUDIT_FLUSH_INTERVAL")
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	a, err := New(service, dir, queueSize, flushInterval)
+	if err != nil {
+		logrus.WithError(err).WithField("dir", dir).Error("Audit trail disabled, cannot create its directory")
+		return nil
+	}
+	a.Start()
+	return a
+}
+
+// New creates an auditor. Call Start to begin writing queued entries.
+//
+// Parameters:
+//   - service: Name of the service, which prefixes its files
+//   - dir: Directory of the audit files, created if missing
+//   - queueSize: Entries queued before new ones are dropped
+//   - flushInterval: How often written entries are flushed to disk
+//
+// Returns:
+//   - *Auditor: The auditor
+//   - error: If the directory cannot be created
+func New(service, dir string, queueSize int, flushInterval time.Duration) (*Auditor, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Auditor{
+		service:       service,
+		dir:           dir,
+		flushInterval: flushInterval,
+		queue:         make(chan Entry, queueSize),
+		now:           time.Now,
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// Start launches the background worker that writes queued entries.
+func (a *Auditor) Start() {
+	logrus.WithFields(logrus.Fields{
+		"service": a.service,
+		"dir":     a.dir,
+	}).Info("Audit trail started")
+	go a.run()
+}
+
+// Stop writes the entries still queued, finishes the open file and ends the
+// worker. Entries recorded afterwards are not written. Stopping a nil
+// auditor does nothing.
+//
+// Parameters:
+//   - ctx: Bounds the wait for the queued entries to be written
+//
+// Returns:
+//   - error: ctx's error if the entries were not written in time
+func (a *Auditor) Stop(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	close(a.quit)
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Record queues an entry. It never blocks: when the queue is full the entry
+// is dropped and counted, and the next written entry is preceded by a gap
+// entry with the number dropped and the time of the first of them. The time
+// and service are filled in.
+//
+// Parameters:
+//   - entry: The change to record
+func (a *Auditor) Record(entry Entry) {
+	if a == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Service = a.service
+	select {
+	case a.queue <- entry:
+	default:
+		if a.dropped.Add(1) == 1 {
+			a.droppedSince.Store(entry.Time.UnixNano())
+		}
+		entriesTotal.Inc("dropped")
+	}
+}
+
+// run writes queued entries and flushes them every flush interval, so a
+// crash loses at most one interval of entries.
+func (a *Auditor) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-a.queue:
+			a.handle(entry)
+		case <-ticker.C:
+			a.flush()
+			queuePending.Set(float64(len(a.queue)))
+		case <-a.quit:
+			for len(a.queue) > 0 {
+				a.handle(<-a.queue)
+			}
+			a.close()
+			queuePending.Set(0)
+			return
+		}
+	}
+}
+
+// handle writes a dequeued entry, after a gap entry if entries were dropped
+// since the last one.
+func (a *Auditor) handle(entry Entry) {
+	if dropped := a.dropped.Swap(0); dropped > 0 {
+		since := time.Unix(0, a.droppedSince.Load())
+		logrus.WithFields(logrus.Fields{
+			"dropped": dropped,
+			"since":   since,
+		}).Warn("Audit queue was full, entries dropped")
+		a.write(Entry{Time: since, Service: a.service, Op: OpGap, Dropped: dropped})
+	}
+	a.write(entry)
+}
+
+// write appends an entry to the file of the current UTC day, opening a new
+// file when the day changes. Entries are written shortly after they happen,
+// so one near midnight may land in the next day's file. A failed write is
+// counted and the file reopened for the next entry.
+func (a *Auditor) write(entry Entry) {
+	day := a.now().UTC().Format(time.DateOnly)
+	if a.file == nil || day != a.day {
+		a.close()
+		if err := a.open(day); err != nil {
+			logrus.WithError(err).Error("Failed to open audit file")
+			entriesTotal.Inc("failed")
+			return
+		}
+	}
+	if err := a.enc.Encode(entry); err != nil {
+		logrus.WithError(err).WithField("file", a.file.Name()).Error("Failed to write audit entry")
+		entriesTotal.Inc("failed")
+		a.close()
+		return
+	}
+	entriesTotal.Inc("written")
+}
+
+// open creates the file of a day. Every open starts a new file, numbered
+// after the ones of the day that exist, so a file left without its gzip
+// trailer by a crash is never appended to.
+func (a *Auditor) open(day string) error {
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("%s-%s%s", a.service, day, fileSuffix)
+		if n > 1 {
+			name = fmt.Sprintf("%s-%s.%d%s", a.service, day, n, fileSuffix)
+		}
+		file, err := os.OpenFile(filepath.Join(a.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		a.file, a.day = file, day
+		a.gz = gzip.NewWriter(file)
+		a.enc = json.NewEncoder(a.gz)
+		return nil
+	}
+}
+
+// flush pushes the entries written so far to the file.
+func (a *Auditor) flush() {
+	if a.file == nil {
+		return
+	}
+	if err := a.gz.Flush(); err != nil {
+		logrus.WithError(err).WithField("file", a.file.Name()).Error("Failed to flush audit file")
+		a.close()
+	}
+}
+
+// close finishes the open file, if any.
+func (a *Auditor) close() {
+	if a.file == nil {
+		return
+	}
+	if err := a.gz.Close(); err != nil {
+		logrus.WithError(err).WithField("file", a.file.Name()).Error("Failed to finish audit file")
+	}
+	if err := a.file.Close(); err != nil {
+		logrus.WithError(err).WithField("file", a.file.Name()).Error("Failed to close audit file")
+	}
+	a.file, a.gz, a.enc = nil, nil, nil
+}
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+func TestDiff(t *testing.T) {
+	stored := map[string]interface{}{
+		"price":       10.0,
+		"stock_info":  datatypes.JSON(`{"stock": 5, "disabled": false}`),
+		"is_active":   true,
+		"name":        "Shirt",
+		"not_written": "kept",
+	}
+	incoming := map[string]interface{}{
+		"price":      9.5,
+		"stock_info": datatypes.JSON(`{"disabled":false,"stock":5}`),
+		"is_active":  false,
+		"name":       "Shirt",
+		"brand_id":   uint(3),
+	}
+	changes := Diff(stored, incoming)
+	if len(changes) != 3 {
+		t.Fatalf("changes = %v, want price, is_active and brand_id", changes)
+	}
+	if c := changes["price"]; string(c.Old) != "10" || string(c.New) != "9.5" {
+		t.Errorf("price change = %s -> %s", c.Old, c.New)
+	}
+	if c := changes["brand_id"]; string(c.Old) != "null" || string(c.New) != "3" {
+		t.Errorf("brand_id change = %s -> %s", c.Old, c.New)
+	}
+}
+
+func TestWriteAndHistory(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New("analysis", dir, 2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)
+	a.now = func() time.Time { return day }
+	offset := int64(41)
+	a.Record(Entry{Time: day, Op: OpCreate, ProductID: 7, Source: "trendyol",
+		Changes: Diff(nil, map[string]interface{}{"price": 10.0}), Origin: Origin{Topic: "PRODUCTS", Offset: &offset}})
+	a.Record(Entry{Time: day.Add(time.Minute), Op: OpUpdate, ProductID: 8, Source: "trendyol",
+		Changes: Diff(nil, map[string]interface{}{"price": 1.0})})
+	// The queue holds two entries, so this one is dropped
+	a.Record(Entry{Time: day.Add(30 * time.Second), Op: OpUpdate, ProductID: 7, Source: "trendyol"})
+	for i := 0; i < 2; i++ {
+		a.handle(<-a.queue)
+	}
+	a.now = func() time.Time { return day.Add(3 * time.Minute) }
+	a.Record(Entry{Time: day.Add(3 * time.Minute), Op: OpUpdate, ProductID: 7, Source: "trendyol",
+		Changes: Diff(map[string]interface{}{"price": 10.0}, map[string]interface{}{"price": 8.0}), Origin: Origin{CorrelationID: "crawl-1"}})
+	a.handle(<-a.queue)
+	// Left unfinished, like after a crash
+	a.flush()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(names) != 2 {
+		t.Fatalf("files = %v, want one per day", names)
+	}
+
+	entries, err := History(dir, Query{ProductID: 7, Source: "trendyol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOps := []string{OpCreate, OpGap, OpUpdate}
+	if len(entries) != len(wantOps) {
+		t.Fatalf("entries = %+v, want %v", entries, wantOps)
+	}
+	for i, op := range wantOps {
+		if entries[i].Op != op {
+			t.Errorf("entry %d op = %s, want %s", i, entries[i].Op, op)
+		}
+	}
+	if entries[1].Dropped != 1 {
+		t.Errorf("gap dropped = %d, want 1", entries[1].Dropped)
+	}
+	if entries[0].Offset == nil || *entries[0].Offset != offset || entries[2].CorrelationID != "crawl-1" {
+		t.Errorf("origins = %+v, %+v", entries[0].Origin, entries[2].Origin)
+	}
+
+	price := Fields(entries)["price"]
+	if len(price) != 2 || string(price[0].New) != "10" || string(price[1].Old) != "10" || string(price[1].New) != "8" {
+		t.Errorf("price history = %+v", price)
+	}
+
+	// The period limits the entries
+	later, err := History(dir, Query{ProductID: 7, From: day.Add(10 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(later) != 2 || later[0].Op != OpGap {
+		t.Errorf("entries after the create = %+v", later)
+	}
+
+	// A restart starts a new file rather than appending to the cut-off one
+	a.close()
+	if err := a.open(day.Add(time.Hour).Format(time.DateOnly)); err != nil {
+		t.Fatal(err)
+	}
+	a.close()
+	if _, err := os.Stat(filepath.Join(dir, "analysis-2026-03-02.2.ndjson.gz")); err != nil {
+		t.Errorf("second file of the day: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+// Package audit implements reading the audit trail back, to reconstruct the
+// history of a product for spot checks
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxLineBytes bounds one audit line; products with large JSONB columns
+// produce long ones
+const maxLineBytes = 16 << 20
+
+// Query selects the entries History returns
+type Query struct {
+	ProductID uint      // Product to reconstruct
+	Source    string    // Marketplace of the product; empty for every marketplace
+	From      time.Time // Earliest entry, inclusive; zero for no limit
+	To        time.Time // Latest entry, exclusive; zero for no limit
+}
+
+// FieldChange is one change of a column in a product's history
+type FieldChange struct {
+	Time   time.Time       `json:"time"`
+	Op     string          `json:"op"`
+	Old    json.RawMessage `json:"old"`
+	New    json.RawMessage `json:"new"`
+	Origin                 // Message and correlation ID of the change
+}
+
+// History reads the entries of a product from every audit file in a
+// directory, oldest first. Gap entries in the period are included, since an
+// entry of the product may be among those dropped. A file cut short by a
+// crash is read up to where it ends.
+//
+// Parameters:
+//   - dir: Directory of the audit files
+//   - q: Product and period
+//
+// Returns:
+//   - []Entry: Matching entries and gaps, ordered by time
+//   - error: If the directory or a file cannot be read, or a line is malformed
+func History(dir string, q Query) ([]Entry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, path := range paths {
+		if !fileInPeriod(filepath.Base(path), q) {
+			continue
+		}
+		err := readFile(path, func(entry Entry) {
+			if !q.From.IsZero() && entry.Time.Before(q.From) {
+				return
+			}
+			if !q.To.IsZero() && !entry.Time.Before(q.To) {
+				return
+			}
+			if entry.Op == OpGap || (entry.ProductID == q.ProductID && (q.Source == "" || entry.Source == q.Source)) {
+				entries = append(entries, entry)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+// Fields groups the changes of a product's entries by column, each column's
+// changes oldest first.
+//
+// Parameters:
+//   - entries: Entries of one product, as returned by History
+//
+// Returns:
+//   - map[string][]FieldChange: Changes by column name
+func Fields(entries []Entry) map[string][]FieldChange {
+	fields := make(map[string][]FieldChange)
+	for _, entry := range entries {
+		for column, change := range entry.Changes {
+			fields[column] = append(fields[column], FieldChange{
+				Time:   entry.Time,
+				Op:     entry.Op,
+				Old:    change.Old,
+				New:    change.New,
+				Origin: entry.Origin,
+			})
+		}
+	}
+	return fields
+}
+
+// fileInPeriod reports whether a file may hold entries of the queried
+// period, judging by the day in its name. An entry may be written the day
+// after it happened, so files of the day after the period are read too.
+// Files whose name has no day are read.
+func fileInPeriod(name string, q Query) bool {
+	// <service>-YYYY-MM-DD[.N].ndjson.gz
+	base := strings.TrimSuffix(name, fileSuffix)
+	if i := strings.LastIndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if len(base) < len(time.DateOnly) {
+		return true
+	}
+	day, err := time.Parse(time.DateOnly, base[len(base)-len(time.DateOnly):])
+	if err != nil {
+		return true
+	}
+	if !q.From.IsZero() && !day.Add(24*time.Hour).After(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !day.Before(q.To.Add(24*time.Hour)) {
+		return false
+	}
+	return true
+}
+
+// readFile passes every entry of an audit file to fn.
+func readFile(path string, fn func(Entry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if errors.Is(err, io.EOF) {
+		return nil // Created but never written to
+	}
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return err
+		}
+		fn(entry)
+	}
+	// A file without its gzip trailer ends early; what was flushed is intact,
+	// though its last line may be cut off
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return nil
+}
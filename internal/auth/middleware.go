@@ -0,0 +1,148 @@
+// Package auth implements the middleware that checks login tokens on the
+// routes a service lists, and the user ID checks of its handlers
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"scraper/internal/apierror"
+)
+
+// claimsKey is the echo.Context key of the authenticated request's claims
+const claimsKey = "auth.claims"
+
+// Access selects who may call a route
+type Access int
+
+// Route access levels
+const (
+	Public Access = iota // Anyone; the level of routes that are not listed
+	User                 // Any logged-in user; the handler checks the user it acts on with Authorize
+	Owner                // The user in the route's Param, or an admin
+	Admin                // Only tokens with the admin claim
+)
+
+// Rule is the access rule of a route
+type Rule struct {
+	Access Access // Who may call the route
+	Param  string // Path parameter holding the user ID, for Owner
+}
+
+// Routes maps "METHOD /path" to a rule. The path is the route as registered,
+// e.g. "GET /users/:id". Routes that are not listed are Public.
+type Routes map[string]Rule
+
+// Middleware requires a valid "Authorization: Bearer <token>" header on the
+// routes listed in routes and stores its claims in the context, where
+// ClaimsFrom and Authorize read them. A missing, invalid or expired token is
+// answered with 401, a token of the wrong user or without the admin claim
+// with 403, and an Owner route whose user ID does not parse with 400. It must be added with e.Use, which runs after routing, so the
+// route is known.
+//
+// Parameters:
+//   - issuer: Verifies the tokens; nil when login is not configured, which
+//     makes the listed routes answer 503
+//   - routes: The service's authenticated routes
+//
+// Returns:
+//   - echo.MiddlewareFunc: Middleware checking the token
+func Middleware(issuer *Issuer, routes Routes) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rule, ok := routes[c.Request().Method+" "+c.Path()]
+			if !ok || rule.Access == Public {
+				return next(c)
+			}
+			if issuer == nil {
+				return apierror.New(http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Authentication is not configured")
+			}
+
+			token, ok := bearerToken(c.Request().Header.Get(echo.HeaderAuthorization))
+			if !ok {
+				return apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Missing bearer token")
+			}
+			claims, err := issuer.Parse(token, time.Now())
+			if errors.Is(err, ErrTokenExpired) {
+				return apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Token expired")
+			}
+			if err != nil {
+				return apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid token")
+			}
+			if _, err := claims.UserID(); err != nil {
+				return apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid token")
+			}
+			c.Set(claimsKey, claims)
+
+			switch rule.Access {
+			case Admin:
+				if !claims.Admin {
+					return apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Admin access required")
+				}
+			case Owner:
+				// A malformed ID names no user the token could own
+				id, err := strconv.ParseUint(c.Param(rule.Param), 10, 32)
+				if err != nil {
+					return apierror.Invalid("Invalid user ID")
+				}
+				if err := Authorize(c, uint(id)); err != nil {
+					return err
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// bearerToken extracts the token of an Authorization header.
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// ClaimsFrom returns the claims Middleware stored for the request.
+//
+// Parameters:
+//   - c: Request context
+//
+// Returns:
+//   - Claims: The token's claims
+//   - bool: False if the request was not authenticated
+func ClaimsFrom(c echo.Context) (Claims, bool) {
+	claims, ok := c.Get(claimsKey).(Claims)
+	return claims, ok
+}
+
+// Authorize checks that the authenticated user may act on a user's data:
+// the user themselves or an admin. Handlers of User routes call it with the
+// user ID of the request body.
+//
+// Parameters:
+//   - c: Request context
+//   - userID: User the request acts on
+//
+// Returns:
+//   - error: 401 if the request was not authenticated, 403 for another
+//     user's data, nil otherwise
+func Authorize(c echo.Context, userID uint) error {
+	claims, ok := ClaimsFrom(c)
+	if !ok {
+		return apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Missing bearer token")
+	}
+	if claims.Admin {
+		return nil
+	}
+	if id, err := claims.UserID(); err != nil || id != userID {
+		return apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Not allowed to access another user's data")
+	}
+	return nil
+}
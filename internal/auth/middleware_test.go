@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"scraper/internal/apierror"
+)
+
+// newTestServer serves a few routes behind Middleware. The body route checks
+// the user in the user_id query parameter the way handlers check body IDs.
+func newTestServer(issuer *Issuer) *echo.Echo {
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler()
+	e.Use(Middleware(issuer, Routes{
+		"GET /users/:id": {Access: Owner, Param: "id"},
+		"POST /items":    {Access: User},
+		"GET /fetch":     {Access: Admin},
+	}))
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.GET("/users/:id", ok)
+	e.GET("/fetch", ok)
+	e.GET("/products", ok)
+	e.POST("/items", func(c echo.Context) error {
+		id, _ := strconv.ParseUint(c.QueryParam("user_id"), 10, 32)
+		if err := Authorize(c, uint(id)); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	return e
+}
+
+func TestMiddleware(t *testing.T) {
+	issuer := newTestIssuer(t, time.Hour)
+	user, _, err := issuer.Issue(7, "user@example.com", false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := issuer.Issue(1, "admin@example.com", true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := issuer.Issue(7, "user@example.com", false, time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestServer(issuer)
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		header string
+		want   int
+	}{
+		{"public route", http.MethodGet, "/products", "", http.StatusOK},
+		{"no token", http.MethodGet, "/users/7", "", http.StatusUnauthorized},
+		{"not a bearer token", http.MethodGet, "/users/7", "Basic " + user, http.StatusUnauthorized},
+		{"garbage token", http.MethodGet, "/users/7", "Bearer abc.def.ghi", http.StatusUnauthorized},
+		{"expired token", http.MethodGet, "/users/7", "Bearer " + expired, http.StatusUnauthorized},
+		{"own profile", http.MethodGet, "/users/7", "Bearer " + user, http.StatusOK},
+		{"lower-case scheme", http.MethodGet, "/users/7", "bearer " + user, http.StatusOK},
+		{"other profile", http.MethodGet, "/users/8", "Bearer " + user, http.StatusForbidden},
+		{"malformed user ID", http.MethodGet, "/users/7x", "Bearer " + user, http.StatusBadRequest},
+		{"malformed user ID as admin", http.MethodGet, "/users/-1", "Bearer " + admin, http.StatusBadRequest},
+		{"admin reads other profile", http.MethodGet, "/users/8", "Bearer " + admin, http.StatusOK},
+		{"own body user", http.MethodPost, "/items?user_id=7", "Bearer " + user, http.StatusOK},
+		{"other body user", http.MethodPost, "/items?user_id=8", "Bearer " + user, http.StatusForbidden},
+		{"admin route as user", http.MethodGet, "/fetch", "Bearer " + user, http.StatusForbidden},
+		{"admin route as admin", http.MethodGet, "/fetch", "Bearer " + admin, http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.header != "" {
+			req.Header.Set(echo.HeaderAuthorization, tc.header)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d (%s)", tc.name, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+}
+
+func TestMiddlewareWithoutIssuer(t *testing.T) {
+	e := newTestServer(nil)
+	for target, want := range map[string]int{"/products": http.StatusOK, "/users/7": http.StatusServiceUnavailable} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", target, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Package auth implements password hashing and the signed tokens returned by
+// POST /login
+package auth
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxPasswordLength is the longest password bcrypt hashes, in bytes
+const MaxPasswordLength = 72
+
+// hashPrefixes are the version prefixes of bcrypt hashes. Go writes $2a$;
+// $2b$ and $2y$ come from other implementations and verify the same way.
+var hashPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+// dummyHash is compared against when there is no hash to check, so a login
+// for an unknown user takes as long as one with a wrong password
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), PasswordCost())
+	return hash
+})
+
+// PasswordCost returns the bcrypt cost new hashes are created with. Each
+// step doubles the time a hash, and so a login, takes.
+//
+// Environment Variables:
+//   - BCRYPT_COST: bcrypt cost, 4-31 (default: 10)
+//
+// Returns:
+//   - int: The cost
+func PasswordCost() int {
+	cost := viper.GetInt("BCRYPT_COST")
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+	return cost
+}
+
+// HashPassword hashes a password with bcrypt for storing in users.password,
+// at PasswordCost.
+//
+// Parameters:
+//   - password: The plain password, at most MaxPasswordLength bytes
+//
+// Returns:
+//   - string: The bcrypt hash
+//   - error: If the password is too long
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost())
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsHashed reports whether a stored password is a bcrypt hash, by its
+// version prefix. Passwords stored before hashing was introduced are plain
+// text.
+func IsHashed(stored string) bool {
+	for _, prefix := range hashPrefixes {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPassword reports whether password matches a bcrypt hash, using
+// bcrypt.CompareHashAndPassword; every password comparison goes through it.
+// A hash that is empty or not a bcrypt hash never matches; the password is
+// compared against a dummy hash instead, so the call takes the same time
+// either way.
+//
+// Parameters:
+//   - hash: Stored hash, empty when the user does not exist
+//   - password: Password to check
+//
+// Returns:
+//   - bool: True if the password matches
+func CheckPassword(hash, password string) bool {
+	if !IsHashed(hash) {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,32 @@
+package auth
+
+import "testing"
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsHashed(hash) {
+		t.Fatalf("IsHashed(%q) = false", hash)
+	}
+
+	cases := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"right password", hash, "correct horse", true},
+		{"wrong password", hash, "wrong horse", false},
+		{"wrong case", hash, "Correct horse", false},
+		{"empty password", hash, "", false},
+		{"no user", "", "correct horse", false},
+		{"plain text stored", "correct horse", "correct horse", false},
+	}
+	for _, tc := range cases {
+		if got := CheckPassword(tc.hash, tc.password); got != tc.want {
+			t.Errorf("%s: CheckPassword = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
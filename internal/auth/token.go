@@ -0,0 +1,221 @@
+// Package auth implements login tokens: JWTs signed with HMAC-SHA256 that
+// carry the user's ID, email address and admin flag. The same issuer signs
+// single-purpose tokens such as email verification links, which are never
+// accepted as login tokens.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// minSecretLength is the shortest JWT_SECRET accepted, in bytes
+const minSecretLength = 32
+
+// Token errors
+var (
+	ErrNoSecret     = errors.New("JWT_SECRET is not set")
+	ErrWeakSecret   = fmt.Errorf("JWT_SECRET must be at least %d bytes", minSecretLength)
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// PurposeVerifyEmail marks the tokens of email verification links
+const PurposeVerifyEmail = "verify_email"
+
+// tokenHeader is the encoded JOSE header of every token
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims are the claims of a login or single-purpose token
+type Claims struct {
+	Subject   string `json:"sub"`               // User ID
+	Email     string `json:"email"`             // User's email address at login
+	IssuedAt  int64  `json:"iat"`               // Unix time the token was issued
+	ExpiresAt int64  `json:"exp"`               // Unix time the token expires
+	Admin     bool   `json:"admin,omitempty"`   // User may act on every user's data
+	Purpose   string `json:"purpose,omitempty"` // What the token is for; empty for login tokens
+}
+
+// UserID returns the user ID of the subject claim.
+func (c Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 32)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return uint(id), nil
+}
+
+// Issuer signs and verifies login tokens
+type Issuer struct {
+	secret []byte        // HMAC key
+	ttl    time.Duration // Lifetime of issued tokens
+}
+
+// NewIssuer creates an issuer.
+//
+// Parameters:
+//   - secret: HMAC key, at least 32 bytes
+//   - ttl: Lifetime of issued tokens
+//
+// Returns:
+//   - *Issuer: The issuer
+//   - error: ErrNoSecret or ErrWeakSecret
+func NewIssuer(secret string, ttl time.Duration) (*Issuer, error) {
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	if len(secret) < minSecretLength {
+		return nil, ErrWeakSecret
+	}
+	return &Issuer{secret: []byte(secret), ttl: ttl}, nil
+}
+
+// IssuerFromEnv creates the issuer configured in the environment.
+//
+// Environment Variables:
+//   - JWT_SECRET: HMAC key of the tokens, at least 32 bytes (required)
+//   - JWT_TTL: Lifetime of issued tokens (default: 24h)
+//
+// Returns:
+//   - *Issuer: The issuer
+//   - error: ErrNoSecret or ErrWeakSecret
+func IssuerFromEnv() (*Issuer, error) {
+	ttl := viper.GetDuration("JWT_TTL")
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	return NewIssuer(viper.GetString("JWT_SECRET"), ttl)
+}
+
+// Issue signs a token for a user.
+//
+// Parameters:
+//   - userID: User the token is for
+//   - email: User's email address
+//   - admin: Whether the user is an admin
+//   - now: Issue time
+//
+// Returns:
+//   - string: The signed token
+//   - time.Time: When the token expires
+//   - error: If the claims could not be encoded
+func (i *Issuer) Issue(userID uint, email string, admin bool, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(i.ttl)
+	token, err := i.encode(Claims{
+		Subject:   strconv.FormatUint(uint64(userID), 10),
+		Email:     email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		Admin:     admin,
+	})
+	return token, expiresAt, err
+}
+
+// IssueFor signs a single-purpose token for a user, such as the token of an
+// email verification link. Parse rejects it as a login token.
+//
+// Parameters:
+//   - purpose: What the token is for, e.g. PurposeVerifyEmail
+//   - userID: User the token is for
+//   - email: User's email address; the token only applies to this address
+//   - ttl: Lifetime of the token
+//   - now: Issue time
+//
+// Returns:
+//   - string: The signed token
+//   - time.Time: When the token expires
+//   - error: If the claims could not be encoded
+func (i *Issuer) IssueFor(purpose string, userID uint, email string, ttl time.Duration, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(ttl)
+	token, err := i.encode(Claims{
+		Subject:   strconv.FormatUint(uint64(userID), 10),
+		Email:     email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		Purpose:   purpose,
+	})
+	return token, expiresAt, err
+}
+
+// encode signs claims into a token.
+func (i *Issuer) encode(claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + i.sign(signed), nil
+}
+
+// Parse verifies a login token's signature and expiry and returns its
+// claims. Only tokens signed with HS256 by this issuer's secret are accepted,
+// and single-purpose tokens from IssueFor are not.
+//
+// Parameters:
+//   - token: The token
+//   - now: Time to check the expiry against
+//
+// Returns:
+//   - Claims: The token's claims
+//   - error: ErrInvalidToken or ErrTokenExpired
+func (i *Issuer) Parse(token string, now time.Time) (Claims, error) {
+	return i.ParseFor("", token, now)
+}
+
+// ParseFor verifies a token issued for a purpose and returns its claims.
+//
+// Parameters:
+//   - purpose: What the token must be for; empty for login tokens
+//   - token: The token
+//   - now: Time to check the expiry against
+//
+// Returns:
+//   - Claims: The token's claims
+//   - error: ErrInvalidToken, also for a token with another purpose, or
+//     ErrTokenExpired
+func (i *Issuer) ParseFor(purpose, token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return Claims{}, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(i.sign(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, expected) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if claims.Purpose != purpose {
+		return Claims{}, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// sign returns the encoded HMAC-SHA256 signature of the signing input.
+func (i *Issuer) sign(input string) string {
+	mac := hmac.New(sha256.New, i.secret)
+	mac.Write([]byte(input))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func newTestIssuer(t *testing.T, ttl time.Duration) *Issuer {
+	t.Helper()
+	issuer, err := NewIssuer(testSecret, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func TestIssueAndParse(t *testing.T) {
+	issuer := newTestIssuer(t, time.Hour)
+	now := time.Unix(1700000000, 0)
+
+	token, expiresAt, err := issuer.Issue(42, "user@example.com", false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("expiresAt = %v, want %v", expiresAt, now.Add(time.Hour))
+	}
+
+	claims, err := issuer.Parse(token, now.Add(59*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := claims.UserID(); err != nil || id != 42 {
+		t.Errorf("UserID() = %d, %v, want 42", id, err)
+	}
+	if claims.Email != "user@example.com" {
+		t.Errorf("Email = %q, want user@example.com", claims.Email)
+	}
+}
+
+func TestParseRejectsExpiredToken(t *testing.T) {
+	issuer := newTestIssuer(t, time.Hour)
+	now := time.Unix(1700000000, 0)
+	token, _, err := issuer.Issue(42, "user@example.com", false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, at := range []time.Time{now.Add(time.Hour), now.Add(time.Hour + time.Second), now.Add(48 * time.Hour)} {
+		if _, err := issuer.Parse(token, at); !errors.Is(err, ErrTokenExpired) {
+			t.Errorf("Parse at %v: err = %v, want ErrTokenExpired", at.Sub(now), err)
+		}
+	}
+}
+
+func TestParseRejectsForgedTokens(t *testing.T) {
+	issuer := newTestIssuer(t, time.Hour)
+	now := time.Unix(1700000000, 0)
+	token, _, err := issuer.Issue(42, "user@example.com", false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	other, err := NewIssuer(strings.Repeat("x", minSecretLength), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, _, _ := other.Issue(42, "user@example.com", false, now)
+	forgedClaims, _, _ := other.Issue(1, "admin@example.com", true, now)
+
+	cases := map[string]string{
+		"other secret":   otherToken,
+		"swapped claims": parts[0] + "." + strings.Split(forgedClaims, ".")[1] + "." + parts[2],
+		"alg none":       "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0." + parts[1] + ".",
+		"missing part":   parts[0] + "." + parts[1],
+		"empty":          "",
+		"bad base64 sig": parts[0] + "." + parts[1] + ".!!!",
+	}
+	for name, forged := range cases {
+		if _, err := issuer.Parse(forged, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestNewIssuerRejectsWeakSecrets(t *testing.T) {
+	if _, err := NewIssuer("", time.Hour); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("empty secret: err = %v, want ErrNoSecret", err)
+	}
+	if _, err := NewIssuer("short", time.Hour); !errors.Is(err, ErrWeakSecret) {
+		t.Errorf("short secret: err = %v, want ErrWeakSecret", err)
+	}
+}
+
+func TestPurposeTokensAreNotLoginTokens(t *testing.T) {
+	issuer := newTestIssuer(t, time.Hour)
+	now := time.Unix(1700000000, 0)
+
+	token, expiresAt, err := issuer.IssueFor(PurposeVerifyEmail, 42, "user@example.com", 48*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.Equal(now.Add(48 * time.Hour)) {
+		t.Errorf("expiresAt = %v, want %v", expiresAt, now.Add(48*time.Hour))
+	}
+	if _, err := issuer.Parse(token, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Parse of a verification token: err = %v, want ErrInvalidToken", err)
+	}
+	claims, err := issuer.ParseFor(PurposeVerifyEmail, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := claims.UserID(); id != 42 || claims.Email != "user@example.com" {
+		t.Errorf("claims = %+v, want user 42 with user@example.com", claims)
+	}
+
+	login, _, err := issuer.Issue(42, "user@example.com", false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.ParseFor(PurposeVerifyEmail, login, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ParseFor of a login token: err = %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Package cors lets browsers call the HTTP APIs from other origins, such as
+// the web frontend. Allowed origins come from the configuration: a strict
+// allowlist in production, or "*" in development to allow any origin.
+// Responses to origins that are not allowed carry no CORS headers, so the
+// browser keeps their responses from the calling page. Preflight requests
+// are answered before routing, so they need neither a route nor a login
+// token.
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// Wildcard allows every origin, or every requested header
+const Wildcard = "*"
+
+// Config is the CORS policy of a service
+type Config struct {
+	Origins        []string      // Allowed origins, e.g. "https://app.example.com", or Wildcard
+	Methods        []string      // Methods a preflight allows
+	Headers        []string      // Request headers a preflight allows, or Wildcard for any
+	ExposedHeaders []string      // Response headers scripts may read
+	MaxAge         time.Duration // How long browsers may cache a preflight; 0 omits the header
+}
+
+// FromConfig reads the CORS policy.
+//
+// Environment Variables:
+//   - CORS_ALLOWED_ORIGINS: Comma-separated allowed origins, or * for any
+//     origin in development (default: none, CORS disabled)
+//   - CORS_ALLOWED_METHODS: Comma-separated methods (default: GET, POST,
+//     PUT, PATCH, DELETE)
+//   - CORS_ALLOWED_HEADERS: Comma-separated request headers, or * for any
+//     (default: Content-Type, Authorization, X-API-Key)
+//   - CORS_EXPOSED_HEADERS: Comma-separated response headers scripts may
+//     read (default: Retry-After and the X-RateLimit-* quota headers)
+//   - CORS_MAX_AGE: How long browsers may cache a preflight (default: 10m)
+//
+// Returns:
+//   - Config: The policy
+func FromConfig() Config {
+	cfg := Config{
+		Origins:        splitList(viper.GetString("CORS_ALLOWED_ORIGINS")),
+		Methods:        splitList(viper.GetString("CORS_ALLOWED_METHODS")),
+		Headers:        splitList(viper.GetString("CORS_ALLOWED_HEADERS")),
+		ExposedHeaders: splitList(viper.GetString("CORS_EXPOSED_HEADERS")),
+		MaxAge:         viper.GetDuration("CORS_MAX_AGE"),
+	}
+	if len(cfg.Methods) == 0 {
+		cfg.Methods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	}
+	if len(cfg.Headers) == 0 {
+		cfg.Headers = []string{echo.HeaderContentType, echo.HeaderAuthorization, "X-API-Key"}
+	}
+	if len(cfg.ExposedHeaders) == 0 {
+		cfg.ExposedHeaders = []string{echo.HeaderRetryAfter, "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = 10 * time.Minute
+	}
+	return cfg
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(raw string) []string {
+	var values []string
+	for _, value := range strings.Split(raw, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// allows reports whether origin may call the service.
+func (cfg Config) allows(origin string) bool {
+	for _, allowed := range cfg.Origins {
+		if allowed == Wildcard || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcard reports whether list allows anything.
+func wildcard(list []string) bool {
+	for _, value := range list {
+		if value == Wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware applies cfg to every request. It must be added with e.Pre, so
+// preflight requests are answered before routing and authentication.
+//
+// Parameters:
+//   - cfg: The service's CORS policy
+//
+// Returns:
+//   - echo.MiddlewareFunc: Middleware setting the CORS headers
+func Middleware(cfg Config) echo.MiddlewareFunc {
+	methods := strings.Join(cfg.Methods, ", ")
+	headers := strings.Join(cfg.Headers, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	anyOrigin, anyHeader := wildcard(cfg.Origins), wildcard(cfg.Headers)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			origin := req.Header.Get(echo.HeaderOrigin)
+			if origin == "" {
+				return next(c)
+			}
+			preflight := req.Method == http.MethodOptions && req.Header.Get(echo.HeaderAccessControlRequestMethod) != ""
+
+			// The response depends on the origin unless every origin gets "*"
+			header := c.Response().Header()
+			if !anyOrigin {
+				header.Add(echo.HeaderVary, echo.HeaderOrigin)
+			}
+			if !cfg.allows(origin) {
+				if preflight {
+					return c.NoContent(http.StatusNoContent)
+				}
+				return next(c)
+			}
+
+			if anyOrigin {
+				header.Set(echo.HeaderAccessControlAllowOrigin, Wildcard)
+			} else {
+				header.Set(echo.HeaderAccessControlAllowOrigin, origin)
+			}
+			if !preflight {
+				if exposed != "" {
+					header.Set(echo.HeaderAccessControlExposeHeaders, exposed)
+				}
+				return next(c)
+			}
+
+			header.Add(echo.HeaderVary, echo.HeaderAccessControlRequestMethod)
+			header.Add(echo.HeaderVary, echo.HeaderAccessControlRequestHeaders)
+			header.Set(echo.HeaderAccessControlAllowMethods, methods)
+			if anyHeader {
+				if requested := req.Header.Get(echo.HeaderAccessControlRequestHeaders); requested != "" {
+					header.Set(echo.HeaderAccessControlAllowHeaders, requested)
+				}
+			} else {
+				header.Set(echo.HeaderAccessControlAllowHeaders, headers)
+			}
+			if cfg.MaxAge > 0 {
+				header.Set(echo.HeaderAccessControlMaxAge, maxAge)
+			}
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// serve runs a request through an Echo instance with the CORS policy and a
+// single GET /items route.
+func serve(cfg Config, method, origin string, header map[string]string) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.Pre(Middleware(cfg))
+	e.GET("/items", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	req := httptest.NewRequest(method, "/items", nil)
+	if origin != "" {
+		req.Header.Set(echo.HeaderOrigin, origin)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func strictConfig() Config {
+	return Config{
+		Origins:        []string{"https://app.example.com"},
+		Methods:        []string{http.MethodGet, http.MethodPost},
+		Headers:        []string{echo.HeaderContentType, "X-API-Key"},
+		ExposedHeaders: []string{echo.HeaderRetryAfter},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	rec := serve(strictConfig(), http.MethodGet, "https://APP.example.com", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "https://APP.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the request origin", got)
+	}
+	if got := rec.Header().Get(echo.HeaderAccessControlExposeHeaders); got != echo.HeaderRetryAfter {
+		t.Errorf("Access-Control-Expose-Headers = %q, want Retry-After", got)
+	}
+	if got := rec.Header().Get(echo.HeaderVary); got != echo.HeaderOrigin {
+		t.Errorf("Vary = %q, want Origin", got)
+	}
+}
+
+func TestDisallowedOrigin(t *testing.T) {
+	rec := serve(strictConfig(), http.MethodGet, "https://evil.example.com", nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want the handler's 200", rec.Code)
+	}
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q for a disallowed origin", got)
+	}
+
+	rec = serve(strictConfig(), http.MethodOptions, "https://evil.example.com", map[string]string{
+		echo.HeaderAccessControlRequestMethod: http.MethodPost,
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("preflight status = %d, want 204", rec.Code)
+	}
+	for _, name := range []string{echo.HeaderAccessControlAllowOrigin, echo.HeaderAccessControlAllowMethods, echo.HeaderAccessControlMaxAge} {
+		if got := rec.Header().Get(name); got != "" {
+			t.Errorf("%s = %q on a disallowed preflight", name, got)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	// POST /items has no route; the preflight is answered before routing
+	rec := serve(strictConfig(), http.MethodOptions, "https://app.example.com", map[string]string{
+		echo.HeaderAccessControlRequestMethod:  http.MethodPost,
+		echo.HeaderAccessControlRequestHeaders: "content-type",
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", rec.Code)
+	}
+	want := map[string]string{
+		echo.HeaderAccessControlAllowOrigin:  "https://app.example.com",
+		echo.HeaderAccessControlAllowMethods: "GET, POST",
+		echo.HeaderAccessControlAllowHeaders: "Content-Type, X-API-Key",
+		echo.HeaderAccessControlMaxAge:       "600",
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	cfg := strictConfig()
+	cfg.Origins = []string{Wildcard}
+	cfg.Headers = []string{Wildcard}
+
+	rec := serve(cfg, http.MethodGet, "http://localhost:3000", nil)
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != Wildcard {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := rec.Header().Get(echo.HeaderVary); got != "" {
+		t.Errorf("Vary = %q, want none in wildcard mode", got)
+	}
+
+	rec = serve(cfg, http.MethodOptions, "http://localhost:3000", map[string]string{
+		echo.HeaderAccessControlRequestMethod:  http.MethodDelete,
+		echo.HeaderAccessControlRequestHeaders: "X-Custom",
+	})
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowHeaders); got != "X-Custom" {
+		t.Errorf("Access-Control-Allow-Headers = %q, want the requested headers", got)
+	}
+}
+
+func TestNoOrigin(t *testing.T) {
+	rec := serve(Config{}, http.MethodGet, "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderVary) != "" {
+		t.Errorf("same-origin request: status %d, Vary %q; want 200 and no CORS headers", rec.Code, rec.Header().Get(echo.HeaderVary))
+	}
+
+	// CORS is off until origins are configured
+	rec = serve(Config{}, http.MethodGet, "https://app.example.com", nil)
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q with no origins configured", got)
+	}
+}
@@ -0,0 +1,307 @@
+// Package crawler implements the operator endpoints used by scraperctl
+package crawler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+	"scraper/internal/emailaddr"
+	"scraper/internal/models"
+	"scraper/internal/proto"
+	"scraper/internal/redact"
+)
+
+// SchedulerFavorites names the favorites price check scheduler
+const SchedulerFavorites = "favorites"
+
+// Timing of the favorites scheduler, shared with GET /scheduler/queue so its
+// estimates follow the scheduler
+const (
+	FavoritesSchedule   = "* * * * *"     // Cron spec of the scheduler runs
+	FavoritesFetchDelay = 2 * time.Second // Pause before each product fetch of a run
+)
+
+// testNotificationTimeout bounds a test notification, which waits for SMTP
+const testNotificationTimeout = 30 * time.Second
+
+// GetSchedulerState returns the state of a scheduler. Schedulers that were
+// never paused or run have no row and are reported as running.
+//
+// Parameters:
+//   - db: Database connection
+//   - name: Scheduler name, e.g. SchedulerFavorites
+//
+// Returns:
+//   - models.SchedulerState: Current state
+//   - error: Any database error
+func GetSchedulerState(db *gorm.DB, name string) (models.SchedulerState, error) {
+	state := models.SchedulerState{Name: name}
+	err := db.Where("name = ?", name).First(&state).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return state, err
+	}
+	return state, nil
+}
+
+// SetSchedulerPaused pauses or resumes a scheduler. A paused scheduler keeps
+// its cron entry but skips every run until resumed.
+//
+// Parameters:
+//   - db: Database connection
+//   - name: Scheduler name, e.g. SchedulerFavorites
+//   - paused: Whether runs should be skipped
+//
+// Returns:
+//   - models.SchedulerState: State after the change
+//   - error: Any database error
+func SetSchedulerPaused(db *gorm.DB, name string, paused bool) (models.SchedulerState, error) {
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"paused", "updated_at"}),
+	}).Create(&models.SchedulerState{Name: name, Paused: paused}).Error
+	if err != nil {
+		return models.SchedulerState{}, err
+	}
+	logrus.WithFields(logrus.Fields{"scheduler": name, "paused": paused}).Info("Scheduler state changed")
+	return GetSchedulerState(db, name)
+}
+
+// RecordSchedulerRun stores when a scheduler last ran and how many products
+// it handled. It does not touch UpdatedAt, which tracks pause changes.
+//
+// Parameters:
+//   - db: Database connection
+//   - name: Scheduler name, e.g. SchedulerFavorites
+//   - count: Products handled by the run
+//
+// Returns:
+//   - error: Any database error
+func RecordSchedulerRun(db *gorm.DB, name string, count int) error {
+	now := time.Now()
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_run_at", "last_run_count"}),
+	}).Create(&models.SchedulerState{Name: name, LastRunAt: &now, LastRunCount: count}).Error
+}
+
+// ScheduledProducts builds the query for the products the favorites
+// scheduler refreshes: active, favorite-marked products with at least one
+// user favorite. It selects id, source, watchers, the number of users who
+// favorited the product, and the inputs of its PriorityScore: last_seen_at,
+// refresh_boost and recent_logs, the price or stock changes logged since
+// changedSince. RankScheduledProducts adds the run order.
+//
+// Parameters:
+//   - db: Database connection
+//   - changedSince: Start of the volatility window
+//
+// Returns:
+//   - *gorm.DB: Query to scan or use as a subquery
+func ScheduledProducts(db *gorm.DB, changedSince time.Time) *gorm.DB {
+	return db.Model(&models.Product{}).
+		Select("products.id, products.source, products.last_seen_at, products.refresh_boost, "+
+			"COUNT(DISTINCT user_favorites.user_id) AS watchers, "+
+			"(SELECT COUNT(*) FROM price_stock_logs WHERE price_stock_logs.product_id = products.id AND price_stock_logs.source = products.source AND price_stock_logs.deleted_at IS NULL AND price_stock_logs.change_time >= ?) AS recent_logs",
+			changedSince).
+		Joins("JOIN user_favorites ON products.id = user_favorites.product_id AND products.source = user_favorites.source AND user_favorites.deleted_at IS NULL").
+		Where("products.is_active = ? AND products.is_favorite = ?", true, true).
+		Group("products.id, products.source, products.last_seen_at, products.refresh_boost")
+}
+
+// apiKeys are the keys requireAPIKey accepts, loaded on first use and
+// reloaded with the .env file
+var apiKeys = sync.OnceValue(apikey.FromConfig)
+
+// requireAPIKey rejects requests whose X-API-Key header does not match one
+// of API_KEY and API_KEYS, and logs accepted requests with the key's ID.
+// While no key is set every request is rejected with 503. A request with an
+// accepted key may ask for unredacted seller data with ?unredacted=true;
+// endpoints without the key never return it.
+func requireAPIKey() echo.MiddlewareFunc {
+	check := apikey.Middleware(apiKeys())
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return check(func(c echo.Context) error {
+			if c.QueryParam("unredacted") == "true" && apikey.KeyID(c) != "" {
+				redact.AllowFull(c)
+				logrus.WithFields(logrus.Fields{
+					"path":   c.Path(),
+					"key_id": apikey.KeyID(c),
+				}).Info("Unredacted response requested")
+			}
+			return next(c)
+		})
+	}
+}
+
+// registerAdminHandlers sets up the operator endpoints:
+// - Pausing, resuming and inspecting the favorites scheduler
+// - Sending a test notification email
+// - Lifting the favorites limit for a user
+// - Reconciling a single product with the marketplace
+// - Listing users whose email addresses collide once normalized
+//
+// All of them require the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - notificationClient: Client for the notification service
+func registerAdminHandlers(e *echo.Echo, db *gorm.DB, notificationClient proto.NotificationServiceClient) {
+	admin := e.Group("", requireAPIKey())
+	validate := newValidator()
+
+	// GET /scheduler
+	// Returns the state of the favorites scheduler
+	admin.GET("/scheduler", func(c echo.Context) error {
+		state, err := GetSchedulerState(db, SchedulerFavorites)
+		if err != nil {
+			return apierror.Internal("Failed to load scheduler state", err)
+		}
+		return c.JSON(http.StatusOK, state)
+	})
+
+	// POST /scheduler/pause and POST /scheduler/resume
+	// Pause or resume the favorites scheduler
+	for path, paused := range map[string]bool{"/scheduler/pause": true, "/scheduler/resume": false} {
+		paused := paused
+		admin.POST(path, func(c echo.Context) error {
+			state, err := SetSchedulerPaused(db, SchedulerFavorites, paused)
+			if err != nil {
+				return apierror.Internal("Failed to update scheduler state", err)
+			}
+			return c.JSON(http.StatusOK, state)
+		})
+	}
+
+	// POST /notifications/test
+	// Sends a sample notification email about a product to any address
+	// Request body: {"email": string, "product_id": uint, "source": string}
+	admin.POST("/notifications/test", func(c echo.Context) error {
+		var req struct {
+			Email     string `json:"email" validate:"required,mailbox"`        // Recipient address
+			ProductID uint   `json:"product_id" validate:"required,productid"` // Product shown in the email
+			Source    string `json:"source"`                                   // Marketplace of the product
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		req.Email = emailaddr.Normalize(req.Email)
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		source, err := NormalizeSource(req.Source)
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), testNotificationTimeout)
+		defer cancel()
+		resp, err := notificationClient.SendNotification(ctx, &proto.NotificationRequest{
+			ProductId: uint64(req.ProductID),
+			Source:    source,
+			Email:     req.Email,
+			Type:      "test",
+		})
+		if err != nil {
+			return apierror.Upstream(status.Convert(err).Message(), err)
+		}
+		if !resp.Success {
+			return apierror.Upstream("Notification service rejected the request", nil)
+		}
+		return c.JSON(http.StatusOK, map[string]string{"status": "Test notification sent"})
+	})
+
+	// PUT /users/:id/favorites-limit
+	// Grants or revokes a user's exemption from FAVORITES_LIMIT
+	// Request body: {"unlimited": bool}
+	admin.PUT("/users/:id/favorites-limit", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		var req struct {
+			Unlimited *bool `json:"unlimited" validate:"required"` // Whether the user may exceed the limit
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+
+		if err := SetUnlimitedFavorites(db, uint(userID), *req.Unlimited); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+			}
+			return apierror.Internal("Failed to update user", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"user_id": userID, "unlimited_favorites": *req.Unlimited})
+	})
+
+	// POST /admin/reconcile
+	// Refetches a stored product and returns how its name, price, stock and
+	// active flag differ from the database, without changing it
+	// Query parameters:
+	//   - product_id: Product to check (required)
+	//   - source: Marketplace of the product (default: trendyol)
+	admin.POST("/admin/reconcile", func(c echo.Context) error {
+		productID, err := models.ParseProductID(c.QueryParam("product_id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		result, err := ReconcileProduct(c.Request().Context(), db, source, productID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
+		if errors.Is(err, ErrRequestBudgetExhausted) {
+			return err
+		}
+		if err != nil {
+			return apierror.Upstream("Failed to reconcile product", err)
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	// POST /admin/favorites/recount
+	// Recomputes every product's local_favorites_count from user_favorites
+	// and returns how many products had a wrong count
+	admin.POST("/admin/favorites/recount", func(c echo.Context) error {
+		fixed, err := RecountLocalFavorites(db.WithContext(c.Request().Context()))
+		if err != nil {
+			return apierror.Internal("Failed to recount favorites", err)
+		}
+		return c.JSON(http.StatusOK, map[string]int64{"products_fixed": fixed})
+	})
+
+	// GET /admin/users/email-collisions
+	// Lists users whose email addresses only differ in case or surrounding
+	// whitespace. Until they are resolved, the case-insensitive unique index
+	// on users.email is not created.
+	admin.GET("/admin/users/email-collisions", func(c echo.Context) error {
+		collisions, err := emailaddr.FindCollisions(db)
+		if err != nil {
+			return apierror.Internal("Failed to find email collisions", err)
+		}
+		if collisions == nil {
+			collisions = []emailaddr.Collision{}
+		}
+		return c.JSON(http.StatusOK, collisions)
+	})
+}
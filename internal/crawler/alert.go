@@ -0,0 +1,95 @@
+// Package crawler implements operator alerts posted to Slack
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"scraper/internal/notification"
+	"scraper/pkg/httpclient"
+)
+
+// slackTimeout bounds a single Slack webhook call
+const slackTimeout = 10 * time.Second
+
+// slackClient posts alerts to the Slack webhook
+var slackClient = httpclient.MustNew(httpclient.Options{Name: "slack", Timeout: slackTimeout})
+
+// errSlackNotConfigured is returned by sendSlackAlert when no webhook is set
+var errSlackNotConfigured = errors.New("SLACK_WEBHOOK_URL not set")
+
+// sendSlackAlert posts a message to the operators' Slack broadcast channel
+// through an incoming webhook. In notification dry-run mode the message is
+// only logged.
+//
+// Environment Variables:
+//   - SLACK_WEBHOOK_URL: Incoming webhook of the broadcast channel
+//   - NOTIFICATIONS_DRY_RUN: Log the message instead of posting it
+//
+// Parameters:
+//   - text: Message to post, Slack mrkdwn is allowed
+//
+// Returns:
+//   - error: errSlackNotConfigured without a webhook, or any request error
+func sendSlackAlert(text string) error {
+	return postSlack(viper.GetString("SLACK_WEBHOOK_URL"), text)
+}
+
+// sendOpsAlert posts a message to the ops Slack channel, or to the broadcast
+// channel when the ops channel has no webhook of its own.
+//
+// Environment Variables:
+//   - SLACK_OPS_WEBHOOK_URL: Incoming webhook of the ops channel (optional)
+//   - SLACK_WEBHOOK_URL: Fallback webhook
+//
+// Parameters:
+//   - text: Message to post, Slack mrkdwn is allowed
+//
+// Returns:
+//   - error: errSlackNotConfigured without a webhook, or any request error
+func sendOpsAlert(text string) error {
+	webhook := viper.GetString("SLACK_OPS_WEBHOOK_URL")
+	if webhook == "" {
+		webhook = viper.GetString("SLACK_WEBHOOK_URL")
+	}
+	return postSlack(webhook, text)
+}
+
+// postSlack posts a message through an incoming webhook, or only logs it in
+// notification dry-run mode.
+func postSlack(webhook, text string) error {
+	if webhook == "" {
+		return errSlackNotConfigured
+	}
+	if notification.DryRun() {
+		logrus.WithField("text", text).Info("Dry run, Slack alert not sent")
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := slackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("slack webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// Package crawler implements recording product deletions and purges in the
+// optional audit trail
+package crawler
+
+import (
+	"scraper/internal/audit"
+)
+
+// auditor records deleted and purged products in the audit trail; nil when
+// AUDIT_ENABLED is off
+var auditor *audit.Auditor
+
+// auditRemoved records products that were deleted or purged.
+//
+// Parameters:
+//   - op: audit.OpDelete or audit.OpPurge
+//   - source: Marketplace of the products
+//   - productIDs: The removed products
+func auditRemoved(op, source string, productIDs ...uint) {
+	for _, id := range productIDs {
+		auditor.Record(audit.Entry{Op: op, ProductID: id, Source: source})
+	}
+}
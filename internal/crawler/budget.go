@@ -0,0 +1,161 @@
+// Package crawler implements the daily budget for outbound Trendyol requests
+package crawler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+// budgetDayFormat formats the UTC day a request counts against
+const budgetDayFormat = "2006-01-02"
+
+// ErrRequestBudgetExhausted is returned by ReserveRequest when the day's
+// Trendyol requests are used up for the caller's priority.
+var ErrRequestBudgetExhausted = errors.New("daily Trendyol request budget exhausted")
+
+// RequestBudgetStatus reports how much of today's Trendyol request budget is
+// left.
+//
+// Once the regular budget is spent PriorityOnly is set: crawling pauses and
+// the favorites scheduler only refreshes its highest priority products,
+// using the priority reserve. Exhausted means the reserve is gone too.
+type RequestBudgetStatus struct {
+	Day             string    `json:"day"`              // UTC day the counter applies to
+	Limit           int       `json:"limit"`            // Requests allowed per day
+	PriorityReserve int       `json:"priority_reserve"` // Part of the limit kept for priority products
+	Used            int       `json:"used"`             // Requests issued today
+	Remaining       int       `json:"remaining"`        // Requests left, including the reserve
+	PriorityOnly    bool      `json:"priority_only"`    // Regular budget spent; only priority fetches allowed
+	Exhausted       bool      `json:"exhausted"`        // No requests left today
+	ResetsAt        time.Time `json:"resets_at"`        // Start of the next UTC day
+}
+
+// requestBudgetLimit returns the daily cap on Trendyol requests.
+//
+// Environment Variables:
+//   - TRENDYOL_DAILY_REQUEST_BUDGET: Requests allowed per UTC day across the
+//     crawler and the favorites scheduler (default: 20000)
+func requestBudgetLimit() int {
+	limit := viper.GetInt("TRENDYOL_DAILY_REQUEST_BUDGET")
+	if limit <= 0 {
+		limit = 20000
+	}
+	return limit
+}
+
+// requestBudgetReserve returns how many of the daily requests only priority
+// fetches may use.
+//
+// Environment Variables:
+//   - TRENDYOL_BUDGET_PRIORITY_RESERVE_PERCENT: Share of the budget kept for
+//     priority products, 0-100 (default: 10)
+func requestBudgetReserve(limit int) int {
+	percent := 10
+	if viper.IsSet("TRENDYOL_BUDGET_PRIORITY_RESERVE_PERCENT") {
+		percent = viper.GetInt("TRENDYOL_BUDGET_PRIORITY_RESERVE_PERCENT")
+	}
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	return limit * percent / 100
+}
+
+// PriorityProductCount returns how many products from the front of the
+// favorites scheduler's run order it keeps refreshing once the regular
+// budget is spent.
+//
+// Environment Variables:
+//   - TRENDYOL_BUDGET_PRIORITY_PRODUCTS: Number of priority products (default: 50)
+func PriorityProductCount() int {
+	count := viper.GetInt("TRENDYOL_BUDGET_PRIORITY_PRODUCTS")
+	if count <= 0 {
+		count = 50
+	}
+	return count
+}
+
+// budgetDay returns the UTC day t counts against.
+func budgetDay(t time.Time) string {
+	return t.UTC().Format(budgetDayFormat)
+}
+
+// ReserveRequest counts one outbound request against today's budget before
+// it is issued. The check and increment are a single statement, so processes
+// sharing the database cannot overshoot the cap. Only Trendyol requests are
+// budgeted; other sources always succeed.
+//
+// Parameters:
+//   - db: Database connection
+//   - source: Marketplace the request goes to
+//   - priority: Whether the request may use the priority reserve
+//
+// Returns:
+//   - error: ErrRequestBudgetExhausted if no budget is left for the
+//     priority, or any database error
+func ReserveRequest(db *gorm.DB, source string, priority bool) error {
+	if source != "" && source != models.SourceTrendyol {
+		return nil
+	}
+
+	ceiling := requestBudgetLimit()
+	if !priority {
+		ceiling -= requestBudgetReserve(ceiling)
+	}
+	if ceiling <= 0 {
+		return ErrRequestBudgetExhausted
+	}
+
+	now := time.Now()
+	result := db.Exec(`INSERT INTO request_budgets (day, source, requests, updated_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT (day, source) DO UPDATE SET requests = request_budgets.requests + 1, updated_at = EXCLUDED.updated_at
+		WHERE request_budgets.requests < ?`,
+		budgetDay(now), models.SourceTrendyol, now, ceiling)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRequestBudgetExhausted
+	}
+	return nil
+}
+
+// GetRequestBudgetStatus returns the state of today's Trendyol request budget.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - RequestBudgetStatus: Current usage
+//   - error: Any database error
+func GetRequestBudgetStatus(db *gorm.DB) (RequestBudgetStatus, error) {
+	now := time.Now().UTC()
+	limit := requestBudgetLimit()
+	status := RequestBudgetStatus{
+		Day:             budgetDay(now),
+		Limit:           limit,
+		PriorityReserve: requestBudgetReserve(limit),
+		ResetsAt:        time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC),
+	}
+
+	var budget models.RequestBudget
+	err := db.Where("day = ? AND source = ?", status.Day, models.SourceTrendyol).First(&budget).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return status, err
+	}
+
+	status.Used = budget.Requests
+	if status.Remaining = limit - status.Used; status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	status.PriorityOnly = status.Used >= limit-status.PriorityReserve
+	status.Exhausted = status.Remaining == 0
+	return status, nil
+}
@@ -0,0 +1,399 @@
+// Package crawler implements favorite collections, user-defined folders for
+// organizing favorites
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/auth"
+	"scraper/internal/models"
+)
+
+// ErrDuplicateCollection is returned when a user already has a collection
+// with the requested name.
+var ErrDuplicateCollection = errors.New("a collection with this name already exists")
+
+// CollectionSummary is a collection with the number of favorites filed in it
+type CollectionSummary struct {
+	models.FavoriteCollection
+	Favorites int64 `json:"favorites"` // Favorites in the collection
+}
+
+// FavoriteRef identifies one of a user's favorites
+type FavoriteRef struct {
+	ProductID uint   `json:"product_id" validate:"required,productid"` // Favorited product
+	Source    string `json:"source"`                                   // Marketplace of the product, default trendyol
+}
+
+// CreateCollection creates a collection for a user.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: Owner of the collection
+//   - name: Collection name, unique per user
+//
+// Returns:
+//   - models.FavoriteCollection: The created collection
+//   - error: ErrDuplicateCollection if the name is taken, or any database error
+func CreateCollection(db *gorm.DB, userID uint, name string) (models.FavoriteCollection, error) {
+	collection := models.FavoriteCollection{UserID: userID, Name: name}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&collection)
+	if result.Error != nil {
+		return collection, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return collection, ErrDuplicateCollection
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "collection_id": collection.ID}).Info("Favorite collection created")
+	return collection, nil
+}
+
+// ListCollections returns a user's collections by name, with how many
+// favorites each holds and how many are uncategorized.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: Owner of the collections
+//
+// Returns:
+//   - []CollectionSummary: The collections
+//   - int64: Favorites not filed in any collection
+//   - error: Any database error
+func ListCollections(db *gorm.DB, userID uint) ([]CollectionSummary, int64, error) {
+	collections := []CollectionSummary{}
+	err := db.Model(&models.FavoriteCollection{}).
+		Select("favorite_collections.*, COUNT(user_favorites.id) AS favorites").
+		Joins("LEFT JOIN user_favorites ON user_favorites.collection_id = favorite_collections.id AND user_favorites.deleted_at IS NULL").
+		Where("favorite_collections.user_id = ?", userID).
+		Group("favorite_collections.id").
+		Order("favorite_collections.name").
+		Scan(&collections).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var uncategorized int64
+	if err := db.Model(&models.UserFavorite{}).Where("user_id = ? AND collection_id IS NULL", userID).Count(&uncategorized).Error; err != nil {
+		return nil, 0, err
+	}
+	return collections, uncategorized, nil
+}
+
+// getCollection loads one of a user's collections.
+//
+// Returns:
+//   - error: gorm.ErrRecordNotFound if the user has no such collection
+func getCollection(db *gorm.DB, userID, collectionID uint) (models.FavoriteCollection, error) {
+	var collection models.FavoriteCollection
+	err := db.Where("id = ? AND user_id = ?", collectionID, userID).First(&collection).Error
+	return collection, err
+}
+
+// RenameCollection renames one of a user's collections.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: Owner of the collection
+//   - collectionID: Collection to rename
+//   - name: New name, unique per user
+//
+// Returns:
+//   - models.FavoriteCollection: The renamed collection
+//   - error: gorm.ErrRecordNotFound, ErrDuplicateCollection, or any database
+//     error
+func RenameCollection(db *gorm.DB, userID, collectionID uint, name string) (models.FavoriteCollection, error) {
+	collection, err := getCollection(db, userID, collectionID)
+	if err != nil {
+		return collection, err
+	}
+	if collection.Name == name {
+		return collection, nil
+	}
+
+	var taken int64
+	if err := db.Model(&models.FavoriteCollection{}).Where("user_id = ? AND name = ?", userID, name).Count(&taken).Error; err != nil {
+		return collection, err
+	}
+	if taken > 0 {
+		return collection, ErrDuplicateCollection
+	}
+
+	collection.Name = name
+	collection.UpdatedAt = time.Now()
+	if err := db.Model(&collection).Updates(map[string]interface{}{"name": name, "updated_at": collection.UpdatedAt}).Error; err != nil {
+		return collection, err
+	}
+	return collection, nil
+}
+
+// DeleteCollection deletes one of a user's collections. Its favorites are
+// kept and become uncategorized.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: Owner of the collection
+//   - collectionID: Collection to delete
+//
+// Returns:
+//   - int64: Favorites moved to uncategorized
+//   - error: gorm.ErrRecordNotFound, or any database error
+func DeleteCollection(db *gorm.DB, userID, collectionID uint) (int64, error) {
+	var moved int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := getCollection(tx, userID, collectionID); err != nil {
+			return err
+		}
+		result := tx.Model(&models.UserFavorite{}).Where("collection_id = ?", collectionID).Update("collection_id", nil)
+		if result.Error != nil {
+			return result.Error
+		}
+		moved = result.RowsAffected
+		return tx.Delete(&models.FavoriteCollection{}, collectionID).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "collection_id": collectionID, "moved": moved}).Info("Favorite collection deleted")
+	return moved, nil
+}
+
+// MoveFavorites files some of a user's favorites under a collection.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: Owner of the favorites
+//   - collectionID: Target collection; nil moves the favorites to uncategorized
+//   - favorites: Favorites to move; products the user has not favorited are
+//     ignored
+//
+// Returns:
+//   - int64: Favorites moved
+//   - error: gorm.ErrRecordNotFound if the collection is not the user's, or
+//     any database error
+func MoveFavorites(db *gorm.DB, userID uint, collectionID *uint, favorites []FavoriteRef) (int64, error) {
+	if collectionID != nil {
+		if _, err := getCollection(db, userID, *collectionID); err != nil {
+			return 0, err
+		}
+	}
+
+	pairs := make([][]interface{}, 0, len(favorites))
+	for _, fav := range favorites {
+		pairs = append(pairs, []interface{}{fav.ProductID, fav.Source})
+	}
+	result := db.Model(&models.UserFavorite{}).
+		Where("user_id = ? AND (product_id, source) IN ?", userID, pairs).
+		Update("collection_id", collectionID)
+	return result.RowsAffected, result.Error
+}
+
+// favoriteFilterFromQuery reads the filters shared by the favorites listing
+// and export:
+//   - source: Only products from this marketplace
+//   - collection_id: A collection ID, or "uncategorized"
+//   - tag: A tag, matched case-insensitively
+//
+// Returns:
+//   - FavoriteFilter: The requested filter
+//   - error: An *apierror.Error for invalid values
+func favoriteFilterFromQuery(c echo.Context) (FavoriteFilter, error) {
+	filter := FavoriteFilter{Source: c.QueryParam("source")}
+	if filter.Source != "" {
+		if _, err := NormalizeSource(filter.Source); err != nil {
+			return filter, apierror.Invalid(err.Error())
+		}
+	}
+
+	switch value := c.QueryParam("collection_id"); value {
+	case "":
+	case "uncategorized":
+		filter.Uncategorized = true
+	default:
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return filter, apierror.Invalid("collection_id must be a collection ID or uncategorized")
+		}
+		collectionID := uint(id)
+		filter.CollectionID = &collectionID
+	}
+	filter.Tag = strings.ToLower(strings.TrimSpace(c.QueryParam("tag")))
+	return filter, nil
+}
+
+// registerCollectionHandlers sets up the favorite collection endpoints:
+// - Creating, listing, renaming and deleting collections
+// - Moving favorites between collections
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - validate: Request validator
+func registerCollectionHandlers(e *echo.Echo, db *gorm.DB, validate *validator.Validate) {
+	// collectionError maps collection errors to API errors
+	collectionError := func(err error, action string) error {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return apierror.NotFound(apierror.CodeNotFound, "Collection not found")
+		case errors.Is(err, ErrDuplicateCollection):
+			return apierror.Conflict("A collection with this name already exists")
+		}
+		return apierror.Internal("Failed to "+action, err)
+	}
+
+	// parseIDs reads the user and collection IDs from the path
+	parseIDs := func(c echo.Context) (uint, uint, error) {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return 0, 0, apierror.Invalid("Invalid user ID")
+		}
+		collectionID, err := strconv.ParseUint(c.Param("collection_id"), 10, 32)
+		if err != nil {
+			return 0, 0, apierror.Invalid("Invalid collection ID")
+		}
+		return uint(userID), uint(collectionID), nil
+	}
+
+	// bindName reads and validates a {"name"} request body
+	bindName := func(c echo.Context) (string, error) {
+		var req struct {
+			Name string `json:"name" validate:"required,max=100"` // Collection name
+		}
+		if err := c.Bind(&req); err != nil {
+			return "", apierror.Invalid("Invalid request")
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if err := validate.Struct(&req); err != nil {
+			return "", apierror.InvalidFields(err)
+		}
+		return req.Name, nil
+	}
+
+	// POST /users/:id/collections
+	// Creates a collection; names are unique per user
+	// Request body: {"name": string}
+	e.POST("/users/:id/collections", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		name, err := bindName(c)
+		if err != nil {
+			return err
+		}
+		var user models.User
+		if err := db.Select("id").First(&user, userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+			}
+			return apierror.Internal("Failed to load user", err)
+		}
+
+		collection, err := CreateCollection(db, uint(userID), name)
+		if err != nil {
+			return collectionError(err, "create collection")
+		}
+		return c.JSON(http.StatusCreated, collection)
+	})
+
+	// GET /users/:id/collections
+	// Lists the user's collections with favorite counts
+	e.GET("/users/:id/collections", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		collections, uncategorized, err := ListCollections(db, uint(userID))
+		if err != nil {
+			return apierror.Internal("Failed to list collections", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"collections":   collections,
+			"uncategorized": uncategorized,
+		})
+	})
+
+	// PUT /users/:id/collections/:collection_id
+	// Renames a collection
+	// Request body: {"name": string}
+	e.PUT("/users/:id/collections/:collection_id", func(c echo.Context) error {
+		userID, collectionID, err := parseIDs(c)
+		if err != nil {
+			return err
+		}
+		name, err := bindName(c)
+		if err != nil {
+			return err
+		}
+		collection, err := RenameCollection(db, userID, collectionID, name)
+		if err != nil {
+			return collectionError(err, "rename collection")
+		}
+		return c.JSON(http.StatusOK, collection)
+	})
+
+	// DELETE /users/:id/collections/:collection_id
+	// Deletes a collection; its favorites become uncategorized
+	e.DELETE("/users/:id/collections/:collection_id", func(c echo.Context) error {
+		userID, collectionID, err := parseIDs(c)
+		if err != nil {
+			return err
+		}
+		moved, err := DeleteCollection(db, userID, collectionID)
+		if err != nil {
+			return collectionError(err, "delete collection")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"status":                 "Collection deleted",
+			"moved_to_uncategorized": moved,
+		})
+	})
+
+	// PUT /favorites/collection
+	// Moves favorites into a collection, or to uncategorized when
+	// collection_id is null
+	// Request body: {"user_id": uint, "collection_id": uint|null,
+	//   "favorites": [{"product_id": uint, "source": string}]}
+	e.PUT("/favorites/collection", func(c echo.Context) error {
+		var req struct {
+			UserID       uint          `json:"user_id" validate:"required"`
+			CollectionID *uint         `json:"collection_id"`
+			Favorites    []FavoriteRef `json:"favorites" validate:"required,min=1,max=500,dive"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+		for i := range req.Favorites {
+			source, err := NormalizeSource(req.Favorites[i].Source)
+			if err != nil {
+				return apierror.Invalid(err.Error())
+			}
+			req.Favorites[i].Source = source
+		}
+
+		moved, err := MoveFavorites(db, req.UserID, req.CollectionID, req.Favorites)
+		if err != nil {
+			return collectionError(err, "move favorites")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"collection_id": req.CollectionID,
+			"moved":         moved,
+		})
+	})
+}
@@ -0,0 +1,309 @@
+// Package crawler implements the per-category crawl coverage checks that
+// warn when Trendyol starts returning fewer products
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// maxCoverageWindow is the most earlier crawls GET /crawl/coverage averages
+const maxCoverageWindow = 30
+
+// maxZeroYieldListed is the most zero-yield categories named in an alert
+const maxZeroYieldListed = 20
+
+// CategoryCoverage is the yield of one web category in a crawl, compared
+// with its trailing average
+type CategoryCoverage struct {
+	Category         int      `json:"category"`          // Trendyol web category ID
+	Listed           int      `json:"listed"`            // Products the category listing returned
+	Yield            int      `json:"yield"`             // Products with details: fetched, or already fetched for an earlier category
+	Failed           int      `json:"failed"`            // Product detail fetches that failed
+	ConversionFailed int      `json:"conversion_failed"` // Fetched details that did not convert
+	Error            string   `json:"error,omitempty"`   // Why the listing could not be read
+	TrailingAverage  *float64 `json:"trailing_average"`  // Mean yield in the earlier crawls, null if none covered the category
+	DropPercent      float64  `json:"drop_percent"`      // How far the yield fell below the average, 0 if it did not
+	Dropped          bool     `json:"dropped"`           // Whether the drop reaches the alert threshold
+}
+
+// CrawlCoverage is the response of GET /crawl/coverage
+type CrawlCoverage struct {
+	ReportID          uint               `json:"report_id"`          // Crawl report checked, the latest finished one
+	StartedAt         time.Time          `json:"started_at"`         // When that crawl started
+	Window            int                `json:"window"`             // Earlier crawls the averages cover
+	DropThreshold     float64            `json:"drop_threshold"`     // Drop in percent that marks a category
+	CategoriesChecked int                `json:"categories_checked"` // Categories the crawl completed
+	ZeroYield         int                `json:"zero_yield"`         // Completed categories without any product
+	ZeroYieldPercent  float64            `json:"zero_yield_percent"` // ZeroYield as a share of CategoriesChecked
+	Categories        []CategoryCoverage `json:"categories"`         // Dropped categories, or all with ?all=true
+}
+
+// yield returns the products of a category whose details were fetched.
+func (s CrawlCategoryStats) yield() int {
+	return s.Fetched + s.Deduplicated
+}
+
+// coverageDropThreshold returns the yield drop, in percent of the trailing
+// average, that marks a category.
+//
+// Environment Variables:
+//   - CRAWL_COVERAGE_DROP_PERCENT: Drop that marks a category (default: 50)
+func coverageDropThreshold() float64 {
+	percent := viper.GetFloat64("CRAWL_COVERAGE_DROP_PERCENT")
+	if percent <= 0 || percent > 100 {
+		percent = 50
+	}
+	return percent
+}
+
+// coverageWindow returns how many earlier crawls the trailing averages cover.
+//
+// Environment Variables:
+//   - CRAWL_COVERAGE_WINDOW: Earlier crawls averaged (default: 7)
+func coverageWindow() int {
+	window := viper.GetInt("CRAWL_COVERAGE_WINDOW")
+	if window < 1 || window > maxCoverageWindow {
+		window = 7
+	}
+	return window
+}
+
+// zeroYieldAlertThreshold returns the share of zero-yield categories, in
+// percent, above which a finished crawl alerts.
+//
+// Environment Variables:
+//   - CRAWL_ZERO_YIELD_ALERT_PERCENT: Alert threshold (default: 20)
+func zeroYieldAlertThreshold() float64 {
+	percent := viper.GetFloat64("CRAWL_ZERO_YIELD_ALERT_PERCENT")
+	if percent <= 0 || percent > 100 {
+		percent = 20
+	}
+	return percent
+}
+
+// categoryCoverage compares each category of a crawl with its mean yield in
+// earlier crawls. Categories where a crawl ran out of request budget are left
+// out on both sides, since their yield says nothing about Trendyol.
+//
+// Parameters:
+//   - latest: Category breakdown of the crawl to check
+//   - history: Breakdowns of earlier crawls
+//   - dropThreshold: Drop in percent that marks a category
+//
+// Returns:
+//   - []CategoryCoverage: Coverage of each completed category, in crawl order
+func categoryCoverage(latest []CrawlCategoryStats, history [][]CrawlCategoryStats, dropThreshold float64) []CategoryCoverage {
+	sums := make(map[int]int)
+	counts := make(map[int]int)
+	for _, crawl := range history {
+		for _, stats := range crawl {
+			if stats.Incomplete {
+				continue
+			}
+			sums[stats.Category] += stats.yield()
+			counts[stats.Category]++
+		}
+	}
+
+	coverage := []CategoryCoverage{}
+	for _, stats := range latest {
+		if stats.Incomplete {
+			continue
+		}
+		c := CategoryCoverage{
+			Category:         stats.Category,
+			Listed:           stats.Listed,
+			Yield:            stats.yield(),
+			Failed:           stats.Failed,
+			ConversionFailed: stats.ConversionFailed,
+			Error:            stats.Error,
+		}
+		if n := counts[stats.Category]; n > 0 {
+			avg := float64(sums[stats.Category]) / float64(n)
+			c.TrailingAverage = &avg
+			if avg > 0 && float64(c.Yield) < avg {
+				c.DropPercent = (avg - float64(c.Yield)) / avg * 100
+				c.Dropped = c.DropPercent >= dropThreshold
+			}
+		}
+		coverage = append(coverage, c)
+	}
+	return coverage
+}
+
+// zeroYieldCategories returns the completed categories of a crawl that
+// yielded no product, and how many categories were completed.
+func zeroYieldCategories(categories []CrawlCategoryStats) (zero []int, checked int) {
+	for _, stats := range categories {
+		if stats.Incomplete {
+			continue
+		}
+		checked++
+		if stats.yield() == 0 {
+			zero = append(zero, stats.Category)
+		}
+	}
+	return zero, checked
+}
+
+// decodeCrawlCategories decodes the category breakdown of a crawl report.
+func decodeCrawlCategories(report models.CrawlReport) ([]CrawlCategoryStats, error) {
+	var categories []CrawlCategoryStats
+	if len(report.Categories) == 0 {
+		return categories, nil
+	}
+	err := json.Unmarshal(report.Categories, &categories)
+	return categories, err
+}
+
+// CheckCrawlCoverage compares the latest finished crawl with the crawls
+// before it. Failed and running crawls are not compared.
+//
+// Parameters:
+//   - db: Database connection
+//   - window: Earlier crawls to average
+//
+// Returns:
+//   - *CrawlCoverage: Coverage of every completed category, nil if no crawl
+//     has finished yet
+//   - error: Any database or decoding error
+func CheckCrawlCoverage(db *gorm.DB, window int) (*CrawlCoverage, error) {
+	var reports []models.CrawlReport
+	err := db.Where("status IN ?", []string{CrawlCompleted, CrawlBudgetExhausted}).
+		Order("started_at DESC, id DESC").
+		Limit(window + 1).
+		Find(&reports).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(reports) == 0 {
+		return nil, nil
+	}
+
+	latest, err := decodeCrawlCategories(reports[0])
+	if err != nil {
+		return nil, fmt.Errorf("decode crawl report %d: %w", reports[0].ID, err)
+	}
+	history := make([][]CrawlCategoryStats, 0, len(reports)-1)
+	for _, report := range reports[1:] {
+		categories, err := decodeCrawlCategories(report)
+		if err != nil {
+			return nil, fmt.Errorf("decode crawl report %d: %w", report.ID, err)
+		}
+		history = append(history, categories)
+	}
+
+	threshold := coverageDropThreshold()
+	zero, checked := zeroYieldCategories(latest)
+	coverage := &CrawlCoverage{
+		ReportID:          reports[0].ID,
+		StartedAt:         reports[0].StartedAt,
+		Window:            len(history),
+		DropThreshold:     threshold,
+		CategoriesChecked: checked,
+		ZeroYield:         len(zero),
+		Categories:        categoryCoverage(latest, history, threshold),
+	}
+	if checked > 0 {
+		coverage.ZeroYieldPercent = float64(len(zero)) / float64(checked) * 100
+	}
+	return coverage, nil
+}
+
+// checkZeroYield alerts the ops Slack channel when more than
+// CRAWL_ZERO_YIELD_ALERT_PERCENT of a finished crawl's categories yielded no
+// product, which usually means Trendyol changed its API or started rejecting
+// our requests.
+//
+// Parameters:
+//   - report: The finished crawl's report
+//   - categories: Its category breakdown
+func checkZeroYield(report models.CrawlReport, categories []CrawlCategoryStats) {
+	zero, checked := zeroYieldCategories(categories)
+	if checked == 0 {
+		return
+	}
+	percent := float64(len(zero)) / float64(checked) * 100
+	threshold := zeroYieldAlertThreshold()
+	if percent <= threshold {
+		return
+	}
+
+	listed := make([]string, 0, maxZeroYieldListed)
+	sort.Ints(zero)
+	for i, wc := range zero {
+		if i == maxZeroYieldListed {
+			listed = append(listed, fmt.Sprintf("and %d more", len(zero)-maxZeroYieldListed))
+			break
+		}
+		listed = append(listed, strconv.Itoa(wc))
+	}
+	text := fmt.Sprintf(":warning: Crawl report %d: %d of %d categories (%.1f%%) yielded no products, above the %.1f%% threshold. Trendyol may have changed its API or be rejecting our requests.\nCategories: %s",
+		report.ID, len(zero), checked, percent, threshold, strings.Join(listed, ", "))
+	logrus.WithFields(logrus.Fields{
+		"report_id":  report.ID,
+		"zero_yield": len(zero),
+		"categories": checked,
+	}).Warn("Crawl yielded no products for many categories")
+	if err := sendOpsAlert(text); err != nil {
+		logrus.WithError(err).WithField("alert", text).Error("Failed to send crawl coverage alert")
+	}
+}
+
+// registerCrawlCoverageHandlers sets up the crawl coverage endpoint.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerCrawlCoverageHandlers(e *echo.Echo, db *gorm.DB) {
+	// GET /crawl/coverage
+	// Compares each category's yield in the latest finished crawl with its
+	// average over the crawls before it and lists the categories whose yield
+	// dropped by CRAWL_COVERAGE_DROP_PERCENT or more
+	// Query parameters:
+	//   - window: Earlier crawls to average, 1-30 (default CRAWL_COVERAGE_WINDOW)
+	//   - all: "true" lists every completed category
+	e.GET("/crawl/coverage", func(c echo.Context) error {
+		window := coverageWindow()
+		if raw := c.QueryParam("window"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxCoverageWindow {
+				return apierror.Invalid("window must be between 1 and 30")
+			}
+			window = n
+		}
+		all := c.QueryParam("all") == "true"
+
+		coverage, err := CheckCrawlCoverage(db.WithContext(c.Request().Context()), window)
+		if err != nil {
+			return apierror.Internal("Failed to check crawl coverage", err)
+		}
+		if coverage == nil {
+			return apierror.NotFound(apierror.CodeNotFound, "No finished crawl yet")
+		}
+		if !all {
+			dropped := []CategoryCoverage{}
+			for _, category := range coverage.Categories {
+				if category.Dropped {
+					dropped = append(dropped, category)
+				}
+			}
+			coverage.Categories = dropped
+		}
+		return c.JSON(http.StatusOK, coverage)
+	})
+}
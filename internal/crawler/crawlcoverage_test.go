@@ -0,0 +1,45 @@
+package crawler
+
+import "testing"
+
+func TestCategoryCoverage(t *testing.T) {
+	history := [][]CrawlCategoryStats{
+		{{Category: 1, Fetched: 40}, {Category: 2, Fetched: 20}, {Category: 3, Fetched: 10}},
+		{{Category: 1, Fetched: 60}, {Category: 2, Fetched: 10, Deduplicated: 10}, {Category: 3, Incomplete: true}},
+	}
+	latest := []CrawlCategoryStats{
+		{Category: 1, Listed: 50, Fetched: 45},
+		{Category: 2, Listed: 20, ConversionFailed: 20},
+		{Category: 3, Fetched: 4},
+		{Category: 4, Fetched: 7},
+		{Category: 5, Incomplete: true},
+	}
+
+	coverage := categoryCoverage(latest, history, 50)
+	if len(coverage) != 4 {
+		t.Fatalf("got %d categories, want 4 (incomplete ones left out)", len(coverage))
+	}
+	want := []struct {
+		avg     float64
+		drop    float64
+		dropped bool
+	}{
+		{avg: 50, drop: 10},
+		{avg: 20, drop: 100, dropped: true},
+		{avg: 10, drop: 60, dropped: true},
+	}
+	for i, w := range want {
+		c := coverage[i]
+		if c.TrailingAverage == nil || *c.TrailingAverage != w.avg || c.DropPercent != w.drop || c.Dropped != w.dropped {
+			t.Errorf("category %d: avg %v, drop %v, dropped %v; want %v, %v, %v", c.Category, c.TrailingAverage, c.DropPercent, c.Dropped, w.avg, w.drop, w.dropped)
+		}
+	}
+	if c := coverage[3]; c.TrailingAverage != nil || c.Dropped {
+		t.Errorf("new category 4 has an average or is dropped: %+v", c)
+	}
+
+	zero, checked := zeroYieldCategories(latest)
+	if checked != 4 || len(zero) != 1 || zero[0] != 2 {
+		t.Errorf("zeroYieldCategories = %v, %d; want [2], 4", zero, checked)
+	}
+}
@@ -0,0 +1,243 @@
+// Package crawler implements crawls of an explicit list of product IDs
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+	"scraper/internal/models"
+	"scraper/internal/timeout"
+	"scraper/pkg/httpclient"
+)
+
+// Limits of POST /crawl/products
+const (
+	maxCrawlProductIDs     = 500 // Product IDs per request
+	crawlProductsInlineMax = 10  // Lists up to this long are crawled within the request
+)
+
+// ProductFailure is a product a POST /crawl/products job skipped
+type ProductFailure struct {
+	ProductID int    `json:"product_id"` // Requested product ID
+	Error     string `json:"error"`      // Why the product was not fetched
+}
+
+// parseCrawlProductIDs checks the IDs of a POST /crawl/products request and
+// drops duplicates, keeping the first occurrence.
+//
+// Parameters:
+//   - ids: Requested product IDs
+//
+// Returns:
+//   - []int: The IDs to crawl, in request order
+//   - error: An apierror for empty, oversized or invalid lists
+func parseCrawlProductIDs(ids []int) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, apierror.Invalid("product_ids must not be empty")
+	}
+	if len(ids) > maxCrawlProductIDs {
+		return nil, apierror.Invalid(fmt.Sprintf("product_ids may list at most %d products", maxCrawlProductIDs))
+	}
+
+	seen := make(map[int]bool, len(ids))
+	unique := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			return nil, apierror.Invalid("product_ids must be positive integers")
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	return unique, nil
+}
+
+// runProductCrawl fetches the job's products one by one, pausing
+// crawlFetchDelay between requests like a category crawl, and publishes the
+// fetched ones to Kafka the way /fetch does. Products that cannot be fetched
+// are skipped, listed in the job's FailedProducts and queued for a retry.
+// Products left when the request budget runs out or ctx ends are listed as
+// failed too; the products fetched before are still published. A shutdown
+// ends the crawl like ctx, and batches Kafka does not take are then spooled
+// to the outbox.
+//
+// Parameters:
+//   - ctx: Context of the crawl; the request's for crawls run within it
+//   - db: Database connection
+//   - producer: Kafka producer the products are published with
+//   - job: The queued job; only its parameters are read
+func runProductCrawl(ctx context.Context, db *gorm.DB, producer sarama.SyncProducer, job FetchJob) {
+	ctx, done := crawls.start(ctx)
+	defer done()
+
+	now := time.Now()
+	fetchJobs.update(job.ID, func(j *FetchJob) {
+		j.State = JobRunning
+		j.StartedAt = &now
+	})
+	logrus.WithFields(logrus.Fields{
+		"job_id":   job.ID,
+		"products": len(job.ProductIDs),
+	}).Info("Starting product crawl")
+
+	trendyol, _ := FetcherFor(models.SourceTrendyol)
+	skip := func(productID int, err error) {
+		fetchJobs.update(job.ID, func(j *FetchJob) {
+			j.DetailFailures++
+			j.FailedProducts = append(j.FailedProducts, ProductFailure{ProductID: productID, Error: err.Error()})
+		})
+	}
+
+	var products []models.Product
+	budgetExhausted := false
+	for i, productID := range job.ProductIDs {
+		if budgetExhausted {
+			skip(productID, ErrRequestBudgetExhausted)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			skip(productID, err)
+			continue
+		}
+
+		// Respect rate limits
+		if i > 0 {
+			if err := timeout.Sleep(ctx, crawlFetchDelay); err != nil {
+				logrus.WithError(err).WithField("remaining", len(job.ProductIDs)-i).Warn("Stopping product crawl, request ended")
+				skip(productID, err)
+				continue
+			}
+		}
+		if err := ReserveRequest(db, models.SourceTrendyol, false); err != nil {
+			logrus.WithError(err).WithField("remaining", len(job.ProductIDs)-i).Warn("Stopping product crawl, no request budget left")
+			budgetExhausted = true
+			skip(productID, err)
+			continue
+		}
+
+		logrus.WithField("product_id", productID).Info("Fetching product details")
+		detail, err := trendyol.FetchDetails(ctx, productID)
+		if err == nil && detail == nil {
+			err = fmt.Errorf("no product details returned for product %d", productID)
+		}
+		var product *models.Product
+		if err == nil {
+			product, err = trendyol.ToProduct(productID, detail)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("product_id", productID).Error("Failed to fetch product details")
+			var fetchErr *FetchError
+			if errors.As(err, &fetchErr) && ctx.Err() == nil {
+				// Queue transport failures for a retry like a category crawl
+				if _, err := RecordFetchFailure(db, models.SourceTrendyol, productID, FetchSourceCrawl, err); err != nil {
+					logrus.WithError(err).WithField("product_id", productID).Error("Failed to record fetch failure")
+				}
+			}
+			skip(productID, err)
+			continue
+		}
+		if err := ClearFetchRetry(db, models.SourceTrendyol, productID); err != nil {
+			logrus.WithError(err).WithField("product_id", productID).Error("Failed to clear fetch retry")
+		}
+		products = append(products, *product)
+		fetchJobs.update(job.ID, func(j *FetchJob) { j.ProductsFetched++ })
+	}
+
+	// Publish products in batches; failed batches are reported, not fatal
+	summary := publishProducts(ctx, producer, products, job.BatchSize)
+	if crawls.stopping() {
+		spoolFailedBatches(db, &summary)
+	}
+	for _, batch := range summary.Failed {
+		fetchJobs.addError(job.ID, fmt.Sprintf("batch %d: %s", batch.Index, batch.Error))
+	}
+	fetchJobs.update(job.ID, func(j *FetchJob) {
+		j.Summary = &summary
+		j.BudgetExhausted = budgetExhausted
+	})
+	fetchJobs.finish(job.ID, nil)
+
+	logrus.WithFields(logrus.Fields{
+		"job_id":  job.ID,
+		"fetched": len(products),
+		"skipped": len(job.ProductIDs) - len(products),
+		"sent":    len(summary.Sent),
+		"failed":  len(summary.Failed),
+	}).Info("Product crawl finished")
+}
+
+// registerCrawlProductsHandlers sets up the product ID crawl endpoint.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - producer: Kafka producer the products are published with
+//   - validate: Validator for request bodies
+func registerCrawlProductsHandlers(e *echo.Echo, db *gorm.DB, producer sarama.SyncProducer, validate *validator.Validate) {
+	// POST /crawl/products
+	// Fetches the listed Trendyol products and publishes them to the PRODUCTS
+	// topic like /fetch, for refreshing a few known products without
+	// crawling whole categories. Runs as a fetch job, so it returns 409 while
+	// another fetch job runs and 429 once only the priority request budget is
+	// left. Lists of up to crawlProductsInlineMax IDs are crawled within the
+	// request and answered with the finished job; longer lists return 202
+	// and are followed at GET /fetch/jobs/:id. Products that could not be
+	// fetched are listed in failed_products. An inline crawl stops at the
+	// request deadline and returns 503; the job keeps the products fetched
+	// until then.
+	// Request body: {"product_ids": [123, 456]}, at most 500 IDs
+	e.POST("/crawl/products", func(c echo.Context) error {
+		var req struct {
+			ProductIDs []int `json:"product_ids" validate:"required"` // Trendyol content IDs
+		}
+		if err := c.Bind(&req); err != nil {
+			logrus.WithError(err).Error("Invalid product crawl request")
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(req); err != nil {
+			return apierror.Invalid("product_ids is required")
+		}
+		productIDs, err := parseCrawlProductIDs(req.ProductIDs)
+		if err != nil {
+			return err
+		}
+
+		job := &FetchJob{
+			ID:         httpclient.NewCorrelationID(),
+			Live:       true,
+			ProductIDs: productIDs,
+			BatchSize:  defaultFetchBatchSize(),
+			APIKeyID:   apikey.KeyID(c),
+		}
+		if err := enqueueFetchJob(db, job); err != nil {
+			return err
+		}
+
+		// Long lists take minutes at one request per crawlFetchDelay
+		if len(productIDs) > crawlProductsInlineMax {
+			go runProductCrawl(context.Background(), db, producer, *job)
+			return fetchJobAccepted(c, job)
+		}
+
+		ctx := c.Request().Context()
+		runProductCrawl(ctx, db, producer, *job)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		snapshot, _ := fetchJobs.get(job.ID)
+		return c.JSON(http.StatusOK, snapshot)
+	}, requireAPIKey())
+}
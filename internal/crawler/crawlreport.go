@@ -0,0 +1,327 @@
+// Package crawler implements the persisted crawl reports
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// Crawl report statuses
+const (
+	CrawlRunning         = "running"
+	CrawlCompleted       = "completed"
+	CrawlBudgetExhausted = "budget_exhausted"
+	CrawlFailed          = "failed"
+	CrawlCancelled       = "cancelled" // Stopped by a shutdown; the products fetched until then were published
+)
+
+// Page size bounds of GET /crawl/reports
+const (
+	defaultCrawlReportLimit = 20
+	maxCrawlReportLimit     = 100
+)
+
+// CrawlCategoryStats is the breakdown of one web category in a crawl report
+type CrawlCategoryStats struct {
+	Category         int    `json:"category"`             // Trendyol web category ID
+	Listed           int    `json:"listed"`               // Products the category listing returned
+	Fetched          int    `json:"fetched"`              // Product details fetched and written
+	Failed           int    `json:"failed"`               // Product detail fetches that failed
+	ConversionFailed int    `json:"conversion_failed"`    // Fetched details that did not convert into a product
+	Deduplicated     int    `json:"deduplicated"`         // Products already fetched for an earlier category
+	Error            string `json:"error,omitempty"`      // Why the listing could not be read
+	Incomplete       bool   `json:"incomplete,omitempty"` // The request budget ran out before the category was done
+}
+
+// crawlRecorder keeps the report of a running crawl up to date. A nil
+// recorder ignores every call, so code shared with mock runs needs no checks.
+type crawlRecorder struct {
+	db         *gorm.DB
+	report     models.CrawlReport
+	categories []CrawlCategoryStats
+	seen       map[uint]bool   // Products fetched so far, for deduplication
+	out        *countingWriter // Writer of data.json, for BytesWritten
+	jobID      string          // Fetch job whose progress mirrors the report, empty for none
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer.
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// startCrawlReport creates the report of a live crawl.
+//
+// Parameters:
+//   - db: Database connection
+//   - correlationID: Correlation ID of the crawl's requests
+//   - out: Writer of data.json, whose byte count is reported
+//
+// Returns:
+//   - *crawlRecorder: Recorder of the crawl; progress is still tracked in
+//     memory if the report could not be stored
+func startCrawlReport(db *gorm.DB, correlationID string, out *countingWriter) *crawlRecorder {
+	r := &crawlRecorder{
+		db:   db,
+		seen: make(map[uint]bool),
+		out:  out,
+		report: models.CrawlReport{
+			CorrelationID: correlationID,
+			Status:        CrawlRunning,
+			StartedAt:     time.Now(),
+		},
+	}
+	r.save()
+	return r
+}
+
+// ID returns the stored report's ID, 0 for a nil recorder or an unsaved report.
+func (r *crawlRecorder) ID() uint {
+	if r == nil {
+		return 0
+	}
+	return r.report.ID
+}
+
+// current returns the stats of the category being crawled.
+func (r *crawlRecorder) current() *CrawlCategoryStats {
+	return &r.categories[len(r.categories)-1]
+}
+
+// startCategory records that the crawl moved on to a web category.
+func (r *crawlRecorder) startCategory(wc int) {
+	if r == nil {
+		return
+	}
+	r.report.CategoriesAttempted++
+	r.categories = append(r.categories, CrawlCategoryStats{Category: wc})
+	r.save()
+}
+
+// categoryListed records the number of products a category listing returned,
+// or why the listing failed when err is set.
+func (r *crawlRecorder) categoryListed(listed int, err error) {
+	if r == nil || len(r.categories) == 0 {
+		return
+	}
+	r.current().Listed = listed
+	if err != nil {
+		r.current().Error = err.Error()
+		fetchJobs.addError(r.jobID, fmt.Sprintf("category %d: %v", r.current().Category, err))
+	}
+	r.save()
+}
+
+// duplicate reports whether a product was already fetched in this crawl and
+// counts it if so.
+func (r *crawlRecorder) duplicate(productID uint) bool {
+	if r == nil || !r.seen[productID] {
+		return false
+	}
+	r.report.Deduplicated++
+	if len(r.categories) > 0 {
+		r.current().Deduplicated++
+	}
+	r.save()
+	return true
+}
+
+// productFetched records a product written to data.json.
+func (r *crawlRecorder) productFetched(productID uint) {
+	if r == nil {
+		return
+	}
+	r.seen[productID] = true
+	r.report.ProductsFetched++
+	if len(r.categories) > 0 {
+		r.current().Fetched++
+	}
+	r.save()
+}
+
+// productFailed records a product whose details could not be fetched.
+func (r *crawlRecorder) productFailed(productID uint, err error) {
+	if r == nil {
+		return
+	}
+	fetchJobs.addError(r.jobID, fmt.Sprintf("product %d: %v", productID, err))
+	r.report.DetailFailures++
+	if len(r.categories) > 0 {
+		r.current().Failed++
+	}
+	r.save()
+}
+
+// productConversionFailed records a product whose details were fetched but
+// did not convert into a product, e.g. an empty response.
+func (r *crawlRecorder) productConversionFailed(productID uint, err error) {
+	if r == nil {
+		return
+	}
+	fetchJobs.addError(r.jobID, fmt.Sprintf("product %d: %v", productID, err))
+	r.report.ConversionFailures++
+	if len(r.categories) > 0 {
+		r.current().ConversionFailed++
+	}
+	r.save()
+}
+
+// budgetExhausted records that the crawl stopped in the current category for
+// lack of request budget, which keeps the category out of coverage checks.
+func (r *crawlRecorder) budgetExhausted() {
+	if r == nil || len(r.categories) == 0 {
+		return
+	}
+	r.current().Incomplete = true
+	r.save()
+}
+
+// published records the outcome of publishing the crawled products.
+func (r *crawlRecorder) published(summary PublishSummary) {
+	if r == nil {
+		return
+	}
+	r.report.BatchesPublished = len(summary.Sent)
+	r.report.BatchesFailed = len(summary.Failed)
+	r.save()
+}
+
+// finish closes the report with its final status. A non-nil err marks the
+// crawl failed.
+func (r *crawlRecorder) finish(status string, err error) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.report.Status = status
+	r.report.FinishedAt = &now
+	if err != nil {
+		r.report.Status = CrawlFailed
+		r.report.Error = err.Error()
+	}
+	r.save()
+	logrus.WithFields(logrus.Fields{
+		"report_id":       r.report.ID,
+		"status":          r.report.Status,
+		"categories":      r.report.CategoriesAttempted,
+		"fetched":         r.report.ProductsFetched,
+		"detail_failures": r.report.DetailFailures,
+		"conversions":     r.report.ConversionFailures,
+		"deduplicated":    r.report.Deduplicated,
+	}).Info("Crawl finished")
+	// A cancelled crawl stopped early, so a low yield says nothing
+	if err == nil && status != CrawlCancelled {
+		checkZeroYield(r.report, r.categories)
+	}
+}
+
+// save writes the current state of the report. Failures are logged and do
+// not stop the crawl.
+func (r *crawlRecorder) save() {
+	if r.out != nil {
+		r.report.BytesWritten = r.out.n
+	}
+	categories, err := json.Marshal(r.categories)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode crawl categories")
+		return
+	}
+	r.report.Categories = datatypes.JSON(categories)
+	if err := r.db.Save(&r.report).Error; err != nil {
+		logrus.WithError(err).WithField("report_id", r.report.ID).Error("Failed to save crawl report")
+	}
+	listed := 0
+	for _, category := range r.categories {
+		listed += category.Listed
+	}
+	fetchJobs.update(r.jobID, func(job *FetchJob) {
+		job.CategoriesProcessed = r.report.CategoriesAttempted
+		job.ProductsListed = listed
+		job.ProductsFetched = r.report.ProductsFetched
+		job.DetailFailures = r.report.DetailFailures
+	})
+}
+
+// ListCrawlReports returns the most recent crawl reports without their
+// per-category breakdown.
+//
+// Parameters:
+//   - db: Database connection
+//   - limit: Reports to return
+//
+// Returns:
+//   - []models.CrawlReport: Reports, newest first
+//   - error: Any database error
+func ListCrawlReports(db *gorm.DB, limit int) ([]models.CrawlReport, error) {
+	reports := []models.CrawlReport{}
+	err := db.Omit("categories").Order("started_at DESC, id DESC").Limit(limit).Find(&reports).Error
+	return reports, err
+}
+
+// registerCrawlReportHandlers sets up the crawl report endpoints.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerCrawlReportHandlers(e *echo.Echo, db *gorm.DB) {
+	// GET /crawl/reports
+	// Lists the most recent live crawls, newest first
+	// Query parameters:
+	//   - limit: Reports to return, 1-100 (default 20)
+	e.GET("/crawl/reports", func(c echo.Context) error {
+		limit := defaultCrawlReportLimit
+		if raw := c.QueryParam("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxCrawlReportLimit {
+				return apierror.Invalid("limit must be between 1 and 100")
+			}
+			limit = n
+		}
+
+		reports, err := ListCrawlReports(db, limit)
+		if err != nil {
+			return apierror.Internal("Failed to list crawl reports", err)
+		}
+		return c.JSON(http.StatusOK, reports)
+	})
+
+	// GET /crawl/reports/:id
+	// Returns a crawl report with its per-category breakdown; a running
+	// crawl shows its progress so far
+	e.GET("/crawl/reports/:id", func(c echo.Context) error {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid report ID")
+		}
+
+		var report models.CrawlReport
+		err = db.First(&report, id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeNotFound, "Crawl report not found")
+		}
+		if err != nil {
+			return apierror.Internal("Failed to load crawl report", err)
+		}
+		return c.JSON(http.StatusOK, report)
+	})
+}
@@ -0,0 +1,416 @@
+// Package crawler implements the notification debugging endpoint
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/emailaddr"
+	"scraper/internal/models"
+	"scraper/internal/pricing"
+)
+
+// Rows listed per section of the notification debug response
+const (
+	debugPriceLogLimit     = 20
+	debugNotificationLimit = 20
+	debugDeliveryLimit     = 10
+)
+
+// NotificationDebug is the response of GET /debug/product/:id/notification-state.
+// Every section is loaded on its own: a section that could not be loaded is
+// null and its error is listed in Errors, the others are still returned.
+type NotificationDebug struct {
+	ProductID     uint                `json:"product_id"`
+	Source        string              `json:"source"`
+	UserID        uint                `json:"user_id"`
+	Product       *DebugProduct       `json:"product"`          // Stored state of the product
+	Favorite      *DebugFavorite      `json:"favorite"`         // The user's favorite of the product
+	Preferences   *Preferences        `json:"preferences"`      // The user's notification preferences and snooze
+	PriceHistory  []PricePoint        `json:"price_history"`    // Recent price and stock changes, newest first
+	Notifications *DebugNotifications `json:"notifications"`    // Notifications about the product for the user
+	Scheduler     *DebugScheduler     `json:"scheduler"`        // Whether the scheduler refreshes the product
+	Blockers      []string            `json:"blockers"`         // Why the user would not be notified right now, from the loaded sections
+	Errors        map[string]string   `json:"errors,omitempty"` // Sections that failed to load, by section name
+}
+
+// DebugProduct is the product section of a notification debug response
+type DebugProduct struct {
+	IsActive       bool          `json:"is_active"`
+	IsFavorite     bool          `json:"is_favorite"`     // Marked for the favorites scheduler
+	Price          float64       `json:"price"`           // Last stored price
+	Stock          *ProductStock `json:"stock"`           // Last stored stock, null if unknown
+	DealScore      *float64      `json:"deal_score"`      // Null for sparse history
+	LastSeenAt     *time.Time    `json:"last_seen_at"`    // Last time a crawl or refresh returned the product
+	UpdatedAt      time.Time     `json:"updated_at"`      // Last time the row changed
+	DiscontinuedAt *time.Time    `json:"discontinued_at"` // Set by the last-seen job
+	FetchRetry     *DebugRetry   `json:"fetch_retry"`     // Pending or failed refetch, null if the last fetch worked
+}
+
+// DebugRetry is the fetch retry queue entry of a product
+type DebugRetry struct {
+	ID            uint      `json:"id"`     // Linked from scheduler run outcomes
+	Status        string    `json:"status"` // "pending" or "failed"
+	Attempts      int       `json:"attempts"`
+	Error         string    `json:"error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// DebugFavorite is the favorite section of a notification debug response
+type DebugFavorite struct {
+	Favorited      bool       `json:"favorited"`
+	AddedAt        *time.Time `json:"added_at"`
+	PriceWhenAdded *float64   `json:"price_when_added"`
+	CollectionID   *uint      `json:"collection_id"`
+}
+
+// DebugNotification is a notification about the product for the user
+type DebugNotification struct {
+	Type     string    `json:"type"`      // e.g. "price_drop" or "discontinued"
+	Status   string    `json:"status"`    // "sent" or "suppressed"
+	Reason   string    `json:"reason"`    // Why a notification was suppressed
+	OldPrice float64   `json:"old_price"` // Price drops only
+	NewPrice float64   `json:"new_price"` // Price drops only
+	At       time.Time `json:"at"`
+}
+
+// DebugDelivery is an email recently sent to the user, about any product
+type DebugDelivery struct {
+	Subject string    `json:"subject"`
+	Status  string    `json:"status"` // "sent", "failed" or "dry_run"
+	Error   string    `json:"error"`
+	At      time.Time `json:"at"`
+}
+
+// DebugNotifications is the notification section of a notification debug
+// response. Only one-time notifications and snoozed ones are stored per
+// product; price drop emails show up in Deliveries.
+type DebugNotifications struct {
+	Recent     []DebugNotification `json:"recent"`     // Newest first
+	Deliveries []DebugDelivery     `json:"deliveries"` // Newest first
+}
+
+// DebugScheduler is the scheduler section of a notification debug response
+type DebugScheduler struct {
+	Paused       bool                    `json:"paused"`
+	LastRunAt    *time.Time              `json:"last_run_at"`
+	Due          bool                    `json:"due"`           // Refreshed by the next run
+	Watchers     int64                   `json:"watchers"`      // Users who favorited the product, 0 when not scheduled
+	Position     int64                   `json:"position"`      // 1-based place in the run order, 0 when not scheduled
+	Score        float64                 `json:"score"`         // Priority score deciding the run order, 0 when not scheduled
+	PastCutOff   bool                    `json:"past_cut_off"`  // Beyond FAVORITES_MAX_PRODUCTS_PER_RUN, so left for a later run
+	PriorityOnly bool                    `json:"priority_only"` // Only the first TRENDYOL_BUDGET_PRIORITY_PRODUCTS are refreshed today
+	RecentRuns   []DebugSchedulerOutcome `json:"recent_runs"`   // The product's outcome in the latest runs that considered it, newest first
+}
+
+// GetNotificationDebug gathers everything that decides whether a user is
+// notified about a product. Sections are loaded independently, so one
+// failing query only blanks its own section.
+//
+// Parameters:
+//   - db: Database connection
+//   - productID: Product the user asked about
+//   - source: Marketplace of the product
+//   - userID: User who expected a notification
+//
+// Returns:
+//   - NotificationDebug: The sections that could be loaded, with the errors of
+//     the others
+func GetNotificationDebug(db *gorm.DB, productID uint, source string, userID uint) NotificationDebug {
+	debug := NotificationDebug{ProductID: productID, Source: source, UserID: userID, Blockers: []string{}}
+	fail := func(section string, err error) {
+		if debug.Errors == nil {
+			debug.Errors = make(map[string]string)
+		}
+		debug.Errors[section] = err.Error()
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"product_id": productID,
+				"user_id":    userID,
+				"section":    section,
+			}).Error("Failed to load notification debug section")
+		}
+	}
+
+	if product, err := debugProduct(db, productID, source); err != nil {
+		fail("product", err)
+	} else {
+		debug.Product = product
+	}
+	if favorite, err := debugFavorite(db, productID, source, userID); err != nil {
+		fail("favorite", err)
+	} else {
+		debug.Favorite = favorite
+	}
+	if prefs, err := GetPreferences(db, userID); err != nil {
+		fail("preferences", err)
+	} else {
+		debug.Preferences = &prefs
+	}
+	if history, err := debugPriceHistory(db, productID, source); err != nil {
+		fail("price_history", err)
+	} else {
+		debug.PriceHistory = history
+	}
+	if notifications, err := debugNotifications(db, productID, source, userID); err != nil {
+		fail("notifications", err)
+	} else {
+		debug.Notifications = notifications
+	}
+	if scheduler, err := debugScheduler(db, productID, source); err != nil {
+		fail("scheduler", err)
+	} else {
+		debug.Scheduler = scheduler
+	}
+
+	debug.Blockers = notificationBlockers(debug)
+	return debug
+}
+
+// debugProduct loads the product section.
+func debugProduct(db *gorm.DB, productID uint, source string) (*DebugProduct, error) {
+	var product models.Product
+	if err := db.Where("id = ? AND source = ?", productID, source).First(&product).Error; err != nil {
+		return nil, err
+	}
+	section := &DebugProduct{
+		IsActive:       product.IsActive,
+		IsFavorite:     product.IsFavorite,
+		Price:          product.Price,
+		Stock:          NewProductDetail(product).Stock,
+		DealScore:      product.DealScore,
+		LastSeenAt:     product.LastSeenAt,
+		UpdatedAt:      product.UpdatedAt,
+		DiscontinuedAt: product.DiscontinuedAt,
+	}
+
+	var retry models.FetchRetry
+	err := db.Where("product_id = ? AND product_source = ?", productID, source).First(&retry).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		section.FetchRetry = &DebugRetry{
+			ID:            retry.ID,
+			Status:        retry.Status,
+			Attempts:      retry.Attempts,
+			Error:         retry.Error,
+			NextAttemptAt: retry.NextAttemptAt,
+		}
+	}
+	return section, nil
+}
+
+// debugFavorite loads the favorite section; a product the user did not
+// favorite is reported as not favorited rather than as an error.
+func debugFavorite(db *gorm.DB, productID uint, source string, userID uint) (*DebugFavorite, error) {
+	var favorite models.UserFavorite
+	err := db.Where("user_id = ? AND product_id = ? AND source = ?", userID, productID, source).First(&favorite).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &DebugFavorite{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DebugFavorite{
+		Favorited:      true,
+		AddedAt:        &favorite.AddedAt,
+		PriceWhenAdded: favorite.PriceWhenAdded,
+		CollectionID:   favorite.CollectionID,
+	}, nil
+}
+
+// debugPriceHistory loads the most recent price and stock changes.
+func debugPriceHistory(db *gorm.DB, productID uint, source string) ([]PricePoint, error) {
+	var entries []models.PriceStockLog
+	err := db.Where("product_id = ? AND source = ?", productID, source).
+		Order("change_time DESC, id DESC").
+		Limit(debugPriceLogLimit).
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	points := make([]PricePoint, 0, len(entries))
+	for _, entry := range entries {
+		points = append(points, newPricePoint(entry))
+	}
+	return points, nil
+}
+
+// debugNotifications loads the one-time and snoozed notifications about the
+// product for the user, and the emails the user was sent lately.
+func debugNotifications(db *gorm.DB, productID uint, source string, userID uint) (*DebugNotifications, error) {
+	section := &DebugNotifications{Recent: []DebugNotification{}, Deliveries: []DebugDelivery{}}
+
+	var history []models.NotificationHistory
+	err := db.Where("user_id = ? AND product_id = ? AND source = ?", userID, productID, source).
+		Order("sent_at DESC").
+		Limit(debugNotificationLimit).
+		Find(&history).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range history {
+		section.Recent = append(section.Recent, DebugNotification{Type: h.Type, Status: "sent", At: h.SentAt})
+	}
+
+	var suppressed []models.SuppressedNotification
+	err = db.Where("user_id = ? AND product_id = ? AND source = ?", userID, productID, source).
+		Order("created_at DESC").
+		Limit(debugNotificationLimit).
+		Find(&suppressed).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range suppressed {
+		section.Recent = append(section.Recent, DebugNotification{
+			Type:     s.Type,
+			Status:   "suppressed",
+			Reason:   "notifications snoozed",
+			OldPrice: s.OldPrice,
+			NewPrice: s.NewPrice,
+			At:       s.CreatedAt,
+		})
+	}
+	sort.SliceStable(section.Recent, func(i, j int) bool { return section.Recent[i].At.After(section.Recent[j].At) })
+	if len(section.Recent) > debugNotificationLimit {
+		section.Recent = section.Recent[:debugNotificationLimit]
+	}
+
+	// Deliveries are logged by normalized address, not by product
+	var user models.User
+	if err := db.Select("id", "email").First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	var logs []models.NotificationLog
+	err = db.Where("recipient = ?", emailaddr.Normalize(user.Email)).
+		Order("created_at DESC").
+		Limit(debugDeliveryLimit).
+		Find(&logs).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range logs {
+		section.Deliveries = append(section.Deliveries, DebugDelivery{Subject: l.Subject, Status: l.Status, Error: l.Error, At: l.CreatedAt})
+	}
+	return section, nil
+}
+
+// debugScheduler reports whether the next favorites scheduler run refreshes
+// the product, mirroring the scheduler's own ranking and cut-off.
+func debugScheduler(db *gorm.DB, productID uint, source string) (*DebugScheduler, error) {
+	state, err := GetSchedulerState(db, SchedulerFavorites)
+	if err != nil {
+		return nil, err
+	}
+	budget, err := GetRequestBudgetStatus(db)
+	if err != nil {
+		return nil, err
+	}
+	section := &DebugScheduler{Paused: state.Paused, LastRunAt: state.LastRunAt, PriorityOnly: budget.PriorityOnly}
+	if section.RecentRuns, err = productSchedulerOutcomes(db, productID, source, debugSchedulerRunLimit); err != nil {
+		return nil, err
+	}
+
+	// Rank the scheduled products like the scheduler and pick this one
+	ranked, err := RankScheduledProducts(db, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range ranked {
+		if entry.ID != productID || entry.Source != source {
+			continue
+		}
+		section.Watchers = entry.Watchers
+		section.Position = entry.Position
+		section.Score = entry.Score
+		section.PastCutOff = entry.Position > int64(MaxProductsPerRun())
+		section.Due = !state.Paused && !section.PastCutOff && (!budget.PriorityOnly || entry.Position <= int64(PriorityProductCount()))
+	}
+	return section, nil
+}
+
+// notificationBlockers lists what keeps the user from being notified about
+// the product right now. Sections that failed to load are skipped.
+func notificationBlockers(debug NotificationDebug) []string {
+	blockers := []string{}
+	if p := debug.Product; p != nil {
+		if !p.IsActive {
+			blockers = append(blockers, "product is inactive")
+		}
+		if p.DiscontinuedAt != nil {
+			blockers = append(blockers, "product is marked discontinued")
+		}
+	}
+	if f := debug.Favorite; f != nil && !f.Favorited {
+		blockers = append(blockers, "user has not favorited the product")
+	}
+	if prefs := debug.Preferences; prefs != nil {
+		if prefs.Notifications.Snoozed {
+			blockers = append(blockers, "user has notifications snoozed")
+		}
+		if debug.Product != nil && !pricing.MeetsDealScore(prefs.Notifications.MinDealScore, debug.Product.DealScore) {
+			blockers = append(blockers, "product deal score is below the user's minimum")
+		}
+	}
+	if s := debug.Scheduler; s != nil && !s.Due {
+		switch {
+		case s.Paused:
+			blockers = append(blockers, "favorites scheduler is paused")
+		case s.Position == 0:
+			blockers = append(blockers, "product is not in the favorites scheduler's due set")
+		case s.PastCutOff:
+			blockers = append(blockers, "product is past the favorites scheduler's per-run cut-off; its score rises until a later run picks it")
+		default:
+			blockers = append(blockers, "request budget only covers the highest priority products today")
+		}
+	}
+	if s := debug.Scheduler; s != nil && len(s.RecentRuns) > 0 {
+		switch last := s.RecentRuns[0]; last.Outcome {
+		case OutcomeFailed:
+			blockers = append(blockers, "last scheduler run failed to fetch the product ("+last.ErrorClass+")")
+		case OutcomeSkippedRateLimit:
+			blockers = append(blockers, "last scheduler run skipped the product because the request budget was spent")
+		}
+	}
+	return blockers
+}
+
+// registerDebugHandlers sets up the support debugging endpoints. They are
+// read-only and require the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerDebugHandlers(e *echo.Echo, db *gorm.DB) {
+	debug := e.Group("/debug", requireAPIKey())
+
+	// GET /debug/product/:id/notification-state
+	// Explains why a user was or was not notified about a product
+	// Query parameters:
+	//   - user_id: User who expected a notification (required)
+	//   - source: Marketplace of the product (default trendyol)
+	debug.GET("/product/:id/notification-state", func(c echo.Context) error {
+		productID, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		userID, err := strconv.ParseUint(c.QueryParam("user_id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+		return c.JSON(http.StatusOK, GetNotificationDebug(db, productID, source, uint(userID)))
+	})
+}
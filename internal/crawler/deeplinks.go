@@ -0,0 +1,75 @@
+// Package crawler implements the redirect behind the product links in
+// notification emails
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/deeplink"
+	"scraper/internal/models"
+)
+
+// RecordLinkClick counts a click on a link of an email in its notification
+// log entry.
+//
+// Parameters:
+//   - db: Database connection
+//   - notificationID: ID of the email, from the link
+//   - now: Time of the click
+//
+// Returns:
+//   - bool: False if no email has the ID, e.g. because it was never logged
+//   - error: Any database error
+func RecordLinkClick(db *gorm.DB, notificationID string, now time.Time) (bool, error) {
+	result := db.Model(&models.NotificationLog{}).Where("notification_id = ?", notificationID).Updates(map[string]interface{}{
+		"clicks":           gorm.Expr("clicks + 1"),
+		"first_clicked_at": gorm.Expr("COALESCE(first_clicked_at, ?)", now),
+		"last_clicked_at":  now,
+	})
+	return result.RowsAffected > 0, result.Error
+}
+
+// registerDeepLinkHandlers sets up the redirect of the signed links in
+// notification emails.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerDeepLinkHandlers(e *echo.Echo, db *gorm.DB) {
+	links, err := deeplink.FromEnv()
+	if err != nil {
+		logrus.WithError(err).Warn("Email link redirects disabled")
+	}
+
+	// GET /r/:token
+	// Redirects an email link to its product page. A valid link records the
+	// click on the email's notification log entry and passes the notified
+	// user and the email on to the page; an expired link redirects without
+	// either. Returns 404 for a link that was not signed by DEEPLINK_SECRET.
+	e.GET("/r/:token", func(c echo.Context) error {
+		now := time.Now()
+		claims, err := links.Parse(c.Param("token"), now)
+		if errors.Is(err, deeplink.ErrLinkExpired) {
+			return c.Redirect(http.StatusFound, links.Target(claims, false))
+		}
+		if err != nil {
+			return apierror.NotFound(apierror.CodeNotFound, "Link not found")
+		}
+
+		fields := logrus.Fields{"notification_id": claims.NotificationID, "user_id": claims.UserID, "product_id": claims.ProductID}
+		// A click that cannot be recorded still reaches the product
+		if found, err := RecordLinkClick(db.WithContext(c.Request().Context()), claims.NotificationID, now); err != nil {
+			logrus.WithError(err).WithFields(fields).Error("Failed to record email link click")
+		} else if !found {
+			logrus.WithFields(fields).Warn("Email link click for an unknown notification")
+		}
+		return c.Redirect(http.StatusFound, links.Target(claims, true))
+	})
+}
@@ -0,0 +1,379 @@
+// Package crawler implements deleting products: the admin soft delete, the
+// admin listing that includes deleted products and the job that purges them
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/audit"
+	"scraper/internal/events"
+	"scraper/internal/models"
+	"scraper/internal/outbox"
+)
+
+// purgeBatchSize caps the products removed per purge transaction
+const purgeBatchSize = 500
+
+// DeleteResult is the outcome of deleting a product
+type DeleteResult struct {
+	ProductID            uint   `json:"product_id"`
+	Source               string `json:"source"`
+	FavoritesRemoved     int64  `json:"favorites_removed"`     // Users whose favorite was removed
+	NotificationsDropped int64  `json:"notifications_dropped"` // Snoozed notifications about the product that were dropped
+}
+
+// productDependent is a table with rows about products. Source is the
+// column holding the product's marketplace, empty for tables keyed by the
+// product ID alone.
+type productDependent struct {
+	Name   string      // Table name, for logs and results
+	Model  interface{} // Model of the table
+	Source string      // Marketplace column
+}
+
+// productDependents are the tables a purge cleans before it removes the
+// products themselves. Children come before their parents: the schema has no
+// foreign key constraints today, but deleting in this order keeps the purge
+// valid once references are enforced.
+var productDependents = []productDependent{
+	{Name: "user_favorites", Model: &models.UserFavorite{}, Source: "source"},
+	{Name: "suppressed_notifications", Model: &models.SuppressedNotification{}, Source: "source"},
+	{Name: "notification_histories", Model: &models.NotificationHistory{}, Source: "source"},
+	{Name: "fetch_retries", Model: &models.FetchRetry{}, Source: "product_source"},
+	{Name: "rating_logs", Model: &models.RatingLog{}, Source: "source"},
+	{Name: "price_history", Model: &models.PriceHistory{}, Source: "source"},
+	{Name: "price_stock_logs", Model: &models.PriceStockLog{}, Source: "source"},
+	{Name: "brand_events", Model: &models.BrandEvent{}},
+}
+
+// PurgeResult counts what a purge removed
+type PurgeResult struct {
+	Products int              `json:"products"` // Products removed
+	Rows     map[string]int64 `json:"rows"`     // Dependent rows removed by table
+}
+
+// DeleteProduct soft-deletes a product and removes it from every user's
+// favorites. Users are not notified about the removal, and the snoozed
+// notifications about the product are dropped so the snooze summary does
+// not mention it. The purge job removes the product for good once it has
+// been deleted for PRODUCT_PURGE_AFTER_DAYS. With search indexing on, the
+// analysis service is told to drop the product from the index.
+//
+// Parameters:
+//   - db: Database connection
+//   - source: Marketplace of the product
+//   - productID: Product to delete
+//
+// Returns:
+//   - DeleteResult: What was removed
+//   - error: gorm.ErrRecordNotFound if the product does not exist or is
+//     already deleted, or any database error
+func DeleteProduct(db *gorm.DB, source string, productID uint) (DeleteResult, error) {
+	result := DeleteResult{ProductID: productID, Source: source}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		deleted := tx.Where("id = ? AND source = ?", productID, source).Delete(&models.Product{})
+		if deleted.Error != nil {
+			return deleted.Error
+		}
+		if deleted.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		favorites := tx.Where("product_id = ? AND source = ?", productID, source).Delete(&models.UserFavorite{})
+		if favorites.Error != nil {
+			return favorites.Error
+		}
+		result.FavoritesRemoved = favorites.RowsAffected
+		if err := tx.Unscoped().Model(&models.Product{}).Where("id = ? AND source = ?", productID, source).UpdateColumn("local_favorites_count", 0).Error; err != nil {
+			return err
+		}
+
+		suppressed := tx.Where("product_id = ? AND source = ?", productID, source).Delete(&models.SuppressedNotification{})
+		if suppressed.Error != nil {
+			return suppressed.Error
+		}
+		result.NotificationsDropped = suppressed.RowsAffected
+		return queueSearchIndex(tx, events.ProductRef{ID: productID, Source: source})
+	})
+	if err != nil {
+		return DeleteResult{}, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"product_id":            productID,
+		"source":                source,
+		"favorites_removed":     result.FavoritesRemoved,
+		"notifications_dropped": result.NotificationsDropped,
+	}).Info("Product deleted")
+	auditRemoved(audit.OpDelete, source, productID)
+	return result, nil
+}
+
+// queueSearchIndex tells the search indexer of the analysis service to
+// re-index products, which deletes the documents of products that no longer
+// exist. The crawler runs no indexer of its own, so the event is written to
+// the outbox in tx and published once tx commits. Nothing is written when
+// search indexing is off.
+//
+// Environment Variables:
+//   - SEARCH_INDEX_ENABLED: Whether products are mirrored into the search index
+//
+// Parameters:
+//   - tx: Transaction that changes or removes the products
+//   - products: Products whose documents are stale
+//
+// Returns:
+//   - error: If the event cannot be built or stored
+func queueSearchIndex(tx *gorm.DB, products ...events.ProductRef) error {
+	if !viper.GetBool("SEARCH_INDEX_ENABLED") {
+		return nil
+	}
+	msg, err := events.NewProductsChangedMessage(products...)
+	if err != nil {
+		return err
+	}
+	return outbox.Add(tx, msg)
+}
+
+// productPurgeAfter returns how long a product stays soft-deleted before
+// the purge job removes it.
+//
+// Environment Variables:
+//   - PRODUCT_PURGE_AFTER_DAYS: Days a deleted product is kept (default: 30)
+func productPurgeAfter() time.Duration {
+	days := viper.GetInt("PRODUCT_PURGE_AFTER_DAYS")
+	if days <= 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// purgeBatch removes up to purgeBatchSize products deleted before cutoff,
+// with their dependent rows, in one transaction. The products are locked
+// first, so a purge running in another crawler removes different ones.
+// Tables keyed by the product ID alone are only cleaned for IDs that no
+// remaining product of another source uses. The purged products are queued
+// for the search index too, for documents their soft delete left behind.
+//
+// Parameters:
+//   - db: Database connection
+//   - cutoff: Products deleted before this time are removed
+//
+// Returns:
+//   - int: Products removed
+//   - map[string]int64: Dependent rows removed by table
+//   - error: Any database error; nothing is removed then
+func purgeBatch(db *gorm.DB, cutoff time.Time) (int, map[string]int64, error) {
+	var products []models.Product
+	rows := make(map[string]int64)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Select("id", "source").
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+			Where("merged_into IS NULL"). // Kept to redirect crawls of merged products
+			Order("deleted_at").
+			Limit(purgeBatchSize).
+			Find(&products).Error
+		if err != nil || len(products) == 0 {
+			return err
+		}
+
+		keys := make([][]interface{}, len(products))
+		ids := make([]uint, len(products))
+		for i, product := range products {
+			keys[i] = []interface{}{product.ID, product.Source}
+			ids[i] = product.ID
+		}
+
+		// IDs still used by a product that is not purged
+		var kept []uint
+		err = tx.Unscoped().Model(&models.Product{}).
+			Where("id IN ? AND (id, source) NOT IN ?", ids, keys).
+			Distinct().
+			Pluck("id", &kept).Error
+		if err != nil {
+			return err
+		}
+		shared := make(map[uint]bool, len(kept))
+		for _, id := range kept {
+			shared[id] = true
+		}
+		var exclusive []uint
+		for _, id := range ids {
+			if !shared[id] {
+				exclusive = append(exclusive, id)
+			}
+		}
+
+		for _, dependent := range productDependents {
+			query := tx.Unscoped()
+			if dependent.Source != "" {
+				query = query.Where("(product_id, "+dependent.Source+") IN ?", keys)
+			} else if len(exclusive) > 0 {
+				query = query.Where("product_id IN ?", exclusive)
+			} else {
+				continue
+			}
+			result := query.Delete(dependent.Model)
+			if result.Error != nil {
+				return result.Error
+			}
+			rows[dependent.Name] = result.RowsAffected
+		}
+
+		refs := make([]events.ProductRef, len(products))
+		for i, product := range products {
+			refs[i] = events.ProductRef{ID: product.ID, Source: product.Source}
+		}
+		if err := queueSearchIndex(tx, refs...); err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("(id, source) IN ?", keys).Delete(&models.Product{}).Error
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, product := range products {
+		auditRemoved(audit.OpPurge, product.Source, product.ID)
+	}
+	return len(products), rows, nil
+}
+
+// PurgeDeletedProducts permanently removes the products that were
+// soft-deleted before cutoff, together with their favorites, notification
+// records, fetch retries and price and rating history. Each batch of
+// purgeBatchSize products is removed in its own transaction.
+//
+// Parameters:
+//   - db: Database connection
+//   - cutoff: Products deleted before this time are removed
+//
+// Returns:
+//   - PurgeResult: What was removed, including the batches before an error
+//   - error: Any database error
+func PurgeDeletedProducts(db *gorm.DB, cutoff time.Time) (PurgeResult, error) {
+	result := PurgeResult{Rows: make(map[string]int64)}
+	for {
+		purged, rows, err := purgeBatch(db, cutoff)
+		if err != nil {
+			return result, err
+		}
+		result.Products += purged
+		for table, n := range rows {
+			result.Rows[table] += n
+		}
+		if purged < purgeBatchSize {
+			return result, nil
+		}
+	}
+}
+
+// startPurgeJob schedules the removal of products that have been deleted
+// for longer than PRODUCT_PURGE_AFTER_DAYS.
+//
+// Environment Variables:
+//   - PRODUCT_PURGE_CRON: Cron expression for the job (default: 30 4 * * *)
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startPurgeJob(db *gorm.DB) *cron.Cron {
+	spec := viper.GetString("PRODUCT_PURGE_CRON")
+	if spec == "" {
+		spec = "30 4 * * *" // Every night at 04:30
+	}
+
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	if _, err := c.AddFunc(spec, func() {
+		cutoff := time.Now().Add(-productPurgeAfter())
+		result, err := PurgeDeletedProducts(db, cutoff)
+		if err != nil {
+			logrus.WithError(err).WithField("purged", result.Products).Error("Failed to purge deleted products")
+			return
+		}
+		if result.Products > 0 {
+			logrus.WithFields(logrus.Fields{
+				"purged": result.Products,
+				"rows":   result.Rows,
+				"cutoff": cutoff,
+			}).Info("Purged deleted products")
+		}
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid product purge cron expression")
+	}
+	c.Start()
+
+	logrus.WithField("schedule", spec).Info("Product purge job scheduled")
+	return c
+}
+
+// registerDeletionHandlers sets up the product deletion endpoints. They
+// require the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerDeletionHandlers(e *echo.Echo, db *gorm.DB) {
+	admin := e.Group("", requireAPIKey())
+
+	// DELETE /products/:id
+	// Soft-deletes a product, such as one created by a simulation, and
+	// removes it from every user's favorites without notifying them
+	// Query parameters:
+	//   - source: Marketplace of the product (default: trendyol)
+	admin.DELETE("/products/:id", func(c echo.Context) error {
+		id, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		result, err := DeleteProduct(db, source, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
+		if err != nil {
+			return apierror.Internal("Failed to delete product", err)
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	// GET /admin/products
+	// Lists products like GET /products and takes the same filters
+	// Query parameters:
+	//   - include_deleted: Also list soft-deleted products; their DeletedAt is set (default: false)
+	admin.GET("/admin/products", func(c echo.Context) error {
+		q, err := parseProductQuery(c)
+		if err != nil {
+			return err
+		}
+		if raw := c.QueryParam("include_deleted"); raw != "" {
+			if q.IncludeDeleted, err = strconv.ParseBool(raw); err != nil {
+				return apierror.Invalid("include_deleted must be true or false")
+			}
+		}
+
+		page, err := ListProducts(db.WithContext(c.Request().Context()), q)
+		if err != nil {
+			return apierror.Internal("Failed to list products", err)
+		}
+		return c.JSON(http.StatusOK, page)
+	})
+}
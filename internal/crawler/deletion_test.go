@@ -0,0 +1,306 @@
+package crawler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"scraper/internal/events"
+)
+
+// purgeDB is the state of the fake database the purge tests run against
+var purgeDB struct {
+	candidates [][]driver.Value // Rows of the purge candidate query: id, source
+	kept       []int64          // IDs still used by products that are not purged
+	failOn     string           // Statements containing this fail
+	statements []string         // Statements received, with BEGIN, COMMIT and ROLLBACK
+	args       map[string][]driver.NamedValue
+}
+
+func init() {
+	sql.Register("purge", purgeDriver{})
+}
+
+// purgeDriver is a database/sql driver that records the statements it
+// receives and answers the purge queries from purgeDB
+type purgeDriver struct{}
+
+func (purgeDriver) Open(string) (driver.Conn, error) { return purgeConn{}, nil }
+
+type purgeConn struct{}
+
+func (purgeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepared statements are not supported")
+}
+
+func (purgeConn) Close() error { return nil }
+
+func (purgeConn) Begin() (driver.Tx, error) {
+	purgeDB.statements = append(purgeDB.statements, "BEGIN")
+	return purgeTx{}, nil
+}
+
+func (purgeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	purgeDB.statements = append(purgeDB.statements, query)
+	purgeDB.args[query] = args
+	if purgeDB.failOn != "" && strings.Contains(query, purgeDB.failOn) {
+		return nil, errors.New("injected failure")
+	}
+	if strings.HasPrefix(query, `DELETE FROM "products"`) {
+		return driver.RowsAffected(len(purgeDB.candidates)), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (purgeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	purgeDB.statements = append(purgeDB.statements, query)
+	purgeDB.args[query] = args
+	switch {
+	case strings.Contains(query, "FOR UPDATE"):
+		return &purgeRows{columns: []string{"id", "source"}, rows: purgeDB.candidates}, nil
+	case strings.Contains(query, "DISTINCT"):
+		rows := make([][]driver.Value, len(purgeDB.kept))
+		for i, id := range purgeDB.kept {
+			rows[i] = []driver.Value{id}
+		}
+		return &purgeRows{columns: []string{"id"}, rows: rows}, nil
+	}
+	return &purgeRows{}, nil
+}
+
+type purgeTx struct{}
+
+func (purgeTx) Commit() error {
+	purgeDB.statements = append(purgeDB.statements, "COMMIT")
+	return nil
+}
+
+func (purgeTx) Rollback() error {
+	purgeDB.statements = append(purgeDB.statements, "ROLLBACK")
+	return nil
+}
+
+// purgeRows returns fixed rows
+type purgeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *purgeRows) Columns() []string { return r.columns }
+
+func (r *purgeRows) Close() error { return nil }
+
+func (r *purgeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// openPurgeDB resets the fake database and opens a gorm connection to it.
+func openPurgeDB(t *testing.T, candidates [][]driver.Value, kept []int64) *gorm.DB {
+	t.Helper()
+	purgeDB.candidates = candidates
+	purgeDB.kept = kept
+	purgeDB.failOn = ""
+	purgeDB.statements = nil
+	purgeDB.args = make(map[string][]driver.NamedValue)
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DriverName: "purge"}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// deletedTables returns the tables of the DELETE statements received, in order.
+func deletedTables() []string {
+	var tables []string
+	for _, statement := range purgeDB.statements {
+		if rest, ok := strings.CutPrefix(statement, `DELETE FROM "`); ok {
+			tables = append(tables, rest[:strings.Index(rest, `"`)])
+		}
+	}
+	return tables
+}
+
+// deleteArgs returns the arguments of the DELETE statement on table.
+func deleteArgs(table string) []interface{} {
+	for _, statement := range purgeDB.statements {
+		if strings.HasPrefix(statement, `DELETE FROM "`+table+`"`) {
+			var args []interface{}
+			for _, arg := range purgeDB.args[statement] {
+				args = append(args, arg.Value)
+			}
+			return args
+		}
+	}
+	return nil
+}
+
+func TestPurgeBatchDeletesDependentsBeforeProducts(t *testing.T) {
+	db := openPurgeDB(t, [][]driver.Value{{int64(1), "trendyol"}, {int64(2), "trendyol"}}, nil)
+
+	purged, rows, err := purgeBatch(db, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("purged = %d, want 2", purged)
+	}
+
+	want := make([]string, 0, len(productDependents)+1)
+	for _, dependent := range productDependents {
+		want = append(want, dependent.Name)
+		if rows[dependent.Name] != 1 {
+			t.Errorf("rows[%s] = %d, want 1", dependent.Name, rows[dependent.Name])
+		}
+	}
+	want = append(want, "products")
+	if got := deletedTables(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("deleted tables = %v, want %v", got, want)
+	}
+
+	// Everything happens in one transaction, products last
+	statements := purgeDB.statements
+	if statements[0] != "BEGIN" || statements[len(statements)-1] != "COMMIT" {
+		t.Errorf("statements are not wrapped in one transaction: %q", statements)
+	}
+	if !strings.HasPrefix(statements[len(statements)-2], `DELETE FROM "products"`) {
+		t.Errorf("last statement before COMMIT = %q, want the products delete", statements[len(statements)-2])
+	}
+	if !strings.Contains(statements[1], "FOR UPDATE SKIP LOCKED") {
+		t.Errorf("candidates are not locked: %q", statements[1])
+	}
+}
+
+func TestPurgeBatchKeepsRowsOfSharedIDs(t *testing.T) {
+	db := openPurgeDB(t, [][]driver.Value{{int64(1), "trendyol"}, {int64(2), "trendyol"}}, []int64{1})
+
+	if _, _, err := purgeBatch(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tables keyed by product ID alone only lose the rows of product 2
+	if args := deleteArgs("brand_events"); len(args) != 1 || args[0] != int64(2) {
+		t.Errorf("brand_events deleted with %v, want only product 2", args)
+	}
+	// Tables with a source column are matched by (id, source)
+	for _, table := range []string{"user_favorites", "price_stock_logs"} {
+		if args := deleteArgs(table); len(args) != 4 {
+			t.Errorf("%s deleted with %v, want both products", table, args)
+		}
+	}
+}
+
+func TestPurgeBatchSkipsProductIDTablesWhenAllIDsAreShared(t *testing.T) {
+	db := openPurgeDB(t, [][]driver.Value{{int64(1), "trendyol"}}, []int64{1})
+
+	if _, _, err := purgeBatch(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range deletedTables() {
+		if table == "brand_events" {
+			t.Errorf("%s was cleaned although product 1 is still used", table)
+		}
+	}
+}
+
+func TestPurgeBatchWithoutCandidates(t *testing.T) {
+	db := openPurgeDB(t, nil, nil)
+
+	purged, _, err := purgeBatch(db, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Errorf("purged = %d, want 0", purged)
+	}
+	if tables := deletedTables(); len(tables) != 0 {
+		t.Errorf("deleted from %v with nothing to purge", tables)
+	}
+}
+
+func TestPurgeBatchRollsBackOnError(t *testing.T) {
+	db := openPurgeDB(t, [][]driver.Value{{int64(1), "trendyol"}}, nil)
+	purgeDB.failOn = `DELETE FROM "price_stock_logs"`
+
+	if _, _, err := purgeBatch(db, time.Now()); err == nil {
+		t.Fatal("purgeBatch succeeded despite a failed delete")
+	}
+	statements := purgeDB.statements
+	if statements[len(statements)-1] != "ROLLBACK" {
+		t.Errorf("last statement = %q, want ROLLBACK", statements[len(statements)-1])
+	}
+	for _, table := range deletedTables() {
+		if table == "products" {
+			t.Error("products were deleted after a dependent delete failed")
+		}
+	}
+}
+
+// searchIndexEvents returns the products of the products_changed events
+// written to the outbox, in order.
+func searchIndexEvents(t *testing.T) []events.ProductRef {
+	t.Helper()
+	var products []events.ProductRef
+	for _, statement := range purgeDB.statements {
+		if !strings.HasPrefix(statement, `INSERT INTO "outbox"`) {
+			continue
+		}
+		args := purgeDB.args[statement]
+		if args[0].Value != events.SearchIndexUpdatesTopic {
+			continue
+		}
+		change, err := events.DecodeProductsChanged(args[2].Value.([]byte))
+		if err != nil {
+			t.Fatal(err)
+		}
+		products = append(products, change.Products...)
+	}
+	return products
+}
+
+func TestDeletionQueuesSearchIndexUpdates(t *testing.T) {
+	viper.Set("SEARCH_INDEX_ENABLED", true)
+	t.Cleanup(func() { viper.Set("SEARCH_INDEX_ENABLED", nil) })
+
+	db := openPurgeDB(t, [][]driver.Value{{int64(1), "trendyol"}}, nil)
+	if _, err := DeleteProduct(db, "trendyol", 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIndexEvents(t); len(got) != 1 || got[0] != (events.ProductRef{ID: 1, Source: "trendyol"}) {
+		t.Errorf("soft delete queued %v, want product 1", got)
+	}
+
+	db = openPurgeDB(t, [][]driver.Value{{int64(1), "trendyol"}, {int64(2), "hepsiburada"}}, nil)
+	if _, _, err := purgeBatch(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	want := []events.ProductRef{{ID: 1, Source: "trendyol"}, {ID: 2, Source: "hepsiburada"}}
+	if got := searchIndexEvents(t); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("purge queued %v, want %v", got, want)
+	}
+
+	viper.Set("SEARCH_INDEX_ENABLED", false)
+	db = openPurgeDB(t, [][]driver.Value{{int64(1), "trendyol"}}, nil)
+	if _, _, err := purgeBatch(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIndexEvents(t); len(got) != 0 {
+		t.Errorf("queued %v with search indexing off", got)
+	}
+}
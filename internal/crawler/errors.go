@@ -0,0 +1,94 @@
+// Package crawler maps crawler errors to API error responses
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"scraper/internal/apierror"
+	"scraper/internal/emailaddr"
+	"scraper/internal/models"
+)
+
+// ErrDuplicateFavorite is returned by AddFavorite when the product is already
+// one of the user's favorites.
+var ErrDuplicateFavorite = errors.New("product is already a favorite")
+
+// Errors AddFavorite returns for a favorite that would reference nothing
+var (
+	// ErrFavoriteUserNotFound is returned when the user does not exist
+	ErrFavoriteUserNotFound = errors.New("user not found")
+	// ErrFavoriteProductNotFound is returned when the product does not exist
+	// in the source
+	ErrFavoriteProductNotFound = errors.New("product not found")
+)
+
+// ErrFavoriteNotFound is returned by RemoveFavorite when the product is not
+// one of the user's favorites.
+var ErrFavoriteNotFound = errors.New("favorite not found")
+
+// uniqueViolation is the PostgreSQL error code of a unique constraint
+// violation
+const uniqueViolation = "23505"
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint
+// violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+// mapError translates crawler errors for apierror.NewHandler:
+//   - *FavoritesLimitError: 422 favorites_limit_reached with the limit
+//   - ErrDuplicateFavorite: 409 duplicate_favorite
+//   - ErrFavoriteUserNotFound: 404 user_not_found
+//   - ErrFavoriteProductNotFound: 404 product_not_found
+//   - ErrFavoriteNotFound: 404 not_found
+//   - ErrRequestBudgetExhausted: 429 rate_limited
+func mapError(err error) *apierror.Error {
+	var limitErr *FavoritesLimitError
+	switch {
+	case errors.As(err, &limitErr):
+		return apierror.New(http.StatusUnprocessableEntity, apierror.CodeFavoritesLimitReached, limitErr.Error()).
+			WithDetails(map[string]int{"limit": limitErr.Limit})
+	case errors.Is(err, ErrDuplicateFavorite):
+		return apierror.New(http.StatusConflict, apierror.CodeDuplicateFavorite, "Product is already favorited")
+	case errors.Is(err, ErrFavoriteUserNotFound):
+		return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+	case errors.Is(err, ErrFavoriteProductNotFound):
+		return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+	case errors.Is(err, ErrFavoriteNotFound):
+		return apierror.NotFound(apierror.CodeNotFound, "Favorite not found")
+	case errors.Is(err, ErrRequestBudgetExhausted):
+		return apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, err.Error())
+	}
+	return nil
+}
+
+// newValidator creates a request validator that reports fields by their JSON
+// names, which is what clients see in validation_failed details. The mailbox
+// tag checks email addresses with emailaddr.Validate, which is stricter than
+// the email tag; normalize the address before validating. The productid tag
+// checks that a product ID is within models.MaxProductID, so it can be stored.
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" || name == "" {
+			return field.Name
+		}
+		return name
+	})
+	validate.RegisterValidation("mailbox", func(fl validator.FieldLevel) bool {
+		return emailaddr.Validate(fl.Field().String()) == nil
+	})
+	validate.RegisterValidation("productid", func(fl validator.FieldLevel) bool {
+		return models.ValidProductID(fl.Field().Uint())
+	})
+	return validate
+}
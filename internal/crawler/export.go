@@ -0,0 +1,302 @@
+// Package crawler implements the favorites export
+package crawler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+)
+
+// Export formats
+const (
+	exportFormatCSV  = "csv"
+	exportFormatJSON = "json"
+)
+
+// exportHeader lists the columns of the favorites export. The product ID comes
+// first so the file can be imported again through POST /favorites/import.
+var exportHeader = []string{
+	"product_id", "source", "name", "brand", "collection", "added_at",
+	"price_when_added", "current_price", "currency", "stock",
+	"last_price_change_at", "last_old_price", "last_new_price",
+}
+
+// FavoriteExportRow is one favorite in the export
+type FavoriteExportRow struct {
+	ProductID         uint       `json:"product_id"`
+	Source            string     `json:"source"`
+	Name              string     `json:"name"`
+	Brand             string     `json:"brand"`
+	Collection        string     `json:"collection"` // Empty when uncategorized
+	AddedAt           time.Time  `json:"added_at"`
+	PriceWhenAdded    *float64   `json:"price_when_added"`
+	CurrentPrice      *float64   `json:"current_price"` // Null while the product has no price
+	Currency          string     `json:"currency"`
+	Stock             *float64   `json:"stock"`                // Null when the stock level is unknown
+	LastPriceChangeAt *time.Time `json:"last_price_change_at"` // Null when no price change was recorded
+	LastOldPrice      string     `json:"last_old_price"`       // As recorded in the price history
+	LastNewPrice      string     `json:"last_new_price"`
+}
+
+// exportQuery selects a user's favorites with their product and the last
+// price change recorded for it, most recently added first
+const exportQuery = `SELECT f.product_id, f.source, p.name,
+	COALESCE(p.brand->>'name', '') AS brand,
+	COALESCE(c.name, '') AS collection,
+	f.added_at, f.price_when_added,
+	NULLIF(p.price, 0) AS current_price,
+	COALESCE(p.price_info->>'currency', '') AS currency,
+	CASE WHEN jsonb_typeof(p.stock_info->'stock') = 'number' THEN (p.stock_info->>'stock')::numeric END AS stock,
+	l.change_time AS last_price_change_at,
+	COALESCE(l.old_price, '') AS last_old_price,
+	COALESCE(l.new_price, '') AS last_new_price
+FROM user_favorites f
+JOIN products p ON p.id = f.product_id AND p.source = f.source AND p.deleted_at IS NULL
+LEFT JOIN favorite_collections c ON c.id = f.collection_id AND c.deleted_at IS NULL
+LEFT JOIN LATERAL (
+	SELECT change_time, old_price, new_price FROM price_stock_logs
+	WHERE product_id = f.product_id AND source = f.source AND deleted_at IS NULL AND old_price <> new_price
+	ORDER BY change_time DESC LIMIT 1
+) l ON true
+WHERE f.user_id = ? AND f.deleted_at IS NULL`
+
+// ExportFavorites streams a user's favorites, most recently added first,
+// without loading them all into memory. A price when added that was never
+// resolved is looked up in the price history but, unlike in
+// ListUserFavorites, not cached.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: ID of the user whose favorites to export
+//   - filter: Marketplace, collection and tag to limit the favorites to
+//   - fn: Called with every favorite in order; an error stops the export
+//
+// Returns:
+//   - error: Any database error or the error returned by fn
+func ExportFavorites(db *gorm.DB, userID uint, filter FavoriteFilter, fn func(FavoriteExportRow) error) error {
+	query := exportQuery
+	args := []interface{}{userID}
+	if filter.Source != "" {
+		query += " AND f.source = ?"
+		args = append(args, filter.Source)
+	}
+	if filter.CollectionID != nil {
+		query += " AND f.collection_id = ?"
+		args = append(args, *filter.CollectionID)
+	} else if filter.Uncategorized {
+		query += " AND f.collection_id IS NULL"
+	}
+	if filter.Tag != "" {
+		query += " AND f.tags @> ?::jsonb"
+		args = append(args, tagContainment(filter.Tag))
+	}
+	query += " ORDER BY f.added_at DESC, f.id"
+
+	rows, err := db.Raw(query, args...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row FavoriteExportRow
+		if err := db.ScanRows(rows, &row); err != nil {
+			return err
+		}
+		if row.PriceWhenAdded == nil {
+			price, err := priceAt(db, row.ProductID, row.Source, row.AddedAt)
+			if err != nil {
+				logrus.WithError(err).WithField("product_id", row.ProductID).Error("Failed to resolve price when added")
+			}
+			row.PriceWhenAdded = price
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// csvExportWriter returns a function writing favorites as CSV rows. The
+// header is written right away, so an export without favorites is a
+// header-only file.
+//
+// Parameters:
+//   - w: Destination of the CSV
+//
+// Returns:
+//   - func(FavoriteExportRow) error: Writes and flushes one row
+//   - error: If the header cannot be written
+func csvExportWriter(w io.Writer) (func(FavoriteExportRow) error, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportHeader); err != nil {
+		return nil, err
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+
+	formatNumber := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*value, 'f', -1, 64)
+	}
+	formatPrice := func(price *float64) string {
+		if price == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*price, 'f', 2, 64)
+	}
+	return func(row FavoriteExportRow) error {
+		lastChange := ""
+		if row.LastPriceChangeAt != nil {
+			lastChange = row.LastPriceChangeAt.UTC().Format(time.RFC3339)
+		}
+		record := []string{
+			strconv.FormatUint(uint64(row.ProductID), 10),
+			row.Source,
+			row.Name,
+			row.Brand,
+			row.Collection,
+			row.AddedAt.UTC().Format(time.RFC3339),
+			formatPrice(row.PriceWhenAdded),
+			formatPrice(row.CurrentPrice),
+			row.Currency,
+			formatNumber(row.Stock),
+			lastChange,
+			row.LastOldPrice,
+			row.LastNewPrice,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+		writer.Flush()
+		return writer.Error()
+	}, nil
+}
+
+// jsonExportWriter returns a function writing favorites as the elements of
+// a JSON array, and one closing the array. The array is opened right away.
+//
+// Parameters:
+//   - w: Destination of the JSON
+//
+// Returns:
+//   - func(FavoriteExportRow) error: Writes one element
+//   - func() error: Closes the array
+//   - error: If the array cannot be opened
+func jsonExportWriter(w io.Writer) (func(FavoriteExportRow) error, func() error, error) {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return nil, nil, err
+	}
+	separator := ""
+	write := func(row FavoriteExportRow) error {
+		encoded, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		separator = ","
+		_, err = w.Write(encoded)
+		return err
+	}
+	closeArray := func() error {
+		_, err := io.WriteString(w, "]\n")
+		return err
+	}
+	return write, closeArray, nil
+}
+
+// registerExportHandlers sets up the favorites export endpoint.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerExportHandlers(e *echo.Echo, db *gorm.DB) {
+	// GET /favorites/:user_id/export
+	// Downloads a user's favorites, most recently added first, streamed row
+	// by row. The route has no request deadline since the file is streamed;
+	// its queries still stop when the client disconnects.
+	// Query parameters:
+	//   - format: csv or json (default csv)
+	//   - source: Only export products from this marketplace (optional)
+	//   - collection_id: Only export this collection, or "uncategorized" (optional)
+	//   - tag: Only export favorites with this tag (optional)
+	e.GET("/favorites/:user_id/export", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		format := strings.ToLower(c.QueryParam("format"))
+		if format == "" {
+			format = exportFormatCSV
+		}
+		if format != exportFormatCSV && format != exportFormatJSON {
+			return apierror.Invalid("format must be csv or json")
+		}
+		filter, err := favoriteFilterFromQuery(c)
+		if err != nil {
+			return err
+		}
+
+		// The headers are sent with the first row, so a failing query still
+		// gets an error response
+		res := c.Response()
+		var write func(FavoriteExportRow) error
+		finish := func() error { return nil }
+		begin := func() (err error) {
+			contentType := "text/csv; charset=utf-8"
+			if format == exportFormatJSON {
+				contentType = echo.MIMEApplicationJSONCharsetUTF8
+			}
+			res.Header().Set(echo.HeaderContentType, contentType)
+			res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="favorites-%d.%s"`, userID, format))
+			res.WriteHeader(http.StatusOK)
+			if format == exportFormatJSON {
+				write, finish, err = jsonExportWriter(res)
+			} else {
+				write, err = csvExportWriter(res)
+			}
+			return err
+		}
+
+		err = ExportFavorites(db.WithContext(c.Request().Context()), uint(userID), filter, func(row FavoriteExportRow) error {
+			if write == nil {
+				if err := begin(); err != nil {
+					return err
+				}
+			}
+			return write(row)
+		})
+		if err != nil && !res.Committed {
+			return apierror.Internal("Failed to export favorites", err)
+		}
+		if err != nil {
+			// Too late for an error response; the client gets a truncated file
+			logrus.WithError(err).WithField("user_id", userID).Error("Favorites export stopped")
+			return nil
+		}
+		// No favorites: a header-only CSV or an empty array
+		if write == nil {
+			if err := begin(); err != nil {
+				return err
+			}
+		}
+		return finish()
+	})
+}
@@ -0,0 +1,69 @@
+package crawler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVExportWriter(t *testing.T) {
+	var buf bytes.Buffer
+	write, err := csvExportWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := strings.Join(exportHeader, ",") + "\n"
+	if buf.String() != header {
+		t.Fatalf("empty export = %q, want the header only", buf.String())
+	}
+
+	added := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	price, stock := 89.9, 12.0
+	err = write(FavoriteExportRow{
+		ProductID:         42,
+		Source:            "trendyol",
+		Name:              "Shoe, black",
+		Brand:             "Acme",
+		AddedAt:           added,
+		CurrentPrice:      &price,
+		Currency:          "TRY",
+		Stock:             &stock,
+		LastPriceChangeAt: &added,
+		LastOldPrice:      "99.90",
+		LastNewPrice:      "89.90",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := header + `42,trendyol,"Shoe, black",Acme,,2026-03-01T12:00:00Z,,89.90,TRY,12,2026-03-01T12:00:00Z,99.90,89.90` + "\n"
+	if buf.String() != want {
+		t.Errorf("export = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestJSONExportWriter(t *testing.T) {
+	var buf bytes.Buffer
+	write, finish, err := jsonExportWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := finish(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "[]\n" {
+		t.Errorf("empty export = %q, want an empty array", buf.String())
+	}
+
+	buf.Reset()
+	write, finish, _ = jsonExportWriter(&buf)
+	for _, id := range []uint{1, 2} {
+		if err := write(FavoriteExportRow{ProductID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finish()
+	if got := strings.Count(buf.String(), `"product_id"`); got != 2 || !strings.HasPrefix(buf.String(), `[{"product_id":1,`) || !strings.Contains(buf.String(), `},{"product_id":2,`) {
+		t.Errorf("export = %s, want an array of both rows", buf.String())
+	}
+}
@@ -0,0 +1,64 @@
+// Package crawler implements the fault injection endpoints
+package crawler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+
+	"scraper/internal/apierror"
+	"scraper/internal/faults"
+)
+
+// registerFaultHandlers sets up the endpoints that manage the fault
+// injection rules of this process. They only exist with FAULT_INJECTION set
+// and require the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+func registerFaultHandlers(e *echo.Echo) {
+	if !faults.Enabled() {
+		return
+	}
+	logrus.Warn("Fault injection enabled, never use this in production")
+	admin := e.Group("/admin/faults", requireAPIKey())
+
+	// GET /admin/faults
+	// Lists the active rules with how often they matched and failed
+	admin.GET("", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, faults.Rules())
+	})
+
+	// POST /admin/faults
+	// Adds a rule
+	// Request body: {"target": "fetch"|"produce"|"smtp", "failure_percent": float,
+	// "latency": duration, "status_code": int, "product_ids": [int],
+	// "topic": string, "recipient": pattern}
+	admin.POST("", func(c echo.Context) error {
+		var rule faults.Rule
+		if err := c.Bind(&rule); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		rule, err := faults.Add(rule)
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+		return c.JSON(http.StatusCreated, rule)
+	})
+
+	// DELETE /admin/faults/:id
+	// Removes a rule
+	admin.DELETE("/:id", func(c echo.Context) error {
+		if !faults.Remove(c.Param("id")) {
+			return apierror.NotFound(apierror.CodeNotFound, "Fault injection rule not found")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	// DELETE /admin/faults
+	// Removes all rules
+	admin.DELETE("", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]int{"removed": faults.Clear()})
+	})
+}
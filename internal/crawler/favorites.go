@@ -2,93 +2,671 @@
 package crawler
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"scraper/internal/metrics"
 	"scraper/internal/models"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
+// favoritesLockNamespace scopes the per-user advisory lock taken while adding
+// favorites so it cannot collide with other advisory locks
+const favoritesLockNamespace = 7240
+
+// nearLimitRatio is the share of the favorites limit at which a user counts
+// as near the cap
+const nearLimitRatio = 0.9
+
+// favoritesLimitUsers counts users close to or at the favorites limit
+var favoritesLimitUsers = metrics.NewGauge(
+	"favorites_limit_users",
+	"Users with at least 90% of FAVORITES_LIMIT favorites (state=near) or at the limit (state=at)",
+	"state",
+)
+
+// FavoritesLimitError is returned when a user without the admin override
+// already has the maximum number of favorites.
+type FavoritesLimitError struct {
+	Limit int // The configured limit
+}
+
+func (e *FavoritesLimitError) Error() string {
+	return fmt.Sprintf("favorites limit reached: a user can favorite at most %d products", e.Limit)
+}
+
+// favoritesLimit returns the maximum number of favorites per user.
+//
+// Environment Variables:
+//   - FAVORITES_LIMIT: Favorites allowed per user (default: 500)
+func favoritesLimit() int {
+	limit := viper.GetInt("FAVORITES_LIMIT")
+	if limit <= 0 {
+		limit = 500
+	}
+	return limit
+}
+
 // AddFavorite creates a new favorite relationship between a user and a product.
 // It records the time when the product was favorited.
 //
+// The user and the product must exist. The favorite is inserted with
+// INSERT ... ON CONFLICT, which also revives a favorite the user removed
+// before; a unique violation the upsert does not absorb is reported as a
+// duplicate. In the same transaction the product's LocalFavoritesCount is
+// incremented and it is marked IsFavorite, so the next scheduler run picks it
+// up. The favorites limit is checked after
+// the insert while holding a per-user advisory lock, so concurrent adds
+// cannot push a user past it; a user over the limit rolls the insert back.
+// Users with the UnlimitedFavorites override are exempt.
+//
 // Parameters:
 //   - db: Database connection
 //   - userID: ID of the user adding the favorite
 //   - productID: ID of the product being favorited
+//   - source: Marketplace of the product
 //
 // Returns:
-//   - error: Any database error that occurred, nil if successful
-func AddFavorite(db *gorm.DB, userID, productID uint) error {
-	// Create new favorite record
-	favorite := models.UserFavorite{
-		UserID:    userID,
-		ProductID: productID,
-		AddedAt:   time.Now(),
-	}
+//   - error: ErrFavoriteUserNotFound or ErrFavoriteProductNotFound if either
+//     does not exist, ErrDuplicateFavorite if the product is already a
+//     favorite, *FavoritesLimitError if the user is at the limit, or any
+//     database error that occurred; nil if successful
+func AddFavorite(db *gorm.DB, userID, productID uint, source string) error {
+	now := time.Now()
 
-	// Attempt to save to database
-	result := db.Create(&favorite)
-	if result.Error != nil {
-		logrus.WithError(result.Error).WithFields(logrus.Fields{
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Serialize adds for this user until the transaction ends
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?, ?)", favoritesLockNamespace, int32(userID)).Error; err != nil {
+			return err
+		}
+
+		// Nothing references the user or the product in the schema, so check
+		// both exist
+		var users, products int64
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Count(&users).Error; err != nil {
+			return err
+		}
+		if users == 0 {
+			return ErrFavoriteUserNotFound
+		}
+		if err := tx.Model(&models.Product{}).Where("id = ? AND source = ?", productID, source).Count(&products).Error; err != nil {
+			return err
+		}
+		if products == 0 {
+			return ErrFavoriteProductNotFound
+		}
+
+		// A live favorite conflicts and returns no row; a removed one is
+		// revived as if it were new
+		var inserted []uint
+		err := tx.Raw(`INSERT INTO user_favorites (created_at, updated_at, user_id, product_id, source, added_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, product_id, source) DO UPDATE
+			SET deleted_at = NULL, updated_at = EXCLUDED.updated_at, added_at = EXCLUDED.added_at,
+				price_when_added = NULL, collection_id = NULL, muted = false, muted_until = NULL, target_price = NULL,
+				note = '', tags = '[]'
+			WHERE user_favorites.deleted_at IS NOT NULL
+			RETURNING id`,
+			now, now, userID, productID, source, now).Scan(&inserted).Error
+		if isUniqueViolation(err) {
+			return ErrDuplicateFavorite
+		}
+		if err != nil {
+			return err
+		}
+		if len(inserted) == 0 {
+			return ErrDuplicateFavorite
+		}
+
+		// Enforce the limit unless an admin lifted it for this user; the
+		// count includes the favorite just added
+		var user models.User
+		if err := tx.Select("unlimited_favorites").Where("id = ?", userID).Limit(1).Find(&user).Error; err != nil {
+			return err
+		}
+		if !user.UnlimitedFavorites {
+			var count int64
+			if err := tx.Model(&models.UserFavorite{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+				return err
+			}
+			if limit := favoritesLimit(); count > int64(limit) {
+				return &FavoritesLimitError{Limit: limit}
+			}
+		}
+
+		return tx.Model(&models.Product{}).Where("id = ? AND source = ?", productID, source).
+			UpdateColumns(map[string]interface{}{
+				"local_favorites_count": gorm.Expr("local_favorites_count + 1"),
+				"is_favorite":           true,
+			}).Error
+	})
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
 			"user_id":    userID,
 			"product_id": productID,
+			"source":     source,
 		}).Error("Failed to add favorite")
 	}
-	return result.Error
+	return err
 }
 
-// RemoveFavorite deletes a favorite relationship between a user and a product.
+// Bulk favorite statuses
+const (
+	BulkFavoriteCreated      = "created"       // Added to the user's favorites
+	BulkFavoriteExists       = "exists"        // Already a favorite
+	BulkFavoriteNotFound     = "not_found"     // No such product in the source
+	BulkFavoriteLimitReached = "limit_reached" // Not added, the user reached FAVORITES_LIMIT
+)
+
+// BulkFavoriteResult is the outcome of one product ID of a bulk add
+type BulkFavoriteResult struct {
+	ProductID uint   `json:"product_id"`
+	Status    string `json:"status"` // One of the BulkFavorite statuses
+}
+
+// BulkAddFavorites adds many products to a user's favorites in one
+// transaction. Unknown products are reported instead of failing the batch.
+// Like AddFavorite, the insert is an upsert on idx_user_product that revives
+// removed favorites, it holds the per-user advisory lock, and it increments
+// the products' LocalFavoritesCount. Products beyond the favorites limit are
+// left out, in request order, unless the user has the override.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: ID of the user adding the favorites
+//   - productIDs: Products to favorite; a repeated ID is reported as exists
+//   - source: Marketplace of the products
+//
+// Returns:
+//   - []BulkFavoriteResult: The outcome of every product ID, in request order
+//   - error: Any database error; nothing is added then
+func BulkAddFavorites(db *gorm.DB, userID uint, productIDs []uint, source string) ([]BulkFavoriteResult, error) {
+	results := make([]BulkFavoriteResult, len(productIDs))
+	now := time.Now()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?, ?)", favoritesLockNamespace, int32(userID)).Error; err != nil {
+			return err
+		}
+
+		var known, existing []uint
+		if err := tx.Model(&models.Product{}).Where("source = ? AND id IN ?", source, productIDs).Pluck("id", &known).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.UserFavorite{}).Where("user_id = ? AND source = ? AND product_id IN ?", userID, source, productIDs).
+			Pluck("product_id", &existing).Error; err != nil {
+			return err
+		}
+		isKnown := make(map[uint]bool, len(known))
+		for _, id := range known {
+			isKnown[id] = true
+		}
+		seen := make(map[uint]bool, len(existing))
+		for _, id := range existing {
+			seen[id] = true
+		}
+
+		// Room left under the limit; the lock keeps it valid until commit
+		room := -1
+		var user models.User
+		if err := tx.Select("unlimited_favorites").Where("id = ?", userID).Limit(1).Find(&user).Error; err != nil {
+			return err
+		}
+		if !user.UnlimitedFavorites {
+			var count int64
+			if err := tx.Model(&models.UserFavorite{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+				return err
+			}
+			room = favoritesLimit() - int(count)
+		}
+
+		var created []uint
+		for i, id := range productIDs {
+			results[i].ProductID = id
+			switch {
+			case !isKnown[id]:
+				results[i].Status = BulkFavoriteNotFound
+			case seen[id]:
+				results[i].Status = BulkFavoriteExists
+			case room >= 0 && len(created) >= room:
+				results[i].Status = BulkFavoriteLimitReached
+			default:
+				results[i].Status = BulkFavoriteCreated
+				created = append(created, id)
+				seen[id] = true
+			}
+		}
+		if len(created) == 0 {
+			return nil
+		}
+
+		values := make([]string, len(created))
+		args := make([]interface{}, 0, len(created)*6)
+		for i, id := range created {
+			values[i] = "(?, ?, ?, ?, ?, ?)"
+			args = append(args, now, now, userID, id, source, now)
+		}
+		var inserted []uint
+		err := tx.Raw(`INSERT INTO user_favorites (created_at, updated_at, user_id, product_id, source, added_at)
+			VALUES `+strings.Join(values, ", ")+`
+			ON CONFLICT (user_id, product_id, source) DO UPDATE
+			SET deleted_at = NULL, updated_at = EXCLUDED.updated_at, added_at = EXCLUDED.added_at,
+				price_when_added = NULL, collection_id = NULL, muted = false, muted_until = NULL, target_price = NULL,
+				note = '', tags = '[]'
+			WHERE user_favorites.deleted_at IS NOT NULL
+			RETURNING product_id`, args...).Scan(&inserted).Error
+		if err != nil {
+			return err
+		}
+		// Under the lock every checked product is inserted; anything else
+		// means the checks above were wrong
+		if len(inserted) != len(created) {
+			return fmt.Errorf("bulk favorites: inserted %d of %d products", len(inserted), len(created))
+		}
+
+		return tx.Model(&models.Product{}).Where("source = ? AND id IN ?", source, created).
+			UpdateColumns(map[string]interface{}{
+				"local_favorites_count": gorm.Expr("local_favorites_count + 1"),
+				"is_favorite":           true,
+			}).Error
+	})
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"user_id":  userID,
+			"products": len(productIDs),
+			"source":   source,
+		}).Error("Failed to add favorites in bulk")
+		return nil, err
+	}
+	return results, nil
+}
+
+// FavoritesLimitReached reports whether a user is at the favorites limit and
+// cannot add more without the admin override.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to check
+//
+// Returns:
+//   - *FavoritesLimitError: Non-nil if the user is at the limit
+//   - error: Any database error
+func FavoritesLimitReached(db *gorm.DB, userID uint) (*FavoritesLimitError, error) {
+	var user models.User
+	if err := db.Select("unlimited_favorites").Where("id = ?", userID).Limit(1).Find(&user).Error; err != nil {
+		return nil, err
+	}
+	if user.UnlimitedFavorites {
+		return nil, nil
+	}
+	var count int64
+	if err := db.Model(&models.UserFavorite{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if limit := favoritesLimit(); count >= int64(limit) {
+		return &FavoritesLimitError{Limit: limit}, nil
+	}
+	return nil, nil
+}
+
+// SetUnlimitedFavorites grants or revokes a user's exemption from the
+// favorites limit.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to update
+//   - unlimited: Whether the user may exceed FAVORITES_LIMIT
+//
+// Returns:
+//   - error: gorm.ErrRecordNotFound if the user does not exist, or any
+//     database error
+func SetUnlimitedFavorites(db *gorm.DB, userID uint, unlimited bool) error {
+	result := db.Model(&models.User{}).Where("id = ?", userID).Update("unlimited_favorites", unlimited)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "unlimited": unlimited}).Info("Favorites limit override changed")
+	return nil
+}
+
+// startFavoritesLimitJob schedules a refresh of the favorites_limit_users
+// metric every minute.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startFavoritesLimitJob(db *gorm.DB) *cron.Cron {
+	c := cron.New()
+	if _, err := c.AddFunc("* * * * *", func() {
+		updateFavoritesLimitMetric(db)
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid favorites limit cron expression")
+	}
+	c.Start()
+
+	logrus.Info("Favorites limit metric job scheduled")
+	return c
+}
+
+// updateFavoritesLimitMetric counts users near and at the favorites limit,
+// excluding users with the override.
+func updateFavoritesLimitMetric(db *gorm.DB) {
+	limit := favoritesLimit()
+	var counts struct {
+		Near int64
+		At   int64
+	}
+	err := db.Raw(`SELECT COUNT(*) FILTER (WHERE n >= ?) AS near, COUNT(*) FILTER (WHERE n >= ?) AS at
+		FROM (SELECT f.user_id, COUNT(*) AS n FROM user_favorites f
+			LEFT JOIN users u ON u.id = f.user_id
+			WHERE f.deleted_at IS NULL AND COALESCE(u.unlimited_favorites, false) = false
+			GROUP BY f.user_id) per_user`,
+		int64(float64(limit)*nearLimitRatio), limit).Scan(&counts).Error
+	if err != nil {
+		logrus.WithError(err).Error("Failed to count users near the favorites limit")
+		return
+	}
+	favoritesLimitUsers.Set(float64(counts.Near), "near")
+	favoritesLimitUsers.Set(float64(counts.At), "at")
+}
+
+// RemoveFavorite deletes a favorite relationship between a user and a product
+// and decrements the product's LocalFavoritesCount in the same transaction.
+// When the last favorite of the product is gone its IsFavorite flag is
+// cleared, so the favorites scheduler stops refreshing it.
 //
 // Parameters:
 //   - db: Database connection
 //   - userID: ID of the user removing the favorite
 //   - productID: ID of the product to unfavorite
+//   - source: Marketplace of the product
 //
 // Returns:
-//   - error: Any database error that occurred, nil if successful
-func RemoveFavorite(db *gorm.DB, userID, productID uint) error {
-	// Delete the favorite record
-	result := db.Where("user_id = ? AND product_id = ?", userID, productID).Delete(&models.UserFavorite{})
-	if result.Error != nil {
-		logrus.WithError(result.Error).WithFields(logrus.Fields{
+//   - error: ErrFavoriteNotFound if the product is not a favorite of the user,
+//     or any database error that occurred; nil if successful
+func RemoveFavorite(db *gorm.DB, userID, productID uint, source string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Only the request that actually deletes the row moves the counter
+		result := tx.Where("user_id = ? AND product_id = ? AND source = ?", userID, productID, source).Delete(&models.UserFavorite{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrFavoriteNotFound
+		}
+
+		// The update locks the product row, so concurrent removals of its
+		// last favorites count one after the other and see each other's
+		// deletes
+		err := tx.Model(&models.Product{}).Where("id = ? AND source = ?", productID, source).
+			UpdateColumn("local_favorites_count", gorm.Expr("GREATEST(local_favorites_count - 1, 0)")).Error
+		if err != nil {
+			return err
+		}
+		var remaining int64
+		if err := tx.Model(&models.UserFavorite{}).Where("product_id = ? AND source = ?", productID, source).Count(&remaining).Error; err != nil {
+			return err
+		}
+		if remaining > 0 {
+			return nil
+		}
+		return tx.Model(&models.Product{}).Where("id = ? AND source = ?", productID, source).
+			UpdateColumn("is_favorite", false).Error
+	})
+	if err != nil && !errors.Is(err, ErrFavoriteNotFound) {
+		logrus.WithError(err).WithFields(logrus.Fields{
 			"user_id":    userID,
 			"product_id": productID,
+			"source":     source,
 		}).Error("Failed to remove favorite")
 	}
-	return result.Error
+	return err
 }
 
-// GetUserFavorites retrieves all favorited products for a given user.
-// This is a two-step process:
-// 1. Get all favorite relationships for the user
-// 2. Fetch the actual product details for those relationships
+// MuteFavorite mutes or unmutes notifications about one of a user's
+// favorites. A muted favorite stays in the list and its price history is
+// still recorded; unmuting does not send the notifications missed meanwhile.
 //
 // Parameters:
 //   - db: Database connection
-//   - userID: ID of the user whose favorites to fetch
+//   - userID: Owner of the favorite
+//   - productID: Favorited product
+//   - source: Marketplace of the product
+//   - muted: Whether to mute the favorite
+//   - until: When the mute ends by itself; nil mutes until unmuted, ignored
+//     when unmuting
 //
 // Returns:
-//   - []models.Product: Slice of favorited products
-//   - error: Any database error that occurred
-func GetUserFavorites(db *gorm.DB, userID uint) ([]models.Product, error) {
-	// First, get all favorite relationships
-	var favorites []models.UserFavorite
-	result := db.Where("user_id = ?", userID).Find(&favorites)
+//   - error: gorm.ErrRecordNotFound if the user has not favorited the
+//     product, or any database error
+func MuteFavorite(db *gorm.DB, userID, productID uint, source string, muted bool, until *time.Time) error {
+	if !muted {
+		until = nil
+	}
+	result := db.Model(&models.UserFavorite{}).
+		Where("user_id = ? AND product_id = ? AND source = ?", userID, productID, source).
+		Updates(map[string]interface{}{"muted": muted, "muted_until": until})
 	if result.Error != nil {
-		logrus.WithError(result.Error).WithField("user_id", userID).Error("Failed to fetch favorites")
-		return nil, result.Error
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
 	}
+	logrus.WithFields(logrus.Fields{
+		"user_id":    userID,
+		"product_id": productID,
+		"source":     source,
+		"muted":      muted,
+		"until":      until,
+	}).Info("Favorite mute changed")
+	return nil
+}
 
-	// Extract product IDs from favorites
-	var productIDs []uint
-	for _, fav := range favorites {
-		productIDs = append(productIDs, fav.ProductID)
+// FavoriteChanges are changes to one of a user's favorites; only the fields
+// marked or non-nil are changed
+type FavoriteChanges struct {
+	SetTargetPrice bool      // Whether to change the target price
+	TargetPrice    *float64  // New target price when SetTargetPrice; nil notifies about every drop again
+	Note           *string   // New note; empty removes it
+	Tags           *[]string // New tags, normalized with NormalizeTags; empty removes them all
+}
+
+// NormalizeTags lower-cases and trims tags, and drops empty and repeated
+// ones, keeping the first occurrence's position.
+//
+// Parameters:
+//   - tags: Tags as entered by the user
+//
+// Returns:
+//   - []string: Normalized tags, never nil
+func NormalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// tagContainment returns the JSONB array that user_favorites.tags must
+// contain (@>) for a favorite to carry tag.
+func tagContainment(tag string) string {
+	encoded, _ := json.Marshal([]string{tag})
+	return string(encoded)
+}
+
+// UpdateFavorite changes the target price, note or tags of one of a user's
+// favorites. Without changes it does nothing.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: Owner of the favorite
+//   - productID: Favorited product
+//   - source: Marketplace of the product
+//   - changes: What to change
+//
+// Returns:
+//   - error: gorm.ErrRecordNotFound if the user has not favorited the
+//     product, or any database error
+func UpdateFavorite(db *gorm.DB, userID, productID uint, source string, changes FavoriteChanges) error {
+	updates := map[string]interface{}{}
+	if changes.SetTargetPrice {
+		updates["target_price"] = changes.TargetPrice
+	}
+	if changes.Note != nil {
+		updates["note"] = strings.TrimSpace(*changes.Note)
+	}
+	if changes.Tags != nil {
+		tags, err := json.Marshal(NormalizeTags(*changes.Tags))
+		if err != nil {
+			return err
+		}
+		updates["tags"] = datatypes.JSON(tags)
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	result := db.Model(&models.UserFavorite{}).
+		Where("user_id = ? AND product_id = ? AND source = ?", userID, productID, source).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	fields := logrus.Fields{
+		"user_id":    userID,
+		"product_id": productID,
+		"source":     source,
+	}
+	for column, value := range updates {
+		if column != "note" {
+			fields[column] = value
+		}
+	}
+	logrus.WithFields(fields).Info("Favorite updated")
+	return nil
+}
+
+// RecountLocalFavorites repairs the LocalFavoritesCount of every product from
+// user_favorites and returns the number of products whose count was wrong.
+// Writes to user_favorites wait while it runs, so it cannot miss a favorite
+// added or removed in the meantime.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - int64: Products whose count was corrected
+//   - error: Any database error
+func RecountLocalFavorites(db *gorm.DB) (int64, error) {
+	var fixed int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// SHARE mode waits for open AddFavorite and RemoveFavorite
+		// transactions, which move the counter before they commit
+		if err := tx.Exec("LOCK TABLE user_favorites IN SHARE MODE").Error; err != nil {
+			return err
+		}
+		result := tx.Exec(`UPDATE products SET local_favorites_count = counted.n
+			FROM (SELECT p.id, p.source, COUNT(f.id) AS n FROM products p
+				LEFT JOIN user_favorites f ON f.product_id = p.id AND f.source = p.source AND f.deleted_at IS NULL
+				GROUP BY p.id, p.source) counted
+			WHERE products.id = counted.id AND products.source = counted.source
+				AND products.local_favorites_count <> counted.n`)
+		fixed = result.RowsAffected
+		return result.Error
+	})
+	return fixed, err
+}
+
+// runFavoritesRecount runs RecountLocalFavorites and logs the outcome.
+func runFavoritesRecount(db *gorm.DB) {
+	fixed, err := RecountLocalFavorites(db)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to recount local favorites")
+		return
+	}
+	if fixed > 0 {
+		logrus.WithField("products", fixed).Warn("Corrected local favorites counts")
+	}
+}
+
+// startFavoritesRecountJob schedules RecountLocalFavorites and runs it once
+// right away, which also fills the counters of favorites added before the
+// column existed.
+//
+// Environment Variables:
+//   - FAVORITES_RECOUNT_CRON: Cron expression for the job (default: 0 4 * * *)
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startFavoritesRecountJob(db *gorm.DB) *cron.Cron {
+	spec := viper.GetString("FAVORITES_RECOUNT_CRON")
+	if spec == "" {
+		spec = "0 4 * * *" // Every night at 04:00
+	}
+
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	if _, err := c.AddFunc(spec, func() {
+		runFavoritesRecount(db)
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid favorites recount cron expression")
+	}
+	c.Start()
+	go runFavoritesRecount(db)
+
+	logrus.WithField("schedule", spec).Info("Favorites recount job scheduled")
+	return c
+}
+
+// GetUserFavorites retrieves all favorited products for a given user by
+// joining the user's favorite relationships with the products they reference
+// on (product_id, source).
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: ID of the user whose favorites to fetch
+//   - source: Only return products from this marketplace; empty for all
+//
+// Returns:
+//   - []models.Product: Slice of favorited products
+//   - error: Any database error that occurred
+func GetUserFavorites(db *gorm.DB, userID uint, source string) ([]models.Product, error) {
+	query := db.Model(&models.Product{}).
+		Joins("JOIN user_favorites ON user_favorites.product_id = products.id AND user_favorites.source = products.source AND user_favorites.deleted_at IS NULL").
+		Where("user_favorites.user_id = ?", userID)
+	if source != "" {
+		query = query.Where("products.source = ?", source)
 	}
 
 	// Fetch actual product details
 	var products []models.Product
-	result = db.Where("id IN ?", productIDs).Find(&products)
+	result := query.Find(&products)
 	if result.Error != nil {
 		logrus.WithError(result.Error).WithField("user_id", userID).Error("Failed to fetch products")
 	}
@@ -101,12 +679,245 @@ func GetUserFavorites(db *gorm.DB, userID uint) ([]models.Product, error) {
 //   - db: Database connection
 //   - userID: ID of the user to check
 //   - productID: ID of the product to check
+//   - source: Marketplace of the product
 //
 // Returns:
 //   - bool: true if the product is favorited by the user, false otherwise
-func IsProductFavorited(db *gorm.DB, userID, productID uint) bool {
+func IsProductFavorited(db *gorm.DB, userID, productID uint, source string) bool {
 	// Count matching favorite relationships
 	var count int64
-	db.Model(&models.UserFavorite{}).Where("user_id = ? AND product_id = ?", userID, productID).Count(&count)
+	db.Model(&models.UserFavorite{}).Where("user_id = ? AND product_id = ? AND source = ?", userID, productID, source).Count(&count)
 	return count > 0
-}
\ No newline at end of file
+}
+
+// FavoriteItem is a favorited product with its price movement since the
+// user favorited it. Price fields are null when no price history exists.
+type FavoriteItem struct {
+	models.Product
+	AddedAt            time.Time  `json:"added_at"`             // When the product was favorited
+	PriceWhenAdded     *float64   `json:"price_when_added"`     // Price at the time it was favorited
+	CurrentPrice       *float64   `json:"current_price"`        // Latest known price
+	PriceChange        *float64   `json:"price_change"`         // CurrentPrice - PriceWhenAdded
+	PriceChangePercent *float64   `json:"price_change_percent"` // PriceChange relative to PriceWhenAdded
+	CollectionID       *uint      `json:"collection_id"`        // Collection the favorite is filed under, null when uncategorized
+	Muted              bool       `json:"muted"`                // No notifications about the product, see PATCH /favorites/mute
+	MutedUntil         *time.Time `json:"muted_until"`          // When the mute ends by itself; null while not muted or muted until unmuted
+	TargetPrice        *float64   `json:"target_price"`         // Only drops to this price or below notify; null for every drop
+	Note               string     `json:"note"`                 // The user's note, empty when none
+	Tags               []string   `json:"tags"`                 // The user's lower-case tags
+	Status             string     `json:"status"`               // FavoriteStatusActive, FavoriteStatusInactive or FavoriteStatusOutOfStock
+}
+
+// Favorite statuses, see favoriteStatus
+const (
+	FavoriteStatusAll        = "all"          // Filter value matching every status
+	FavoriteStatusActive     = "active"       // Listed and in stock
+	FavoriteStatusInactive   = "inactive"     // No longer listed, e.g. discontinued
+	FavoriteStatusOutOfStock = "out_of_stock" // Listed without stock, or the listing is disabled
+)
+
+// FavoriteStatusCounts is the number of a user's favorites in each status
+type FavoriteStatusCounts struct {
+	All        int `json:"all"`
+	Active     int `json:"active"`
+	Inactive   int `json:"inactive"`
+	OutOfStock int `json:"out_of_stock"`
+}
+
+// favoriteStatus derives the status of a favorited product. The typed
+// StockInfo decides first, since the analysis service also marks products
+// without stock inactive; products without stock information count as in
+// stock.
+func favoriteStatus(p models.Product) string {
+	if stock := productStock(p); stock != nil && (stock.Quantity <= 0 || stock.Disabled) {
+		return FavoriteStatusOutOfStock
+	}
+	if !p.IsActive {
+		return FavoriteStatusInactive
+	}
+	return FavoriteStatusActive
+}
+
+// FilterFavoritesByStatus keeps the favorites in a status and counts the
+// favorites of every status, so a client can show how many each filter
+// would list.
+//
+// Parameters:
+//   - items: Favorites from ListUserFavorites
+//   - status: One of the FavoriteStatus constants; FavoriteStatusAll keeps
+//     every favorite
+//
+// Returns:
+//   - []FavoriteItem: The favorites in the status, in their original order
+//   - FavoriteStatusCounts: The favorites of items by status
+func FilterFavoritesByStatus(items []FavoriteItem, status string) ([]FavoriteItem, FavoriteStatusCounts) {
+	counts := FavoriteStatusCounts{All: len(items)}
+	kept := make([]FavoriteItem, 0, len(items))
+	for _, item := range items {
+		switch item.Status {
+		case FavoriteStatusActive:
+			counts.Active++
+		case FavoriteStatusInactive:
+			counts.Inactive++
+		case FavoriteStatusOutOfStock:
+			counts.OutOfStock++
+		}
+		if status == FavoriteStatusAll || item.Status == status {
+			kept = append(kept, item)
+		}
+	}
+	return kept, counts
+}
+
+// FavoriteFilter narrows the favorites returned by ListUserFavorites
+type FavoriteFilter struct {
+	Source        string // Only this marketplace; empty for all
+	CollectionID  *uint  // Only favorites in this collection
+	Uncategorized bool   // Only favorites outside any collection
+	Tag           string // Only favorites carrying this lower-case tag
+}
+
+// ListUserFavorites retrieves a user's favorited products together with how
+// their price moved since they were favorited. The price when added is
+// resolved from the price history entry nearest to AddedAt and cached on the
+// favorite row once found.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: ID of the user whose favorites to fetch
+//   - filter: Marketplace, collection and tag to limit the favorites to
+//   - sortBy: "biggest_drop" to order by largest price decrease first (unknown
+//     changes last); anything else keeps the most recently added first
+//
+// Returns:
+//   - []FavoriteItem: Favorited products with price movement
+//   - error: Any database error that occurred
+func ListUserFavorites(db *gorm.DB, userID uint, filter FavoriteFilter, sortBy string) ([]FavoriteItem, error) {
+	source := filter.Source
+
+	// Load the favorite relationships
+	query := db.Where("user_id = ?", userID)
+	if source != "" {
+		query = query.Where("source = ?", source)
+	}
+	if filter.CollectionID != nil {
+		query = query.Where("collection_id = ?", *filter.CollectionID)
+	} else if filter.Uncategorized {
+		query = query.Where("collection_id IS NULL")
+	}
+	if filter.Tag != "" {
+		query = query.Where("tags @> ?::jsonb", tagContainment(filter.Tag))
+	}
+	var favorites []models.UserFavorite
+	if err := query.Order("added_at DESC").Find(&favorites).Error; err != nil {
+		logrus.WithError(err).WithField("user_id", userID).Error("Failed to fetch favorites")
+		return nil, err
+	}
+
+	// Load the referenced products keyed by (source, id)
+	products, err := GetUserFavorites(db, userID, source)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]models.Product, len(products))
+	for _, p := range products {
+		byKey[p.Source+":"+strconv.FormatUint(uint64(p.ID), 10)] = p
+	}
+
+	now := time.Now()
+	items := make([]FavoriteItem, 0, len(favorites))
+	for _, fav := range favorites {
+		product, ok := byKey[fav.Source+":"+strconv.FormatUint(uint64(fav.ProductID), 10)]
+		if !ok {
+			continue
+		}
+
+		// Resolve and cache the price when added
+		if fav.PriceWhenAdded == nil {
+			price, err := priceAt(db, fav.ProductID, fav.Source, fav.AddedAt)
+			if err != nil {
+				logrus.WithError(err).WithField("product_id", fav.ProductID).Error("Failed to resolve price when added")
+			} else if price != nil {
+				fav.PriceWhenAdded = price
+				if err := db.Model(&fav).Update("price_when_added", *price).Error; err != nil {
+					logrus.WithError(err).WithField("product_id", fav.ProductID).Error("Failed to cache price when added")
+				}
+			}
+		}
+
+		item := FavoriteItem{Product: product, AddedAt: fav.AddedAt, PriceWhenAdded: fav.PriceWhenAdded, CollectionID: fav.CollectionID, TargetPrice: fav.TargetPrice, Note: fav.Note, Tags: []string{}, Status: favoriteStatus(product)}
+		if len(fav.Tags) > 0 {
+			if err := json.Unmarshal(fav.Tags, &item.Tags); err != nil {
+				logrus.WithError(err).WithField("product_id", fav.ProductID).Error("Failed to decode favorite tags")
+			}
+		}
+		if fav.Muted && (fav.MutedUntil == nil || fav.MutedUntil.After(now)) {
+			item.Muted, item.MutedUntil = true, fav.MutedUntil
+		}
+		if product.Price > 0 {
+			current := product.Price
+			item.CurrentPrice = &current
+		}
+		if item.PriceWhenAdded != nil && item.CurrentPrice != nil {
+			change := *item.CurrentPrice - *item.PriceWhenAdded
+			item.PriceChange = &change
+			if *item.PriceWhenAdded > 0 {
+				percent := change / *item.PriceWhenAdded * 100
+				item.PriceChangePercent = &percent
+			}
+		}
+		items = append(items, item)
+	}
+
+	if sortBy == "biggest_drop" {
+		sort.SliceStable(items, func(i, j int) bool {
+			a, b := items[i].PriceChange, items[j].PriceChange
+			if a == nil || b == nil {
+				return a != nil
+			}
+			return *a < *b
+		})
+	}
+	return items, nil
+}
+
+// priceAt resolves a product's price at a point in time from the price
+// history entry closest to it: the new price of the last change before t or
+// the old price of the first change after t, whichever is nearer.
+//
+// Parameters:
+//   - db: Database connection
+//   - productID: Product to look up
+//   - source: Marketplace of the product
+//   - t: Point in time
+//
+// Returns:
+//   - *float64: The price, nil if the product has no usable history
+//   - error: Any database error that occurred
+func priceAt(db *gorm.DB, productID uint, source string, t time.Time) (*float64, error) {
+	var before, after models.PriceStockLog
+	errBefore := db.Where("product_id = ? AND source = ? AND change_time <= ?", productID, source, t).Order("change_time DESC").First(&before).Error
+	if errBefore != nil && !errors.Is(errBefore, gorm.ErrRecordNotFound) {
+		return nil, errBefore
+	}
+	errAfter := db.Where("product_id = ? AND source = ? AND change_time > ?", productID, source, t).Order("change_time ASC").First(&after).Error
+	if errAfter != nil && !errors.Is(errAfter, gorm.ErrRecordNotFound) {
+		return nil, errAfter
+	}
+
+	var raw string
+	switch {
+	case errBefore == nil && (errAfter != nil || t.Sub(before.ChangeTime) <= after.ChangeTime.Sub(t)):
+		raw = before.NewPrice
+	case errAfter == nil:
+		raw = after.OldPrice
+	default:
+		return nil, nil
+	}
+
+	price, err := strconv.ParseFloat(raw, 64)
+	if err != nil || price <= 0 {
+		return nil, nil
+	}
+	return &price, nil
+}
@@ -0,0 +1,423 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"scraper/internal/apierror"
+	"scraper/internal/auth"
+	"scraper/internal/models"
+)
+
+// The stress tests use IDs from here on, far from real data
+const stressBaseID = 900000000
+
+// openStressDB connects to the PostgreSQL database in TEST_DATABASE_DSN,
+// skipping the test when it is unset, and removes the test rows afterwards.
+func openStressDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Product{}, &models.User{}, &models.UserFavorite{}); err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Unscoped().Where("user_id >= ?", stressBaseID).Delete(&models.UserFavorite{})
+		db.Unscoped().Where("id >= ?", stressBaseID).Delete(&models.Product{})
+		db.Unscoped().Where("id >= ?", stressBaseID).Delete(&models.User{})
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+	return db
+}
+
+// createStressUsers creates n users from stressBaseID on.
+func createStressUsers(t *testing.T, db *gorm.DB, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		id := uint(stressBaseID + i)
+		user := models.User{Model: gorm.Model{ID: id}, Email: fmt.Sprintf("stress-%d@example.test", id), IsActive: true}
+		if err := db.Create(&user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkLocalFavoritesCounts fails the test if a product's counter differs
+// from its live favorites.
+func checkLocalFavoritesCounts(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	var rows []struct {
+		ID      uint
+		Counter int64
+		Actual  int64
+	}
+	err := db.Raw(`SELECT p.id, p.local_favorites_count AS counter, COUNT(f.id) AS actual FROM products p
+		LEFT JOIN user_favorites f ON f.product_id = p.id AND f.source = p.source AND f.deleted_at IS NULL
+		WHERE p.id >= ? GROUP BY p.id, p.local_favorites_count`, stressBaseID).Scan(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if row.Counter != row.Actual {
+			t.Errorf("product %d: local_favorites_count = %d, want %d", row.ID, row.Counter, row.Actual)
+		}
+	}
+}
+
+func TestConcurrentFavoritesKeepCountersConsistent(t *testing.T) {
+	db := openStressDB(t)
+	viper.Set("FAVORITES_LIMIT", 3)
+	t.Cleanup(func() { viper.Set("FAVORITES_LIMIT", nil) })
+
+	const users, products = 6, 5
+	createStressUsers(t, db, users)
+	for i := uint(0); i < products; i++ {
+		if err := db.Create(&models.Product{ID: stressBaseID + i, Source: models.SourceTrendyol, Name: "stress"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 50; i++ {
+				userID := stressBaseID + uint(r.Intn(users))
+				productID := stressBaseID + uint(r.Intn(products))
+				if r.Intn(2) == 0 {
+					err := AddFavorite(db, userID, productID, models.SourceTrendyol)
+					var limitErr *FavoritesLimitError
+					if err != nil && !errors.Is(err, ErrDuplicateFavorite) && !errors.As(err, &limitErr) {
+						t.Error(err)
+						return
+					}
+				} else if err := RemoveFavorite(db, userID, productID, models.SourceTrendyol); err != nil && !errors.Is(err, ErrFavoriteNotFound) {
+					t.Error(err)
+					return
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	checkLocalFavoritesCounts(t, db)
+
+	var overLimit int64
+	err := db.Raw(`SELECT COUNT(*) FROM (SELECT user_id FROM user_favorites
+		WHERE user_id >= ? AND deleted_at IS NULL GROUP BY user_id HAVING COUNT(*) > 3) over`, stressBaseID).Scan(&overLimit).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overLimit > 0 {
+		t.Errorf("%d users are over the favorites limit", overLimit)
+	}
+}
+
+func TestRecountLocalFavoritesRepairsCounters(t *testing.T) {
+	db := openStressDB(t)
+
+	product := models.Product{ID: stressBaseID, Source: models.SourceTrendyol, Name: "stress"}
+	if err := db.Create(&product).Error; err != nil {
+		t.Fatal(err)
+	}
+	createStressUsers(t, db, 2)
+	for i := uint(0); i < 2; i++ {
+		if err := AddFavorite(db, stressBaseID+i, product.ID, product.Source); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Model(&models.Product{}).Where("id = ?", product.ID).UpdateColumn("local_favorites_count", 7)
+
+	fixed, err := RecountLocalFavorites(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed < 1 {
+		t.Errorf("fixed = %d, want at least 1", fixed)
+	}
+	checkLocalFavoritesCounts(t, db)
+}
+
+func TestBulkAddFavorites(t *testing.T) {
+	db := openStressDB(t)
+	viper.Set("FAVORITES_LIMIT", 3)
+	t.Cleanup(func() { viper.Set("FAVORITES_LIMIT", nil) })
+
+	for i := uint(0); i < 4; i++ {
+		if err := db.Create(&models.Product{ID: stressBaseID + i, Source: models.SourceTrendyol, Name: "stress"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	user := uint(stressBaseID)
+	createStressUsers(t, db, 1)
+	if err := AddFavorite(db, user, stressBaseID, models.SourceTrendyol); err != nil {
+		t.Fatal(err)
+	}
+	// A removed favorite is added again
+	if err := AddFavorite(db, user, stressBaseID+1, models.SourceTrendyol); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveFavorite(db, user, stressBaseID+1, models.SourceTrendyol); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []uint{stressBaseID, stressBaseID + 99, stressBaseID + 1, stressBaseID + 1, stressBaseID + 2, stressBaseID + 3}
+	results, err := BulkAddFavorites(db, user, ids, models.SourceTrendyol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{BulkFavoriteExists, BulkFavoriteNotFound, BulkFavoriteCreated, BulkFavoriteExists, BulkFavoriteCreated, BulkFavoriteLimitReached}
+	for i, result := range results {
+		if result.ProductID != ids[i] || result.Status != want[i] {
+			t.Errorf("result %d = %+v, want %d %s", i, result, ids[i], want[i])
+		}
+	}
+	// The re-added and the new favorite are flagged; the one over the limit is not
+	for id, favorite := range map[uint]bool{stressBaseID + 1: true, stressBaseID + 2: true, stressBaseID + 3: false} {
+		var product models.Product
+		if err := db.First(&product, "id = ? AND source = ?", id, models.SourceTrendyol).Error; err != nil {
+			t.Fatal(err)
+		}
+		if product.IsFavorite != favorite {
+			t.Errorf("product %d is_favorite = %v, want %v", id, product.IsFavorite, favorite)
+		}
+	}
+	checkLocalFavoritesCounts(t, db)
+}
+
+func TestNormalizeTags(t *testing.T) {
+	got := NormalizeTags([]string{" Gift Ideas", "wait for sale", "", "GIFT IDEAS", "  "})
+	want := []string{"gift ideas", "wait for sale"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("NormalizeTags = %q, want %q", got, want)
+	}
+	if got := NormalizeTags(nil); got == nil || len(got) != 0 {
+		t.Errorf("NormalizeTags(nil) = %#v, want an empty slice", got)
+	}
+	if got := tagContainment(`say "hi"`); got != `["say \"hi\""]` {
+		t.Errorf("tagContainment = %s, want a one-element JSON array", got)
+	}
+}
+
+func TestFilterFavoritesByStatus(t *testing.T) {
+	product := func(id uint, active bool, stock string) FavoriteItem {
+		p := models.Product{ID: id, IsActive: active}
+		if stock != "" {
+			p.StockInfo = []byte(stock)
+		}
+		return FavoriteItem{Product: p, Status: favoriteStatus(p)}
+	}
+	items := []FavoriteItem{
+		product(1, true, `{"stock": 7}`),
+		product(2, true, ""),              // No stock information counts as in stock
+		product(3, false, `{"stock": 0}`), // Marked inactive for the empty stock
+		product(4, true, `{"stock": 3, "disabled": true}`),
+		product(5, false, `{"stock": 2}`), // Discontinued
+	}
+
+	tests := []struct {
+		status string
+		want   []uint
+	}{
+		{FavoriteStatusAll, []uint{1, 2, 3, 4, 5}},
+		{FavoriteStatusActive, []uint{1, 2}},
+		{FavoriteStatusOutOfStock, []uint{3, 4}},
+		{FavoriteStatusInactive, []uint{5}},
+	}
+	for _, tt := range tests {
+		kept, counts := FilterFavoritesByStatus(items, tt.status)
+		var got []uint
+		for _, item := range kept {
+			got = append(got, item.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("status %s kept %v, want %v", tt.status, got, tt.want)
+		}
+		if want := (FavoriteStatusCounts{All: 5, Active: 2, Inactive: 1, OutOfStock: 2}); counts != want {
+			t.Errorf("status %s counts = %+v, want %+v", tt.status, counts, want)
+		}
+	}
+}
+
+func TestAddFavoriteHandler(t *testing.T) {
+	db := openStressDB(t)
+	issuer, err := auth.NewIssuer(strings.Repeat("k", 32), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := issuer.Issue(1, "admin@example.test", true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler(mapError)
+	e.Use(auth.Middleware(issuer, authRoutes()))
+	registerHandlers(e, db, nil, issuer)
+
+	createStressUsers(t, db, 1)
+	user, product := uint(stressBaseID), uint(stressBaseID)
+	if err := db.Create(&models.Product{ID: product, Source: models.SourceTrendyol, Name: "stress"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	add := func(userID, productID uint) (int, apierror.Response) {
+		body := fmt.Sprintf(`{"user_id": %d, "product_id": %d}`, userID, productID)
+		req := httptest.NewRequest(http.MethodPost, "/favorites", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var res apierror.Response
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+
+	tests := []struct {
+		name      string
+		userID    uint
+		productID uint
+		status    int
+		code      apierror.Code
+	}{
+		{"unknown user", stressBaseID + 50, product, http.StatusNotFound, apierror.CodeUserNotFound},
+		{"unknown product", user, stressBaseID + 50, http.StatusNotFound, apierror.CodeProductNotFound},
+		{"added", user, product, http.StatusOK, ""},
+		{"added twice", user, product, http.StatusConflict, apierror.CodeDuplicateFavorite},
+	}
+	for _, tt := range tests {
+		status, res := add(tt.userID, tt.productID)
+		if status != tt.status || res.Code != tt.code {
+			t.Errorf("%s: status %d with code %q, want %d with %q", tt.name, status, res.Code, tt.status, tt.code)
+		}
+	}
+
+	var stored models.Product
+	if err := db.Where("id = ? AND source = ?", product, models.SourceTrendyol).First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.IsFavorite || stored.LocalFavoritesCount != 1 {
+		t.Errorf("product is_favorite = %v, local_favorites_count = %d; want true and 1", stored.IsFavorite, stored.LocalFavoritesCount)
+	}
+	var favorites int64
+	db.Model(&models.UserFavorite{}).Where("product_id >= ?", stressBaseID).Count(&favorites)
+	if favorites != 1 {
+		t.Errorf("%d favorites stored, want only the added one", favorites)
+	}
+}
+
+func TestConcurrentRemoveFavorite(t *testing.T) {
+	db := openStressDB(t)
+	issuer, err := auth.NewIssuer(strings.Repeat("k", 32), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := issuer.Issue(1, "admin@example.test", true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler(mapError)
+	e.Use(auth.Middleware(issuer, authRoutes()))
+	registerHandlers(e, db, nil, issuer)
+
+	const users = 3
+	createStressUsers(t, db, users)
+	product := uint(stressBaseID)
+	if err := db.Create(&models.Product{ID: product, Source: models.SourceTrendyol, Name: "stress"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := uint(0); i < users; i++ {
+		if err := AddFavorite(db, stressBaseID+i, product, models.SourceTrendyol); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isFavorite := func() bool {
+		var stored models.Product
+		if err := db.Where("id = ? AND source = ?", product, models.SourceTrendyol).First(&stored).Error; err != nil {
+			t.Fatal(err)
+		}
+		return stored.IsFavorite
+	}
+
+	// Concurrent removals of the same favorite: exactly one deletes it
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	removed, notFound := 0, 0
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := RemoveFavorite(db, stressBaseID, product, models.SourceTrendyol)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				removed++
+			case errors.Is(err, ErrFavoriteNotFound):
+				notFound++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if removed != 1 || notFound != 15 {
+		t.Errorf("%d removals succeeded and %d were not found, want 1 and 15", removed, notFound)
+	}
+	checkLocalFavoritesCounts(t, db)
+	if !isFavorite() {
+		t.Error("is_favorite cleared while the product still has followers")
+	}
+
+	// The remaining followers leave at the same time
+	for i := uint(1); i < users; i++ {
+		wg.Add(1)
+		go func(userID uint) {
+			defer wg.Done()
+			if err := RemoveFavorite(db, userID, product, models.SourceTrendyol); err != nil {
+				t.Error(err)
+			}
+		}(stressBaseID + i)
+	}
+	wg.Wait()
+	checkLocalFavoritesCounts(t, db)
+	if isFavorite() {
+		t.Error("is_favorite still set after the last follower left")
+	}
+
+	// Removing it again over HTTP is a 404
+	body := fmt.Sprintf(`{"user_id": %d, "product_id": %d}`, stressBaseID, product)
+	req := httptest.NewRequest(http.MethodDelete, "/favorites", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var res apierror.Response
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	if rec.Code != http.StatusNotFound || res.Code != apierror.CodeNotFound {
+		t.Errorf("DELETE /favorites of a removed favorite: status %d with code %q, want 404 not_found", rec.Code, res.Code)
+	}
+}
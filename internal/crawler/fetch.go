@@ -3,20 +3,60 @@
 package crawler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 
 	"gorm.io/datatypes"
 
 	"scraper/internal/models"
+	"scraper/pkg/httpclient"
 
 	"github.com/sirupsen/logrus"
 )
 
+// productFetchTimeout bounds a single product detail request
+const productFetchTimeout = 30 * time.Second
+
+// trendyolClient sends every request to Trendyol, sharing its connection pool
+var trendyolClient = httpclient.MustNew(httpclient.Options{Name: "trendyol", Timeout: productFetchTimeout})
+
+// productDetailURL is the Trendyol product detail endpoint, formatted with the
+// product ID; a variable so tests can point it at a local server
+var productDetailURL = "https://apigw.trendyol.com/discovery-sfint-product-service/api/product-detail/?contentId=%d&campaignId=null&storefrontId=36&culture=en-AE"
+
+// FetchError describes a failed product detail request.
+type FetchError struct {
+	ProductID  int   // Product that could not be fetched
+	StatusCode int   // HTTP status, 0 if no response was received
+	Err        error // Underlying error
+}
+
+// Error implements the error interface
+func (e *FetchError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("fetch product %d: HTTP %d", e.ProductID, e.StatusCode)
+	}
+	return fmt.Sprintf("fetch product %d: %v", e.ProductID, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *FetchError) Unwrap() error { return e.Err }
+
+// Retryable reports whether the failure is transient: network errors,
+// timeouts, rate limiting and 5xx responses.
+func (e *FetchError) Retryable() bool {
+	if e.StatusCode == 0 {
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
 // FetchProductDetails retrieves detailed product information from Trendyol's API.
 // It makes an HTTP GET request to Trendyol's product detail endpoint and returns
 // the raw JSON response as a map.
@@ -28,21 +68,50 @@ import (
 //   - map[string]interface{}: The raw JSON response from Trendyol's API
 //   - nil if any error occurs during the request
 //
+// The request goes through the Trendyol Fetcher, so injected fetch faults
+// apply. Callers that need to know why a request failed should use the
+// Fetcher from FetcherFor instead.
+func FetchProductDetails(productID int) map[string]interface{} {
+	trendyol, _ := FetcherFor(models.SourceTrendyol)
+	detail, err := trendyol.FetchDetails(context.Background(), productID)
+	if err != nil {
+		logrus.WithError(err).WithField("product_id", productID).Error("Error fetching product")
+		return nil
+	}
+	return detail
+}
+
+// FetchProductDetailsWithError retrieves detailed product information from Trendyol's
+// API and reports failures as a *FetchError.
+//
 // The function handles various error cases:
 //   - Request creation errors
-//   - Network/HTTP errors
+//   - Network/HTTP errors and timeouts
+//   - Non-200 responses
 //   - Response reading errors
 //   - JSON parsing errors
-func FetchProductDetails(productID int) map[string]interface{} {
+//
+// Parameters:
+//   - ctx: Context of the request; the request is abandoned once it is done
+//   - productID: The unique identifier of the product to fetch
+//
+// Returns:
+//   - map[string]interface{}: The raw JSON response from Trendyol's API
+//   - error: A *FetchError describing the failure
+//
+// The request is counted in trendyol_requests_total and its duration is
+// recorded in product_detail_fetch_duration_seconds.
+func FetchProductDetailsWithError(ctx context.Context, productID int) (map[string]interface{}, error) {
+	start := time.Now()
+	defer func() { productDetailFetchDuration.Observe(time.Since(start).Seconds()) }()
+
 	// Construct the API URL with the product ID
-	url := fmt.Sprintf("https://apigw.trendyol.com/discovery-sfint-product-service/api/product-detail/?contentId=%d&campaignId=null&storefrontId=36&culture=en-AE", productID)
+	url := fmt.Sprintf(productDetailURL, productID)
 
-	// Create HTTP client and request
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+	// Create the request
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		logrus.WithError(err).WithField("product_id", productID).Error("Error creating request")
-		return nil
+		return nil, &FetchError{ProductID: productID, Err: err}
 	}
 
 	// Set required headers for the API request
@@ -59,39 +128,114 @@ func FetchProductDetails(productID int) map[string]interface{} {
 	// req.Header.Set("Accept-Encoding", "gzip, deflate, br, zstd")
 
 	// Execute the request
-	resp, err := client.Do(req)
+	resp, err := trendyolClient.Do(req)
+	trendyolRequests.Inc(endpointProductDetail, responseStatus(resp, err))
 	if err != nil {
-		logrus.WithError(err).WithField("product_id", productID).Error("Error fetching product")
-		return nil
+		return nil, &FetchError{ProductID: productID, Err: err}
 	}
 	defer resp.Body.Close()
 
+	// Reject error responses before parsing
+	if resp.StatusCode != http.StatusOK {
+		return nil, &FetchError{ProductID: productID, StatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+
 	// Read and parse the response
 	bodyText, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logrus.WithError(err).WithField("product_id", productID).Error("Error reading response")
-		return nil
+		return nil, &FetchError{ProductID: productID, Err: err}
 	}
 
 	// Parse JSON response
 	var jsonResponse map[string]interface{}
 	if err := json.Unmarshal(bodyText, &jsonResponse); err != nil {
-		logrus.WithError(err).WithField("product_id", productID).Error("Error unmarshaling response")
-		return nil
+		return nil, &FetchError{ProductID: productID, StatusCode: resp.StatusCode, Err: err}
+	}
+
+	return jsonResponse, nil
+}
+
+// FetchProduct retrieves a single product from Trendyol and converts it into our
+// internal Product model. It goes through the Trendyol Fetcher, like the
+// favorites scheduler, so the response is converted the same way.
+//
+// Parameters:
+//   - ctx: Context of the request
+//   - productID: The unique identifier of the product to fetch
+//
+// Returns:
+//   - *models.Product: The converted product
+//   - error: If the product could not be fetched or decoded
+func FetchProduct(ctx context.Context, productID int) (*models.Product, error) {
+	return FetchProductFrom(ctx, models.SourceTrendyol, productID)
+}
+
+// FetchProductFrom retrieves a single product from the marketplace it belongs
+// to, using the fetcher registered for the source.
+//
+// Parameters:
+//   - ctx: Context of the request
+//   - source: Marketplace of the product; empty means trendyol
+//   - productID: The product identifier within the source
+//
+// Returns:
+//   - *models.Product: The converted product
+//   - error: If the source is unknown or the product could not be fetched
+func FetchProductFrom(ctx context.Context, source string, productID int) (*models.Product, error) {
+	fetcher, err := FetcherFor(source)
+	if err != nil {
+		return nil, err
+	}
+	detail, err := fetcher.FetchDetails(ctx, productID)
+	if err != nil {
+		return nil, err
 	}
+	return fetcher.ToProduct(productID, detail)
+}
 
-	return jsonResponse
+// productFromDetail converts a raw product detail response into our internal
+// Product model.
+//
+// Parameters:
+//   - productID: The product the detail was fetched for
+//   - detail: Raw JSON response from FetchProductDetails
+//
+// Returns:
+//   - *models.Product: The converted product
+//   - error: If the response cannot be decoded or is empty
+func productFromDetail(productID int, detail map[string]interface{}) (*models.Product, error) {
+	// Convert raw map into the typed Trendyol response
+	data, err := json.Marshal(detail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal product %d: %v", productID, err)
+	}
+	var resp models.TrendyolResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product %d: %v", productID, err)
+	}
+	if resp.ID == 0 {
+		return nil, fmt.Errorf("product %d not found on Trendyol", productID)
+	}
+
+	// Convert to Product model, stamped for pipeline latency tracking
+	products := ConvertTrendyolToProduct(&[]models.TrendyolResponse{resp})
+	fetchedAt := time.Now()
+	products[0].FetchedAt = &fetchedAt
+	return &products[0], nil
 }
 
 // readMockData reads and parses mock product data from a JSON file.
 // This is used for testing and development purposes.
 //
+// Parameters:
+//   - path: The file to read, usually crawlDataFile
+//
 // Returns:
 //   - []models.Product: Slice of parsed product models
 //   - error: Any error that occurred during file reading or parsing
-func readMockData() ([]models.Product, error) {
+func readMockData(path string) ([]models.Product, error) {
 	// Read mock data file
-	data, err := ioutil.ReadFile("data.json")
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read mock data: %v", err)
 	}
@@ -109,7 +253,8 @@ func readMockData() ([]models.Product, error) {
 
 // ConvertTrendyolToProduct converts Trendyol API responses to our internal Product models.
 // It handles the mapping of all fields and nested structures, converting them to the
-// appropriate format for our database schema.
+// appropriate format for our database schema. JSONB fields over their size
+// limit are shortened, see GuardPayload.
 //
 // Parameters:
 //   - item: Pointer to slice of TrendyolResponse objects from the API
@@ -157,8 +302,8 @@ func ConvertTrendyolToProduct(item *[]models.TrendyolResponse) []models.Product
 
 		// Convert delivery information to JSON
 		deliveryJSON, _ := json.Marshal(map[string]interface{}{
-			"deliveryEndDate":   content.Delivery.DeliveryEndDate,
-			"deliveryStartDate": content.Delivery.DeliveryStartDate,
+			"deliveryEndDate":   content.WinnerMerchantListing.DeliveryEndDate,
+			"deliveryStartDate": content.WinnerMerchantListing.DeliveryStartDate,
 		})
 
 		// Process other sellers' variants
@@ -208,10 +353,13 @@ func ConvertTrendyolToProduct(item *[]models.TrendyolResponse) []models.Product
 		// Create the product model with all converted data
 		products[i] = models.Product{
 			ID:                uint(content.ID),
+			Source:            models.SourceTrendyol,
 			Name:              content.Name,
 			CategoryPath:      content.Category.Hierarchy,
 			Brand:             datatypes.JSON(brandJSON),
+			BrandID:           uint(content.Brand.ID),
 			Seller:            datatypes.JSON(sellerJSON),
+			SellerID:          uint(content.WinnerMerchantListing.Merchant.ID),
 			RatingScore:       datatypes.JSON(ratingJSON),
 			IsActive:          content.InStock,
 			StockInfo:         datatypes.JSON(stockJSON),
@@ -226,9 +374,16 @@ func ConvertTrendyolToProduct(item *[]models.TrendyolResponse) []models.Product
 			AddToCartEvents:   addToBasket,
 			EstimatedDelivery: datatypes.JSON(deliveryJSON),
 			OtherSellers:      datatypes.JSON(otherSellersVariantsJSON),
+			Price:             content.WinnerVariant.Price.DiscountedPrice,
 		}
 	}
 
+	// Keep oversized description and listing blobs out of the database
+	limits := LoadPayloadLimits()
+	for i := range products {
+		GuardPayload(&products[i], limits)
+	}
+
 	// Log success and return converted products
 	logrus.WithField("count", len(products)).Info("Converted Trendyol response to products")
 	return products
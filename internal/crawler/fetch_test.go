@@ -0,0 +1,30 @@
+package crawler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"scraper/internal/models"
+)
+
+func TestConvertTrendyolDeliveryDates(t *testing.T) {
+	// Trendyol reports the delivery window on the winning listing; the
+	// response has no top-level delivery object
+	raw := `[{"id": 1, "name": "Rug", "winnerMerchantListing": {
+		"deliveryStartDate": "2025-05-03T21:06:30", "deliveryEndDate": "2025-05-07T21:06:30"}}]`
+	var items []models.TrendyolResponse
+	if err := json.Unmarshal([]byte(raw), &items); err != nil {
+		t.Fatal(err)
+	}
+	products := ConvertTrendyolToProduct(&items)
+	if len(products) != 1 {
+		t.Fatalf("%d products, want 1", len(products))
+	}
+	var delivery map[string]string
+	if err := json.Unmarshal(products[0].EstimatedDelivery, &delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery["deliveryStartDate"] != "2025-05-03T21:06:30" || delivery["deliveryEndDate"] != "2025-05-07T21:06:30" {
+		t.Errorf("estimated delivery = %v, want the winning listing's window", delivery)
+	}
+}
@@ -0,0 +1,735 @@
+// Package crawler implements the asynchronous /fetch jobs
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+	"scraper/internal/models"
+	"scraper/internal/timeout"
+	"scraper/pkg/httpclient"
+)
+
+// Fetch job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// Limits of the in-memory job registry
+const (
+	maxFetchJobs      = 100 // Finished jobs kept for GET /fetch/jobs/:id
+	maxFetchJobErrors = 50  // Errors listed per job; ErrorCount counts all
+)
+
+// Bounds of the crawl a /fetch request may select
+const (
+	maxCrawlSpan     = 500 // Web categories per crawl
+	maxCrawlPageSize = 200 // Products per category listing request
+)
+
+// crawlFetchDelay is the pause between Trendyol product detail requests of a
+// crawl
+var crawlFetchDelay = 4 * time.Second
+
+// crawlListingURL is the Trendyol category listing, formatted with the web
+// category and page size
+var crawlListingURL = "https://apigw.trendyol.com/discovery-sfint-browsing-service/api/search-feed/products?source=sr?wc=%d&size=%d"
+
+// crawlDataFile is where a live crawl writes the raw product details it
+// publishes. The crawl writes crawlDataFile+".tmp" and renames it once the
+// file is complete, so readers never see a partial file.
+var crawlDataFile = "data.json"
+
+// Built-in crawl range used when FETCH_WC_START, FETCH_WC_END and
+// FETCH_PAGE_SIZE are unset or invalid
+var builtinCrawlRange = crawlRange{First: 94, Last: 200, PageSize: 60}
+
+// errFetchJobActive is returned when a job is enqueued while another one is
+// queued or running
+var errFetchJobActive = errors.New("a fetch job is already running")
+
+// errCrawlCancelled finishes a job whose crawl a shutdown stopped
+var errCrawlCancelled = errors.New("crawl cancelled by shutdown")
+
+// FetchJob is the state of one /fetch run, as returned by GET /fetch/jobs/:id
+type FetchJob struct {
+	ID                  string           `json:"id"`                         // Generated job ID
+	Live                bool             `json:"live"`                       // Crawls Trendyol; false publishes the stored data.json
+	DryRun              bool             `json:"dry_run"`                    // Builds and logs the batches without publishing them
+	State               string           `json:"state"`                      // "queued", "running", "completed" or "failed"
+	FirstCategory       int              `json:"first_category"`             // First web category to crawl
+	LastCategory        int              `json:"last_category"`              // Last web category to crawl
+	PageSize            int              `json:"page_size"`                  // Products listed per category
+	ProductIDs          []int            `json:"product_ids,omitempty"`      // Products crawled by POST /crawl/products instead of categories
+	BatchSize           int              `json:"batch_size"`                 // Products per Kafka message
+	ReportID            uint             `json:"report_id,omitempty"`        // Crawl report of a live crawl
+	APIKeyID            string           `json:"api_key_id,omitempty"`       // ID of the API key that started the job, see apikey.ID
+	CategoriesProcessed int              `json:"categories_processed"`       // Web categories the crawl started on
+	ProductsListed      int              `json:"products_listed"`            // Products the category listings returned
+	ProductsFetched     int              `json:"products_fetched"`           // Product details fetched and written
+	DetailFailures      int              `json:"detail_failures"`            // Product detail fetches that failed
+	BudgetExhausted     bool             `json:"budget_exhausted"`           // The crawl stopped early for lack of request budget
+	FailedProducts      []ProductFailure `json:"failed_products,omitempty"`  // Products of a POST /crawl/products job that were skipped
+	Errors              []string         `json:"errors"`                     // The first maxFetchJobErrors errors encountered
+	ErrorCount          int              `json:"error_count"`                // All errors encountered
+	Summary             *PublishSummary  `json:"summary,omitempty"`          // Kafka publish outcome once finished
+	Error               string           `json:"error,omitempty"`            // Why a failed job stopped
+	CreatedAt           time.Time        `json:"created_at"`                 // When the job was enqueued
+	StartedAt           *time.Time       `json:"started_at,omitempty"`       // When the job started running
+	FinishedAt          *time.Time       `json:"finished_at,omitempty"`      // When the job finished
+	DurationSeconds     float64          `json:"duration_seconds,omitempty"` // How long the job ran, once finished
+}
+
+// crawlRange selects the web categories a crawl lists and how many products
+// it lists per category
+type crawlRange struct {
+	First    int // First web category
+	Last     int // Last web category, inclusive
+	PageSize int // Products per category listing request
+}
+
+// validate checks a crawl range against the /fetch limits.
+func (r crawlRange) validate() error {
+	if r.First < 1 {
+		return fmt.Errorf("wc_start must be a positive integer")
+	}
+	if r.First > r.Last {
+		return fmt.Errorf("wc_start must not be greater than wc_end")
+	}
+	if r.Last-r.First+1 > maxCrawlSpan {
+		return fmt.Errorf("a crawl may span at most %d categories", maxCrawlSpan)
+	}
+	if r.PageSize < 1 || r.PageSize > maxCrawlPageSize {
+		return fmt.Errorf("page_size must be between 1 and %d", maxCrawlPageSize)
+	}
+	return nil
+}
+
+// defaultCrawlRange returns the crawl range of a /fetch request without range
+// parameters. An invalid configuration is logged and replaced by 94-200 with
+// 60 products per category.
+//
+// Environment Variables:
+//   - FETCH_WC_START: First web category crawled (default: 94)
+//   - FETCH_WC_END: Last web category crawled (default: 200)
+//   - FETCH_PAGE_SIZE: Products listed per category (1-200, default: 60)
+func defaultCrawlRange() crawlRange {
+	r := builtinCrawlRange
+	if start := viper.GetInt("FETCH_WC_START"); start != 0 {
+		r.First = start
+	}
+	if end := viper.GetInt("FETCH_WC_END"); end != 0 {
+		r.Last = end
+	}
+	if size := viper.GetInt("FETCH_PAGE_SIZE"); size != 0 {
+		r.PageSize = size
+	}
+	if err := r.validate(); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"wc_start":  r.First,
+			"wc_end":    r.Last,
+			"page_size": r.PageSize,
+		}).Warn("Invalid default crawl range, using 94-200")
+		return builtinCrawlRange
+	}
+	return r
+}
+
+// parseCrawlRange reads the crawl range of a /fetch request. category crawls
+// a single web category and cannot be combined with wc_start or wc_end;
+// omitted parameters fall back to defaultCrawlRange.
+//
+// Returns:
+//   - crawlRange: The requested range
+//   - error: An apierror for malformed or out-of-bounds parameters
+func parseCrawlRange(c echo.Context) (crawlRange, error) {
+	r := defaultCrawlRange()
+	intParam := func(name string, target *int) error {
+		raw := c.QueryParam(name)
+		if raw == "" {
+			return nil
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return apierror.Invalid(name + " must be an integer")
+		}
+		*target = value
+		return nil
+	}
+
+	if raw := c.QueryParam("category"); raw != "" {
+		if c.QueryParam("wc_start") != "" || c.QueryParam("wc_end") != "" {
+			return r, apierror.Invalid("category cannot be combined with wc_start or wc_end")
+		}
+		category, err := strconv.Atoi(raw)
+		if err != nil || category <= 0 {
+			return r, apierror.Invalid("category must be a positive integer")
+		}
+		r.First, r.Last = category, category
+	}
+	if err := intParam("wc_start", &r.First); err != nil {
+		return r, err
+	}
+	if err := intParam("wc_end", &r.Last); err != nil {
+		return r, err
+	}
+	if err := intParam("page_size", &r.PageSize); err != nil {
+		return r, err
+	}
+	if err := r.validate(); err != nil {
+		return r, apierror.Invalid(err.Error())
+	}
+	return r, nil
+}
+
+// fetchJobRegistry holds the jobs of this crawler process. Only one job runs
+// at a time: live crawls take hours and spend the request budget, and every
+// job reads or writes data.json.
+type fetchJobRegistry struct {
+	mu     sync.Mutex
+	jobs   map[string]*FetchJob
+	order  []string // Job IDs, oldest first
+	active string   // Queued or running job, empty when idle
+}
+
+// fetchJobs is the job registry of the crawler service
+var fetchJobs = &fetchJobRegistry{jobs: make(map[string]*FetchJob)}
+
+// enqueue registers a job as queued, dropping the oldest finished jobs
+// beyond maxFetchJobs.
+//
+// Parameters:
+//   - job: The new job
+//
+// Returns:
+//   - string: ID of the job that is already queued or running on failure
+//   - error: errFetchJobActive if another job has not finished
+func (r *fetchJobRegistry) enqueue(job *FetchJob) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active != "" {
+		return r.active, errFetchJobActive
+	}
+
+	job.State = JobQueued
+	job.CreatedAt = time.Now()
+	job.Errors = []string{}
+	r.jobs[job.ID] = job
+	r.order = append(r.order, job.ID)
+	r.active = job.ID
+	for len(r.order) > maxFetchJobs {
+		delete(r.jobs, r.order[0])
+		r.order = r.order[1:]
+	}
+	return "", nil
+}
+
+// get returns a copy of a job that is safe to encode while it runs.
+func (r *fetchJobRegistry) get(id string) (FetchJob, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return FetchJob{}, false
+	}
+	snapshot := *job
+	snapshot.Errors = append([]string{}, job.Errors...)
+	snapshot.FailedProducts = append([]ProductFailure(nil), job.FailedProducts...)
+	return snapshot, true
+}
+
+// update changes a job under the registry lock. Unknown IDs, such as the
+// empty ID of a crawl without a job, are ignored.
+func (r *fetchJobRegistry) update(id string, change func(job *FetchJob)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job, ok := r.jobs[id]; ok {
+		change(job)
+	}
+}
+
+// addError records an error the job encountered without stopping it.
+func (r *fetchJobRegistry) addError(id, message string) {
+	r.update(id, func(job *FetchJob) {
+		job.ErrorCount++
+		if len(job.Errors) < maxFetchJobErrors {
+			job.Errors = append(job.Errors, message)
+		}
+	})
+}
+
+// finish closes a job and lets the next one be enqueued. A non-nil err marks
+// the job failed.
+func (r *fetchJobRegistry) finish(id string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	job.FinishedAt = &now
+	if job.StartedAt != nil {
+		job.DurationSeconds = now.Sub(*job.StartedAt).Seconds()
+	}
+	job.State = JobCompleted
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+		job.ErrorCount++
+		if len(job.Errors) < maxFetchJobErrors {
+			job.Errors = append(job.Errors, err.Error())
+		}
+	}
+	if r.active == id {
+		r.active = ""
+	}
+	if job.StartedAt != nil {
+		mode := "file"
+		if job.Live {
+			mode = "live"
+		}
+		fetchJobDuration.Observe(job.DurationSeconds, mode, job.State)
+	}
+}
+
+// runFetchJob crawls the job's web categories into data.json when it is live,
+// then publishes data.json to Kafka. Progress is recorded in the job and, for
+// live crawls, in a crawl report.
+//
+// A shutdown stops the crawl before its next request. The products fetched
+// until then are still published, batches Kafka does not take are spooled to
+// the outbox, and the report is closed as cancelled.
+//
+// A dry run fetches and converts like any other job but only counts and logs
+// the batches, see countBatches. Its crawl leaves data.json and the retry
+// queue alone, so nothing it found reaches Kafka later either.
+//
+// Parameters:
+//   - db: Database connection
+//   - producer: Kafka producer the products are published with
+//   - job: The queued job; only its parameters are read
+func runFetchJob(db *gorm.DB, producer sarama.SyncProducer, job FetchJob) {
+	now := time.Now()
+	fetchJobs.update(job.ID, func(j *FetchJob) {
+		j.State = JobRunning
+		j.StartedAt = &now
+	})
+
+	ctx, done := crawls.start(context.Background())
+	defer done()
+
+	// Live crawls keep a report of their progress; mock runs have none
+	var report *crawlRecorder
+	budgetExhausted := false
+	cancelled := false
+	publishCtx := context.Background()
+	dataFile := crawlDataFile
+
+	if job.Live {
+		trendyol, _ := FetcherFor(models.SourceTrendyol)
+
+		// Tie the crawl's Trendyol requests together under one correlation ID
+		correlationID := httpclient.NewCorrelationID()
+		crawlCtx := httpclient.WithCorrelationID(ctx, correlationID)
+		// Publishing outlives a shutdown, it flushes what was fetched
+		publishCtx = context.WithoutCancel(crawlCtx)
+		logrus.WithFields(logrus.Fields{
+			"correlation_id": correlationID,
+			"job_id":         job.ID,
+			"wc_start":       job.FirstCategory,
+			"wc_end":         job.LastCategory,
+			"page_size":      job.PageSize,
+		}).Info("Starting crawl")
+
+		// Create file to store raw product data
+		file, err := os.Create(crawlDataFile + ".tmp")
+		if err != nil {
+			logrus.WithError(err).Error("Failed to create JSON file")
+			fetchJobs.finish(job.ID, fmt.Errorf("create data.json: %w", err))
+			return
+		}
+		defer os.Remove(file.Name()) // Left over only if the crawl fails
+		defer file.Close()
+		out := &countingWriter{w: file}
+		report = startCrawlReport(db, correlationID, out)
+		report.jobID = job.ID
+		fetchJobs.update(job.ID, func(j *FetchJob) { j.ReportID = report.ID() })
+
+		// Initialize JSON array in file
+		io.WriteString(out, "[\n")
+		first := true // Track first item for JSON formatting
+
+		// Iterate through each category
+	crawl:
+		for wc := job.FirstCategory; wc <= job.LastCategory; wc++ {
+			if crawlCtx.Err() != nil {
+				cancelled = true
+				break
+			}
+			logrus.WithFields(logrus.Fields{
+				"wc":       wc,
+				"wc_start": job.FirstCategory,
+				"wc_end":   job.LastCategory,
+			}).Info("Fetching products")
+			report.startCategory(wc)
+			if err := ReserveRequest(db, models.SourceTrendyol, false); err != nil {
+				logrus.WithError(err).WithField("wc", wc).Warn("Stopping crawl, no request budget left")
+				budgetExhausted = true
+				report.budgetExhausted()
+				break
+			}
+
+			// Construct API URL for category products
+			url := fmt.Sprintf(crawlListingURL, wc, job.PageSize)
+			req, err := http.NewRequestWithContext(crawlCtx, "GET", url, nil)
+			if err != nil {
+				logrus.WithError(err).Error("Failed to create HTTP request")
+				report.categoryListed(0, err)
+				continue
+			}
+
+			// Set required headers for API request
+			req.Header.Set("accept", "application/json")
+			// TODO: Add all required headers from original fetch logic
+			// req.Header.Set("User-Agent", "Mozilla/5.0...")
+			// req.Header.Set("Referer", "https://www.trendyol.com/")
+			// etc.
+
+			// Execute request
+			resp, err := trendyolClient.Do(req)
+			trendyolRequests.Inc(endpointSearchFeed, responseStatus(resp, err))
+			if crawlCtx.Err() != nil {
+				if err == nil {
+					resp.Body.Close()
+				}
+				cancelled = true
+				break
+			}
+			if err != nil {
+				logrus.WithError(err).Error("Failed to fetch products")
+				report.categoryListed(0, err)
+				continue
+			}
+
+			// Read response body; close it right away, the crawl runs for hours
+			bodyText, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				logrus.WithError(err).Error("Failed to read response body")
+				report.categoryListed(0, err)
+				continue
+			}
+
+			// Parse JSON response
+			var result models.Root
+			if err := json.Unmarshal(bodyText, &result); err != nil {
+				logrus.WithError(err).Error("Failed to unmarshal response")
+				report.categoryListed(0, err)
+				continue
+			}
+			report.categoryListed(len(result.Data.Contents), nil)
+
+			// Skip if no products found in category
+			if len(result.Data.Contents) == 0 {
+				logrus.Info("No more products found")
+				continue
+			}
+
+			// Process each product in category
+			for _, p := range result.Data.Contents {
+				// Products listed in several categories are fetched once
+				if report.duplicate(uint(p.ID)) {
+					continue
+				}
+
+				// Respect rate limits
+				if err := timeout.Sleep(crawlCtx, crawlFetchDelay); err != nil {
+					cancelled = true
+					break crawl
+				}
+
+				// Fetch detailed product information
+				if err := ReserveRequest(db, models.SourceTrendyol, false); err != nil {
+					logrus.WithError(err).WithField("product_id", p.ID).Warn("Stopping crawl, no request budget left")
+					budgetExhausted = true
+					report.budgetExhausted()
+					break crawl
+				}
+				logrus.WithField("product_id", p.ID).Info("Fetching product details")
+				detailedProduct, err := trendyol.FetchDetails(crawlCtx, p.ID)
+				if crawlCtx.Err() != nil {
+					// The product is fetched again by the next crawl, not retried
+					cancelled = true
+					break crawl
+				}
+				if err != nil {
+					// Queue the product for a retry instead of skipping it until the next crawl
+					logrus.WithError(err).WithField("product_id", p.ID).Error("Failed to fetch product details")
+					if job.DryRun {
+						report.productFailed(uint(p.ID), err)
+						continue
+					}
+					if _, err := RecordFetchFailure(db, models.SourceTrendyol, p.ID, FetchSourceCrawl, err); err != nil {
+						logrus.WithError(err).WithField("product_id", p.ID).Error("Failed to record fetch failure")
+					}
+					report.productFailed(uint(p.ID), err)
+					continue
+				}
+				// Details that do not convert, such as the empty responses of a
+				// request Trendyol rejected silently, are counted per category
+				if _, err := trendyol.ToProduct(p.ID, detailedProduct); err != nil {
+					logrus.WithError(err).WithField("product_id", p.ID).Warn("Fetched product details did not convert")
+					report.productConversionFailed(uint(p.ID), err)
+					continue
+				}
+				if !job.DryRun {
+					if err := ClearFetchRetry(db, models.SourceTrendyol, p.ID); err != nil {
+						logrus.WithError(err).WithField("product_id", p.ID).Error("Failed to clear fetch retry")
+					}
+				}
+
+				// Write product to file with proper JSON formatting
+				encoder := json.NewEncoder(out)
+				if !first {
+					io.WriteString(out, ",\n")
+				}
+				first = false
+
+				// Encode and write product data
+				if err := encoder.Encode(detailedProduct); err != nil {
+					logrus.WithError(err).WithField("product_id", p.ID).Error("Failed to write product to file")
+					fetchJobs.addError(job.ID, fmt.Sprintf("product %d: %v", p.ID, err))
+					continue
+				}
+				report.productFetched(uint(p.ID))
+			}
+		}
+
+		// Close JSON array
+		io.WriteString(out, "\n]")
+		if cancelled {
+			logrus.WithFields(logrus.Fields{
+				"job_id":  job.ID,
+				"fetched": report.report.ProductsFetched,
+			}).Warn("Crawl cancelled, publishing the products fetched so far")
+		}
+
+		// Replace data.json only with a complete file; a dry run reads its
+		// products back from the temporary file instead
+		finish := finishCrawlDataFile
+		if job.DryRun {
+			finish = closeCrawlDataFile
+			dataFile = file.Name()
+		}
+		if err := finish(file); err != nil {
+			logrus.WithError(err).Error("Failed to finish JSON file")
+			report.finish(CrawlFailed, err)
+			fetchJobs.finish(job.ID, fmt.Errorf("write data.json: %w", err))
+			return
+		}
+	}
+
+	// Read mock product data from file
+	mockProducts, err := readMockData(dataFile)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read mock data")
+		report.finish(CrawlFailed, err)
+		fetchJobs.finish(job.ID, fmt.Errorf("read data.json: %w", err))
+		return
+	}
+
+	// Stamp the fetch time for pipeline latency tracking
+	fetchedAt := time.Now()
+	for i := range mockProducts {
+		mockProducts[i].FetchedAt = &fetchedAt
+	}
+
+	// Publish products in batches; failed batches are reported, not fatal
+	var summary PublishSummary
+	if job.DryRun {
+		summary = countBatches(mockProducts, job.BatchSize)
+	} else {
+		summary = publishProducts(publishCtx, producer, mockProducts, job.BatchSize)
+	}
+	if cancelled {
+		// The process is exiting; the outbox relay of the next one sends these
+		spoolFailedBatches(db, &summary)
+	}
+	report.published(summary)
+	switch {
+	case cancelled:
+		report.finish(CrawlCancelled, nil)
+	case budgetExhausted:
+		report.finish(CrawlBudgetExhausted, nil)
+	default:
+		report.finish(CrawlCompleted, nil)
+	}
+	for _, batch := range summary.Failed {
+		fetchJobs.addError(job.ID, fmt.Sprintf("batch %d: %s", batch.Index, batch.Error))
+	}
+	fetchJobs.update(job.ID, func(j *FetchJob) {
+		j.Summary = &summary
+		j.BudgetExhausted = budgetExhausted
+	})
+	if cancelled {
+		fetchJobs.finish(job.ID, errCrawlCancelled)
+	} else {
+		fetchJobs.finish(job.ID, nil)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"job_id":     job.ID,
+		"dry_run":    job.DryRun,
+		"batches":    summary.TotalBatches,
+		"batch_size": job.BatchSize,
+		"sent":       len(summary.Sent),
+		"failed":     len(summary.Failed),
+		"oversized":  len(summary.Oversized),
+		"spooled":    len(summary.Spooled),
+	}).Info("Products fetched and sent to Kafka")
+}
+
+// finishCrawlDataFile flushes a crawl's temporary data file to disk, closes it
+// and moves it over crawlDataFile.
+func finishCrawlDataFile(file *os.File) error {
+	if err := closeCrawlDataFile(file); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), crawlDataFile)
+}
+
+// closeCrawlDataFile flushes a crawl's temporary data file to disk and
+// closes it.
+func closeCrawlDataFile(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// enqueueFetchJob registers a job for a handler to start. Live jobs are
+// refused once only the priority reserve of the request budget is left.
+//
+// Parameters:
+//   - db: Database connection
+//   - job: The new job
+//
+// Returns:
+//   - error: An apierror: 429 without regular request budget, 409 with the
+//     active job's ID while another job is queued or running
+func enqueueFetchJob(db *gorm.DB, job *FetchJob) error {
+	if job.Live {
+		budget, err := GetRequestBudgetStatus(db)
+		if err != nil {
+			return apierror.Internal("Failed to load request budget", err)
+		}
+		if budget.PriorityOnly {
+			return apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, ErrRequestBudgetExhausted.Error()).
+				WithDetails(map[string]interface{}{"request_budget": budget})
+		}
+	}
+	if active, err := fetchJobs.enqueue(job); err != nil {
+		return apierror.Conflict("A fetch job is already running").
+			WithDetails(map[string]string{"job_id": active})
+	}
+	return nil
+}
+
+// fetchJobAccepted answers a request whose job runs in the background with
+// 202 and where to follow it.
+func fetchJobAccepted(c echo.Context, job *FetchJob) error {
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"job_id":     job.ID,
+		"state":      JobQueued,
+		"status_url": "/fetch/jobs/" + job.ID,
+	})
+}
+
+// registerFetchJobHandlers sets up the fetch job status endpoint and the
+// single-category crawl.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - producer: Kafka producer the crawled products are published with
+func registerFetchJobHandlers(e *echo.Echo, db *gorm.DB, producer sarama.SyncProducer) {
+	// GET /fetch/jobs/:id
+	// Returns the state and progress of a job started by GET /fetch,
+	// POST /crawl/category/:wc or POST /crawl/products. Jobs are kept in
+	// memory, so they are gone after a restart.
+	e.GET("/fetch/jobs/:id", func(c echo.Context) error {
+		job, ok := fetchJobs.get(c.Param("id"))
+		if !ok {
+			return apierror.NotFound(apierror.CodeNotFound, "Fetch job not found")
+		}
+		return c.JSON(http.StatusOK, job)
+	})
+
+	// POST /crawl/category/:wc
+	// Re-crawls a single Trendyol web category: lists its products, fetches
+	// their details and publishes them to Kafka, like a live /fetch of that
+	// category alone. Returns 202 with the job ID; GET /fetch/jobs/:id reports
+	// products_listed, products_fetched, detail_failures and, once finished,
+	// duration_seconds. 409 while another fetch job runs, 429 once only the
+	// priority request budget is left.
+	// URL parameters:
+	//   - wc: Web category to crawl
+	// Query parameters:
+	//   - page_size: Products listed, 1-200 (default: FETCH_PAGE_SIZE or 60)
+	e.POST("/crawl/category/:wc", func(c echo.Context) error {
+		wc, err := strconv.Atoi(c.Param("wc"))
+		if err != nil || wc <= 0 {
+			return apierror.Invalid("wc must be a positive integer")
+		}
+		crawl := crawlRange{First: wc, Last: wc, PageSize: defaultCrawlRange().PageSize}
+		if raw := c.QueryParam("page_size"); raw != "" {
+			if crawl.PageSize, err = strconv.Atoi(raw); err != nil {
+				return apierror.Invalid("page_size must be an integer")
+			}
+		}
+		if err := crawl.validate(); err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		job := &FetchJob{
+			ID:            httpclient.NewCorrelationID(),
+			Live:          true,
+			FirstCategory: crawl.First,
+			LastCategory:  crawl.Last,
+			PageSize:      crawl.PageSize,
+			BatchSize:     defaultFetchBatchSize(),
+			APIKeyID:      apikey.KeyID(c),
+		}
+		if err := enqueueFetchJob(db, job); err != nil {
+			return err
+		}
+		go runFetchJob(db, producer, *job)
+
+		logrus.WithFields(logrus.Fields{
+			"job_id": job.ID,
+			"wc":     wc,
+			"key_id": job.APIKeyID,
+		}).Info("Category crawl queued")
+		return fetchJobAccepted(c, job)
+	}, requireAPIKey())
+}
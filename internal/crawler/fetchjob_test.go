@@ -0,0 +1,163 @@
+package crawler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+	"scraper/internal/models"
+)
+
+// serveFetch registers the crawler handlers on a new Echo with a fake
+// database, a data.json holding products 1-3 and testAPIKey configured.
+func serveFetch(t *testing.T, producer *recordingProducer) *echo.Echo {
+	t.Helper()
+	useTestAPIKey(t)
+	db := openPurgeDB(t, nil, nil)
+
+	savedDataFile := crawlDataFile
+	crawlDataFile = filepath.Join(t.TempDir(), "data.json")
+	t.Cleanup(func() { crawlDataFile = savedDataFile })
+	stored := `[{"id": 1, "name": "Product 1"}, {"id": 2, "name": "Product 2"}, {"id": 3, "name": "Product 3"}]`
+	if err := os.WriteFile(crawlDataFile, []byte(stored), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler(mapError)
+	registerHandlers(e, db, producer, nil)
+	return e
+}
+
+// testAPIKey is the key useTestAPIKey configures
+const testAPIKey = "test-key"
+
+// useTestAPIKey configures testAPIKey for the routes behind requireAPIKey,
+// which reject every request while no key is set.
+func useTestAPIKey(t *testing.T) {
+	t.Helper()
+	viper.Set("API_KEY", testAPIKey)
+	apiKeys().Reload()
+	t.Cleanup(func() {
+		viper.Set("API_KEY", nil)
+		apiKeys().Reload()
+	})
+}
+
+// withTestAPIKey sets testAPIKey on req.
+func withTestAPIKey(req *http.Request) *http.Request {
+	req.Header.Set(apikey.HeaderName, testAPIKey)
+	return req
+}
+
+func TestFetchDryRunOfStoredData(t *testing.T) {
+	producer := &recordingProducer{}
+	e := serveFetch(t, producer)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, withTestAPIKey(httptest.NewRequest(http.MethodGet, "/fetch?dry_run=true&batch_size=2", nil)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /fetch?dry_run=true = %d %s, want 200 with the finished job", rec.Code, rec.Body)
+	}
+	var job FetchJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobCompleted || !job.DryRun || job.Live {
+		t.Errorf("job = %s, dry_run %v, live %v; want a completed dry run of data.json", job.State, job.DryRun, job.Live)
+	}
+	if job.Summary == nil || !job.Summary.DryRun || job.Summary.TotalProducts != 3 ||
+		job.Summary.TotalBatches != 2 || len(job.Summary.Batches) != 2 || len(job.Summary.Sent) != 0 {
+		t.Fatalf("summary = %+v, want 2 counted batches of 3 products and none sent", job.Summary)
+	}
+	if b := job.Summary.Batches[1]; b.Start != 2 || b.End != 3 || b.Key != "3-3" || b.Bytes == 0 {
+		t.Errorf("second batch = %+v, want product 3 alone", b)
+	}
+	if len(producer.sent) != 0 {
+		t.Errorf("%d messages published by a dry run", len(producer.sent))
+	}
+}
+
+func TestFetchLiveDryRun(t *testing.T) {
+	listing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var root models.Root
+		for id := 1; id <= 5; id++ {
+			root.Data.Contents = append(root.Data.Contents, models.ProductItem{ID: id})
+		}
+		json.NewEncoder(w).Encode(root)
+	}))
+	defer listing.Close()
+	saved := struct {
+		fetcher Fetcher
+		url     string
+		delay   time.Duration
+	}{fetchers[models.SourceTrendyol], crawlListingURL, crawlFetchDelay}
+	fetchers[models.SourceTrendyol] = blockingFetcher{}
+	crawlListingURL = listing.URL + "/?wc=%d&size=%d"
+	crawlFetchDelay = 0
+	t.Cleanup(func() {
+		fetchers[models.SourceTrendyol], crawlListingURL, crawlFetchDelay = saved.fetcher, saved.url, saved.delay
+	})
+	producer := &recordingProducer{}
+	e := serveFetch(t, producer)
+	stored, _ := os.ReadFile(crawlDataFile)
+
+	// The flag of the request body still selects a live crawl
+	req := httptest.NewRequest(http.MethodPost, "/fetch?category=7&dry_run=true", strings.NewReader(`{"flag": true}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, withTestAPIKey(req))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /fetch = %d %s, want 202", rec.Code, rec.Body)
+	}
+	var started struct {
+		JobID string `json:"job_id"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &started)
+
+	var job FetchJob
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		job, _ = fetchJobs.get(started.JobID)
+		if job.FinishedAt != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", job.State)
+		}
+	}
+	if !job.Live || !job.DryRun || job.Summary == nil || job.Summary.TotalProducts != 5 || len(job.Summary.Batches) != 1 {
+		t.Fatalf("job = %+v, want a live dry run counting the 5 crawled products", job)
+	}
+	if len(producer.sent) != 0 {
+		t.Errorf("%d messages published by a dry run", len(producer.sent))
+	}
+	if data, _ := os.ReadFile(crawlDataFile); string(data) != string(stored) {
+		t.Errorf("data.json = %s, want it untouched by a dry run", data)
+	}
+	if _, err := os.Stat(crawlDataFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary data file left behind: %v", err)
+	}
+}
+
+func TestFetchQueryFlags(t *testing.T) {
+	e := serveFetch(t, &recordingProducer{})
+	for _, query := range []string{"live=yes", "dry_run=maybe"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, withTestAPIKey(httptest.NewRequest(http.MethodGet, "/fetch?"+query, nil)))
+		var res apierror.Response
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		if rec.Code != http.StatusBadRequest || res.Code != apierror.CodeValidationFailed {
+			t.Errorf("GET /fetch?%s = %d %s, want 400", query, rec.Code, res.Code)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package crawler implements the gRPC endpoints of the crawler service
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"scraper/internal/models"
+	"scraper/internal/proto"
+)
+
+// GetProduct returns a single product as JSON-encoded models.Product.
+// The stored copy is returned when available unless ForceRefresh is set,
+// in which case the product is refetched from its marketplace and converted.
+// An empty Source means trendyol.
+//
+// Parameters:
+//   - ctx: Request context
+//   - in: Product ID and whether to bypass the database copy
+//
+// Returns:
+//   - *proto.GetProductResponse: Encoded product and whether it was refetched
+//   - error: InvalidArgument for unknown sources and product IDs out of
+//     range, ResourceExhausted when the
+//     daily request budget is spent, Unavailable if the product could not be
+//     fetched
+func (s *CrawlerServer) GetProduct(ctx context.Context, in *proto.GetProductRequest) (*proto.GetProductResponse, error) {
+	logrus.WithFields(logrus.Fields{
+		"product_id":    in.ProductId,
+		"force_refresh": in.ForceRefresh,
+		"source":        in.Source,
+	}).Info("Received GetProduct request")
+
+	if !models.ValidProductID(in.ProductId) {
+		return nil, status.Error(codes.InvalidArgument, models.ErrInvalidProductID.Error())
+	}
+	source, err := NormalizeSource(in.Source)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Serve the stored product unless a refresh was requested
+	if !in.ForceRefresh && s.db != nil {
+		var product models.Product
+		if err := s.db.WithContext(ctx).Where("id = ? AND source = ?", in.ProductId, source).First(&product).Error; err == nil {
+			data, err := json.Marshal(product)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to encode product: %v", err)
+			}
+			return &proto.GetProductResponse{Product: data}, nil
+		}
+	}
+
+	// Fetch fresh data from the product's marketplace, budget permitting
+	if s.db != nil {
+		if err := ReserveRequest(s.db, source, false); err != nil {
+			logrus.WithError(err).WithField("product_id", in.ProductId).Warn("Refusing product refresh")
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+	}
+	product, err := FetchProductFrom(ctx, source, int(in.ProductId))
+	if err != nil {
+		logrus.WithError(err).WithField("product_id", in.ProductId).Error("Failed to refresh product")
+		return nil, status.Errorf(codes.Unavailable, "failed to fetch product: %v", err)
+	}
+
+	data, err := json.Marshal(product)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode product: %v", err)
+	}
+	return &proto.GetProductResponse{Product: data, Refreshed: true}, nil
+}
@@ -3,22 +3,29 @@
 package crawler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/IBM/sarama"
-	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
 
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+	"scraper/internal/auth"
+	"scraper/internal/emailaddr"
+	"scraper/internal/events"
 	"scraper/internal/models"
+	"scraper/internal/outbox"
+	"scraper/pkg/httpclient"
 )
 
 // registerHandlers sets up all HTTP endpoints for the crawler service.
@@ -32,266 +39,334 @@ import (
 //   - e: Echo instance for HTTP routing
 //   - db: Database connection for product operations
 //   - producer: Kafka producer for publishing updates
-func registerHandlers(e *echo.Echo, db *gorm.DB, producer sarama.SyncProducer) {
+//   - issuer: Signs email verification tokens; nil when JWT_SECRET is not configured
+func registerHandlers(e *echo.Echo, db *gorm.DB, producer sarama.SyncProducer, issuer *auth.Issuer) {
+	// Initialize validator for request validation
+	validate := newValidator()
+
+	// New accounts verify their email address
+	verifier := newEmailVerifier(db, issuer)
+
 	// POST /simulate-price-drop
 	// Simulates a price drop for a product to test the notification system
-	// Request body: {"product_id": uint, "new_price": float64}
+	// Request body: {"product_id": uint, "new_price": float64, "bypass_min_drop": bool, "source": string}
+	// bypass_min_drop skips the global minimum-drop floor so tiny drops still notify
+	// source defaults to trendyol
+	// new_price must be below the current price; the change is recorded in
+	// price_history
 	e.POST("/simulate-price-drop", func(c echo.Context) error {
 		// Parse and validate request
 		var req struct {
-			ProductID uint    `json:"product_id" validate:"required"`
-			NewPrice  float64 `json:"new_price" validate:"required,gt=0"`
+			ProductID     uint    `json:"product_id" validate:"required,productid"`
+			NewPrice      float64 `json:"new_price" validate:"required,gt=0"`
+			BypassMinDrop bool    `json:"bypass_min_drop"`
+			Source        string  `json:"source"`
 		}
 		if err := c.Bind(&req); err != nil {
 			logrus.WithError(err).Error("Invalid price drop simulation request")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		source, err := NormalizeSource(req.Source)
+		if err != nil {
+			return apierror.Invalid(err.Error())
 		}
 
 		// Get current product price from database
 		var product models.Product
-		if err := db.First(&product, req.ProductID).Error; err != nil {
+		if err := db.Where("id = ? AND source = ?", req.ProductID, source).First(&product).Error; err != nil {
 			logrus.WithError(err).Error("Failed to find product")
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Product not found"})
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
 		}
 
 		// Store old price for comparison
 		oldPrice := product.Price
+		if req.NewPrice >= oldPrice {
+			return apierror.Invalid(fmt.Sprintf("new_price must be below the current price of %.2f", oldPrice))
+		}
 		
+		// Build a single price_change event; the favorites service resolves
+		// the users who favorited the product and notifies them
+		msg, err := events.NewPriceChangeMessage(events.PriceChange{
+			ProductID:     req.ProductID,
+			Source:        source,
+			ProductName:   product.Name,
+			OldPrice:      oldPrice,
+			NewPrice:      req.NewPrice,
+			BypassMinDrop: req.BypassMinDrop,
+		})
+		if err != nil {
+			logrus.WithError(err).Error("Invalid price change event")
+			return apierror.Invalid(err.Error())
+		}
+
 		// Update product price in database
 		product.Price = req.NewPrice
 		priceInfo := fmt.Sprintf(`{"currency": "TRY", "original": %f}`, req.NewPrice)
 		product.PriceInfo = datatypes.JSON([]byte(priceInfo))
-		// Save updated product to database
-		if err := db.Save(&product).Error; err != nil {
-			logrus.WithError(err).Error("Failed to update product price")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update price"})
-		}
-
-		// Record price change in price history table
-		// This helps track price fluctuations over time
-		if err := db.Exec("INSERT INTO price_history (product_id, old_price, new_price) VALUES (?, ?, ?)", 
-			req.ProductID, oldPrice, req.NewPrice).Error; err != nil {
-			logrus.WithError(err).Error("Failed to record price history")
-		}
-
-		// Find all users who have favorited this product
-		// These users will receive price drop notifications
-		var favorites []models.UserFavorite
-		if err := db.Where("product_id = ?", req.ProductID).Find(&favorites).Error; err != nil {
-			logrus.WithError(err).Error("Failed to find favorites")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to find favorites"})
-		}
-
-		// Send price drop notifications to each user via Kafka
-		// The notification service will consume these messages and send emails
-		for _, fav := range favorites {
-			msg := &sarama.ProducerMessage{
-				Topic: "FAVORITE_PRODUCTS",
-				Key:   sarama.StringEncoder(fmt.Sprintf("%d", fav.UserID)), // User ID as key for partitioning
-				Value: sarama.StringEncoder(fmt.Sprintf(`{"user_id":%d,"product_id":%d,"old_price":%f,"new_price":%f}`, 
-					fav.UserID, req.ProductID, oldPrice, req.NewPrice)),
+		// Save the product, its price history entry and the event together;
+		// the outbox relay publishes the event, so a crash after the commit
+		// cannot lose it
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// The favorites counter changes concurrently; never write back the copy read above
+			if err := tx.Omit("local_favorites_count").Save(&product).Error; err != nil {
+				return err
 			}
-			_, _, err := producer.SendMessage(msg)
-			if err != nil {
-				logrus.WithError(err).Error("Failed to send notification message")
+			history := models.PriceHistory{
+				ProductID: req.ProductID,
+				Source:    source,
+				OldPrice:  oldPrice,
+				NewPrice:  req.NewPrice,
 			}
+			if err := tx.Create(&history).Error; err != nil {
+				return err
+			}
+			return outbox.Add(tx, msg)
+		})
+		if err != nil {
+			return apierror.Internal("Failed to update price", err)
 		}
 
-		return c.JSON(http.StatusOK, map[string]string{"status": "Price updated and notifications sent"})
-	})
+		return c.JSON(http.StatusOK, map[string]string{"status": "Price updated and notifications queued"})
+	}, requireAPIKey())
 
-	// Initialize validator for request validation
-	validate := validator.New()
+	// Seller watch endpoints
+	registerWatchHandlers(e, db, validate)
 
-	// GET /fetch
-	// Fetches products from Trendyol API and publishes them to Kafka
-	// Query parameters:
-	//   - flag: If true, fetches live data from API. If false, uses mock data.
-	e.GET("/fetch", func(c echo.Context) error {
-		// Parse and validate request
-		var req struct {
-			Flag bool `json:"flag" validate:"required"` // Whether to fetch live data
-		}
-		if err := c.Bind(&req); err != nil {
-			logrus.WithError(err).Error("Invalid fetch request")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
-		}
+	// Notification preference and snooze endpoints
+	registerPreferenceHandlers(e, db, validate)
 
-		// If flag is true, fetch live data from Trendyol API
-		if req.Flag {
-			// Initialize HTTP client for API requests
-			client := &http.Client{}
+	// Profile, password update and account deletion endpoints
+	registerUserProfileHandlers(e, db, validate)
 
-			// Define category range to fetch (wc = web category)
-			start := 94  // Starting category ID
-			end := 200   // Ending category ID
+	// Password reset endpoints
+	registerPasswordResetHandlers(e, db, validate)
 
-			// Create file to store raw product data
-			file, err := os.Create("data.json")
-			if err != nil {
-				logrus.WithError(err).Error("Failed to create data.json")
-				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create JSON file"})
-			}
-			defer file.Close()
-
-			// Initialize JSON array in file
-			file.WriteString("[\n")
-			first := true // Track first item for JSON formatting
-
-			// Iterate through each category
-			for wc := start; wc <= end; wc++ {
-				logrus.WithField("wc", wc).Info("Fetching products")
-
-				// Construct API URL for category products
-				url := fmt.Sprintf("https://apigw.trendyol.com/discovery-sfint-browsing-service/api/search-feed/products?source=sr?wc=%d&size=60", wc)
-				req, err := http.NewRequest("GET", url, nil)
-				if err != nil {
-					logrus.WithError(err).Error("Failed to create HTTP request")
-					continue
-				}
+	// Product listing, attribute filter and history endpoints
+	registerProductHandlers(e, db)
+	registerPriceHistoryHandlers(e, db)
+	registerProductSearchHandlers(e, db)
 
-				// Set required headers for API request
-				req.Header.Set("accept", "application/json")
-				// TODO: Add all required headers from original fetch logic
-				// req.Header.Set("User-Agent", "Mozilla/5.0...")
-				// req.Header.Set("Referer", "https://www.trendyol.com/")
-				// etc.
-
-				// Execute request
-				resp, err := client.Do(req)
-				if err != nil {
-					logrus.WithError(err).Error("Failed to fetch products")
-					continue
-				}
-				defer resp.Body.Close()
+	// Crawl report and coverage endpoints
+	registerCrawlReportHandlers(e, db)
+	registerCrawlCoverageHandlers(e, db)
+	registerPriceDropStatsHandlers(e, db)
 
-				// Read response body
-				bodyText, err := io.ReadAll(resp.Body)
-				if err != nil {
-					logrus.WithError(err).Error("Failed to read response body")
-					continue
-				}
+	// Duplicate product merge endpoint
+	registerMergeHandlers(e, db, validate)
 
-				// Parse JSON response
-				var result models.Root
-				if err := json.Unmarshal(bodyText, &result); err != nil {
-					logrus.WithError(err).Error("Failed to unmarshal response")
-					continue
-				}
-
-				// Skip if no products found in category
-				if len(result.Data.Contents) == 0 {
-					logrus.Info("No more products found")
-					continue
-				}
-
-				// Process each product in category
-				for _, p := range result.Data.Contents {
-					// Respect rate limits
-					time.Sleep(4 * time.Second)
-
-					// Fetch detailed product information
-					logrus.WithField("product_id", p.ID).Info("Fetching product details")
-					detailedProduct := FetchProductDetails(p.ID)
-
-					// Write product to file with proper JSON formatting
-					encoder := json.NewEncoder(file)
-					if !first {
-						file.WriteString(",\n")
-					}
-					first = false
-
-					// Encode and write product data
-					if err := encoder.Encode(detailedProduct); err != nil {
-						logrus.WithError(err).WithField("product_id", p.ID).Error("Failed to write product to file")
-						continue
-					}
-				}
-			}
+	// Favorite collection endpoints and the favorites export
+	registerCollectionHandlers(e, db, validate)
+	registerExportHandlers(e, db)
 
-			// Close JSON array
-			file.WriteString("\n]")
+	// GET /products/:id
+	// Returns a stored product with its price, stock, images and rating decoded.
+	// The notification emails link here.
+	// Query parameters:
+	//   - source: Marketplace of the product (default trendyol)
+	//   - user_id: Also report whether this user favorited the product (optional)
+	e.GET("/products/:id", func(c echo.Context) error {
+		id, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
 		}
 
-		// Read mock product data from file
-		mockProducts, err := readMockData()
+		// Soft-deleted products are excluded by gorm and reported as missing
+		var product models.Product
+		err = db.Where("id = ? AND source = ?", id, source).First(&product).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
 		if err != nil {
-			logrus.WithError(err).Error("Failed to read mock data")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Failed to read mock data: %v", err)})
+			return apierror.Internal("Failed to load product", err)
 		}
 
-		// Process products in batches to avoid overwhelming Kafka
-		batchSize := 50 // Maximum products per batch
-		totalProducts := len(mockProducts)
-		
-		// Iterate through products in batches
-		for i := 0; i < totalProducts; i += batchSize {
-			// Calculate end index for current batch
-			end := i + batchSize
-			if end > totalProducts {
-				end = totalProducts
+		detail := NewProductDetail(product)
+		if raw := c.QueryParam("user_id"); raw != "" {
+			userID, err := strconv.ParseUint(raw, 10, 32)
+			if err != nil {
+				return apierror.Invalid("Invalid user ID")
 			}
-			
-			// Get current batch of products
-			batch := mockProducts[i:end]
+			favorited := IsProductFavorited(db, uint(userID), product.ID, product.Source)
+			detail.IsFavorited = &favorited
+		}
+		return c.JSON(http.StatusOK, detail)
+	})
 
-			// Convert batch to JSON for Kafka message
-			productsJSON, err := json.Marshal(batch)
-			if err != nil {
-				logrus.WithError(err).Error("Failed to marshal products batch")
-				continue
+	// GET /fetch, POST /fetch
+	// Starts a fetch job that crawls Trendyol and publishes the products to
+	// Kafka, and returns 202 with its job ID right away. Progress is reported
+	// by GET /fetch/jobs/:id. Only one job runs at a time; starting another
+	// returns 409 with the running job's ID.
+	// Query parameters:
+	//   - live: If true, fetches live data from API. If false, uses mock data.
+	//   - dry_run: If true, builds and logs the batches without publishing them
+	//   - batch_size: Products per Kafka message, 1-500 (default: FETCH_BATCH_SIZE or 50)
+	//   - category: Only crawl this Trendyol web category; excludes wc_start and wc_end
+	//   - wc_start: First web category to crawl (default: FETCH_WC_START or 94)
+	//   - wc_end: Last web category to crawl, at most 500 after wc_start (default: FETCH_WC_END or 200)
+	//   - page_size: Products listed per category, 1-200 (default: FETCH_PAGE_SIZE or 60)
+	// Request body: {"flag": bool}, read like live when live is not given;
+	// kept for existing clients
+	//
+	// Live crawls count every Trendyol request against the daily budget: they
+	// are refused with 429 once the regular budget is spent and stop early if
+	// it runs out mid-crawl.
+	// Each live crawl is recorded in a crawl report that is updated as the
+	// crawl progresses; the job reports its ID as report_id.
+	// A dry run of the stored data.json runs within the request and returns
+	// 200 with the finished job, whose summary counts the batches.
+	fetch := func(c echo.Context) error {
+		// Parse and validate request
+		var req struct {
+			Flag bool `json:"flag"` // Whether to fetch live data, when live is not given
+		}
+		if err := c.Bind(&req); err != nil {
+			logrus.WithError(err).Error("Invalid fetch request")
+			return apierror.Invalid("Invalid request")
+		}
+		live, dryRun := req.Flag, false
+		if raw := c.QueryParam("live"); raw != "" {
+			var err error
+			if live, err = strconv.ParseBool(raw); err != nil {
+				return apierror.Invalid("live must be true or false")
+			}
+		}
+		if raw := c.QueryParam("dry_run"); raw != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(raw); err != nil {
+				return apierror.Invalid("dry_run must be true or false")
 			}
-			
-			// Prepare Kafka message
-			msg := &sarama.ProducerMessage{
-				Topic: "PRODUCTS", // Topic for product updates
-				Value: sarama.ByteEncoder(productsJSON),
+		}
+
+		// Validate the batch size before doing any work
+		batchSize := defaultFetchBatchSize()
+		if raw := c.QueryParam("batch_size"); raw != "" {
+			size, err := strconv.Atoi(raw)
+			if err == nil {
+				err = validateBatchSize(size)
 			}
-			
-			// Send batch to Kafka
-			if _, _, err := producer.SendMessage(msg); err != nil {
-				logrus.WithError(err).WithField("batch_start", i).WithField("batch_end", end).Error("Failed to send batch to Kafka")
-				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send message to Kafka"})
+			if err != nil {
+				return apierror.Invalid("batch_size must be between 1 and 500")
 			}
-			
-			// Log successful batch processing
-			logrus.WithFields(logrus.Fields{
-				"batch_start": i,
-				"batch_end":   end,
-				"batch_size":  len(batch),
-			}).Info("Batch sent to Kafka")
-			
-			// Rate limiting between batches
-			time.Sleep(500 * time.Millisecond)
-		}
-
-		logrus.Info("Products fetched and sent to Kafka")
-		return c.JSON(http.StatusOK, map[string]string{"status": "Products fetched and sent to Kafka"})
+			batchSize = size
+		}
+
+		// Category range to fetch (wc = web category); invalid ranges are
+		// rejected rather than replaced by the default
+		crawl, err := parseCrawlRange(c)
+		if err != nil {
+			return err
+		}
+
+		job := &FetchJob{
+			ID:            httpclient.NewCorrelationID(),
+			Live:          live,
+			DryRun:        dryRun,
+			FirstCategory: crawl.First,
+			LastCategory:  crawl.Last,
+			PageSize:      crawl.PageSize,
+			BatchSize:     batchSize,
+			APIKeyID:      apikey.KeyID(c),
+		}
+		// Crawling pauses once only the priority reserve is left
+		if err := enqueueFetchJob(db, job); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"job_id":  job.ID,
+			"live":    job.Live,
+			"dry_run": job.DryRun,
+			"key_id":  job.APIKeyID,
+		}).Info("Fetch job queued")
+
+		// Counting the batches of data.json takes no longer than reading it
+		if dryRun && !live {
+			runFetchJob(db, producer, *job)
+			snapshot, _ := fetchJobs.get(job.ID)
+			return c.JSON(http.StatusOK, snapshot)
+		}
+		go runFetchJob(db, producer, *job)
+		return fetchJobAccepted(c, job)
+	}
+	e.GET("/fetch", fetch, requireAPIKey())
+	e.POST("/fetch", fetch, requireAPIKey())
+	registerFetchJobHandlers(e, db, producer)
+	registerCrawlProductsHandlers(e, db, producer, validate)
+
+	// GET /stats
+	// Reports the state of the fetch retry queue, including products that
+	// exhausted their retries and will not be fetched again until the next crawl,
+	// and today's Trendyol request budget
+	e.GET("/stats", func(c echo.Context) error {
+		retries, err := getFetchRetryStats(db)
+		if err != nil {
+			return apierror.Internal("Failed to load stats", err)
+		}
+		budget, err := GetRequestBudgetStatus(db)
+		if err != nil {
+			return apierror.Internal("Failed to load stats", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"fetch_retries":  retries,
+			"request_budget": budget,
+		})
 	})
 
 	// POST /favorites
 	// Adds a product to a user's favorites list
-	// Request body: {"user_id": uint, "product_id": uint}
+	// Request body: {"user_id": uint, "product_id": uint, "source": string,
+	//   "target_price": float64 (optional), "note": string (optional),
+	//   "tags": [string] (optional)}
+	// source defaults to trendyol. With target_price, only drops to that price
+	// or below notify. Tags are stored lower-case. Returns 409 duplicate_favorite if the product
+	// is already a favorite, and 422 favorites_limit_reached once the user has
+	// FAVORITES_LIMIT favorites unless an admin lifted the limit for them.
 	e.POST("/favorites", func(c echo.Context) error {
 		// Parse and validate request
 		var req struct {
-			UserID    uint `json:"user_id" validate:"required"` // ID of the user adding favorite
-			ProductID uint `json:"product_id" validate:"required"` // ID of product to favorite
+			UserID    uint   `json:"user_id" validate:"required"` // ID of the user adding favorite
+			ProductID uint   `json:"product_id" validate:"required,productid"` // ID of product to favorite
+			Source    string `json:"source"` // Marketplace of the product
+			TargetPrice *float64 `json:"target_price" validate:"omitempty,gt=0"` // Only notify about drops to this price or below
+			Note        *string  `json:"note" validate:"omitempty,max=1000"` // Free-text note
+			Tags        []string `json:"tags" validate:"max=20,dive,max=50"` // Tags to organize the favorites with
 		}
 		if err := c.Bind(&req); err != nil {
 			logrus.WithError(err).Error("Invalid favorites request")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return apierror.Invalid("Invalid request")
 		}
 		// Validate required fields
 		if err := validate.Struct(&req); err != nil {
 			logrus.WithError(err).Error("Validation failed for favorites request")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+
+		source, err := NormalizeSource(req.Source)
+		if err != nil {
+			return apierror.Invalid(err.Error())
 		}
 
 		// Add product to user's favorites
-		if err := AddFavorite(db, req.UserID, req.ProductID); err != nil {
-			logrus.WithError(err).Error("Failed to add favorite")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add favorite"})
+		if err := AddFavorite(db, req.UserID, req.ProductID, source); err != nil {
+			// Limit and duplicate errors are mapped by mapError
+			return err
+		}
+		changes := FavoriteChanges{SetTargetPrice: req.TargetPrice != nil, TargetPrice: req.TargetPrice, Note: req.Note}
+		if req.Tags != nil {
+			changes.Tags = &req.Tags
+		}
+		if err := UpdateFavorite(db, req.UserID, req.ProductID, source, changes); err != nil {
+			return apierror.Internal("Failed to update favorite", err)
 		}
 
 		// Log successful addition
@@ -299,29 +374,100 @@ func registerHandlers(e *echo.Echo, db *gorm.DB, producer sarama.SyncProducer) {
 		return c.JSON(http.StatusOK, map[string]string{"status": "Product added to favorites"})
 	})
 
+	// POST /favorites/bulk
+	// Adds many products to a user's favorites in one transaction
+	// Request body: {"user_id": uint, "product_ids": [uint], "source": string}
+	// source defaults to trendyol. At most 500 IDs are accepted per request.
+	// Each ID is reported as created, exists, not_found or limit_reached;
+	// unknown products do not fail the rest. Returns 404 if the user does not
+	// exist.
+	e.POST("/favorites/bulk", func(c echo.Context) error {
+		var req struct {
+			UserID     uint   `json:"user_id" validate:"required"`
+			ProductIDs []uint `json:"product_ids" validate:"required,min=1,max=500,dive,required,productid"`
+			Source     string `json:"source"`
+		}
+		if err := c.Bind(&req); err != nil {
+			logrus.WithError(err).Error("Invalid bulk favorites request")
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			logrus.WithError(err).Error("Validation failed for bulk favorites request")
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+
+		source, err := NormalizeSource(req.Source)
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+		var user models.User
+		if err := db.Select("id").First(&user, req.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+			}
+			return apierror.Internal("Failed to load user", err)
+		}
+
+		results, err := BulkAddFavorites(db, req.UserID, req.ProductIDs, source)
+		if err != nil {
+			return apierror.Internal("Failed to add favorites", err)
+		}
+		counts := make(map[string]int)
+		for _, result := range results {
+			counts[result.Status]++
+		}
+		logrus.WithFields(logrus.Fields{
+			"user_id":   req.UserID,
+			"products":  len(req.ProductIDs),
+			"created":   counts[BulkFavoriteCreated],
+			"not_found": counts[BulkFavoriteNotFound],
+		}).Info("Products added to favorites in bulk")
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"user_id": req.UserID,
+			"source":  source,
+			"counts":  counts,
+			"results": results,
+		})
+	})
+
 	// DELETE /favorites
-	// Removes a product from a user's favorites list
-	// Request body: {"user_id": uint, "product_id": uint}
+	// Removes a product from a user's favorites list; 404 if it is not one
+	// Request body: {"user_id": uint, "product_id": uint, "source": string}
+	// source defaults to trendyol
 	e.DELETE("/favorites", func(c echo.Context) error {
 		// Parse and validate request
 		var req struct {
-			UserID    uint `json:"user_id" validate:"required"` // ID of the user removing favorite
-			ProductID uint `json:"product_id" validate:"required"` // ID of product to remove
+			UserID    uint   `json:"user_id" validate:"required"` // ID of the user removing favorite
+			ProductID uint   `json:"product_id" validate:"required,productid"` // ID of product to remove
+			Source    string `json:"source"` // Marketplace of the product
 		}
 		if err := c.Bind(&req); err != nil {
 			logrus.WithError(err).Error("Invalid favorites deletion request")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return apierror.Invalid("Invalid request")
 		}
 		// Validate required fields
 		if err := validate.Struct(&req); err != nil {
 			logrus.WithError(err).Error("Validation failed for favorites deletion")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+
+		source, err := NormalizeSource(req.Source)
+		if err != nil {
+			return apierror.Invalid(err.Error())
 		}
 
 		// Remove product from user's favorites
-		if err := RemoveFavorite(db, req.UserID, req.ProductID); err != nil {
-			logrus.WithError(err).Error("Failed to remove favorite")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove favorite"})
+		if err := RemoveFavorite(db, req.UserID, req.ProductID, source); err != nil {
+			if errors.Is(err, ErrFavoriteNotFound) {
+				return err
+			}
+			return apierror.Internal("Failed to remove favorite", err)
 		}
 
 		// Log successful removal
@@ -329,79 +475,336 @@ func registerHandlers(e *echo.Echo, db *gorm.DB, producer sarama.SyncProducer) {
 		return c.JSON(http.StatusOK, map[string]string{"status": "Product removed from favorites"})
 	})
 
+	// PATCH /favorites
+	// Changes the target price, note or tags of a favorite; fields left out
+	// of the body are kept
+	// Request body: {"user_id": uint, "product_id": uint, "source": string,
+	//   "target_price": float64|null, "note": string, "tags": [string]}
+	// source defaults to trendyol. A null target_price notifies about every
+	// drop again, an empty note or tags array removes them. Tags are stored
+	// lower-case. Returns 404 if the product is not a favorite.
+	e.PATCH("/favorites", func(c echo.Context) error {
+		var req struct {
+			UserID      uint            `json:"user_id" validate:"required"`
+			ProductID   uint            `json:"product_id" validate:"required,productid"`
+			Source      string          `json:"source"`
+			TargetPrice json.RawMessage `json:"target_price"` // Absent keeps, null clears
+			Note        *string         `json:"note" validate:"omitempty,max=1000"`
+			Tags        *[]string       `json:"tags" validate:"omitempty,max=20,dive,max=50"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		changes := FavoriteChanges{Note: req.Note, Tags: req.Tags}
+		if len(req.TargetPrice) > 0 {
+			changes.SetTargetPrice = true
+			if string(req.TargetPrice) != "null" {
+				var target float64
+				if err := json.Unmarshal(req.TargetPrice, &target); err != nil || target <= 0 {
+					return apierror.Invalid("target_price must be a positive number or null")
+				}
+				changes.TargetPrice = &target
+			}
+		}
+		if !changes.SetTargetPrice && changes.Note == nil && changes.Tags == nil {
+			return apierror.Invalid("Nothing to change; set target_price, note or tags")
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+		source, err := NormalizeSource(req.Source)
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		if err := UpdateFavorite(db, req.UserID, req.ProductID, source, changes); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeNotFound, "Favorite not found")
+			}
+			return apierror.Internal("Failed to update favorite", err)
+		}
+		response := map[string]interface{}{"product_id": req.ProductID, "source": source}
+		if changes.SetTargetPrice {
+			response["target_price"] = changes.TargetPrice
+		}
+		if changes.Note != nil {
+			response["note"] = strings.TrimSpace(*changes.Note)
+		}
+		if changes.Tags != nil {
+			response["tags"] = NormalizeTags(*changes.Tags)
+		}
+		return c.JSON(http.StatusOK, response)
+	})
+
+	// PATCH /favorites/mute
+	// Mutes or unmutes notifications about one favorite. A muted favorite
+	// stays in the list, its price history is still recorded and it still
+	// appears in the daily digest; unmuting does not send what was missed.
+	// Request body: {"user_id": uint, "product_id": uint, "source": string,
+	//   "muted": bool, "muted_until": RFC 3339 time (optional)}
+	// source defaults to trendyol. Returns 404 if the product is not a favorite.
+	e.PATCH("/favorites/mute", func(c echo.Context) error {
+		var req struct {
+			UserID     uint       `json:"user_id" validate:"required"`
+			ProductID  uint       `json:"product_id" validate:"required,productid"`
+			Source     string     `json:"source"`
+			Muted      *bool      `json:"muted" validate:"required"`
+			MutedUntil *time.Time `json:"muted_until"` // Mute ends by itself; omitted mutes until unmuted
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+		if req.MutedUntil != nil && (!*req.Muted || !req.MutedUntil.After(time.Now())) {
+			return apierror.Invalid("muted_until must be in the future and needs muted set")
+		}
+		source, err := NormalizeSource(req.Source)
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		if err := MuteFavorite(db, req.UserID, req.ProductID, source, *req.Muted, req.MutedUntil); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeNotFound, "Favorite not found")
+			}
+			return apierror.Internal("Failed to mute favorite", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"product_id":  req.ProductID,
+			"source":      source,
+			"muted":       *req.Muted,
+			"muted_until": req.MutedUntil,
+		})
+	})
+
+	// POST /favorites/import
+	// Imports favorites from an uploaded CSV where each row is a Trendyol
+	// product URL or content ID. Unknown products are fetched and created first.
+	// Files with more than importBackgroundThreshold rows are processed as a
+	// background job whose progress is available at GET /favorites/import/:job_id.
+	// Returns 422 if the user is already at the favorites limit; rows beyond
+	// the limit are reported as limit_reached. An import run within the
+	// request stops at the request deadline and returns 503.
+	// Multipart form: user_id (uint), file (CSV)
+	e.POST("/favorites/import", func(c echo.Context) error {
+		// Parse and validate user ID
+		userID, err := strconv.ParseUint(c.FormValue("user_id"), 10, 32)
+		if err != nil || userID == 0 {
+			logrus.WithError(err).Error("Invalid user ID for favorites import")
+			return apierror.Invalid("Invalid user ID")
+		}
+		if err := auth.Authorize(c, uint(userID)); err != nil {
+			return err
+		}
+
+		// Make sure the user exists before doing any work
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			logrus.WithError(err).Error("User not found")
+			return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+		}
+
+		// Nothing can be imported once the user is at the favorites limit
+		limitErr, err := FavoritesLimitReached(db, uint(userID))
+		if err != nil {
+			return apierror.Internal("Failed to check favorites limit", err)
+		}
+		if limitErr != nil {
+			return limitErr
+		}
+
+		// Read uploaded CSV file
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			logrus.WithError(err).Error("Missing CSV file for favorites import")
+			return apierror.Invalid("CSV file is required")
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			logrus.WithError(err).Error("Failed to open uploaded CSV file")
+			return apierror.Invalid("Failed to read CSV file")
+		}
+		defer file.Close()
+
+		rows, err := parseImportCSV(file)
+		if err != nil {
+			logrus.WithError(err).Error("Invalid CSV file for favorites import")
+			return apierror.Invalid(err.Error())
+		}
+		if len(rows) == 0 {
+			return apierror.Invalid("CSV file has no rows")
+		}
+
+		job := newImportJob(uint(userID), len(rows))
+		logrus.WithFields(logrus.Fields{"user_id": userID, "job_id": job.ID, "rows": len(rows)}).Info("Starting favorites import")
+
+		// Large files are processed in the background
+		if len(rows) > importBackgroundThreshold {
+			go runImport(context.Background(), db, job, rows)
+			return c.JSON(http.StatusAccepted, map[string]interface{}{
+				"job_id": job.ID,
+				"status": "Import started",
+				"rows":   len(rows),
+			})
+		}
+
+		// Small files are processed within the request
+		ctx := c.Request().Context()
+		runImport(ctx, db, job, rows)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		snapshot, _ := getImportJob(job.ID)
+		return c.JSON(http.StatusOK, snapshot)
+	})
+
+	// GET /favorites/import/:job_id
+	// Returns the progress and per-row report of a favorites import job
+	e.GET("/favorites/import/:job_id", func(c echo.Context) error {
+		job, ok := getImportJob(c.Param("job_id"))
+		if !ok {
+			return apierror.NotFound(apierror.CodeNotFound, "Import job not found")
+		}
+		if err := auth.Authorize(c, job.UserID); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, job)
+	})
+
 	// GET /favorites/:user_id
 	// Retrieves all favorite products for a given user
 	// URL parameters:
 	//   - user_id: ID of the user whose favorites to retrieve
+	// Query parameters:
+	//   - source: Only list products from this marketplace (optional)
+	//   - collection_id: Only list this collection, or "uncategorized" (optional)
+	//   - sort: "biggest_drop" to list the largest price decreases first (optional)
+	//   - tag: Only list favorites with this tag, case-insensitively (optional)
+	//   - status: active, inactive, out_of_stock or all (default all)
+	// Returns {"favorites", "status", "counts"}, with the number of favorites
+	// in each status in counts. Each product includes price_when_added,
+	// current_price, price_change, price_change_percent, collection_id, note,
+	// tags and status; the price fields are null when the price history is
+	// unknown.
 	e.GET("/favorites/:user_id", func(c echo.Context) error {
 		// Parse and validate user ID from URL
 		userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
 		if err != nil {
 			logrus.WithError(err).Error("Invalid user ID")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+			return apierror.Invalid("Invalid user ID")
+		}
+
+		// Validate the optional source and collection filters
+		filter, err := favoriteFilterFromQuery(c)
+		if err != nil {
+			return err
+		}
+
+		sortBy := c.QueryParam("sort")
+		if sortBy != "" && sortBy != "biggest_drop" {
+			return apierror.Invalid("sort must be biggest_drop")
+		}
+
+		status := c.QueryParam("status")
+		switch status {
+		case "":
+			status = FavoriteStatusAll
+		case FavoriteStatusAll, FavoriteStatusActive, FavoriteStatusInactive, FavoriteStatusOutOfStock:
+		default:
+			return apierror.Invalid("status must be active, inactive, out_of_stock or all")
 		}
 
-		// Get user's favorite products
-		favorites, err := GetUserFavorites(db, uint(userID))
+		// Get user's favorite products with their price movement
+		favorites, err := ListUserFavorites(db, uint(userID), filter, sortBy)
 		if err != nil {
-			logrus.WithError(err).Error("Failed to get favorites")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get favorites"})
+			return apierror.Internal("Failed to get favorites", err)
 		}
+		// Counts cover the other filters but not the status, so every status
+		// filter can show how many favorites it would list
+		favorites, counts := FilterFavoritesByStatus(favorites, status)
 
 		// Return list of favorites
 		logrus.WithField("user_id", userID).Info("Fetched user favorites")
-		return c.JSON(http.StatusOK, favorites)
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"favorites": favorites,
+			"status":    status,
+			"counts":    counts,
+		})
 	})
 
 	// POST /users
-	// Creates a new user account
+	// Creates a new user account, unverified until the user opens the link
+	// emailed to the address
 	// Request body: {"email": string, "username": string, "password": string, "name": string}
 	e.POST("/users", func(c echo.Context) error {
 		// Parse and validate request
 		var req struct {
-			Email    string `json:"email" validate:"required,email"` // User's email (must be unique)
+			Email    string `json:"email" validate:"required,mailbox"` // User's email (must be unique, ignoring case)
 			Username string `json:"username" validate:"required"` // Username (must be unique)
-			Password string `json:"password" validate:"required,min=6"` // Password (min 6 chars)
+			Password string `json:"password" validate:"required,min=6"` // Password (min 6 chars, at most 72 bytes)
 			Name     string `json:"name" validate:"required"` // User's full name
 		}
 		if err := c.Bind(&req); err != nil {
 			logrus.WithError(err).Error("Invalid user creation request")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return apierror.Invalid("Invalid request")
 		}
+		// Store the address trimmed and with a lower-case domain
+		req.Email = emailaddr.Normalize(req.Email)
 		// Validate required fields and formats
 		if err := validate.Struct(&req); err != nil {
 			logrus.WithError(err).Error("Validation failed for user creation")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return apierror.InvalidFields(err)
 		}
 
-		// Check for existing user with same email
+		// Check for existing user with same email, ignoring case
 		var count int64
-		db.Model(&models.User{}).Where("email = ?", req.Email).Count(&count)
+		db.Model(&models.User{}).Where("lower(email) = ?", emailaddr.Key(req.Email)).Count(&count)
 		if count > 0 {
 			logrus.WithField("email", req.Email).Error("User with this email already exists")
-			return c.JSON(http.StatusConflict, map[string]string{"error": "User with this email already exists"})
+			return apierror.Conflict("User with this email already exists")
 		}
 
 		// Check for existing user with same username
 		db.Model(&models.User{}).Where("username = ?", req.Username).Count(&count)
 		if count > 0 {
 			logrus.WithField("username", req.Username).Error("Username is already taken")
-			return c.JSON(http.StatusConflict, map[string]string{"error": "Username is already taken"})
+			return apierror.Conflict("Username is already taken")
 		}
 
-		// Create new user
+		// Store only the bcrypt hash of the password; bcrypt ignores bytes
+		// beyond its limit, so longer passwords are rejected
+		if len(req.Password) > auth.MaxPasswordLength {
+			return apierror.Invalid(fmt.Sprintf("password must be at most %d bytes", auth.MaxPasswordLength))
+		}
+		hash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			return apierror.Internal("Failed to create user", err)
+		}
+
+		// Create new user; without verification it counts as verified
 		user := models.User{
 			Email:       req.Email,
 			Username:    req.Username,
-			Password:    req.Password, // TODO: Hash password in production
+			Password:    hash,
 			Name:        req.Name,
 			IsActive:    true,
 			LastLoginAt: time.Now(),
+			Verified:    !verifier.enabled(),
 		}
 		result := db.Create(&user)
 		if result.Error != nil {
-			logrus.WithError(result.Error).Error("Failed to create user")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
+			return apierror.Internal("Failed to create user", result.Error)
+		}
+		if verifier.enabled() {
+			go verifier.send(user)
 		}
 
 		// Clear password before returning user data
@@ -419,14 +822,14 @@ func registerHandlers(e *echo.Echo, db *gorm.DB, producer sarama.SyncProducer) {
 		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
 		if err != nil {
 			logrus.WithError(err).Error("Invalid user ID")
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+			return apierror.Invalid("Invalid user ID")
 		}
 
 		// Get user from database
 		var user models.User
 		if err := db.First(&user, id).Error; err != nil {
 			logrus.WithError(err).Error("User not found")
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+			return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
 		}
 
 		// Clear password before returning user data
@@ -0,0 +1,39 @@
+package crawler
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// nakedClient matches HTTP clients built without pkg/httpclient, which have
+// no timeouts and skip the outbound request metrics
+var nakedClient = regexp.MustCompile(`http\.Client\s*\{|http\.DefaultClient|http\.(Get|Post|PostForm|Head)\(`)
+
+// TestNoNakedHTTPClients fails when a crawler source file creates its own
+// HTTP client instead of using httpclient.New.
+func TestNoNakedHTTPClients(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "//") {
+				continue
+			}
+			if nakedClient.MatchString(line) {
+				t.Errorf("%s:%d: use httpclient.New instead of a naked HTTP client: %s", file, i+1, strings.TrimSpace(line))
+			}
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Package crawler implements bulk favorite imports from CSV uploads
+package crawler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+	"scraper/internal/timeout"
+)
+
+// importBackgroundThreshold is the number of rows above which an import is
+// processed as a background job instead of inside the HTTP request.
+const importBackgroundThreshold = 20
+
+// importFetchDelay is the pause between Trendyol requests made while importing
+// products that are not yet in our database.
+const importFetchDelay = 2 * time.Second
+
+// importJobTTL is how long a finished import stays available to
+// GET /favorites/import/:job_id before it is dropped from memory.
+const importJobTTL = time.Hour
+
+// productURLPattern matches the content ID in Trendyol product URLs,
+// e.g. https://www.trendyol.com/brand/some-product-p-123456789?boutiqueId=1
+var productURLPattern = regexp.MustCompile(`-p-(\d+)`)
+
+// ImportRowResult describes the outcome of importing a single CSV row.
+type ImportRowResult struct {
+	Row       int    `json:"row"`                  // 1-based row number in the uploaded file
+	Input     string `json:"input"`                // Raw cell value
+	ProductID uint   `json:"product_id,omitempty"` // Extracted content ID
+	Status    string `json:"status"`               // added, created, exists, invalid, limit_reached or failed
+	Error     string `json:"error,omitempty"`      // Failure reason if any
+}
+
+// ImportJob tracks the progress of a favorites import.
+type ImportJob struct {
+	ID         string            `json:"id"`          // Job identifier
+	UserID     uint              `json:"user_id"`     // User receiving the favorites
+	State      string            `json:"state"`       // running or completed
+	Total      int               `json:"total"`       // Number of rows in the file
+	Processed  int               `json:"processed"`   // Number of rows processed so far
+	Results    []ImportRowResult `json:"results"`     // Per-row report
+	StartedAt  time.Time         `json:"started_at"`  // When processing started
+	FinishedAt *time.Time        `json:"finished_at"` // When processing finished
+}
+
+// importJobs holds background import jobs by ID
+var (
+	importJobsMu sync.RWMutex
+	importJobs   = make(map[string]*ImportJob)
+)
+
+// parseImportCSV reads product references from an uploaded CSV file.
+// Each row must contain a product URL or content ID in its first column.
+// Empty rows are skipped, and a header row is tolerated since it simply
+// reports as invalid.
+//
+// Parameters:
+//   - r: Reader over the uploaded CSV content
+//
+// Returns:
+//   - []string: The first cell of every non-empty row
+//   - error: If the file is not valid CSV
+func parseImportCSV(r io.Reader) ([]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // Allow rows with varying column counts
+	reader.TrimLeadingSpace = true
+
+	var rows []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CSV: %v", err)
+		}
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		rows = append(rows, strings.TrimSpace(record[0]))
+	}
+	return rows, nil
+}
+
+// extractContentID resolves a Trendyol content ID from either a plain numeric
+// ID or a product URL.
+//
+// Parameters:
+//   - input: Product URL or content ID
+//
+// Returns:
+//   - uint: The content ID
+//   - error: If no content ID could be found
+func extractContentID(input string) (uint, error) {
+	// Plain numeric content ID
+	if id, err := models.ParseProductID(input); err == nil {
+		return id, nil
+	}
+
+	// Product URL, either with the -p-<id> slug or a contentId query parameter
+	if u, err := url.Parse(input); err == nil && u.Host != "" {
+		if m := productURLPattern.FindStringSubmatch(u.Path); m != nil {
+			if id, err := models.ParseProductID(m[1]); err == nil {
+				return id, nil
+			}
+		}
+		if v := u.Query().Get("contentId"); v != "" {
+			if id, err := models.ParseProductID(v); err == nil {
+				return id, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("no product ID found")
+}
+
+// runImport processes every row of an import for a user and records the
+// per-row outcome on the job. Products missing from our database are fetched
+// from Trendyol (rate limited) and created before the favorite is added.
+// Rows left when ctx ends are reported as failed.
+//
+// Parameters:
+//   - ctx: Context of the import; the request's for imports run within it
+//   - db: Database connection
+//   - job: Job to record progress on
+//   - rows: Raw row values from the CSV file
+func runImport(ctx context.Context, db *gorm.DB, job *ImportJob, rows []string) {
+	fetched := false
+	for i, input := range rows {
+		result := ImportRowResult{Row: i + 1, Input: input}
+		if err := ctx.Err(); err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			recordImportResult(job, result)
+			continue
+		}
+
+		productID, err := extractContentID(input)
+		if err != nil {
+			result.Status = "invalid"
+			result.Error = err.Error()
+			recordImportResult(job, result)
+			continue
+		}
+		result.ProductID = productID
+
+		// Create the product first if we have never seen it
+		var count int64
+		db.Model(&models.Product{}).Where("id = ? AND source = ?", productID, models.SourceTrendyol).Count(&count)
+		if count == 0 {
+			// Rate limit requests to Trendyol
+			if fetched {
+				if err := timeout.Sleep(ctx, importFetchDelay); err != nil {
+					result.Status = "failed"
+					result.Error = err.Error()
+					recordImportResult(job, result)
+					continue
+				}
+			}
+			fetched = true
+
+			if err := ReserveRequest(db, models.SourceTrendyol, false); err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+				recordImportResult(job, result)
+				continue
+			}
+			product, err := FetchProduct(ctx, int(productID))
+			if err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+				recordImportResult(job, result)
+				continue
+			}
+			if err := db.Create(product).Error; err != nil {
+				logrus.WithError(err).WithField("product_id", productID).Error("Failed to create imported product")
+				result.Status = "failed"
+				result.Error = "failed to create product"
+				recordImportResult(job, result)
+				continue
+			}
+			result.Status = "created"
+		}
+
+		// Add the favorite relationship
+		if IsProductFavorited(db, job.UserID, productID, models.SourceTrendyol) {
+			result.Status = "exists"
+		} else if err := AddFavorite(db, job.UserID, productID, models.SourceTrendyol); err != nil {
+			var limitErr *FavoritesLimitError
+			if errors.As(err, &limitErr) {
+				result.Status = "limit_reached"
+				result.Error = limitErr.Error()
+			} else if errors.Is(err, ErrDuplicateFavorite) {
+				result.Status = "exists"
+			} else {
+				result.Status = "failed"
+				result.Error = "failed to add favorite"
+			}
+		} else if result.Status == "" {
+			result.Status = "added"
+		}
+		recordImportResult(job, result)
+	}
+
+	// Mark job as completed
+	importJobsMu.Lock()
+	now := time.Now()
+	job.State = "completed"
+	job.FinishedAt = &now
+	importJobsMu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"job_id":  job.ID,
+		"user_id": job.UserID,
+		"rows":    job.Total,
+	}).Info("Favorites import completed")
+}
+
+// recordImportResult appends a row result to the job under the registry lock.
+func recordImportResult(job *ImportJob, result ImportRowResult) {
+	importJobsMu.Lock()
+	defer importJobsMu.Unlock()
+	job.Results = append(job.Results, result)
+	job.Processed++
+}
+
+// newImportJob creates and registers a new import job, dropping the jobs
+// that finished more than importJobTTL ago.
+//
+// Parameters:
+//   - userID: User receiving the favorites
+//   - total: Number of rows in the import
+//
+// Returns:
+//   - *ImportJob: The registered job
+func newImportJob(userID uint, total int) *ImportJob {
+	job := &ImportJob{
+		ID:        newImportJobID(),
+		UserID:    userID,
+		State:     "running",
+		Total:     total,
+		Results:   []ImportRowResult{},
+		StartedAt: time.Now(),
+	}
+	importJobsMu.Lock()
+	for id, old := range importJobs {
+		if old.FinishedAt != nil && job.StartedAt.Sub(*old.FinishedAt) > importJobTTL {
+			delete(importJobs, id)
+		}
+	}
+	importJobs[job.ID] = job
+	importJobsMu.Unlock()
+	return job
+}
+
+// newImportJobID returns a random job ID, so one user cannot guess the ID
+// of another user's import.
+func newImportJobID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// getImportJob returns a snapshot of an import job by ID.
+//
+// Returns:
+//   - ImportJob: Copy of the job state
+//   - bool: false if no job with that ID exists
+func getImportJob(id string) (ImportJob, bool) {
+	importJobsMu.RLock()
+	defer importJobsMu.RUnlock()
+	job, ok := importJobs[id]
+	if !ok {
+		return ImportJob{}, false
+	}
+	snapshot := *job
+	snapshot.Results = append([]ImportRowResult(nil), job.Results...)
+	return snapshot, true
+}
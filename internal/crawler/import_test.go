@@ -0,0 +1,36 @@
+package crawler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewImportJobDropsExpiredJobs(t *testing.T) {
+	saved := importJobs
+	importJobs = make(map[string]*ImportJob)
+	t.Cleanup(func() { importJobs = saved })
+
+	finished := func(ago time.Duration) *ImportJob {
+		job := newImportJob(1, 1)
+		at := time.Now().Add(-ago)
+		job.State, job.FinishedAt = "completed", &at
+		return job
+	}
+	expired := finished(importJobTTL + time.Minute)
+	recent := finished(time.Minute)
+	running := newImportJob(1, 1)
+	running.StartedAt = time.Now().Add(-2 * importJobTTL)
+
+	job := newImportJob(1, 1)
+	if _, ok := getImportJob(expired.ID); ok {
+		t.Error("job finished past importJobTTL still registered")
+	}
+	for _, kept := range []*ImportJob{recent, running, job} {
+		if _, ok := getImportJob(kept.ID); !ok {
+			t.Errorf("job %s dropped, want it kept", kept.ID)
+		}
+	}
+	if len(job.ID) != 24 || job.ID == recent.ID || job.ID == running.ID {
+		t.Errorf("job ID %q, want 24 random hex digits", job.ID)
+	}
+}
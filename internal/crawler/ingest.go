@@ -0,0 +1,364 @@
+// Package crawler implements the ingest endpoint for product details captured
+// by the browser extension
+package crawler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/analysis"
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+	"scraper/internal/audit"
+	"scraper/internal/metrics"
+	"scraper/internal/models"
+	"scraper/pkg/httpclient"
+)
+
+// Results of an ingest submission
+const (
+	ingestAccepted  = "accepted"  // The product was stored
+	ingestDuplicate = "duplicate" // The same payload was stored within the dedup window
+	ingestRejected  = "rejected"  // The payload was malformed and kept in the ingest-error store
+)
+
+// Ingest defaults
+const (
+	defaultIngestMaxBytes       = 1 << 20
+	defaultIngestDedupWindow    = 5 * time.Minute
+	defaultIngestErrorRetention = 7 * 24 * time.Hour
+)
+
+// Limits of GET /admin/ingest/errors
+const (
+	defaultIngestErrorsLimit = 20
+	maxIngestErrorsLimit     = 100
+)
+
+// ingestSubmissions counts ingest submissions by result
+var ingestSubmissions = metrics.NewCounter(
+	"ingest_submissions_total",
+	"Product payloads submitted to POST /ingest/product by result (accepted, duplicate, rejected)",
+	"result",
+)
+
+// IngestResult is the response of POST /ingest/product
+type IngestResult struct {
+	Product   ProductDetail `json:"product"`   // The stored product
+	Duplicate bool          `json:"duplicate"` // True if the same payload was stored within the dedup window and was not applied again
+	Favorited bool          `json:"favorited"` // True if the product was added to the user's favorites by this request
+}
+
+// ingestMaxBytes returns the largest payload POST /ingest/product accepts.
+//
+// Environment Variables:
+//   - INGEST_MAX_BYTES: Largest accepted payload in bytes (default: 1048576)
+func ingestMaxBytes() int {
+	if n := viper.GetInt("INGEST_MAX_BYTES"); n > 0 {
+		return n
+	}
+	return defaultIngestMaxBytes
+}
+
+// ingestDedupWindow returns how long a payload is remembered after it was
+// stored.
+//
+// Environment Variables:
+//   - INGEST_DEDUP_WINDOW: Time within which an identical payload is not
+//     applied again (default: 5m)
+func ingestDedupWindow() time.Duration {
+	if window := viper.GetDuration("INGEST_DEDUP_WINDOW"); window > 0 {
+		return window
+	}
+	return defaultIngestDedupWindow
+}
+
+// ingestErrorRetention returns how long rejected payloads are kept.
+//
+// Environment Variables:
+//   - INGEST_ERROR_RETENTION: How long rejected payloads are kept (default: 168h)
+func ingestErrorRetention() time.Duration {
+	if retention := viper.GetDuration("INGEST_ERROR_RETENTION"); retention > 0 {
+		return retention
+	}
+	return defaultIngestErrorRetention
+}
+
+// contentHash returns the hex SHA-256 of a payload.
+func contentHash(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseIngestPayload validates a raw Trendyol product detail response and
+// converts it into a product. The payload is compacted before it is hashed,
+// so the same response captured with different formatting hashes the same.
+//
+// Parameters:
+//   - payload: Product detail JSON, shaped like models.TrendyolResponse
+//
+// Returns:
+//   - *models.Product: The converted product
+//   - string: Hex SHA-256 of the compacted payload
+//   - error: If the payload is not JSON, does not decode as a product detail,
+//     or lacks a valid ID, a name or a price
+func ParseIngestPayload(payload []byte) (*models.Product, string, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, payload); err != nil {
+		return nil, "", fmt.Errorf("payload is not valid JSON: %v", err)
+	}
+	var resp models.TrendyolResponse
+	if err := json.Unmarshal(compact.Bytes(), &resp); err != nil {
+		return nil, "", fmt.Errorf("payload is not a product detail: %v", err)
+	}
+	switch {
+	case resp.ID <= 0 || !models.ValidProductID(uint64(resp.ID)):
+		return nil, "", errors.New("product detail has no valid id")
+	case resp.Name == "":
+		return nil, "", errors.New("product detail has no name")
+	case resp.WinnerVariant.Price.DiscountedPrice <= 0:
+		return nil, "", errors.New("product detail has no price")
+	}
+
+	products := ConvertTrendyolToProduct(&[]models.TrendyolResponse{resp})
+	product := products[0]
+	product.Source = models.SourceTrendyol
+	return &product, contentHash(compact.Bytes()), nil
+}
+
+// RecordIngestError stores a rejected payload in the ingest-error store and
+// removes entries older than INGEST_ERROR_RETENTION.
+//
+// Parameters:
+//   - db: Database connection
+//   - entry: The rejected payload with the reason
+//
+// Returns:
+//   - error: Any database error storing the entry
+func RecordIngestError(db *gorm.DB, entry *models.IngestError) error {
+	if err := db.Create(entry).Error; err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-ingestErrorRetention())
+	if err := db.Where("created_at < ?", cutoff).Delete(&models.IngestError{}).Error; err != nil {
+		logrus.WithError(err).Warn("Failed to prune ingest errors")
+	}
+	return nil
+}
+
+// claimIngestSubmission records a payload as stored unless the same payload
+// was stored within the dedup window. Entries older than the window are
+// taken over and pruned.
+//
+// Parameters:
+//   - db: Database connection
+//   - hash: Hex SHA-256 of the compacted payload
+//   - p: The product the payload describes
+//
+// Returns:
+//   - bool: False if the payload is a duplicate
+//   - error: Any database error
+func claimIngestSubmission(db *gorm.DB, hash string, p *models.Product) (bool, error) {
+	now := time.Now()
+	cutoff := now.Add(-ingestDedupWindow())
+
+	// An entry within the window conflicts and returns no row
+	var claimed []string
+	err := db.Raw(`INSERT INTO ingest_submissions (content_hash, product_id, source, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (content_hash) DO UPDATE
+		SET product_id = EXCLUDED.product_id, source = EXCLUDED.source, created_at = EXCLUDED.created_at
+		WHERE ingest_submissions.created_at < ?
+		RETURNING content_hash`,
+		hash, p.ID, p.Source, now, cutoff).Scan(&claimed).Error
+	if err != nil {
+		return false, err
+	}
+	if err := db.Where("created_at < ?", cutoff).Delete(&models.IngestSubmission{}).Error; err != nil {
+		logrus.WithError(err).Warn("Failed to prune ingest submissions")
+	}
+	return len(claimed) > 0, nil
+}
+
+// IngestProduct stores a product captured by the browser extension through
+// the analysis upsert path, so price changes reach the favorites service and
+// watchers like a crawled product. A payload stored within
+// INGEST_DEDUP_WINDOW is not applied again. With a user, the product is
+// added to the user's favorites; a product that already is one is not an
+// error.
+//
+// Parameters:
+//   - db: Database connection
+//   - producer: Kafka producer for forwarding favorited products
+//   - product: The product, see ParseIngestPayload
+//   - hash: Hex SHA-256 of the payload
+//   - userID: User to favorite the product for; 0 for none
+//   - origin: Request the product came from, for the audit trail
+//
+// Returns:
+//   - IngestResult: The stored product and what was done
+//   - error: ErrFavoriteUserNotFound, *FavoritesLimitError, or any database
+//     error
+func IngestProduct(db *gorm.DB, producer sarama.SyncProducer, product *models.Product, hash string, userID uint, origin audit.Origin) (IngestResult, error) {
+	var result IngestResult
+
+	// Check the user first, so a missing user does not claim the payload
+	if userID != 0 {
+		var users int64
+		if err := db.Model(&models.User{}).Where("id = ?", userID).Count(&users).Error; err != nil {
+			return result, err
+		}
+		if users == 0 {
+			return result, ErrFavoriteUserNotFound
+		}
+	}
+
+	claimed, err := claimIngestSubmission(db, hash, product)
+	if err != nil {
+		return result, err
+	}
+	result.Duplicate = !claimed
+	if claimed {
+		analysis.ApplyProducts(db, producer, []models.Product{*product}, origin)
+	}
+
+	var stored models.Product
+	if err := db.Where("id = ? AND source = ?", product.ID, product.Source).First(&stored).Error; err != nil {
+		if claimed {
+			// Let the extension submit the payload again
+			db.Where("content_hash = ?", hash).Delete(&models.IngestSubmission{})
+		}
+		return result, err
+	}
+	result.Product = NewProductDetail(stored)
+
+	if userID != 0 {
+		err := AddFavorite(db, userID, product.ID, product.Source)
+		if err != nil && !errors.Is(err, ErrDuplicateFavorite) {
+			return result, err
+		}
+		result.Favorited = err == nil
+	}
+	return result, nil
+}
+
+// registerIngestHandlers sets up the ingest endpoint for the browser
+// extension and the listing of the payloads it rejected. Both require the
+// API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - producer: Kafka producer for forwarding favorited products
+func registerIngestHandlers(e *echo.Echo, db *gorm.DB, producer sarama.SyncProducer) {
+	admin := e.Group("", requireAPIKey())
+
+	// POST /ingest/product
+	// Stores a raw Trendyol product detail response captured by the browser
+	// extension and returns the stored product. Malformed payloads are kept
+	// in the ingest-error store and rejected with its entry ID as error_id.
+	// Query parameters:
+	//   - user_id: Optional user to add the product to the favorites of
+	admin.POST("/ingest/product", func(c echo.Context) error {
+		var userID uint
+		if raw := c.QueryParam("user_id"); raw != "" {
+			id, err := strconv.ParseUint(raw, 10, 32)
+			if err != nil || id == 0 {
+				return apierror.Invalid("Invalid user ID")
+			}
+			userID = uint(id)
+		}
+
+		maxBytes := ingestMaxBytes()
+		payload, err := io.ReadAll(io.LimitReader(c.Request().Body, int64(maxBytes)+1))
+		if err != nil {
+			return apierror.Invalid("Failed to read payload")
+		}
+		if len(payload) > maxBytes {
+			return apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeValidationFailed,
+				fmt.Sprintf("payload exceeds %d bytes", maxBytes))
+		}
+
+		ctx := c.Request().Context()
+		product, hash, err := ParseIngestPayload(payload)
+		if err != nil {
+			ingestSubmissions.Inc(ingestRejected)
+			entry := models.IngestError{
+				ContentHash: contentHash(payload),
+				KeyID:       apikey.KeyID(c),
+				Error:       err.Error(),
+				Payload:     string(payload),
+			}
+			if userID != 0 {
+				entry.UserID = &userID
+			}
+			if err := RecordIngestError(db.WithContext(ctx), &entry); err != nil {
+				logrus.WithError(err).Error("Failed to record ingest error")
+			}
+			logrus.WithError(err).WithField("key_id", entry.KeyID).Warn("Rejected malformed ingest payload")
+			return apierror.Invalid("Malformed product payload: " + err.Error()).
+				WithDetails(map[string]uint{"error_id": entry.ID})
+		}
+
+		origin := audit.Origin{CorrelationID: c.Request().Header.Get(httpclient.HeaderCorrelationID)}
+		result, err := IngestProduct(db.WithContext(ctx), producer, product, hash, userID, origin)
+		if errors.Is(err, ErrFavoriteUserNotFound) {
+			return err
+		}
+		var limitErr *FavoritesLimitError
+		if errors.As(err, &limitErr) {
+			return err
+		}
+		if err != nil {
+			return apierror.Internal("Failed to store product", err)
+		}
+
+		if result.Duplicate {
+			ingestSubmissions.Inc(ingestDuplicate)
+		} else {
+			ingestSubmissions.Inc(ingestAccepted)
+		}
+		logrus.WithFields(logrus.Fields{
+			"product_id": product.ID,
+			"key_id":     apikey.KeyID(c),
+			"duplicate":  result.Duplicate,
+			"favorited":  result.Favorited,
+		}).Info("Ingested product from browser extension")
+		return c.JSON(http.StatusOK, result)
+	})
+
+	// GET /admin/ingest/errors
+	// Lists the most recent payloads POST /ingest/product rejected
+	// Query parameters:
+	//   - limit: Entries to list, 1-100 (default 20)
+	admin.GET("/admin/ingest/errors", func(c echo.Context) error {
+		limit := defaultIngestErrorsLimit
+		if raw := c.QueryParam("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxIngestErrorsLimit {
+				return apierror.Invalid(fmt.Sprintf("limit must be between 1 and %d", maxIngestErrorsLimit))
+			}
+			limit = n
+		}
+		entries := []models.IngestError{}
+		err := db.WithContext(c.Request().Context()).Order("created_at DESC, id DESC").Limit(limit).Find(&entries).Error
+		if err != nil {
+			return apierror.Internal("Failed to load ingest errors", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"errors": entries})
+	})
+}
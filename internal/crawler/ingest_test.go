@@ -0,0 +1,110 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"scraper/internal/audit"
+	"scraper/internal/models"
+)
+
+// ingestPayload returns a product detail response for product id.
+func ingestPayload(id int, price float64) string {
+	return fmt.Sprintf(`{"id": %d, "name": "Product %d", "inStock": true,
+		"winnerVariant": {"price": {"currency": "TRY", "discountedPrice": %.2f, "sellingPrice": %.2f}}}`, id, id, price, price)
+}
+
+func TestParseIngestPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr string
+	}{
+		{"valid", ingestPayload(42, 99.9), ""},
+		{"not json", `{"id": 42,`, "not valid JSON"},
+		{"wrong shape", `{"id": "42"}`, "not a product detail"},
+		{"no id", `{"name": "Product"}`, "no valid id"},
+		{"negative id", `{"id": -1, "name": "Product"}`, "no valid id"},
+		{"no name", `{"id": 42}`, "no name"},
+		{"no price", `{"id": 42, "name": "Product"}`, "no price"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			product, hash, err := ParseIngestPayload([]byte(tt.payload))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if product.ID != 42 || product.Source != models.SourceTrendyol || product.Price != 99.9 || len(hash) != 64 {
+				t.Errorf("product = %d/%s at %.2f, hash %q; want 42/trendyol at 99.90 with a SHA-256", product.ID, product.Source, product.Price, hash)
+			}
+		})
+	}
+}
+
+func TestParseIngestPayloadHashIgnoresFormatting(t *testing.T) {
+	_, compact, err := ParseIngestPayload([]byte(`{"id":42,"name":"Product","winnerVariant":{"price":{"discountedPrice":10}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, indented, err := ParseIngestPayload([]byte("{\n  \"id\": 42,\n  \"name\": \"Product\",\n  \"winnerVariant\": {\"price\": {\"discountedPrice\": 10}}\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compact != indented {
+		t.Errorf("hashes differ by formatting: %s, %s", compact, indented)
+	}
+}
+
+func TestIngestProductDeduplicates(t *testing.T) {
+	db := openStressDB(t)
+	if err := db.AutoMigrate(&models.IngestSubmission{}, &models.PriceStockLog{}, &models.RatingLog{}); err != nil {
+		t.Fatal(err)
+	}
+	createStressUsers(t, db, 1)
+
+	product, hash, err := ParseIngestPayload([]byte(ingestPayload(stressBaseID, 120)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Where("content_hash = ?", hash).Delete(&models.IngestSubmission{}) })
+
+	producer := &recordingProducer{}
+	first, err := IngestProduct(db, producer, product, hash, stressBaseID, audit.Origin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Duplicate || !first.Favorited || first.Product.ID != stressBaseID || first.Product.Price != 120 {
+		t.Errorf("first submission = %+v, want the stored product favorited", first)
+	}
+
+	// The same payload within the window is not applied again
+	second, err := IngestProduct(db, producer, product, hash, stressBaseID, audit.Origin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Duplicate || second.Favorited || second.Product.ID != stressBaseID {
+		t.Errorf("second submission = %+v, want a duplicate of the stored product", second)
+	}
+
+	// An unknown user is rejected before the payload is claimed
+	other, otherHash, err := ParseIngestPayload([]byte(ingestPayload(stressBaseID+1, 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IngestProduct(db, producer, other, otherHash, stressBaseID+99, audit.Origin{}); !errors.Is(err, ErrFavoriteUserNotFound) {
+		t.Errorf("err = %v, want ErrFavoriteUserNotFound", err)
+	}
+	var claims int64
+	db.Model(&models.IngestSubmission{}).Where("content_hash = ?", otherHash).Count(&claims)
+	if claims != 0 {
+		t.Error("payload for an unknown user was claimed")
+	}
+}
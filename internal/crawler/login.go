@@ -0,0 +1,213 @@
+// Package crawler implements user login with email and password and the
+// access rules of the endpoints that need a login token
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/auth"
+	"scraper/internal/emailaddr"
+	"scraper/internal/models"
+)
+
+// Login errors
+var (
+	// ErrInvalidCredentials is returned for an unknown email address and for
+	// a wrong password alike, so callers cannot tell which accounts exist
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	// ErrUserInactive is returned when the password is right but the
+	// account is deactivated
+	ErrUserInactive = errors.New("user is inactive")
+)
+
+// LoginResult is the response of a successful login
+type LoginResult struct {
+	Token     string      `json:"token"`      // Signed JWT
+	TokenType string      `json:"token_type"` // Always "Bearer"
+	ExpiresAt time.Time   `json:"expires_at"` // When the token expires
+	User      models.User `json:"user"`       // The user, with the password cleared
+}
+
+// authenticate checks a password against a user. The password is verified
+// before the account status, so only the owner of an account learns that it
+// is inactive.
+//
+// Parameters:
+//   - user: The user with the email address, nil if there is none
+//   - password: Password to check
+//
+// Returns:
+//   - error: ErrInvalidCredentials, ErrUserInactive or nil
+func authenticate(user *models.User, password string) error {
+	hash := ""
+	if user != nil {
+		hash = user.Password
+	}
+	// Unknown users are checked against a dummy hash, taking as long as a
+	// wrong password
+	if !auth.CheckPassword(hash, password) || user == nil {
+		return ErrInvalidCredentials
+	}
+	if !user.IsActive {
+		return ErrUserInactive
+	}
+	return nil
+}
+
+// Login verifies a user's email address and password, records the login and
+// issues a token.
+//
+// Parameters:
+//   - db: Database connection
+//   - issuer: Signs the token
+//   - email: Email address as entered; compared like at registration
+//   - password: The user's password
+//
+// Returns:
+//   - LoginResult: The token and the user
+//   - error: ErrInvalidCredentials, ErrUserInactive or any database error
+func Login(db *gorm.DB, issuer *auth.Issuer, email, password string) (LoginResult, error) {
+	var user models.User
+	err := db.Where("lower(email) = ?", emailaddr.Key(email)).First(&user).Error
+	found := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return LoginResult{}, err
+	}
+	var candidate *models.User
+	if found {
+		candidate = &user
+	}
+	if err := authenticate(candidate, password); err != nil {
+		return LoginResult{}, err
+	}
+
+	now := time.Now()
+	if err := db.Model(&user).UpdateColumn("last_login_at", now).Error; err != nil {
+		return LoginResult{}, err
+	}
+	user.LastLoginAt = now
+
+	token, expiresAt, err := issuer.Issue(user.ID, user.Email, user.IsAdmin, now)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	user.Password = ""
+	return LoginResult{Token: token, TokenType: "Bearer", ExpiresAt: expiresAt, User: user}, nil
+}
+
+// authRoutes returns the access rules of the crawler's endpoints. A user's
+// favorites, collections, seller and brand watches, preferences and profile
+// are only available to that user and to admins. POST /users and the product endpoints stay public.
+//
+// Environment Variables:
+//   - AUTH_RESTRICT_CRAWLS: Limit price drop simulation, fetches and crawls
+//     to admins (default: false)
+//
+// Returns:
+//   - auth.Routes: Rules for auth.Middleware
+func authRoutes() auth.Routes {
+	routes := auth.Routes{
+		// The user is in the request body; the handlers call auth.Authorize
+		"POST /favorites":               {Access: auth.User},
+		"POST /favorites/bulk":          {Access: auth.User},
+		"DELETE /favorites":             {Access: auth.User},
+		"PATCH /favorites":              {Access: auth.User},
+		"PATCH /favorites/mute":         {Access: auth.User},
+		"PUT /favorites/collection":     {Access: auth.User},
+		"POST /favorites/import":        {Access: auth.User},
+		"GET /favorites/import/:job_id": {Access: auth.User},
+		"POST /seller-watches":          {Access: auth.User},
+		"DELETE /seller-watches":        {Access: auth.User},
+		"POST /brand-watches":           {Access: auth.User},
+		"DELETE /brand-watches":         {Access: auth.User},
+
+		"GET /favorites/:user_id":        {Access: auth.Owner, Param: "user_id"},
+		"GET /favorites/:user_id/export": {Access: auth.Owner, Param: "user_id"},
+		"GET /seller-watches/:user_id":   {Access: auth.Owner, Param: "user_id"},
+		"GET /brand-watches/:user_id":    {Access: auth.Owner, Param: "user_id"},
+
+		"GET /users/:id":                               {Access: auth.Owner, Param: "id"},
+		"PUT /users/:id":                               {Access: auth.Owner, Param: "id"},
+		"PUT /users/:id/password":                      {Access: auth.Owner, Param: "id"},
+		"DELETE /users/:id":                            {Access: auth.Owner, Param: "id"},
+		"POST /users/:id/collections":                  {Access: auth.Owner, Param: "id"},
+		"GET /users/:id/collections":                   {Access: auth.Owner, Param: "id"},
+		"PUT /users/:id/collections/:collection_id":    {Access: auth.Owner, Param: "id"},
+		"DELETE /users/:id/collections/:collection_id": {Access: auth.Owner, Param: "id"},
+		"GET /users/:id/preferences":                   {Access: auth.Owner, Param: "id"},
+		"PATCH /users/:id/preferences/notifications":   {Access: auth.Owner, Param: "id"},
+		"PATCH /users/:id/preferences/digest":          {Access: auth.Owner, Param: "id"},
+		"POST /users/:id/notifications/snooze":         {Access: auth.Owner, Param: "id"},
+		"DELETE /users/:id/notifications/snooze":       {Access: auth.Owner, Param: "id"},
+	}
+	if viper.GetBool("AUTH_RESTRICT_CRAWLS") {
+		for _, route := range []string{
+			"POST /simulate-price-drop",
+			"GET /fetch",
+			"POST /fetch",
+			"POST /crawl/products",
+			"POST /crawl/category/:wc",
+		} {
+			routes[route] = auth.Rule{Access: auth.Admin}
+		}
+	}
+	return routes
+}
+
+// registerLoginHandlers sets up the login endpoint. Without a valid
+// JWT_SECRET it answers 503.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - validate: Validator for request bodies
+//   - issuer: Signs the tokens; nil when login is not configured
+func registerLoginHandlers(e *echo.Echo, db *gorm.DB, validate *validator.Validate, issuer *auth.Issuer) {
+
+	// POST /login
+	// Verifies a user's email address and password and returns a signed
+	// token with the user. Returns 401 for an unknown address and a wrong
+	// password alike, and 403 if the password is right but the user is
+	// inactive.
+	// Request body: {"email": string, "password": string}
+	e.POST("/login", func(c echo.Context) error {
+		if issuer == nil {
+			return apierror.New(http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Login is not configured")
+		}
+
+		var req struct {
+			Email    string `json:"email" validate:"required"`
+			Password string `json:"password" validate:"required"`
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+
+		result, err := Login(db.WithContext(c.Request().Context()), issuer, req.Email, req.Password)
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			logrus.Info("Failed login")
+			return apierror.New(http.StatusUnauthorized, apierror.CodeInvalidCredentials, "Invalid email or password")
+		case errors.Is(err, ErrUserInactive):
+			logrus.Info("Login of inactive user refused")
+			return apierror.New(http.StatusForbidden, apierror.CodeUserInactive, "User is inactive")
+		case err != nil:
+			return apierror.Internal("Failed to log in", err)
+		}
+
+		logrus.WithField("user_id", result.User.ID).Info("User logged in")
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,51 @@
+package crawler
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+
+	"scraper/internal/auth"
+	"scraper/internal/models"
+)
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := auth.HashPassword("secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := &models.User{Email: "user@example.com", Password: hash, IsActive: true}
+	inactive := &models.User{Email: "user@example.com", Password: hash, IsActive: false}
+
+	cases := []struct {
+		name     string
+		user     *models.User
+		password string
+		want     error
+	}{
+		{"right password", active, "secret123", nil},
+		{"wrong password", active, "secret124", ErrInvalidCredentials},
+		{"unknown user", nil, "secret123", ErrInvalidCredentials},
+		{"inactive user", inactive, "secret123", ErrUserInactive},
+		// An inactive account is not revealed without its password
+		{"inactive user, wrong password", inactive, "wrong", ErrInvalidCredentials},
+	}
+	for _, tc := range cases {
+		if err := authenticate(tc.user, tc.password); !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestAuthRoutesCoverWatches(t *testing.T) {
+	e := echo.New()
+	registerWatchHandlers(e, nil, validator.New())
+	routes := authRoutes()
+	for _, r := range e.Routes() {
+		if rule, ok := routes[r.Method+" "+r.Path]; !ok || rule.Access == auth.Public {
+			t.Errorf("%s %s is public, want it limited to the watching user", r.Method, r.Path)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package crawler implements merging duplicate products: the same physical
+// product listed under two content IDs, e.g. after a storefront migration
+package crawler
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/events"
+	"scraper/internal/models"
+)
+
+// ErrMergeSameProduct is returned when a product would be merged into itself
+var ErrMergeSameProduct = errors.New("winner and loser are the same product")
+
+// MergeResult is the outcome of merging two products
+type MergeResult struct {
+	WinnerID      uint             `json:"winner_id"`
+	LoserID       uint             `json:"loser_id"`
+	Source        string           `json:"source"`
+	Moved         map[string]int64 `json:"moved"`          // Rows repointed to the winner by table
+	Deduplicated  map[string]int64 `json:"deduplicated"`   // Loser rows dropped because the winner had the same row, by table
+	FilledColumns []string         `json:"filled_columns"` // Winner variant columns that were empty and took the loser's values
+}
+
+// mergedVariantColumns are the columns holding a product's variant data. The
+// winner keeps its own; an empty one takes the loser's until the next crawl.
+var mergedVariantColumns = []string{"other_sellers", "stock_info", "price_info", "images", "attributes"}
+
+// emptyJSON reports whether a JSON column holds no data.
+func emptyJSON(value []byte) bool {
+	trimmed := bytes.TrimSpace(value)
+	for _, empty := range []string{"", "null", "{}", "[]"} {
+		if string(trimmed) == empty {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeProducts merges a duplicate product into the one that stays, in one
+// transaction:
+//   - Favorites move to the winner. A user who has both keeps the winner's
+//     favorite, and the favorite counter is recounted.
+//   - Price and stock logs, price and rating history, brand events and the
+//     notification history and snoozed notifications move to the winner.
+//     Notification history the winner already has for a user is dropped.
+//   - Fetch retries of the loser are dropped.
+//   - Variant columns the winner lacks are filled from the loser.
+//   - The loser is soft-deleted with merged_into set to the winner, and
+//     products merged into the loser before point at the winner too. The
+//     analysis consumer redirects later crawls of the loser to the winner.
+//   - With search indexing on, both products are queued for the search
+//     index once the transaction commits, which drops the loser's document
+//     and rewrites the winner's.
+//
+// Tables keyed by the product ID alone only move when no product of another
+// source uses the loser's ID.
+//
+// Parameters:
+//   - db: Database connection
+//   - source: Marketplace of both products
+//   - winnerID: Product that stays
+//   - loserID: Duplicate merged into it
+//
+// Returns:
+//   - MergeResult: Rows moved and dropped
+//   - error: ErrMergeSameProduct, gorm.ErrRecordNotFound if either product
+//     does not exist or is deleted, or any database error
+func MergeProducts(db *gorm.DB, source string, winnerID, loserID uint) (MergeResult, error) {
+	if winnerID == loserID {
+		return MergeResult{}, ErrMergeSameProduct
+	}
+	result := MergeResult{
+		WinnerID:      winnerID,
+		LoserID:       loserID,
+		Source:        source,
+		Moved:         make(map[string]int64),
+		Deduplicated:  make(map[string]int64),
+		FilledColumns: []string{},
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Lock both products, in ID order so concurrent merges cannot deadlock
+		var products []models.Product
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id IN ? AND source = ?", []uint{winnerID, loserID}, source).
+			Order("id").
+			Find(&products).Error
+		if err != nil {
+			return err
+		}
+		if len(products) != 2 {
+			return gorm.ErrRecordNotFound
+		}
+		winner, loser := products[0], products[1]
+		if winner.ID != winnerID {
+			winner, loser = loser, winner
+		}
+
+		if err := mergeFavorites(tx, source, winnerID, loserID, &result); err != nil {
+			return err
+		}
+		if err := mergeNotificationHistory(tx, source, winnerID, loserID, &result); err != nil {
+			return err
+		}
+
+		// Rows without a uniqueness constraint move as they are
+		shared, err := productIDShared(tx, source, loserID)
+		if err != nil {
+			return err
+		}
+		for _, dependent := range []productDependent{
+			{Name: "suppressed_notifications", Model: &models.SuppressedNotification{}, Source: "source"},
+			{Name: "rating_logs", Model: &models.RatingLog{}, Source: "source"},
+			{Name: "price_history", Model: &models.PriceHistory{}, Source: "source"},
+			{Name: "price_stock_logs", Model: &models.PriceStockLog{}, Source: "source"},
+			{Name: "brand_events", Model: &models.BrandEvent{}},
+		} {
+			query := tx.Unscoped().Model(dependent.Model).Where("product_id = ?", loserID)
+			if dependent.Source != "" {
+				query = query.Where(dependent.Source+" = ?", source)
+			} else if shared {
+				continue
+			}
+			moved := query.UpdateColumn("product_id", winnerID)
+			if moved.Error != nil {
+				return moved.Error
+			}
+			result.Moved[dependent.Name] = moved.RowsAffected
+		}
+
+		dropped := tx.Unscoped().Where("product_id = ? AND product_source = ?", loserID, source).Delete(&models.FetchRetry{})
+		if dropped.Error != nil {
+			return dropped.Error
+		}
+		result.Deduplicated["fetch_retries"] = dropped.RowsAffected
+
+		// The winner's variant data wins; only gaps are filled from the loser
+		filled := make(map[string]interface{})
+		winnerColumns := map[string]datatypes.JSON{
+			"other_sellers": winner.OtherSellers, "stock_info": winner.StockInfo, "price_info": winner.PriceInfo,
+			"images": winner.Images, "attributes": winner.Attributes,
+		}
+		loserColumns := map[string]datatypes.JSON{
+			"other_sellers": loser.OtherSellers, "stock_info": loser.StockInfo, "price_info": loser.PriceInfo,
+			"images": loser.Images, "attributes": loser.Attributes,
+		}
+		for _, column := range mergedVariantColumns {
+			if emptyJSON(winnerColumns[column]) && !emptyJSON(loserColumns[column]) {
+				filled[column] = loserColumns[column]
+				result.FilledColumns = append(result.FilledColumns, column)
+			}
+		}
+		// The scheduler refreshes favorite-marked products
+		if loser.IsFavorite && !winner.IsFavorite {
+			filled["is_favorite"] = true
+		}
+		filled["local_favorites_count"] = tx.Unscoped().Model(&models.UserFavorite{}).
+			Select("count(*)").
+			Where("product_id = ? AND source = ? AND deleted_at IS NULL", winnerID, source)
+		if err := tx.Model(&models.Product{}).Where("id = ? AND source = ?", winnerID, source).UpdateColumns(filled).Error; err != nil {
+			return err
+		}
+
+		// Products merged into the loser before now point at the winner, so
+		// a redirect never takes more than one step
+		err = tx.Unscoped().Model(&models.Product{}).
+			Where("merged_into = ? AND source = ?", loserID, source).
+			UpdateColumn("merged_into", winnerID).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&models.Product{}).Where("id = ? AND source = ?", loserID, source).
+			UpdateColumns(map[string]interface{}{"merged_into": winnerID, "local_favorites_count": 0}).Error
+		if err != nil {
+			return err
+		}
+		err = queueSearchIndex(tx, events.ProductRef{ID: winnerID, Source: source}, events.ProductRef{ID: loserID, Source: source})
+		if err != nil {
+			return err
+		}
+		return tx.Where("id = ? AND source = ?", loserID, source).Delete(&models.Product{}).Error
+	})
+	if err != nil {
+		return MergeResult{}, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"winner_id":    winnerID,
+		"loser_id":     loserID,
+		"source":       source,
+		"moved":        result.Moved,
+		"deduplicated": result.Deduplicated,
+		"filled":       result.FilledColumns,
+	}).Info("Products merged")
+	return result, nil
+}
+
+// mergeFavorites moves the loser's favorites to the winner. The unique index
+// on (user_id, product_id, source) covers removed favorites too, so a user's
+// removed favorite gives way to an active one of the other product, and of
+// two remaining favorites the winner's is kept.
+func mergeFavorites(tx *gorm.DB, source string, winnerID, loserID uint, result *MergeResult) error {
+	stale := tx.Exec(`DELETE FROM user_favorites w
+		WHERE w.product_id = ? AND w.source = ? AND w.deleted_at IS NOT NULL
+		AND EXISTS (SELECT 1 FROM user_favorites l
+			WHERE l.user_id = w.user_id AND l.product_id = ? AND l.source = w.source AND l.deleted_at IS NULL)`,
+		winnerID, source, loserID)
+	if stale.Error != nil {
+		return stale.Error
+	}
+
+	duplicates := tx.Exec(`DELETE FROM user_favorites l
+		WHERE l.product_id = ? AND l.source = ?
+		AND EXISTS (SELECT 1 FROM user_favorites w
+			WHERE w.user_id = l.user_id AND w.product_id = ? AND w.source = l.source)`,
+		loserID, source, winnerID)
+	if duplicates.Error != nil {
+		return duplicates.Error
+	}
+	result.Deduplicated["user_favorites"] = duplicates.RowsAffected
+
+	moved := tx.Unscoped().Model(&models.UserFavorite{}).
+		Where("product_id = ? AND source = ?", loserID, source).
+		UpdateColumn("product_id", winnerID)
+	if moved.Error != nil {
+		return moved.Error
+	}
+	result.Moved["user_favorites"] = moved.RowsAffected
+	return nil
+}
+
+// mergeNotificationHistory moves the loser's notification history to the
+// winner. A notification the user already got about the winner is kept
+// once, so it is still sent at most once.
+func mergeNotificationHistory(tx *gorm.DB, source string, winnerID, loserID uint, result *MergeResult) error {
+	duplicates := tx.Exec(`DELETE FROM notification_histories l
+		WHERE l.product_id = ? AND l.source = ?
+		AND EXISTS (SELECT 1 FROM notification_histories w
+			WHERE w.user_id = l.user_id AND w.product_id = ? AND w.source = l.source AND w.type = l.type)`,
+		loserID, source, winnerID)
+	if duplicates.Error != nil {
+		return duplicates.Error
+	}
+	result.Deduplicated["notification_histories"] = duplicates.RowsAffected
+
+	moved := tx.Model(&models.NotificationHistory{}).
+		Where("product_id = ? AND source = ?", loserID, source).
+		UpdateColumn("product_id", winnerID)
+	if moved.Error != nil {
+		return moved.Error
+	}
+	result.Moved["notification_histories"] = moved.RowsAffected
+	return nil
+}
+
+// productIDShared reports whether a product of another source uses the ID,
+// so rows keyed by the product ID alone cannot be told apart.
+func productIDShared(tx *gorm.DB, source string, productID uint) (bool, error) {
+	var count int64
+	err := tx.Unscoped().Model(&models.Product{}).Where("id = ? AND source <> ?", productID, source).Count(&count).Error
+	return count > 0, err
+}
+
+// registerMergeHandlers sets up the product merge endpoint. It requires the
+// API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - validate: Request validator
+func registerMergeHandlers(e *echo.Echo, db *gorm.DB, validate *validator.Validate) {
+	admin := e.Group("", requireAPIKey())
+
+	// POST /admin/products/merge
+	// Merges a duplicate product into the one that stays and returns the
+	// rows moved. Returns 404 if either product does not exist or is deleted.
+	// Request body: {"winner_id": uint, "loser_id": uint, "source": string}
+	admin.POST("/admin/products/merge", func(c echo.Context) error {
+		var req struct {
+			WinnerID uint   `json:"winner_id" validate:"required"` // Product that stays
+			LoserID  uint   `json:"loser_id" validate:"required"`  // Duplicate merged into it
+			Source   string `json:"source"`                        // Marketplace of both products (default: trendyol)
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		source, err := NormalizeSource(req.Source)
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		result, err := MergeProducts(db.WithContext(c.Request().Context()), source, req.WinnerID, req.LoserID)
+		switch {
+		case errors.Is(err, ErrMergeSameProduct):
+			return apierror.Invalid("winner_id and loser_id must differ")
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		case err != nil:
+			return apierror.Internal("Failed to merge products", err)
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,106 @@
+package crawler
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"scraper/internal/events"
+	"scraper/internal/models"
+)
+
+func TestMergeProducts(t *testing.T) {
+	db := openStressDB(t)
+	if err := db.AutoMigrate(&models.PriceStockLog{}, &models.NotificationHistory{}, &models.FetchRetry{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Where("product_id >= ?", stressBaseID).Delete(&models.PriceStockLog{})
+		db.Unscoped().Where("product_id >= ?", stressBaseID).Delete(&models.NotificationHistory{})
+		db.Unscoped().Where("product_id >= ?", stressBaseID).Delete(&models.FetchRetry{})
+	})
+
+	winner, loser := uint(stressBaseID), uint(stressBaseID+1)
+	both, loserOnly, returning := uint(stressBaseID), uint(stressBaseID+1), uint(stressBaseID+2)
+	source := models.SourceTrendyol
+	now := time.Now()
+	rows := []interface{}{
+		&models.Product{ID: winner, Source: source, Name: "winner", LocalFavoritesCount: 1},
+		&models.Product{ID: loser, Source: source, Name: "loser", IsFavorite: true, LocalFavoritesCount: 3,
+			OtherSellers: []byte(`{"barcode":"123"}`)},
+		&models.UserFavorite{UserID: both, ProductID: winner, Source: source, AddedAt: now},
+		&models.UserFavorite{UserID: both, ProductID: loser, Source: source, AddedAt: now},
+		&models.UserFavorite{UserID: loserOnly, ProductID: loser, Source: source, AddedAt: now},
+		&models.UserFavorite{UserID: returning, ProductID: winner, Source: source, AddedAt: now},
+		&models.UserFavorite{UserID: returning, ProductID: loser, Source: source, AddedAt: now},
+		&models.PriceStockLog{ProductID: loser, NewPrice: "10", ChangeTime: now},
+		&models.NotificationHistory{UserID: both, ProductID: winner, Source: source, Type: "discontinued", SentAt: now},
+		&models.NotificationHistory{UserID: both, ProductID: loser, Source: source, Type: "discontinued", SentAt: now},
+		&models.FetchRetry{ProductID: loser, ProductSource: source, Status: "pending", NextAttemptAt: now},
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The returning user removed the winner before favoriting the loser
+	db.Where("user_id = ? AND product_id = ?", returning, winner).Delete(&models.UserFavorite{})
+
+	result, err := MergeProducts(db, source, winner, loser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Moved["user_favorites"] != 2 || result.Deduplicated["user_favorites"] != 1 {
+		t.Errorf("favorites moved %d, deduplicated %d; want 2, 1", result.Moved["user_favorites"], result.Deduplicated["user_favorites"])
+	}
+	if result.Moved["price_stock_logs"] != 1 || result.Deduplicated["notification_histories"] != 1 || result.Deduplicated["fetch_retries"] != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if len(result.FilledColumns) != 1 || result.FilledColumns[0] != "other_sellers" {
+		t.Errorf("filled columns = %v, want [other_sellers]", result.FilledColumns)
+	}
+
+	var users []uint
+	db.Model(&models.UserFavorite{}).Where("product_id = ?", winner).Order("user_id").Pluck("user_id", &users)
+	if len(users) != 3 {
+		t.Errorf("winner favorited by %v, want all three users", users)
+	}
+	var left int64
+	db.Unscoped().Model(&models.UserFavorite{}).Where("product_id = ?", loser).Count(&left)
+	if left != 0 {
+		t.Errorf("%d favorites left on the loser", left)
+	}
+	checkLocalFavoritesCounts(t, db)
+
+	var merged models.Product
+	if err := db.Unscoped().Where("id = ? AND source = ?", loser, source).First(&merged).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !merged.DeletedAt.Valid || merged.MergedInto == nil || *merged.MergedInto != winner {
+		t.Errorf("loser deleted %v, merged into %v; want deleted and merged into %d", merged.DeletedAt.Valid, merged.MergedInto, winner)
+	}
+
+	if _, err := MergeProducts(db, source, winner, loser); err == nil {
+		t.Error("merging a merged product again succeeded")
+	}
+}
+
+func TestMergeQueuesSearchIndexUpdates(t *testing.T) {
+	viper.Set("SEARCH_INDEX_ENABLED", true)
+	t.Cleanup(func() { viper.Set("SEARCH_INDEX_ENABLED", nil) })
+	db := openPurgeDB(t, [][]driver.Value{{int64(1), "trendyol"}, {int64(2), "trendyol"}}, nil)
+
+	if _, err := MergeProducts(db, "trendyol", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	want := []events.ProductRef{{ID: 1, Source: "trendyol"}, {ID: 2, Source: "trendyol"}}
+	if got := searchIndexEvents(t); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("merge queued %v, want the winner and the loser", got)
+	}
+	if statements := purgeDB.statements; statements[len(statements)-1] != "COMMIT" {
+		t.Errorf("last statement = %q, want the event committed with the merge", statements[len(statements)-1])
+	}
+}
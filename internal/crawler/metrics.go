@@ -0,0 +1,105 @@
+// Package crawler implements the Prometheus metrics of the crawler service
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"scraper/internal/metrics"
+)
+
+// Trendyol endpoints in trendyol_requests_total
+const (
+	endpointProductDetail = "product_detail" // Product detail of FetchProductDetailsWithError
+	endpointSearchFeed    = "search_feed"    // Category listing of the /fetch crawl
+)
+
+// Results in kafka_messages_produced_total
+const (
+	produceSent   = "sent"
+	produceFailed = "failed"
+)
+
+// Crawler metrics
+var (
+	trendyolRequests = metrics.NewCounter(
+		"trendyol_requests_total",
+		"Requests to Trendyol by endpoint (product_detail, search_feed) and response status (\"error\" when no response was received)",
+		"endpoint", "status",
+	)
+	productDetailFetchDuration = metrics.NewHistogram(
+		"product_detail_fetch_duration_seconds",
+		"Seconds to fetch and decode a Trendyol product detail, failures included",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		time.Hour,
+	)
+	kafkaMessagesProduced = metrics.NewCounter(
+		"kafka_messages_produced_total",
+		"Kafka messages the crawler produced by topic and result (sent, failed)",
+		"topic", "result",
+	)
+	fetchJobDuration = metrics.NewHistogram(
+		"fetch_job_duration_seconds",
+		"Seconds a /fetch or /crawl job ran by mode (live, file) and final state (completed, failed)",
+		[]float64{1, 5, 15, 60, 300, 900, 1800, 3600, 7200, 14400},
+		24*time.Hour,
+		"mode", "state",
+	)
+)
+
+// responseStatus returns the status label of a Trendyol response: its HTTP
+// status code, or "error" when no response was received.
+func responseStatus(resp *http.Response, err error) string {
+	if err != nil || resp == nil {
+		return "error"
+	}
+	return strconv.Itoa(resp.StatusCode)
+}
+
+// countingProducer counts the messages handed to the real producer in
+// kafka_messages_produced_total
+type countingProducer struct {
+	sarama.SyncProducer
+}
+
+// countProduced wraps a producer so the messages it sends are counted.
+func countProduced(producer sarama.SyncProducer) sarama.SyncProducer {
+	return countingProducer{producer}
+}
+
+// SendMessage implements sarama.SyncProducer.
+func (p countingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	partition, offset, err := p.SyncProducer.SendMessage(msg)
+	result := produceSent
+	if err != nil {
+		result = produceFailed
+	}
+	kafkaMessagesProduced.Inc(msg.Topic, result)
+	return partition, offset, err
+}
+
+// SendMessages implements sarama.SyncProducer. Messages listed in the
+// returned sarama.ProducerErrors count as failed; any other error fails the
+// whole batch.
+func (p countingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	err := p.SyncProducer.SendMessages(msgs)
+	failed := make(map[*sarama.ProducerMessage]bool)
+	var errs sarama.ProducerErrors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			failed[e.Msg] = true
+		}
+	}
+	for _, msg := range msgs {
+		result := produceSent
+		if failed[msg] || (err != nil && errs == nil) {
+			result = produceFailed
+		}
+		kafkaMessagesProduced.Inc(msg.Topic, result)
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package crawler
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/labstack/echo/v4"
+
+	"scraper/internal/metrics"
+)
+
+// scrapeMetrics serves GET /metrics through e and returns the value of every
+// series by its name and labels.
+func scrapeMetrics(t *testing.T, e *echo.Echo) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", rec.Code)
+	}
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("parse %q: %v", line, err)
+		}
+		series[line[:i]] = value
+	}
+	return series
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	detail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("contentId") == "2" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer detail.Close()
+	savedURL := productDetailURL
+	productDetailURL = detail.URL + "/?contentId=%d"
+	defer func() { productDetailURL = savedURL }()
+
+	e := echo.New()
+	e.Use(metrics.Middleware("crawler"))
+	e.GET("/metrics", metrics.Handler)
+	e.GET("/products/:id", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusNotFound)
+	})
+	before := scrapeMetrics(t, e)
+
+	// Simulated activity: a fetched product, a failed one, a sent and a
+	// failed message and a handled request
+	if _, err := FetchProductDetailsWithError(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchProductDetailsWithError(context.Background(), 2); err == nil {
+		t.Fatal("fetch of product 2 succeeded, want the 503")
+	}
+	msg := &sarama.ProducerMessage{Topic: "products", Value: sarama.StringEncoder("{}")}
+	countProduced(&recordingProducer{}).SendMessage(msg)
+	countProduced(&recordingProducer{fail: true}).SendMessage(msg)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/products/7", nil))
+
+	after := scrapeMetrics(t, e)
+	for series, want := range map[string]float64{
+		`trendyol_requests_total{endpoint="product_detail",status="200"}`:                                        1,
+		`trendyol_requests_total{endpoint="product_detail",status="503"}`:                                        1,
+		`product_detail_fetch_duration_seconds_count`:                                                            2,
+		`kafka_messages_produced_total{topic="products",result="sent"}`:                                          1,
+		`kafka_messages_produced_total{topic="products",result="failed"}`:                                        1,
+		`http_request_duration_seconds_count{service="crawler",method="GET",route="/products/:id",status="404"}`: 1,
+	} {
+		if got := after[series] - before[series]; got != want {
+			t.Errorf("%s increased by %g, want %g", series, got, want)
+		}
+	}
+}
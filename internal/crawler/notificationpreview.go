@@ -0,0 +1,143 @@
+// Package crawler implements the preview of the notifications a price change
+// would trigger
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+	"scraper/internal/notification"
+	"scraper/internal/pricealert"
+	"scraper/internal/pricing"
+)
+
+// NotificationPreview is the response of GET /admin/notifications/preview
+type NotificationPreview struct {
+	ProductID  uint                  `json:"product_id"`
+	Source     string                `json:"source"`
+	OldPrice   float64               `json:"old_price"`             // Stored price of the product
+	NewPrice   float64               `json:"new_price"`             // Price the preview drops it to
+	DealScore  *float64              `json:"deal_score"`            // Deal score of the new price; null for sparse history
+	DropReason string                `json:"drop_reason,omitempty"` // Why the change notifies nobody; every user is skipped with it
+	Counts     map[string]int        `json:"counts"`                // Users by decision status
+	Recipients []pricealert.Decision `json:"recipients"`            // Users who would get the notification, with the channel
+	Skipped    []pricealert.Decision `json:"skipped"`               // Users who would not, with the reason
+}
+
+// PreviewNotifications decides who would be notified if a product's price
+// changed, through the same pricealert stages as a real price change, and
+// writes nothing: the deal score is computed but not stored, and snoozed
+// notifications are not held back.
+//
+// Parameters:
+//   - db: Database connection
+//   - productID: Product whose price changes
+//   - source: Marketplace of the product
+//   - newPrice: Price after the change
+//   - bypassMinDrop: Skip the minimum-drop floors, like simulated drops
+//
+// Returns:
+//   - NotificationPreview: The decision for every user who favorited the product
+//   - error: gorm.ErrRecordNotFound if the product does not exist, or any
+//     database error
+func PreviewNotifications(db *gorm.DB, productID uint, source string, newPrice float64, bypassMinDrop bool) (NotificationPreview, error) {
+	var product models.Product
+	if err := db.Select("id", "source", "price").Where("id = ? AND source = ?", productID, source).First(&product).Error; err != nil {
+		return NotificationPreview{}, err
+	}
+	score, err := pricing.DealScore(db, productID, source, newPrice)
+	if err != nil {
+		return NotificationPreview{}, err
+	}
+	var userIDs []uint
+	if err := db.Model(&models.UserFavorite{}).Where("product_id = ? AND source = ?", productID, source).
+		Order("user_id").Pluck("user_id", &userIDs).Error; err != nil {
+		return NotificationPreview{}, err
+	}
+	users, err := pricealert.LoadUsers(db, userIDs)
+	if err != nil {
+		return NotificationPreview{}, err
+	}
+	now := time.Now()
+	if err := pricealert.MarkFavorites(db, users, productID, source, now); err != nil {
+		return NotificationPreview{}, err
+	}
+
+	change := pricealert.Change{OldPrice: product.Price, NewPrice: newPrice, BypassMinDrop: bypassMinDrop, DealScore: score}
+	preview := NotificationPreview{
+		ProductID:  productID,
+		Source:     source,
+		OldPrice:   product.Price,
+		NewPrice:   newPrice,
+		DealScore:  score,
+		DropReason: pricealert.DropReason(change),
+		Counts:     make(map[string]int),
+		Recipients: []pricealert.Decision{},
+		Skipped:    []pricealert.Decision{},
+	}
+	for _, user := range users {
+		decision := pricealert.Decide(change, user, now, notification.HoldBackInDryRun)
+		preview.Counts[decision.Status]++
+		if decision.Status == pricealert.StatusSkipped {
+			preview.Skipped = append(preview.Skipped, decision)
+		} else {
+			preview.Recipients = append(preview.Recipients, decision)
+		}
+	}
+	return preview, nil
+}
+
+// registerNotificationPreviewHandlers sets up the notification preview
+// endpoint. It is read-only and requires the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerNotificationPreviewHandlers(e *echo.Echo, db *gorm.DB) {
+	admin := e.Group("", requireAPIKey())
+
+	// GET /admin/notifications/preview
+	// Lists who would be notified, and through which channel, if a product's
+	// price changed to new_price, and why everyone else would not be
+	// Query parameters:
+	//   - product_id: Product whose price changes (required)
+	//   - new_price: Price after the change (required)
+	//   - source: Marketplace of the product (default trendyol)
+	//   - bypass_min_drop: Skip the minimum-drop floors like a simulation (default false)
+	admin.GET("/admin/notifications/preview", func(c echo.Context) error {
+		productID, err := models.ParseProductID(c.QueryParam("product_id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		newPrice, err := strconv.ParseFloat(c.QueryParam("new_price"), 64)
+		if err != nil || newPrice < 0 {
+			return apierror.Invalid("Invalid new price")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+		bypass := false
+		if value := c.QueryParam("bypass_min_drop"); value != "" {
+			if bypass, err = strconv.ParseBool(value); err != nil {
+				return apierror.Invalid("Invalid bypass_min_drop")
+			}
+		}
+
+		preview, err := PreviewNotifications(db, productID, source, newPrice, bypass)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
+		if err != nil {
+			return apierror.Internal("Failed to preview notifications", err)
+		}
+		return c.JSON(http.StatusOK, preview)
+	})
+}
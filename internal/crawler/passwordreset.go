@@ -0,0 +1,243 @@
+// Package crawler implements the password reset flow: an emailed one-time
+// token that lets a user set a new password
+package crawler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/auth"
+	"scraper/internal/emailaddr"
+	"scraper/internal/models"
+	"scraper/internal/notification"
+)
+
+// ErrInvalidResetToken is returned for a password reset token that is
+// unknown, expired or already used
+var ErrInvalidResetToken = errors.New("password reset token is invalid or expired")
+
+// passwordResetTTL returns how long a password reset token is valid.
+//
+// Environment Variables:
+//   - PASSWORD_RESET_TTL: Token lifetime (default: 1h)
+func passwordResetTTL() time.Duration {
+	ttl := viper.GetDuration("PASSWORD_RESET_TTL")
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return ttl
+}
+
+// passwordResetLink returns the link of the page where a user sets a new
+// password with the token.
+//
+// Environment Variables:
+//   - PUBLIC_BASE_URL: Base URL of the web app (default: http://localhost:8080)
+func passwordResetLink(token string) string {
+	base := strings.TrimRight(viper.GetString("PUBLIC_BASE_URL"), "/")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return base + "/password-reset?token=" + url.QueryEscape(token)
+}
+
+// hashResetToken returns the hex SHA-256 of a token, the form it is stored in.
+func hashResetToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// RequestPasswordReset issues a password reset token for the active user
+// with the email address. Earlier unused tokens of the user stop working.
+//
+// Parameters:
+//   - db: Database connection
+//   - email: Email address as entered; compared like at registration
+//
+// Returns:
+//   - string: The token, empty if no active user has the address
+//   - models.User: The user the token is for
+//   - time.Time: When the token expires
+//   - error: Any database error
+func RequestPasswordReset(db *gorm.DB, email string) (string, models.User, time.Time, error) {
+	var user models.User
+	err := db.Where("lower(email) = ?", emailaddr.Key(email)).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !user.IsActive) {
+		return "", models.User{}, time.Time{}, nil
+	}
+	if err != nil {
+		return "", models.User{}, time.Time{}, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", models.User{}, time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	expiresAt := now.Add(passwordResetTTL())
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			UpdateColumn("used_at", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashResetToken(token),
+			ExpiresAt: expiresAt,
+		}).Error
+	})
+	if err != nil {
+		return "", models.User{}, time.Time{}, err
+	}
+	user.Password = ""
+	return token, user, expiresAt, nil
+}
+
+// ConfirmPasswordReset sets a new password with a reset token and marks the
+// token as used, so it works only once.
+//
+// Parameters:
+//   - db: Database connection
+//   - token: The token from the reset email
+//   - password: The new password
+//
+// Returns:
+//   - uint: The user whose password changed
+//   - error: ErrInvalidResetToken for an unknown, expired or used token, or
+//     any database or hashing error
+func ConfirmPasswordReset(db *gorm.DB, token, password string) (uint, error) {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var userID uint
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Lock the token so two confirmations cannot both use it
+		var reset models.PasswordResetToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashResetToken(token)).
+			First(&reset).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if reset.UsedAt != nil || !now.Before(reset.ExpiresAt) {
+			return ErrInvalidResetToken
+		}
+
+		// A user deleted since the request cannot reset the password
+		result := tx.Model(&models.User{}).Where("id = ?", reset.UserID).Update("password", hash)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+		userID = reset.UserID
+		return tx.Model(&reset).UpdateColumn("used_at", now).Error
+	})
+	return userID, err
+}
+
+// registerPasswordResetHandlers sets up the password reset endpoints. Both
+// are public: the emailed token is what proves the user's identity.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - validate: Request validator
+func registerPasswordResetHandlers(e *echo.Echo, db *gorm.DB, validate *validator.Validate) {
+	emailService := notification.NewEmailService(db)
+
+	// POST /password-reset/request
+	// Emails a reset link to the user with the address. Always returns 200,
+	// whether or not the address belongs to an active user, so the endpoint
+	// cannot be used to find out which addresses have accounts.
+	// Request body: {"email": string}
+	e.POST("/password-reset/request", func(c echo.Context) error {
+		var req struct {
+			Email string `json:"email" validate:"required,mailbox"` // Address of the account
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		req.Email = emailaddr.Normalize(req.Email)
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+
+		token, user, expiresAt, err := RequestPasswordReset(db.WithContext(c.Request().Context()), req.Email)
+		if err != nil {
+			return apierror.Internal("Failed to request password reset", err)
+		}
+		if token != "" {
+			// Sent in the background, so the response takes as long for
+			// unknown addresses
+			go func() {
+				if err := emailService.SendPasswordReset(user, passwordResetLink(token), expiresAt); err != nil {
+					logrus.WithError(err).WithField("user_id", user.ID).Error("Failed to send password reset email")
+					return
+				}
+				logrus.WithField("user_id", user.ID).Info("Password reset email sent")
+			}()
+		} else {
+			logrus.Info("Password reset requested for an unknown or inactive address")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"status": "If the address belongs to an account, a reset link has been sent"})
+	})
+
+	// POST /password-reset/confirm
+	// Sets a new password with the token from the reset email. Returns 204,
+	// or 400 if the token is unknown, expired or already used.
+	// Request body: {"token": string, "new_password": string}
+	e.POST("/password-reset/confirm", func(c echo.Context) error {
+		var req struct {
+			Token       string `json:"token" validate:"required"`              // Token from the reset link
+			NewPassword string `json:"new_password" validate:"required,min=6"` // New password (min 6 chars, at most 72 bytes)
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		// bcrypt ignores bytes beyond its limit, so longer passwords are rejected
+		if len(req.NewPassword) > auth.MaxPasswordLength {
+			return apierror.Invalid(fmt.Sprintf("new_password must be at most %d bytes", auth.MaxPasswordLength))
+		}
+
+		userID, err := ConfirmPasswordReset(db.WithContext(c.Request().Context()), req.Token, req.NewPassword)
+		switch {
+		case errors.Is(err, ErrInvalidResetToken):
+			return apierror.Invalid("Password reset token is invalid or expired")
+		case err != nil:
+			return apierror.Internal("Failed to reset password", err)
+		}
+
+		logrus.WithField("user_id", userID).Info("Password reset")
+		return c.NoContent(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,68 @@
+package crawler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"scraper/internal/auth"
+	"scraper/internal/models"
+)
+
+func TestPasswordReset(t *testing.T) {
+	db := openStressDB(t)
+	if err := db.AutoMigrate(&models.PasswordResetToken{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Where("user_id >= ?", stressBaseID).Delete(&models.PasswordResetToken{})
+	})
+
+	userID := uint(stressBaseID)
+	if err := db.Create(&models.User{Model: gorm.Model{ID: userID}, Email: "reset@example.test", IsActive: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, _, err := RequestPasswordReset(db, "nobody@example.test")
+	if err != nil || token != "" {
+		t.Fatalf("unknown address: token = %q, err = %v; want no token", token, err)
+	}
+
+	replaced, _, _, err := RequestPasswordReset(db, "Reset@Example.test")
+	if err != nil || replaced == "" {
+		t.Fatalf("first request: token = %q, err = %v", replaced, err)
+	}
+	token, user, _, err := RequestPasswordReset(db, "reset@example.test")
+	if err != nil || token == "" || user.ID != userID {
+		t.Fatalf("second request: token = %q, user = %d, err = %v", token, user.ID, err)
+	}
+	if _, err := ConfirmPasswordReset(db, replaced, "secret1"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("replaced token: err = %v, want ErrInvalidResetToken", err)
+	}
+
+	if _, err := ConfirmPasswordReset(db, token, "secret2"); err != nil {
+		t.Fatal(err)
+	}
+	var stored models.User
+	if err := db.First(&stored, userID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !auth.CheckPassword(stored.Password, "secret2") {
+		t.Error("password was not changed")
+	}
+	if _, err := ConfirmPasswordReset(db, token, "secret3"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("reused token: err = %v, want ErrInvalidResetToken", err)
+	}
+
+	expired, _, _, err := RequestPasswordReset(db, "reset@example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&models.PasswordResetToken{}).Where("token_hash = ?", hashResetToken(expired)).
+		UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+	if _, err := ConfirmPasswordReset(db, expired, "secret4"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("expired token: err = %v, want ErrInvalidResetToken", err)
+	}
+}
@@ -0,0 +1,328 @@
+// Package crawler implements the size guards of the JSONB columns written
+// for a product
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/metrics"
+	"scraper/internal/models"
+)
+
+// Actions taken on a JSONB field over its limit
+const (
+	payloadTruncated = "truncated" // Trailing array elements or the largest object members were removed
+	payloadDropped   = "dropped"   // The field could not be shortened and was cleared
+)
+
+// defaultPayloadFieldLimit is the per-field byte limit when
+// PAYLOAD_FIELD_MAX_BYTES is not set
+const defaultPayloadFieldLimit = 64 << 10
+
+// Limits of GET /admin/products/largest
+const (
+	defaultLargestProductsLimit = 20
+	maxLargestProductsLimit     = 100
+)
+
+// Payload size metrics
+var (
+	payloadBytes = metrics.NewHistogram(
+		"product_payload_bytes",
+		"Size of the JSONB fields of converted products by field, before any truncation",
+		[]float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20},
+		time.Hour,
+		"field",
+	)
+	payloadGuarded = metrics.NewCounter(
+		"product_payload_truncations_total",
+		"JSONB fields over their byte limit by field and action (truncated, dropped)",
+		"field", "action",
+	)
+)
+
+// PayloadLimits are the byte limits of a product's JSONB fields, keyed by
+// column
+type PayloadLimits map[string]int
+
+// payloadFields returns the JSONB fields of a product, keyed by column.
+func payloadFields(p *models.Product) map[string]*datatypes.JSON {
+	return map[string]*datatypes.JSON{
+		"images":             &p.Images,
+		"seller":             &p.Seller,
+		"brand":              &p.Brand,
+		"rating_score":       &p.RatingScore,
+		"top_reviews":        &p.TopReviews,
+		"estimated_delivery": &p.EstimatedDelivery,
+		"stock_info":         &p.StockInfo,
+		"price_info":         &p.PriceInfo,
+		"similar_products":   &p.SimilarProducts,
+		"attributes":         &p.Attributes,
+		"other_sellers":      &p.OtherSellers,
+	}
+}
+
+// LoadPayloadLimits reads the byte limits of the JSONB fields.
+//
+// Environment Variables:
+//   - PAYLOAD_FIELD_MAX_BYTES: Limit of every JSONB field (default: 65536)
+//   - PAYLOAD_FIELD_LIMITS: Comma-separated column=bytes overrides, e.g.
+//     "similar_products=16384,top_reviews=32768"
+//
+// Returns:
+//   - PayloadLimits: Limit of every JSONB column
+func LoadPayloadLimits() PayloadLimits {
+	limit := viper.GetInt("PAYLOAD_FIELD_MAX_BYTES")
+	if limit <= 0 {
+		limit = defaultPayloadFieldLimit
+	}
+	limits := make(PayloadLimits)
+	for column := range payloadFields(&models.Product{}) {
+		limits[column] = limit
+	}
+
+	for _, entry := range strings.Split(viper.GetString("PAYLOAD_FIELD_LIMITS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		column, raw, _ := strings.Cut(entry, "=")
+		column = strings.TrimSpace(column)
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if _, known := limits[column]; !known || err != nil || n <= 0 {
+			logrus.WithField("entry", entry).Warn("Ignoring invalid PAYLOAD_FIELD_LIMITS entry")
+			continue
+		}
+		limits[column] = n
+	}
+	return limits
+}
+
+// GuardPayload keeps every JSONB field of a product within its limit and
+// records the field sizes. A field over its limit is shortened: an array
+// keeps its leading elements and an object drops its largest members until
+// it fits, while other values and invalid JSON are cleared. The result is
+// always valid JSON. Products with a shortened field get PayloadTruncated
+// set.
+//
+// Parameters:
+//   - p: Converted product, shortened in place
+//   - limits: Byte limit of each column; columns without one are left alone
+func GuardPayload(p *models.Product, limits PayloadLimits) {
+	for column, field := range payloadFields(p) {
+		if len(*field) == 0 {
+			continue
+		}
+		payloadBytes.Observe(float64(len(*field)), column)
+		limit, ok := limits[column]
+		if !ok || len(*field) <= limit {
+			continue
+		}
+
+		shortened, ok := truncateJSON(*field, limit)
+		action := payloadTruncated
+		if !ok {
+			shortened, action = nil, payloadDropped
+		}
+		logrus.WithFields(logrus.Fields{
+			"id":     p.ID,
+			"field":  column,
+			"bytes":  len(*field),
+			"limit":  limit,
+			"action": action,
+		}).Warn("Product field over its size limit")
+		payloadGuarded.Inc(column, action)
+		*field = datatypes.JSON(shortened)
+		p.PayloadTruncated = true
+	}
+}
+
+// truncateJSON shortens a JSON array or object to at most limit bytes.
+//
+// Parameters:
+//   - data: JSON document
+//   - limit: Maximum size in bytes
+//
+// Returns:
+//   - []byte: The compacted, shortened document
+//   - bool: False if data is not a valid array or object, or even its empty
+//     form does not fit
+func truncateJSON(data []byte, limit int) ([]byte, bool) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil || compact.Len() < 2 || limit < 2 {
+		return nil, false
+	}
+	if compact.Len() <= limit {
+		return compact.Bytes(), true
+	}
+
+	switch compact.Bytes()[0] {
+	case '[':
+		var elements []json.RawMessage
+		if err := json.Unmarshal(compact.Bytes(), &elements); err != nil {
+			return nil, false
+		}
+		// Keep the leading elements that fit
+		return joinJSON('[', ']', elements[:fitting(elements, limit)]), true
+
+	case '{':
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(compact.Bytes(), &object); err != nil {
+			return nil, false
+		}
+		encoded := make([]json.RawMessage, 0, len(object))
+		for key, value := range object {
+			name, err := json.Marshal(key)
+			if err != nil {
+				return nil, false
+			}
+			encoded = append(encoded, append(append(name, ':'), value...))
+		}
+		// Drop the largest members first; ties go by key so the result is stable
+		sort.Slice(encoded, func(i, j int) bool {
+			if len(encoded[i]) != len(encoded[j]) {
+				return len(encoded[i]) < len(encoded[j])
+			}
+			return bytes.Compare(encoded[i], encoded[j]) < 0
+		})
+		kept := encoded[:fitting(encoded, limit)]
+		sort.Slice(kept, func(i, j int) bool { return bytes.Compare(kept[i], kept[j]) < 0 })
+		return joinJSON('{', '}', kept), true
+	}
+	return nil, false
+}
+
+// fitting returns how many leading parts fit within limit bytes once joined
+// with commas between two brackets.
+func fitting(parts []json.RawMessage, limit int) int {
+	size := 2
+	for i, part := range parts {
+		size += len(part)
+		if i > 0 {
+			size++
+		}
+		if size > limit {
+			return i
+		}
+	}
+	return len(parts)
+}
+
+// joinJSON writes encoded elements or members between two brackets.
+func joinJSON(start, end byte, parts []json.RawMessage) []byte {
+	var out bytes.Buffer
+	out.WriteByte(start)
+	for i, part := range parts {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		out.Write(part)
+	}
+	out.WriteByte(end)
+	return out.Bytes()
+}
+
+// LargePayloadProduct is a row of the largest products report
+type LargePayloadProduct struct {
+	ID               uint             `json:"id"`
+	Source           string           `json:"source"`
+	Name             string           `json:"name"`
+	PayloadTruncated bool             `json:"payload_truncated"` // A field was shortened when the product was last converted
+	TotalBytes       int64            `json:"total_bytes"`       // Size of all JSONB fields
+	Fields           map[string]int64 `json:"fields"`            // Size of each JSONB field, keyed by column
+}
+
+// LargestPayloads returns the products whose JSONB fields take the most
+// space, measured as the length of their JSON text. It reads every product,
+// so it is meant for occasional operator use.
+//
+// Parameters:
+//   - db: Database connection
+//   - limit: Products to return
+//
+// Returns:
+//   - []LargePayloadProduct: The products, largest first
+//   - error: Any database error
+func LargestPayloads(db *gorm.DB, limit int) ([]LargePayloadProduct, error) {
+	columns := make([]string, 0, len(payloadFields(&models.Product{})))
+	for column := range payloadFields(&models.Product{}) {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	sizes := make([]string, len(columns))
+	for i, column := range columns {
+		sizes[i] = fmt.Sprintf("COALESCE(octet_length(%s::text), 0)", column)
+	}
+	query := fmt.Sprintf(`SELECT id, source, name, payload_truncated, %s AS total_bytes, %s
+	FROM products WHERE deleted_at IS NULL
+	ORDER BY total_bytes DESC, id, source LIMIT ?`, strings.Join(sizes, " + "), strings.Join(sizes, ", "))
+
+	rows, err := db.Raw(query, limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []LargePayloadProduct{}
+	for rows.Next() {
+		p := LargePayloadProduct{Fields: make(map[string]int64, len(columns))}
+		fieldSizes := make([]int64, len(columns))
+		dest := []interface{}{&p.ID, &p.Source, &p.Name, &p.PayloadTruncated, &p.TotalBytes}
+		for i := range fieldSizes {
+			dest = append(dest, &fieldSizes[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, column := range columns {
+			p.Fields[column] = fieldSizes[i]
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+// registerPayloadSizeHandlers sets up the largest products report. It
+// requires the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerPayloadSizeHandlers(e *echo.Echo, db *gorm.DB) {
+	admin := e.Group("", requireAPIKey())
+
+	// GET /admin/products/largest
+	// Lists the products with the largest JSONB fields, with the size of
+	// each field and whether one was truncated
+	// Query parameters:
+	//   - limit: Products to list, 1-100 (default 20)
+	admin.GET("/admin/products/largest", func(c echo.Context) error {
+		limit := defaultLargestProductsLimit
+		if raw := c.QueryParam("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxLargestProductsLimit {
+				return apierror.Invalid(fmt.Sprintf("limit must be between 1 and %d", maxLargestProductsLimit))
+			}
+			limit = n
+		}
+		products, err := LargestPayloads(db.WithContext(c.Request().Context()), limit)
+		if err != nil {
+			return apierror.Internal("Failed to load the largest products", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"products": products})
+	})
+}
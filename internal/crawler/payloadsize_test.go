@@ -0,0 +1,84 @@
+package crawler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gorm.io/datatypes"
+
+	"scraper/internal/models"
+)
+
+func TestTruncateJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		limit int
+		want  string
+		ok    bool
+	}{
+		{"fits", `[1, 2, 3]`, 20, `[1,2,3]`, true},
+		{"array prefix", `[10,20,30,40]`, 9, `[10,20]`, true},
+		{"array empty", `["long value"]`, 5, `[]`, true},
+		{"object drops largest", `{"a":1,"b":"long text","c":2}`, 16, `{"a":1,"c":2}`, true},
+		{"escaped strings", `["a\"b<c>","çok uzun bir metin"]`, 14, `["a\"b<c>"]`, true},
+		{"string", `"` + strings.Repeat("x", 50) + `"`, 10, "", false},
+		{"invalid", `[1, 2`, 10, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := truncateJSON([]byte(tt.data), tt.limit)
+		if ok != tt.ok || string(got) != tt.want {
+			t.Errorf("%s: truncateJSON = %s, %v; want %s, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+		if ok && (len(got) > tt.limit || !json.Valid(got)) {
+			t.Errorf("%s: result %s is invalid or over %d bytes", tt.name, got, tt.limit)
+		}
+	}
+}
+
+func TestGuardPayload(t *testing.T) {
+	viper.Set("PAYLOAD_FIELD_MAX_BYTES", 64)
+	viper.Set("PAYLOAD_FIELD_LIMITS", "similar_products=16, unknown=5")
+	t.Cleanup(func() {
+		viper.Set("PAYLOAD_FIELD_MAX_BYTES", nil)
+		viper.Set("PAYLOAD_FIELD_LIMITS", nil)
+	})
+	limits := LoadPayloadLimits()
+	if limits["similar_products"] != 16 || limits["images"] != 64 {
+		t.Fatalf("limits = %v", limits)
+	}
+
+	truncated := payloadGuarded.Value("similar_products", payloadTruncated)
+	dropped := payloadGuarded.Value("top_reviews", payloadDropped)
+	p := models.Product{
+		ID:              1,
+		Images:          datatypes.JSON(`["a.jpg","b.jpg"]`),
+		SimilarProducts: datatypes.JSON(`[{"id":1},{"id":2},{"id":3}]`),
+		TopReviews:      datatypes.JSON(`"` + strings.Repeat("x", 100) + `"`),
+	}
+	GuardPayload(&p, limits)
+
+	if !p.PayloadTruncated {
+		t.Error("PayloadTruncated not set")
+	}
+	if string(p.Images) != `["a.jpg","b.jpg"]` {
+		t.Errorf("images = %s, want them unchanged", p.Images)
+	}
+	if string(p.SimilarProducts) != `[{"id":1}]` {
+		t.Errorf("similar_products = %s, want the first product", p.SimilarProducts)
+	}
+	if p.TopReviews != nil {
+		t.Errorf("top_reviews = %s, want it dropped", p.TopReviews)
+	}
+	if payloadGuarded.Value("similar_products", payloadTruncated) != truncated+1 || payloadGuarded.Value("top_reviews", payloadDropped) != dropped+1 {
+		t.Error("truncations were not counted")
+	}
+
+	small := models.Product{ID: 2, Images: datatypes.JSON(`[]`)}
+	GuardPayload(&small, limits)
+	if small.PayloadTruncated {
+		t.Error("PayloadTruncated set on a product within the limits")
+	}
+}
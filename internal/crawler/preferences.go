@@ -0,0 +1,310 @@
+// Package crawler implements the user notification preference endpoints
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// NotificationPreferences is the notification part of a user's preferences
+type NotificationPreferences struct {
+	Snoozed      bool       `json:"snoozed"`        // Whether notifications are currently held back
+	SnoozedUntil *time.Time `json:"snoozed_until"`  // When the snooze ends, null when not snoozed
+	Missed       int64      `json:"missed"`         // Notifications held back so far, summarized when the snooze ends
+	MinDealScore *float64   `json:"min_deal_score"` // Only price drops with at least this deal score notify, null for every drop
+}
+
+// DigestPreferences is the daily digest part of a user's preferences
+type DigestPreferences struct {
+	GroupByCollection bool `json:"group_by_collection"` // Include favorite price drops, grouped by collection
+}
+
+// Preferences is the response of GET /users/:id/preferences
+type Preferences struct {
+	UserID        uint                    `json:"user_id"`       // User the preferences belong to
+	Notifications NotificationPreferences `json:"notifications"` // Notification settings
+	Digest        DigestPreferences       `json:"digest"`        // Daily digest settings
+}
+
+// maxSnoozeDuration returns the longest snooze a user may request.
+//
+// Environment Variables:
+//   - SNOOZE_MAX_DURATION: Longest allowed snooze (default: 2160h, 90 days)
+func maxSnoozeDuration() time.Duration {
+	limit := viper.GetDuration("SNOOZE_MAX_DURATION")
+	if limit <= 0 {
+		limit = 90 * 24 * time.Hour
+	}
+	return limit
+}
+
+// parseSnoozeDuration parses a Go duration such as "36h", or a whole number
+// of days such as "14d".
+func parseSnoozeDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// GetPreferences returns a user's preferences. A snooze that has already
+// ended is reported as not snoozed.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to look up
+//
+// Returns:
+//   - Preferences: The user's preferences
+//   - error: gorm.ErrRecordNotFound if the user does not exist, or any
+//     database error
+func GetPreferences(db *gorm.DB, userID uint) (Preferences, error) {
+	prefs := Preferences{UserID: userID}
+
+	var user models.User
+	if err := db.Select("id", "notifications_snoozed_until", "digest_group_by_collection", "min_deal_score").First(&user, userID).Error; err != nil {
+		return prefs, err
+	}
+	prefs.Digest.GroupByCollection = user.DigestGroupByCollection
+	prefs.Notifications.MinDealScore = user.MinDealScore
+	if until := user.NotificationsSnoozedUntil; until != nil && until.After(time.Now()) {
+		prefs.Notifications.Snoozed = true
+		prefs.Notifications.SnoozedUntil = until
+	}
+	if err := db.Model(&models.SuppressedNotification{}).Where("user_id = ?", userID).Count(&prefs.Notifications.Missed).Error; err != nil {
+		return prefs, err
+	}
+	return prefs, nil
+}
+
+// SnoozeNotifications holds back a user's notifications until the given
+// time. Calling it again replaces the previous snooze.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to snooze
+//   - until: When notifications resume; nil cancels the snooze
+//
+// Returns:
+//   - error: gorm.ErrRecordNotFound if the user does not exist, or any
+//     database error
+func SnoozeNotifications(db *gorm.DB, userID uint, until *time.Time) error {
+	result := db.Model(&models.User{}).Where("id = ?", userID).Update("notifications_snoozed_until", until)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "until": until}).Info("Notification snooze changed")
+	return nil
+}
+
+// SetDigestGroupByCollection turns the favorites section of a user's daily
+// digest on or off.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to update
+//   - enabled: Whether favorite drops are added to the digest by collection
+//
+// Returns:
+//   - error: gorm.ErrRecordNotFound if the user does not exist, or any
+//     database error
+func SetDigestGroupByCollection(db *gorm.DB, userID uint, enabled bool) error {
+	result := db.Model(&models.User{}).Where("id = ?", userID).Update("digest_group_by_collection", enabled)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// SetMinDealScore sets the deal score a price drop needs to notify a user.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to update
+//   - minimum: Minimum deal score from 0 to 100; nil notifies about every drop
+//
+// Returns:
+//   - error: gorm.ErrRecordNotFound if the user does not exist, or any
+//     database error
+func SetMinDealScore(db *gorm.DB, userID uint, minimum *float64) error {
+	result := db.Model(&models.User{}).Where("id = ?", userID).Update("min_deal_score", minimum)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// registerPreferenceHandlers sets up the user preference endpoints:
+// - Reading a user's preferences
+// - Changing the notification and daily digest settings
+// - Snoozing notifications and cancelling a snooze
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - validate: Request validator
+func registerPreferenceHandlers(e *echo.Echo, db *gorm.DB, validate *validator.Validate) {
+	// respond writes the user's preferences after a change
+	respond := func(c echo.Context, userID uint) error {
+		prefs, err := GetPreferences(db, userID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+		}
+		if err != nil {
+			return apierror.Internal("Failed to load preferences", err)
+		}
+		return c.JSON(http.StatusOK, prefs)
+	}
+
+	// GET /users/:id/preferences
+	// Returns the user's notification preferences, including any snooze
+	e.GET("/users/:id/preferences", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		return respond(c, uint(userID))
+	})
+
+	// PATCH /users/:id/preferences/notifications
+	// Changes the notification settings
+	// Request body: {"min_deal_score": float64}; null or omitted notifies
+	// about every price drop
+	e.PATCH("/users/:id/preferences/notifications", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		var req struct {
+			MinDealScore *float64 `json:"min_deal_score" validate:"omitempty,min=0,max=100"` // Minimum deal score of a notifying drop
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+
+		if err := SetMinDealScore(db, uint(userID), req.MinDealScore); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+			}
+			return apierror.Internal("Failed to update notification preferences", err)
+		}
+		return respond(c, uint(userID))
+	})
+
+	// PATCH /users/:id/preferences/digest
+	// Changes the daily digest settings
+	// Request body: {"group_by_collection": bool}
+	e.PATCH("/users/:id/preferences/digest", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		var req struct {
+			GroupByCollection *bool `json:"group_by_collection" validate:"required"` // Add favorite drops grouped by collection
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+
+		if err := SetDigestGroupByCollection(db, uint(userID), *req.GroupByCollection); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+			}
+			return apierror.Internal("Failed to update digest preferences", err)
+		}
+		return respond(c, uint(userID))
+	})
+
+	// POST /users/:id/notifications/snooze
+	// Holds back the user's notifications for a while. What they miss is
+	// summarized in one email when the snooze ends.
+	// Request body: {"duration": "14d"} or {"until": "2024-08-01T00:00:00Z"}
+	e.POST("/users/:id/notifications/snooze", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		var req struct {
+			Duration string     `json:"duration" validate:"required_without=Until,excluded_with=Until"` // Go duration or whole days, e.g. "14d"
+			Until    *time.Time `json:"until" validate:"required_without=Duration"`                     // RFC 3339 end of the snooze
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+
+		now := time.Now()
+		until := req.Until
+		if req.Duration != "" {
+			duration, err := parseSnoozeDuration(req.Duration)
+			if err != nil || duration <= 0 {
+				return apierror.Invalid("duration must be a positive duration such as 36h or 14d")
+			}
+			end := now.Add(duration)
+			until = &end
+		}
+		if !until.After(now) {
+			return apierror.Invalid("until must be in the future")
+		}
+		if until.Sub(now) > maxSnoozeDuration() {
+			return apierror.Invalid("Snooze cannot be longer than " + maxSnoozeDuration().String())
+		}
+
+		if err := SnoozeNotifications(db, uint(userID), until); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+			}
+			return apierror.Internal("Failed to snooze notifications", err)
+		}
+		return respond(c, uint(userID))
+	})
+
+	// DELETE /users/:id/notifications/snooze
+	// Ends a snooze early; the summary of missed notifications follows shortly
+	e.DELETE("/users/:id/notifications/snooze", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		if err := SnoozeNotifications(db, uint(userID), nil); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+			}
+			return apierror.Internal("Failed to cancel snooze", err)
+		}
+		return respond(c, uint(userID))
+	})
+}
@@ -0,0 +1,283 @@
+// Package crawler implements the brand and seller price drop leaderboards
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// Groupings of the price drop leaderboard
+const (
+	PriceDropsByBrand  = "brand"
+	PriceDropsBySeller = "seller"
+)
+
+// defaultPriceDropWindow is the window of GET /stats/price-drops without one
+const defaultPriceDropWindow = "24h"
+
+// priceDropWindows are the windows the leaderboards are computed for
+var priceDropWindows = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// priceDropGroupColumns are the products columns each grouping reads: the
+// group ID and the name of the group
+var priceDropGroupColumns = map[string][2]string{
+	PriceDropsByBrand:  {"p.brand_id", "p.brand->>'name'"},
+	PriceDropsBySeller: {"p.seller_id", "p.seller->>'officialName'"},
+}
+
+// PriceDropGroup is one brand or seller of the price drop leaderboard
+type PriceDropGroup struct {
+	ID             uint    `json:"id"`               // Brand or seller ID
+	Name           string  `json:"name"`             // Brand or seller name
+	Drops          int     `json:"drops"`            // Price drops in the window
+	Products       int     `json:"products"`         // Distinct products that dropped
+	AvgDropPercent float64 `json:"avg_drop_percent"` // Mean drop in percent of the old price
+	MaxDropPercent float64 `json:"max_drop_percent"` // Largest drop in percent of the old price
+}
+
+// PriceDropLeaderboard is the response of GET /stats/price-drops
+type PriceDropLeaderboard struct {
+	GroupBy    string           `json:"group_by"`    // "brand" or "seller"
+	Window     string           `json:"window"`      // Period the drops were counted in
+	ComputedAt *time.Time       `json:"computed_at"` // When the leaderboard was computed, null before the first run
+	Items      []PriceDropGroup `json:"items"`       // The requested page, most drops first
+	Total      int64            `json:"total"`       // Groups matching the filter
+	Page       int              `json:"page"`        // 1-based page number
+	PageSize   int              `json:"page_size"`   // Groups per page
+}
+
+// PriceDropQuery selects a page of a price drop leaderboard
+type PriceDropQuery struct {
+	GroupBy        string  // PriceDropsByBrand or PriceDropsBySeller
+	Window         string  // A key of priceDropWindows
+	MinDropPercent float64 // Only groups whose average drop is at least this
+	Page           int     // 1-based page number
+	PageSize       int     // Groups per page
+}
+
+// ComputePriceDropStats recomputes the leaderboard of a grouping and window
+// from price_stock_logs and replaces its rows in price_drop_stats. A drop is
+// a logged change whose new price is below the old one; changes without a
+// numeric old or new price and products without a brand or seller ID are
+// skipped.
+//
+// Parameters:
+//   - db: Database connection
+//   - groupBy: PriceDropsByBrand or PriceDropsBySeller
+//   - window: A key of priceDropWindows
+//   - now: End of the window and the computation time
+//
+// Returns:
+//   - int: Groups with at least one drop
+//   - error: An unknown grouping or window, or any database error
+func ComputePriceDropStats(db *gorm.DB, groupBy, window string, now time.Time) (int, error) {
+	columns, ok := priceDropGroupColumns[groupBy]
+	if !ok {
+		return 0, fmt.Errorf("unknown price drop grouping %q", groupBy)
+	}
+	length, ok := priceDropWindows[window]
+	if !ok {
+		return 0, fmt.Errorf("unknown price drop window %q", window)
+	}
+
+	// old_price is logged as text; only plain decimals are compared. The
+	// pattern avoids ? which gorm would read as a placeholder.
+	query := fmt.Sprintf(`INSERT INTO price_drop_stats (group_by, period, group_id, name, drops, products, avg_drop_percent, max_drop_percent)
+		SELECT ?, ?, %[1]s, COALESCE(MAX(%[2]s), ''), COUNT(*), COUNT(DISTINCT (d.product_id, d.source)), AVG(d.percent), MAX(d.percent)
+		FROM (
+			SELECT l.product_id, l.source, (o.price - l.price_value) / o.price * 100 AS percent
+			FROM price_stock_logs l
+			CROSS JOIN LATERAL (SELECT CASE WHEN l.old_price ~ '^[0-9]+(\.[0-9]+){0,1}$' THEN l.old_price::numeric END AS price) o
+			WHERE l.change_time >= ? AND l.change_time < ? AND l.deleted_at IS NULL
+				AND l.price_value IS NOT NULL AND o.price > 0 AND l.price_value < o.price
+		) d
+		JOIN products p ON p.id = d.product_id AND p.source = d.source
+		WHERE %[1]s <> 0
+		GROUP BY %[1]s`, columns[0], columns[1])
+
+	groups := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_by = ? AND period = ?", groupBy, window).Delete(&models.PriceDropStat{}).Error; err != nil {
+			return err
+		}
+		result := tx.Exec(query, groupBy, window, now.Add(-length), now)
+		if result.Error != nil {
+			return result.Error
+		}
+		groups = int(result.RowsAffected)
+		run := models.PriceDropStatsRun{GroupBy: groupBy, Period: window, Groups: groups, ComputedAt: now}
+		return tx.Save(&run).Error
+	})
+	return groups, err
+}
+
+// runPriceDropStats recomputes every leaderboard and logs the outcome.
+func runPriceDropStats(db *gorm.DB) {
+	now := time.Now()
+	for groupBy := range priceDropGroupColumns {
+		for window := range priceDropWindows {
+			groups, err := ComputePriceDropStats(db, groupBy, window, now)
+			fields := logrus.Fields{"group_by": groupBy, "window": window}
+			if err != nil {
+				logrus.WithError(err).WithFields(fields).Error("Failed to compute price drop stats")
+				continue
+			}
+			logrus.WithFields(fields).WithField("groups", groups).Debug("Computed price drop stats")
+		}
+	}
+	logrus.WithField("duration", time.Since(now).String()).Info("Price drop stats computed")
+}
+
+// startPriceDropStatsJob schedules the leaderboard computation and runs it
+// once right away, so the endpoint has data after a deploy.
+//
+// Environment Variables:
+//   - PRICE_DROP_STATS_CRON: Cron expression for the job (default: 0 * * * *)
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startPriceDropStatsJob(db *gorm.DB) *cron.Cron {
+	spec := viper.GetString("PRICE_DROP_STATS_CRON")
+	if spec == "" {
+		spec = "0 * * * *" // Every hour
+	}
+
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	if _, err := c.AddFunc(spec, func() {
+		runPriceDropStats(db)
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid price drop stats cron expression")
+	}
+	c.Start()
+	go runPriceDropStats(db)
+
+	logrus.WithField("schedule", spec).Info("Price drop stats job scheduled")
+	return c
+}
+
+// GetPriceDropLeaderboard reads a page of a precomputed leaderboard.
+//
+// Parameters:
+//   - db: Database connection
+//   - q: Grouping, window, filter and page
+//
+// Returns:
+//   - PriceDropLeaderboard: The page, most drops first and then the largest
+//     average drop
+//   - error: Any database error
+func GetPriceDropLeaderboard(db *gorm.DB, q PriceDropQuery) (PriceDropLeaderboard, error) {
+	board := PriceDropLeaderboard{GroupBy: q.GroupBy, Window: q.Window, Items: []PriceDropGroup{}, Page: q.Page, PageSize: q.PageSize}
+
+	var run models.PriceDropStatsRun
+	err := db.Where("group_by = ? AND period = ?", q.GroupBy, q.Window).First(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return board, nil
+	}
+	if err != nil {
+		return board, err
+	}
+	board.ComputedAt = &run.ComputedAt
+
+	query := db.Model(&models.PriceDropStat{}).Where("group_by = ? AND period = ?", q.GroupBy, q.Window)
+	if q.MinDropPercent > 0 {
+		query = query.Where("avg_drop_percent >= ?", q.MinDropPercent)
+	}
+	if err := query.Count(&board.Total).Error; err != nil {
+		return board, err
+	}
+
+	var rows []models.PriceDropStat
+	err = query.Order("drops DESC, avg_drop_percent DESC, group_id").
+		Limit(q.PageSize).
+		Offset((q.Page - 1) * q.PageSize).
+		Find(&rows).Error
+	if err != nil {
+		return board, err
+	}
+	for _, row := range rows {
+		board.Items = append(board.Items, PriceDropGroup{
+			ID:             row.GroupID,
+			Name:           row.Name,
+			Drops:          row.Drops,
+			Products:       row.Products,
+			AvgDropPercent: row.AvgDropPercent,
+			MaxDropPercent: row.MaxDropPercent,
+		})
+	}
+	return board, nil
+}
+
+// parsePriceDropQuery reads the parameters of GET /stats/price-drops.
+//
+// Returns:
+//   - PriceDropQuery: The query to read
+//   - error: An apierror for an invalid parameter
+func parsePriceDropQuery(c echo.Context) (PriceDropQuery, error) {
+	q := PriceDropQuery{GroupBy: c.QueryParam("group_by"), Window: c.QueryParam("window")}
+	if _, ok := priceDropGroupColumns[q.GroupBy]; !ok {
+		return q, apierror.Invalid("group_by must be brand or seller")
+	}
+	if q.Window == "" {
+		q.Window = defaultPriceDropWindow
+	}
+	if _, ok := priceDropWindows[q.Window]; !ok {
+		return q, apierror.Invalid("window must be 24h, 7d or 30d")
+	}
+	if raw := c.QueryParam("min_drop_percent"); raw != "" {
+		percent, err := strconv.ParseFloat(raw, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return q, apierror.Invalid("min_drop_percent must be between 0 and 100")
+		}
+		q.MinDropPercent = percent
+	}
+	var err error
+	q.Page, q.PageSize, err = parsePageParams(c)
+	return q, err
+}
+
+// registerPriceDropStatsHandlers sets up the price drop leaderboard endpoint.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerPriceDropStatsHandlers(e *echo.Echo, db *gorm.DB) {
+	// GET /stats/price-drops
+	// Ranks brands or sellers by their price drops in a window, most drops
+	// first. The leaderboards are precomputed by a periodic job, see
+	// PRICE_DROP_STATS_CRON; computed_at says when.
+	// Query parameters:
+	//   - group_by: brand or seller (required)
+	//   - window: 24h, 7d or 30d (default 24h)
+	//   - min_drop_percent: Only groups whose average drop is at least this
+	//   - page, page_size: 1-based page, 1-100 groups per page (default 50)
+	e.GET("/stats/price-drops", func(c echo.Context) error {
+		q, err := parsePriceDropQuery(c)
+		if err != nil {
+			return err
+		}
+		board, err := GetPriceDropLeaderboard(db, q)
+		if err != nil {
+			return apierror.Internal("Failed to load price drop stats", err)
+		}
+		return c.JSON(http.StatusOK, board)
+	})
+}
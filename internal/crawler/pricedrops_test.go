@@ -0,0 +1,99 @@
+package crawler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/datatypes"
+
+	"scraper/internal/models"
+)
+
+func TestParsePriceDropQuery(t *testing.T) {
+	tests := []struct {
+		query  string
+		valid  bool
+		window string
+	}{
+		{"group_by=brand", true, "24h"},
+		{"group_by=seller&window=7d&min_drop_percent=12.5&page=2&page_size=10", true, "7d"},
+		{"", false, ""},
+		{"group_by=category", false, ""},
+		{"group_by=brand&window=1h", false, ""},
+		{"group_by=brand&min_drop_percent=150", false, ""},
+		{"group_by=brand&page_size=500", false, ""},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/stats/price-drops?"+tt.query, nil), httptest.NewRecorder())
+		q, err := parsePriceDropQuery(c)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: error %v, want valid = %v", tt.query, err, tt.valid)
+			continue
+		}
+		if tt.valid && q.Window != tt.window {
+			t.Errorf("%q: window %q, want %q", tt.query, q.Window, tt.window)
+		}
+	}
+}
+
+func TestComputePriceDropStats(t *testing.T) {
+	db := openStressDB(t)
+	if err := db.AutoMigrate(&models.PriceStockLog{}, &models.PriceDropStat{}, &models.PriceDropStatsRun{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Where("product_id >= ?", stressBaseID).Delete(&models.PriceStockLog{})
+	})
+
+	brand := datatypes.JSON(`{"name": "Stress Brand"}`)
+	for i := 0; i < 2; i++ {
+		product := models.Product{ID: uint(stressBaseID + i), Source: models.SourceTrendyol, Brand: brand, BrandID: stressBaseID}
+		if err := db.Create(&product).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	price := func(v float64) *float64 { return &v }
+	logs := []models.PriceStockLog{
+		{ProductID: stressBaseID, OldPrice: "100.00", PriceValue: price(80), ChangeTime: now.Add(-time.Hour)},       // 20% drop
+		{ProductID: stressBaseID + 1, OldPrice: "50.00", PriceValue: price(45), ChangeTime: now.Add(-time.Hour)},    // 10% drop
+		{ProductID: stressBaseID, OldPrice: "80.00", PriceValue: price(90), ChangeTime: now.Add(-time.Hour)},        // Increase
+		{ProductID: stressBaseID, OldPrice: "n/a", PriceValue: price(70), ChangeTime: now.Add(-time.Hour)},          // Not a number
+		{ProductID: stressBaseID, OldPrice: "200.00", PriceValue: price(100), ChangeTime: now.Add(-48 * time.Hour)}, // Outside 24h
+	}
+	if err := db.Create(&logs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ComputePriceDropStats(db, PriceDropsByBrand, "24h", now); err != nil {
+		t.Fatal(err)
+	}
+	var stat models.PriceDropStat
+	if err := db.Where("group_by = ? AND period = ? AND group_id = ?", PriceDropsByBrand, "24h", stressBaseID).First(&stat).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Where("group_id = ?", stressBaseID).Delete(&models.PriceDropStat{}) })
+	if stat.Drops != 2 || stat.Products != 2 || stat.Name != "Stress Brand" {
+		t.Errorf("stat = %+v, want 2 drops of 2 products of Stress Brand", stat)
+	}
+	if stat.AvgDropPercent < 14.99 || stat.AvgDropPercent > 15.01 || stat.MaxDropPercent < 19.99 || stat.MaxDropPercent > 20.01 {
+		t.Errorf("average %.2f%%, max %.2f%%; want 15%% and 20%%", stat.AvgDropPercent, stat.MaxDropPercent)
+	}
+
+	board, err := GetPriceDropLeaderboard(db, PriceDropQuery{GroupBy: PriceDropsByBrand, Window: "24h", MinDropPercent: 99, Page: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if board.ComputedAt == nil || board.ComputedAt.Sub(now).Abs() > time.Millisecond {
+		t.Errorf("computed_at = %v, want %v", board.ComputedAt, now)
+	}
+	for _, item := range board.Items {
+		if item.ID == stressBaseID {
+			t.Errorf("brand with a 15%% average drop listed with min_drop_percent=99")
+		}
+	}
+}
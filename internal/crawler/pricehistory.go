@@ -0,0 +1,445 @@
+// Package crawler implements the price history endpoint
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// Price history granularities. GranularityRaw returns the logged changes
+// themselves; the others aggregate them into buckets of that size.
+const (
+	GranularityRaw  = "raw"
+	GranularityHour = "hour"
+	GranularityDay  = "day"
+	GranularityWeek = "week"
+)
+
+// PriceBucket aggregates the price changes of one time bucket. Open and Close
+// are the prices set by the first and last change in the bucket.
+type PriceBucket struct {
+	Time    time.Time `json:"time"`    // Start of the bucket (UTC)
+	Open    float64   `json:"open"`    // Price after the first change in the bucket
+	High    float64   `json:"high"`    // Highest price set in the bucket
+	Low     float64   `json:"low"`     // Lowest price set in the bucket
+	Close   float64   `json:"close"`   // Price after the last change in the bucket
+	Changes int       `json:"changes"` // Changes aggregated into the bucket
+}
+
+// DailyPrice is one day of the daily price chart. A day without changes
+// carries the last known price forward in all four prices.
+type DailyPrice struct {
+	Date           string  `json:"date"`            // UTC day, YYYY-MM-DD
+	First          float64 `json:"first"`           // Price after the first change of the day
+	Last           float64 `json:"last"`            // Price after the last change of the day
+	Min            float64 `json:"min"`             // Lowest price set that day
+	Max            float64 `json:"max"`             // Highest price set that day
+	Changes        int     `json:"changes"`         // Changes logged that day
+	CarriedForward bool    `json:"carried_forward"` // No change that day, the prices are the last known one
+}
+
+// Daily price chart range bounds
+const (
+	defaultDailyPriceDays = 30
+	maxDailyPriceDays     = 366
+)
+
+// PricePoint is a single logged price or stock change. The prices and stocks
+// are logged as strings; a value that is not a number is null and named in
+// Invalid, an empty one is just null.
+type PricePoint struct {
+	Time     time.Time `json:"time"`              // When the change was detected
+	OldPrice *float64  `json:"old_price"`         // Price before the change
+	NewPrice *float64  `json:"new_price"`         // Price after the change
+	OldStock *float64  `json:"old_stock"`         // Stock before the change
+	NewStock *float64  `json:"new_stock"`         // Stock after the change
+	Invalid  []string  `json:"invalid,omitempty"` // Fields whose logged value is not a number
+}
+
+// PriceHistoryQuery selects the price history of a product
+type PriceHistoryQuery struct {
+	ProductID   uint
+	Source      string    // Marketplace of the product
+	Granularity string    // One of the Granularity constants
+	Limit       int       // Raw changes returned at most, PRICE_HISTORY_RAW_LIMIT when zero
+	From        time.Time // Only changes at or after this time, all when zero
+	To          time.Time // Only changes before this time, all when zero
+}
+
+// PriceHistory is the response of GET /products/:id/price-history. Points is
+// set for raw granularity and Buckets otherwise.
+type PriceHistory struct {
+	ProductID   uint          `json:"product_id"`
+	Granularity string        `json:"granularity"`
+	Buckets     []PriceBucket `json:"buckets,omitempty"`
+	Points      []PricePoint  `json:"points,omitempty"`
+	Truncated   bool          `json:"truncated"`                // Raw points were capped at the limit
+	Invalid     int           `json:"invalid_points,omitempty"` // Raw points with a value that is not a number
+}
+
+// priceHistoryRawLimit returns the maximum number of raw points returned.
+//
+// Environment Variables:
+//   - PRICE_HISTORY_RAW_LIMIT: Raw price changes returned at most (default: 1000)
+func priceHistoryRawLimit() int {
+	if limit := viper.GetInt("PRICE_HISTORY_RAW_LIMIT"); limit > 0 {
+		return limit
+	}
+	return 1000
+}
+
+// parseLoggedValue parses a price or stock logged as a string.
+//
+// Returns:
+//   - *float64: The value, nil if it is empty or not a number
+//   - bool: False if the value is set but not a number
+func parseLoggedValue(raw string) (*float64, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, true
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, false
+	}
+	return &value, true
+}
+
+// newPricePoint converts a logged change into its API representation. The
+// numeric columns are preferred for the new values when they are set.
+func newPricePoint(entry models.PriceStockLog) PricePoint {
+	point := PricePoint{Time: entry.ChangeTime}
+	fields := []struct {
+		name   string
+		raw    string
+		stored *float64
+		dst    **float64
+	}{
+		{"old_price", entry.OldPrice, nil, &point.OldPrice},
+		{"new_price", entry.NewPrice, entry.PriceValue, &point.NewPrice},
+		{"old_stock", entry.OldStock, nil, &point.OldStock},
+		{"new_stock", entry.NewStock, entry.StockValue, &point.NewStock},
+	}
+	for _, field := range fields {
+		if field.stored != nil {
+			*field.dst = field.stored
+			continue
+		}
+		value, ok := parseLoggedValue(field.raw)
+		if !ok {
+			point.Invalid = append(point.Invalid, field.name)
+		}
+		*field.dst = value
+	}
+	return point
+}
+
+// scopePriceHistory restricts price_stock_logs to the product and period of q.
+func scopePriceHistory(db *gorm.DB, q PriceHistoryQuery) *gorm.DB {
+	query := db.Model(&models.PriceStockLog{}).Where("product_id = ? AND source = ?", q.ProductID, q.Source)
+	if !q.From.IsZero() {
+		query = query.Where("change_time >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		query = query.Where("change_time < ?", q.To)
+	}
+	return query
+}
+
+// GetPriceHistory loads the price history of a product. Aggregated
+// granularities group the changes into UTC buckets in SQL; raw granularity
+// returns the most recent q.Limit changes. Raw changes with a logged value
+// that is not a number are returned with that value null and counted in
+// Invalid rather than failing the request.
+//
+// Parameters:
+//   - db: Database connection
+//   - q: Product, granularity and period
+//
+// Returns:
+//   - PriceHistory: The buckets oldest first, or the raw changes newest first
+//   - error: gorm.ErrRecordNotFound if the product does not exist, or any
+//     database error
+func GetPriceHistory(db *gorm.DB, q PriceHistoryQuery) (PriceHistory, error) {
+	history := PriceHistory{ProductID: q.ProductID, Granularity: q.Granularity}
+
+	var product models.Product
+	if err := db.Select("id").Where("id = ? AND source = ?", q.ProductID, q.Source).First(&product).Error; err != nil {
+		return history, err
+	}
+
+	if q.Granularity == GranularityRaw {
+		limit := q.Limit
+		if limit <= 0 {
+			limit = priceHistoryRawLimit()
+		}
+		var logs []models.PriceStockLog
+		err := scopePriceHistory(db, q).
+			Order("change_time DESC, id DESC").
+			Limit(limit + 1).
+			Find(&logs).Error
+		if err != nil {
+			return history, err
+		}
+		if len(logs) > limit {
+			logs = logs[:limit]
+			history.Truncated = true
+		}
+
+		history.Points = make([]PricePoint, len(logs))
+		for i, entry := range logs {
+			history.Points[i] = newPricePoint(entry)
+			if len(history.Points[i].Invalid) > 0 {
+				history.Invalid++
+			}
+		}
+		return history, nil
+	}
+
+	history.Buckets = []PriceBucket{}
+	err := scopePriceHistory(db, q).
+		Select(`date_trunc(?, change_time AT TIME ZONE 'UTC') AS time,
+			(array_agg(price_value ORDER BY change_time, id))[1] AS open,
+			max(price_value) AS high,
+			min(price_value) AS low,
+			(array_agg(price_value ORDER BY change_time DESC, id DESC))[1] AS close,
+			count(*) AS changes`, q.Granularity).
+		Where("price_value IS NOT NULL").
+		Group("time").
+		Order("time").
+		Scan(&history.Buckets).Error
+	for i := range history.Buckets {
+		history.Buckets[i].Time = history.Buckets[i].Time.UTC()
+	}
+	return history, err
+}
+
+// GetDailyPrices returns one entry per UTC day for charting. The days are
+// aggregated in SQL; days without changes carry the last known price forward,
+// including the last price logged before the range. Days before the first
+// known price are left out.
+//
+// Parameters:
+//   - db: Database connection
+//   - productID: Product ID
+//   - source: Marketplace of the product
+//   - from: First day, UTC midnight
+//   - to: Last day, inclusive, UTC midnight
+//
+// Returns:
+//   - []DailyPrice: The days, oldest first
+//   - error: gorm.ErrRecordNotFound if the product does not exist, or any
+//     database error
+func GetDailyPrices(db *gorm.DB, productID uint, source string, from, to time.Time) ([]DailyPrice, error) {
+	history, err := GetPriceHistory(db, PriceHistoryQuery{
+		ProductID:   productID,
+		Source:      source,
+		Granularity: GranularityDay,
+		From:        from,
+		To:          to.AddDate(0, 0, 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The price in effect when the range starts
+	var before []float64
+	err = scopePriceHistory(db, PriceHistoryQuery{ProductID: productID, Source: source, To: from}).
+		Where("price_value IS NOT NULL").
+		Order("change_time DESC, id DESC").
+		Limit(1).
+		Pluck("price_value", &before).Error
+	if err != nil {
+		return nil, err
+	}
+	var last *float64
+	if len(before) > 0 {
+		last = &before[0]
+	}
+
+	byDay := make(map[string]PriceBucket, len(history.Buckets))
+	for _, bucket := range history.Buckets {
+		byDay[bucket.Time.Format(time.DateOnly)] = bucket
+	}
+
+	days := []DailyPrice{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		if bucket, ok := byDay[date]; ok {
+			days = append(days, DailyPrice{
+				Date:    date,
+				First:   bucket.Open,
+				Last:    bucket.Close,
+				Min:     bucket.Low,
+				Max:     bucket.High,
+				Changes: bucket.Changes,
+			})
+			price := bucket.Close
+			last = &price
+			continue
+		}
+		if last == nil {
+			continue
+		}
+		days = append(days, DailyPrice{Date: date, First: *last, Last: *last, Min: *last, Max: *last, CarriedForward: true})
+	}
+	return days, nil
+}
+
+// parseHistoryDate parses an optional YYYY-MM-DD query parameter as a UTC day.
+func parseHistoryDate(c echo.Context, name string) (time.Time, bool, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return time.Time{}, false, nil
+	}
+	day, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return time.Time{}, false, apierror.Invalid(fmt.Sprintf("%s must be a date (YYYY-MM-DD)", name))
+	}
+	return day, true, nil
+}
+
+// parseHistoryTime parses an optional RFC 3339 query parameter.
+func parseHistoryTime(c echo.Context, name string) (time.Time, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, apierror.Invalid(fmt.Sprintf("%s must be an RFC 3339 time", name))
+	}
+	return t, nil
+}
+
+// registerPriceHistoryHandlers sets up the price history endpoints.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerPriceHistoryHandlers(e *echo.Echo, db *gorm.DB) {
+	// GET /products/:id/price-history
+	// Returns a product's price history: buckets oldest first, or the
+	// individual price and stock changes newest first
+	// Query parameters:
+	//   - source: Marketplace of the product (default trendyol)
+	//   - granularity: hour, day or week to aggregate into open/high/low/close
+	//     buckets, or raw for the individual changes (default day)
+	//   - from, to: RFC 3339 period, to is exclusive (optional)
+	//   - limit: Raw changes to return, 1 to PRICE_HISTORY_RAW_LIMIT (default
+	//     PRICE_HISTORY_RAW_LIMIT, raw only)
+	e.GET("/products/:id/price-history", func(c echo.Context) error {
+		id, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		q := PriceHistoryQuery{ProductID: id, Source: source, Granularity: c.QueryParam("granularity")}
+		switch q.Granularity {
+		case "":
+			q.Granularity = GranularityDay
+		case GranularityRaw, GranularityHour, GranularityDay, GranularityWeek:
+		default:
+			return apierror.Invalid("granularity must be one of raw, hour, day, week")
+		}
+		if q.From, err = parseHistoryTime(c, "from"); err != nil {
+			return err
+		}
+		if q.To, err = parseHistoryTime(c, "to"); err != nil {
+			return err
+		}
+		if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+			return apierror.Invalid("from must be before to")
+		}
+		if raw := c.QueryParam("limit"); raw != "" {
+			if q.Granularity != GranularityRaw {
+				return apierror.Invalid("limit only applies to granularity=raw")
+			}
+			maxLimit := priceHistoryRawLimit()
+			limit, err := strconv.Atoi(raw)
+			if err != nil || limit < 1 || limit > maxLimit {
+				return apierror.Invalid(fmt.Sprintf("limit must be between 1 and %d", maxLimit))
+			}
+			q.Limit = limit
+		}
+
+		history, err := GetPriceHistory(db.WithContext(c.Request().Context()), q)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
+		if err != nil {
+			return apierror.Internal("Failed to load price history", err)
+		}
+		return c.JSON(http.StatusOK, history)
+	})
+
+	// GET /products/:id/price-history/daily
+	// Returns one entry per UTC day with the first, last, lowest and highest
+	// price, carrying the last known price over days without changes
+	// Query parameters:
+	//   - source: Marketplace of the product (default trendyol)
+	//   - from, to: First and last day as YYYY-MM-DD, both inclusive
+	//     (default: the 30 days ending today, at most 366 days)
+	e.GET("/products/:id/price-history/daily", func(c echo.Context) error {
+		id, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		to, hasTo, err := parseHistoryDate(c, "to")
+		if err != nil {
+			return err
+		}
+		if !hasTo {
+			to = time.Now().UTC().Truncate(24 * time.Hour)
+		}
+		from, hasFrom, err := parseHistoryDate(c, "from")
+		if err != nil {
+			return err
+		}
+		if !hasFrom {
+			from = to.AddDate(0, 0, 1-defaultDailyPriceDays)
+		}
+		if from.After(to) {
+			return apierror.Invalid("from must not be after to")
+		}
+		if to.Sub(from) >= maxDailyPriceDays*24*time.Hour {
+			return apierror.Invalid(fmt.Sprintf("the range must not exceed %d days", maxDailyPriceDays))
+		}
+
+		days, err := GetDailyPrices(db.WithContext(c.Request().Context()), id, source, from, to)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
+		if err != nil {
+			return apierror.Internal("Failed to load daily prices", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"product_id": id,
+			"from":       from.Format(time.DateOnly),
+			"to":         to.Format(time.DateOnly),
+			"days":       days,
+		})
+	})
+}
@@ -0,0 +1,117 @@
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+
+	"scraper/internal/events"
+	"scraper/internal/models"
+	"scraper/internal/proto"
+)
+
+// largeProductID is beyond the range of 32-bit integers
+const largeProductID = 1<<32 + 5
+
+func TestParseProductID(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want uint
+		ok   bool
+	}{
+		{"42", 42, true},
+		{" 2147483648 ", 1 << 31, true},
+		{"4294967301", largeProductID, true},
+		{"9223372036854775807", models.MaxProductID, true},
+		{"9223372036854775808", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"12a", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := models.ParseProductID(tt.raw)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseProductID(%q) = %d, %v; want %d, ok = %v", tt.raw, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExtractContentIDKeepsLargeIDs(t *testing.T) {
+	for _, input := range []string{
+		"4294967301",
+		"https://www.trendyol.com/marka/urun-p-4294967301",
+		"https://www.trendyol.com/urun?contentId=4294967301",
+	} {
+		id, err := extractContentID(input)
+		if err != nil || id != largeProductID {
+			t.Errorf("extractContentID(%q) = %d, %v; want %d", input, id, err, largeProductID)
+		}
+	}
+}
+
+func TestProductIDValidation(t *testing.T) {
+	validate := newValidator()
+	for _, body := range []struct {
+		json string
+		ok   bool
+	}{
+		{`{"product_id": 4294967301}`, true},
+		{`{"product_id": 9223372036854775807}`, true},
+		{`{"product_id": 9223372036854775808}`, false},
+		{`{"product_id": 0}`, false},
+	} {
+		var ref FavoriteRef
+		if err := json.NewDecoder(strings.NewReader(body.json)).Decode(&ref); err != nil {
+			t.Fatal(err)
+		}
+		if err := validate.Struct(&ref); (err == nil) != body.ok {
+			t.Errorf("%s: validation error %v, want ok = %v", body.json, err, body.ok)
+		}
+	}
+}
+
+func TestGetProductRequestCarries64BitIDs(t *testing.T) {
+	data, err := protobuf.Marshal(&proto.GetProductRequest{ProductId: largeProductID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded proto.GetProductRequest
+	if err := protobuf.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ProductId != largeProductID {
+		t.Errorf("product_id = %d after a round trip, want %d", decoded.ProductId, largeProductID)
+	}
+
+	_, err = (&CrawlerServer{}).GetProduct(context.Background(), &proto.GetProductRequest{ProductId: models.MaxProductID + 1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetProduct beyond MaxProductID = %v, want InvalidArgument", err)
+	}
+}
+
+func TestPriceChangeCarries64BitIDs(t *testing.T) {
+	msg, err := events.NewPriceChangeMessage(events.PriceChange{ProductID: largeProductID, OldPrice: 100, NewPrice: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := msg.Value.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	change, err := events.DecodePriceChange(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.ProductID != largeProductID {
+		t.Errorf("product_id = %d after a round trip, want %d", change.ProductID, largeProductID)
+	}
+
+	if err := (events.PriceChange{ProductID: models.MaxProductID + 1, OldPrice: 100, NewPrice: 80}).Validate(); err == nil {
+		t.Error("price change beyond MaxProductID passed validation")
+	}
+}
@@ -0,0 +1,573 @@
+// Package crawler implements the product detail, listing, attribute filter and
+// rating history endpoints
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// attributesExpr is the lower-cased attributes column. Filters must use this
+// exact expression so Postgres can use idx_products_attributes_lower.
+const attributesExpr = "lower(products.attributes::text)::jsonb"
+
+// Page bounds of GET /products. maxProductPage keeps the offset of the
+// largest page within int32, so it cannot overflow into a negative OFFSET.
+const (
+	defaultProductPageSize = 50
+	maxProductPageSize     = 100
+	maxProductPage         = math.MaxInt32 / maxProductPageSize
+)
+
+// AttributeFilter matches products whose attribute Key equals any of Values,
+// ignoring case
+type AttributeFilter struct {
+	Key    string
+	Values []string
+}
+
+// ProductQuery selects products for the listing endpoint
+type ProductQuery struct {
+	Source     string            // Only this marketplace, all when empty
+	Category   string            // Category path or one of its ancestors, all when empty
+	Brand      string            // Brand ID or name ignoring case, all when empty
+	MinPrice   *float64          // Lowest price, inclusive
+	MaxPrice   *float64          // Highest price, inclusive
+	IsActive   *bool             // Only active or only inactive products
+	MinDeal    *float64          // Lowest deal score, inclusive; excludes products without a score
+	Attributes []AttributeFilter // Every filter must match
+	Page       int               // 1-based page number
+	PageSize   int               // Products per page
+
+	IncludeDeleted bool // Also list soft-deleted products; only set by admin endpoints
+}
+
+// ProductPage is the response of GET /products
+type ProductPage struct {
+	Items    []models.Product `json:"items"`     // The requested page
+	Total    int64            `json:"total"`     // Products matching the query
+	Page     int              `json:"page"`      // 1-based page number
+	PageSize int              `json:"page_size"` // Products per page
+}
+
+// AttributeValue is a value of an attribute key in a category
+type AttributeValue struct {
+	Value string `json:"value"` // One spelling of the value, matching ignores case
+	Count int64  `json:"count"` // Products in the category with this value
+}
+
+// AttributeFacet lists the values of an attribute key in a category
+type AttributeFacet struct {
+	Key    string           `json:"key"`    // Attribute name
+	Values []AttributeValue `json:"values"` // Most common values first
+}
+
+// ProductPricing is the decoded PriceInfo of a product
+type ProductPricing struct {
+	Price         float64 `json:"price"`          // Discounted price
+	OriginalPrice float64 `json:"original_price"` // Price before the discount
+	Currency      string  `json:"currency"`
+}
+
+// ProductStock is the decoded StockInfo of a product
+type ProductStock struct {
+	Quantity float64 `json:"quantity"` // Units in stock
+	Disabled bool    `json:"disabled"` // Whether the listing is disabled
+}
+
+// ProductRating is the decoded RatingScore of a product
+type ProductRating struct {
+	AverageRating float64 `json:"average_rating"` // Average user rating (0-5)
+	CommentCount  int     `json:"comment_count"`  // Number of reviews
+	TotalCount    int     `json:"total_count"`    // Number of ratings
+}
+
+// ProductDetail is the response of GET /products/:id. The JSONB columns are
+// decoded into typed fields, which are null when a column is empty or
+// malformed.
+type ProductDetail struct {
+	ID             uint            `json:"id"`
+	Source         string          `json:"source"`
+	Name           string          `json:"name"`
+	CategoryPath   string          `json:"category_path"`
+	Price          float64         `json:"price"`
+	DealScore      *float64        `json:"deal_score"` // Percentile of the price in its trailing history, null for sparse history
+	Pricing        *ProductPricing `json:"pricing"`
+	Stock          *ProductStock   `json:"stock"`
+	Images         []string        `json:"images"`
+	Rating         *ProductRating  `json:"rating"`
+	IsActive       bool            `json:"is_active"`
+	LastSeenAt     *time.Time      `json:"last_seen_at"`
+	DiscontinuedAt *time.Time      `json:"discontinued_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	IsFavorited    *bool           `json:"is_favorited,omitempty"` // Only set when the request names a user
+}
+
+// NewProductDetail decodes a stored product into its API representation.
+//
+// Parameters:
+//   - p: Stored product
+//
+// Returns:
+//   - ProductDetail: The product with decoded JSONB columns
+func NewProductDetail(p models.Product) ProductDetail {
+	detail := ProductDetail{
+		ID:             p.ID,
+		Source:         p.Source,
+		Name:           p.Name,
+		CategoryPath:   p.CategoryPath,
+		Price:          p.Price,
+		DealScore:      p.DealScore,
+		Images:         []string{},
+		IsActive:       p.IsActive,
+		LastSeenAt:     p.LastSeenAt,
+		DiscontinuedAt: p.DiscontinuedAt,
+		UpdatedAt:      p.UpdatedAt,
+	}
+
+	var pricing struct {
+		Price         *float64 `json:"price"`
+		OriginalPrice *float64 `json:"originalPrice"`
+		Original      *float64 `json:"original"` // Written by /simulate-price-drop
+		Currency      string   `json:"currency"`
+	}
+	if len(p.PriceInfo) > 0 && json.Unmarshal(p.PriceInfo, &pricing) == nil {
+		detail.Pricing = &ProductPricing{Price: p.Price, Currency: pricing.Currency}
+		if pricing.Price != nil {
+			detail.Pricing.Price = *pricing.Price
+		}
+		switch {
+		case pricing.OriginalPrice != nil:
+			detail.Pricing.OriginalPrice = *pricing.OriginalPrice
+		case pricing.Original != nil:
+			detail.Pricing.OriginalPrice = *pricing.Original
+		}
+	}
+
+	detail.Stock = productStock(p)
+
+	var images []string
+	if len(p.Images) > 0 && json.Unmarshal(p.Images, &images) == nil && images != nil {
+		detail.Images = images
+	}
+
+	var rating struct {
+		AverageRating float64 `json:"averageRating"`
+		CommentCount  int     `json:"commentCount"`
+		TotalCount    int     `json:"totalCount"`
+	}
+	if len(p.RatingScore) > 0 && json.Unmarshal(p.RatingScore, &rating) == nil {
+		detail.Rating = &ProductRating{AverageRating: rating.AverageRating, CommentCount: rating.CommentCount, TotalCount: rating.TotalCount}
+	}
+	return detail
+}
+
+// productStock decodes the StockInfo of a product.
+//
+// Returns:
+//   - *ProductStock: The stock, nil when the column is empty or malformed
+func productStock(p models.Product) *ProductStock {
+	var stock struct {
+		Stock    float64 `json:"stock"`
+		Disabled bool    `json:"disabled"`
+	}
+	if len(p.StockInfo) == 0 || json.Unmarshal(p.StockInfo, &stock) != nil {
+		return nil
+	}
+	return &ProductStock{Quantity: stock.Stock, Disabled: stock.Disabled}
+}
+
+// maxAttributeFilters returns how many attr[...] values one listing request
+// may combine. Each one adds a JSONB containment check to the query.
+//
+// Environment Variables:
+//   - PRODUCT_MAX_ATTRIBUTE_FILTERS: Maximum attribute filter values (default: 5)
+func maxAttributeFilters() int {
+	limit := viper.GetInt("PRODUCT_MAX_ATTRIBUTE_FILTERS")
+	if limit <= 0 {
+		limit = 5
+	}
+	return limit
+}
+
+// parseAttributeFilters reads attr[key]=value query parameters. Repeating a
+// key matches any of its values, e.g. attr[color]=red&attr[color]=blue.
+//
+// Parameters:
+//   - query: Request query parameters
+//
+// Returns:
+//   - []AttributeFilter: Filters sorted by key
+//   - error: A malformed parameter or too many filter values
+func parseAttributeFilters(query url.Values) ([]AttributeFilter, error) {
+	var filters []AttributeFilter
+	count := 0
+	for param, values := range query {
+		if !strings.HasPrefix(param, "attr[") {
+			continue
+		}
+		key := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(param, "attr["), "]"))
+		if !strings.HasSuffix(param, "]") || key == "" {
+			return nil, fmt.Errorf("invalid attribute filter %q, expected attr[key]=value", param)
+		}
+		filter := AttributeFilter{Key: key}
+		for _, value := range values {
+			if value = strings.TrimSpace(value); value == "" {
+				return nil, fmt.Errorf("attribute filter %q has an empty value", param)
+			}
+			filter.Values = append(filter.Values, value)
+		}
+		count += len(filter.Values)
+		filters = append(filters, filter)
+	}
+	if count > maxAttributeFilters() {
+		return nil, fmt.Errorf("at most %d attribute filters are allowed", maxAttributeFilters())
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Key < filters[j].Key })
+	return filters, nil
+}
+
+// likeEscaper escapes the LIKE wildcards of a user-supplied pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// whereCategory limits a products query to a category path and everything
+// below it, ignoring case.
+func whereCategory(query *gorm.DB, category string) *gorm.DB {
+	category = strings.ToLower(strings.Trim(category, "/ "))
+	escaped := likeEscaper.Replace(category)
+	return query.Where("lower(products.category_path) = ? OR lower(products.category_path) LIKE ?", category, escaped+"/%")
+}
+
+// ListProducts returns a page of products matching the query. Attribute
+// filters are JSONB containment checks on the lower-cased attributes, so they
+// ignore case and are served by the GIN expression index. A numeric brand
+// matches the brand ID, anything else the brand name ignoring case.
+//
+// Parameters:
+//   - db: Database connection
+//   - q: Filters and page
+//
+// Returns:
+//   - ProductPage: Matching products, most recently updated first
+//   - error: Any database error
+func ListProducts(db *gorm.DB, q ProductQuery) (ProductPage, error) {
+	page := ProductPage{Page: q.Page, PageSize: q.PageSize}
+
+	query := db.Model(&models.Product{})
+	if q.IncludeDeleted {
+		query = query.Unscoped()
+	}
+	if q.Source != "" {
+		query = query.Where("products.source = ?", q.Source)
+	}
+	if q.Category != "" {
+		query = whereCategory(query, q.Category)
+	}
+	if q.Brand != "" {
+		if brandID, err := strconv.ParseUint(q.Brand, 10, 32); err == nil {
+			query = query.Where("products.brand_id = ?", brandID)
+		} else {
+			query = query.Where("lower(products.brand->>'name') = ?", strings.ToLower(q.Brand))
+		}
+	}
+	if q.MinPrice != nil {
+		query = query.Where("products.price >= ?", *q.MinPrice)
+	}
+	if q.MaxPrice != nil {
+		query = query.Where("products.price <= ?", *q.MaxPrice)
+	}
+	if q.IsActive != nil {
+		query = query.Where("products.is_active = ?", *q.IsActive)
+	}
+	if q.MinDeal != nil {
+		query = query.Where("products.deal_score >= ?", *q.MinDeal)
+	}
+	for _, filter := range q.Attributes {
+		conditions := make([]string, 0, len(filter.Values))
+		args := make([]interface{}, 0, len(filter.Values))
+		for _, value := range filter.Values {
+			contained, err := json.Marshal(map[string]string{
+				strings.ToLower(filter.Key): strings.ToLower(value),
+			})
+			if err != nil {
+				return page, err
+			}
+			conditions = append(conditions, attributesExpr+" @> ?::jsonb")
+			args = append(args, string(contained))
+		}
+		query = query.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+
+	// The count and the page share the filters
+	query = query.Session(&gorm.Session{})
+	if err := query.Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+	page.Items = []models.Product{}
+	err := query.Order("products.updated_at DESC, products.id, products.source").
+		Limit(q.PageSize).
+		Offset((q.Page - 1) * q.PageSize).
+		Find(&page.Items).Error
+	return page, err
+}
+
+// ListCategoryAttributes returns the attribute keys and values of the
+// products in a category, for building filter UIs. Values differing only in
+// case are reported once.
+//
+// Parameters:
+//   - db: Database connection
+//   - category: Category path, including its subcategories
+//
+// Returns:
+//   - []AttributeFacet: Keys sorted by name, values by product count
+//   - error: Any database error
+func ListCategoryAttributes(db *gorm.DB, category string) ([]AttributeFacet, error) {
+	var rows []struct {
+		Key   string
+		Value string
+		Count int64
+	}
+	// jsonb_each_text fails on anything but an object, such as a JSON null
+	query := db.Table("products, jsonb_each_text(CASE WHEN jsonb_typeof(products.attributes) = 'object' THEN products.attributes ELSE '{}'::jsonb END) AS attr").
+		Select("min(attr.key) AS key, min(attr.value) AS value, count(*) AS count").
+		Where("products.deleted_at IS NULL")
+	err := whereCategory(query, category).
+		Group("lower(attr.key), lower(attr.value)").
+		Order("lower(min(attr.key)), count DESC, min(attr.value)").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	facets := []AttributeFacet{}
+	for _, row := range rows {
+		if n := len(facets); n > 0 && strings.EqualFold(facets[n-1].Key, row.Key) {
+			facets[n-1].Values = append(facets[n-1].Values, AttributeValue{Value: row.Value, Count: row.Count})
+			continue
+		}
+		facets = append(facets, AttributeFacet{
+			Key:    row.Key,
+			Values: []AttributeValue{{Value: row.Value, Count: row.Count}},
+		})
+	}
+	return facets, nil
+}
+
+// RatingHistory returns the recorded rating and review count changes of a
+// product, oldest first.
+//
+// Parameters:
+//   - db: Database connection
+//   - id: Product ID
+//   - source: Marketplace of the product
+//
+// Returns:
+//   - []models.RatingLog: The changes, empty if the rating never changed
+//   - error: gorm.ErrRecordNotFound if the product does not exist, or any
+//     database error
+func RatingHistory(db *gorm.DB, id uint, source string) ([]models.RatingLog, error) {
+	var product models.Product
+	if err := db.Select("id").Where("id = ? AND source = ?", id, source).First(&product).Error; err != nil {
+		return nil, err
+	}
+
+	history := []models.RatingLog{}
+	err := db.Where("product_id = ? AND source = ?", id, source).
+		Order("change_time, id").
+		Find(&history).Error
+	return history, err
+}
+
+// parsePriceParam parses an optional non-negative price query parameter.
+func parsePriceParam(c echo.Context, name string) (*float64, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return nil, nil
+	}
+	price, err := strconv.ParseFloat(raw, 64)
+	if err != nil || price < 0 {
+		return nil, apierror.Invalid(name + " must be a non-negative number")
+	}
+	return &price, nil
+}
+
+// parsePageParams reads the page and page_size query parameters of the
+// product listings.
+//
+// Returns:
+//   - int: 1-based page number, at most maxProductPage (default 1)
+//   - int: Products per page, 1-100 (default 50)
+//   - error: An invalid parameter
+func parsePageParams(c echo.Context) (int, int, error) {
+	page, size := 1, defaultProductPageSize
+	if raw := c.QueryParam("page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxProductPage {
+			return 0, 0, apierror.Invalid(fmt.Sprintf("page must be between 1 and %d", maxProductPage))
+		}
+		page = n
+	}
+	if raw := c.QueryParam("page_size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxProductPageSize {
+			return 0, 0, apierror.Invalid(fmt.Sprintf("page_size must be between 1 and %d", maxProductPageSize))
+		}
+		size = n
+	}
+	return page, size, nil
+}
+
+// parseProductQuery reads the filters and page of a product listing request.
+//
+// Returns:
+//   - ProductQuery: The query to list
+//   - error: An apierror for an invalid parameter
+func parseProductQuery(c echo.Context) (ProductQuery, error) {
+	q := ProductQuery{
+		Category: c.QueryParam("category"),
+		Brand:    strings.TrimSpace(c.QueryParam("brand")),
+	}
+
+	if source := c.QueryParam("source"); source != "" {
+		normalized, err := NormalizeSource(source)
+		if err != nil {
+			return q, apierror.Invalid(err.Error())
+		}
+		q.Source = normalized
+	}
+	var err error
+	if q.Page, q.PageSize, err = parsePageParams(c); err != nil {
+		return q, err
+	}
+	if q.MinPrice, err = parsePriceParam(c, "min_price"); err != nil {
+		return q, err
+	}
+	if q.MaxPrice, err = parsePriceParam(c, "max_price"); err != nil {
+		return q, err
+	}
+	if q.MinPrice != nil && q.MaxPrice != nil && *q.MinPrice > *q.MaxPrice {
+		return q, apierror.Invalid("min_price must not exceed max_price")
+	}
+	if raw := c.QueryParam("is_active"); raw != "" {
+		active, err := strconv.ParseBool(raw)
+		if err != nil {
+			return q, apierror.Invalid("is_active must be true or false")
+		}
+		q.IsActive = &active
+	}
+	if raw := c.QueryParam("min_deal_score"); raw != "" {
+		score, err := strconv.ParseFloat(raw, 64)
+		if err != nil || score < 0 || score > 100 {
+			return q, apierror.Invalid("min_deal_score must be between 0 and 100")
+		}
+		q.MinDeal = &score
+	}
+	filters, err := parseAttributeFilters(c.QueryParams())
+	if err != nil {
+		return q, apierror.Invalid(err.Error())
+	}
+	q.Attributes = filters
+	return q, nil
+}
+
+// registerProductHandlers sets up the product endpoints:
+// - Listing products with category and attribute filters
+// - Listing the attributes available in a category
+// - Showing the rating history of a product
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerProductHandlers(e *echo.Echo, db *gorm.DB) {
+	// GET /products
+	// Lists products, most recently updated first
+	// Query parameters:
+	//   - source: Only list products from this marketplace (optional)
+	//   - category: Category path, including subcategories (optional)
+	//   - brand: Brand ID or name (optional)
+	//   - min_price, max_price: Price range, inclusive (optional)
+	//   - is_active: true or false (optional)
+	//   - min_deal_score: Lowest deal score, 0-100 (optional)
+	//   - attr[key]: Attribute value to match, ignoring case; repeat a key to
+	//     match any of several values (optional, PRODUCT_MAX_ATTRIBUTE_FILTERS values at most)
+	//   - page: 1-based page number (default 1)
+	//   - page_size: Products per page, 1-100 (default 50)
+	e.GET("/products", func(c echo.Context) error {
+		q, err := parseProductQuery(c)
+		if err != nil {
+			return err
+		}
+
+		page, err := ListProducts(db.WithContext(c.Request().Context()), q)
+		if err != nil {
+			return apierror.Internal("Failed to list products", err)
+		}
+		return c.JSON(http.StatusOK, page)
+	})
+
+	// GET /products/attributes
+	// Lists the attribute keys and values found in a category with their
+	// product counts, for building filter UIs
+	// Query parameters:
+	//   - category: Category path, including subcategories (required)
+	e.GET("/products/attributes", func(c echo.Context) error {
+		category := strings.TrimSpace(c.QueryParam("category"))
+		if category == "" {
+			return apierror.Invalid("category is required")
+		}
+
+		facets, err := ListCategoryAttributes(db.WithContext(c.Request().Context()), category)
+		if err != nil {
+			return apierror.Internal("Failed to list attributes", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"category":   category,
+			"attributes": facets,
+		})
+	})
+
+	// GET /products/:id/rating-history
+	// Lists the changes of a product's average rating and review count,
+	// oldest first
+	// Query parameters:
+	//   - source: Marketplace of the product (default trendyol)
+	e.GET("/products/:id/rating-history", func(c echo.Context) error {
+		id, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		history, err := RatingHistory(db.WithContext(c.Request().Context()), id, source)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
+		if err != nil {
+			return apierror.Internal("Failed to load rating history", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"product_id": id,
+			"source":     source,
+			"history":    history,
+		})
+	})
+}
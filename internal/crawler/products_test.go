@@ -0,0 +1,153 @@
+package crawler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/datatypes"
+
+	"scraper/internal/models"
+)
+
+func TestParsePageParams(t *testing.T) {
+	tests := []struct {
+		query string
+		valid bool
+		page  int
+		size  int
+	}{
+		{"", true, 1, defaultProductPageSize},
+		{"page=3&page_size=20", true, 3, 20},
+		{"page=21474836&page_size=100", true, maxProductPage, maxProductPageSize},
+		{"page=0", false, 0, 0},
+		{"page=-1", false, 0, 0},
+		{"page=abc", false, 0, 0},
+		{"page=21474837", false, 0, 0},
+		{"page=92233720368547758", false, 0, 0},
+		{"page_size=0", false, 0, 0},
+		{"page_size=101", false, 0, 0},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/products?"+tt.query, nil), httptest.NewRecorder())
+		page, size, err := parsePageParams(c)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: error %v, want valid = %v", tt.query, err, tt.valid)
+			continue
+		}
+		if tt.valid && (page != tt.page || size != tt.size) {
+			t.Errorf("%q: page %d, size %d, want %d, %d", tt.query, page, size, tt.page, tt.size)
+		}
+		if tt.valid && (page-1)*size < 0 {
+			t.Errorf("%q: offset %d is negative", tt.query, (page-1)*size)
+		}
+	}
+}
+
+func TestListProducts(t *testing.T) {
+	db := openStressDB(t)
+
+	// Every case lists below the StressListing category, so rows of other
+	// tests and real data in the database are never matched
+	now := time.Now().Truncate(time.Microsecond)
+	products := []struct {
+		category string
+		brand    string
+		brandID  uint
+		price    float64
+		active   bool
+	}{
+		{"StressListing/Shoes", "Acme", stressBaseID, 100, true},
+		{"StressListing/Shoes/Running", "Acme", stressBaseID, 250, true},
+		{"StressListing/Bags", "Other", stressBaseID + 1, 50, false},
+		{"StressListing/Shoes", "ACME", stressBaseID + 2, 400, true},
+		{"StressListingOther", "Acme", stressBaseID, 75, true}, // Shares the prefix but not the path
+	}
+	for i, p := range products {
+		product := models.Product{
+			ID:           uint(stressBaseID + i),
+			Source:       models.SourceTrendyol,
+			CategoryPath: p.category,
+			Brand:        datatypes.JSON(`{"name": "` + p.brand + `"}`),
+			BrandID:      p.brandID,
+			Price:        p.price,
+		}
+		// Product i is the i+1th most recently updated
+		product.UpdatedAt = now.Add(-time.Duration(i+1) * time.Hour)
+		if err := db.Create(&product).Error; err != nil {
+			t.Fatal(err)
+		}
+		if !p.active {
+			// Create replaces a false is_active with the column default
+			if err := db.Model(&product).UpdateColumn("is_active", false).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	price := func(v float64) *float64 { return &v }
+	boolean := func(v bool) *bool { return &v }
+	tests := []struct {
+		name  string
+		q     ProductQuery
+		want  []int // Indexes into products, in the expected order
+		total int64
+	}{
+		{"all, most recently updated first", ProductQuery{}, []int{0, 1, 2, 3}, 4},
+		{"category prefix", ProductQuery{Category: "StressListing/Shoes"}, []int{0, 1, 3}, 3},
+		{"category ignores case and slashes", ProductQuery{Category: "/stresslisting/shoes/"}, []int{0, 1, 3}, 3},
+		{"leaf category", ProductQuery{Category: "StressListing/Shoes/Running"}, []int{1}, 1},
+		{"brand by ID", ProductQuery{Brand: strconv.Itoa(stressBaseID)}, []int{0, 1}, 2},
+		{"brand by name ignores case", ProductQuery{Brand: "acme"}, []int{0, 1, 3}, 3},
+		{"min price is inclusive", ProductQuery{MinPrice: price(100)}, []int{0, 1, 3}, 3},
+		{"max price is inclusive", ProductQuery{MaxPrice: price(100)}, []int{0, 2}, 2},
+		{"price range", ProductQuery{MinPrice: price(60), MaxPrice: price(300)}, []int{0, 1}, 2},
+		{"inactive", ProductQuery{IsActive: boolean(false)}, []int{2}, 1},
+		{"active", ProductQuery{IsActive: boolean(true)}, []int{0, 1, 3}, 3},
+		{"combined filters", ProductQuery{Category: "StressListing/Shoes", Brand: "acme", MaxPrice: price(300)}, []int{0, 1}, 2},
+		{"first page", ProductQuery{PageSize: 3}, []int{0, 1, 2}, 4},
+		{"last page", ProductQuery{Page: 2, PageSize: 3}, []int{3}, 4},
+		{"page past the end", ProductQuery{Page: 3, PageSize: 2}, []int{}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.q
+			if q.Category == "" {
+				q.Category = "StressListing"
+			}
+			if q.Page == 0 {
+				q.Page = 1
+			}
+			if q.PageSize == 0 {
+				q.PageSize = defaultProductPageSize
+			}
+
+			page, err := ListProducts(db, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != tt.total {
+				t.Errorf("total = %d, want %d", page.Total, tt.total)
+			}
+			if page.Page != q.Page || page.PageSize != q.PageSize {
+				t.Errorf("page %d of size %d, want %d of size %d", page.Page, page.PageSize, q.Page, q.PageSize)
+			}
+			got := make([]uint, len(page.Items))
+			for i, item := range page.Items {
+				got[i] = item.ID
+			}
+			want := make([]uint, len(tt.want))
+			for i, index := range tt.want {
+				want[i] = uint(stressBaseID + index)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("products = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+// Package crawler implements batch publishing of products to Kafka
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/kafka"
+	"scraper/internal/models"
+	"scraper/internal/outbox"
+	"scraper/pkg/httpclient"
+)
+
+// Batch size limits for /fetch publishing
+const (
+	minBatchSize     = 1
+	maxBatchSize     = 500
+	defaultBatchSize = 50
+)
+
+// batchBytesHeadroom is reserved below the producer's message limit for the
+// key, headers and record overhead
+const batchBytesHeadroom = 64 * 1024
+
+// BatchResult describes the outcome of publishing one batch of products.
+type BatchResult struct {
+	Index int    `json:"index"`           // Position of the batch in the run
+	Start int    `json:"start"`           // Index of the first product in the batch
+	End   int    `json:"end"`             // Index after the last product in the batch
+	Key   string `json:"key"`             // Kafka message key used for partitioning
+	Bytes int    `json:"bytes"`           // Serialized size of the batch
+	Error string `json:"error,omitempty"` // Failure reason if the batch was not sent
+
+	value []byte // Encoded products
+}
+
+// PublishSummary reports the outcome of publishing a set of products.
+type PublishSummary struct {
+	TotalProducts int           `json:"total_products"`    // Number of products considered
+	TotalBatches  int           `json:"total_batches"`     // Number of batches built
+	BatchSize     int           `json:"batch_size"`        // Maximum products per batch
+	MaxBatchBytes int           `json:"max_batch_bytes"`   // Maximum serialized bytes per batch
+	Sent          []int         `json:"sent"`              // Indices of batches that were published
+	Failed        []BatchResult `json:"failed"`            // Batches that could not be published
+	Oversized     []uint        `json:"oversized"`         // Products larger than MaxBatchBytes, published alone
+	Spooled       []int         `json:"spooled,omitempty"` // Indices of failed batches written to the outbox instead
+	DryRun        bool          `json:"dry_run,omitempty"` // The batches were built and logged but not published
+	Batches       []BatchResult `json:"batches,omitempty"` // Batches a dry run would have published
+}
+
+// defaultFetchBatchSize returns the configured default number of products
+// per batch, falling back to defaultBatchSize when unset or out of range.
+//
+// Environment Variables:
+//   - FETCH_BATCH_SIZE: Default products per batch (1-500, default: 50)
+func defaultFetchBatchSize() int {
+	size := viper.GetInt("FETCH_BATCH_SIZE")
+	if size == 0 {
+		return defaultBatchSize
+	}
+	if err := validateBatchSize(size); err != nil {
+		logrus.WithError(err).WithField("batch_size", size).Warn("Invalid FETCH_BATCH_SIZE, using default")
+		return defaultBatchSize
+	}
+	return size
+}
+
+// validateBatchSize checks that a batch size is within the allowed range.
+func validateBatchSize(size int) error {
+	if size < minBatchSize || size > maxBatchSize {
+		return fmt.Errorf("batch_size must be between %d and %d", minBatchSize, maxBatchSize)
+	}
+	return nil
+}
+
+// maxBatchBytes returns the largest serialized batch to publish. It is
+// derived from the producer's message limit minus headroom and can only be
+// lowered through configuration.
+//
+// Environment Variables:
+//   - FETCH_BATCH_MAX_BYTES: Byte limit per batch (default: producer limit minus 64KB)
+func maxBatchBytes() int {
+	limit := kafka.MaxMessageBytes - batchBytesHeadroom
+	if configured := viper.GetInt("FETCH_BATCH_MAX_BYTES"); configured > 0 && configured < limit {
+		limit = configured
+	}
+	return limit
+}
+
+// buildBatches splits products into batches of at most batchSize products
+// and maxBytes serialized bytes. A batch is closed early when adding the next
+// product would exceed maxBytes; a product that exceeds maxBytes on its own
+// becomes a single-product batch.
+//
+// Parameters:
+//   - products: Products to split
+//   - batchSize: Maximum products per batch
+//   - maxBytes: Maximum serialized bytes per batch
+//
+// Returns:
+//   - []BatchResult: Batches with their encoded value
+//   - []uint: IDs of products larger than maxBytes
+//   - error: If a product cannot be encoded
+func buildBatches(products []models.Product, batchSize, maxBytes int) ([]BatchResult, []uint, error) {
+	var batches []BatchResult
+	var oversized []uint
+
+	var current [][]byte
+	start, size := 0, 2 // Size includes the enclosing brackets
+	flush := func(end int) {
+		if len(current) == 0 {
+			return
+		}
+		value := append(append([]byte{'['}, bytes.Join(current, []byte{','})...), ']')
+		batches = append(batches, BatchResult{
+			Index: len(batches),
+			Start: start,
+			End:   end,
+			Key:   fmt.Sprintf("%d-%d", products[start].ID, products[end-1].ID),
+			Bytes: len(value),
+			value: value,
+		})
+		current, start, size = nil, end, 2
+	}
+
+	for i, product := range products {
+		encoded, err := json.Marshal(product)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encode product %d: %w", product.ID, err)
+		}
+
+		// Oversized products are published alone
+		if len(encoded)+2 > maxBytes {
+			flush(i)
+			logrus.WithFields(logrus.Fields{
+				"product_id": product.ID,
+				"bytes":      len(encoded),
+				"max_bytes":  maxBytes,
+			}).Warn("Product exceeds the batch byte limit, publishing it alone")
+			oversized = append(oversized, product.ID)
+			current = [][]byte{encoded}
+			flush(i + 1)
+			continue
+		}
+
+		// Close the batch if this product would overflow it
+		extra := len(encoded)
+		if len(current) > 0 {
+			extra++ // Separating comma
+		}
+		if len(current) == batchSize || size+extra > maxBytes {
+			flush(i)
+			extra = len(encoded)
+		}
+		current = append(current, encoded)
+		size += extra
+	}
+	flush(len(products))
+	return batches, oversized, nil
+}
+
+// publishProducts splits products into batches and publishes them to the
+// PRODUCTS topic concurrently. Batches hold at most batchSize products and
+// are closed early once they would exceed the byte limit from maxBatchBytes.
+// Each message is keyed by the product ID range it carries so related
+// products land on the same partition. A failed batch does not stop the
+// others; the summary lists sent and failed batch indices. The correlation
+// ID of ctx, if any, is sent as a header so consumers can tie the products
+// to the crawl that found them.
+// Throttling is left to the producer's own flush and retry settings.
+//
+// Environment Variables:
+//   - FETCH_PUBLISH_CONCURRENCY: Maximum batches in flight (default: 4)
+//
+// Parameters:
+//   - ctx: Carries the correlation ID of the operation, see httpclient.WithCorrelationID
+//   - producer: Kafka producer
+//   - products: Products to publish
+//   - batchSize: Maximum products per batch
+//
+// Returns:
+//   - PublishSummary: Per-batch outcome
+func publishProducts(ctx context.Context, producer sarama.SyncProducer, products []models.Product, batchSize int) PublishSummary {
+	concurrency := viper.GetInt("FETCH_PUBLISH_CONCURRENCY")
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	maxBytes := maxBatchBytes()
+	var headers []sarama.RecordHeader
+	if id := httpclient.CorrelationID(ctx); id != "" {
+		headers = []sarama.RecordHeader{{Key: []byte(kafka.HeaderCorrelationID), Value: []byte(id)}}
+	}
+
+	// Build batches up front so results can be reported by index
+	summary, batches := prepareBatches(products, batchSize, maxBytes)
+
+	// Publish batches with bounded concurrency
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(batch *BatchResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// Send batch to Kafka
+			msg := batch.message()
+			msg.Headers = headers
+			if _, _, err := producer.SendMessage(msg); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"batch":       batch.Index,
+					"batch_start": batch.Start,
+					"batch_end":   batch.End,
+				}).Error("Failed to send batch to Kafka")
+				batch.Error = err.Error()
+				return
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"batch":       batch.Index,
+				"batch_start": batch.Start,
+				"batch_end":   batch.End,
+				"batch_size":  batch.End - batch.Start,
+				"bytes":       batch.Bytes,
+				"key":         batch.Key,
+			}).Info("Batch sent to Kafka")
+		}(&batches[i])
+	}
+	wg.Wait()
+
+	// Collect results in batch order
+	for _, batch := range batches {
+		if batch.Error != "" {
+			summary.Failed = append(summary.Failed, batch)
+		} else {
+			summary.Sent = append(summary.Sent, batch.Index)
+		}
+	}
+	return summary
+}
+
+// prepareBatches builds the batches of publishProducts and the summary they
+// are reported in. Products that cannot be encoded fail as one batch, and no
+// batches are returned.
+func prepareBatches(products []models.Product, batchSize, maxBytes int) (PublishSummary, []BatchResult) {
+	summary := PublishSummary{
+		TotalProducts: len(products),
+		BatchSize:     batchSize,
+		MaxBatchBytes: maxBytes,
+		Sent:          []int{},
+		Failed:        []BatchResult{},
+		Oversized:     []uint{},
+	}
+	batches, oversized, err := buildBatches(products, batchSize, maxBytes)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode products for publishing")
+		summary.Failed = append(summary.Failed, BatchResult{Start: 0, End: len(products), Error: err.Error()})
+		return summary, nil
+	}
+	summary.TotalBatches = len(batches)
+	summary.Oversized = append(summary.Oversized, oversized...)
+	return summary, batches
+}
+
+// countBatches builds the batches publishProducts would send and logs them
+// instead, for dry runs that validate a crawl's output before it reaches the
+// PRODUCTS topic. The summary lists them under Batches; Sent stays empty.
+//
+// Parameters:
+//   - products: Products to split
+//   - batchSize: Maximum products per batch
+//
+// Returns:
+//   - PublishSummary: The batches that would have been published
+func countBatches(products []models.Product, batchSize int) PublishSummary {
+	summary, batches := prepareBatches(products, batchSize, maxBatchBytes())
+	summary.DryRun = true
+	summary.Batches = []BatchResult{}
+	for _, batch := range batches {
+		logrus.WithFields(logrus.Fields{
+			"batch":       batch.Index,
+			"batch_start": batch.Start,
+			"batch_end":   batch.End,
+			"batch_size":  batch.End - batch.Start,
+			"bytes":       batch.Bytes,
+			"key":         batch.Key,
+		}).Info("Dry run, batch not sent to Kafka")
+		summary.Batches = append(summary.Batches, batch)
+	}
+	return summary
+}
+
+// message builds the Kafka message of a batch.
+func (b *BatchResult) message() *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Topic: "PRODUCTS", // Topic for product updates
+		Key:   sarama.StringEncoder(b.Key),
+		Value: sarama.ByteEncoder(b.value),
+	}
+}
+
+// spoolFailedBatches writes the batches Kafka did not take to the outbox,
+// whose relay publishes them once Kafka is back. A crawl stopped by a
+// shutdown uses it so its products outlive the process; batches that were
+// never encoded cannot be spooled and stay in Failed only.
+//
+// Parameters:
+//   - db: Database connection
+//   - summary: Outcome of publishProducts; Spooled is filled in
+func spoolFailedBatches(db *gorm.DB, summary *PublishSummary) {
+	for _, batch := range summary.Failed {
+		if batch.value == nil {
+			continue
+		}
+		if err := outbox.Add(db, batch.message()); err != nil {
+			logrus.WithError(err).WithField("batch", batch.Index).Error("Failed to spool batch to the outbox")
+			continue
+		}
+		summary.Spooled = append(summary.Spooled, batch.Index)
+	}
+	if len(summary.Spooled) > 0 {
+		logrus.WithField("batches", len(summary.Spooled)).Warn("Spooled unpublished batches to the outbox")
+	}
+}
@@ -0,0 +1,270 @@
+// Package crawler implements the reconciliation job, which compares stored
+// products with a fresh fetch to catch rows the upsert path got wrong
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+// FieldMismatch is a field whose stored value differs from the fetched one
+type FieldMismatch struct {
+	DB      interface{} `json:"db"`      // Value in the database
+	Fetched interface{} `json:"fetched"` // Value returned by the marketplace
+}
+
+// ProductReconciliation is the comparison of one product
+type ProductReconciliation struct {
+	ProductID uint                     `json:"product_id"`
+	Source    string                   `json:"source"`
+	Matched   bool                     `json:"matched"` // True if no compared field differs
+	Diff      map[string]FieldMismatch `json:"diff"`    // Differing fields by name
+}
+
+// reconcileSampleSize returns how many products a nightly run refetches.
+//
+// Environment Variables:
+//   - RECONCILE_SAMPLE_SIZE: Products sampled per run (default: 100)
+func reconcileSampleSize() int {
+	size := viper.GetInt("RECONCILE_SAMPLE_SIZE")
+	if size <= 0 {
+		size = 100
+	}
+	return size
+}
+
+// reconcileAlertThreshold returns the mismatch rate, as a fraction of the
+// checked products, above which a nightly run alerts.
+//
+// Environment Variables:
+//   - RECONCILE_ALERT_THRESHOLD_PERCENT: Alert threshold (default: 5)
+func reconcileAlertThreshold() float64 {
+	percent := viper.GetFloat64("RECONCILE_ALERT_THRESHOLD_PERCENT")
+	if percent <= 0 {
+		percent = 5
+	}
+	return percent / 100
+}
+
+// reconciledFields returns the compared fields of a product. Prices are
+// rounded to cents like the database column.
+func reconciledFields(p *models.Product) map[string]interface{} {
+	var stock interface{}
+	var stockInfo struct {
+		Stock *float64 `json:"stock"`
+	}
+	if err := json.Unmarshal(p.StockInfo, &stockInfo); err == nil && stockInfo.Stock != nil {
+		stock = *stockInfo.Stock
+	}
+	return map[string]interface{}{
+		"name":      p.Name,
+		"price":     math.Round(p.Price*100) / 100,
+		"stock":     stock,
+		"is_active": p.IsActive,
+	}
+}
+
+// compareProducts returns the compared fields that differ between the stored
+// and the fetched copy of a product.
+func compareProducts(stored, fetched *models.Product) map[string]FieldMismatch {
+	storedFields := reconciledFields(stored)
+	fetchedFields := reconciledFields(fetched)
+
+	diff := make(map[string]FieldMismatch)
+	for name, fetchedValue := range fetchedFields {
+		if storedValue := storedFields[name]; storedValue != fetchedValue {
+			diff[name] = FieldMismatch{DB: storedValue, Fetched: fetchedValue}
+		}
+	}
+	return diff
+}
+
+// ReconcileProduct refetches a stored product and compares its name, price,
+// stock and active flag with the database. The database is not changed; use
+// the resync endpoint to repair a mismatch.
+//
+// Parameters:
+//   - ctx: Context of the lookup and the fetch
+//   - db: Database connection
+//   - source: Marketplace of the product
+//   - productID: Product to check
+//
+// Returns:
+//   - ProductReconciliation: The comparison
+//   - error: gorm.ErrRecordNotFound if the product is not stored,
+//     ErrRequestBudgetExhausted, or any fetch or database error
+func ReconcileProduct(ctx context.Context, db *gorm.DB, source string, productID uint) (ProductReconciliation, error) {
+	result := ProductReconciliation{ProductID: productID, Source: source}
+
+	var stored models.Product
+	if err := db.WithContext(ctx).Where("id = ? AND source = ?", productID, source).First(&stored).Error; err != nil {
+		return result, err
+	}
+	if err := ReserveRequest(db, source, false); err != nil {
+		return result, err
+	}
+	fetched, err := FetchProductFrom(ctx, source, int(productID))
+	if err != nil {
+		return result, fmt.Errorf("failed to fetch product: %w", err)
+	}
+
+	result.Diff = compareProducts(&stored, fetched)
+	result.Matched = len(result.Diff) == 0
+	return result, nil
+}
+
+// RunReconciliation reconciles the given products, stores a report of the run
+// and alerts when the mismatch rate is above the threshold. Products are
+// fetched with the same pacing as fetch retries, and the run stops early once
+// the request budget is exhausted.
+//
+// Parameters:
+//   - db: Database connection
+//   - products: Products to check
+//
+// Returns:
+//   - models.ReconciliationReport: The stored report
+//   - []ProductReconciliation: The products that differ from the database
+//   - error: Any error storing the report
+func RunReconciliation(db *gorm.DB, products []models.Product) (models.ReconciliationReport, []ProductReconciliation, error) {
+	report := models.ReconciliationReport{Sampled: len(products), StartedAt: time.Now()}
+
+	mismatches := []ProductReconciliation{}
+	for i, product := range products {
+		// Rate limit requests to the marketplace
+		if i > 0 {
+			time.Sleep(retryFetchDelay)
+		}
+
+		result, err := ReconcileProduct(context.Background(), db, product.Source, product.ID)
+		if errors.Is(err, ErrRequestBudgetExhausted) {
+			logrus.WithField("remaining", len(products)-i).Warn("Stopping reconciliation, no request budget left")
+			break
+		}
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{"product_id": product.ID, "source": product.Source}).Warn("Failed to reconcile product")
+			report.FetchFailed++
+			continue
+		}
+		report.Checked++
+		if !result.Matched {
+			mismatches = append(mismatches, result)
+		}
+	}
+
+	report.Mismatched = len(mismatches)
+	if report.Checked > 0 {
+		report.MismatchRate = float64(report.Mismatched) / float64(report.Checked)
+	}
+	mismatchesJSON, err := json.Marshal(mismatches)
+	if err != nil {
+		return report, mismatches, err
+	}
+	report.Mismatches = datatypes.JSON(mismatchesJSON)
+	report.FinishedAt = time.Now()
+
+	if report.Checked > 0 && report.MismatchRate > reconcileAlertThreshold() {
+		report.Alerted = alertReconciliation(report, mismatches)
+	}
+
+	if err := db.Create(&report).Error; err != nil {
+		return report, mismatches, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"checked":       report.Checked,
+		"fetch_failed":  report.FetchFailed,
+		"mismatched":    report.Mismatched,
+		"mismatch_rate": report.MismatchRate,
+	}).Info("Reconciliation run completed")
+	return report, mismatches, nil
+}
+
+// alertReconciliation posts a mismatch alert to Slack and reports whether it
+// was delivered.
+func alertReconciliation(report models.ReconciliationReport, mismatches []ProductReconciliation) bool {
+	// Count which fields diverge most to hint at the broken code path
+	fieldCounts := make(map[string]int)
+	for _, m := range mismatches {
+		for field := range m.Diff {
+			fieldCounts[field]++
+		}
+	}
+	fields := make([]string, 0, len(fieldCounts))
+	for field := range fieldCounts {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fieldCounts[fields[i]] > fieldCounts[fields[j]] })
+	breakdown := ""
+	for _, field := range fields {
+		breakdown += fmt.Sprintf("\n• %s: %d", field, fieldCounts[field])
+	}
+
+	text := fmt.Sprintf(":warning: Reconciliation found %d of %d products (%.1f%%) differing from the marketplace, above the %.1f%% threshold.%s",
+		report.Mismatched, report.Checked, report.MismatchRate*100, reconcileAlertThreshold()*100, breakdown)
+	if err := sendSlackAlert(text); err != nil {
+		logrus.WithError(err).WithField("alert", text).Error("Failed to send reconciliation alert")
+		return false
+	}
+	return true
+}
+
+// sampleProducts picks random active products for a nightly run.
+func sampleProducts(db *gorm.DB, n int) ([]models.Product, error) {
+	var products []models.Product
+	err := db.Select("id", "source").
+		Where("is_active = ? AND discontinued_at IS NULL", true).
+		Order("random()").
+		Limit(n).
+		Find(&products).Error
+	return products, err
+}
+
+// startReconcileJob schedules the nightly reconciliation of a random sample
+// of active products.
+//
+// Environment Variables:
+//   - RECONCILE_CRON: Cron expression for the job (default: 0 3 * * *)
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startReconcileJob(db *gorm.DB) *cron.Cron {
+	spec := viper.GetString("RECONCILE_CRON")
+	if spec == "" {
+		spec = "0 3 * * *" // Every night at 03:00
+	}
+
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	if _, err := c.AddFunc(spec, func() {
+		products, err := sampleProducts(db, reconcileSampleSize())
+		if err != nil {
+			logrus.WithError(err).Error("Failed to sample products for reconciliation")
+			return
+		}
+		if _, _, err := RunReconciliation(db, products); err != nil {
+			logrus.WithError(err).Error("Failed to store reconciliation report")
+		}
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid reconciliation cron expression")
+	}
+	c.Start()
+
+	logrus.WithField("schedule", spec).Info("Reconciliation job scheduled")
+	return c
+}
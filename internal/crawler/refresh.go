@@ -0,0 +1,281 @@
+// Package crawler implements the synchronous refresh of a single product
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+	"scraper/internal/pricing"
+)
+
+// refreshColumns are the product columns a refresh overwrites. IsFavorite,
+// LocalFavoritesCount and DealScore are maintained by other paths and kept.
+var refreshColumns = []string{
+	"name", "category_path", "images", "video", "seller", "seller_id", "brand", "brand_id",
+	"rating_score", "favorites_count", "comments_count", "add_to_cart_events", "views",
+	"orders", "top_reviews", "size_recommendation", "estimated_delivery", "stock_info",
+	"price_info", "similar_products", "attributes", "other_sellers", "is_active", "price",
+	"payload_truncated", "last_seen_at", "updated_at",
+}
+
+// RefreshResult is the outcome of refreshing a product
+type RefreshResult struct {
+	Product      ProductDetail `json:"product"`       // The stored product after the refresh
+	Created      bool          `json:"created"`       // True if the product was not stored before
+	PriceChanged bool          `json:"price_changed"` // True if the price differs from the stored one
+	StockChanged bool          `json:"stock_changed"` // True if the stock differs from the stored one
+	NotFound     bool          `json:"not_found"`     // True if Trendyol returned nothing and the product was marked inactive
+	Message      string        `json:"message"`       // Human-readable summary
+}
+
+// refreshStock returns the stock quantity of a product and whether it is known.
+func refreshStock(p *models.Product) (float64, bool) {
+	var stockInfo struct {
+		Stock *float64 `json:"stock"`
+	}
+	if err := json.Unmarshal(p.StockInfo, &stockInfo); err != nil || stockInfo.Stock == nil {
+		return 0, false
+	}
+	return *stockInfo.Stock, true
+}
+
+// fetchForRefresh fetches and converts a product. The request is abandoned
+// once ctx is done.
+//
+// Returns:
+//   - *models.Product: The fetched product, nil if Trendyol returned nothing
+//     for it (404, an empty response or one without a product)
+//   - error: Any other fetch failure, such as a network error or a 5xx
+func fetchForRefresh(ctx context.Context, source string, productID int) (*models.Product, error) {
+	fetcher, err := FetcherFor(source)
+	if err != nil {
+		return nil, err
+	}
+	detail, err := fetcher.FetchDetails(ctx, productID)
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) && fetchErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if detail == nil {
+		return nil, nil
+	}
+	product, err := fetcher.ToProduct(productID, detail)
+	if err != nil {
+		// The response decoded but held no product
+		logrus.WithError(err).WithField("product_id", productID).Warn("No product in refresh response")
+		return nil, nil
+	}
+	return product, nil
+}
+
+// RefreshProduct fetches a product and writes it to the products table
+// within the call, instead of publishing it for the analysis service. A
+// price or stock change is recorded in the price history. A product that is
+// out of stock is stored inactive, like the analysis service does; one that
+// Trendyol returns nothing for is marked inactive.
+//
+// The request may use the priority reserve of the request budget, since a
+// refresh is a support action for a specific user.
+//
+// Parameters:
+//   - ctx: Context of the refresh; its queries and the fetch stop once it is done
+//   - db: Database connection
+//   - source: Marketplace of the product
+//   - productID: Product to refresh
+//
+// Returns:
+//   - RefreshResult: The stored product and what changed
+//   - error: gorm.ErrRecordNotFound if the product was deleted or Trendyol
+//     returned nothing for a product that is not stored,
+//     ErrRequestBudgetExhausted, a *FetchError, or any database error
+func RefreshProduct(ctx context.Context, db *gorm.DB, source string, productID uint) (RefreshResult, error) {
+	var result RefreshResult
+	db = db.WithContext(ctx)
+
+	// Deleted products stay deleted rather than being revived by the upsert
+	var existing models.Product
+	err := db.Unscoped().Where("id = ? AND source = ?", productID, source).First(&existing).Error
+	stored := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return result, err
+	}
+	if stored && existing.DeletedAt.Valid {
+		return result, gorm.ErrRecordNotFound
+	}
+
+	if err := ReserveRequest(db, source, true); err != nil {
+		return result, err
+	}
+	fetched, err := fetchForRefresh(ctx, source, int(productID))
+	if err != nil {
+		return result, err
+	}
+
+	now := time.Now()
+	if fetched == nil {
+		if !stored {
+			return result, gorm.ErrRecordNotFound
+		}
+		existing.IsActive = false
+		if err := db.Model(&existing).Update("is_active", false).Error; err != nil {
+			return result, err
+		}
+		result.NotFound = true
+		result.Message = "Trendyol returned nothing for the product; it was marked inactive"
+		result.Product = NewProductDetail(existing)
+		logrus.WithFields(logrus.Fields{"product_id": productID, "source": source}).Warn("Refreshed product not found on Trendyol, marked inactive")
+		return result, nil
+	}
+
+	fetched.Source = source
+	fetched.LastSeenAt = &now
+	if stock, ok := refreshStock(fetched); ok && stock == 0 {
+		fetched.IsActive = false
+	}
+	columns := refreshColumns
+	if fetched.IsActive {
+		// A discontinued product that is listed again may notify again later
+		fetched.DiscontinuedAt = nil
+		columns = append(columns[:len(columns):len(columns)], "discontinued_at")
+	}
+
+	result.Created = !stored
+	if stored {
+		oldStock, _ := refreshStock(&existing)
+		newStock, _ := refreshStock(fetched)
+		result.PriceChanged = existing.Price != fetched.Price
+		result.StockChanged = oldStock != newStock
+	}
+
+	active := fetched.IsActive
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}, {Name: "source"}},
+			DoUpdates: clause.AssignmentColumns(columns),
+		}).Create(fetched).Error
+		if err != nil {
+			return err
+		}
+		if !active {
+			// Create replaces a false is_active with the column default
+			err := tx.Model(&models.Product{}).
+				Where("id = ? AND source = ?", productID, source).
+				Update("is_active", false).Error
+			if err != nil {
+				return err
+			}
+		}
+		if !result.PriceChanged && !result.StockChanged {
+			return nil
+		}
+
+		oldStock, _ := refreshStock(&existing)
+		newStock, stockKnown := refreshStock(fetched)
+		priceLog := models.PriceStockLog{
+			ProductID:  fetched.ID,
+			Source:     source,
+			OldPrice:   fmt.Sprintf("%.2f", existing.Price),
+			NewPrice:   fmt.Sprintf("%.2f", fetched.Price),
+			OldStock:   fmt.Sprintf("%.0f", oldStock),
+			NewStock:   fmt.Sprintf("%.0f", newStock),
+			PriceValue: &fetched.Price,
+			ChangeTime: now,
+		}
+		if stockKnown {
+			priceLog.StockValue = &newStock
+		}
+		return tx.Create(&priceLog).Error
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if result.PriceChanged {
+		if _, err := pricing.RefreshDealScore(db, fetched.ID, source, fetched.Price); err != nil {
+			logrus.WithError(err).WithField("product_id", productID).Error("Failed to refresh deal score")
+		}
+	}
+	if err := ClearFetchRetry(db, source, int(productID)); err != nil {
+		logrus.WithError(err).WithField("product_id", productID).Error("Failed to clear fetch retry")
+	}
+
+	var refreshed models.Product
+	if err := db.Where("id = ? AND source = ?", productID, source).First(&refreshed).Error; err != nil {
+		return result, err
+	}
+	result.Product = NewProductDetail(refreshed)
+	switch {
+	case result.Created:
+		result.Message = "Product fetched and stored"
+	case result.PriceChanged || result.StockChanged:
+		result.Message = "Product refreshed; the price or stock change was recorded"
+	default:
+		result.Message = "Product refreshed; price and stock are unchanged"
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"product_id":    productID,
+		"source":        source,
+		"price_changed": result.PriceChanged,
+		"stock_changed": result.StockChanged,
+	}).Info("Product refreshed")
+	return result, nil
+}
+
+// registerRefreshHandlers sets up the product refresh endpoint. It requires
+// the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerRefreshHandlers(e *echo.Echo, db *gorm.DB) {
+	admin := e.Group("", requireAPIKey())
+
+	// POST /products/:id/refresh
+	// Fetches a product from Trendyol and stores it within the request, for
+	// support cases where a user reports a stale price and waiting for the
+	// scheduler is not an option. Returns the refreshed product; if Trendyol
+	// returns nothing the product is marked inactive and not_found is set.
+	// Query parameters:
+	//   - source: Marketplace of the product (default: trendyol)
+	admin.POST("/products/:id/refresh", func(c echo.Context) error {
+		id, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+
+		result, err := RefreshProduct(c.Request().Context(), db, source, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
+		if errors.Is(err, ErrRequestBudgetExhausted) {
+			return err
+		}
+		var fetchErr *FetchError
+		if errors.As(err, &fetchErr) {
+			return apierror.Upstream("Failed to fetch product", err)
+		}
+		if err != nil {
+			return apierror.Internal("Failed to refresh product", err)
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
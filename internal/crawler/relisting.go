@@ -0,0 +1,183 @@
+// Package crawler implements the weekly relisting check that finds inactive
+// products listed again
+package crawler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+// RelistingResult is the outcome of a relisting check
+type RelistingResult struct {
+	Checked     int  // Inactive products fetched
+	Relisted    int  // Products listed and in stock again, published and recorded
+	StillGone   int  // Products that are still missing or out of stock
+	Failed      int  // Fetches that failed, or relisted products that could not be published
+	BudgetLimit bool // Whether the check stopped early for lack of request budget
+}
+
+// relistingBatchSize returns the most inactive products a check fetches.
+//
+// Environment Variables:
+//   - RELISTING_BATCH_SIZE: Products checked per run (default: 200)
+func relistingBatchSize() int {
+	size := viper.GetInt("RELISTING_BATCH_SIZE")
+	if size <= 0 {
+		size = 200
+	}
+	return size
+}
+
+// relistingCandidates returns the inactive products to check: the most
+// watched first, and of those the most recently deactivated first, since a
+// product that vanished lately is the likeliest to come back. Products that
+// went inactive for being out of stock have no discontinued_at and count as
+// deactivated at their last update.
+func relistingCandidates(db *gorm.DB, n int) ([]models.Product, error) {
+	var products []models.Product
+	err := db.Select("id", "source", "discontinued_at").
+		Where("is_active = ?", false).
+		Order("local_favorites_count DESC").
+		Order("COALESCE(discontinued_at, updated_at) DESC").
+		Limit(n).
+		Find(&products).Error
+	return products, err
+}
+
+// RunRelistingCheck fetches a batch of inactive products from their
+// marketplace. Those that are listed and in stock again are published to the
+// PRODUCTS topic like a regular crawl, which reactivates them and tells the
+// users notified of their discontinuation that they are back, and each is
+// recorded in product_relistings. The check only uses the regular request
+// budget, never the priority reserve, and stops once it is spent.
+//
+// Parameters:
+//   - db: Database connection
+//   - producer: Kafka producer for publishing relisted products
+//   - n: Most products to check
+//
+// Returns:
+//   - RelistingResult: Products checked, relisted and still gone
+//   - error: Any database error while loading the candidates
+func RunRelistingCheck(db *gorm.DB, producer sarama.SyncProducer, n int) (RelistingResult, error) {
+	var result RelistingResult
+	candidates, err := relistingCandidates(db, n)
+	if err != nil {
+		return result, err
+	}
+
+	var relisted []models.Product
+	var inactiveSince []*time.Time
+	for i, candidate := range candidates {
+		// Rate limit requests to Trendyol
+		if i > 0 {
+			time.Sleep(retryFetchDelay)
+		}
+
+		if err := ReserveRequest(db, candidate.Source, false); err != nil {
+			if !errors.Is(err, ErrRequestBudgetExhausted) {
+				logrus.WithError(err).Error("Failed to reserve request budget, stopping relisting check")
+				break
+			}
+			result.BudgetLimit = true
+			logrus.WithField("remaining", len(candidates)-i).Warn("Stopping relisting check, no request budget left")
+			break
+		}
+		result.Checked++
+
+		product, err := fetchForRefresh(context.Background(), candidate.Source, int(candidate.ID))
+		if err != nil {
+			result.Failed++
+			logrus.WithError(err).WithField("product_id", candidate.ID).Warn("Relisting check fetch failed")
+			continue
+		}
+		if product == nil || !product.IsActive {
+			result.StillGone++
+			continue
+		}
+		product.Source = candidate.Source
+		relisted = append(relisted, *product)
+		inactiveSince = append(inactiveSince, candidate.DiscontinuedAt)
+	}
+
+	if len(relisted) > 0 {
+		summary := publishProducts(context.Background(), producer, relisted, defaultFetchBatchSize())
+		unsent := make([]bool, len(relisted))
+		for _, batch := range summary.Failed {
+			for i := batch.Start; i < batch.End; i++ {
+				unsent[i] = true
+			}
+		}
+		for i, product := range relisted {
+			if unsent[i] {
+				result.Failed++
+				continue
+			}
+			result.Relisted++
+			err := db.Create(&models.ProductRelisting{
+				ProductID:     product.ID,
+				Source:        product.Source,
+				InactiveSince: inactiveSince[i],
+				Price:         product.Price,
+			}).Error
+			if err != nil {
+				logrus.WithError(err).WithField("product_id", product.ID).Error("Failed to record relisting")
+			}
+			logrus.WithFields(logrus.Fields{
+				"product_id": product.ID,
+				"source":     product.Source,
+			}).Info("Inactive product is listed again")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"checked":      result.Checked,
+		"relisted":     result.Relisted,
+		"still_gone":   result.StillGone,
+		"failed":       result.Failed,
+		"budget_limit": result.BudgetLimit,
+	}).Info("Relisting check completed")
+	return result, nil
+}
+
+// startRelistingJob schedules the weekly relisting check. Inactive products
+// are left out of the favorites scheduler, so without it a product that is
+// listed again only comes back with a full crawl.
+//
+// Environment Variables:
+//   - RELISTING_CRON: Cron expression for the job (default: 0 4 * * 0)
+//
+// Parameters:
+//   - db: Database connection
+//   - producer: Kafka producer for publishing relisted products
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startRelistingJob(db *gorm.DB, producer sarama.SyncProducer) *cron.Cron {
+	spec := viper.GetString("RELISTING_CRON")
+	if spec == "" {
+		spec = "0 4 * * 0" // Sundays at 04:00
+	}
+
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	if _, err := c.AddFunc(spec, func() {
+		if _, err := RunRelistingCheck(db, producer, relistingBatchSize()); err != nil {
+			logrus.WithError(err).Error("Failed to load inactive products for the relisting check")
+		}
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid relisting cron expression")
+	}
+	c.Start()
+
+	logrus.WithField("schedule", spec).Info("Relisting job scheduled")
+	return c
+}
@@ -0,0 +1,53 @@
+package crawler
+
+import (
+	"testing"
+	"time"
+
+	"scraper/internal/models"
+)
+
+func TestRelistingCandidatesOrder(t *testing.T) {
+	db := openStressDB(t)
+
+	source := models.SourceTrendyol
+	now := time.Now()
+	earlier, later := now.Add(-48*time.Hour), now.Add(-time.Hour)
+	rows := []*models.Product{
+		{ID: stressBaseID, Source: source, IsActive: true, LocalFavoritesCount: 9},
+		{ID: stressBaseID + 1, Source: source, LocalFavoritesCount: 1, DiscontinuedAt: &later},
+		{ID: stressBaseID + 2, Source: source, LocalFavoritesCount: 5, DiscontinuedAt: &earlier},
+		{ID: stressBaseID + 3, Source: source, LocalFavoritesCount: 5, DiscontinuedAt: &later},
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+		// Create replaces a false is_active with the column default
+		if !row.IsActive {
+			db.Model(row).Update("is_active", false)
+		}
+	}
+
+	candidates, err := relistingCandidates(db.Where("id >= ?", stressBaseID), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint{stressBaseID + 3, stressBaseID + 2, stressBaseID + 1}
+	if len(candidates) != len(want) {
+		t.Fatalf("got %d candidates, want %d", len(candidates), len(want))
+	}
+	for i, id := range want {
+		if candidates[i].ID != id {
+			t.Errorf("candidate %d = %d, want %d", i, candidates[i].ID, id)
+		}
+	}
+
+	capped, err := relistingCandidates(db.Where("id >= ?", stressBaseID), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(capped) != 1 || capped[0].ID != stressBaseID+3 {
+		t.Errorf("capped candidates = %+v, want only %d", capped, stressBaseID+3)
+	}
+}
@@ -0,0 +1,279 @@
+// Package crawler implements the persistent retry queue for product fetches
+// that failed during a crawl or a favorites scheduler run
+package crawler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+// Fetch retry statuses
+const (
+	FetchRetryPending = "pending" // Waiting for the next attempt
+	FetchRetryFailed  = "failed"  // Attempt cap reached or the error is not transient
+)
+
+// Fetch retry sources
+const (
+	FetchSourceCrawl     = "crawl"     // Failed during a /fetch crawl
+	FetchSourceScheduler = "scheduler" // Failed during a favorites scheduler run
+)
+
+// retryFetchDelay is the pause between Trendyol requests made by the retry job
+const retryFetchDelay = 2 * time.Second
+
+// FetchRetryStats summarizes the retry queue for the stats endpoint.
+type FetchRetryStats struct {
+	Pending        int64               `json:"pending"`         // Products waiting for a retry
+	Failed         int64               `json:"failed"`          // Products that will not be retried
+	FailedProducts []models.FetchRetry `json:"failed_products"` // Details of the failed products
+}
+
+// RecordFetchFailure records a failed product fetch in the retry queue. The
+// attempt count is incremented and the next attempt is scheduled with
+// exponential backoff. Once FETCH_RETRY_MAX_ATTEMPTS is reached, or if the
+// error is not transient (e.g. a 404), the product is marked as failed.
+//
+// Environment Variables:
+//   - FETCH_RETRY_MAX_ATTEMPTS: Attempts before giving up (default: 5)
+//   - FETCH_RETRY_BASE_DELAY: Delay before the first retry (default: 5m)
+//   - FETCH_RETRY_MAX_DELAY: Upper bound on the backoff (default: 6h)
+//
+// Parameters:
+//   - db: Database connection
+//   - productSource: Marketplace of the product
+//   - productID: Product that could not be fetched
+//   - source: Where the failure happened (FetchSourceCrawl or FetchSourceScheduler)
+//   - fetchErr: The fetch error
+//
+// Returns:
+//   - uint: ID of the retry queue entry, which a scheduler run links to
+//   - error: Any database error
+func RecordFetchFailure(db *gorm.DB, productSource string, productID int, source string, fetchErr error) (uint, error) {
+	var retry models.FetchRetry
+	err := db.Where("product_id = ? AND product_source = ?", productID, productSource).First(&retry).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+
+	retry.ProductID = uint(productID)
+	retry.ProductSource = productSource
+	retry.Source = source
+	retry.Error = fetchErr.Error()
+	retry.Attempts++
+	retry.Status = FetchRetryPending
+	retry.NextAttemptAt = time.Now().Add(retryBackoff(retry.Attempts))
+
+	// Give up once the cap is reached or the failure is permanent
+	var fe *FetchError
+	retry.StatusCode = 0
+	if errors.As(fetchErr, &fe) {
+		retry.StatusCode = fe.StatusCode
+	}
+	if retry.Attempts >= retryMaxAttempts() || (fe != nil && !fe.Retryable()) {
+		retry.Status = FetchRetryFailed
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"product_id":     productID,
+		"product_source": productSource,
+		"source":         source,
+		"attempts":       retry.Attempts,
+		"status":         retry.Status,
+		"next":           retry.NextAttemptAt,
+	}).Warn("Recorded product fetch failure")
+	if err := db.Save(&retry).Error; err != nil {
+		return 0, err
+	}
+	return retry.ID, nil
+}
+
+// ClearFetchRetry removes a product from the retry queue after a successful
+// fetch. The row is deleted permanently so the product can be queued again.
+//
+// Parameters:
+//   - db: Database connection
+//   - productSource: Marketplace of the product
+//   - productID: Product that was fetched
+//
+// Returns:
+//   - error: Any database error
+func ClearFetchRetry(db *gorm.DB, productSource string, productID int) error {
+	return db.Unscoped().Where("product_id = ? AND product_source = ?", productID, productSource).Delete(&models.FetchRetry{}).Error
+}
+
+// startRetryJob schedules the periodic retry of failed product fetches.
+//
+// Environment Variables:
+//   - FETCH_RETRY_CRON: Cron expression for the retry job (default: */5 * * * *)
+//
+// Parameters:
+//   - db: Database connection
+//   - producer: Kafka producer for publishing recovered products
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startRetryJob(db *gorm.DB, producer sarama.SyncProducer) *cron.Cron {
+	spec := viper.GetString("FETCH_RETRY_CRON")
+	if spec == "" {
+		spec = "*/5 * * * *" // Every five minutes
+	}
+
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	if _, err := c.AddFunc(spec, func() {
+		runFetchRetries(db, producer)
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid fetch retry cron expression")
+	}
+	c.Start()
+
+	logrus.WithField("schedule", spec).Info("Fetch retry job scheduled")
+	return c
+}
+
+// runFetchRetries refetches every pending product whose next attempt is due,
+// using the fetcher registered for the product's source.
+// Recovered products are published to the PRODUCTS topic like a regular crawl
+// and removed from the queue once their batch is sent. Failures are recorded
+// again, which pushes the next attempt further out.
+//
+// Environment Variables:
+//   - FETCH_RETRY_BATCH_SIZE: Maximum products retried per run (default: 50)
+//
+// Parameters:
+//   - db: Database connection
+//   - producer: Kafka producer for publishing recovered products
+func runFetchRetries(db *gorm.DB, producer sarama.SyncProducer) {
+	limit := viper.GetInt("FETCH_RETRY_BATCH_SIZE")
+	if limit <= 0 {
+		limit = 50
+	}
+
+	var due []models.FetchRetry
+	if err := db.Where("status = ? AND next_attempt_at <= ?", FetchRetryPending, time.Now()).
+		Order("next_attempt_at").
+		Limit(limit).
+		Find(&due).Error; err != nil {
+		logrus.WithError(err).Error("Failed to load due fetch retries")
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	var products []models.Product
+	for i, retry := range due {
+		// Rate limit requests to Trendyol
+		if i > 0 {
+			time.Sleep(retryFetchDelay)
+		}
+
+		productID := int(retry.ProductID)
+
+		// Leave the rest queued until the request budget resets
+		if err := ReserveRequest(db, retry.ProductSource, false); err != nil {
+			logrus.WithError(err).WithField("remaining", len(due)-i).Warn("Stopping fetch retries, no request budget left")
+			break
+		}
+
+		product, err := FetchProductFrom(context.Background(), retry.ProductSource, productID)
+		if err == nil {
+			products = append(products, *product)
+			continue
+		}
+		if _, err := RecordFetchFailure(db, retry.ProductSource, productID, retry.Source, err); err != nil {
+			logrus.WithError(err).WithField("product_id", productID).Error("Failed to record fetch failure")
+		}
+	}
+
+	// Publish recovered products and dequeue the ones that were sent
+	recovered := 0
+	if len(products) > 0 {
+		summary := publishProducts(context.Background(), producer, products, defaultFetchBatchSize())
+		unsent := make([]bool, len(products))
+		for _, batch := range summary.Failed {
+			for i := batch.Start; i < batch.End; i++ {
+				unsent[i] = true
+			}
+		}
+		for i, product := range products {
+			if unsent[i] {
+				continue
+			}
+			if err := ClearFetchRetry(db, product.Source, int(product.ID)); err != nil {
+				logrus.WithError(err).WithField("product_id", product.ID).Error("Failed to clear fetch retry")
+				continue
+			}
+			recovered++
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"due":       len(due),
+		"recovered": recovered,
+	}).Info("Fetch retry run completed")
+}
+
+// getFetchRetryStats counts pending and failed retries and lists the products
+// that will no longer be retried.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - FetchRetryStats: Queue summary
+//   - error: Any database error
+func getFetchRetryStats(db *gorm.DB) (FetchRetryStats, error) {
+	stats := FetchRetryStats{FailedProducts: []models.FetchRetry{}}
+	if err := db.Model(&models.FetchRetry{}).Where("status = ?", FetchRetryPending).Count(&stats.Pending).Error; err != nil {
+		return stats, err
+	}
+	if err := db.Model(&models.FetchRetry{}).Where("status = ?", FetchRetryFailed).Count(&stats.Failed).Error; err != nil {
+		return stats, err
+	}
+	if err := db.Where("status = ?", FetchRetryFailed).Order("updated_at DESC").Find(&stats.FailedProducts).Error; err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// retryBackoff returns the delay before the next attempt, doubling with each
+// failed attempt up to FETCH_RETRY_MAX_DELAY.
+func retryBackoff(attempts int) time.Duration {
+	base := viper.GetDuration("FETCH_RETRY_BASE_DELAY")
+	if base <= 0 {
+		base = 5 * time.Minute
+	}
+	max := viper.GetDuration("FETCH_RETRY_MAX_DELAY")
+	if max <= 0 {
+		max = 6 * time.Hour
+	}
+
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// retryMaxAttempts returns the number of attempts after which a product is
+// marked as failed.
+func retryMaxAttempts() int {
+	attempts := viper.GetInt("FETCH_RETRY_MAX_ATTEMPTS")
+	if attempts <= 0 {
+		attempts = 5
+	}
+	return attempts
+}
@@ -0,0 +1,227 @@
+// Package crawler implements the priority the favorites scheduler refreshes
+// products in, and the per-run cap that cuts its run order off
+package crawler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// Weights of the priority score. Watchers count logarithmically, so a hot
+// product is refreshed more often without starving the rest: a product with
+// one watcher overtakes one with a thousand after about 15 hours without a
+// refresh.
+const (
+	priorityWatcherWeight    = 10.0               // Points per doubling of the watchers
+	priorityStalenessWeight  = 1.0                // Points per stalenessUnit since the last refresh
+	priorityStalenessUnit    = 10 * time.Minute   // Staleness of one point
+	priorityStalenessCap     = 24 * time.Hour     // Staleness counts up to this long
+	priorityChangeWeight     = 5.0                // Points per price or stock change in the volatility window
+	priorityChangeCap        = 10                 // Changes counted at most
+	priorityBoost            = 1000.0             // Points of an operator boost, enough to come first
+	priorityVolatilityWindow = 7 * 24 * time.Hour // How far back changes count as volatility
+)
+
+// PriorityInputs are what a scheduled product's priority score is computed from
+type PriorityInputs struct {
+	Watchers     int64      // Users who favorited the product
+	LastSeenAt   *time.Time // Last crawl or refresh of the product, nil if never
+	RecentLogs   int64      // Price or stock changes logged in the volatility window
+	RefreshBoost bool       // Set by an operator through PUT /products/:id/refresh-boost
+}
+
+// PriorityScore scores a scheduled product; the favorites scheduler
+// refreshes the highest scores first. The score adds up:
+//   - 10 points per doubling of the watchers
+//   - 1 point per 10 minutes since the last refresh, up to 24 hours; a
+//     product never seen counts as 24 hours stale
+//   - 5 points per change in the last 7 days, up to 10 changes
+//   - 1000 points when boosted
+//
+// Parameters:
+//   - in: The product's inputs
+//   - now: Time the score is computed at
+//
+// Returns:
+//   - float64: The score, 0 or more
+func PriorityScore(in PriorityInputs, now time.Time) float64 {
+	score := 0.0
+	if in.Watchers > 0 {
+		score += priorityWatcherWeight * math.Log2(1+float64(in.Watchers))
+	}
+
+	staleness := priorityStalenessCap
+	if in.LastSeenAt != nil {
+		staleness = now.Sub(*in.LastSeenAt)
+	}
+	if staleness > priorityStalenessCap {
+		staleness = priorityStalenessCap
+	}
+	if staleness > 0 {
+		score += priorityStalenessWeight * float64(staleness) / float64(priorityStalenessUnit)
+	}
+
+	changes := in.RecentLogs
+	if changes > priorityChangeCap {
+		changes = priorityChangeCap
+	}
+	if changes > 0 {
+		score += priorityChangeWeight * float64(changes)
+	}
+
+	if in.RefreshBoost {
+		score += priorityBoost
+	}
+	return score
+}
+
+// RankedProduct is a product of ScheduledProducts with its priority score
+// and place in the favorites scheduler's run order
+type RankedProduct struct {
+	ID           uint       // Product identifier within its source
+	Source       string     // Marketplace of the product
+	Watchers     int64      // Users who favorited the product
+	LastSeenAt   *time.Time // Last crawl or refresh, nil if never
+	RecentLogs   int64      // Price or stock changes logged in the last 7 days
+	RefreshBoost bool       // Boosted by an operator
+	Score        float64    `gorm:"-"` // PriorityScore of the product
+	Position     int64      `gorm:"-"` // 1-based place in the run order
+}
+
+// RankScheduledProducts orders the products of ScheduledProducts the way the
+// favorites scheduler refreshes them: highest PriorityScore first, then most
+// watched, then by source and ID. The scheduler, the notification debug
+// endpoint and GET /scheduler/queue all read this ranking.
+//
+// Parameters:
+//   - db: Database connection
+//   - now: Time the scores are computed at
+//
+// Returns:
+//   - []RankedProduct: Every scheduled product in run order
+//   - error: Any database error
+func RankScheduledProducts(db *gorm.DB, now time.Time) ([]RankedProduct, error) {
+	var ranked []RankedProduct
+	if err := db.Table("(?) AS scheduled", ScheduledProducts(db, now.Add(-priorityVolatilityWindow))).
+		Scan(&ranked).Error; err != nil {
+		return nil, err
+	}
+	for i := range ranked {
+		p := &ranked[i]
+		p.Score = PriorityScore(PriorityInputs{
+			Watchers:     p.Watchers,
+			LastSeenAt:   p.LastSeenAt,
+			RecentLogs:   p.RecentLogs,
+			RefreshBoost: p.RefreshBoost,
+		}, now)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Watchers != b.Watchers {
+			return a.Watchers > b.Watchers
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.ID < b.ID
+	})
+	for i := range ranked {
+		ranked[i].Position = int64(i + 1)
+	}
+	return ranked, nil
+}
+
+// MaxProductsPerRun returns how many products of the run order one
+// favorites scheduler run refreshes; the rest wait for later runs, where
+// their growing staleness moves them up.
+//
+// Environment Variables:
+//   - FAVORITES_MAX_PRODUCTS_PER_RUN: Products per run (default: 30, what fits
+//     in a minute at FavoritesFetchDelay)
+func MaxProductsPerRun() int {
+	max := viper.GetInt("FAVORITES_MAX_PRODUCTS_PER_RUN")
+	if max <= 0 {
+		max = int(time.Minute / FavoritesFetchDelay)
+	}
+	return max
+}
+
+// SetRefreshBoost sets or clears the operator boost of a product, which
+// puts it at the front of the favorites scheduler's run order.
+//
+// Parameters:
+//   - db: Database connection
+//   - productID: ID of the product
+//   - source: Marketplace of the product
+//   - boost: Whether the product is boosted
+//
+// Returns:
+//   - error: gorm.ErrRecordNotFound if the product does not exist, or any
+//     database error
+func SetRefreshBoost(db *gorm.DB, productID uint, source string, boost bool) error {
+	result := db.Model(&models.Product{}).
+		Where("id = ? AND source = ?", productID, source).
+		UpdateColumn("refresh_boost", boost)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// registerRefreshBoostHandlers sets up the refresh boost endpoint. It
+// requires the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerRefreshBoostHandlers(e *echo.Echo, db *gorm.DB) {
+	admin := e.Group("", requireAPIKey())
+
+	// PUT /products/:id/refresh-boost
+	// Boosts a product to the front of the favorites scheduler's run order,
+	// or removes the boost
+	// Query parameters:
+	//   - source: Marketplace of the product (default: trendyol)
+	// Request body: {"boost": bool}
+	admin.PUT("/products/:id/refresh-boost", func(c echo.Context) error {
+		id, err := models.ParseProductID(c.Param("id"))
+		if err != nil {
+			return apierror.Invalid("Invalid product ID")
+		}
+		source, err := NormalizeSource(c.QueryParam("source"))
+		if err != nil {
+			return apierror.Invalid(err.Error())
+		}
+		var req struct {
+			Boost *bool `json:"boost"` // Whether the product is boosted
+		}
+		if err := c.Bind(&req); err != nil || req.Boost == nil {
+			return apierror.Invalid("boost must be true or false")
+		}
+
+		err = SetRefreshBoost(db, id, source, *req.Boost)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound(apierror.CodeProductNotFound, "Product not found")
+		}
+		if err != nil {
+			return apierror.Internal("Failed to update refresh boost", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"product_id": id, "source": source, "boost": *req.Boost})
+	})
+}
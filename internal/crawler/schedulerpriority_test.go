@@ -0,0 +1,76 @@
+package crawler
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+func TestPriorityScore(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) *time.Time {
+		at := now.Add(-d)
+		return &at
+	}
+
+	tests := []struct {
+		name string
+		in   PriorityInputs
+		want float64
+	}{
+		{"just refreshed, one watcher", PriorityInputs{Watchers: 1, LastSeenAt: ago(0)}, 10},
+		{"watchers count per doubling", PriorityInputs{Watchers: 3, LastSeenAt: ago(0)}, 20},
+		{"staleness per 10 minutes", PriorityInputs{Watchers: 1, LastSeenAt: ago(time.Hour)}, 16},
+		{"staleness capped at a day", PriorityInputs{Watchers: 1, LastSeenAt: ago(72 * time.Hour)}, 154},
+		{"never seen counts as a day", PriorityInputs{Watchers: 1}, 154},
+		{"seen in the future counts as fresh", PriorityInputs{Watchers: 1, LastSeenAt: ago(-time.Hour)}, 10},
+		{"changes in the window", PriorityInputs{Watchers: 1, LastSeenAt: ago(0), RecentLogs: 3}, 25},
+		{"changes capped", PriorityInputs{Watchers: 1, LastSeenAt: ago(0), RecentLogs: 50}, 60},
+		{"boost", PriorityInputs{Watchers: 1, LastSeenAt: ago(0), RefreshBoost: true}, 1010},
+	}
+	for _, tt := range tests {
+		if got := PriorityScore(tt.in, now); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: PriorityScore = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A hot product refreshed just now yields to a cold one left for a day,
+	// but not to one refreshed an hour ago
+	hot := PriorityScore(PriorityInputs{Watchers: 1023, LastSeenAt: ago(0)}, now)
+	if cold := PriorityScore(PriorityInputs{Watchers: 1, LastSeenAt: ago(24 * time.Hour)}, now); cold <= hot {
+		t.Errorf("cold product left for a day scores %v, want above the hot product's %v", cold, hot)
+	}
+	if recent := PriorityScore(PriorityInputs{Watchers: 1, LastSeenAt: ago(time.Hour)}, now); recent >= hot {
+		t.Errorf("cold product refreshed an hour ago scores %v, want below the hot product's %v", recent, hot)
+	}
+}
+
+func TestNextScheduledCheck(t *testing.T) {
+	schedule, err := cron.ParseStandard(FavoritesSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 5, 1, 12, 0, 30, 0, time.UTC)
+	next := time.Date(2026, 5, 1, 12, 1, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		position     int64
+		priority     bool
+		priorityOnly bool
+		want         time.Time
+	}{
+		{"first of the next run", 1, true, false, next.Add(FavoritesFetchDelay)},
+		{"last of the next run", 30, false, false, next.Add(30 * FavoritesFetchDelay)},
+		{"past the cut-off", 31, false, false, next.Add(time.Minute + FavoritesFetchDelay)},
+		{"regular while priority only", 2, false, true, time.Date(2026, 5, 2, 0, 0, 0, 0, time.UTC).Add(2 * FavoritesFetchDelay)},
+	}
+	for _, tt := range tests {
+		got := nextScheduledCheck(schedule, now, tt.position, 30, tt.priority, tt.priorityOnly)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: nextScheduledCheck = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package crawler implements the view of the favorites scheduler's queue:
+// which products its next runs refresh, in which order, why and roughly when
+package crawler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// Limits of GET /scheduler/queue
+const (
+	defaultSchedulerQueueLimit = 50
+	maxSchedulerQueueLimit     = 500
+)
+
+// Priority bands of scheduled products
+const (
+	BandPriority = "priority" // Among the first TRENDYOL_BUDGET_PRIORITY_PRODUCTS of the run order; refreshed from the reserve
+	BandRegular  = "regular"  // Only refreshed while the regular request budget lasts
+)
+
+// ScheduledProduct is a product in the favorites scheduler's run order
+type ScheduledProduct struct {
+	Position      int64      `json:"position"`        // 1-based place in the run order
+	ProductID     uint       `json:"product_id"`      // Product identifier within its source
+	Source        string     `json:"source"`          // Marketplace of the product
+	Score         float64    `json:"score"`           // PriorityScore the run order is sorted by
+	Watchers      int64      `json:"watchers"`        // Users who favorited the product
+	LastSeenAt    *time.Time `json:"last_seen_at"`    // Last crawl or refresh, nil if never
+	RecentChanges int64      `json:"recent_changes"`  // Price or stock changes logged in the last 7 days
+	Boosted       bool       `json:"boosted"`         // Boosted by an operator
+	Priority      string     `json:"priority"`        // BandPriority or BandRegular
+	InNextRun     bool       `json:"in_next_run"`     // Within the next run's cut-off
+	LastChangedAt *time.Time `json:"last_changed_at"` // Last logged price or stock change, nil if none
+	NextCheckAt   *time.Time `json:"next_check_at"`   // Estimated refresh time, nil while the scheduler is paused
+}
+
+// SchedulerBand counts the scheduled products of a priority band
+type SchedulerBand struct {
+	Band     string `json:"band"`     // BandPriority or BandRegular
+	Products int64  `json:"products"` // Products in the band
+	Watchers int64  `json:"watchers"` // Watchers of those products
+}
+
+// SchedulerQueue is the favorites scheduler's queue as of GeneratedAt
+type SchedulerQueue struct {
+	GeneratedAt      time.Time          `json:"generated_at"`
+	Paused           bool               `json:"paused"`
+	PriorityOnly     bool               `json:"priority_only"`     // Regular budget spent; the regular band waits for midnight UTC
+	PriorityProducts int                `json:"priority_products"` // TRENDYOL_BUDGET_PRIORITY_PRODUCTS
+	MaxPerRun        int                `json:"max_per_run"`       // FAVORITES_MAX_PRODUCTS_PER_RUN, the cut-off of each run
+	NextRunAt        *time.Time         `json:"next_run_at"`       // Start of the next run, nil while paused
+	Total            int64              `json:"total"`             // Products the scheduler refreshes
+	Bands            []SchedulerBand    `json:"bands"`
+	Products         []ScheduledProduct `json:"products"` // The first products in run order
+}
+
+// nextScheduledCheck estimates when a run of the favorites scheduler
+// refreshes the product at position. Each run takes the next maxPerRun
+// products and pauses FavoritesFetchDelay before each fetch, so the product
+// is fetched in run (position-1)/maxPerRun from now, its place in that run
+// delays after the run starts. Regular products wait for the first run after
+// midnight UTC while only the priority reserve is left. The estimate keeps
+// today's order, though scores change as products are refreshed, and does
+// not predict runs that stop early because the budget ran out.
+//
+// Parameters:
+//   - schedule: The scheduler's cron schedule
+//   - now: Time the estimate is made at
+//   - position: 1-based place of the product in the run order
+//   - maxPerRun: Products each run refreshes
+//   - priority: Whether the product is in the priority band
+//   - priorityOnly: Whether only the priority reserve is left today
+//
+// Returns:
+//   - time.Time: Estimated refresh time
+func nextScheduledCheck(schedule cron.Schedule, now time.Time, position int64, maxPerRun int, priority, priorityOnly bool) time.Time {
+	after := now
+	if priorityOnly && !priority {
+		// The budget resets at midnight UTC; the first run from then on
+		after = now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Add(-time.Nanosecond)
+	}
+	run := schedule.Next(after)
+	for i := int64(0); i < (position-1)/int64(maxPerRun); i++ {
+		run = schedule.Next(run)
+	}
+	return run.Add(time.Duration((position-1)%int64(maxPerRun)+1) * FavoritesFetchDelay)
+}
+
+// GetSchedulerQueue returns the favorites scheduler's run order with the
+// priority score, cut-off and estimated refresh time of each product and the
+// totals by priority band. It reads RankScheduledProducts, the ranking the
+// scheduler itself runs.
+//
+// Parameters:
+//   - db: Database connection
+//   - limit: Products to list, from the start of the run order
+//
+// Returns:
+//   - SchedulerQueue: The queue
+//   - error: Any database error
+func GetSchedulerQueue(db *gorm.DB, limit int) (SchedulerQueue, error) {
+	now := time.Now()
+	queue := SchedulerQueue{GeneratedAt: now, PriorityProducts: PriorityProductCount(), MaxPerRun: MaxProductsPerRun()}
+
+	state, err := GetSchedulerState(db, SchedulerFavorites)
+	if err != nil {
+		return queue, err
+	}
+	budget, err := GetRequestBudgetStatus(db)
+	if err != nil {
+		return queue, err
+	}
+	queue.Paused = state.Paused
+	queue.PriorityOnly = budget.PriorityOnly
+	schedule, err := cron.ParseStandard(FavoritesSchedule)
+	if err != nil {
+		return queue, err
+	}
+	if !queue.Paused {
+		next := schedule.Next(now)
+		queue.NextRunAt = &next
+	}
+
+	ranked, err := RankScheduledProducts(db, now)
+	if err != nil {
+		return queue, err
+	}
+
+	// Totals by band over the whole run order
+	queue.Bands = []SchedulerBand{{Band: BandPriority}, {Band: BandRegular}}
+	for _, product := range ranked {
+		band := &queue.Bands[1]
+		if product.Position <= int64(queue.PriorityProducts) {
+			band = &queue.Bands[0]
+		}
+		band.Products++
+		band.Watchers += product.Watchers
+	}
+	queue.Total = int64(len(ranked))
+
+	// The first products
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	queue.Products = make([]ScheduledProduct, len(ranked))
+	keys := make([][]interface{}, len(ranked))
+	for i, r := range ranked {
+		priority := r.Position <= int64(queue.PriorityProducts)
+		product := ScheduledProduct{
+			Position:      r.Position,
+			ProductID:     r.ID,
+			Source:        r.Source,
+			Score:         math.Round(r.Score*10) / 10,
+			Watchers:      r.Watchers,
+			LastSeenAt:    r.LastSeenAt,
+			RecentChanges: r.RecentLogs,
+			Boosted:       r.RefreshBoost,
+			Priority:      BandRegular,
+			InNextRun:     r.Position <= int64(queue.MaxPerRun) && (!queue.PriorityOnly || priority),
+		}
+		if priority {
+			product.Priority = BandPriority
+		}
+		if !queue.Paused {
+			next := nextScheduledCheck(schedule, now, r.Position, queue.MaxPerRun, priority, queue.PriorityOnly)
+			product.NextCheckAt = &next
+		}
+		queue.Products[i] = product
+		keys[i] = []interface{}{r.ID, r.Source}
+	}
+
+	// The last change of each listed product
+	if len(keys) > 0 {
+		var changes []struct {
+			ProductID     uint
+			Source        string
+			LastChangedAt time.Time
+		}
+		err = db.Model(&models.PriceStockLog{}).
+			Select("product_id, source, MAX(change_time) AS last_changed_at").
+			Where("(product_id, source) IN ?", keys).
+			Group("product_id, source").
+			Scan(&changes).Error
+		if err != nil {
+			return queue, err
+		}
+		for _, change := range changes {
+			change := change
+			for i := range queue.Products {
+				if queue.Products[i].ProductID == change.ProductID && queue.Products[i].Source == change.Source {
+					queue.Products[i].LastChangedAt = &change.LastChangedAt
+				}
+			}
+		}
+	}
+	return queue, nil
+}
+
+// registerSchedulerQueueHandlers sets up the scheduler queue endpoint. It
+// requires the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerSchedulerQueueHandlers(e *echo.Echo, db *gorm.DB) {
+	admin := e.Group("", requireAPIKey())
+
+	// GET /scheduler/queue
+	// Lists the products the favorites scheduler refreshes, in run order,
+	// with their priority score and its inputs, priority band, whether they
+	// are within the next run's cut-off, last price or stock change and
+	// estimated next check, plus totals by priority band
+	// Query parameters:
+	//   - limit: Products to list, 1-500 (default 50)
+	admin.GET("/scheduler/queue", func(c echo.Context) error {
+		limit := defaultSchedulerQueueLimit
+		if raw := c.QueryParam("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxSchedulerQueueLimit {
+				return apierror.Invalid(fmt.Sprintf("limit must be between 1 and %d", maxSchedulerQueueLimit))
+			}
+			limit = n
+		}
+
+		queue, err := GetSchedulerQueue(db.WithContext(c.Request().Context()), limit)
+		if err != nil {
+			return apierror.Internal("Failed to load scheduler queue", err)
+		}
+		return c.JSON(http.StatusOK, queue)
+	})
+}
@@ -0,0 +1,259 @@
+// Package crawler implements the per-cycle records of the favorites
+// scheduler
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// Outcomes of a product in a scheduler run
+const (
+	OutcomeFetched          = "fetched"            // Fetched and published
+	OutcomeSkippedRateLimit = "skipped_rate_limit" // Not fetched, the request budget was spent
+	OutcomeFailed           = "failed"             // The fetch failed and was queued for a retry
+)
+
+// Classes of fetch errors, so runs stay compact and can be grouped
+const (
+	FetchErrorNotFound        = "not_found"        // HTTP 404
+	FetchErrorRateLimited     = "rate_limited"     // HTTP 429
+	FetchErrorClient          = "client_error"     // Other 4xx responses
+	FetchErrorServer          = "server_error"     // 5xx responses
+	FetchErrorTimeout         = "timeout"          // No response before the deadline
+	FetchErrorNetwork         = "network"          // No response for another reason
+	FetchErrorInvalidResponse = "invalid_response" // A response that is not a product
+	FetchErrorUnknownSource   = "unknown_source"   // No fetcher for the product's source
+)
+
+// Limits of GET /scheduler/runs and the notification debug endpoint
+const (
+	defaultSchedulerRunsLimit = 5
+	maxSchedulerRunsLimit     = 50
+	debugSchedulerRunLimit    = 5
+)
+
+// SchedulerOutcome is what a scheduler run did with one product. Runs store
+// them as a JSON array in SchedulerRun.Outcomes.
+type SchedulerOutcome struct {
+	ProductID  uint   `json:"product_id"`
+	Source     string `json:"source"`
+	Outcome    string `json:"outcome"`               // OutcomeFetched, OutcomeSkippedRateLimit or OutcomeFailed
+	ErrorClass string `json:"error_class,omitempty"` // Failed products only, a FetchError* class
+	RetryID    uint   `json:"retry_id,omitempty"`    // Retry queue entry the failure created or updated
+}
+
+// DebugSchedulerOutcome is a product's outcome in one scheduler run, for the
+// notification debug endpoint
+type DebugSchedulerOutcome struct {
+	RunID      uint      `json:"run_id"`
+	StartedAt  time.Time `json:"started_at"`
+	Outcome    string    `json:"outcome"`
+	ErrorClass string    `json:"error_class,omitempty"`
+	RetryID    uint      `json:"retry_id,omitempty"`
+}
+
+// FetchErrorClass classifies a failed product fetch.
+//
+// Parameters:
+//   - err: Error of the fetch or of converting its response
+//
+// Returns:
+//   - string: One of the FetchError* classes
+func FetchErrorClass(err error) string {
+	var fe *FetchError
+	if !errors.As(err, &fe) {
+		return FetchErrorInvalidResponse
+	}
+	switch {
+	case fe.StatusCode == http.StatusNotFound:
+		return FetchErrorNotFound
+	case fe.StatusCode == http.StatusTooManyRequests:
+		return FetchErrorRateLimited
+	case fe.StatusCode >= 500:
+		return FetchErrorServer
+	case fe.StatusCode != 0:
+		return FetchErrorClient
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return FetchErrorTimeout
+	}
+	return FetchErrorNetwork
+}
+
+// schedulerRunRetention returns how long scheduler runs are kept.
+//
+// Environment Variables:
+//   - SCHEDULER_RUN_RETENTION: How long runs are kept (default: 72h)
+func schedulerRunRetention() time.Duration {
+	if retention := viper.GetDuration("SCHEDULER_RUN_RETENTION"); retention > 0 {
+		return retention
+	}
+	return 72 * time.Hour
+}
+
+// SaveSchedulerRun stores a scheduler cycle with its per-product outcomes,
+// counting them into the run's totals, and deletes the runs older than
+// SCHEDULER_RUN_RETENTION.
+//
+// Parameters:
+//   - db: Database connection
+//   - run: Scheduler, start and end of the cycle; the counts and outcomes
+//     are filled in
+//   - outcomes: What happened to each product the cycle considered
+//
+// Returns:
+//   - error: Any database error
+func SaveSchedulerRun(db *gorm.DB, run *models.SchedulerRun, outcomes []SchedulerOutcome) error {
+	run.Considered = len(outcomes)
+	run.Fetched, run.Skipped, run.Failed = 0, 0, 0
+	for _, outcome := range outcomes {
+		switch outcome.Outcome {
+		case OutcomeFetched:
+			run.Fetched++
+		case OutcomeSkippedRateLimit:
+			run.Skipped++
+		case OutcomeFailed:
+			run.Failed++
+		}
+	}
+	if outcomes == nil {
+		outcomes = []SchedulerOutcome{}
+	}
+	data, err := json.Marshal(outcomes)
+	if err != nil {
+		return err
+	}
+	run.Outcomes = data
+	if err := db.Create(run).Error; err != nil {
+		return err
+	}
+
+	result := db.Where("started_at < ?", time.Now().Add(-schedulerRunRetention())).Delete(&models.SchedulerRun{})
+	if result.Error != nil {
+		logrus.WithError(result.Error).Error("Failed to prune scheduler runs")
+	} else if result.RowsAffected > 0 {
+		logrus.WithField("deleted", result.RowsAffected).Debug("Pruned scheduler runs")
+	}
+	return nil
+}
+
+// GetSchedulerRuns returns the most recent runs of a scheduler.
+//
+// Parameters:
+//   - db: Database connection
+//   - scheduler: Scheduler name, e.g. SchedulerFavorites
+//   - limit: Runs to return
+//
+// Returns:
+//   - []models.SchedulerRun: The runs, newest first
+//   - error: Any database error
+func GetSchedulerRuns(db *gorm.DB, scheduler string, limit int) ([]models.SchedulerRun, error) {
+	runs := []models.SchedulerRun{}
+	err := db.Where("scheduler = ?", scheduler).Order("started_at DESC, id DESC").Limit(limit).Find(&runs).Error
+	return runs, err
+}
+
+// productSchedulerOutcomes returns the product's outcomes in the most recent
+// favorites scheduler runs that considered it.
+//
+// Parameters:
+//   - db: Database connection
+//   - productID: Product to look up
+//   - source: Marketplace of the product
+//   - limit: Runs to return
+//
+// Returns:
+//   - []DebugSchedulerOutcome: The outcomes, newest first
+//   - error: Any database error
+func productSchedulerOutcomes(db *gorm.DB, productID uint, source string, limit int) ([]DebugSchedulerOutcome, error) {
+	match, err := json.Marshal([]map[string]interface{}{{"product_id": productID, "source": source}})
+	if err != nil {
+		return nil, err
+	}
+	var runs []models.SchedulerRun
+	err = db.Where("scheduler = ? AND outcomes @> ?::jsonb", SchedulerFavorites, string(match)).
+		Order("started_at DESC, id DESC").
+		Limit(limit).
+		Find(&runs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]DebugSchedulerOutcome, 0, len(runs))
+	for _, run := range runs {
+		var outcomes []SchedulerOutcome
+		if err := json.Unmarshal(run.Outcomes, &outcomes); err != nil {
+			return nil, fmt.Errorf("scheduler run %d: %w", run.ID, err)
+		}
+		for _, outcome := range outcomes {
+			if outcome.ProductID == productID && outcome.Source == source {
+				results = append(results, DebugSchedulerOutcome{
+					RunID:      run.ID,
+					StartedAt:  run.StartedAt,
+					Outcome:    outcome.Outcome,
+					ErrorClass: outcome.ErrorClass,
+					RetryID:    outcome.RetryID,
+				})
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// parseSchedulerRunsLimit reads the limit parameter of GET /scheduler/runs.
+func parseSchedulerRunsLimit(c echo.Context) (int, error) {
+	raw := c.QueryParam("limit")
+	if raw == "" {
+		return defaultSchedulerRunsLimit, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 || n > maxSchedulerRunsLimit {
+		return 0, apierror.Invalid(fmt.Sprintf("limit must be between 1 and %d", maxSchedulerRunsLimit))
+	}
+	return n, nil
+}
+
+// registerSchedulerRunHandlers sets up the scheduler run history endpoint.
+// It requires the API key.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerSchedulerRunHandlers(e *echo.Echo, db *gorm.DB) {
+	admin := e.Group("", requireAPIKey())
+
+	// GET /scheduler/runs
+	// Lists the most recent favorites scheduler runs, newest first, with
+	// their counts and the outcome of every product they considered. Runs
+	// are kept for SCHEDULER_RUN_RETENTION.
+	// Query parameters:
+	//   - limit: Runs to list, 1-50 (default 5)
+	admin.GET("/scheduler/runs", func(c echo.Context) error {
+		limit, err := parseSchedulerRunsLimit(c)
+		if err != nil {
+			return err
+		}
+		runs, err := GetSchedulerRuns(db.WithContext(c.Request().Context()), SchedulerFavorites, limit)
+		if err != nil {
+			return apierror.Internal("Failed to load scheduler runs", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"runs": runs})
+	})
+}
@@ -0,0 +1,90 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"scraper/internal/models"
+)
+
+func TestFetchErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&FetchError{StatusCode: 404}, FetchErrorNotFound},
+		{&FetchError{StatusCode: 429}, FetchErrorRateLimited},
+		{&FetchError{StatusCode: 403}, FetchErrorClient},
+		{&FetchError{StatusCode: 503}, FetchErrorServer},
+		{&FetchError{Err: context.DeadlineExceeded}, FetchErrorTimeout},
+		{&FetchError{Err: errors.New("connection refused")}, FetchErrorNetwork},
+		{fmt.Errorf("wrapped: %w", &FetchError{StatusCode: 404}), FetchErrorNotFound},
+		{errors.New("product detail has no id"), FetchErrorInvalidResponse},
+	}
+	for _, tt := range tests {
+		if got := FetchErrorClass(tt.err); got != tt.want {
+			t.Errorf("FetchErrorClass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulerRunOutcomes(t *testing.T) {
+	db := openStressDB(t)
+	if err := db.AutoMigrate(&models.SchedulerRun{}, &models.FetchRetry{}, &models.SchedulerState{}, &models.RequestBudget{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Where("outcomes @> ?::jsonb", fmt.Sprintf(`[{"product_id": %d}]`, stressBaseID)).Delete(&models.SchedulerRun{})
+		db.Unscoped().Where("product_id >= ?", stressBaseID).Delete(&models.FetchRetry{})
+	})
+
+	product := uint(stressBaseID)
+	retryID, err := RecordFetchFailure(db, models.SourceTrendyol, int(product), FetchSourceScheduler, &FetchError{StatusCode: 503})
+	if err != nil || retryID == 0 {
+		t.Fatalf("RecordFetchFailure = %d, %v; want the retry ID", retryID, err)
+	}
+
+	now := time.Now()
+	old := models.SchedulerRun{Scheduler: SchedulerFavorites, StartedAt: now.Add(-schedulerRunRetention() - time.Hour), FinishedAt: now}
+	if err := SaveSchedulerRun(db, &old, []SchedulerOutcome{{ProductID: product, Source: models.SourceTrendyol, Outcome: OutcomeFetched}}); err != nil {
+		t.Fatal(err)
+	}
+	run := models.SchedulerRun{Scheduler: SchedulerFavorites, StartedAt: now, FinishedAt: now}
+	outcomes := []SchedulerOutcome{
+		{ProductID: product, Source: models.SourceTrendyol, Outcome: OutcomeFailed, ErrorClass: FetchErrorServer, RetryID: retryID},
+		{ProductID: product + 1, Source: models.SourceTrendyol, Outcome: OutcomeFetched},
+		{ProductID: product + 2, Source: models.SourceTrendyol, Outcome: OutcomeSkippedRateLimit},
+	}
+	if err := SaveSchedulerRun(db, &run, outcomes); err != nil {
+		t.Fatal(err)
+	}
+	if run.Considered != 3 || run.Fetched != 1 || run.Failed != 1 || run.Skipped != 1 {
+		t.Errorf("run counts = %d considered, %d fetched, %d failed, %d skipped; want 3, 1, 1, 1", run.Considered, run.Fetched, run.Failed, run.Skipped)
+	}
+
+	// The run past the retention was pruned
+	var stale int64
+	db.Model(&models.SchedulerRun{}).Where("id = ?", old.ID).Count(&stale)
+	if stale != 0 {
+		t.Error("run older than SCHEDULER_RUN_RETENTION was kept")
+	}
+
+	got, err := productSchedulerOutcomes(db, product, models.SourceTrendyol, debugSchedulerRunLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].RunID != run.ID || got[0].Outcome != OutcomeFailed || got[0].ErrorClass != FetchErrorServer || got[0].RetryID != retryID {
+		t.Errorf("outcomes = %+v, want the failure of run %d linked to retry %d", got, run.ID, retryID)
+	}
+
+	debug := GetNotificationDebug(db, product, models.SourceTrendyol, stressBaseID)
+	if debug.Scheduler == nil || len(debug.Scheduler.RecentRuns) != 1 {
+		t.Fatalf("debug scheduler section = %+v, want the run", debug.Scheduler)
+	}
+	if debug.Scheduler.RecentRuns[0].RetryID != retryID {
+		t.Errorf("debug outcome = %+v, want retry %d", debug.Scheduler.RecentRuns[0], retryID)
+	}
+}
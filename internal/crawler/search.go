@@ -0,0 +1,150 @@
+// Package crawler implements the product name search endpoint
+package crawler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/models"
+)
+
+// Length bounds of the search term
+const (
+	minSearchLength = 2
+	maxSearchLength = 100
+)
+
+// ProductSearch selects products for GET /products/search
+type ProductSearch struct {
+	Term     string // Matched against the name and category path, ignoring case
+	Source   string // Only this marketplace, all when empty
+	Page     int    // 1-based page number
+	PageSize int    // Products per page
+}
+
+// ProductSearchPage is the response of GET /products/search. Total counts at
+// most PRODUCT_SEARCH_MAX_RESULTS matches; Capped reports that there are more.
+type ProductSearchPage struct {
+	ProductPage
+	Query  string `json:"query"`  // The search term
+	Capped bool   `json:"capped"` // More products matched than can be paged through
+}
+
+// maxSearchResults returns how many matches of a search can be paged through.
+//
+// Environment Variables:
+//   - PRODUCT_SEARCH_MAX_RESULTS: Matches a search returns at most (default: 1000)
+func maxSearchResults() int {
+	if limit := viper.GetInt("PRODUCT_SEARCH_MAX_RESULTS"); limit > 0 {
+		return limit
+	}
+	return 1000
+}
+
+// SearchProducts finds products whose name or category path contains the
+// search term, ignoring case. Names starting with the term come first, then
+// names containing it, then products only matching by category; shorter names
+// rank higher within each group. The ILIKE patterns are served by the trigram
+// indexes created in db.Setup.
+//
+// Parameters:
+//   - db: Database connection
+//   - s: Search term, filters and page
+//
+// Returns:
+//   - ProductSearchPage: Matching products, most relevant first
+//   - error: Any database error
+func SearchProducts(db *gorm.DB, s ProductSearch) (ProductSearchPage, error) {
+	result := ProductSearchPage{
+		ProductPage: ProductPage{Items: []models.Product{}, Page: s.Page, PageSize: s.PageSize},
+		Query:       s.Term,
+	}
+
+	escaped := likeEscaper.Replace(s.Term)
+	prefix, contains := escaped+"%", "%"+escaped+"%"
+	query := db.Model(&models.Product{}).
+		Where("products.name ILIKE ? OR products.category_path ILIKE ?", contains, contains)
+	if s.Source != "" {
+		query = query.Where("products.source = ?", s.Source)
+	}
+	query = query.Session(&gorm.Session{})
+
+	// Count one match past the cap so a popular term never counts every row
+	limit := maxSearchResults()
+	var matches int64
+	err := db.Table("(?) AS matches", query.Select("1").Limit(limit+1)).Count(&matches).Error
+	if err != nil {
+		return result, err
+	}
+	result.Total = matches
+	if matches > int64(limit) {
+		result.Total = int64(limit)
+		result.Capped = true
+	}
+
+	offset := (s.Page - 1) * s.PageSize
+	size := s.PageSize
+	if offset+size > limit {
+		size = limit - offset
+	}
+	if size <= 0 {
+		return result, nil
+	}
+	err = query.
+		Order(clause.OrderBy{Expression: clause.Expr{
+			SQL: `CASE WHEN products.name ILIKE ? THEN 0 WHEN products.name ILIKE ? THEN 1 ELSE 2 END,
+				length(products.name), products.id, products.source`,
+			Vars:               []interface{}{prefix, contains},
+			WithoutParentheses: true,
+		}}).
+		Limit(size).
+		Offset(offset).
+		Find(&result.Items).Error
+	return result, err
+}
+
+// registerProductSearchHandlers sets up the product search endpoint.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+func registerProductSearchHandlers(e *echo.Echo, db *gorm.DB) {
+	// GET /products/search
+	// Finds products by name or category path, ignoring case
+	// Query parameters:
+	//   - q: Search term, 2-100 characters (required)
+	//   - source: Only search products from this marketplace (optional)
+	//   - page: 1-based page number (default 1)
+	//   - page_size: Products per page, 1-100 (default 50)
+	e.GET("/products/search", func(c echo.Context) error {
+		s := ProductSearch{Term: strings.TrimSpace(c.QueryParam("q"))}
+		if n := utf8.RuneCountInString(s.Term); n < minSearchLength || n > maxSearchLength {
+			return apierror.Invalid(fmt.Sprintf("q must be between %d and %d characters", minSearchLength, maxSearchLength))
+		}
+		if source := c.QueryParam("source"); source != "" {
+			normalized, err := NormalizeSource(source)
+			if err != nil {
+				return apierror.Invalid(err.Error())
+			}
+			s.Source = normalized
+		}
+		var err error
+		if s.Page, s.PageSize, err = parsePageParams(c); err != nil {
+			return err
+		}
+
+		result, err := SearchProducts(db.WithContext(c.Request().Context()), s)
+		if err != nil {
+			return apierror.Internal("Failed to search products", err)
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
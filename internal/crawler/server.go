@@ -1,85 +1,221 @@
 package crawler
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
 	"net"
+	"net/http"
 
 	"github.com/labstack/echo/v4"
 	"google.golang.org/grpc"
+	"gorm.io/gorm"
 
+	"scraper/internal/analysis"
+	"scraper/internal/apierror"
+	"scraper/internal/audit"
+	"scraper/internal/auth"
+	"scraper/internal/cors"
 	"scraper/internal/db"
+	"scraper/internal/health"
 	"scraper/internal/kafka"
+	"scraper/internal/metrics"
+	"scraper/internal/notification"
+	"scraper/internal/outbox"
+	"scraper/internal/profiling"
 	"scraper/internal/proto"
+	"scraper/internal/ratelimit"
+	"scraper/internal/redact"
+	"scraper/internal/timeout"
+	"scraper/pkg/listen"
+	"scraper/pkg/readiness"
+	"scraper/pkg/shutdown"
 
 	"github.com/sirupsen/logrus"
 )
 
+// ready is marked once the crawler's HTTP and gRPC servers are starting
+var ready = readiness.New()
+
+// Ready returns a channel that is closed once the crawler serves requests.
+func Ready() <-chan struct{} {
+	return ready.Ready()
+}
+
 type CrawlerServer struct {
 	proto.UnimplementedCrawlerServiceServer
+	db *gorm.DB // Database connection for cached product lookups
 }
 
-func Start() {
+// Start runs the crawler's HTTP and gRPC servers and its scheduled jobs.
+// Shutdown stops them; the crawler has no consumers to stop with ctx.
+func Start(ctx context.Context) {
 	// Initialize dependencies
 	dbConn := db.Setup()
-	producer := kafka.SetupProducer()
+	// Messages produced by the crawler are counted in /metrics
+	producer := countProduced(kafka.SetupProducer())
+	closing.Add("Kafka producer", shutdown.Close(producer))
 
-	// Start HTTP server
+	// Start HTTP server; errors are reported as {code, message, details}
 	e := echo.New()
-	registerHandlers(e, dbConn, producer)
+	e.HTTPErrorHandler = apierror.NewHandler(mapError)
+	// Browser preflights are answered before rate limits, routing and login
+	e.Pre(cors.Middleware(cors.FromConfig()))
+	// Handler latency is recorded for every request, rejected ones included
+	e.Use(metrics.Middleware("crawler"))
+	// Seller tax numbers and addresses are masked in every JSON response
+	// unless an admin endpoint was asked for the full values
+	e.JSONSerializer = redact.Serializer{}
+
+	// Clients are limited per API key or, without one, per IP; user signups
+	// and crawl triggers get stricter buckets of their own
+	_, strict := ratelimit.Limits()
+	e.Use(ratelimit.Middleware(ratelimit.Routes{
+		"GET /fetch":               strict,
+		"POST /fetch":              strict,
+		"POST /users":              strict,
+		"POST /crawl/category/:wc": strict,
+		"POST /crawl/products":     strict,
+	}, apiKeys()))
+
+	// Requests get a deadline; job submissions return before their job runs
+	// and stay short
+	e.Use(timeout.Middleware(timeout.Routes{
+		"POST /crawl/products":           timeout.Long,
+		"POST /favorites/import":         timeout.Long,
+		"POST /products/:id/refresh":     timeout.Long,
+		"POST /admin/reconcile":          timeout.Long,
+		"GET /favorites/:user_id/export": timeout.Exempt, // Streams the CSV
+		profiling.Route:                  timeout.Exempt,
+	}))
+
+	// Users may only act on their own data; see authRoutes. Without a valid
+	// JWT_SECRET, login and these routes answer 503.
+	issuer, err := auth.IssuerFromEnv()
+	if err != nil {
+		logrus.WithError(err).Warn("Login disabled")
+		issuer = nil
+	}
+	e.Use(auth.Middleware(issuer, authRoutes()))
+	registerHandlers(e, dbConn, producer, issuer)
+	registerVerificationHandlers(e, dbConn, issuer)
+
+	// Operator endpoints send test emails through the notification service
+	notificationClient, err := notification.Dial("crawler")
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create notification client")
+	}
+	registerAdminHandlers(e, dbConn, notificationClient)
+
+	// Products submitted by the browser extension go through the analysis
+	// upsert path in this process, which notifies watchers through the same
+	// client
+	analysis.SetNotificationClient(notificationClient)
+	registerIngestHandlers(e, dbConn, producer)
+	registerDebugHandlers(e, dbConn)
+	registerFaultHandlers(e)
+	registerRefreshHandlers(e, dbConn)
+	registerDeletionHandlers(e, dbConn)
+	registerNotificationPreviewHandlers(e, dbConn)
+	registerSchedulerQueueHandlers(e, dbConn)
+	registerSchedulerRunHandlers(e, dbConn)
+	registerPayloadSizeHandlers(e, dbConn)
+	registerRefreshBoostHandlers(e, dbConn)
+	registerLoginHandlers(e, dbConn, newValidator(), issuer)
+	registerDeepLinkHandlers(e, dbConn)
+
+	// Register Prometheus metrics endpoint
+	e.GET("/metrics", metrics.Handler)
+
+	// Publish the events queued by the handlers
+	relay := outbox.NewRelay(dbConn, producer)
+	relay.Start("crawler")
+	closing.Add("outbox relay", relay.Stop)
+
+	// Retry products that failed to fetch
+	stopping.Add("retry job", shutdown.Cron(startRetryJob(dbConn, producer)))
+
+	// Track users approaching the favorites limit
+	stopping.Add("favorites limit job", shutdown.Cron(startFavoritesLimitJob(dbConn)))
+
+	// Compare a sample of stored products with the marketplace every night
+	stopping.Add("reconcile job", shutdown.Cron(startReconcileJob(dbConn)))
 
-	port := findAvailablePort(8080, "Crawler HTTP")
+	// Record deleted and purged products in the audit trail when enabled
+	auditor = audit.FromConfig("crawler")
+	closing.Add("audit trail", auditor.Stop)
+
+	// Remove products that have been deleted for long enough
+	stopping.Add("purge job", shutdown.Cron(startPurgeJob(dbConn)))
+
+	// Repair the denormalized favorites counters of products
+	stopping.Add("favorites recount job", shutdown.Cron(startFavoritesRecountJob(dbConn)))
+
+	// Check inactive products for relistings every week
+	stopping.Add("relisting job", shutdown.Cron(startRelistingJob(dbConn, producer)))
+
+	// Remove accounts that never verified their email address
+	stopping.Add("unverified user cleanup job", shutdown.Cron(startUnverifiedUserCleanupJob(dbConn)))
+
+	// Rank brands and sellers by their price drops for GET /stats/price-drops
+	stopping.Add("price drop stats job", shutdown.Cron(startPriceDropStatsJob(dbConn)))
+
+	// Report the build and the bound ports
+	e.GET("/version", listen.VersionHandler)
+
+	// Profiling endpoints when DEBUG_PPROF is set
+	profiling.Register(e, "crawler")
+
+	// Liveness, and readiness once Postgres and Kafka are reachable
+	health.New().
+		Add("postgres", health.Database(dbConn)).
+		Add("kafka", health.Kafka(kafka.Brokers())).
+		Register(e)
+
+	// Bind the configured port, failing fast if it is taken
+	httpListener, err := listen.TCP("Crawler HTTP", "CRAWLER_PORT", 8080)
+	if err != nil {
+		logrus.WithError(err).Fatal("Crawler HTTP port unavailable")
+	}
+	e.Listener = httpListener
 	go func() {
-		logrus.WithField("port", port).Info("Starting Crawler HTTP server")
-		if err := e.Start(fmt.Sprintf(":%d", port)); err != nil {
+		logrus.WithField("addr", httpListener.Addr().String()).Info("Starting Crawler HTTP server")
+		if err := e.Start(""); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logrus.Fatalf("Crawler HTTP server failed: %v", err)
 		}
 	}()
+	stopping.Add("HTTP server", shutdown.HTTP(e))
 
 	// Start gRPC server
-	s, lis := startGRPCServer()
+	s, lis := startGRPCServer(dbConn)
 	go func() {
-		logrus.WithField("port", port+1).Info("Starting Crawler gRPC server")
-		log.Fatal(s.Serve(lis))
+		logrus.WithField("addr", lis.Addr().String()).Info("Starting Crawler gRPC server")
+		if err := s.Serve(lis); err != nil {
+			logrus.Fatalf("Crawler gRPC server failed: %v", err)
+		}
 	}()
+	stopping.Add("gRPC server", shutdown.GRPC(s))
+
+	ready.Mark()
 }
 
-func startGRPCServer() (*grpc.Server, net.Listener) {
-	port := findAvailablePort(8081, "Crawler gRPC")
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// startGRPCServer binds the crawler gRPC port and registers the service.
+//
+// Environment Variables:
+//   - CRAWLER_GRPC_PORT: gRPC bind port (default: 8081)
+//
+// Parameters:
+//   - db: Database connection for cached product lookups
+//
+// Returns:
+//   - *grpc.Server: Configured gRPC server
+//   - net.Listener: TCP listener for the server
+func startGRPCServer(db *gorm.DB) (*grpc.Server, net.Listener) {
+	lis, err := listen.TCP("Crawler gRPC", "CRAWLER_GRPC_PORT", 8081)
 	if err != nil {
-		logrus.Fatalf("Failed to listen on port %d: %v", port, err)
+		logrus.WithError(err).Fatal("Crawler gRPC port unavailable")
 	}
 
 	s := grpc.NewServer()
-	proto.RegisterCrawlerServiceServer(s, &CrawlerServer{})
+	proto.RegisterCrawlerServiceServer(s, &CrawlerServer{db: db})
 	return s, lis
 }
-
-func findAvailablePort(basePort int, serviceName string) int {
-	port := basePort
-	maxAttempts := 10
-
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		addr := fmt.Sprintf(":%d", port)
-		listener, err := net.Listen("tcp", addr)
-		if err == nil {
-			listener.Close()
-			logrus.WithFields(logrus.Fields{
-				"service": serviceName,
-				"port":    port,
-			}).Info("Found available port")
-			return port
-		}
-		logrus.WithFields(logrus.Fields{
-			"service": serviceName,
-			"port":    port,
-		}).Warn("Port in use, trying next port")
-		port++
-	}
-	logrus.WithFields(logrus.Fields{
-		"service": serviceName,
-		"port":    port,
-	}).Warn("Failed to find available port, using default")
-	return port
-}
\ No newline at end of file
@@ -0,0 +1,107 @@
+// Package crawler implements stopping the crawler and its background crawls
+// on shutdown
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"scraper/pkg/shutdown"
+)
+
+// stopping holds the servers and jobs Start started, which hand work to the
+// crawls and to what closing holds
+var stopping = shutdown.New("crawler")
+
+// closing holds the producer and the writers that flush what the servers,
+// jobs and crawls handed them
+var closing = shutdown.New("crawler")
+
+// crawlGroup tracks the crawls of this process so a shutdown can stop them
+// and wait until their output is flushed
+type crawlGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// crawls is the crawl group of the crawler service
+var crawls = newCrawlGroup()
+
+// newCrawlGroup creates a group whose crawls run until shutdown.
+func newCrawlGroup() *crawlGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &crawlGroup{ctx: ctx, cancel: cancel}
+}
+
+// start registers a crawl. The crawl must stop fetching once the returned
+// context is done and call the returned function after its output is
+// flushed. A crawl started after shutdown gets a context that is already
+// done.
+//
+// Parameters:
+//   - parent: Context of the crawl, e.g. the request's for an inline crawl
+//
+// Returns:
+//   - context.Context: Done when parent is or the process shuts down
+//   - func(): Marks the crawl finished
+func (g *crawlGroup) start(parent context.Context) (context.Context, func()) {
+	g.wg.Add(1)
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(g.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		g.wg.Done()
+	}
+}
+
+// stopping reports whether the process is shutting down.
+func (g *crawlGroup) stopping() bool {
+	return g.ctx.Err() != nil
+}
+
+// shutdown cancels every crawl and waits until they finished.
+//
+// Returns:
+//   - error: ctx's error if it ended before the crawls finished
+func (g *crawlGroup) shutdown(ctx context.Context) error {
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the crawler. The running crawls stop fetching first, so
+// requests running an inline crawl can answer while the HTTP and gRPC
+// servers finish their running requests and the jobs their running runs.
+// The crawls then publish what they fetched so far, falling back to the
+// outbox for batches Kafka does not take, and close their crawl report as
+// cancelled. The outbox relay, audit trail and producer are closed last.
+// Call it before the process exits.
+//
+// Parameters:
+//   - ctx: Bounds the wait for running requests, runs and crawls
+//
+// Returns:
+//   - error: The parts that did not stop cleanly, e.g. ctx's error if a
+//     crawl was still flushing when ctx ended
+func Shutdown(ctx context.Context) error {
+	crawls.cancel()
+	stopped := stopping.Stop(ctx)
+	var flushed error
+	if err := crawls.shutdown(ctx); err != nil {
+		flushed = fmt.Errorf("crawler crawls: %w", err)
+	}
+	return errors.Join(stopped, flushed, closing.Stop(ctx))
+}
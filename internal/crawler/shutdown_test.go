@@ -0,0 +1,213 @@
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"scraper/internal/models"
+)
+
+// blockingFetcher returns products until it reaches blockOn, whose fetch
+// waits for the crawl to be cancelled
+type blockingFetcher struct {
+	blockOn int
+	blocked chan struct{} // Closed once the fetch of blockOn started
+}
+
+func (f blockingFetcher) FetchDetails(ctx context.Context, productID int) (map[string]interface{}, error) {
+	if productID == f.blockOn {
+		close(f.blocked)
+		<-ctx.Done()
+		return nil, &FetchError{ProductID: productID, Err: ctx.Err()}
+	}
+	return map[string]interface{}{"id": productID, "name": fmt.Sprintf("Product %d", productID)}, nil
+}
+
+func (blockingFetcher) ToProduct(productID int, detail map[string]interface{}) (*models.Product, error) {
+	return productFromDetail(productID, detail)
+}
+
+// recordingProducer records the messages it is sent, or fails every send
+type recordingProducer struct {
+	sarama.SyncProducer
+	fail bool
+
+	mu   sync.Mutex
+	sent []*sarama.ProducerMessage
+}
+
+func (p *recordingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if p.fail {
+		return 0, 0, errors.New("kafka unavailable")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent)), nil
+}
+
+// startCancellableCrawl runs a live crawl of one category listing products
+// 1-5 that blocks on the detail fetch of product 3, then stops it with
+// SIGTERM the way cmd/scraper does.
+//
+// Returns:
+//   - FetchJob: The finished job
+func startCancellableCrawl(t *testing.T, producer sarama.SyncProducer) FetchJob {
+	t.Helper()
+	db := openPurgeDB(t, nil, nil)
+
+	listing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var root models.Root
+		for id := 1; id <= 5; id++ {
+			root.Data.Contents = append(root.Data.Contents, models.ProductItem{ID: id})
+		}
+		json.NewEncoder(w).Encode(root)
+	}))
+	t.Cleanup(listing.Close)
+
+	fetcher := blockingFetcher{blockOn: 3, blocked: make(chan struct{})}
+	saved := struct {
+		fetcher  Fetcher
+		url      string
+		dataFile string
+		delay    time.Duration
+		crawls   *crawlGroup
+	}{fetchers[models.SourceTrendyol], crawlListingURL, crawlDataFile, crawlFetchDelay, crawls}
+	fetchers[models.SourceTrendyol] = fetcher
+	crawlListingURL = listing.URL + "/?wc=%d&size=%d"
+	crawlDataFile = filepath.Join(t.TempDir(), "data.json")
+	crawlFetchDelay = 0
+	crawls = newCrawlGroup()
+	t.Cleanup(func() {
+		fetchers[models.SourceTrendyol] = saved.fetcher
+		crawlListingURL, crawlDataFile, crawlFetchDelay, crawls = saved.url, saved.dataFile, saved.delay, saved.crawls
+	})
+
+	job := FetchJob{ID: t.Name(), Live: true, FirstCategory: 1, LastCategory: 3, PageSize: 5, BatchSize: 1}
+	if _, err := fetchJobs.enqueue(&job); err != nil {
+		t.Fatal(err)
+	}
+	go runFetchJob(db, producer, job)
+
+	select {
+	case <-fetcher.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("crawl did not reach product 3")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	self, _ := os.FindProcess(os.Getpid())
+	if err := self.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Shutdown(flushCtx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+
+	finished, _ := fetchJobs.get(job.ID)
+	return finished
+}
+
+// lastInsertArgs returns the arguments of the last INSERT into table.
+func lastInsertArgs(table string) []interface{} {
+	var args []interface{}
+	for _, statement := range purgeDB.statements {
+		if strings.HasPrefix(statement, `INSERT INTO "`+table+`"`) {
+			args = args[:0]
+			for _, arg := range purgeDB.args[statement] {
+				args = append(args, arg.Value)
+			}
+		}
+	}
+	return args
+}
+
+// countInserts returns the INSERT statements into table.
+func countInserts(table string) int {
+	n := 0
+	for _, statement := range purgeDB.statements {
+		if strings.HasPrefix(statement, `INSERT INTO "`+table+`"`) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestShutdownPublishesFetchedProducts(t *testing.T) {
+	producer := &recordingProducer{}
+	job := startCancellableCrawl(t, producer)
+
+	if job.State != JobFailed || job.Error != errCrawlCancelled.Error() {
+		t.Errorf("job state = %s (%q), want failed with %q", job.State, job.Error, errCrawlCancelled)
+	}
+	if job.Summary == nil || job.Summary.TotalProducts != 2 {
+		t.Fatalf("summary = %+v, want the 2 products fetched before the shutdown", job.Summary)
+	}
+	if len(producer.sent) != 2 || len(job.Summary.Failed) != 0 {
+		t.Errorf("sent %d batches with %d failed, want both batches sent", len(producer.sent), len(job.Summary.Failed))
+	}
+
+	// The report is closed as cancelled
+	found := false
+	for _, arg := range lastInsertArgs("crawl_reports") {
+		if arg == CrawlCancelled {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("last crawl report save %v has no %q status", lastInsertArgs("crawl_reports"), CrawlCancelled)
+	}
+
+	// The interrupted fetch is not queued as a failure
+	if n := countInserts("fetch_retries"); n != 0 {
+		t.Errorf("%d fetch retries recorded for the cancelled fetch", n)
+	}
+
+	// data.json is complete and the temporary file is gone
+	data, err := os.ReadFile(crawlDataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var products []models.TrendyolResponse
+	if err := json.Unmarshal(data, &products); err != nil {
+		t.Fatalf("data.json is not valid JSON: %v", err)
+	}
+	if len(products) != 2 {
+		t.Errorf("data.json holds %d products, want 2", len(products))
+	}
+	if _, err := os.Stat(crawlDataFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary data file left behind: %v", err)
+	}
+}
+
+func TestShutdownSpoolsBatchesWhenKafkaIsDown(t *testing.T) {
+	job := startCancellableCrawl(t, &recordingProducer{fail: true})
+
+	if job.Summary == nil || len(job.Summary.Failed) != 2 {
+		t.Fatalf("summary = %+v, want 2 failed batches", job.Summary)
+	}
+	if len(job.Summary.Spooled) != 2 {
+		t.Errorf("spooled batches = %v, want both", job.Summary.Spooled)
+	}
+	if n := countInserts("outbox"); n != 2 {
+		t.Errorf("%d outbox events written, want 2", n)
+	}
+}
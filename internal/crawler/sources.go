@@ -0,0 +1,113 @@
+// Package crawler implements the registry of marketplace fetchers
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"scraper/internal/faults"
+	"scraper/internal/models"
+)
+
+// Fetcher retrieves products from a single marketplace. Refreshes are routed
+// to the fetcher registered for the product's Source.
+type Fetcher interface {
+	// FetchDetails returns the raw product detail response. The request is
+	// abandoned once ctx is done.
+	FetchDetails(ctx context.Context, productID int) (map[string]interface{}, error)
+	// ToProduct converts a raw detail response into a Product
+	ToProduct(productID int, detail map[string]interface{}) (*models.Product, error)
+}
+
+// fetchers maps a product source to its fetcher
+var fetchers = map[string]Fetcher{
+	models.SourceTrendyol: trendyolFetcher{},
+}
+
+// fetchFaults reports whether fetchers are wrapped for fault injection; the
+// setting is read once, on the first lookup
+var fetchFaults = sync.OnceValue(faults.Enabled)
+
+// FetcherFor returns the fetcher for a product source. An empty source
+// means models.SourceTrendyol. With FAULT_INJECTION set, the fetcher injects
+// the fetch faults of internal/faults.
+//
+// Parameters:
+//   - source: Marketplace of the product
+//
+// Returns:
+//   - Fetcher: The fetcher registered for the source
+//   - error: If no fetcher is registered for the source
+func FetcherFor(source string) (Fetcher, error) {
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+	fetcher, ok := fetchers[source]
+	if !ok {
+		return nil, fmt.Errorf("unknown product source %q", source)
+	}
+	if fetchFaults() {
+		return faultyFetcher{fetcher}, nil
+	}
+	return fetcher, nil
+}
+
+// Sources returns the names of all registered product sources, sorted.
+func Sources() []string {
+	sources := make([]string, 0, len(fetchers))
+	for source := range fetchers {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// NormalizeSource validates a source name supplied by a client. An empty
+// source means models.SourceTrendyol.
+//
+// Returns:
+//   - string: The source to use
+//   - error: If no fetcher is registered for the source
+func NormalizeSource(source string) (string, error) {
+	if source == "" {
+		return models.SourceTrendyol, nil
+	}
+	if _, ok := fetchers[source]; !ok {
+		return "", fmt.Errorf("unknown product source %q", source)
+	}
+	return source, nil
+}
+
+// trendyolFetcher fetches products from Trendyol's product detail API
+type trendyolFetcher struct{}
+
+// FetchDetails implements Fetcher.
+func (trendyolFetcher) FetchDetails(ctx context.Context, productID int) (map[string]interface{}, error) {
+	return FetchProductDetailsWithError(ctx, productID)
+}
+
+// ToProduct implements Fetcher.
+func (trendyolFetcher) ToProduct(productID int, detail map[string]interface{}) (*models.Product, error) {
+	return productFromDetail(productID, detail)
+}
+
+// faultyFetcher injects fetch faults before the real detail request.
+// Injected failures are *FetchError values, so the retry queue treats them
+// like real ones: network errors and 5xx are retried, 404 counts towards
+// discontinuation.
+type faultyFetcher struct {
+	Fetcher
+}
+
+// FetchDetails implements Fetcher.
+func (f faultyFetcher) FetchDetails(ctx context.Context, productID int) (map[string]interface{}, error) {
+	if err := faults.Inject(faults.TargetFetch, faults.Scope{ProductID: productID}); err != nil {
+		var fault *faults.Fault
+		errors.As(err, &fault)
+		return nil, &FetchError{ProductID: productID, StatusCode: fault.StatusCode, Err: err}
+	}
+	return f.Fetcher.FetchDetails(ctx, productID)
+}
@@ -0,0 +1,292 @@
+// Package crawler implements the user profile, password update and account
+// deletion endpoints
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/auth"
+	"scraper/internal/emailaddr"
+	"scraper/internal/models"
+)
+
+// Profile update errors
+var (
+	// ErrEmailTaken is returned when another user has the email address,
+	// ignoring case
+	ErrEmailTaken = errors.New("user with this email already exists")
+	// ErrUsernameTaken is returned when another user has the username
+	ErrUsernameTaken = errors.New("username is already taken")
+)
+
+// UserUpdate holds the profile fields to change; nil fields keep their value
+type UserUpdate struct {
+	Name     *string // Full name
+	Username *string // Username, unique
+	Email    *string // Email address, normalized and unique ignoring case
+}
+
+// UpdateUser changes a user's profile with the uniqueness checks of
+// registration, leaving out the user's own row.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to change
+//   - update: Fields to change
+//
+// Returns:
+//   - models.User: The changed user, with the password cleared
+//   - error: gorm.ErrRecordNotFound for an unknown user, ErrEmailTaken,
+//     ErrUsernameTaken or any database error
+func UpdateUser(db *gorm.DB, userID uint, update UserUpdate) (models.User, error) {
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		updates := make(map[string]interface{})
+		if update.Email != nil {
+			var count int64
+			err := tx.Model(&models.User{}).Where("lower(email) = ? AND id <> ?", emailaddr.Key(*update.Email), userID).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrEmailTaken
+			}
+			updates["email"] = *update.Email
+		}
+		if update.Username != nil {
+			var count int64
+			err := tx.Model(&models.User{}).Where("username = ? AND id <> ?", *update.Username, userID).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrUsernameTaken
+			}
+			updates["username"] = *update.Username
+		}
+		if update.Name != nil {
+			updates["name"] = *update.Name
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Model(&user).Updates(updates).Error
+	})
+	user.Password = ""
+	return user, err
+}
+
+// ChangePassword replaces a user's password after checking the current one.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User whose password to change
+//   - current: The user's current password
+//   - password: The new password
+//
+// Returns:
+//   - error: gorm.ErrRecordNotFound for an unknown user,
+//     ErrInvalidCredentials for a wrong current password, or any database
+//     or hashing error
+func ChangePassword(db *gorm.DB, userID uint, current, password string) error {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return err
+	}
+	if !auth.CheckPassword(user.Password, current) {
+		return ErrInvalidCredentials
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return db.Model(&user).Update("password", hash).Error
+}
+
+// DeleteUser deactivates and soft-deletes a user and removes their favorites
+// in one transaction, so the favorites scheduler stops fetching products
+// nobody follows anymore. Each unfavorited product's LocalFavoritesCount is
+// decremented, and a product left without followers is no longer marked as a
+// favorite.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to delete
+//
+// Returns:
+//   - int64: Favorites removed
+//   - error: gorm.ErrRecordNotFound for an unknown or already deleted user,
+//     or any database error
+func DeleteUser(db *gorm.DB, userID uint) (int64, error) {
+	var removed int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		var favorites []models.UserFavorite
+		if err := tx.Select("product_id", "source").Where("user_id = ?", userID).Find(&favorites).Error; err != nil {
+			return err
+		}
+		result := tx.Where("user_id = ?", userID).Delete(&models.UserFavorite{})
+		if result.Error != nil {
+			return result.Error
+		}
+		removed = result.RowsAffected
+
+		for _, favorite := range favorites {
+			err := tx.Model(&models.Product{}).Where("id = ? AND source = ?", favorite.ProductID, favorite.Source).
+				UpdateColumn("local_favorites_count", gorm.Expr("GREATEST(local_favorites_count - 1, 0)")).Error
+			if err != nil {
+				return err
+			}
+			// The scheduler only refreshes products marked as favorites
+			err = tx.Model(&models.Product{}).
+				Where("id = ? AND source = ? AND is_favorite", favorite.ProductID, favorite.Source).
+				Where("NOT EXISTS (SELECT 1 FROM user_favorites f WHERE f.product_id = products.id AND f.source = products.source AND f.deleted_at IS NULL)").
+				UpdateColumn("is_favorite", false).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&user).UpdateColumn("is_active", false).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	return removed, err
+}
+
+// registerUserProfileHandlers sets up the profile, password update and
+// account deletion endpoints.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - validate: Request validator
+func registerUserProfileHandlers(e *echo.Echo, db *gorm.DB, validate *validator.Validate) {
+	// PUT /users/:id
+	// Changes a user's name, username or email address. Omitted fields keep
+	// their value. Returns 409 if another user has the email address or the
+	// username.
+	// Request body: {"name": string, "username": string, "email": string}
+	e.PUT("/users/:id", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		var req struct {
+			Name     *string `json:"name" validate:"omitempty,min=1"`     // User's full name
+			Username *string `json:"username" validate:"omitempty,min=1"` // Username (must be unique)
+			Email    *string `json:"email" validate:"omitempty,mailbox"`  // User's email (must be unique, ignoring case)
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		// Store the address like at registration
+		if req.Email != nil {
+			normalized := emailaddr.Normalize(*req.Email)
+			req.Email = &normalized
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		if req.Name == nil && req.Username == nil && req.Email == nil {
+			return apierror.Invalid("Nothing to update")
+		}
+
+		user, err := UpdateUser(db.WithContext(c.Request().Context()), uint(userID), UserUpdate{
+			Name:     req.Name,
+			Username: req.Username,
+			Email:    req.Email,
+		})
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+		case errors.Is(err, ErrEmailTaken):
+			return apierror.Conflict("User with this email already exists")
+		case errors.Is(err, ErrUsernameTaken):
+			return apierror.Conflict("Username is already taken")
+		case err != nil:
+			return apierror.Internal("Failed to update user", err)
+		}
+
+		logrus.WithField("user_id", userID).Info("User profile updated")
+		return c.JSON(http.StatusOK, user)
+	})
+
+	// PUT /users/:id/password
+	// Sets a new password after checking the current one. Returns 204, or
+	// 403 if the current password is wrong.
+	// Request body: {"current_password": string, "new_password": string}
+	e.PUT("/users/:id/password", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+		var req struct {
+			CurrentPassword string `json:"current_password" validate:"required"`   // The user's password
+			NewPassword     string `json:"new_password" validate:"required,min=6"` // New password (min 6 chars, at most 72 bytes)
+		}
+		if err := c.Bind(&req); err != nil {
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			return apierror.InvalidFields(err)
+		}
+		// bcrypt ignores bytes beyond its limit, so longer passwords are rejected
+		if len(req.NewPassword) > auth.MaxPasswordLength {
+			return apierror.Invalid(fmt.Sprintf("new_password must be at most %d bytes", auth.MaxPasswordLength))
+		}
+
+		err = ChangePassword(db.WithContext(c.Request().Context()), uint(userID), req.CurrentPassword, req.NewPassword)
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+		case errors.Is(err, ErrInvalidCredentials):
+			logrus.WithField("user_id", userID).Info("Password change with a wrong current password")
+			return apierror.New(http.StatusForbidden, apierror.CodeInvalidCredentials, "Current password is wrong")
+		case err != nil:
+			return apierror.Internal("Failed to change password", err)
+		}
+
+		logrus.WithField("user_id", userID).Info("User password changed")
+		return c.NoContent(http.StatusNoContent)
+	})
+	// DELETE /users/:id
+	// Deactivates and deletes a user together with their favorites. Returns
+	// 204, or 404 if the user does not exist or is already deleted.
+	e.DELETE("/users/:id", func(c echo.Context) error {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			return apierror.Invalid("Invalid user ID")
+		}
+
+		removed, err := DeleteUser(db.WithContext(c.Request().Context()), uint(userID))
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+		case err != nil:
+			return apierror.Internal("Failed to delete user", err)
+		}
+
+		logrus.WithFields(logrus.Fields{"user_id": userID, "favorites": removed}).Info("User deleted")
+		return c.NoContent(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,63 @@
+package crawler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+func TestDeleteUser(t *testing.T) {
+	db := openStressDB(t)
+
+	leaving, staying := uint(stressBaseID), uint(stressBaseID+1)
+	shared, orphaned := uint(stressBaseID), uint(stressBaseID+1)
+	source := models.SourceTrendyol
+	now := time.Now()
+	rows := []interface{}{
+		&models.User{Model: gorm.Model{ID: leaving}, Email: "leaving@example.test", IsActive: true},
+		&models.User{Model: gorm.Model{ID: staying}, Email: "staying@example.test", IsActive: true},
+		&models.Product{ID: shared, Source: source, IsFavorite: true, LocalFavoritesCount: 2},
+		&models.Product{ID: orphaned, Source: source, IsFavorite: true, LocalFavoritesCount: 1},
+		&models.UserFavorite{UserID: leaving, ProductID: shared, Source: source, AddedAt: now},
+		&models.UserFavorite{UserID: staying, ProductID: shared, Source: source, AddedAt: now},
+		&models.UserFavorite{UserID: leaving, ProductID: orphaned, Source: source, AddedAt: now},
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := DeleteUser(db, leaving)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("removed %d favorites, want 2", removed)
+	}
+	checkLocalFavoritesCounts(t, db)
+
+	var user models.User
+	if err := db.Unscoped().First(&user, leaving).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.IsActive || !user.DeletedAt.Valid {
+		t.Errorf("user active = %v, deleted = %v; want inactive and deleted", user.IsActive, user.DeletedAt.Valid)
+	}
+
+	var products []models.Product
+	if err := db.Where("id IN ?", []uint{shared, orphaned}).Order("id").Find(&products).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || !products[0].IsFavorite || products[1].IsFavorite {
+		t.Errorf("favorite flags = %+v, want the shared product still marked and the orphaned one not", products)
+	}
+
+	if _, err := DeleteUser(db, leaving); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("deleting twice: err = %v, want gorm.ErrRecordNotFound", err)
+	}
+}
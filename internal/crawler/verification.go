@@ -0,0 +1,274 @@
+// Package crawler implements email verification of new accounts and the
+// cleanup of accounts that were never verified
+package crawler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/apierror"
+	"scraper/internal/auth"
+	"scraper/internal/emailaddr"
+	"scraper/internal/models"
+	"scraper/internal/notification"
+)
+
+// ErrInvalidVerificationToken is returned for a verification token that is
+// forged, for another purpose, or for an address the user no longer has
+var ErrInvalidVerificationToken = errors.New("email verification token is invalid")
+
+// verificationTTL returns how long a verification link works.
+//
+// Environment Variables:
+//   - EMAIL_VERIFICATION_TTL: Lifetime of verification links (default: 48h)
+func verificationTTL() time.Duration {
+	ttl := viper.GetDuration("EMAIL_VERIFICATION_TTL")
+	if ttl <= 0 {
+		ttl = 48 * time.Hour
+	}
+	return ttl
+}
+
+// unverifiedUserTTL returns how old an unverified account gets before the
+// cleanup job removes it.
+//
+// Environment Variables:
+//   - UNVERIFIED_USER_TTL: Age of removed unverified accounts (default: 168h)
+func unverifiedUserTTL() time.Duration {
+	ttl := viper.GetDuration("UNVERIFIED_USER_TTL")
+	if ttl <= 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+	return ttl
+}
+
+// emailVerifier signs verification tokens and emails the links. Without a
+// login token issuer there is nothing to sign with, so new accounts are
+// created verified.
+type emailVerifier struct {
+	issuer *auth.Issuer               // Signs the tokens; nil disables verification
+	emails *notification.EmailService // Sends the verification emails
+}
+
+// newEmailVerifier creates the verifier of POST /users.
+//
+// Parameters:
+//   - db: Database connection
+//   - issuer: Signs the tokens; nil when JWT_SECRET is not configured
+//
+// Returns:
+//   - *emailVerifier: The verifier
+func newEmailVerifier(db *gorm.DB, issuer *auth.Issuer) *emailVerifier {
+	if issuer == nil {
+		logrus.Warn("Email verification disabled, new accounts are created verified")
+	}
+	return &emailVerifier{issuer: issuer, emails: notification.NewEmailService(db)}
+}
+
+// enabled reports whether new accounts must verify their email address.
+func (v *emailVerifier) enabled() bool {
+	return v.issuer != nil
+}
+
+// send emails a user the verification link. Failures are logged; the user
+// stays unverified.
+//
+// Environment Variables:
+//   - PUBLIC_BASE_URL: Base URL of the crawler in the link (default: http://localhost:8080)
+//
+// Parameters:
+//   - user: The new user
+func (v *emailVerifier) send(user models.User) {
+	fields := logrus.Fields{"user_id": user.ID}
+	token, expiresAt, err := v.issuer.IssueFor(auth.PurposeVerifyEmail, user.ID, user.Email, verificationTTL(), time.Now())
+	if err != nil {
+		logrus.WithError(err).WithFields(fields).Error("Failed to issue verification token")
+		return
+	}
+	base := strings.TrimRight(viper.GetString("PUBLIC_BASE_URL"), "/")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	link := base + "/users/verify?token=" + url.QueryEscape(token)
+	if err := v.emails.SendEmailVerification(user, link, expiresAt); err != nil {
+		logrus.WithError(err).WithFields(fields).Error("Failed to send verification email")
+		return
+	}
+	logrus.WithFields(fields).Info("Verification email sent")
+}
+
+// VerifyEmail marks the user of a verification token verified. Verifying
+// again succeeds without changing anything.
+//
+// Parameters:
+//   - db: Database connection
+//   - issuer: Verifies the token
+//   - token: The token from the verification link
+//
+// Returns:
+//   - uint: The verified user
+//   - error: auth.ErrTokenExpired, ErrInvalidVerificationToken or any
+//     database error
+func VerifyEmail(db *gorm.DB, issuer *auth.Issuer, token string) (uint, error) {
+	claims, err := issuer.ParseFor(auth.PurposeVerifyEmail, token, time.Now())
+	if errors.Is(err, auth.ErrTokenExpired) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, ErrInvalidVerificationToken
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return 0, ErrInvalidVerificationToken
+	}
+
+	// The link only verifies the address it was sent to
+	result := db.Model(&models.User{}).
+		Where("id = ? AND lower(email) = ?", userID, emailaddr.Key(claims.Email)).
+		Update("verified", true)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, ErrInvalidVerificationToken
+	}
+	return userID, nil
+}
+
+// PurgeUnverifiedUsers removes the accounts that are still unverified after
+// the TTL, each in its own transaction. Their favorites are removed like in
+// DeleteUser, then the user and every row that belongs to it are deleted for
+// good, so the address can register again.
+//
+// Parameters:
+//   - db: Database connection
+//   - olderThan: Accounts created before this time are removed
+//
+// Returns:
+//   - int: Accounts removed
+//   - error: The first database error; accounts removed before it stay removed
+func PurgeUnverifiedUsers(db *gorm.DB, olderThan time.Time) (int, error) {
+	var userIDs []uint
+	err := db.Model(&models.User{}).
+		Where("verified = ? AND created_at < ?", false, olderThan).
+		Pluck("id", &userIDs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, userID := range userIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Skip a user who verified since the lookup
+			var user models.User
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id = ? AND verified = ?", userID, false).
+				Take(&user).Error
+			if err != nil {
+				return err
+			}
+			if _, err := DeleteUser(tx, userID); err != nil {
+				return err
+			}
+			for _, model := range []interface{}{
+				&models.UserFavorite{}, &models.FavoriteCollection{}, &models.SellerWatch{},
+				&models.BrandWatch{}, &models.SuppressedNotification{}, &models.NotificationHistory{},
+				&models.PendingNotification{}, &models.PasswordResetToken{},
+			} {
+				if err := tx.Unscoped().Where("user_id = ?", userID).Delete(model).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Unscoped().Delete(&models.User{}, userID).Error
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// startUnverifiedUserCleanupJob schedules the removal of accounts that were
+// never verified.
+//
+// Environment Variables:
+//   - UNVERIFIED_USER_CLEANUP_CRON: Cron expression for the job (default: 0 5 * * *)
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startUnverifiedUserCleanupJob(db *gorm.DB) *cron.Cron {
+	spec := viper.GetString("UNVERIFIED_USER_CLEANUP_CRON")
+	if spec == "" {
+		spec = "0 5 * * *" // Every night at 05:00
+	}
+
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	if _, err := c.AddFunc(spec, func() {
+		purged, err := PurgeUnverifiedUsers(db, time.Now().Add(-unverifiedUserTTL()))
+		if err != nil {
+			logrus.WithError(err).WithField("purged", purged).Error("Failed to remove unverified users")
+			return
+		}
+		if purged > 0 {
+			logrus.WithField("purged", purged).Info("Removed unverified users")
+		}
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid unverified user cleanup cron expression")
+	}
+	c.Start()
+
+	logrus.WithField("schedule", spec).Info("Unverified user cleanup job scheduled")
+	return c
+}
+
+// registerVerificationHandlers sets up the email verification endpoint. It is
+// public: the signed token identifies the user.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection
+//   - issuer: Verifies the tokens; nil when JWT_SECRET is not configured
+func registerVerificationHandlers(e *echo.Echo, db *gorm.DB, issuer *auth.Issuer) {
+	// GET /users/verify?token=...
+	// Marks the account of the emailed link verified. Returns 400 if the
+	// token is invalid or expired.
+	e.GET("/users/verify", func(c echo.Context) error {
+		if issuer == nil {
+			return apierror.New(http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Email verification is not configured")
+		}
+		token := c.QueryParam("token")
+		if token == "" {
+			return apierror.Invalid("token is required")
+		}
+
+		userID, err := VerifyEmail(db.WithContext(c.Request().Context()), issuer, token)
+		switch {
+		case errors.Is(err, auth.ErrTokenExpired):
+			return apierror.Invalid("Verification link has expired")
+		case errors.Is(err, ErrInvalidVerificationToken):
+			return apierror.Invalid("Verification link is invalid")
+		case err != nil:
+			return apierror.Internal("Failed to verify email address", err)
+		}
+
+		logrus.WithField("user_id", userID).Info("Email address verified")
+		return c.JSON(http.StatusOK, map[string]string{"status": "Email address verified"})
+	})
+}
@@ -0,0 +1,76 @@
+package crawler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"scraper/internal/auth"
+	"scraper/internal/models"
+)
+
+func TestVerifyAndPurgeUsers(t *testing.T) {
+	db := openStressDB(t)
+	if err := db.AutoMigrate(
+		&models.FavoriteCollection{}, &models.SellerWatch{}, &models.BrandWatch{},
+		&models.SuppressedNotification{}, &models.NotificationHistory{},
+		&models.PendingNotification{}, &models.PasswordResetToken{},
+	); err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := auth.NewIssuer("verification-test-secret-0123456789", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, stale, fresh := uint(stressBaseID), uint(stressBaseID+1), uint(stressBaseID+2)
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	for _, user := range []*models.User{
+		{Model: gorm.Model{ID: verified, CreatedAt: old}, Email: "verified@example.test", IsActive: true},
+		{Model: gorm.Model{ID: stale, CreatedAt: old}, Email: "stale@example.test", IsActive: true},
+		{Model: gorm.Model{ID: fresh}, Email: "fresh@example.test", IsActive: true},
+	} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	login, _, err := issuer.Issue(verified, "verified@example.test", false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyEmail(db, issuer, login); !errors.Is(err, ErrInvalidVerificationToken) {
+		t.Errorf("login token: err = %v, want ErrInvalidVerificationToken", err)
+	}
+	other, _, err := issuer.IssueFor(auth.PurposeVerifyEmail, verified, "old@example.test", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyEmail(db, issuer, other); !errors.Is(err, ErrInvalidVerificationToken) {
+		t.Errorf("token for another address: err = %v, want ErrInvalidVerificationToken", err)
+	}
+	token, _, err := issuer.IssueFor(auth.PurposeVerifyEmail, verified, "Verified@Example.test", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if userID, err := VerifyEmail(db, issuer, token); err != nil || userID != verified {
+			t.Fatalf("verify %d: user = %d, err = %v", i, userID, err)
+		}
+	}
+
+	purged, err := PurgeUnverifiedUsers(db, time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("purged %d users, want 1", purged)
+	}
+	var remaining []uint
+	db.Unscoped().Model(&models.User{}).Where("id >= ?", stressBaseID).Order("id").Pluck("id", &remaining)
+	if len(remaining) != 2 || remaining[0] != verified || remaining[1] != fresh {
+		t.Errorf("remaining users = %v, want %d and %d", remaining, verified, fresh)
+	}
+}
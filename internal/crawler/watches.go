@@ -0,0 +1,218 @@
+// Package crawler implements seller and brand watch management endpoints
+package crawler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"scraper/internal/apierror"
+	"scraper/internal/auth"
+	"scraper/internal/models"
+)
+
+// registerWatchHandlers sets up the endpoints that let users follow sellers
+// and brands. Seller watchers are notified by the analysis service when a
+// watched seller lists a new product or significantly drops the price of an
+// existing one. Brand watchers receive a daily digest of new arrivals and
+// notable price drops from the notification service.
+//
+// Parameters:
+//   - e: Echo instance for HTTP routing
+//   - db: Database connection for watch operations
+//   - validate: Shared request validator
+func registerWatchHandlers(e *echo.Echo, db *gorm.DB, validate *validator.Validate) {
+	// POST /seller-watches
+	// Starts watching a seller for a user
+	// Request body: {"user_id": uint, "seller_id": uint}
+	e.POST("/seller-watches", func(c echo.Context) error {
+		// Parse and validate request
+		var req struct {
+			UserID   uint `json:"user_id" validate:"required"`   // ID of the watching user
+			SellerID uint `json:"seller_id" validate:"required"` // Trendyol merchant ID
+		}
+		if err := c.Bind(&req); err != nil {
+			logrus.WithError(err).Error("Invalid seller watch request")
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			logrus.WithError(err).Error("Validation failed for seller watch request")
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+
+		// Make sure the user exists
+		var user models.User
+		if err := db.First(&user, req.UserID).Error; err != nil {
+			logrus.WithError(err).Error("User not found")
+			return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+		}
+
+		// Reject duplicate watches
+		var count int64
+		db.Model(&models.SellerWatch{}).Where("user_id = ? AND seller_id = ?", req.UserID, req.SellerID).Count(&count)
+		if count > 0 {
+			return apierror.Conflict("Seller is already watched")
+		}
+
+		watch := models.SellerWatch{UserID: req.UserID, SellerID: req.SellerID}
+		if err := db.Create(&watch).Error; err != nil {
+			return apierror.Internal("Failed to watch seller", err)
+		}
+
+		logrus.WithFields(logrus.Fields{"user_id": req.UserID, "seller_id": req.SellerID}).Info("Seller watch created")
+		return c.JSON(http.StatusCreated, watch)
+	})
+
+	// GET /seller-watches/:user_id
+	// Lists the sellers watched by a user
+	e.GET("/seller-watches/:user_id", func(c echo.Context) error {
+		// Parse and validate user ID from URL
+		userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+		if err != nil {
+			logrus.WithError(err).Error("Invalid user ID")
+			return apierror.Invalid("Invalid user ID")
+		}
+
+		var watches []models.SellerWatch
+		if err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&watches).Error; err != nil {
+			return apierror.Internal("Failed to get seller watches", err)
+		}
+		return c.JSON(http.StatusOK, watches)
+	})
+
+	// DELETE /seller-watches
+	// Stops watching a seller
+	// Request body: {"user_id": uint, "seller_id": uint}
+	e.DELETE("/seller-watches", func(c echo.Context) error {
+		// Parse and validate request
+		var req struct {
+			UserID   uint `json:"user_id" validate:"required"`   // ID of the watching user
+			SellerID uint `json:"seller_id" validate:"required"` // Trendyol merchant ID
+		}
+		if err := c.Bind(&req); err != nil {
+			logrus.WithError(err).Error("Invalid seller watch deletion request")
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			logrus.WithError(err).Error("Validation failed for seller watch deletion")
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+
+		// Hard delete so the unique index allows watching the seller again later
+		result := db.Unscoped().Where("user_id = ? AND seller_id = ?", req.UserID, req.SellerID).Delete(&models.SellerWatch{})
+		if result.Error != nil {
+			return apierror.Internal("Failed to remove seller watch", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return apierror.NotFound(apierror.CodeNotFound, "Seller watch not found")
+		}
+
+		logrus.WithFields(logrus.Fields{"user_id": req.UserID, "seller_id": req.SellerID}).Info("Seller watch removed")
+		return c.JSON(http.StatusOK, map[string]string{"status": "Seller watch removed"})
+	})
+
+	// POST /brand-watches
+	// Subscribes a user to a brand's daily digest
+	// Request body: {"user_id": uint, "brand_id": uint}
+	e.POST("/brand-watches", func(c echo.Context) error {
+		// Parse and validate request
+		var req struct {
+			UserID  uint `json:"user_id" validate:"required"`  // ID of the watching user
+			BrandID uint `json:"brand_id" validate:"required"` // Trendyol brand ID
+		}
+		if err := c.Bind(&req); err != nil {
+			logrus.WithError(err).Error("Invalid brand watch request")
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			logrus.WithError(err).Error("Validation failed for brand watch request")
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+
+		// Make sure the user exists
+		var user models.User
+		if err := db.First(&user, req.UserID).Error; err != nil {
+			logrus.WithError(err).Error("User not found")
+			return apierror.NotFound(apierror.CodeUserNotFound, "User not found")
+		}
+
+		// Reject duplicate watches
+		var count int64
+		db.Model(&models.BrandWatch{}).Where("user_id = ? AND brand_id = ?", req.UserID, req.BrandID).Count(&count)
+		if count > 0 {
+			return apierror.Conflict("Brand is already watched")
+		}
+
+		watch := models.BrandWatch{UserID: req.UserID, BrandID: req.BrandID}
+		if err := db.Create(&watch).Error; err != nil {
+			return apierror.Internal("Failed to watch brand", err)
+		}
+
+		logrus.WithFields(logrus.Fields{"user_id": req.UserID, "brand_id": req.BrandID}).Info("Brand watch created")
+		return c.JSON(http.StatusCreated, watch)
+	})
+
+	// GET /brand-watches/:user_id
+	// Lists the brands watched by a user
+	e.GET("/brand-watches/:user_id", func(c echo.Context) error {
+		// Parse and validate user ID from URL
+		userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+		if err != nil {
+			logrus.WithError(err).Error("Invalid user ID")
+			return apierror.Invalid("Invalid user ID")
+		}
+
+		var watches []models.BrandWatch
+		if err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&watches).Error; err != nil {
+			return apierror.Internal("Failed to get brand watches", err)
+		}
+		return c.JSON(http.StatusOK, watches)
+	})
+
+	// DELETE /brand-watches
+	// Unsubscribes a user from a brand
+	// Request body: {"user_id": uint, "brand_id": uint}
+	e.DELETE("/brand-watches", func(c echo.Context) error {
+		// Parse and validate request
+		var req struct {
+			UserID  uint `json:"user_id" validate:"required"`  // ID of the watching user
+			BrandID uint `json:"brand_id" validate:"required"` // Trendyol brand ID
+		}
+		if err := c.Bind(&req); err != nil {
+			logrus.WithError(err).Error("Invalid brand watch deletion request")
+			return apierror.Invalid("Invalid request")
+		}
+		if err := validate.Struct(&req); err != nil {
+			logrus.WithError(err).Error("Validation failed for brand watch deletion")
+			return apierror.InvalidFields(err)
+		}
+		if err := auth.Authorize(c, req.UserID); err != nil {
+			return err
+		}
+
+		// Hard delete so the unique index allows watching the brand again later
+		result := db.Unscoped().Where("user_id = ? AND brand_id = ?", req.UserID, req.BrandID).Delete(&models.BrandWatch{})
+		if result.Error != nil {
+			return apierror.Internal("Failed to remove brand watch", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return apierror.NotFound(apierror.CodeNotFound, "Brand watch not found")
+		}
+
+		logrus.WithFields(logrus.Fields{"user_id": req.UserID, "brand_id": req.BrandID}).Info("Brand watch removed")
+		return c.JSON(http.StatusOK, map[string]string{"status": "Brand watch removed"})
+	})
+}
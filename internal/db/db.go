@@ -3,6 +3,8 @@ package db
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 
 	// viper for configuration management
 	"github.com/spf13/viper"
@@ -11,15 +13,33 @@ import (
 	"gorm.io/gorm"
 
 	// internal models for database schema
+	"scraper/internal/auth"
+	"scraper/internal/emailaddr"
 	"scraper/internal/models"
+	"scraper/pkg/readiness"
 
 	// logrus for structured logging
 	"github.com/sirupsen/logrus"
 )
 
+// Migrations run once per process; the services of a single-process
+// deployment share them instead of migrating concurrently
+var (
+	migrateOnce sync.Once
+	migrated    = readiness.New()
+)
+
+// Ready returns a channel that is closed once this process has finished the
+// schema migrations. Services wait for it before touching the database.
+func Ready() <-chan struct{} {
+	return migrated.Ready()
+}
+
 // Setup initializes the PostgreSQL database connection and runs migrations.
 // It reads configuration from environment variables using viper, sets up the
 // connection, performs auto-migrations, and ensures a default admin user exists.
+// Migrations only run on the first call in a process; concurrent callers block
+// until they have finished.
 // Returns a configured *gorm.DB instance or panics on fatal errors.
 func Setup() *gorm.DB {
 	// Read database configuration from environment variables
@@ -50,29 +70,389 @@ func Setup() *gorm.DB {
 		logrus.WithError(err).Fatal("Failed to connect to database")
 	}
 
+	migrateOnce.Do(func() {
+		migrate(db)
+		migrated.Mark()
+	})
+	return db // Return configured database connection
+}
+
+// migrate brings the schema up to date and seeds the default admin user.
+// Failures are fatal since no service can run on an outdated schema.
+//
+// Parameters:
+//   - db: Database connection
+func migrate(db *gorm.DB) {
+	// Accounts created before email verification count as verified
+	verifyExisting := db.Migrator().HasTable(&models.User{}) && !db.Migrator().HasColumn(&models.User{}, "verified")
+	// Price logs written before they carried a source default to trendyol
+	attributeLogs := db.Migrator().HasTable(&models.PriceStockLog{}) && !db.Migrator().HasColumn(&models.PriceStockLog{}, "source")
+
 	// Auto-migrate database schema for all models
 	// This creates tables if they don't exist and updates existing ones
 	db.AutoMigrate(
 		&models.Product{},      // Product information table
 		&models.PriceStockLog{}, // Price and stock history
+		&models.PriceHistory{},  // Price changes made through the API
+		&models.RatingLog{},     // Rating and review count history
 		&models.User{},         // User accounts
 		&models.UserFavorite{}, // User's favorite products
+		&models.FavoriteCollection{},  // User-defined folders of favorites
+		&models.SellerWatch{},  // Sellers followed by users
+		&models.BrandWatch{},   // Brands followed by users
+		&models.BrandEvent{},   // New arrivals and price drops for watched brands
+		&models.FetchRetry{},   // Products waiting for a fetch retry
+		&models.NotificationHistory{}, // One-time notifications already sent
+		&models.NotificationLog{},     // Outcome of every outgoing notification
+		&models.SchedulerState{},      // Pause state of background schedulers
+		&models.RequestBudget{},       // Daily outbound request counters
+		&models.SuppressedNotification{}, // Notifications held back by a snooze
+		&models.ReconciliationReport{},   // Results of DB vs. marketplace reconciliation runs
+		&models.CrawlReport{},            // Progress and results of live crawls
+		&models.OutboxEvent{},            // Kafka events waiting for the outbox relay
+		&models.PendingNotification{},    // Notifications spilled from the full send queue
+		&models.FanOutCheckpoint{},       // Progress of price change fan-outs to watchers
+		&models.PasswordResetToken{},     // One-time password reset tokens
+		&models.ProductRelisting{},       // Inactive products found listed again
+		&models.PriceDropStat{},          // Precomputed price drop leaderboards
+		&models.PriceDropStatsRun{},      // When each leaderboard was last computed
+		&models.SchedulerRun{},           // Per-product outcomes of scheduler cycles
+		&models.IngestSubmission{},       // Recent browser extension payloads, for deduplication
+		&models.IngestError{},            // Malformed browser extension payloads
 	)
 
+	// Bring tables created before multi-source crawling up to date
+	if err := migrateProductSource(db); err != nil {
+		logrus.WithError(err).Fatal("Failed to migrate product source")
+	}
+	if attributeLogs {
+		if err := attributePriceLogs(db); err != nil {
+			logrus.WithError(err).Fatal("Failed to attribute price logs to their source")
+		}
+	}
+
+	// Product IDs are 64-bit; widen columns created as 32-bit integers
+	if err := widenProductIDColumns(db); err != nil {
+		logrus.WithError(err).Fatal("Failed to widen product ID columns")
+	}
+
+	// Price history aggregation reads the numeric columns
+	if err := backfillPriceLogValues(db); err != nil {
+		logrus.WithError(err).Fatal("Failed to backfill price history values")
+	}
+
+	// Attribute filters match the lower-cased attributes so they ignore case;
+	// index that expression rather than the raw column
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_products_attributes_lower ON products USING gin ((lower(attributes::text)::jsonb))").Error; err != nil {
+		logrus.WithError(err).Fatal("Failed to create product attributes index")
+	}
+
+	// The product listing pages through the most recently updated products
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_products_updated_at ON products (updated_at DESC)").Error; err != nil {
+		logrus.WithError(err).Fatal("Failed to create product updated_at index")
+	}
+
+	// The outbox relay reads the pending events in ID order; delivered events
+	// stay until cleanup and must not slow that read down
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox (id) WHERE delivered_at IS NULL").Error; err != nil {
+		logrus.WithError(err).Fatal("Failed to create outbox index")
+	}
+
+	// Store addresses normalized and keep accounts unique regardless of
+	// case. Collisions are reported, not fatal: they need an operator.
+	if err := migrateUserEmails(db); err != nil {
+		logrus.WithError(err).Fatal("Failed to migrate user emails")
+	}
+
+	// Login compares bcrypt hashes; hash passwords stored in plain text
+	if err := migrateUserPasswords(db); err != nil {
+		logrus.WithError(err).Fatal("Failed to migrate user passwords")
+	}
+
+	if verifyExisting {
+		if err := db.Model(&models.User{}).Where("verified = ?", false).UpdateColumn("verified", true).Error; err != nil {
+			logrus.WithError(err).Fatal("Failed to mark existing users verified")
+		}
+	}
+
+	// Product search matches substrings with ILIKE, which only trigram indexes
+	// serve. Search still works without them, so a missing extension is not fatal.
+	if err := createSearchIndexes(db); err != nil {
+		logrus.WithError(err).Warn("Failed to create product search indexes, search falls back to sequential scans")
+	}
+
 	// Ensure at least one admin user exists in the system
 	var count int64
 	db.Model(&models.User{}).Count(&count)
 	if count == 0 {
 		// Create default admin user for first-time setup
+		hash, err := auth.HashPassword("admin123")
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to hash default admin password")
+		}
 		db.Create(&models.User{
 			Email:    "faisal712000@gmail.com",
 			Username: "admin",
-			Password: "admin123", // TODO: Hash password before storing in production
+			Password: hash,
 			Name:     "Admin User",
+			IsAdmin:  true,
+			Verified: true,
 		})
 		logrus.Info("Created default admin user")
 	}
 
 	logrus.Info("Database initialized successfully")
-	return db // Return configured database connection
-}
\ No newline at end of file
+}
+
+// migrateProductSource upgrades tables created before products carried a
+// marketplace Source. AutoMigrate adds the columns but does not change keys,
+// so this:
+// 1. Backfills empty sources with models.SourceTrendyol
+// 2. Makes (id, source) the primary key of products
+// 3. Adds source to the user/product unique index of user_favorites
+// 4. Replaces the product-only unique index of fetch_retries
+// 5. Adds source to the product/time index of price_stock_logs
+//
+// Every step is idempotent, so it is safe to run on each startup.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - error: The first failing statement
+func migrateProductSource(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Backfill rows created before the column existed
+		for _, table := range []string{"products", "user_favorites"} {
+			if err := tx.Exec("UPDATE "+table+" SET source = ? WHERE source IS NULL OR source = ''", models.SourceTrendyol).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("UPDATE fetch_retries SET product_source = ? WHERE product_source IS NULL OR product_source = ''", models.SourceTrendyol).Error; err != nil {
+			return err
+		}
+
+		// Include source in the products primary key
+		var pkColumns int64
+		err := tx.Raw(`SELECT COUNT(*) FROM information_schema.key_column_usage k
+			JOIN information_schema.table_constraints c ON c.constraint_name = k.constraint_name AND c.table_name = k.table_name
+			WHERE c.table_name = 'products' AND c.constraint_type = 'PRIMARY KEY' AND k.column_name = 'source'`).Scan(&pkColumns).Error
+		if err != nil {
+			return err
+		}
+		if pkColumns == 0 {
+			logrus.Info("Adding source to the products primary key")
+			if err := tx.Exec("ALTER TABLE products ALTER COLUMN source SET NOT NULL").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("ALTER TABLE products DROP CONSTRAINT IF EXISTS products_pkey, ADD PRIMARY KEY (id, source)").Error; err != nil {
+				return err
+			}
+		}
+
+		// Recreate the favorites unique index if it predates the source column
+		var indexDef string
+		if err := tx.Raw("SELECT indexdef FROM pg_indexes WHERE tablename = 'user_favorites' AND indexname = 'idx_user_product'").Scan(&indexDef).Error; err != nil {
+			return err
+		}
+		if !strings.Contains(indexDef, "source") {
+			logrus.Info("Adding source to the user favorites unique index")
+			if err := tx.Exec("DROP INDEX IF EXISTS idx_user_product").Error; err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&models.UserFavorite{}, "idx_user_product"); err != nil {
+				return err
+			}
+		}
+
+		// Recreate the price history index if it predates the source column
+		indexDef = ""
+		if err := tx.Raw("SELECT indexdef FROM pg_indexes WHERE tablename = 'price_stock_logs' AND indexname = 'idx_price_stock_logs_product_time'").Scan(&indexDef).Error; err != nil {
+			return err
+		}
+		if !strings.Contains(indexDef, "source") {
+			logrus.Info("Adding source to the price history index")
+			if err := tx.Exec("DROP INDEX IF EXISTS idx_price_stock_logs_product_time").Error; err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&models.PriceStockLog{}, "idx_price_stock_logs_product_time"); err != nil {
+				return err
+			}
+		}
+
+		// Fetch retries are now unique per (product, source)
+		return tx.Exec("DROP INDEX IF EXISTS idx_fetch_retries_product_id").Error
+	})
+}
+
+// attributePriceLogs sets the source of price history rows written before
+// price_stock_logs had the column. They were given models.SourceTrendyol;
+// rows whose product ID is only stored under one other source belong to
+// that source. IDs stored under several sources stay trendyol, the source
+// every log was written for before multi-source crawling.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - error: If the update fails
+func attributePriceLogs(db *gorm.DB) error {
+	return db.Exec(`UPDATE price_stock_logs l SET source = p.source FROM products p
+		WHERE p.id = l.product_id AND p.source <> ?
+			AND (SELECT COUNT(*) FROM products o WHERE o.id = l.product_id) = 1`, models.SourceTrendyol).Error
+}
+
+// widenProductIDColumns changes product ID columns that are still smallint
+// or integer to bigint, so Trendyol IDs above 2^31 fit: products.id and every
+// product_id column. Columns that are already bigint are left alone, so it is
+// safe to run on each startup.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - error: The first failing statement
+func widenProductIDColumns(db *gorm.DB) error {
+	var columns []struct {
+		TableName  string
+		ColumnName string
+	}
+	err := db.Raw(`SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND data_type IN ('smallint', 'integer')
+			AND (column_name = 'product_id' OR (table_name = 'products' AND column_name = 'id'))`).Scan(&columns).Error
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		logrus.WithFields(logrus.Fields{"table": column.TableName, "column": column.ColumnName}).Info("Widening product ID column to bigint")
+		table, name := db.Statement.Quote(column.TableName), db.Statement.Quote(column.ColumnName)
+		if err := db.Exec("ALTER TABLE " + table + " ALTER COLUMN " + name + " TYPE bigint").Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillPriceLogValues fills the numeric price_value and stock_value
+// columns of price history rows written before they existed. Text values that
+// are not plain numbers are left NULL. Only rows with NULL values are touched,
+// so it is safe to run on each startup.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - error: The first failing statement
+func backfillPriceLogValues(db *gorm.DB) error {
+	const number = `'^-?[0-9]+(\.[0-9]+)?$'`
+	if err := db.Exec("UPDATE price_stock_logs SET price_value = new_price::numeric WHERE price_value IS NULL AND new_price ~ " + number).Error; err != nil {
+		return err
+	}
+	return db.Exec("UPDATE price_stock_logs SET stock_value = new_stock::numeric WHERE stock_value IS NULL AND new_stock ~ " + number).Error
+}
+
+// migrateUserEmails normalizes the stored user email addresses and adds a
+// unique index on lower(email), so addresses differing only in case can no
+// longer belong to two accounts. Existing duplicates are left untouched and
+// logged, one warning per collision, and the index is only created once they
+// are resolved; until then user creation still rejects new duplicates with
+// its own lookup. Safe to run on each startup.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - error: The first failing statement
+func migrateUserEmails(db *gorm.DB) error {
+	collisions, err := emailaddr.FindCollisions(db)
+	if err != nil {
+		return err
+	}
+	colliding := make(map[uint]bool)
+	for _, collision := range collisions {
+		logrus.WithFields(logrus.Fields{
+			"key":      collision.Key,
+			"user_ids": collision.UserIDs,
+			"emails":   collision.Emails,
+		}).Warn("Users share an email address that differs only in case or whitespace")
+		for _, id := range collision.UserIDs {
+			colliding[id] = true
+		}
+	}
+
+	// Rewrite the addresses whose normalized form differs
+	var users []models.User
+	if err := db.Unscoped().Select("id", "email").Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		normalized := emailaddr.Normalize(user.Email)
+		if normalized == user.Email || colliding[user.ID] {
+			continue
+		}
+		if err := db.Unscoped().Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("email", normalized).Error; err != nil {
+			return err
+		}
+		logrus.WithField("user_id", user.ID).Info("Normalized user email")
+	}
+
+	if len(collisions) > 0 {
+		logrus.WithField("collisions", len(collisions)).Warn("Not creating the case-insensitive user email index until the collisions are resolved, see GET /admin/users/email-collisions")
+		return nil
+	}
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (lower(email))").Error
+}
+
+// migrateUserPasswords replaces passwords stored in plain text, from before
+// users.password held bcrypt hashes, with their hash. A password is plain
+// text unless it has a bcrypt version prefix ($2a$, $2b$ or $2y$). Users
+// without a password are left alone; they cannot log in until one is set.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - error: The first failing statement
+func migrateUserPasswords(db *gorm.DB) error {
+	var users []models.User
+	err := db.Unscoped().Select("id", "password").
+		Where("password <> '' AND password NOT LIKE ? AND password NOT LIKE ? AND password NOT LIKE ?", "$2a$%", "$2b$%", "$2y$%").
+		Find(&users).Error
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if auth.IsHashed(user.Password) {
+			continue
+		}
+		hash, err := auth.HashPassword(user.Password)
+		if err != nil {
+			logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to hash stored password, the user cannot log in")
+			continue
+		}
+		if err := db.Unscoped().Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("password", hash).Error; err != nil {
+			return err
+		}
+		logrus.WithField("user_id", user.ID).Info("Hashed plain text user password")
+	}
+	return nil
+}
+
+// createSearchIndexes creates the trigram indexes used by product search.
+// pg_trgm is a trusted extension since PostgreSQL 13, so the database owner
+// can enable it.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - error: The first failing statement
+func createSearchIndexes(db *gorm.DB) error {
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		return err
+	}
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_products_name_trgm ON products USING gin (name gin_trgm_ops)").Error; err != nil {
+		return err
+	}
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_products_category_path_trgm ON products USING gin (category_path gin_trgm_ops)").Error
+}
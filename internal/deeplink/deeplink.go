@@ -0,0 +1,215 @@
+// Package deeplink implements the product links in notification emails. Links
+// point at PUBLIC_BASE_URL; with DEEPLINK_SECRET set they go through
+// GET /r/:token, whose signed token names the email and the notified user so
+// the click can be recorded before redirecting to the product page.
+package deeplink
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"scraper/internal/models"
+)
+
+// minSecretLength is the shortest DEEPLINK_SECRET accepted, in bytes
+const minSecretLength = 32
+
+// Link errors
+var (
+	ErrInvalidLink = errors.New("invalid link")
+	ErrLinkExpired = errors.New("link expired")
+)
+
+// Claims are the contents of a link token. Short JSON names keep the links
+// short.
+type Claims struct {
+	NotificationID string `json:"n"`           // Email the link was sent in, see models.NotificationLog
+	UserID         uint   `json:"u,omitempty"` // Notified user; 0 for test emails
+	ProductID      uint   `json:"p"`           // Linked product
+	Source         string `json:"s"`           // Marketplace of the product
+	ExpiresAt      int64  `json:"e"`           // Unix time after which the click is not attributed
+}
+
+// Signer builds and verifies links
+type Signer struct {
+	baseURL string        // Public base URL without a trailing slash
+	secret  []byte        // HMAC key; nil when links are not signed
+	ttl     time.Duration // How long a click is attributed
+}
+
+// FromEnv creates the signer configured in the environment. A missing or
+// short secret disables signed links: emails then link to the product page
+// directly.
+//
+// Environment Variables:
+//   - PUBLIC_BASE_URL: Base URL of the product pages in emails (default: http://localhost:8080)
+//   - DEEPLINK_SECRET: HMAC key of link tokens, at least 32 bytes (optional)
+//   - DEEPLINK_TTL: How long a link attributes clicks (default: 72h)
+//
+// Returns:
+//   - *Signer: The signer
+//   - error: Why links are not signed, nil if they are
+func FromEnv() (*Signer, error) {
+	base := strings.TrimRight(viper.GetString("PUBLIC_BASE_URL"), "/")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	ttl := viper.GetDuration("DEEPLINK_TTL")
+	if ttl <= 0 {
+		ttl = 72 * time.Hour
+	}
+	signer := &Signer{baseURL: base, ttl: ttl}
+
+	secret := viper.GetString("DEEPLINK_SECRET")
+	switch {
+	case secret == "":
+		return signer, errors.New("DEEPLINK_SECRET is not set")
+	case len(secret) < minSecretLength:
+		return signer, fmt.Errorf("DEEPLINK_SECRET must be at least %d bytes", minSecretLength)
+	}
+	signer.secret = []byte(secret)
+	return signer, nil
+}
+
+// Signed reports whether the signer creates GET /r/:token links.
+func (s *Signer) Signed() bool {
+	return s.secret != nil
+}
+
+// NewNotificationID returns a random ID for an email, stored with its
+// notification log entry and carried by its links.
+func NewNotificationID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ProductURL returns the product page URL, without attribution.
+//
+// Parameters:
+//   - productID: Product to link to
+//   - source: Marketplace of the product; empty means trendyol
+//
+// Returns:
+//   - string: The URL
+func (s *Signer) ProductURL(productID uint, source string) string {
+	u := fmt.Sprintf("%s/products/%d", s.baseURL, productID)
+	if source != "" && source != models.SourceTrendyol {
+		u += "?source=" + url.QueryEscape(source)
+	}
+	return u
+}
+
+// Link returns the link to put in an email: a GET /r/:token link when links
+// are signed, the product page otherwise.
+//
+// Parameters:
+//   - notificationID: ID of the email, from NewNotificationID
+//   - userID: Notified user; 0 when the email is not for a user
+//   - productID: Product to link to
+//   - source: Marketplace of the product; empty means trendyol
+//   - now: Time the email is rendered
+//
+// Returns:
+//   - string: The URL
+func (s *Signer) Link(notificationID string, userID, productID uint, source string, now time.Time) string {
+	if !s.Signed() {
+		return s.ProductURL(productID, source)
+	}
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+	payload, err := json.Marshal(Claims{
+		NotificationID: notificationID,
+		UserID:         userID,
+		ProductID:      productID,
+		Source:         source,
+		ExpiresAt:      now.Add(s.ttl).Unix(),
+	})
+	if err != nil {
+		return s.ProductURL(productID, source)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return s.baseURL + "/r/" + encoded + "." + s.sign(encoded)
+}
+
+// Target returns where a link redirects: the product page, with the notified
+// user and the email when the click is attributed so the web app can pick up
+// the session.
+//
+// Parameters:
+//   - claims: The link's claims
+//   - attributed: Whether the token was still valid
+//
+// Returns:
+//   - string: The URL
+func (s *Signer) Target(claims Claims, attributed bool) string {
+	target := s.ProductURL(claims.ProductID, claims.Source)
+	if !attributed {
+		return target
+	}
+	query := url.Values{}
+	if claims.UserID != 0 {
+		query.Set("user_id", strconv.FormatUint(uint64(claims.UserID), 10))
+	}
+	query.Set("notification_id", claims.NotificationID)
+	separator := "?"
+	if strings.Contains(target, "?") {
+		separator = "&"
+	}
+	return target + separator + query.Encode()
+}
+
+// Parse verifies a link token. An expired token still returns its claims, with
+// ErrLinkExpired, so the link can redirect without attribution.
+//
+// Parameters:
+//   - token: The token of a GET /r/:token link
+//   - now: Time to check the expiry against
+//
+// Returns:
+//   - Claims: The token's claims
+//   - error: ErrInvalidLink or ErrLinkExpired
+func (s *Signer) Parse(token string, now time.Time) (Claims, error) {
+	if !s.Signed() {
+		return Claims{}, ErrInvalidLink
+	}
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return Claims{}, ErrInvalidLink
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Claims{}, ErrInvalidLink
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ProductID == 0 {
+		return Claims{}, ErrInvalidLink
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrLinkExpired
+	}
+	return claims, nil
+}
+
+// sign returns the encoded HMAC-SHA256 signature of an encoded payload.
+func (s *Signer) sign(encoded string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,86 @@
+package deeplink
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(secret string) *Signer {
+	s := &Signer{baseURL: "https://shop.example.com", ttl: time.Hour}
+	if secret != "" {
+		s.secret = []byte(secret)
+	}
+	return s
+}
+
+func TestLinkRoundTrip(t *testing.T) {
+	s := newTestSigner("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+
+	link := s.Link("abc123", 42, 7, "", now)
+	token, ok := strings.CutPrefix(link, "https://shop.example.com/r/")
+	if !ok {
+		t.Fatalf("link = %q, want a /r/ link", link)
+	}
+
+	claims, err := s.Parse(token, now.Add(59*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.NotificationID != "abc123" || claims.UserID != 42 || claims.ProductID != 7 || claims.Source != "trendyol" {
+		t.Errorf("claims = %+v", claims)
+	}
+	want := "https://shop.example.com/products/7?notification_id=abc123&user_id=42"
+	if got := s.Target(claims, true); got != want {
+		t.Errorf("Target(attributed) = %q, want %q", got, want)
+	}
+
+	// Expired links keep their product but lose the attribution
+	claims, err = s.Parse(token, now.Add(time.Hour))
+	if !errors.Is(err, ErrLinkExpired) {
+		t.Fatalf("err = %v, want ErrLinkExpired", err)
+	}
+	if got := s.Target(claims, false); got != "https://shop.example.com/products/7" {
+		t.Errorf("Target(expired) = %q", got)
+	}
+}
+
+func TestParseRejectsForgedLinks(t *testing.T) {
+	s := newTestSigner("0123456789abcdef0123456789abcdef")
+	other := newTestSigner(strings.Repeat("x", minSecretLength))
+	now := time.Unix(1700000000, 0)
+	token := strings.TrimPrefix(s.Link("abc123", 42, 7, "", now), "https://shop.example.com/r/")
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := strings.TrimPrefix(other.Link("abc123", 1, 7, "", now), "https://shop.example.com/r/")
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	for name, bad := range map[string]string{
+		"other secret":    forged,
+		"swapped payload": forgedPayload + "." + signature,
+		"missing sig":     payload,
+		"empty":           "",
+		"garbage":         "not-a-token",
+		"unsigned signer": token,
+	} {
+		signer := s
+		if name == "unsigned signer" {
+			signer = newTestSigner("")
+		}
+		if _, err := signer.Parse(bad, now); !errors.Is(err, ErrInvalidLink) {
+			t.Errorf("%s: err = %v, want ErrInvalidLink", name, err)
+		}
+	}
+}
+
+func TestUnsignedLinksPointAtTheProduct(t *testing.T) {
+	s := newTestSigner("")
+	now := time.Unix(1700000000, 0)
+	if got := s.Link("abc123", 42, 7, "", now); got != "https://shop.example.com/products/7" {
+		t.Errorf("Link = %q", got)
+	}
+	if got := s.Link("abc123", 42, 7, "hepsiburada", now); got != "https://shop.example.com/products/7?source=hepsiburada" {
+		t.Errorf("Link with source = %q", got)
+	}
+}
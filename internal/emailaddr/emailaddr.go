@@ -0,0 +1,193 @@
+// Package emailaddr implements normalization and validation of user email
+// addresses, so an address is stored, compared and mailed in one form
+// however it was typed or pasted
+package emailaddr
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+// keyExpr is Key in SQL, for grouping stored addresses
+const keyExpr = "lower(btrim(email, E' \\t\\r\\n'))"
+
+// Length limits of RFC 5321
+const (
+	maxLocalLength   = 64
+	maxDomainLength  = 253
+	maxAddressLength = 254
+)
+
+// Normalize trims surrounding whitespace and lower-cases the domain. The
+// local part keeps its case unless EMAIL_LOWERCASE_LOCAL is set; mail
+// servers may treat it case-sensitively, though few do. Addresses without
+// "@" are only trimmed.
+//
+// Environment Variables:
+//   - EMAIL_LOWERCASE_LOCAL: Lower-case the local part too (default: false)
+//
+// Parameters:
+//   - address: Address as entered
+//
+// Returns:
+//   - string: The normalized address
+func Normalize(address string) string {
+	address = strings.TrimSpace(address)
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+	local, domain := address[:at], strings.ToLower(address[at+1:])
+	if viper.GetBool("EMAIL_LOWERCASE_LOCAL") {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + domain
+}
+
+// Key returns the form two addresses are compared in for uniqueness: the
+// normalized address, fully lower-cased. It matches the lower(email) unique
+// index on users, so "User@x.com" and "user@x.com" belong to one account
+// whether or not the local part is lower-cased when stored.
+func Key(address string) string {
+	return strings.ToLower(Normalize(address))
+}
+
+// Validate checks a normalized address more strictly than the validator's
+// email tag: it rejects whitespace and control characters, display names,
+// quoted local parts, IP literals, domains without a dot and top-level
+// domains that are not at least two letters (or an xn-- label).
+//
+// Parameters:
+//   - address: Normalized address
+//
+// Returns:
+//   - error: Why the address is invalid, nil if it is valid
+func Validate(address string) error {
+	if address == "" {
+		return errors.New("email address is empty")
+	}
+	if len(address) > maxAddressLength {
+		return fmt.Errorf("email address is longer than %d characters", maxAddressLength)
+	}
+	for _, r := range address {
+		if r <= ' ' || r == 0x7f {
+			return errors.New("email address contains spaces or control characters")
+		}
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Name != "" || parsed.Address != address {
+		return errors.New("email address is malformed")
+	}
+
+	at := strings.LastIndex(address, "@")
+	local, domain := address[:at], address[at+1:]
+	if len(local) > maxLocalLength {
+		return fmt.Errorf("local part is longer than %d characters", maxLocalLength)
+	}
+	if strings.HasPrefix(local, `"`) {
+		return errors.New("quoted local parts are not supported")
+	}
+	if len(domain) > maxDomainLength {
+		return fmt.Errorf("domain is longer than %d characters", maxDomainLength)
+	}
+
+	labels := strings.Split(strings.ToLower(domain), ".")
+	if len(labels) < 2 {
+		return errors.New("domain must contain a dot")
+	}
+	for _, label := range labels {
+		if !validLabel(label) {
+			return fmt.Errorf("domain label %q is invalid", label)
+		}
+	}
+	if !validTLD(labels[len(labels)-1]) {
+		return errors.New("top-level domain is invalid")
+	}
+	return nil
+}
+
+// validLabel reports whether a lower-cased DNS label has 1-63 letters,
+// digits and inner hyphens.
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validTLD reports whether a lower-cased top-level domain is alphabetic and
+// at least two letters long, or an internationalized xn-- label.
+func validTLD(tld string) bool {
+	if strings.HasPrefix(tld, "xn--") {
+		return len(tld) > len("xn--")
+	}
+	if len(tld) < 2 {
+		return false
+	}
+	for _, c := range tld {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Collision is a set of users whose addresses share one Key
+type Collision struct {
+	Key     string   `json:"key"`      // Shared comparison form
+	UserIDs []uint   `json:"user_ids"` // Colliding users, oldest first
+	Emails  []string `json:"emails"`   // Their stored addresses, in UserIDs order
+}
+
+// FindCollisions lists the users, soft-deleted ones included, whose
+// addresses only differ in case or surrounding whitespace. They keep the
+// lower(email) unique index from being created until an operator merges or
+// changes them.
+//
+// Parameters:
+//   - db: Database connection
+//
+// Returns:
+//   - []Collision: Colliding users grouped by Key
+//   - error: Any database error
+func FindCollisions(db *gorm.DB) ([]Collision, error) {
+	var users []models.User
+	err := db.Unscoped().
+		Select("id", "email").
+		Where(keyExpr+" IN (?)", db.Unscoped().Model(&models.User{}).
+			Select(keyExpr).
+			Group(keyExpr).
+			Having("count(*) > 1")).
+		Order("id").
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var collisions []Collision
+	index := make(map[string]int)
+	for _, user := range users {
+		key := Key(user.Email)
+		i, ok := index[key]
+		if !ok {
+			i = len(collisions)
+			index[key] = i
+			collisions = append(collisions, Collision{Key: key})
+		}
+		collisions[i].UserIDs = append(collisions[i].UserIDs, user.ID)
+		collisions[i].Emails = append(collisions[i].Emails, user.Email)
+	}
+	return collisions, nil
+}
@@ -0,0 +1,157 @@
+// Package events defines the message contracts shared by Kafka producers and
+// consumers. Every message on the FAVORITE_PRODUCTS and SEARCH_INDEX_UPDATES
+// topics is an Envelope whose payload matches its Type; producers must build
+// messages with the constructors in this package and consumers must decode
+// them with the matching Decode function so both sides validate the same
+// rules.
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"scraper/internal/models"
+	"scraper/internal/productdiff"
+)
+
+// FavoriteProductsTopic is the topic consumed by the favorites service
+const FavoriteProductsTopic = "FAVORITE_PRODUCTS"
+
+// Version is the current envelope version. Consumers reject other versions.
+const Version = 1
+
+// TypePriceChange identifies a PriceChange payload
+const TypePriceChange = "price_change"
+
+// Envelope wraps every event with its type and version.
+type Envelope struct {
+	Version    int             `json:"version"`     // Envelope version, see Version
+	Type       string          `json:"type"`        // Payload type, e.g. price_change
+	OccurredAt time.Time       `json:"occurred_at"` // When the event was produced
+	Payload    json.RawMessage `json:"payload"`     // Type specific payload
+}
+
+// PriceChange reports that a product's price changed. The users to notify are
+// resolved by the consumer from the product's favorites, except on
+// notification retries which target a single user.
+type PriceChange struct {
+	ProductID   uint    `json:"product_id"`   // ID of the product with price change
+	ProductName string  `json:"product_name"` // Product name at the time of the change
+	OldPrice    float64 `json:"old_price"`    // Previous price of the product
+	NewPrice    float64 `json:"new_price"`    // New price of the product
+	// Source is the marketplace of the product; empty means trendyol
+	Source string `json:"source,omitempty"`
+	// UserID restricts delivery to one user; only set when requeueing a failed notification
+	UserID uint `json:"user_id,omitempty"`
+	// Attempt counts previous delivery attempts of a requeued notification
+	Attempt int `json:"attempt,omitempty"`
+	// BypassMinDrop skips the global minimum-drop floor (used by simulations)
+	BypassMinDrop bool `json:"bypass_min_drop,omitempty"`
+	// FetchedAt is when the product data behind the change was fetched from
+	// Trendyol; used for pipeline latency tracking and unset for simulations
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	// Changes lists what else changed about the product in the same update,
+	// such as the seller or the stock band; see the productdiff package
+	Changes []productdiff.Change `json:"changes,omitempty"`
+}
+
+// Validate checks the invariants every PriceChange must satisfy.
+func (p PriceChange) Validate() error {
+	switch {
+	case p.ProductID == 0:
+		return fmt.Errorf("product_id is required")
+	case !models.ValidProductID(uint64(p.ProductID)):
+		return models.ErrInvalidProductID
+	case p.OldPrice < 0 || p.NewPrice < 0:
+		return fmt.Errorf("prices must not be negative")
+	case p.OldPrice == p.NewPrice:
+		return fmt.Errorf("old_price and new_price are equal")
+	case p.Attempt < 0:
+		return fmt.Errorf("attempt must not be negative")
+	case p.Attempt > 0 && p.UserID == 0:
+		return fmt.Errorf("retries must target a user_id")
+	}
+	for _, change := range p.Changes {
+		if !change.Valid() {
+			return fmt.Errorf("invalid change of %q", change.Field)
+		}
+	}
+	return nil
+}
+
+// NewPriceChangeMessage validates a price change and wraps it in an envelope
+// ready to publish. Messages are keyed by product ID so all changes for a
+// product stay ordered on one partition.
+//
+// Parameters:
+//   - change: The price change to publish
+//
+// Returns:
+//   - *sarama.ProducerMessage: Message for FavoriteProductsTopic
+//   - error: If the change is invalid or cannot be encoded
+func NewPriceChangeMessage(change PriceChange) (*sarama.ProducerMessage, error) {
+	if err := change.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid price change: %w", err)
+	}
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(Envelope{
+		Version:    Version,
+		Type:       TypePriceChange,
+		OccurredAt: time.Now().UTC(),
+		Payload:    payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sarama.ProducerMessage{
+		Topic: FavoriteProductsTopic,
+		Key:   sarama.StringEncoder(strconv.FormatUint(uint64(change.ProductID), 10)),
+		Value: sarama.ByteEncoder(data),
+	}, nil
+}
+
+// DecodePriceChange parses and validates a FAVORITE_PRODUCTS message. Unknown
+// fields, other versions and other event types are rejected.
+//
+// Parameters:
+//   - data: Raw message value
+//
+// Returns:
+//   - PriceChange: The decoded payload
+//   - error: If the message does not follow the contract
+func DecodePriceChange(data []byte) (PriceChange, error) {
+	var env Envelope
+	if err := strictUnmarshal(data, &env); err != nil {
+		return PriceChange{}, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if env.Version != Version {
+		return PriceChange{}, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	if env.Type != TypePriceChange {
+		return PriceChange{}, fmt.Errorf("unexpected event type %q", env.Type)
+	}
+
+	var change PriceChange
+	if err := strictUnmarshal(env.Payload, &change); err != nil {
+		return PriceChange{}, fmt.Errorf("invalid %s payload: %w", env.Type, err)
+	}
+	if err := change.Validate(); err != nil {
+		return PriceChange{}, fmt.Errorf("invalid %s payload: %w", env.Type, err)
+	}
+	return change, nil
+}
+
+// strictUnmarshal decodes JSON, failing on unknown fields.
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
@@ -0,0 +1,166 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"scraper/internal/models"
+	"scraper/internal/productdiff"
+)
+
+// envelope encodes an envelope around payload the way NewPriceChangeMessage
+// does, so single fields can be broken on purpose.
+func envelope(t *testing.T, version int, eventType string, payload interface{}) []byte {
+	t.Helper()
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(Envelope{Version: version, Type: eventType, OccurredAt: time.Now().UTC(), Payload: raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPriceChangeRoundTrip(t *testing.T) {
+	fetchedAt := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		change PriceChange
+	}{
+		{
+			// crawler: POST /simulate-price-drop
+			name: "simulated drop",
+			change: PriceChange{
+				ProductID:     123,
+				Source:        models.SourceTrendyol,
+				ProductName:   "Running Shoe",
+				OldPrice:      100,
+				NewPrice:      80,
+				BypassMinDrop: true,
+			},
+		},
+		{
+			// analysis: forwardFavorited after a crawl
+			name: "crawled change",
+			change: PriceChange{
+				ProductID:   456,
+				Source:      models.SourceTrendyol,
+				ProductName: "Backpack",
+				OldPrice:    250,
+				NewPrice:    199.9,
+				FetchedAt:   &fetchedAt,
+				Changes: []productdiff.Change{
+					{Field: productdiff.FieldSeller, Old: "Shop A", New: "Shop B"},
+					{Field: productdiff.FieldDiscount, Old: productdiff.NoDiscount, New: "20%"},
+				},
+			},
+		},
+		{
+			// favorites: requeueNotification for one failed user
+			name: "notification retry",
+			change: PriceChange{
+				ProductID:   789,
+				ProductName: "Kettle",
+				OldPrice:    40,
+				NewPrice:    35,
+				UserID:      7,
+				Attempt:     2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := NewPriceChangeMessage(tt.change)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Topic != FavoriteProductsTopic {
+				t.Errorf("topic = %q, want %q", msg.Topic, FavoriteProductsTopic)
+			}
+			key, _ := msg.Key.Encode()
+			if want := strconv.FormatUint(uint64(tt.change.ProductID), 10); string(key) != want {
+				t.Errorf("key = %q, want the product ID %q", key, want)
+			}
+
+			value, err := msg.Value.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := DecodePriceChange(value)
+			if err != nil {
+				t.Fatalf("producer message rejected: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.change) {
+				t.Errorf("decoded %+v, want %+v", decoded, tt.change)
+			}
+		})
+	}
+}
+
+func TestNewPriceChangeMessageRejectsInvalidChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change PriceChange
+	}{
+		{"missing product", PriceChange{OldPrice: 10, NewPrice: 5}},
+		{"unchanged price", PriceChange{ProductID: 1, OldPrice: 10, NewPrice: 10}},
+		{"negative price", PriceChange{ProductID: 1, OldPrice: 10, NewPrice: -1}},
+		{"retry without user", PriceChange{ProductID: 1, OldPrice: 10, NewPrice: 5, Attempt: 1}},
+		{"unknown change field", PriceChange{ProductID: 1, OldPrice: 10, NewPrice: 5, Changes: []productdiff.Change{{Field: "color", Old: "red", New: "blue"}}}},
+	}
+	for _, tt := range tests {
+		if _, err := NewPriceChangeMessage(tt.change); err == nil {
+			t.Errorf("%s: message built, want an error", tt.name)
+		}
+	}
+}
+
+func TestDecodePriceChangeRejectsOtherShapes(t *testing.T) {
+	valid := PriceChange{ProductID: 1, ProductName: "Mug", OldPrice: 10, NewPrice: 8}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			// Batches the analysis service sent before the envelope
+			name: "legacy product list",
+			data: mustJSON(t, []models.Product{{ID: 1, Source: models.SourceTrendyol, Name: "Mug", Price: 8}}),
+		},
+		{
+			// One message per user, as sent before the favorites service
+			// resolved the watchers itself
+			name: "per-user message",
+			data: mustJSON(t, map[string]interface{}{"user_id": 7, "product_id": 1, "old_price": 10.0, "new_price": 8.0}),
+		},
+		{
+			name: "per-user payload in an envelope",
+			data: envelope(t, Version, TypePriceChange, map[string]interface{}{"user_ids": []uint{7}, "product_id": 1, "old_price": 10.0, "new_price": 8.0}),
+		},
+		{"unknown version", envelope(t, Version+1, TypePriceChange, valid)},
+		{"missing version", envelope(t, 0, TypePriceChange, valid)},
+		{"other event type", envelope(t, Version, TypeProductsChanged, valid)},
+		{"invalid payload", envelope(t, Version, TypePriceChange, PriceChange{ProductID: 1, OldPrice: 10, NewPrice: 10})},
+		{"unknown envelope field", []byte(`{"version":1,"type":"price_change","occurred_at":"2024-05-01T00:00:00Z","payload":{"product_id":1,"old_price":10,"new_price":8},"extra":true}`)},
+		{"not JSON", []byte("price dropped")},
+	}
+	for _, tt := range tests {
+		if change, err := DecodePriceChange(tt.data); err == nil {
+			t.Errorf("%s: decoded %+v, want an error", tt.name, change)
+		}
+	}
+}
+
+// mustJSON encodes v or fails the test.
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
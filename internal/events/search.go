@@ -0,0 +1,119 @@
+// Package events implements the contract of the search index updates that
+// services without a search indexer hand to the analysis service
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"scraper/internal/models"
+)
+
+// SearchIndexUpdatesTopic is the topic the analysis service reads products to
+// re-index from
+const SearchIndexUpdatesTopic = "SEARCH_INDEX_UPDATES"
+
+// TypeProductsChanged identifies a ProductsChanged payload
+const TypeProductsChanged = "products_changed"
+
+// ProductRef identifies a product across marketplaces
+type ProductRef struct {
+	ID     uint   `json:"id"`     // Product identifier within its source
+	Source string `json:"source"` // Marketplace of the product
+}
+
+// ProductsChanged reports products whose search documents are stale, such as
+// deleted, purged or merged products. The indexer loads each product when it
+// writes it and deletes the document of one that no longer exists, so the
+// event does not say what changed.
+type ProductsChanged struct {
+	Products []ProductRef `json:"products"` // Products to re-index
+}
+
+// Validate checks the invariants every ProductsChanged must satisfy.
+func (p ProductsChanged) Validate() error {
+	if len(p.Products) == 0 {
+		return fmt.Errorf("products are required")
+	}
+	for _, product := range p.Products {
+		switch {
+		case product.ID == 0:
+			return fmt.Errorf("product id is required")
+		case !models.ValidProductID(uint64(product.ID)):
+			return models.ErrInvalidProductID
+		case product.Source == "":
+			return fmt.Errorf("source of product %d is required", product.ID)
+		}
+	}
+	return nil
+}
+
+// NewProductsChangedMessage validates a products_changed event and wraps it
+// in an envelope ready to publish. Messages are keyed by the first product's
+// ID.
+//
+// Parameters:
+//   - products: Products to re-index
+//
+// Returns:
+//   - *sarama.ProducerMessage: Message for SearchIndexUpdatesTopic
+//   - error: If the event is invalid or cannot be encoded
+func NewProductsChangedMessage(products ...ProductRef) (*sarama.ProducerMessage, error) {
+	change := ProductsChanged{Products: products}
+	if err := change.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid products change: %w", err)
+	}
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(Envelope{
+		Version:    Version,
+		Type:       TypeProductsChanged,
+		OccurredAt: time.Now().UTC(),
+		Payload:    payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sarama.ProducerMessage{
+		Topic: SearchIndexUpdatesTopic,
+		Key:   sarama.StringEncoder(strconv.FormatUint(uint64(products[0].ID), 10)),
+		Value: sarama.ByteEncoder(data),
+	}, nil
+}
+
+// DecodeProductsChanged parses and validates a SEARCH_INDEX_UPDATES message.
+// Unknown fields, other versions and other event types are rejected.
+//
+// Parameters:
+//   - data: Raw message value
+//
+// Returns:
+//   - ProductsChanged: The decoded payload
+//   - error: If the message does not follow the contract
+func DecodeProductsChanged(data []byte) (ProductsChanged, error) {
+	var env Envelope
+	if err := strictUnmarshal(data, &env); err != nil {
+		return ProductsChanged{}, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if env.Version != Version {
+		return ProductsChanged{}, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	if env.Type != TypeProductsChanged {
+		return ProductsChanged{}, fmt.Errorf("unexpected event type %q", env.Type)
+	}
+
+	var change ProductsChanged
+	if err := strictUnmarshal(env.Payload, &change); err != nil {
+		return ProductsChanged{}, fmt.Errorf("invalid %s payload: %w", env.Type, err)
+	}
+	if err := change.Validate(); err != nil {
+		return ProductsChanged{}, fmt.Errorf("invalid %s payload: %w", env.Type, err)
+	}
+	return change, nil
+}
@@ -0,0 +1,301 @@
+// Package faults implements dev-only fault injection for Trendyol fetches,
+// Kafka produces and SMTP sends, so retries, the DLQ and alerting can be
+// exercised without a real outage. Services only wrap their seams (the
+// crawler's Fetcher, the notification EmailSender and the Kafka producer)
+// when FAULT_INJECTION is set, so production pays nothing for it.
+package faults
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"scraper/internal/metrics"
+	"scraper/pkg/httpclient"
+)
+
+// Seams faults can be injected into
+const (
+	TargetFetch   = "fetch"   // Trendyol product detail requests
+	TargetProduce = "produce" // Kafka messages sent by any service
+	TargetSMTP    = "smtp"    // Emails handed to the SMTP server
+)
+
+// Limits of a rule
+const (
+	maxRules   = 100
+	maxLatency = time.Minute
+)
+
+// ErrInjected is the cause of every injected failure
+var ErrInjected = errors.New("injected fault")
+
+// injections counts the operations a rule slowed down or failed
+var injections = metrics.NewCounter(
+	"fault_injections_total",
+	"Operations affected by fault injection by target and effect (latency, failure)",
+	"target", "effect",
+)
+
+// Rule injects failures or latency into the operations of one seam. A rule
+// without scope matches every operation of its target.
+type Rule struct {
+	ID             string    `json:"id"`                    // Generated rule ID
+	Target         string    `json:"target"`                // "fetch", "produce" or "smtp"
+	FailurePercent float64   `json:"failure_percent"`       // Share of matching operations that fail, 0-100
+	Latency        string    `json:"latency,omitempty"`     // Delay added to every matching operation, e.g. "2s"
+	StatusCode     int       `json:"status_code,omitempty"` // HTTP status of injected fetch failures, 0 for a network error
+	ProductIDs     []int     `json:"product_ids,omitempty"` // fetch and produce: only these products (message keys for produce)
+	Topic          string    `json:"topic,omitempty"`       // produce: only this topic
+	Recipient      string    `json:"recipient,omitempty"`   // smtp: only recipients matching this pattern, e.g. "*@example.com"
+	Matched        int64     `json:"matched"`               // Operations the rule matched
+	Failed         int64     `json:"failed"`                // Operations the rule failed
+	CreatedAt      time.Time `json:"created_at"`            // When the rule was added
+
+	latency time.Duration
+}
+
+// Scope describes the operation a seam is about to perform
+type Scope struct {
+	ProductID int    // Product fetched or, for produce, the numeric message key; 0 if unknown
+	Topic     string // Kafka topic
+	Recipient string // Email recipient
+}
+
+// Fault is an injected failure. Seams translate it into the error their
+// callers expect, such as a fetch error with StatusCode.
+type Fault struct {
+	RuleID     string // Rule that injected the failure
+	StatusCode int    // Rule's status_code, for fetch failures
+}
+
+// Error implements the error interface
+func (f *Fault) Error() string {
+	return fmt.Sprintf("%v (rule %s)", ErrInjected, f.RuleID)
+}
+
+// Unwrap returns ErrInjected
+func (f *Fault) Unwrap() error { return ErrInjected }
+
+// registry holds the rules of this process
+var registry struct {
+	mu    sync.Mutex
+	once  sync.Once
+	rules []*Rule
+}
+
+// Enabled reports whether fault injection is switched on. Seams check it
+// once when they are set up and are left unwrapped otherwise.
+//
+// Environment Variables:
+//   - FAULT_INJECTION: Enable fault injection; never set in production (default: false)
+func Enabled() bool {
+	return viper.GetBool("FAULT_INJECTION")
+}
+
+// loadRules adds the rules configured in the environment, so services
+// running in their own processes start with the same rules. Invalid rules
+// are logged and skipped.
+//
+// Environment Variables:
+//   - FAULT_INJECTION_RULES: JSON array of rules added on startup
+func loadRules() {
+	raw := viper.GetString("FAULT_INJECTION_RULES")
+	if raw == "" {
+		return
+	}
+	var rules []Rule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		logrus.WithError(err).Error("Ignoring invalid FAULT_INJECTION_RULES")
+		return
+	}
+	for _, rule := range rules {
+		rule := rule
+		if err := rule.prepare(); err != nil {
+			logrus.WithError(err).WithField("target", rule.Target).Error("Ignoring invalid fault injection rule")
+			continue
+		}
+		registry.rules = append(registry.rules, &rule)
+	}
+	logrus.WithField("rules", len(registry.rules)).Warn("Fault injection rules loaded from the environment")
+}
+
+// lock locks the registry, loading the environment rules on first use.
+func lock() {
+	registry.once.Do(loadRules)
+	registry.mu.Lock()
+}
+
+// prepare validates a new rule and fills in its ID, parsed latency and
+// creation time.
+func (r *Rule) prepare() error {
+	switch r.Target {
+	case TargetFetch, TargetProduce, TargetSMTP:
+	default:
+		return fmt.Errorf("target must be %q, %q or %q", TargetFetch, TargetProduce, TargetSMTP)
+	}
+	if r.FailurePercent < 0 || r.FailurePercent > 100 {
+		return errors.New("failure_percent must be between 0 and 100")
+	}
+	if r.Latency != "" {
+		latency, err := time.ParseDuration(r.Latency)
+		if err != nil || latency < 0 || latency > maxLatency {
+			return fmt.Errorf("latency must be a duration between 0 and %s", maxLatency)
+		}
+		r.latency = latency
+	}
+	if r.FailurePercent == 0 && r.latency == 0 {
+		return errors.New("a rule needs failure_percent or latency")
+	}
+	if r.StatusCode != 0 && (r.Target != TargetFetch || r.StatusCode < 400 || r.StatusCode > 599) {
+		return errors.New("status_code must be a 4xx or 5xx status of a fetch rule")
+	}
+	if len(r.ProductIDs) > 0 && r.Target == TargetSMTP {
+		return errors.New("product_ids only scope fetch and produce rules")
+	}
+	if r.Topic != "" && r.Target != TargetProduce {
+		return errors.New("topic only scopes produce rules")
+	}
+	if r.Recipient != "" {
+		if r.Target != TargetSMTP {
+			return errors.New("recipient only scopes smtp rules")
+		}
+		if _, err := path.Match(r.Recipient, ""); err != nil {
+			return fmt.Errorf("recipient is not a valid pattern: %w", err)
+		}
+	}
+	r.ID = httpclient.NewCorrelationID()
+	r.Matched, r.Failed = 0, 0
+	r.CreatedAt = time.Now()
+	return nil
+}
+
+// matches reports whether the rule applies to an operation of target.
+func (r *Rule) matches(target string, scope Scope) bool {
+	if r.Target != target {
+		return false
+	}
+	if r.Topic != "" && r.Topic != scope.Topic {
+		return false
+	}
+	if r.Recipient != "" {
+		if ok, _ := path.Match(r.Recipient, scope.Recipient); !ok {
+			return false
+		}
+	}
+	if len(r.ProductIDs) == 0 {
+		return true
+	}
+	for _, id := range r.ProductIDs {
+		if id == scope.ProductID {
+			return true
+		}
+	}
+	return false
+}
+
+// Add validates and stores a rule.
+//
+// Parameters:
+//   - rule: The rule; ID, counters and CreatedAt are set by Add
+//
+// Returns:
+//   - Rule: The stored rule
+//   - error: Why the rule is invalid, or that the rule limit is reached
+func Add(rule Rule) (Rule, error) {
+	if err := rule.prepare(); err != nil {
+		return Rule{}, err
+	}
+	lock()
+	defer registry.mu.Unlock()
+	if len(registry.rules) >= maxRules {
+		return Rule{}, fmt.Errorf("at most %d rules can be active", maxRules)
+	}
+	registry.rules = append(registry.rules, &rule)
+	logrus.WithFields(logrus.Fields{
+		"rule_id":         rule.ID,
+		"target":          rule.Target,
+		"failure_percent": rule.FailurePercent,
+		"latency":         rule.Latency,
+	}).Warn("Fault injection rule added")
+	return rule, nil
+}
+
+// Remove deletes a rule and reports whether it existed.
+func Remove(id string) bool {
+	lock()
+	defer registry.mu.Unlock()
+	for i, rule := range registry.rules {
+		if rule.ID == id {
+			registry.rules = append(registry.rules[:i], registry.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear deletes all rules and returns how many there were.
+func Clear() int {
+	lock()
+	defer registry.mu.Unlock()
+	n := len(registry.rules)
+	registry.rules = nil
+	return n
+}
+
+// Rules returns copies of the active rules, oldest first.
+func Rules() []Rule {
+	lock()
+	defer registry.mu.Unlock()
+	rules := make([]Rule, len(registry.rules))
+	for i, rule := range registry.rules {
+		rules[i] = *rule
+	}
+	return rules
+}
+
+// Inject applies the matching rules to an operation: it sleeps for their
+// latency and fails the operation with the chance of each rule's
+// failure_percent. Seams call it before the real operation.
+//
+// Parameters:
+//   - target: The seam, TargetFetch, TargetProduce or TargetSMTP
+//   - scope: The operation
+//
+// Returns:
+//   - error: A *Fault if the operation must fail, nil otherwise
+func Inject(target string, scope Scope) error {
+	var latency time.Duration
+	var fault *Fault
+
+	lock()
+	for _, rule := range registry.rules {
+		if !rule.matches(target, scope) {
+			continue
+		}
+		rule.Matched++
+		latency += rule.latency
+		if fault == nil && rule.FailurePercent > 0 && rand.Float64()*100 < rule.FailurePercent {
+			rule.Failed++
+			fault = &Fault{RuleID: rule.ID, StatusCode: rule.StatusCode}
+		}
+	}
+	registry.mu.Unlock()
+
+	if latency > 0 {
+		injections.Inc(target, "latency")
+		time.Sleep(latency)
+	}
+	if fault != nil {
+		injections.Inc(target, "failure")
+		return fault
+	}
+	return nil
+}
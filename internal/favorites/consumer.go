@@ -2,94 +2,137 @@
 package favorites
 
 import (
-	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	// Kafka client for message processing
 	"github.com/IBM/sarama"
-	// gRPC for notification service communication
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-
 	// Internal packages
+	"scraper/internal/events"
+	"scraper/internal/kafka"
+	"scraper/internal/metrics"
 	"scraper/internal/models"
-	"scraper/internal/proto"
+	"scraper/internal/pricealert"
+	"scraper/internal/pricing"
 
 	// Logging and database
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
+// maxNotificationAttempts caps how many times a failed notification is requeued
+const maxNotificationAttempts = 3
+
 // handleFavorites creates a message handler for processing favorite product updates.
-// It takes a database connection and Kafka producer as input and returns a function
-// that processes incoming messages about price changes for favorited products.
+// It takes a database connection and the notification send queue as input and returns a function
+// that processes incoming messages about price changes for favorited products. The message's
+// topic, partition and offset identify the fan-out checkpoint of the event.
 //
 // The handler performs the following steps:
-// 1. Connects to the notification service via gRPC
-// 2. Unmarshals the price update data
-// 3. Retrieves product details from the database
-// 4. Sends a notification to the user about the price change
-// 5. Records the price change in the price history log
-func handleFavorites(db *gorm.DB, producer sarama.SyncProducer) func([]byte) {
-	return func(data []byte) {
+// 1. Decodes the price_change event (see the events package for the contract)
+// 2. Retrieves product details from the database
+// 3. Resolves the users to notify, paging through the product's watchers (see fanOut), and hands their notifications to the send queue
+// 4. Records the price change in the price history log
+//
+// Messages that break the contract and unknown products are reported as fatal errors so the
+// message goes to the DLQ; database and notification service outages are
+// retryable. Price changes of deleted products are acknowledged without
+// notifying anyone. The send queue delivers the notifications and requeues the
+// failed ones, so a slow notification service does not stall the consumer.
+func handleFavorites(db *gorm.DB, queue *sendQueue) kafka.MessageHandler {
+	fan := newFanOut(db, queue)
+	return func(msg kafka.Message) error {
 		// Log received data for debugging
-		logrus.WithField("data", string(data)).Info("Received favorited product update")
+		logrus.WithField("data", string(msg.Value)).Info("Received favorited product update")
 
-		// Get notification service port from environment or use default
-		notificationGrpcPort := os.Getenv("NOTIFICATION_GRPC_PORT")
-		if notificationGrpcPort == "" {
-			notificationGrpcPort = "8083" // Default notification service port
-		}
-
-		// Establish gRPC connection to notification service
-		conn, err := grpc.DialContext(context.Background(),
-			fmt.Sprintf("0.0.0.0:%s", notificationGrpcPort),
-			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		// Decode the price change event
+		update, err := events.DecodePriceChange(msg.Value)
 		if err != nil {
-			logrus.WithError(err).Fatal("Failed to connect to notification service")
-			return
-		}
-		defer conn.Close()
-		notificationClient := proto.NewNotificationServiceClient(conn)
-
-		// Define price update structure and unmarshal data
-		var priceUpdate struct {
-			UserID    uint    `json:"user_id"`    // ID of the user who favorited the product
-			ProductID uint    `json:"product_id"` // ID of the product with price change
-			OldPrice  float64 `json:"old_price"`  // Previous price of the product
-			NewPrice  float64 `json:"new_price"`  // New price of the product
+			logrus.WithError(err).Error("Rejecting message that breaks the FAVORITE_PRODUCTS contract")
+			return kafka.Fatal(err)
 		}
-		if err := json.Unmarshal(data, &priceUpdate); err != nil {
-			logrus.WithError(err).Error("Error unmarshaling price update")
-			return
+
+		// Record how long the change took to reach this stage; requeued
+		// notifications are skipped so retries do not skew the latency
+		if update.FetchedAt != nil && update.Attempt == 0 {
+			metrics.ObservePipelineLatency(metrics.StageFavorites, *update.FetchedAt)
 		}
 
 		// Retrieve product details from database
+		if update.Source == "" {
+			update.Source = models.SourceTrendyol
+		}
+		source := update.Source
 		var product models.Product
-		if err := db.First(&product, priceUpdate.ProductID).Error; err != nil {
+		if err := db.Where("id = ? AND source = ?", update.ProductID, source).First(&product).Error; err != nil {
 			logrus.WithError(err).Error("Failed to find product")
-			return
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				// Price changes of deleted products notify nobody
+				var deleted int64
+				db.Unscoped().Model(&models.Product{}).
+					Where("id = ? AND source = ? AND deleted_at IS NOT NULL", update.ProductID, source).
+					Count(&deleted)
+				if deleted > 0 {
+					logrus.WithField("product_id", update.ProductID).Info("Skipping price change of deleted product")
+					return nil
+				}
+				return kafka.Fatal(fmt.Errorf("unknown product %d", update.ProductID))
+			}
+			return kafka.Retryable(fmt.Errorf("load product %d: %w", update.ProductID, err))
 		}
 
-		// Send price drop notification to user via gRPC
-		_, err = notificationClient.SendNotification(context.Background(), &proto.NotificationRequest{
-			UserId:    fmt.Sprintf("%d", priceUpdate.UserID),
-			ProductId: uint32(priceUpdate.ProductID),
-			Message:   fmt.Sprintf("Price dropped from %.2f to %.2f for %s", priceUpdate.OldPrice, priceUpdate.NewPrice, product.Name),
-		})
-		if err != nil {
-			logrus.WithError(err).Error("Failed to send notification")
-			return
+		// Rate the new price; changes that did not pass through the analysis
+		// service, like simulated drops, have no fresh score yet. Retries
+		// reuse the score stored by the first attempt.
+		dealScore := product.DealScore
+		if update.Attempt == 0 {
+			score, err := pricing.RefreshDealScore(db, product.ID, source, update.NewPrice)
+			if err != nil {
+				logrus.WithError(err).WithField("product_id", update.ProductID).Error("Failed to refresh deal score")
+			} else {
+				dealScore = score
+			}
+		}
+
+		// Notify a single user for targeted updates, otherwise everyone who
+		// favorited the product, page by page. Drops under the global floor
+		// notify nobody but are still recorded below.
+		change := pricealert.Change{
+			OldPrice:      update.OldPrice,
+			NewPrice:      update.NewPrice,
+			BypassMinDrop: update.BypassMinDrop,
+			DealScore:     dealScore,
+		}
+		if !update.BypassMinDrop && !pricing.IsSignificantDrop(update.OldPrice, update.NewPrice) {
+			logrus.WithField("product_id", update.ProductID).Info("Price change below global floor, skipping notifications")
+		} else if update.UserID != 0 {
+			users, err := eligibleRecipients(db, change, update, []uint{update.UserID})
+			if err != nil {
+				logrus.WithError(err).Error("Failed to load users")
+				return kafka.Retryable(fmt.Errorf("product %d: %w", update.ProductID, err))
+			}
+			if err := queue.Enqueue(notificationsFor(update, product.Name, users)); err != nil {
+				logrus.WithError(err).Error("Failed to queue notifications")
+				return kafka.Retryable(err)
+			}
+		} else if err := fan.Run(msg, update, change, product.Name); err != nil {
+			logrus.WithError(err).Error("Failed to notify watchers")
+			return kafka.Retryable(fmt.Errorf("notify watchers of product %d: %w", update.ProductID, err))
+		}
+
+		// Only the first delivery attempt records the price change
+		if update.Attempt > 0 {
+			return nil
 		}
 
 		// Record price change in history log
 		priceLog := models.PriceStockLog{
-			ProductID:  priceUpdate.ProductID,
-			OldPrice:   fmt.Sprintf("%.2f", priceUpdate.OldPrice),
-			NewPrice:   fmt.Sprintf("%.2f", priceUpdate.NewPrice),
+			ProductID:  update.ProductID,
+			Source:     source,
+			OldPrice:   fmt.Sprintf("%.2f", update.OldPrice),
+			NewPrice:   fmt.Sprintf("%.2f", update.NewPrice),
+			PriceValue: &update.NewPrice,
 			ChangeTime: time.Now(), // Record exact time of price change
 		}
 
@@ -97,5 +140,66 @@ func handleFavorites(db *gorm.DB, producer sarama.SyncProducer) func([]byte) {
 		if err := db.Create(&priceLog).Error; err != nil {
 			logrus.WithError(err).Error("Failed to create price log")
 		}
+		return nil
+	}
+}
+
+// eligibleUsers keeps the users pricealert.Eligible lets a price change
+// notify, logging how many were skipped for each reason.
+//
+// Parameters:
+//   - change: The price change
+//   - users: Users who favorited the product
+//
+// Returns:
+//   - []pricealert.User: Users to notify, in their original order
+func eligibleUsers(change pricealert.Change, users []pricealert.User) []pricealert.User {
+	kept := make([]pricealert.User, 0, len(users))
+	skipped := make(map[string]int)
+	for _, user := range users {
+		if reason := pricealert.Eligible(change, user); reason != "" {
+			skipped[reason]++
+			continue
+		}
+		kept = append(kept, user)
+	}
+	for reason, count := range skipped {
+		logrus.WithFields(logrus.Fields{"skipped": count, "reason": reason}).Info("Skipped users who are not notified")
+	}
+	return kept
+}
+
+// requeueNotification publishes a failed notification back to the favorites
+// topic for a single user, giving up after maxNotificationAttempts.
+//
+// Parameters:
+//   - producer: Kafka producer used to republish the update
+//   - update: The original price update
+//   - userID: User whose notification failed
+//   - reason: Failure reason reported by the notification service
+func requeueNotification(producer sarama.SyncProducer, update events.PriceChange, userID uint, reason string) {
+	fields := logrus.Fields{
+		"user_id":    userID,
+		"product_id": update.ProductID,
+		"attempt":    update.Attempt + 1,
+		"reason":     reason,
+	}
+	if update.Attempt+1 >= maxNotificationAttempts {
+		logrus.WithFields(fields).Error("Notification failed too many times, giving up")
+		return
+	}
+
+	retry := update
+	retry.UserID = userID
+	retry.Attempt = update.Attempt + 1
+	msg, err := events.NewPriceChangeMessage(retry)
+	if err != nil {
+		logrus.WithError(err).WithFields(fields).Error("Failed to build notification retry")
+		return
+	}
+	if _, _, err := producer.SendMessage(msg); err != nil {
+		logrus.WithError(err).WithFields(fields).Error("Failed to requeue notification")
+		return
 	}
-}
\ No newline at end of file
+	logrus.WithFields(fields).Warn("Requeued failed notification")
+}
@@ -0,0 +1,247 @@
+// Package favorites implements the paged fan-out of a price change to the
+// users watching the product
+package favorites
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/events"
+	"scraper/internal/kafka"
+	"scraper/internal/metrics"
+	"scraper/internal/models"
+	"scraper/internal/pricealert"
+)
+
+// fanOutRetention is how long completed checkpoints are kept, so an event
+// redelivered after its fan-out finished is recognized
+const fanOutRetention = 24 * time.Hour
+
+// Fan-out metrics
+var (
+	fanOutSize = metrics.NewHistogram(
+		"notification_fanout_size",
+		"Notifications queued per price change event",
+		[]float64{0, 1, 10, 100, 1000, 10000, 100000},
+		time.Hour,
+	)
+	fanOutOverflow = metrics.NewCounter(
+		"notification_fanout_overflow_total",
+		"Watchers left out because a price change event hit NOTIFICATION_MAX_FANOUT",
+	)
+)
+
+// fanOut notifies the watchers of a product about a price change. Watchers
+// are streamed in pages in user ID order rather than loaded at once, every
+// page is handed to the send queue, which batches the requests to the
+// notification service, and the progress is checkpointed after every page.
+type fanOut struct {
+	db       *gorm.DB
+	queue    *sendQueue
+	pageSize int // Watchers loaded per page
+	max      int // Notifications queued per event at most
+}
+
+// newFanOut creates a fan-out from the environment.
+//
+// Environment Variables:
+//   - NOTIFICATION_FANOUT_PAGE_SIZE: Watchers loaded and queued per page (default: 1000)
+//   - NOTIFICATION_MAX_FANOUT: Notifications queued per price change at most; the
+//     remaining watchers are logged for manual review (default: 100000)
+//
+// Parameters:
+//   - db: Database connection
+//   - queue: Send queue the notifications are handed to
+//
+// Returns:
+//   - *fanOut: The configured fan-out
+func newFanOut(db *gorm.DB, queue *sendQueue) *fanOut {
+	pageSize := viper.GetInt("NOTIFICATION_FANOUT_PAGE_SIZE")
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	max := viper.GetInt("NOTIFICATION_MAX_FANOUT")
+	if max <= 0 {
+		max = 100000
+	}
+	return &fanOut{db: db, queue: queue, pageSize: pageSize, max: max}
+}
+
+// Run notifies everyone watching the product of a price change event. A
+// redelivered event resumes after the last page its checkpoint records, and
+// one whose fan-out completed notifies nobody. A failure while handling a
+// page can only notify that page's users twice.
+//
+// Parameters:
+//   - msg: The Kafka message of the event, which identifies its checkpoint
+//   - update: The price change
+//   - change: The price change as the pricealert stages see it
+//   - name: Product name for the notification text
+//
+// Returns:
+//   - error: Any database or send queue error
+func (f *fanOut) Run(msg kafka.Message, update events.PriceChange, change pricealert.Change, name string) error {
+	checkpoint := models.FanOutCheckpoint{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		ProductID: update.ProductID,
+		Source:    update.Source,
+	}
+	if err := f.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&checkpoint).Error; err != nil {
+		return fmt.Errorf("create fan-out checkpoint: %w", err)
+	}
+	if err := f.db.Where("topic = ? AND partition = ? AND \"offset\" = ?", msg.Topic, msg.Partition, msg.Offset).
+		First(&checkpoint).Error; err != nil {
+		return fmt.Errorf("load fan-out checkpoint: %w", err)
+	}
+
+	fields := logrus.Fields{
+		"product_id": update.ProductID,
+		"partition":  msg.Partition,
+		"offset":     msg.Offset,
+	}
+	if checkpoint.CompletedAt != nil {
+		logrus.WithFields(fields).Info("Fan-out of redelivered price change already completed")
+		return nil
+	}
+	if checkpoint.LastUserID > 0 {
+		logrus.WithFields(fields).WithField("after_user_id", checkpoint.LastUserID).Info("Resuming fan-out of price change")
+	}
+
+	for {
+		var userIDs []uint
+		if err := f.db.Model(&models.UserFavorite{}).
+			Where("product_id = ? AND source = ? AND user_id > ?", update.ProductID, update.Source, checkpoint.LastUserID).
+			Order("user_id").
+			Limit(f.pageSize).
+			Pluck("user_id", &userIDs).Error; err != nil {
+			return fmt.Errorf("load watchers after user %d: %w", checkpoint.LastUserID, err)
+		}
+		if len(userIDs) == 0 {
+			break
+		}
+
+		eligible, err := eligibleRecipients(f.db, change, update, userIDs)
+		if err != nil {
+			return err
+		}
+		if room := f.max - checkpoint.Queued; len(eligible) > room {
+			overflow, err := f.overflow(update, userIDs[len(userIDs)-1])
+			if err != nil {
+				return err
+			}
+			checkpoint.Overflow = len(eligible) - room + overflow
+			eligible = eligible[:room]
+		}
+		if err := f.queue.Enqueue(notificationsFor(update, name, eligible)); err != nil {
+			return err
+		}
+
+		checkpoint.LastUserID = userIDs[len(userIDs)-1]
+		checkpoint.Watchers += len(userIDs)
+		checkpoint.Queued += len(eligible)
+		if err := f.db.Save(&checkpoint).Error; err != nil {
+			return fmt.Errorf("save fan-out checkpoint: %w", err)
+		}
+		if checkpoint.Overflow > 0 || len(userIDs) < f.pageSize {
+			break
+		}
+	}
+
+	now := time.Now()
+	checkpoint.CompletedAt = &now
+	if err := f.db.Save(&checkpoint).Error; err != nil {
+		return fmt.Errorf("complete fan-out checkpoint: %w", err)
+	}
+	f.finish(checkpoint, fields)
+	return nil
+}
+
+// overflow counts the watchers after a user, the ones a capped fan-out does
+// not look at.
+func (f *fanOut) overflow(update events.PriceChange, afterUserID uint) (int, error) {
+	var count int64
+	err := f.db.Model(&models.UserFavorite{}).
+		Where("product_id = ? AND source = ? AND user_id > ?", update.ProductID, update.Source, afterUserID).
+		Count(&count).Error
+	if err != nil {
+		return 0, fmt.Errorf("count watchers after user %d: %w", afterUserID, err)
+	}
+	return int(count), nil
+}
+
+// finish reports a completed fan-out and deletes the checkpoints completed
+// longer than fanOutRetention ago.
+func (f *fanOut) finish(checkpoint models.FanOutCheckpoint, fields logrus.Fields) {
+	fanOutSize.Observe(float64(checkpoint.Queued))
+	fields["watchers"] = checkpoint.Watchers
+	fields["queued"] = checkpoint.Queued
+	if checkpoint.Overflow > 0 {
+		fanOutOverflow.Add(float64(checkpoint.Overflow))
+		fields["overflow"] = checkpoint.Overflow
+		fields["last_user_id"] = checkpoint.LastUserID
+		logrus.WithFields(fields).Warn("Price change exceeded NOTIFICATION_MAX_FANOUT, watchers after last_user_id were not notified; review manually")
+	} else {
+		logrus.WithFields(fields).Info("Fan-out of price change completed")
+	}
+
+	if err := f.db.Where("completed_at < ?", time.Now().Add(-fanOutRetention)).
+		Delete(&models.FanOutCheckpoint{}).Error; err != nil {
+		logrus.WithError(err).Warn("Failed to delete old fan-out checkpoints")
+	}
+}
+
+// eligibleRecipients loads users and keeps the ones a price change
+// notifies. Users deleted since the favorite or the retry was made, users who
+// muted the product or whose target price was not reached, users who have not
+// verified their address yet and users who only want drops with a higher
+// deal score are left out.
+//
+// Parameters:
+//   - db: Database connection
+//   - change: The price change
+//   - update: The price change event, naming the product
+//   - userIDs: Users to check
+//
+// Returns:
+//   - []pricealert.User: Users to notify, in their original order
+//   - error: Any database error
+func eligibleRecipients(db *gorm.DB, change pricealert.Change, update events.PriceChange, userIDs []uint) ([]pricealert.User, error) {
+	users, err := pricealert.LoadUsers(db, userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("load users: %w", err)
+	}
+	if err := pricealert.MarkFavorites(db, users, update.ProductID, update.Source, time.Now()); err != nil {
+		return nil, fmt.Errorf("load favorites: %w", err)
+	}
+	return eligibleUsers(change, users), nil
+}
+
+// notificationsFor builds the notifications of a price change for users.
+// Users whose target price was reached are told so.
+//
+// Parameters:
+//   - update: The price change
+//   - name: Product name
+//   - users: Users to notify
+//
+// Returns:
+//   - []queuedNotification: One notification per user
+func notificationsFor(update events.PriceChange, name string, users []pricealert.User) []queuedNotification {
+	message := fmt.Sprintf("Price dropped from %.2f to %.2f for %s", update.OldPrice, update.NewPrice, name)
+	notifications := make([]queuedNotification, len(users))
+	for i, user := range users {
+		text := message
+		if user.TargetPrice != nil {
+			text += fmt.Sprintf(". Your target price of %.2f was reached", *user.TargetPrice)
+		}
+		notifications[i] = queuedNotification{update: update, userID: user.ID, message: text}
+	}
+	return notifications
+}
@@ -3,14 +3,17 @@
 package favorites
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"gorm.io/gorm"
 
 	"scraper/internal/crawler"
@@ -20,37 +23,90 @@ import (
 // jobIDs maps job names to their cron entry IDs for management
 var jobIDs = make(map[string]cron.EntryID)
 
+// schedulerLockID is the Postgres advisory lock held during a scheduler run,
+// so processes running the scheduler half do not refresh products twice
+const schedulerLockID = 0x6661767363686564 // "favsched"
+
+// productRef identifies a product across marketplaces
+type productRef struct {
+	ID       int    // Product identifier within its source
+	Source   string // Marketplace the product belongs to
+	Watchers int    // Users who favorited the product
+}
+
 // startScheduler initializes and starts a cron scheduler that periodically
 // checks for price updates on favorited products.
 //
 // The scheduler runs every minute (* * * * *) and performs the following:
-// 1. Fetches all favorited product IDs from the database
-// 2. For each product, fetches latest details from Trendyol
-// 3. Publishes updates to Kafka for price change analysis
+// 1. Skips the run if an operator paused it (see crawler.SetSchedulerPaused)
+// 2. Fetches favorited product IDs from the database, highest priority score
+//    first, up to FAVORITES_MAX_PRODUCTS_PER_RUN
+// 3. Once the day's regular Trendyol request budget is spent, keeps only the
+//    first TRENDYOL_BUDGET_PRIORITY_PRODUCTS of them
+// 4. For each product, fetches latest details from its marketplace
+// 5. Publishes updates to the products topic; the analysis service applies
+//    them and emits price_change events for favorited products
+// 6. Records the run in the scheduler state, and the outcome of every
+//    product it considered as a SchedulerRun
+//
+// A run is skipped while another run, of this or another process, is still
+// going; see exclusive.
 //
 // Parameters:
 //   - db: Database connection for fetching favorite products
 //   - producer: Kafka producer for publishing product updates
-func startScheduler(db *gorm.DB, producer sarama.SyncProducer) {
+//
+// Returns:
+//   - *cron.Cron: The started scheduler, stopped on shutdown
+func startScheduler(db *gorm.DB, producer sarama.SyncProducer) *cron.Cron {
 	// Initialize cron scheduler
 	c := cron.New()
 
 	// Add job to run every minute
-	id, err := c.AddFunc("* * * * *", func() {
+	id, err := c.AddFunc(crawler.FavoritesSchedule, exclusive(db, func() {
 		logrus.Info("Running scheduled task")
+		started := time.Now()
 
-		// Fetch product IDs that need updating
-		productIDs, err := fetchProductIDsFromDB(db)
+		// Skip the run while an operator has the scheduler paused
+		state, err := crawler.GetSchedulerState(db, crawler.SchedulerFavorites)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to load scheduler state")
+		} else if state.Paused {
+			logrus.Info("Scheduler paused, skipping run")
+			return
+		}
+
+		// Fetch products that need updating
+		refs, err := fetchProductIDsFromDB(db)
 		if err != nil {
 			logrus.WithError(err).Error("Failed to fetch favorited product IDs")
 			return
 		}
 
-		logrus.WithField("count", len(productIDs)).Info("Found active favorited products to update")
-		if len(productIDs) > 0 {
-			runTask(producer, productIDs)
+		logrus.WithField("count", len(refs)).Info("Found active favorited products to update")
+
+		// Only the highest priority products are refreshed from the priority reserve
+		var skipped []crawler.SchedulerOutcome
+		budget, err := crawler.GetRequestBudgetStatus(db)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to load request budget")
+		} else if budget.PriorityOnly && len(refs) > crawler.PriorityProductCount() {
+			skipped = skippedOutcomes(refs[crawler.PriorityProductCount():])
+			refs = refs[:crawler.PriorityProductCount()]
+			logrus.WithField("count", len(refs)).Info("Request budget low, refreshing priority products only")
+		}
+		var outcomes []crawler.SchedulerOutcome
+		if len(refs) > 0 {
+			outcomes = runTask(db, producer, refs)
+		}
+		if err := crawler.RecordSchedulerRun(db, crawler.SchedulerFavorites, len(refs)); err != nil {
+			logrus.WithError(err).Error("Failed to record scheduler run")
 		}
-	})
+		run := models.SchedulerRun{Scheduler: crawler.SchedulerFavorites, StartedAt: started, FinishedAt: time.Now()}
+		if err := crawler.SaveSchedulerRun(db, &run, append(outcomes, skipped...)); err != nil {
+			logrus.WithError(err).Error("Failed to save scheduler run outcomes")
+		}
+	}))
 
 	if err != nil {
 		logrus.WithError(err).Fatal("Invalid cron expression")
@@ -62,129 +118,304 @@ func startScheduler(db *gorm.DB, producer sarama.SyncProducer) {
 	// Start the scheduler
 	c.Start()
 	logrus.Info("Scheduler started for product details fetching")
+	return c
+}
+
+// exclusive wraps a scheduler job so that one run is going at a time across
+// all processes: the job only runs while its connection holds the
+// scheduler's advisory lock, and is skipped when another run holds it.
+//
+// Parameters:
+//   - db: Database connection the lock is taken on
+//   - job: The scheduler run
+//
+// Returns:
+//   - func(): The job to schedule
+func exclusive(db *gorm.DB, job func()) func() {
+	return func() {
+		err := db.Connection(func(conn *gorm.DB) error {
+			var locked bool
+			if err := conn.Raw("SELECT pg_try_advisory_lock(?)", schedulerLockID).Scan(&locked).Error; err != nil {
+				return err
+			}
+			if !locked {
+				logrus.Info("Another scheduler run is going, skipping run")
+				return nil
+			}
+			defer conn.Exec("SELECT pg_advisory_unlock(?)", schedulerLockID)
+			job()
+			return nil
+		})
+		if err != nil {
+			logrus.WithError(err).Error("Failed to take the scheduler lock, skipping run")
+		}
+	}
 }
 
 // runTask executes the main product update workflow:
-// 1. Fetches latest product details from Trendyol
-// 2. Saves updates to local JSON file for backup
+// 1. Fetches latest product details, routed to the fetcher for each product's source
+// 2. Merges Trendyol updates into the local JSON backup (one snapshot per product)
 // 3. Converts data to internal models
-// 4. Publishes updates to Kafka for processing
+// 4. Publishes updates to the products topic for the analysis service, which
+//    owns price change detection and forwards price_change events to
+//    FAVORITE_PRODUCTS
+//
+// Products that fail to fetch are queued in the crawler's retry queue rather
+// than dropped for this cycle. Every request is counted against the daily
+// Trendyol budget; refs are expected highest priority first, and the first
+// TRENDYOL_BUDGET_PRIORITY_PRODUCTS of them may use the priority reserve. The
+// run stops early once no budget is left.
 //
 // Parameters:
+//   - db: Database connection for the fetch retry queue
 //   - producer: Kafka producer for publishing updates
-//   - productIDs: List of product IDs to fetch and update
-func runTask(producer sarama.SyncProducer, productIDs []int) {
+//   - refs: Products to fetch and update
+//
+// Returns:
+//   - []crawler.SchedulerOutcome: What happened to each of refs, in order
+func runTask(db *gorm.DB, producer sarama.SyncProducer, refs []productRef) []crawler.SchedulerOutcome {
 	logrus.WithField("time", time.Now()).Info("Running scheduled task")
 
-	// Store fetched product details
-	var newProducts []map[string]interface{}
+	// Converted products to publish and raw Trendyol snapshots to back up
+	var products []models.Product
+	var snapshots []map[string]interface{}
 
 	// Fetch latest details for each product
-	logrus.WithField("count", len(productIDs)).Info("Fetching details for products")
-	for _, productID := range productIDs {
-		logrus.WithField("product_id", productID).Info("Fetching product")
+	logrus.WithField("count", len(refs)).Info("Fetching details for products")
+	priorityCount := crawler.PriorityProductCount()
+	outcomes := make([]crawler.SchedulerOutcome, 0, len(refs))
+	for i, ref := range refs {
+		fields := logrus.Fields{"product_id": ref.ID, "source": ref.Source}
+		outcome := crawler.SchedulerOutcome{ProductID: uint(ref.ID), Source: ref.Source, Outcome: crawler.OutcomeFetched}
+		fetcher, err := crawler.FetcherFor(ref.Source)
+		if err != nil {
+			logrus.WithError(err).WithFields(fields).Error("No fetcher for product source")
+			outcome.Outcome, outcome.ErrorClass = crawler.OutcomeFailed, crawler.FetchErrorUnknownSource
+			outcomes = append(outcomes, outcome)
+			continue
+		}
+
+		logrus.WithFields(fields).Info("Fetching product")
 		// Rate limit requests to avoid overwhelming the API
-		time.Sleep(2 * time.Second)
-		detail := crawler.FetchProductDetails(productID)
-		if detail != nil {
-			newProducts = append(newProducts, detail)
+		time.Sleep(crawler.FavoritesFetchDelay)
+		if err := crawler.ReserveRequest(db, ref.Source, i < priorityCount); err != nil {
+			logrus.WithError(err).WithFields(fields).Warn("Stopping run, no request budget left")
+			outcomes = append(outcomes, skippedOutcomes(refs[i:])...)
+			break
+		}
+		detail, err := fetcher.FetchDetails(context.Background(), ref.ID)
+		var product *models.Product
+		if err == nil {
+			product, err = fetcher.ToProduct(ref.ID, detail)
+		}
+		if err != nil {
+			logrus.WithError(err).WithFields(fields).Error("Failed to fetch product")
+			outcome.Outcome, outcome.ErrorClass = crawler.OutcomeFailed, crawler.FetchErrorClass(err)
+			if outcome.RetryID, err = crawler.RecordFetchFailure(db, ref.Source, ref.ID, crawler.FetchSourceScheduler, err); err != nil {
+				logrus.WithError(err).WithFields(fields).Error("Failed to record fetch failure")
+			}
+			outcomes = append(outcomes, outcome)
+			continue
 		}
+		if err := crawler.ClearFetchRetry(db, ref.Source, ref.ID); err != nil {
+			logrus.WithError(err).WithFields(fields).Error("Failed to clear fetch retry")
+		}
+
+		products = append(products, *product)
+		if ref.Source == models.SourceTrendyol {
+			snapshots = append(snapshots, detail)
+		}
+		outcomes = append(outcomes, outcome)
 	}
 
 	// Skip processing if no products were fetched
-	if len(newProducts) == 0 {
+	if len(products) == 0 {
 		logrus.Info("No new products fetched")
-		return
+		return outcomes
 	}
 
-	// Save to local JSON file for backup
-	filePath := "data.json"
-	var existing []map[string]interface{}
-	if file, err := os.ReadFile(filePath); err == nil {
-		json.Unmarshal(file, &existing)
-	}
-	existing = append(existing, newProducts...)
-
-	// Create/update the backup file
-	file, err := os.Create(filePath)
-	if err != nil {
-		logrus.WithError(err).WithField("file", filePath).Error("Failed to open file")
-		return
-	}
-	defer file.Close()
-
-	// Write formatted JSON
-	enc := json.NewEncoder(file)
-	enc.SetIndent("", " ")
-	if err := enc.Encode(existing); err != nil {
-		logrus.WithError(err).Error("Failed to encode products to file")
-		return
-	}
+	// Save to local JSON file for backup, keeping one snapshot per product.
+	// The backup doubles as the /fetch mock data, so it only holds Trendyol products.
+	if len(snapshots) > 0 {
+		filePath := "data.json"
+		var existing []map[string]interface{}
+		if file, err := os.ReadFile(filePath); err == nil {
+			json.Unmarshal(file, &existing)
+		}
+		maxProducts := viper.GetInt("DATA_FILE_MAX_PRODUCTS")
+		if maxProducts <= 0 {
+			maxProducts = 5000 // Default cap on backed up products
+		}
+		merged := mergeSnapshots(existing, snapshots, maxProducts)
 
-	logrus.Info("Product details saved to data.json")
+		// Write atomically so a crash never leaves a truncated backup
+		if err := writeJSONAtomic(filePath, merged); err != nil {
+			logrus.WithError(err).WithField("file", filePath).Error("Failed to write products to file")
+			return outcomes
+		}
 
-	// Convert raw data to internal models
-	trendyolResp := make([]models.TrendyolResponse, len(newProducts))
-	for i, p := range newProducts {
-		data, _ := json.Marshal(p)
-		var resp models.TrendyolResponse
-		json.Unmarshal(data, &resp)
-		trendyolResp[i] = resp
+		logrus.Info("Product details saved to data.json")
 	}
-	products := crawler.ConvertTrendyolToProduct(&trendyolResp)
 
 	// Prepare data for Kafka
 	productsJSON, err := json.Marshal(products)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to marshal products for Kafka")
-		return
+		return outcomes
 	}
 
 	// Create Kafka message
+	productsTopic := os.Getenv("KAFKA_PRODUCTS_TOPIC")
+	if productsTopic == "" {
+		productsTopic = "PRODUCTS" // Default topic
+	}
 	msg := &sarama.ProducerMessage{
-		Topic: "FAVORITE_PRODUCTS",
+		Topic: productsTopic,
 		Value: sarama.ByteEncoder(productsJSON),
 	}
 	if _, _, err := producer.SendMessage(msg); err != nil {
 		logrus.WithError(err).Error("Failed to send message to Kafka")
 	} else {
-		logrus.Info("Products sent to Kafka topic FAVORITE_PRODUCTS")
+		logrus.WithField("topic", productsTopic).Info("Products sent to Kafka")
 	}
+	return outcomes
 }
 
-// fetchProductIDsFromDB retrieves IDs of all active products that are marked as favorites.
-// It performs a JOIN between products and user_favorites tables to find products that:
+// skippedOutcomes records refs as skipped for the request budget.
+func skippedOutcomes(refs []productRef) []crawler.SchedulerOutcome {
+	outcomes := make([]crawler.SchedulerOutcome, len(refs))
+	for i, ref := range refs {
+		outcomes[i] = crawler.SchedulerOutcome{ProductID: uint(ref.ID), Source: ref.Source, Outcome: crawler.OutcomeSkippedRateLimit}
+	}
+	return outcomes
+}
+
+// fetchProductIDsFromDB retrieves the IDs and sources of the active products that are
+// marked as favorites, highest priority first, up to the per-run cap.
+// It runs crawler.RankScheduledProducts, a JOIN between products and user_favorites
+// tables on (id, source) scored by crawler.PriorityScore, to find products that:
 // 1. Are marked as active (is_active = true)
 // 2. Are marked as favorites (is_favorite = true)
 // 3. Have at least one user who has favorited them
 //
+// Only the first crawler.MaxProductsPerRun of them are returned; the rest
+// grow staler and move up for later runs.
+//
 // Parameters:
 //   - db: Database connection
 //
 // Returns:
-//   - []int: List of product IDs that need price updates
+//   - []productRef: Products that need price updates
 //   - error: Database error if any occurred, or "no active favorited products" error if none found
-func fetchProductIDsFromDB(db *gorm.DB) ([]int, error) {
-	var productIDs []int
-
-	// Query to find active favorited products
-	result := db.Model(&models.Product{}).
-		Select("DISTINCT products.id"). // Avoid duplicates if multiple users favorited same product
-		Joins("JOIN user_favorites ON products.id = user_favorites.product_id"). // Only get favorited products
-		Where("products.is_active = ? AND products.is_favorite = ?", true, true). // Only active and favorite-marked products
-		Pluck("products.id", &productIDs)
+func fetchProductIDsFromDB(db *gorm.DB) ([]productRef, error) {
+	// Rank active favorited products by priority for the request budget
+	ranked, err := crawler.RankScheduledProducts(db, time.Now())
 
 	// Handle database errors
-	if result.Error != nil {
-		logrus.WithError(result.Error).Error("Failed to fetch product IDs")
-		return nil, result.Error
+	if err != nil {
+		logrus.WithError(err).Error("Failed to fetch product IDs")
+		return nil, err
 	}
 
 	// Return error if no products found
-	if len(productIDs) == 0 {
+	if len(ranked) == 0 {
 		logrus.Info("No active favorited products found")
 		return nil, fmt.Errorf("no active favorited products")
 	}
 
-	return productIDs, nil
-}
\ No newline at end of file
+	if max := crawler.MaxProductsPerRun(); len(ranked) > max {
+		logrus.WithFields(logrus.Fields{
+			"scheduled":     len(ranked),
+			"max_per_run":   max,
+			"cut_off_score": ranked[max-1].Score,
+		}).Info("Refreshing the highest priority products, the rest wait for later runs")
+		ranked = ranked[:max]
+	}
+
+	refs := make([]productRef, len(ranked))
+	for i, product := range ranked {
+		refs[i] = productRef{ID: int(product.ID), Source: product.Source, Watchers: int(product.Watchers)}
+	}
+	return refs, nil
+}
+
+// mergeSnapshots merges freshly fetched product snapshots into the existing
+// backup. Snapshots are keyed on the product content ID so each product
+// appears once with its newest data. The result is ordered from least to most
+// recently updated, and the oldest entries are evicted once maxProducts is
+// exceeded. Snapshots without an ID are kept as-is.
+//
+// Parameters:
+//   - existing: Snapshots currently stored in the backup file
+//   - incoming: Newly fetched snapshots
+//   - maxProducts: Maximum number of snapshots to keep
+//
+// Returns:
+//   - []map[string]interface{}: Deduplicated, bounded snapshots
+func mergeSnapshots(existing, incoming []map[string]interface{}, maxProducts int) []map[string]interface{} {
+	merged := make([]map[string]interface{}, 0, len(existing)+len(incoming))
+	index := make(map[string]int) // Content ID -> position in merged
+
+	for _, snapshot := range append(append([]map[string]interface{}{}, existing...), incoming...) {
+		id, ok := snapshot["id"]
+		if !ok || id == nil {
+			merged = append(merged, snapshot)
+			continue
+		}
+		key := fmt.Sprint(id)
+
+		// Newer snapshot replaces the older one and moves to the end
+		if pos, found := index[key]; found {
+			merged[pos] = nil
+		}
+		index[key] = len(merged)
+		merged = append(merged, snapshot)
+	}
+
+	// Drop replaced entries
+	result := merged[:0]
+	for _, snapshot := range merged {
+		if snapshot != nil {
+			result = append(result, snapshot)
+		}
+	}
+
+	// Evict the oldest updated products beyond the cap
+	if maxProducts > 0 && len(result) > maxProducts {
+		result = result[len(result)-maxProducts:]
+	}
+	return result
+}
+
+// writeJSONAtomic writes v as indented JSON to a temporary file next to path
+// and renames it into place.
+//
+// Parameters:
+//   - path: Destination file
+//   - v: Value to encode
+//
+// Returns:
+//   - error: Any error creating, writing or renaming the file
+func writeJSONAtomic(path string, v interface{}) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	// Write formatted JSON
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", " ")
+	if err := enc.Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,120 @@
+package favorites
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// snapshot builds a product snapshot as decoded from JSON, with the run
+// that fetched it
+func snapshot(id int, run string) map[string]interface{} {
+	return map[string]interface{}{"id": float64(id), "run": run}
+}
+
+// snapshotKeys describes snapshots as id@run, in order.
+func snapshotKeys(snapshots []map[string]interface{}) []string {
+	keys := make([]string, len(snapshots))
+	for i, s := range snapshots {
+		keys[i] = fmt.Sprintf("%v@%v", s["id"], s["run"])
+	}
+	return keys
+}
+
+func TestMergeSnapshots(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []map[string]interface{}
+		incoming []map[string]interface{}
+		max      int
+		want     []string
+	}{
+		{
+			name:     "empty backup",
+			incoming: []map[string]interface{}{snapshot(1, "new"), snapshot(2, "new")},
+			max:      10,
+			want:     []string{"1@new", "2@new"},
+		},
+		{
+			name:     "newest snapshot wins and moves to the end",
+			existing: []map[string]interface{}{snapshot(1, "old"), snapshot(2, "old"), snapshot(3, "old")},
+			incoming: []map[string]interface{}{snapshot(2, "new")},
+			max:      10,
+			want:     []string{"1@old", "3@old", "2@new"},
+		},
+		{
+			name:     "duplicates within one run keep the last",
+			incoming: []map[string]interface{}{snapshot(1, "first"), snapshot(1, "second")},
+			max:      10,
+			want:     []string{"1@second"},
+		},
+		{
+			name:     "oldest updated are evicted beyond the cap",
+			existing: []map[string]interface{}{snapshot(1, "old"), snapshot(2, "old"), snapshot(3, "old")},
+			incoming: []map[string]interface{}{snapshot(1, "new"), snapshot(4, "new")},
+			max:      3,
+			want:     []string{"3@old", "1@new", "4@new"},
+		},
+		{
+			name:     "incoming alone beyond the cap",
+			incoming: []map[string]interface{}{snapshot(1, "new"), snapshot(2, "new"), snapshot(3, "new")},
+			max:      2,
+			want:     []string{"2@new", "3@new"},
+		},
+		{
+			name:     "no cap",
+			existing: []map[string]interface{}{snapshot(1, "old")},
+			incoming: []map[string]interface{}{snapshot(2, "new")},
+			max:      0,
+			want:     []string{"1@old", "2@new"},
+		},
+		{
+			name:     "snapshots without an ID are kept",
+			existing: []map[string]interface{}{{"run": "old"}},
+			incoming: []map[string]interface{}{{"id": nil, "run": "new"}, snapshot(1, "new")},
+			max:      10,
+			want:     []string{"<nil>@old", "<nil>@new", "1@new"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := snapshotKeys(mergeSnapshots(tt.existing, tt.incoming, tt.max))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeSnapshotsOverRuns(t *testing.T) {
+	const maxProducts = 4
+
+	// Two scheduler runs over overlapping products, each merged into the
+	// backup the previous one left
+	var backup []map[string]interface{}
+	runs := [][]int{{1, 2, 3}, {2, 3, 4, 5}}
+	for i, ids := range runs {
+		incoming := make([]map[string]interface{}, len(ids))
+		for j, id := range ids {
+			incoming[j] = snapshot(id, fmt.Sprint("run", i+1))
+		}
+		backup = mergeSnapshots(backup, incoming, maxProducts)
+
+		if len(backup) > maxProducts {
+			t.Fatalf("run %d: %d snapshots, want at most %d", i+1, len(backup), maxProducts)
+		}
+		seen := make(map[interface{}]bool)
+		for _, s := range backup {
+			if seen[s["id"]] {
+				t.Fatalf("run %d: product %v is stored twice: %v", i+1, s["id"], snapshotKeys(backup))
+			}
+			seen[s["id"]] = true
+		}
+	}
+
+	// Product 1 was not refreshed by the second run and is the one evicted
+	want := []string{"2@run2", "3@run2", "4@run2", "5@run2"}
+	if got := snapshotKeys(backup); !reflect.DeepEqual(got, want) {
+		t.Errorf("backup = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,371 @@
+// Package favorites implements the bounded notification send queue
+package favorites
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/events"
+	"scraper/internal/metrics"
+	"scraper/internal/models"
+	"scraper/internal/productdiff"
+	"scraper/internal/proto"
+)
+
+// maxSendBatch caps the notifications a sender passes to one batch request
+const maxSendBatch = 50
+
+// Send queue metrics
+var (
+	queueDepth = metrics.NewGauge(
+		"notification_queue_depth",
+		"Notifications waiting in the favorites send queue",
+	)
+	queuePending = metrics.NewGauge(
+		"notification_queue_pending",
+		"Notifications spilled to pending_notifications and not yet drained",
+	)
+	queueSpilled = metrics.NewCounter(
+		"notification_queue_spilled_total",
+		"Notifications written to pending_notifications because the send queue was full",
+	)
+	queueDrained = metrics.NewCounter(
+		"notification_queue_drained_total",
+		"Notifications moved from pending_notifications back into the send queue",
+	)
+)
+
+// queuedNotification is one user's notification about a price change
+type queuedNotification struct {
+	update  events.PriceChange // The event that caused it; the user's retry is built from it
+	userID  uint               // User to notify
+	message string             // Notification text
+}
+
+// sendQueue decouples the favorites consumer from the notification service.
+// The consumer enqueues without waiting for SMTP; a pool of senders delivers
+// the notifications in batches. The in-memory queue is bounded: notifications
+// that do not fit are spilled to the pending_notifications table, and a
+// drainer moves them back once the queue has room, so a slow SMTP server
+// neither grows memory nor stalls the consumer.
+type sendQueue struct {
+	db            *gorm.DB
+	producer      sarama.SyncProducer             // Requeues failed notifications on the favorites topic
+	client        proto.NotificationServiceClient // Delivers the notifications
+	queue         chan queuedNotification
+	senders       int
+	drainInterval time.Duration
+	quit          chan struct{}  // Closed by Stop
+	workers       sync.WaitGroup // Senders and the drainer
+}
+
+// newSendQueue creates a send queue from the environment. Call Start to
+// begin sending.
+//
+// Environment Variables:
+//   - NOTIFICATION_QUEUE_CAPACITY: Notifications held in memory at most (default: 1000)
+//   - NOTIFICATION_QUEUE_SENDERS: Concurrent batch requests to the notification service (default: 4)
+//   - NOTIFICATION_QUEUE_DRAIN_INTERVAL: How often spilled notifications are drained (default: 1s)
+//
+// Parameters:
+//   - db: Database connection holding pending_notifications
+//   - producer: Kafka producer for requeueing failed notifications
+//   - client: Notification service client
+//
+// Returns:
+//   - *sendQueue: The configured queue
+func newSendQueue(db *gorm.DB, producer sarama.SyncProducer, client proto.NotificationServiceClient) *sendQueue {
+	capacity := viper.GetInt("NOTIFICATION_QUEUE_CAPACITY")
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	senders := viper.GetInt("NOTIFICATION_QUEUE_SENDERS")
+	if senders <= 0 {
+		senders = 4
+	}
+	drainInterval := viper.GetDuration("NOTIFICATION_QUEUE_DRAIN_INTERVAL")
+	if drainInterval <= 0 {
+		drainInterval = time.Second
+	}
+
+	return &sendQueue{
+		db:            db,
+		producer:      producer,
+		client:        client,
+		queue:         make(chan queuedNotification, capacity),
+		senders:       senders,
+		drainInterval: drainInterval,
+		quit:          make(chan struct{}),
+	}
+}
+
+// Start launches the senders and the drainer.
+func (q *sendQueue) Start() {
+	q.workers.Add(q.senders + 1)
+	for i := 0; i < q.senders; i++ {
+		go q.send()
+	}
+	go q.drain()
+	logrus.WithFields(logrus.Fields{
+		"capacity": cap(q.queue),
+		"senders":  q.senders,
+	}).Info("Notification send queue started")
+}
+
+// Enqueue hands notifications to the senders without blocking. Those that do
+// not fit into the queue are written to pending_notifications.
+//
+// Parameters:
+//   - notifications: Notifications to send
+//
+// Returns:
+//   - error: If spilled notifications could not be stored; the ones already
+//     queued are still sent, so redelivering the event may notify some users
+//     twice
+func (q *sendQueue) Enqueue(notifications []queuedNotification) error {
+	var spill []models.PendingNotification
+	for _, n := range notifications {
+		select {
+		case q.queue <- n:
+			continue
+		default:
+		}
+
+		row, err := pendingNotification(n)
+		if err != nil {
+			return err
+		}
+		spill = append(spill, row)
+	}
+	queueDepth.Set(float64(len(q.queue)))
+	if len(spill) == 0 {
+		return nil
+	}
+
+	if err := q.db.Create(&spill).Error; err != nil {
+		return fmt.Errorf("spill %d notifications: %w", len(spill), err)
+	}
+	queueSpilled.Add(float64(len(spill)))
+	logrus.WithFields(logrus.Fields{
+		"spilled":  len(spill),
+		"capacity": cap(q.queue),
+	}).Warn("Notification send queue full, spilled notifications to the database")
+	return nil
+}
+
+// Stop stops the senders and the drainer once the batches being delivered
+// are done, and writes the notifications still queued to
+// pending_notifications, so a favorites service sends them after a restart.
+// Stop the consumer first, so nothing is enqueued meanwhile.
+//
+// Parameters:
+//   - ctx: Bounds the wait for the batches being delivered
+//
+// Returns:
+//   - error: ctx's error if a batch was still being delivered, or the
+//     error storing the queued notifications
+func (q *sendQueue) Stop(ctx context.Context) error {
+	close(q.quit)
+	stopped := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(stopped)
+	}()
+	var waitErr error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+	}
+
+	var spill []models.PendingNotification
+	for len(q.queue) > 0 {
+		row, err := pendingNotification(<-q.queue)
+		if err != nil {
+			return err
+		}
+		spill = append(spill, row)
+	}
+	queueDepth.Set(0)
+	if len(spill) > 0 {
+		if err := q.db.Create(&spill).Error; err != nil {
+			return fmt.Errorf("store %d queued notifications: %w", len(spill), err)
+		}
+		logrus.WithField("stored", len(spill)).Info("Stored queued notifications for the next start")
+	}
+	return waitErr
+}
+
+// pendingNotification converts a queued notification to its
+// pending_notifications row.
+func pendingNotification(n queuedNotification) (models.PendingNotification, error) {
+	event, err := json.Marshal(n.update)
+	if err != nil {
+		return models.PendingNotification{}, fmt.Errorf("encode notification: %w", err)
+	}
+	return models.PendingNotification{UserID: n.userID, Event: event, Message: n.message}, nil
+}
+
+// send delivers queued notifications until the queue is stopped, taking up
+// to maxSendBatch waiting notifications per batch request.
+func (q *sendQueue) send() {
+	defer q.workers.Done()
+	for {
+		var n queuedNotification
+		select {
+		case n = <-q.queue:
+		case <-q.quit:
+			return
+		}
+		batch := []queuedNotification{n}
+	collect:
+		for len(batch) < maxSendBatch {
+			select {
+			case next := <-q.queue:
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		queueDepth.Set(float64(len(q.queue)))
+		q.deliver(batch)
+	}
+}
+
+// productChanges converts the changes of a price change event for the
+// notification service.
+func productChanges(changes []productdiff.Change) []*proto.ProductChange {
+	if len(changes) == 0 {
+		return nil
+	}
+	items := make([]*proto.ProductChange, len(changes))
+	for i, change := range changes {
+		items[i] = &proto.ProductChange{Field: change.Field, OldValue: change.Old, NewValue: change.New}
+	}
+	return items
+}
+
+// deliver sends one batch request and requeues the notifications that
+// failed on the favorites topic.
+func (q *sendQueue) deliver(batch []queuedNotification) {
+	items := make([]*proto.NotificationRequest, len(batch))
+	for i, n := range batch {
+		var fetchedAt int64
+		if n.update.FetchedAt != nil {
+			fetchedAt = n.update.FetchedAt.UnixMilli()
+		}
+		items[i] = &proto.NotificationRequest{
+			UserId:    fmt.Sprintf("%d", n.userID),
+			ProductId: uint64(n.update.ProductID),
+			Source:    n.update.Source,
+			Message:   n.message,
+			FetchedAt: fetchedAt,
+			Changes:   productChanges(n.update.Changes),
+		}
+	}
+
+	resp, err := q.client.SendNotifications(context.Background(), &proto.BatchNotificationRequest{Items: items})
+	if err != nil {
+		logrus.WithError(err).WithField("count", len(batch)).Error("Failed to send notifications")
+		for _, n := range batch {
+			requeueNotification(q.producer, n.update, n.userID, err.Error())
+		}
+		return
+	}
+
+	// Requeue only the failed notifications
+	for _, result := range resp.Results {
+		if result.Success || int(result.Index) >= len(batch) {
+			continue
+		}
+		n := batch[result.Index]
+		requeueNotification(q.producer, n.update, n.userID, result.Error)
+	}
+}
+
+// drain moves spilled notifications back into the queue every drain
+// interval, as many as the queue has room for.
+func (q *sendQueue) drain() {
+	defer q.workers.Done()
+	ticker := time.NewTicker(q.drainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.quit:
+			return
+		}
+		if room := cap(q.queue) - len(q.queue); room > 0 {
+			if err := q.drainOnce(room); err != nil {
+				logrus.WithError(err).Error("Failed to drain pending notifications")
+			}
+		}
+
+		var pending int64
+		if err := q.db.Model(&models.PendingNotification{}).Count(&pending).Error; err != nil {
+			logrus.WithError(err).Warn("Failed to count pending notifications")
+			continue
+		}
+		queuePending.Set(float64(pending))
+	}
+}
+
+// drainOnce moves up to room of the oldest spilled notifications into the
+// queue. The rows are locked so favorites services in other processes drain
+// different rows, and deleted in the same transaction; a failed commit can
+// only lead to a notification being sent twice, never to one being lost.
+//
+// Parameters:
+//   - room: Free places in the queue
+//
+// Returns:
+//   - error: Any database error
+func (q *sendQueue) drainOnce(room int) error {
+	return q.db.Transaction(func(tx *gorm.DB) error {
+		var rows []models.PendingNotification
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Order("id").
+			Limit(room).
+			Find(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+
+		var drained []uint64
+	push:
+		for _, row := range rows {
+			var update events.PriceChange
+			if err := json.Unmarshal(row.Event, &update); err != nil {
+				// Undecodable rows would block the table forever
+				logrus.WithError(err).WithField("id", row.ID).Error("Dropping undecodable pending notification")
+				drained = append(drained, row.ID)
+				continue
+			}
+			select {
+			case q.queue <- queuedNotification{update: update, userID: row.UserID, message: row.Message}:
+				drained = append(drained, row.ID)
+			default:
+				// The consumer filled the queue in the meantime
+				break push
+			}
+		}
+		if len(drained) == 0 {
+			return nil
+		}
+		if err := tx.Delete(&models.PendingNotification{}, drained).Error; err != nil {
+			return err
+		}
+		queueDrained.Add(float64(len(drained)))
+		queueDepth.Set(float64(len(q.queue)))
+		return nil
+	})
+}
@@ -2,16 +2,86 @@
 package favorites
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"strings"
 
+	"github.com/IBM/sarama"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
 
+	"scraper/internal/apierror"
+	"scraper/internal/crawler"
 	"scraper/internal/db"
+	"scraper/internal/health"
 	"scraper/internal/kafka"
+	"scraper/internal/metrics"
+	"scraper/internal/notification"
+	"scraper/internal/outbox"
+	"scraper/internal/profiling"
+	"scraper/internal/timeout"
+	"scraper/pkg/readiness"
+	"scraper/pkg/shutdown"
 )
 
+// ready is marked once the favorites service started the halves it runs
+var ready = readiness.New()
+
+// Ready returns a channel that is closed once the favorites service is
+// consuming price updates, or scheduling refreshes when it only runs the
+// scheduler.
+func Ready() <-chan struct{} {
+	return ready.Ready()
+}
+
+// stopping holds what Start started, stopped by Shutdown
+var stopping = shutdown.New("favorites")
+
+// Mode selects the halves of the favorites service a process runs, so the
+// Kafka consumer can be scaled apart from the scheduler
+type Mode string
+
+const (
+	ModeScheduler Mode = "scheduler" // Only refresh favorited products on a schedule
+	ModeConsumer  Mode = "consumer"  // Only notify watchers of price changes from Kafka
+	ModeBoth      Mode = "both"      // Run both halves
+)
+
+// Scheduler reports whether the mode runs the scheduler half.
+func (m Mode) Scheduler() bool { return m == ModeScheduler || m == ModeBoth }
+
+// Consumer reports whether the mode runs the consumer half.
+func (m Mode) Consumer() bool { return m == ModeConsumer || m == ModeBoth }
+
+// CurrentMode returns the configured mode. An unknown mode stops the process
+// rather than running a half twice or not at all.
+//
+// Environment Variables:
+//   - FAVORITES_MODE: scheduler, consumer or both (default: both)
+//
+// Returns:
+//   - Mode: The halves to run
+func CurrentMode() Mode {
+	mode := Mode(strings.ToLower(strings.TrimSpace(viper.GetString("FAVORITES_MODE"))))
+	switch mode {
+	case "":
+		return ModeBoth
+	case ModeScheduler, ModeConsumer, ModeBoth:
+		return mode
+	}
+	logrus.WithField("FAVORITES_MODE", mode).Fatal("Unknown favorites mode")
+	return ""
+}
+
+// Deps are the resources Start shares between the halves it runs
+type Deps struct {
+	DB       *gorm.DB            // Database connection
+	Producer sarama.SyncProducer // Publishes refreshed products, requeued notifications, retries and dead letters
+}
+
 // Start initializes and runs the favorite product service.
 // This service is responsible for:
 // 1. Running a periodic scheduler that checks favorite products for price updates
@@ -22,23 +92,59 @@ import (
 // - Initializes database connection
 // - Sets up Kafka producer for sending price updates
 // - Creates HTTP server with health check endpoint
-// - Starts the product update scheduler
-// - Sets up Kafka consumer for processing price changes
+// - Starts the halves selected by FAVORITES_MODE, see StartScheduler and
+//   StartConsumer
+//
+// Consuming stops once ctx is cancelled; Shutdown stops the rest.
 //
 // Environment Variables:
 //   - FAVORITE_PORT: Port for the HTTP server (default: 8084)
-//   - KAFKA_FAVORITES_TOPIC: Kafka topic for favorite product updates (default: FAVORITE_PRODUCTS)
-func Start() {
-	// Initialize database and Kafka producer
+//   - FAVORITES_MODE: Halves to run: scheduler, consumer or both (default: both)
+func Start(ctx context.Context) {
+	mode := CurrentMode()
+
+	// Initialize database and Kafka producer, used by both halves
 	dbConn := db.Setup()
 	producer := kafka.SetupProducer()
+	stopping.Add("Kafka producer", shutdown.Close(producer))
+	deps := Deps{DB: dbConn, Producer: producer}
 
-	// Setup HTTP server with health check
+	// Setup HTTP server with liveness and readiness endpoints. /health
+	// answers like /health/ready and also reports the running halves and
+	// the scheduler's view of today's Trendyol request budget
 	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler()
+	e.Use(timeout.Middleware(timeout.Routes{profiling.Route: timeout.Exempt}))
+	checker := health.New().
+		Add("postgres", health.Database(dbConn)).
+		Add("kafka", health.Kafka(kafka.Brokers()))
+	checker.Register(e)
 	e.GET("/health", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+		report := checker.Run(c.Request().Context())
+		body := map[string]interface{}{
+			"status": report.Status,
+			"checks": report.Checks,
+			"mode":   mode,
+			"halves": map[string]bool{"scheduler": mode.Scheduler(), "consumer": mode.Consumer()},
+		}
+		budget, err := crawler.GetRequestBudgetStatus(dbConn)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to load request budget")
+		} else {
+			body["request_budget"] = budget
+		}
+		return c.JSON(report.HTTPStatus(), body)
 	})
 
+	// Register Prometheus metrics endpoint
+	e.GET("/metrics", metrics.Handler)
+
+	// Register pipeline latency summary (p50/p95 per stage over the last hour)
+	e.GET("/admin/pipeline-latency", metrics.PipelineLatencyHandler)
+
+	// Register profiling endpoints when DEBUG_PPROF is set
+	profiling.Register(e, "favorites")
+
 	// Get service port from environment
 	port := os.Getenv("FAVORITE_PORT")
 	if port == "" {
@@ -46,20 +152,79 @@ func Start() {
 	}
 
 	// Start HTTP server in a goroutine
-	logrus.WithField("port", port).Info("Starting Favorite Product Service")
+	logrus.WithFields(logrus.Fields{"port": port, "mode": mode}).Info("Starting Favorite Product Service")
 	go func() {
 		if err := e.Start("0.0.0.0:" + port); err != nil && err != http.ErrServerClosed {
 			logrus.WithError(err).Error("Favorite service shutdown")
 		}
 	}()
+	stopping.Add("HTTP server", shutdown.HTTP(e))
+
+	// Take over publishing outbox events when the crawler is not running;
+	// the relays of several processes take turns
+	relay := outbox.NewRelay(dbConn, producer)
+	relay.Start("favorites")
+	stopping.Add("outbox relay", relay.Stop)
 
-	// Start the scheduler that periodically checks favorite products
-	startScheduler(dbConn, producer)
+	if mode.Scheduler() {
+		StartScheduler(deps)
+	}
+	if mode.Consumer() {
+		StartConsumer(ctx, deps)
+	}
+	ready.Mark()
+}
+
+// StartScheduler starts the half of the service that periodically refreshes
+// favorited products and publishes them to the products topic. It does not
+// call the notification service. Several processes may run it: a run only
+// starts while no other process runs one (see startScheduler).
+//
+// Parameters:
+//   - deps: Database and producer the scheduler uses
+func StartScheduler(deps Deps) {
+	stopping.Add("scheduler", shutdown.Cron(startScheduler(deps.DB, deps.Producer)))
+}
 
+// StartConsumer starts the half of the service that consumes price changes
+// and notifies the watchers through the send queue. It owns the connection
+// to the notification service. Several processes may run it: they share
+// the topic's consumer group and the pending_notifications table.
+//
+// Consuming stops once ctx is cancelled; Shutdown stops the rest.
+//
+// Parameters:
+//   - ctx: Stops consuming once done
+//   - deps: Database, and producer for requeued notifications, retries and
+//     dead letters
+//
+// Environment Variables:
+//   - KAFKA_FAVORITES_TOPIC: Kafka topic for favorite product updates (default: FAVORITE_PRODUCTS)
+//   - NOTIFICATION_GRPC_ADDR: Notification service address (default: localhost:$NOTIFICATION_GRPC_PORT)
+func StartConsumer(ctx context.Context, deps Deps) {
 	// Setup Kafka consumer for processing price updates
 	favoritesTopic := os.Getenv("KAFKA_FAVORITES_TOPIC")
 	if favoritesTopic == "" {
 		favoritesTopic = "FAVORITE_PRODUCTS" // Default topic
 	}
-	kafka.SetupConsumer(favoritesTopic, handleFavorites(dbConn, producer))
+
+	// Connect to the notification service once and share the connection
+	notificationClient, err := notification.Dial("favorites")
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create notification client")
+	}
+	queue := newSendQueue(deps.DB, deps.Producer, notificationClient)
+	queue.Start()
+	stopping.Add("send queue", queue.Stop)
+	consumer := kafka.SetupMessageConsumer(ctx, favoritesTopic, handleFavorites(deps.DB, queue), kafka.WithProducer(deps.Producer), kafka.WithRetryTopics(kafka.RetryDelays()...))
+	stopping.Add("Kafka consumer", consumer.Close)
+}
+
+// Shutdown stops what Start started: the consumer finishes its running
+// message, the send queue its running batches and stores the queued
+// notifications, the scheduler its running run, then the HTTP server and
+// producer are closed. Work still running when ctx ends is cancelled. Halves
+// that FAVORITES_MODE left out are skipped.
+func Shutdown(ctx context.Context) error {
+	return stopping.Stop(ctx)
 }
\ No newline at end of file
@@ -0,0 +1,232 @@
+// Package health serves the liveness and readiness endpoints of the
+// services. GET /health/live answers as long as the process serves HTTP, so
+// an orchestrator only restarts a hung process. GET /health/ready runs the
+// service's dependency checks, such as a Postgres ping and a Kafka metadata
+// fetch, and answers 503 with the failing checks when one of them fails, so
+// traffic is held back until the dependencies are reachable again.
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Check states
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// Check probes one dependency. It returns an error if the dependency cannot
+// be used, and should give up once ctx is done.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check
+type Result struct {
+	Status     string  `json:"status"`          // StatusOK or StatusFailing
+	Error      string  `json:"error,omitempty"` // Why the check failed
+	DurationMS float64 `json:"duration_ms"`     // How long the check took
+}
+
+// Report is the response of GET /health/ready
+type Report struct {
+	Status string            `json:"status"` // StatusOK if every check passed
+	Checks map[string]Result `json:"checks"` // Outcome of each check by name
+}
+
+// HTTPStatus returns 200 for a passing report and 503 otherwise.
+func (r Report) HTTPStatus() int {
+	if r.Status == StatusOK {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Timeout returns how long a single check may take.
+//
+// Environment Variables:
+//   - HEALTH_CHECK_TIMEOUT: Time limit of each readiness check (default: 2s)
+func Timeout() time.Duration {
+	if timeout := viper.GetDuration("HEALTH_CHECK_TIMEOUT"); timeout > 0 {
+		return timeout
+	}
+	return 2 * time.Second
+}
+
+// Checker runs the dependency checks of a service. Create it with New and
+// add the checks before registering its routes.
+type Checker struct {
+	timeout time.Duration
+	checks  map[string]Check
+}
+
+// New creates a checker without checks, limiting each check to Timeout.
+func New() *Checker {
+	return &Checker{timeout: Timeout(), checks: make(map[string]Check)}
+}
+
+// Add registers a check under a name, e.g. "postgres".
+//
+// Returns:
+//   - *Checker: The checker, for chaining
+func (c *Checker) Add(name string, check Check) *Checker {
+	c.checks[name] = check
+	return c
+}
+
+// Run runs every check concurrently. A check still running when its time
+// limit passes is reported as failing; it is left to finish in the
+// background.
+//
+// Parameters:
+//   - ctx: Context of the request; the checks stop once it is done
+//
+// Returns:
+//   - Report: The outcome of every check
+func (c *Checker) Run(ctx context.Context) Report {
+	type outcome struct {
+		name   string
+		result Result
+	}
+	outcomes := make(chan outcome, len(c.checks))
+	for name, check := range c.checks {
+		go func(name string, check Check) {
+			ctx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- check(ctx) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = errors.New("check timed out after " + c.timeout.String())
+			}
+
+			result := Result{Status: StatusOK, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status, result.Error = StatusFailing, err.Error()
+			}
+			outcomes <- outcome{name: name, result: result}
+		}(name, check)
+	}
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(c.checks))}
+	for range c.checks {
+		o := <-outcomes
+		report.Checks[o.name] = o.result
+		if o.result.Status != StatusOK {
+			report.Status = StatusFailing
+		}
+	}
+	return report
+}
+
+// Live is the GET /health/live handler; it answers 200 while the process
+// serves HTTP.
+func Live(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+// Ready is the GET /health/ready handler; it answers 200 with the report if
+// every check passes and 503 otherwise.
+func (c *Checker) Ready(ctx echo.Context) error {
+	report := c.Run(ctx.Request().Context())
+	return ctx.JSON(report.HTTPStatus(), report)
+}
+
+// Register adds GET /health/live and GET /health/ready to a service.
+//
+// Parameters:
+//   - e: Echo instance of the service
+func (c *Checker) Register(e *echo.Echo) {
+	e.GET("/health/live", Live)
+	e.GET("/health/ready", c.Ready)
+}
+
+// Database checks that the database answers a ping.
+//
+// Parameters:
+//   - db: Database connection of the service
+//
+// Returns:
+//   - Check: The check
+func Database(db *gorm.DB) Check {
+	return func(ctx context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.PingContext(ctx)
+	}
+}
+
+// kafkaCheck fetches cluster metadata through a client it keeps between
+// checks
+type kafkaCheck struct {
+	brokers []string
+	config  *sarama.Config
+
+	mu     sync.Mutex
+	client sarama.Client // nil until connected, and after a failure
+}
+
+// Kafka checks that broker metadata can be fetched from the cluster. The
+// client is connected on the first check and reconnected after a failure;
+// its network timeouts are the check's time limit.
+//
+// Parameters:
+//   - brokers: Broker addresses, see kafka.Brokers
+//
+// Returns:
+//   - Check: The check
+func Kafka(brokers []string) Check {
+	config := sarama.NewConfig()
+	config.Net.DialTimeout = Timeout()
+	config.Net.ReadTimeout = Timeout()
+	config.Net.WriteTimeout = Timeout()
+	config.Metadata.Timeout = Timeout()
+	config.Metadata.Retry.Max = 0
+	// Only the checks fetch metadata, not a background refresh of every topic
+	config.Metadata.Full = false
+	check := &kafkaCheck{brokers: brokers, config: config}
+	return check.run
+}
+
+// run connects if needed and refreshes the metadata.
+func (k *kafkaCheck) run(ctx context.Context) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if k.client == nil {
+		client, err := sarama.NewClient(k.brokers, k.config)
+		if err != nil {
+			return err
+		}
+		k.client = client
+	}
+	if err := k.client.RefreshMetadata(); err != nil {
+		k.client.Close()
+		k.client = nil
+		return err
+	}
+	if len(k.client.Brokers()) == 0 {
+		return errors.New("kafka metadata lists no brokers")
+	}
+	return nil
+}
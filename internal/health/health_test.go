@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func passing(context.Context) error { return nil }
+
+func failing(context.Context) error { return errors.New("connection refused") }
+
+// ready serves GET /health/ready of checker.
+func ready(t *testing.T, checker *Checker) (int, Report) {
+	t.Helper()
+	e := echo.New()
+	checker.Register(e)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, report
+}
+
+func TestReadyPassing(t *testing.T) {
+	code, report := ready(t, New().Add("postgres", passing).Add("kafka", passing))
+	if code != http.StatusOK || report.Status != StatusOK || len(report.Checks) != 2 {
+		t.Fatalf("ready = %d %+v, want 200 with both checks ok", code, report)
+	}
+}
+
+func TestReadyFailing(t *testing.T) {
+	code, report := ready(t, New().Add("postgres", passing).Add("kafka", failing))
+	if code != http.StatusServiceUnavailable || report.Status != StatusFailing {
+		t.Fatalf("ready = %d %+v, want 503", code, report)
+	}
+	if report.Checks["postgres"].Status != StatusOK {
+		t.Errorf("postgres = %+v, want ok", report.Checks["postgres"])
+	}
+	if kafka := report.Checks["kafka"]; kafka.Status != StatusFailing || kafka.Error != "connection refused" {
+		t.Errorf("kafka = %+v, want the error", kafka)
+	}
+}
+
+func TestReadyTimesOut(t *testing.T) {
+	checker := New()
+	checker.timeout = 20 * time.Millisecond
+	stuck := make(chan struct{})
+	defer close(stuck)
+	checker.Add("postgres", func(context.Context) error {
+		<-stuck // Ignores its context
+		return nil
+	})
+
+	start := time.Now()
+	code, report := ready(t, checker)
+	if code != http.StatusServiceUnavailable || !strings.Contains(report.Checks["postgres"].Error, "timed out") {
+		t.Errorf("ready = %d %+v, want a timed out check", code, report)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ready took %s, want it bounded by the check timeout", elapsed)
+	}
+}
+
+func TestLive(t *testing.T) {
+	e := echo.New()
+	New().Add("kafka", failing).Register(e)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("live = %d, want 200 regardless of dependencies", rec.Code)
+	}
+}
+
+func TestKafkaUnreachable(t *testing.T) {
+	// A port that was free a moment ago refuses connections
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	check := Kafka([]string{addr})
+	for i := 0; i < 2; i++ {
+		if err := check(context.Background()); err == nil {
+			t.Fatalf("check %d passed against %s, want an error", i+1, addr)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+//go:build integration
+
+// Package integration runs the analysis, favorites and notification services
+// in-process against real PostgreSQL and Kafka and checks a price drop
+// travelling the whole pipeline. Run it with
+//
+//	docker compose up -d postgres kafka zookeeper
+//	DB_USER=postgres DB_PASSWORD=password go test -tags=integration ./internal/integration/
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/analysis"
+	"scraper/internal/crawler"
+	"scraper/internal/db"
+	"scraper/internal/favorites"
+	"scraper/internal/models"
+	"scraper/internal/notification"
+	"scraper/pkg/config"
+	"scraper/pkg/readiness"
+)
+
+// The test uses IDs from here on, far from real data
+const baseID = 950000000
+
+// timeout bounds every wait of the test
+const timeout = 60 * time.Second
+
+func TestPriceDropReachesNotification(t *testing.T) {
+	run := time.Now().UnixNano()
+	productID := uint(baseID + run%1000000)
+	email := fmt.Sprintf("integration-%d@example.com", run)
+
+	// Topics of this run, so messages of earlier runs are not consumed;
+	// ports away from a locally running stack
+	env := map[string]string{
+		"KAFKA_PRODUCTS_TOPIC":   fmt.Sprintf("it-products-%d", run),
+		"KAFKA_FAVORITES_TOPIC":  fmt.Sprintf("it-favorites-%d", run),
+		"NOTIFICATIONS_DRY_RUN":  "true",
+		"NOTIFICATION_PORT":      "18082",
+		"NOTIFICATION_GRPC_PORT": "18083",
+		"ANALYZER_PORT":          "18084",
+		"FAVORITE_PORT":          "18085",
+		"CRAWLER_GRPC_PORT":      "18081",
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	if err := config.Load(); err != nil {
+		t.Fatal(err)
+	}
+	brokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
+	if brokers[0] == "" {
+		brokers = []string{"localhost:9092"}
+	}
+
+	// Start the services like cmd/scraper does
+	conn := db.Setup()
+	t.Cleanup(func() { cleanup(conn, productID, email) })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		analysis.Shutdown(context.Background())
+		favorites.Shutdown(context.Background())
+		notification.Shutdown(context.Background())
+	})
+	go notification.Start(ctx)
+	wait(t, "notification", notification.Ready())
+	go analysis.Start(ctx)
+	go favorites.Start(ctx)
+	wait(t, "analysis", analysis.Ready())
+	wait(t, "favorites", favorites.Ready())
+	waitForConsumers(t, brokers, viper.GetString("KAFKA_PRODUCTS_TOPIC"), viper.GetString("KAFKA_FAVORITES_TOPIC"))
+
+	producer, err := sarama.NewSyncProducer(brokers, producerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+
+	// A crawl stores the product
+	publish(t, producer, models.Product{ID: productID, Source: models.SourceTrendyol, Name: "Integration Shoe", Price: 100, IsActive: true, IsFavorite: true})
+	var product models.Product
+	eventually(t, "product stored", func() bool {
+		return conn.Where("id = ? AND source = ?", productID, models.SourceTrendyol).First(&product).Error == nil
+	})
+
+	// A verified user favorites it
+	user := models.User{Email: email, Name: "Integration", IsActive: true, Verified: true}
+	if err := conn.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := crawler.AddFavorite(conn, user.ID, productID, models.SourceTrendyol); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next crawl finds it cheaper
+	publish(t, producer, models.Product{ID: productID, Source: models.SourceTrendyol, Name: "Integration Shoe", Price: 80, IsActive: true, IsFavorite: true})
+
+	eventually(t, "price updated", func() bool {
+		return conn.Where("id = ? AND source = ?", productID, models.SourceTrendyol).First(&product).Error == nil && product.Price == 80
+	})
+	var priceLog models.PriceStockLog
+	eventually(t, "price change logged", func() bool {
+		return conn.Where("product_id = ?", productID).Order("change_time DESC").First(&priceLog).Error == nil
+	})
+	if priceLog.OldPrice != "100.00" || priceLog.NewPrice != "80.00" || priceLog.PriceValue == nil || *priceLog.PriceValue != 80 {
+		t.Errorf("price log = %s -> %s (value %v), want 100.00 -> 80.00", priceLog.OldPrice, priceLog.NewPrice, priceLog.PriceValue)
+	}
+	var delivery models.NotificationLog
+	eventually(t, "notification recorded", func() bool {
+		return conn.Where("recipient = ?", email).First(&delivery).Error == nil
+	})
+	if delivery.Status != "dry_run" || !strings.Contains(delivery.Subject, "Integration Shoe") {
+		t.Errorf("notification = %q with status %q, want a dry-run price drop alert for Integration Shoe", delivery.Subject, delivery.Status)
+	}
+}
+
+// producerConfig is the configuration of the test's own producer
+func producerConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	return config
+}
+
+// publish sends a product batch the way the crawler does.
+func publish(t *testing.T, producer sarama.SyncProducer, products ...models.Product) {
+	t.Helper()
+	value, err := json.Marshal(products)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = producer.SendMessage(&sarama.ProducerMessage{
+		Topic: viper.GetString("KAFKA_PRODUCTS_TOPIC"),
+		Value: sarama.ByteEncoder(value),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForConsumers waits until the consumer groups of the topics have joined.
+// The groups start at the newest offset, so anything published earlier would
+// be skipped.
+func waitForConsumers(t *testing.T, brokers []string, topics ...string) {
+	t.Helper()
+	admin, err := sarama.NewClusterAdmin(brokers, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	groups := make([]string, len(topics))
+	for i, topic := range topics {
+		groups[i] = "scraper-" + strings.ToLower(topic)
+	}
+	eventually(t, "consumer groups stable", func() bool {
+		described, err := admin.DescribeConsumerGroups(groups)
+		if err != nil || len(described) != len(groups) {
+			return false
+		}
+		for _, group := range described {
+			if group.State != "Stable" || len(group.Members) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// wait fails the test if a service is not ready in time.
+func wait(t *testing.T, name string, ready <-chan struct{}) {
+	t.Helper()
+	if err := readiness.Wait(name, ready, timeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventually polls a condition until it holds, failing the test after the
+// timeout.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// cleanup removes the rows the test created.
+func cleanup(conn *gorm.DB, productID uint, email string) {
+	var userIDs []uint
+	conn.Unscoped().Model(&models.User{}).Where("email = ?", email).Pluck("id", &userIDs)
+	if len(userIDs) > 0 {
+		conn.Unscoped().Where("user_id IN ?", userIDs).Delete(&models.UserFavorite{})
+		conn.Unscoped().Where("id IN ?", userIDs).Delete(&models.User{})
+	}
+	conn.Unscoped().Where("product_id = ?", productID).Delete(&models.PriceStockLog{})
+	conn.Unscoped().Where("id = ?", productID).Delete(&models.Product{})
+	conn.Where("recipient = ?", email).Delete(&models.NotificationLog{})
+}
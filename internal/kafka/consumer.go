@@ -3,84 +3,400 @@
 package kafka
 
 import (
-	"os"
+	"context"
+	"errors"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/sirupsen/logrus"
 )
 
-// SetupConsumer initializes and configures a Kafka consumer for a given topic.
-// It sets up a consumer group that processes messages from the specified topic
-// using the provided handler function. The consumer runs in a separate goroutine
-// and continuously processes messages until the application terminates.
+// Handler processes a single message value. Returning nil acknowledges the
+// message; a RetryableError triggers redelivery with backoff and a FatalError
+// routes the message to the dead-letter topic immediately.
+type Handler func([]byte) error
+
+// HeaderCorrelationID is the message header carrying the correlation ID of
+// the operation that published the message, such as a crawl
+const HeaderCorrelationID = "correlation_id"
+
+// Message is a consumed message with where it was read from
+//
+// A message redelivered from a retry topic reports the topic, partition and
+// offset of its first delivery, so handlers that key work on them resume it.
+type Message struct {
+	Topic     string            // Topic the message was read from
+	Partition int32             // Partition of the message
+	Offset    int64             // Offset of the message in its partition
+	Value     []byte            // Message value
+	Headers   map[string]string // Message headers; the last value of a repeated key wins
+}
+
+// MessageHandler processes a consumed message with its metadata. Its return
+// value is classified like a Handler's.
+type MessageHandler func(Message) error
+
+// consumerOptions holds the tunables applied through Option values
+type consumerOptions struct {
+	groupID     string              // Consumer group ID
+	maxRetries  int                 // Redeliveries before a retryable failure is dead-lettered
+	backoff     time.Duration       // Initial redelivery delay, doubled on every attempt
+	maxBackoff  time.Duration       // Upper bound for the redelivery delay
+	dlqTopic    string              // Dead-letter topic
+	producer    sarama.SyncProducer // Producer used to publish dead letters and retries
+	retryDelays []time.Duration     // Delays of the retry topics; none redelivers in-process
+	retryTiers  []retryTier         // Retry topics derived from retryDelays
+}
+
+// Option customizes a consumer created by SetupConsumer
+type Option func(*consumerOptions)
+
+// WithGroupID sets the consumer group ID (default: scraper-<topic>).
+func WithGroupID(groupID string) Option {
+	return func(o *consumerOptions) { o.groupID = groupID }
+}
+
+// WithMaxRetries sets how many times a retryable failure is redelivered
+// before the message is dead-lettered (default: 5).
+func WithMaxRetries(n int) Option {
+	return func(o *consumerOptions) { o.maxRetries = n }
+}
+
+// WithBackoff sets the initial and maximum redelivery delay
+// (default: 500ms doubling up to 30s).
+func WithBackoff(initial, max time.Duration) Option {
+	return func(o *consumerOptions) {
+		o.backoff = initial
+		o.maxBackoff = max
+	}
+}
+
+// WithDLQ sets the dead-letter topic (default: <topic>.DLQ).
+func WithDLQ(topic string) Option {
+	return func(o *consumerOptions) { o.dlqTopic = topic }
+}
+
+// WithRetryTopics hands retryable failures to retry topics instead of
+// redelivering them in-process: a failed message is published to
+// <topic>_RETRY_<delay> for the first delay, e.g. PRODUCTS_RETRY_1M, and a
+// delay consumer publishes it back to the topic once the delay passed. A
+// message that fails again moves on to the next delay's topic, and to the
+// dead-letter topic after the last one. The consumer no longer blocks its
+// partition while a dependency is down; WithMaxRetries and WithBackoff then
+// only apply to publishing the retries. Without delays, e.g. from
+// RetryDelays with KAFKA_RETRY_DELAYS=off, messages are redelivered
+// in-process.
+//
+// A retried message is republished to the topic, so every consumer group of
+// the topic sees it again; use retry topics for topics with one group.
+func WithRetryTopics(delays ...time.Duration) Option {
+	return func(o *consumerOptions) { o.retryDelays = delays }
+}
+
+// WithProducer reuses an existing producer for dead letters instead of
+// creating a dedicated one.
+func WithProducer(producer sarama.SyncProducer) Option {
+	return func(o *consumerOptions) { o.producer = producer }
+}
+
+// Consumer is a running consumer group. Close it on shutdown.
+type Consumer struct {
+	topic   string
+	group   sarama.ConsumerGroup
+	cancel  context.CancelFunc
+	done    chan struct{} // Closed once the consume loop returned
+	retries []*Consumer   // Delay consumers of the retry topics
+}
+
+// Close stops consuming and leaves the group. The message being handled is
+// finished first, so its offset is committed with the others when the group
+// is left; a message waiting for a redelivery is left uncommitted for the
+// member that takes over the partition.
 //
 // Parameters:
+//   - ctx: Bounds the wait for the message being handled
+//
+// Returns:
+//   - error: ctx's error if the handler did not finish in time, or the
+//     error leaving the group
+//
+// The delay consumers of its retry topics are closed after it, so a message
+// it hands to a retry topic while stopping is still redelivered later.
+func (c *Consumer) Close(ctx context.Context) error {
+	c.cancel()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	errs := []error{c.group.Close()}
+	for _, retry := range c.retries {
+		errs = append(errs, retry.Close(ctx))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	logrus.WithField("topic", c.topic).Info("Stopped consuming from topic")
+	return nil
+}
+
+// SetupConsumer initializes and configures a Kafka consumer group for a given topic.
+// Each message is passed to the handler and its offset is only committed once
+// the handler has either succeeded or the message has been dead-lettered.
+// The consumer runs in a separate goroutine until ctx is done or it is
+// closed.
+//
+// Parameters:
+//   - ctx: Stops consuming once done; Close then waits for the group to leave
 //   - topic: The Kafka topic to consume messages from
-//   - handler: A function that processes each message received from the topic
-//              The function takes a byte slice containing the message value
+//   - handler: A function that processes each message value and classifies
+//     failures as RetryableError or FatalError
+//   - opts: Optional overrides for the group ID, retry policy and DLQ
 //
 // Environment Variables:
 //   - KAFKA_BROKERS: Comma-separated list of Kafka broker addresses (default: localhost:9092)
 //
 // The consumer is configured with:
 //   - Error reporting enabled
-//   - Latest offset strategy (only processes new messages)
-//   - Single partition consumption (partition 0)
-//   - Automatic broker discovery
+//   - Latest offset strategy for new groups (only processes new messages)
+//   - Manual offset marking after each handled message
+//
+// Failure handling:
+//  1. nil: the message is acknowledged
+//  2. RetryableError (or any unclassified error): redelivered with
+//     exponential backoff up to the retry budget, or through the retry
+//     topics of WithRetryTopics, then dead-lettered
+//  3. FatalError: dead-lettered immediately
 //
-// The function runs indefinitely in a goroutine and will:
-//   1. Connect to the Kafka brokers
-//   2. Create a partition consumer
-//   3. Process messages as they arrive using the handler function
-//   4. Log any errors that occur during consumption
+// Dead letters keep the original key and value and carry the source topic,
+// partition, offset, error and attempt count as headers.
+//
+// Returns:
+//   - *Consumer: The running consumer
+func SetupConsumer(ctx context.Context, topic string, handler Handler, opts ...Option) *Consumer {
+	return SetupMessageConsumer(ctx, topic, func(msg Message) error { return handler(msg.Value) }, opts...)
+}
+
+// SetupMessageConsumer is SetupConsumer for handlers that need to know where
+// a message came from, such as its offset or headers.
 //
-// Note: This is a simplified consumer implementation. In production, you might want to:
-//   - Implement proper shutdown handling
-//   - Use consumer groups for scalability
-//   - Add retry logic for failed messages
-//   - Implement offset management
-func SetupConsumer(topic string, handler func([]byte)) {
-	// Get Kafka broker addresses from environment
-	brokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
-	if len(brokers) == 0 || brokers[0] == "" {
-		// Default to localhost if no brokers specified
-		brokers = []string{"localhost:9092"}
+// Parameters:
+//   - ctx: Stops consuming once done; Close then waits for the group to leave
+//   - topic: The Kafka topic to consume messages from
+//   - handler: A function that processes each message and classifies
+//     failures as RetryableError or FatalError
+//   - opts: Optional overrides for the group ID, retry policy and DLQ
+//
+// Returns:
+//   - *Consumer: The running consumer
+func SetupMessageConsumer(ctx context.Context, topic string, handler MessageHandler, opts ...Option) *Consumer {
+	options := consumerOptions{
+		groupID:    "scraper-" + strings.ToLower(topic),
+		maxRetries: 5,
+		backoff:    500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		dlqTopic:   topic + ".DLQ",
+	}
+	for _, opt := range opts {
+		opt(&options)
 	}
+	if options.producer == nil {
+		options.producer = SetupProducer()
+	}
+	options.retryTiers = retryTiers(topic, options.retryDelays)
+
+	gh := &groupHandler{topic: topic, handler: handler, options: options}
+	consumer := startGroup(ctx, topic, options.groupID, gh)
+	for _, tier := range options.retryTiers {
+		groupID := options.groupID + "-retry-" + strings.ToLower(strings.TrimPrefix(tier.topic, topic+"_RETRY_"))
+		consumer.retries = append(consumer.retries, startGroup(ctx, tier.topic, groupID, newDelayHandler(tier.topic, options)))
+	}
+	return consumer
+}
+
+// startGroup joins a consumer group and consumes topic with handler in the
+// background until ctx is done or the returned consumer is closed,
+// rejoining after rebalances and failed sessions.
+func startGroup(ctx context.Context, topic, groupID string, handler sarama.ConsumerGroupHandler) *Consumer {
+	brokers := Brokers()
 
 	// Configure consumer settings
 	config := sarama.NewConfig()
 	// Enable error reporting
 	config.Consumer.Return.Errors = true
+	// Start new groups at the end of the topic, like the previous partition consumer
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
 
-	// Create the consumer
-	consumer, err := sarama.NewConsumer(brokers, config)
+	// Create the consumer group
+	group, err := sarama.NewConsumerGroup(brokers, groupID, config)
 	if err != nil {
-		logrus.WithError(err).Fatal("Error creating consumer")
+		logrus.WithError(err).Fatal("Error creating consumer group")
 	}
 
-	// Create a partition consumer
-	// Note: In production, you'd typically use a consumer group instead
-	partitionConsumer, err := consumer.ConsumePartition(topic, 0, sarama.OffsetNewest)
-	if err != nil {
-		logrus.WithError(err).Fatal("Error creating partition consumer")
-	}
+	logrus.WithFields(logrus.Fields{
+		"topic": topic,
+		"group": groupID,
+	}).Info("Started consuming from topic")
 
-	logrus.WithField("topic", topic).Info("Started consuming from topic")
+	// Log consumer errors
+	go func() {
+		for err := range group.Errors() {
+			logrus.WithError(err).WithField("topic", topic).Error("Error consuming")
+		}
+	}()
 
-	// Start consuming messages in a separate goroutine
+	// Consume until the consumer is stopped, rejoining after rebalances
+	ctx, cancel := context.WithCancel(ctx)
+	consumer := &Consumer{topic: topic, group: group, cancel: cancel, done: make(chan struct{})}
 	go func() {
-		for {
-			select {
-			// Handle incoming messages
-			case msg := <-partitionConsumer.Messages():
-				logrus.WithField("topic", topic).Info("Received message")
-				handler(msg.Value)
-
-			// Handle errors
-			case err := <-partitionConsumer.Errors():
-				logrus.WithError(err).WithField("topic", topic).Error("Error consuming")
+		defer close(consumer.done)
+		for ctx.Err() == nil {
+			if err := group.Consume(ctx, []string{topic}, handler); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).WithField("topic", topic).Error("Consumer group session failed")
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+				}
 			}
 		}
 	}()
-}
\ No newline at end of file
+	return consumer
+}
+
+// groupHandler adapts a Handler to sarama.ConsumerGroupHandler
+type groupHandler struct {
+	topic   string
+	handler MessageHandler
+	options consumerOptions
+}
+
+// Setup is run at the beginning of a new session
+func (h *groupHandler) Setup(sarama.ConsumerGroupSession) error { return nil }
+
+// Cleanup is run at the end of a session
+func (h *groupHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+// ConsumeClaim processes messages from a single partition in order until
+// the session ends. A message is only marked once it was handled; one left
+// unhandled ends the claim, so its redelivery resumes from it.
+func (h *groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			logrus.WithField("topic", h.topic).Info("Received message")
+			// A later message must not be marked past one left unhandled
+			if !h.process(session.Context(), msg) {
+				return nil
+			}
+			session.MarkMessage(msg, "")
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// process runs the handler for a message, redelivering retryable failures
+// with backoff or through the retry topics and dead-lettering fatal or
+// exhausted ones.
+//
+// Returns:
+//   - bool: False if ctx ended while the message waited for a redelivery or
+//     before it was written to the DLQ, so it must not be marked
+func (h *groupHandler) process(ctx context.Context, msg *sarama.ConsumerMessage) bool {
+	message := newMessage(msg)
+
+	delay := h.options.backoff
+	for attempt := 1; ; attempt++ {
+		err := h.handler(message)
+		if err == nil {
+			return true
+		}
+
+		fields := logrus.Fields{
+			"topic":     h.topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+			"attempt":   attempt,
+		}
+		if !isFatal(err) && len(h.options.retryTiers) > 0 {
+			return h.scheduleRetry(ctx, msg, message, err)
+		}
+		if isFatal(err) || attempt > h.options.maxRetries {
+			logrus.WithError(err).WithFields(fields).Error("Message failed, routing to DLQ")
+			return h.deadLetter(ctx, msg, message, err, attempt)
+		}
+
+		logrus.WithError(err).WithFields(fields).Warn("Message failed, retrying")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			// Leave the message for whichever member picks up the partition
+			return false
+		}
+		delay *= 2
+		if delay > h.options.maxBackoff {
+			delay = h.options.maxBackoff
+		}
+	}
+}
+
+// newMessage converts a consumed message for the handler. A message
+// redelivered from a retry topic gets the position of its first delivery.
+func newMessage(msg *sarama.ConsumerMessage) Message {
+	message := Message{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Value:     msg.Value,
+		Headers:   make(map[string]string, len(msg.Headers)),
+	}
+	for _, header := range msg.Headers {
+		if header != nil {
+			message.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	if message.Headers[HeaderOriginalTopic] == msg.Topic {
+		partition, perr := strconv.ParseInt(message.Headers[HeaderOriginalPartition], 10, 32)
+		offset, oerr := strconv.ParseInt(message.Headers[HeaderOriginalOffset], 10, 64)
+		if perr == nil && oerr == nil {
+			message.Partition, message.Offset = int32(partition), offset
+		}
+	}
+	return message
+}
+
+// deadLetter publishes a failed message to the dead-letter topic, retrying
+// with backoff while the broker rejects it. The source headers name the
+// message's first delivery.
+//
+// Returns:
+//   - bool: False if ctx ended before the message was written to the DLQ,
+//     so it must not be marked
+func (h *groupHandler) deadLetter(ctx context.Context, msg *sarama.ConsumerMessage, message Message, cause error, attempts int) bool {
+	dlq := &sarama.ProducerMessage{
+		Topic: h.options.dlqTopic,
+		Key:   sarama.ByteEncoder(msg.Key),
+		Value: sarama.ByteEncoder(msg.Value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("source_topic"), Value: []byte(message.Topic)},
+			{Key: []byte("source_partition"), Value: []byte(strconv.Itoa(int(message.Partition)))},
+			{Key: []byte("source_offset"), Value: []byte(strconv.FormatInt(message.Offset, 10))},
+			{Key: []byte("error"), Value: []byte(cause.Error())},
+			{Key: []byte("attempts"), Value: []byte(strconv.Itoa(attempts))},
+		},
+	}
+	if !sendUntilDone(ctx, h.options.producer, dlq, h.options.backoff, h.options.maxBackoff) {
+		logrus.WithFields(logrus.Fields{
+			"topic":  h.topic,
+			"dlq":    h.options.dlqTopic,
+			"offset": msg.Offset,
+		}).Warn("Stopped before the message reached the DLQ, leaving it unmarked")
+		return false
+	}
+	return true
+}
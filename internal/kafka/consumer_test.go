@@ -0,0 +1,75 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// failingHandler returns a handler for PRODUCTS without retry topics whose
+// every delivery fails fatally.
+func failingHandler(producer sarama.SyncProducer) *groupHandler {
+	return &groupHandler{
+		topic:   "PRODUCTS",
+		handler: func(Message) error { return Fatal(errors.New("malformed")) },
+		options: consumerOptions{
+			backoff:    time.Millisecond,
+			maxBackoff: time.Millisecond,
+			dlqTopic:   "PRODUCTS.DLQ",
+			producer:   producer,
+		},
+	}
+}
+
+func TestDeadLetterRetriesRejectedSends(t *testing.T) {
+	producer := &recordingProducer{fail: 2}
+	h := failingHandler(producer)
+
+	if !h.process(context.Background(), &sarama.ConsumerMessage{Topic: "PRODUCTS", Offset: 7, Value: []byte(`{`)}) {
+		t.Fatal("dead-lettered message was not marked")
+	}
+	if sent := producer.messages(); len(sent) != 1 || sent[0].Topic != "PRODUCTS.DLQ" {
+		t.Fatalf("sent %d messages, want one to PRODUCTS.DLQ after the rejected sends", len(sent))
+	}
+}
+
+func TestDeadLetterLeavesUnwrittenMessageUnmarked(t *testing.T) {
+	producer := &recordingProducer{fail: -1} // Rejects every send
+	h := failingHandler(producer)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if h.process(ctx, &sarama.ConsumerMessage{Topic: "PRODUCTS", Offset: 7, Value: []byte(`{`)}) {
+		t.Error("message marked although it never reached the DLQ")
+	}
+}
+
+func TestConsumeClaimStopsAtUnhandledMessage(t *testing.T) {
+	producer := &recordingProducer{fail: -1} // The DLQ write never succeeds
+	h := failingHandler(producer)
+	h.handler = func(msg Message) error {
+		if msg.Offset == 7 {
+			return Fatal(errors.New("malformed"))
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	session := &fakeSession{ctx: ctx}
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 2)}
+	claim.messages <- &sarama.ConsumerMessage{Topic: "PRODUCTS", Offset: 7, Value: []byte(`{`)}
+	claim.messages <- &sarama.ConsumerMessage{Topic: "PRODUCTS", Offset: 8, Value: []byte(`{}`)}
+
+	if err := h.ConsumeClaim(session, claim); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.marked) != 0 {
+		t.Errorf("marked %v, want nothing past the message that never reached the DLQ", session.marked)
+	}
+	if len(claim.messages) != 1 {
+		t.Error("the next message was consumed after the unhandled one")
+	}
+}
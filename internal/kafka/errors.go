@@ -0,0 +1,51 @@
+package kafka
+
+import "errors"
+
+// RetryableError marks a handler failure as transient. The consumer redelivers
+// the message with backoff until the retry budget is exhausted, after which
+// the message is routed to the dead-letter topic.
+type RetryableError struct {
+	Err error
+}
+
+// Error implements the error interface
+func (e *RetryableError) Error() string { return "retryable: " + e.Err.Error() }
+
+// Unwrap returns the underlying error
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+// FatalError marks a handler failure as permanent, e.g. a malformed payload.
+// The consumer routes the message to the dead-letter topic immediately.
+type FatalError struct {
+	Err error
+}
+
+// Error implements the error interface
+func (e *FatalError) Error() string { return "fatal: " + e.Err.Error() }
+
+// Unwrap returns the underlying error
+func (e *FatalError) Unwrap() error { return e.Err }
+
+// Retryable wraps err as a RetryableError. It returns nil for a nil error.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+// Fatal wraps err as a FatalError. It returns nil for a nil error.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &FatalError{Err: err}
+}
+
+// isFatal reports whether err, or any error it wraps, is a FatalError.
+// Unclassified errors are treated as retryable.
+func isFatal(err error) bool {
+	var fatal *FatalError
+	return errors.As(err, &fatal)
+}
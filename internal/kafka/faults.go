@@ -0,0 +1,72 @@
+// Package kafka implements the fault injection seam of the producer
+package kafka
+
+import (
+	"strconv"
+
+	"github.com/IBM/sarama"
+
+	"scraper/internal/faults"
+)
+
+// faultyProducer injects the produce faults of internal/faults before
+// handing messages to the real producer
+type faultyProducer struct {
+	sarama.SyncProducer
+}
+
+// withFaultInjection wraps a producer when fault injection is enabled and
+// returns it unchanged otherwise.
+func withFaultInjection(producer sarama.SyncProducer) sarama.SyncProducer {
+	if !faults.Enabled() {
+		return producer
+	}
+	return faultyProducer{producer}
+}
+
+// messageScope describes a message for rule matching; numeric keys, like
+// the product ID of price_change events, count as product IDs.
+func messageScope(msg *sarama.ProducerMessage) faults.Scope {
+	scope := faults.Scope{Topic: msg.Topic}
+	if msg.Key != nil {
+		if key, err := msg.Key.Encode(); err == nil {
+			scope.ProductID, _ = strconv.Atoi(string(key))
+		}
+	}
+	return scope
+}
+
+// SendMessage implements sarama.SyncProducer.
+func (p faultyProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if err := faults.Inject(faults.TargetProduce, messageScope(msg)); err != nil {
+		return -1, -1, err
+	}
+	return p.SyncProducer.SendMessage(msg)
+}
+
+// SendMessages implements sarama.SyncProducer. Messages hit by a fault are
+// reported in sarama.ProducerErrors and the others are still sent.
+func (p faultyProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	var failed sarama.ProducerErrors
+	send := make([]*sarama.ProducerMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if err := faults.Inject(faults.TargetProduce, messageScope(msg)); err != nil {
+			failed = append(failed, &sarama.ProducerError{Msg: msg, Err: err})
+			continue
+		}
+		send = append(send, msg)
+	}
+	if len(send) > 0 {
+		if err := p.SyncProducer.SendMessages(send); err != nil {
+			if errs, ok := err.(sarama.ProducerErrors); ok {
+				failed = append(failed, errs...)
+			} else {
+				return err
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
@@ -5,11 +5,32 @@ package kafka
 import (
 	"os"
 	"strings"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/sirupsen/logrus"
 )
 
+// MaxMessageBytes is the largest message the producer accepts. Publishers
+// that batch records should stay below it.
+const MaxMessageBytes = 5 * 1024 * 1024
+
+// Brokers returns the Kafka broker addresses.
+//
+// Environment Variables:
+//   - KAFKA_BROKERS: Comma-separated list of Kafka broker addresses (default: localhost:9092)
+//
+// Returns:
+//   - []string: Broker addresses
+func Brokers() []string {
+	brokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
+	if len(brokers) == 0 || brokers[0] == "" {
+		// Default to localhost if no brokers specified
+		brokers = []string{"localhost:9092"}
+	}
+	return brokers
+}
+
 // SetupProducer initializes and configures a synchronous Kafka producer.
 // It reads broker addresses from environment variables and sets up the producer
 // with appropriate configuration for our use case.
@@ -20,25 +41,30 @@ import (
 // The producer is configured with:
 //   - Synchronous operation (waits for acknowledgment)
 //   - 5MB maximum message size (for large product batches)
+//   - Hash partitioning on the message key
+//   - Retries with backoff and small flush windows to throttle bursts
 //   - Automatic broker discovery
+//   - Injected produce faults when FAULT_INJECTION is set (see internal/faults)
 //
 // Returns:
 //   - sarama.SyncProducer: A configured Kafka producer
 //   - Panics if producer creation fails
 func SetupProducer() sarama.SyncProducer {
-	// Get Kafka broker addresses from environment
-	brokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
-	if len(brokers) == 0 || brokers[0] == "" {
-		// Default to localhost if no brokers specified
-		brokers = []string{"localhost:9092"}
-	}
+	brokers := Brokers()
 
 	// Configure producer settings
 	config := sarama.NewConfig()
 	// Enable synchronous operation
 	config.Producer.Return.Successes = true
 	// Increase max message size to 5MB to handle large product batches
-	config.Producer.MaxMessageBytes = 5 * 1024 * 1024
+	config.Producer.MaxMessageBytes = MaxMessageBytes
+	// Keep keyed messages on a stable partition
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	// Let the producer absorb broker back-pressure instead of callers sleeping
+	config.Producer.Retry.Max = 5
+	config.Producer.Retry.Backoff = 250 * time.Millisecond
+	config.Producer.Flush.Frequency = 50 * time.Millisecond
+	config.Producer.Flush.Bytes = 1024 * 1024
 
 	// Create synchronous producer
 	producer, err := sarama.NewSyncProducer(brokers, config)
@@ -47,5 +73,5 @@ func SetupProducer() sarama.SyncProducer {
 	}
 
 	logrus.WithField("brokers", brokers).Info("Kafka producer initialized")
-	return producer
+	return withFaultInjection(producer)
 }
\ No newline at end of file
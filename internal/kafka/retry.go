@@ -0,0 +1,322 @@
+// Package kafka implements delayed redelivery through retry topics
+package kafka
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/sirupsen/logrus"
+
+	"scraper/internal/metrics"
+)
+
+// Headers of a message on its way through the retry topics
+const (
+	HeaderNotBefore         = "not-before"         // Unix milliseconds before which the message is not redelivered
+	HeaderRetryAttempt      = "retry_attempt"      // Retry topics the message went through, 1 for the first
+	HeaderOriginalTopic     = "original_topic"     // Topic the message is redelivered to
+	HeaderOriginalPartition = "original_partition" // Partition of the first delivery
+	HeaderOriginalOffset    = "original_offset"    // Offset of the first delivery
+	HeaderRetryError        = "retry_error"        // Why the last delivery failed
+)
+
+// defaultRetryDelays are the retry tiers used when KAFKA_RETRY_DELAYS is unset
+var defaultRetryDelays = []time.Duration{time.Minute, 10 * time.Minute}
+
+var (
+	retryDepth = metrics.NewGauge(
+		"kafka_retry_tier_depth",
+		"Messages waiting in a retry topic, by the lag of its delay consumer",
+		"topic")
+	retryMessages = metrics.NewCounter(
+		"kafka_retry_messages_total",
+		"Messages moved through a retry topic by result (scheduled, redelivered, exhausted)",
+		"topic", "result")
+)
+
+// RetryDelays returns the delays of the retry tiers, shortest first.
+//
+// Environment Variables:
+//   - KAFKA_RETRY_DELAYS: Comma-separated delays of the retry topics, or
+//     "off" to redeliver in-process instead (default: 1m,10m)
+//
+// Returns:
+//   - []time.Duration: Tier delays; nil when retry topics are off
+func RetryDelays() []time.Duration {
+	raw := strings.TrimSpace(os.Getenv("KAFKA_RETRY_DELAYS"))
+	if raw == "" {
+		return defaultRetryDelays
+	}
+	if strings.EqualFold(raw, "off") {
+		return nil
+	}
+	var delays []time.Duration
+	for _, part := range strings.Split(raw, ",") {
+		delay, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || delay < time.Second || (len(delays) > 0 && delay <= delays[len(delays)-1]) {
+			logrus.WithField("KAFKA_RETRY_DELAYS", raw).Warn("Invalid retry delays, using 1m,10m")
+			return defaultRetryDelays
+		}
+		delays = append(delays, delay)
+	}
+	return delays
+}
+
+// RetryTopic names the retry topic of a topic for a delay, e.g.
+// PRODUCTS_RETRY_1M for one minute or PRODUCTS_RETRY_30S for 30 seconds.
+func RetryTopic(topic string, delay time.Duration) string {
+	var suffix string
+	switch {
+	case delay%time.Hour == 0:
+		suffix = strconv.Itoa(int(delay/time.Hour)) + "H"
+	case delay%time.Minute == 0:
+		suffix = strconv.Itoa(int(delay/time.Minute)) + "M"
+	default:
+		suffix = strconv.Itoa(int(delay/time.Second)) + "S"
+	}
+	return topic + "_RETRY_" + suffix
+}
+
+// retryTier is one retry topic and how long its messages wait
+type retryTier struct {
+	topic string
+	delay time.Duration
+}
+
+// retryTiers returns the tiers of a topic for the configured delays.
+func retryTiers(topic string, delays []time.Duration) []retryTier {
+	tiers := make([]retryTier, len(delays))
+	for i, delay := range delays {
+		tiers[i] = retryTier{topic: RetryTopic(topic, delay), delay: delay}
+	}
+	return tiers
+}
+
+// scheduleRetry hands a message whose retryable failure the handler reported
+// to the next retry topic, or to the dead-letter topic once it went through
+// all of them. The message keeps its headers; the first delivery's topic,
+// partition and offset are recorded on the first retry and kept after that.
+//
+// Returns:
+//   - bool: False if ctx ended before the message could be handed over to a
+//     retry topic or the DLQ, so it must not be marked
+func (h *groupHandler) scheduleRetry(ctx context.Context, msg *sarama.ConsumerMessage, message Message, cause error) bool {
+	passed, _ := strconv.Atoi(message.Headers[HeaderRetryAttempt])
+	fields := logrus.Fields{
+		"topic":         h.topic,
+		"partition":     message.Partition,
+		"offset":        message.Offset,
+		"retry_attempt": passed,
+	}
+	if passed >= len(h.options.retryTiers) {
+		logrus.WithError(cause).WithFields(fields).Error("Message failed after its last retry, routing to DLQ")
+		retryMessages.Inc(h.options.retryTiers[len(h.options.retryTiers)-1].topic, "exhausted")
+		return h.deadLetter(ctx, msg, message, cause, passed+1)
+	}
+
+	tier := h.options.retryTiers[passed]
+	headers := map[string]string{
+		HeaderOriginalTopic:     message.Topic,
+		HeaderOriginalPartition: strconv.Itoa(int(message.Partition)),
+		HeaderOriginalOffset:    strconv.FormatInt(message.Offset, 10),
+		HeaderRetryAttempt:      strconv.Itoa(passed + 1),
+		HeaderNotBefore:         strconv.FormatInt(time.Now().Add(tier.delay).UnixMilli(), 10),
+		HeaderRetryError:        cause.Error(),
+	}
+	retry := &sarama.ProducerMessage{
+		Topic:   tier.topic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: replaceHeaders(msg.Headers, headers),
+	}
+	if !sendUntilDone(ctx, h.options.producer, retry, h.options.backoff, h.options.maxBackoff) {
+		return false
+	}
+	retryMessages.Inc(tier.topic, "scheduled")
+	logrus.WithError(cause).WithFields(fields).WithFields(logrus.Fields{
+		"retry_topic": tier.topic,
+		"delay":       tier.delay,
+	}).Warn("Message failed, scheduled for a delayed retry")
+	return true
+}
+
+// delayHandler consumes a retry topic. It holds every message until its
+// not-before time and then publishes it to its original topic. Messages of a
+// retry topic all wait the same delay, so waiting for the first message of a
+// partition never holds back one that is due earlier.
+type delayHandler struct {
+	topic      string // Retry topic
+	producer   sarama.SyncProducer
+	backoff    time.Duration // Initial delay between failed publishes
+	maxBackoff time.Duration // Upper bound for that delay
+
+	mu  sync.Mutex
+	lag map[int32]int64 // Messages left per claimed partition
+}
+
+// newDelayHandler creates the consumer handler of a retry topic.
+func newDelayHandler(topic string, options consumerOptions) *delayHandler {
+	return &delayHandler{
+		topic:      topic,
+		producer:   options.producer,
+		backoff:    options.backoff,
+		maxBackoff: options.maxBackoff,
+		lag:        make(map[int32]int64),
+	}
+}
+
+// Setup is run at the beginning of a new session
+func (h *delayHandler) Setup(sarama.ConsumerGroupSession) error { return nil }
+
+// Cleanup forgets the partitions of the ended session; the next session
+// reports the ones it claims
+func (h *delayHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lag = make(map[int32]int64)
+	retryDepth.Set(0, h.topic)
+	return nil
+}
+
+// ConsumeClaim redelivers the messages of a partition in order once they
+// are due, until the session ends.
+func (h *delayHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			h.setLag(msg.Partition, claim.HighWaterMarkOffset()-msg.Offset)
+			if !h.redeliver(session.Context(), msg) {
+				return nil
+			}
+			session.MarkMessage(msg, "")
+			h.setLag(msg.Partition, claim.HighWaterMarkOffset()-msg.Offset-1)
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// setLag records the messages left in a partition and updates the depth.
+func (h *delayHandler) setLag(partition int32, lag int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lag[partition] = lag
+	var depth int64
+	for _, n := range h.lag {
+		depth += n
+	}
+	retryDepth.Set(float64(depth), h.topic)
+}
+
+// redeliver waits until a message is due and publishes it to its original
+// topic without the not-before header. A message without an original topic
+// cannot be redelivered and is dropped with an error.
+//
+// Returns:
+//   - bool: False if ctx ended first, so the message must not be marked
+func (h *delayHandler) redeliver(ctx context.Context, msg *sarama.ConsumerMessage) bool {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		if header != nil {
+			headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	fields := logrus.Fields{"topic": h.topic, "partition": msg.Partition, "offset": msg.Offset}
+	original := headers[HeaderOriginalTopic]
+	if original == "" {
+		logrus.WithFields(fields).Error("Retry message has no original topic, dropping it")
+		return true
+	}
+
+	if notBefore, err := strconv.ParseInt(headers[HeaderNotBefore], 10, 64); err == nil {
+		if wait := time.Until(time.UnixMilli(notBefore)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			}
+		}
+	}
+
+	out := &sarama.ProducerMessage{
+		Topic:   original,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: replaceHeaders(msg.Headers, map[string]string{HeaderNotBefore: ""}),
+	}
+	if !sendUntilDone(ctx, h.producer, out, h.backoff, h.maxBackoff) {
+		return false
+	}
+	retryMessages.Inc(h.topic, "redelivered")
+	logrus.WithFields(fields).WithField("original_topic", original).Info("Redelivered retry message")
+	return true
+}
+
+// replaceHeaders returns headers with the given keys replaced; an empty
+// value removes the key.
+func replaceHeaders(headers []*sarama.RecordHeader, replace map[string]string) []sarama.RecordHeader {
+	out := make([]sarama.RecordHeader, 0, len(headers)+len(replace))
+	for _, header := range headers {
+		if header == nil {
+			continue
+		}
+		if _, ok := replace[string(header.Key)]; ok {
+			continue
+		}
+		out = append(out, *header)
+	}
+	for _, key := range sortedHeaderKeys(replace) {
+		if value := replace[key]; value != "" {
+			out = append(out, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+		}
+	}
+	return out
+}
+
+// sortedHeaderKeys returns the keys of headers in a stable order.
+func sortedHeaderKeys(headers map[string]string) []string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sendUntilDone publishes a message, retrying with backoff while the broker
+// rejects it.
+//
+// Returns:
+//   - bool: False if ctx ended before the message was published
+func sendUntilDone(ctx context.Context, producer sarama.SyncProducer, msg *sarama.ProducerMessage, backoff, maxBackoff time.Duration) bool {
+	for {
+		_, _, err := producer.SendMessage(msg)
+		if err == nil {
+			return true
+		}
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"topic":    msg.Topic,
+			"retry_in": backoff,
+		}).Error("Failed to publish message, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// recordingProducer records the messages it is asked to send, after
+// rejecting the first fail sends
+type recordingProducer struct {
+	sarama.SyncProducer
+
+	mu   sync.Mutex
+	fail int
+	sent []*sarama.ProducerMessage
+}
+
+func (p *recordingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail != 0 {
+		p.fail--
+		return 0, 0, errors.New("broker unavailable")
+	}
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent)), nil
+}
+
+func (p *recordingProducer) messages() []*sarama.ProducerMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*sarama.ProducerMessage(nil), p.sent...)
+}
+
+// fakeSession is a consumer group session recording marked offsets
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+
+	ctx    context.Context
+	mu     sync.Mutex
+	marked []int64
+}
+
+func (s *fakeSession) Context() context.Context { return s.ctx }
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, msg.Offset)
+}
+
+// fakeClaim is a partition claim serving messages from a channel
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+
+	messages  chan *sarama.ConsumerMessage
+	highWater int64
+}
+
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return c.highWater }
+
+// headerMap returns the headers of a produced message by key.
+func headerMap(msg *sarama.ProducerMessage) map[string]string {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	return headers
+}
+
+// retryingHandler returns a handler for PRODUCTS with 1m and 10m retry tiers
+// whose every delivery fails with err.
+func retryingHandler(producer sarama.SyncProducer, err error, seen *[]Message) *groupHandler {
+	return &groupHandler{
+		topic: "PRODUCTS",
+		handler: func(msg Message) error {
+			*seen = append(*seen, msg)
+			return err
+		},
+		options: consumerOptions{
+			backoff:    time.Millisecond,
+			maxBackoff: time.Millisecond,
+			dlqTopic:   "PRODUCTS.DLQ",
+			producer:   producer,
+			retryTiers: retryTiers("PRODUCTS", []time.Duration{time.Minute, 10 * time.Minute}),
+		},
+	}
+}
+
+func TestRetryableFailureMovesThroughTiers(t *testing.T) {
+	producer := &recordingProducer{}
+	var seen []Message
+	h := retryingHandler(producer, Retryable(errors.New("database down")), &seen)
+
+	first := &sarama.ConsumerMessage{
+		Topic: "PRODUCTS", Partition: 2, Offset: 40, Key: []byte("1-50"), Value: []byte(`[]`),
+		Headers: []*sarama.RecordHeader{{Key: []byte("trace_id"), Value: []byte("abc")}},
+	}
+	if !h.process(context.Background(), first) {
+		t.Fatal("message scheduled for a retry was not marked")
+	}
+	if len(seen) != 1 {
+		t.Fatalf("handler ran %d times, want once before the retry", len(seen))
+	}
+	sent := producer.messages()
+	if len(sent) != 1 || sent[0].Topic != "PRODUCTS_RETRY_1M" {
+		t.Fatalf("sent %d messages, want one to PRODUCTS_RETRY_1M", len(sent))
+	}
+	headers := headerMap(sent[0])
+	notBefore, _ := strconv.ParseInt(headers[HeaderNotBefore], 10, 64)
+	if wait := time.Until(time.UnixMilli(notBefore)); wait < 50*time.Second || wait > time.Minute {
+		t.Errorf("not-before in %s, want a minute", wait)
+	}
+	if headers[HeaderRetryAttempt] != "1" || headers[HeaderOriginalTopic] != "PRODUCTS" ||
+		headers[HeaderOriginalPartition] != "2" || headers[HeaderOriginalOffset] != "40" ||
+		headers[HeaderRetryError] != "retryable: database down" || headers["trace_id"] != "abc" {
+		t.Errorf("headers = %v", headers)
+	}
+
+	// Redelivered to PRODUCTS at a new offset, the message keeps its first position
+	second := &sarama.ConsumerMessage{Topic: "PRODUCTS", Partition: 0, Offset: 900, Key: first.Key, Value: first.Value}
+	for _, header := range sent[0].Headers {
+		if string(header.Key) != HeaderNotBefore {
+			second.Headers = append(second.Headers, &sarama.RecordHeader{Key: header.Key, Value: header.Value})
+		}
+	}
+	h.process(context.Background(), second)
+	if seen[1].Partition != 2 || seen[1].Offset != 40 {
+		t.Errorf("redelivered message at %d/%d, want its first delivery 2/40", seen[1].Partition, seen[1].Offset)
+	}
+	sent = producer.messages()
+	if len(sent) != 2 || sent[1].Topic != "PRODUCTS_RETRY_10M" || headerMap(sent[1])[HeaderRetryAttempt] != "2" {
+		t.Fatalf("second failure sent to %s, want PRODUCTS_RETRY_10M", sent[len(sent)-1].Topic)
+	}
+	if headers := headerMap(sent[1]); headers[HeaderOriginalPartition] != "2" || headers[HeaderOriginalOffset] != "40" {
+		t.Errorf("second retry headers = %v, want the first delivery kept", headers)
+	}
+}
+
+func TestExhaustedRetryGoesToDLQ(t *testing.T) {
+	producer := &recordingProducer{}
+	var seen []Message
+	h := retryingHandler(producer, Retryable(errors.New("database down")), &seen)
+	exhausted := retryMessages.Value("PRODUCTS_RETRY_10M", "exhausted")
+
+	msg := &sarama.ConsumerMessage{
+		Topic: "PRODUCTS", Partition: 0, Offset: 901, Value: []byte(`[]`),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(HeaderRetryAttempt), Value: []byte("2")},
+			{Key: []byte(HeaderOriginalTopic), Value: []byte("PRODUCTS")},
+			{Key: []byte(HeaderOriginalPartition), Value: []byte("2")},
+			{Key: []byte(HeaderOriginalOffset), Value: []byte("40")},
+		},
+	}
+	if !h.process(context.Background(), msg) {
+		t.Fatal("dead-lettered message was not marked")
+	}
+	sent := producer.messages()
+	if len(sent) != 1 || sent[0].Topic != "PRODUCTS.DLQ" {
+		t.Fatalf("sent %d messages, want one to PRODUCTS.DLQ", len(sent))
+	}
+	headers := headerMap(sent[0])
+	if headers["source_topic"] != "PRODUCTS" || headers["source_partition"] != "2" ||
+		headers["source_offset"] != "40" || headers["attempts"] != "3" {
+		t.Errorf("DLQ headers = %v, want the first delivery and 3 attempts", headers)
+	}
+	if got := retryMessages.Value("PRODUCTS_RETRY_10M", "exhausted") - exhausted; got != 1 {
+		t.Errorf("exhausted count grew by %v, want 1", got)
+	}
+}
+
+func TestFatalFailureSkipsRetryTopics(t *testing.T) {
+	producer := &recordingProducer{}
+	var seen []Message
+	h := retryingHandler(producer, Fatal(errors.New("malformed")), &seen)
+
+	h.process(context.Background(), &sarama.ConsumerMessage{Topic: "PRODUCTS", Value: []byte(`{`)})
+	if sent := producer.messages(); len(sent) != 1 || sent[0].Topic != "PRODUCTS.DLQ" {
+		t.Fatalf("fatal failure sent to %v, want PRODUCTS.DLQ only", sent)
+	}
+}
+
+func TestDelayHandlerRedeliversWhenDue(t *testing.T) {
+	producer := &recordingProducer{}
+	h := newDelayHandler("PRODUCTS_RETRY_1M", consumerOptions{
+		producer:   producer,
+		backoff:    time.Millisecond,
+		maxBackoff: time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := &fakeSession{ctx: ctx}
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 2), highWater: 12}
+
+	due := time.UnixMilli(time.Now().Add(150 * time.Millisecond).UnixMilli())
+	claim.messages <- &sarama.ConsumerMessage{
+		Topic: "PRODUCTS_RETRY_1M", Offset: 10, Key: []byte("k"), Value: []byte(`[]`),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(HeaderNotBefore), Value: []byte(strconv.FormatInt(due.UnixMilli(), 10))},
+			{Key: []byte(HeaderOriginalTopic), Value: []byte("PRODUCTS")},
+			{Key: []byte(HeaderRetryAttempt), Value: []byte("1")},
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- h.ConsumeClaim(session, claim) }()
+
+	time.Sleep(50 * time.Millisecond)
+	if len(producer.messages()) != 0 {
+		t.Fatal("message redelivered before its not-before time")
+	}
+	if depth := retryDepth.Value("PRODUCTS_RETRY_1M"); depth != 2 {
+		t.Errorf("depth = %v while waiting, want 2", depth)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(producer.messages()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not redelivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if time.Now().Before(due) {
+		t.Error("message redelivered early")
+	}
+	out := producer.messages()[0]
+	headers := headerMap(out)
+	if out.Topic != "PRODUCTS" || headers[HeaderRetryAttempt] != "1" {
+		t.Errorf("redelivered to %s with %v, want PRODUCTS keeping the attempt", out.Topic, headers)
+	}
+	if _, ok := headers[HeaderNotBefore]; ok {
+		t.Error("redelivered message still carries not-before")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(session.marked) != 1 || session.marked[0] != 10 {
+		t.Errorf("marked %v, want offset 10", session.marked)
+	}
+	if depth := retryDepth.Value("PRODUCTS_RETRY_1M"); depth != 1 {
+		t.Errorf("depth = %v after the redelivery, want 1", depth)
+	}
+}
+
+func TestDelayHandlerLeavesWaitingMessageOnShutdown(t *testing.T) {
+	producer := &recordingProducer{}
+	h := newDelayHandler("PRODUCTS_RETRY_10M", consumerOptions{producer: producer})
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &fakeSession{ctx: ctx}
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 1), highWater: 1}
+	claim.messages <- &sarama.ConsumerMessage{
+		Topic: "PRODUCTS_RETRY_10M",
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(HeaderNotBefore), Value: []byte(strconv.FormatInt(time.Now().Add(10*time.Minute).UnixMilli(), 10))},
+			{Key: []byte(HeaderOriginalTopic), Value: []byte("PRODUCTS")},
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- h.ConsumeClaim(session, claim) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delay handler did not stop")
+	}
+	if len(producer.messages()) != 0 || len(session.marked) != 0 {
+		t.Errorf("sent %d and marked %v, want the waiting message left unmarked", len(producer.messages()), session.marked)
+	}
+}
+
+func TestRetryTopic(t *testing.T) {
+	for delay, want := range map[time.Duration]string{
+		time.Minute:      "PRODUCTS_RETRY_1M",
+		10 * time.Minute: "PRODUCTS_RETRY_10M",
+		2 * time.Hour:    "PRODUCTS_RETRY_2H",
+		30 * time.Second: "PRODUCTS_RETRY_30S",
+	} {
+		if got := RetryTopic("PRODUCTS", delay); got != want {
+			t.Errorf("RetryTopic(%s) = %s, want %s", delay, got, want)
+		}
+	}
+}
+
+func TestRetryDelays(t *testing.T) {
+	for raw, want := range map[string][]time.Duration{
+		"":            {time.Minute, 10 * time.Minute},
+		"off":         nil,
+		"30s, 5m, 1h": {30 * time.Second, 5 * time.Minute, time.Hour},
+		"10m,1m":      {time.Minute, 10 * time.Minute},
+		"500ms":       {time.Minute, 10 * time.Minute},
+		"soon":        {time.Minute, 10 * time.Minute},
+	} {
+		t.Setenv("KAFKA_RETRY_DELAYS", raw)
+		got := RetryDelays()
+		if len(got) != len(want) {
+			t.Errorf("KAFKA_RETRY_DELAYS=%q: %v, want %v", raw, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("KAFKA_RETRY_DELAYS=%q: %v, want %v", raw, got, want)
+				break
+			}
+		}
+	}
+}
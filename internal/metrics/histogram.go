@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxWindowSamples bounds the recent observations kept per label set so a
+// burst of traffic cannot grow memory without limit
+const maxWindowSamples = 10000
+
+// Histogram counts observations in cumulative buckets, optionally split by
+// labels. It also keeps the observations from a recent time window so
+// quantiles can be computed without a Prometheus server.
+type Histogram struct {
+	name       string
+	help       string
+	buckets    []float64 // Upper bounds, ascending
+	labelNames []string
+	window     time.Duration
+	mu         sync.Mutex
+	series     map[string]*histogramSeries // Keyed by rendered label set
+}
+
+// histogramSeries holds the state for one label set
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // Per bucket, non-cumulative
+	count       uint64
+	sum         float64
+	recent      []sample // Observations within the window, oldest first
+}
+
+// sample is a single timestamped observation
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// NewHistogram creates and registers a histogram.
+//
+// Parameters:
+//   - name: Metric name, e.g. pipeline_latency_seconds
+//   - help: Human readable description
+//   - buckets: Bucket upper bounds; sorted before use
+//   - window: How long observations are kept for Quantile
+//   - labelNames: Names of the labels passed to Observe, in order
+//
+// Returns:
+//   - *Histogram: The registered histogram
+func NewHistogram(name, help string, buckets []float64, window time.Duration, labelNames ...string) *Histogram {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	h := &Histogram{
+		name:       name,
+		help:       help,
+		buckets:    sorted,
+		labelNames: labelNames,
+		window:     window,
+		series:     make(map[string]*histogramSeries),
+	}
+	register(h)
+	return h
+}
+
+// Observe records v for the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelString(h.labelNames, labelValues)
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+
+	s.recent = append(s.recent, sample{at: now, value: v})
+	s.prune(now.Add(-h.window))
+}
+
+// Quantiles returns the requested quantiles of the observations made within
+// the window for each label set, keyed by the first label value.
+//
+// Parameters:
+//   - qs: Quantiles to compute, between 0 and 1
+//
+// Returns:
+//   - map[string]WindowSummary: Summary per label set
+func (h *Histogram) Quantiles(qs ...float64) map[string]WindowSummary {
+	cutoff := time.Now().Add(-h.window)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make(map[string]WindowSummary, len(h.series))
+	for key, s := range h.series {
+		s.prune(cutoff)
+		values := make([]float64, len(s.recent))
+		for i, smp := range s.recent {
+			values[i] = smp.value
+		}
+		sort.Float64s(values)
+
+		summary := WindowSummary{Count: len(values), Quantiles: make(map[string]float64, len(qs))}
+		for _, q := range qs {
+			summary.Quantiles[fmt.Sprintf("p%g", q*100)] = quantile(values, q)
+		}
+		if len(s.labelValues) > 0 {
+			key = s.labelValues[0]
+		}
+		result[key] = summary
+	}
+	return result
+}
+
+// WindowSummary describes the observations of one label set within the
+// histogram window.
+type WindowSummary struct {
+	Count     int                `json:"count"`     // Number of observations in the window
+	Quantiles map[string]float64 `json:"quantiles"` // Quantile values keyed like p50, p95
+}
+
+// prune drops observations older than cutoff and beyond maxWindowSamples.
+func (s *histogramSeries) prune(cutoff time.Time) {
+	drop := 0
+	for drop < len(s.recent) && s.recent[drop].at.Before(cutoff) {
+		drop++
+	}
+	if excess := len(s.recent) - drop - maxWindowSamples; excess > 0 {
+		drop += excess
+	}
+	if drop > 0 {
+		s.recent = append(s.recent[:0], s.recent[drop:]...)
+	}
+}
+
+// quantile returns the q-th quantile of sorted values using nearest rank.
+// NaN is returned when there are no values.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// write renders the histogram in Prometheus text format.
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		names := append(append([]string(nil), h.labelNames...), "le")
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			values := append(append([]string(nil), s.labelValues...), fmt.Sprintf("%g", bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(names, values), cumulative)
+		}
+		values := append(append([]string(nil), s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, key, s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// httpRequestDuration measures how long the HTTP servers take to answer
+var httpRequestDuration = NewHistogram(
+	"http_request_duration_seconds",
+	"Seconds to answer an inbound HTTP request by service, method, route and response status",
+	[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	time.Hour,
+	"service", "method", "route", "status",
+)
+
+// Middleware records the latency of every request a service answers in
+// http_request_duration_seconds. Requests are labelled with their route as
+// registered, e.g. /products/:id, so the number of series stays bounded;
+// requests matching no route are labelled "unmatched". Add it before the
+// other middleware, so rejected requests are counted too.
+//
+// Parameters:
+//   - service: Name of the service, e.g. "crawler"
+//
+// Returns:
+//   - echo.MiddlewareFunc: Middleware recording request latency
+func Middleware(service string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			// Send the error response here, so its status is recorded
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			httpRequestDuration.Observe(time.Since(start).Seconds(),
+				service, c.Request().Method, route, strconv.Itoa(c.Response().Status))
+			return nil
+		}
+	}
+}
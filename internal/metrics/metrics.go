@@ -0,0 +1,183 @@
+// Package metrics provides a minimal in-process metrics registry that is
+// rendered in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// registry holds every metric created through this package
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+// collector is implemented by every metric type
+type collector interface {
+	write(w io.Writer)
+}
+
+// register adds a metric to the global registry.
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// Counter is a monotonically increasing value, optionally split by labels.
+type Counter struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.Mutex
+	values     map[string]float64 // Keyed by rendered label set
+}
+
+// NewCounter creates and registers a counter.
+//
+// Parameters:
+//   - name: Metric name, e.g. price_drops_suppressed_total
+//   - help: Human readable description
+//   - labelNames: Names of the labels passed to Inc/Add, in order
+//
+// Returns:
+//   - *Counter: The registered counter
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter by one for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter by v for the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := labelString(c.labelNames, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Value returns the current counter value for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := labelString(c.labelNames, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// write renders the counter in Prometheus text format.
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, key, c.values[key])
+	}
+}
+
+// Gauge is a value that can go up and down, optionally split by labels.
+type Gauge struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.Mutex
+	values     map[string]float64 // Keyed by rendered label set
+}
+
+// NewGauge creates and registers a gauge.
+//
+// Parameters:
+//   - name: Metric name, e.g. search_index_lag_seconds
+//   - help: Human readable description
+//   - labelNames: Names of the labels passed to Set, in order
+//
+// Returns:
+//   - *Gauge: The registered gauge
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+// Set replaces the gauge value for the given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := labelString(g.labelNames, labelValues)
+	g.mu.Lock()
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+// Value returns the current gauge value for the given label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	key := labelString(g.labelNames, labelValues)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[key]
+}
+
+// write renders the gauge in Prometheus text format.
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %g\n", g.name, key, g.values[key])
+	}
+}
+
+// labelString renders label names and values as {a="x",b="y"}.
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		parts[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// sortedKeys returns map keys in a stable order for rendering.
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WritePrometheus renders every registered metric to w.
+func WritePrometheus(w io.Writer) {
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the registered metrics in Prometheus text format.
+func Handler(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	WritePrometheus(c.Response())
+	return nil
+}
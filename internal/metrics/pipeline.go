@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Pipeline stages that record how long ago the data they handle was fetched
+const (
+	StageAnalysis     = "analysis"     // Product batch consumed by the analysis service
+	StageFavorites    = "favorites"    // price_change event consumed by the favorites service
+	StageNotification = "notification" // Notification email sent
+)
+
+// pipelineWindow is the period covered by the pipeline latency summary
+const pipelineWindow = time.Hour
+
+// pipelineLatency measures the time from a product fetch to each stage
+var pipelineLatency = NewHistogram(
+	"pipeline_latency_seconds",
+	"Seconds between fetching a product from Trendyol and handling it at a pipeline stage",
+	[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200},
+	pipelineWindow,
+	"stage",
+)
+
+// ObservePipelineLatency records the time elapsed since fetchedAt at a stage.
+// Zero timestamps (data from before stamping was introduced) are ignored.
+//
+// Parameters:
+//   - stage: One of the Stage constants
+//   - fetchedAt: When the product data was fetched
+func ObservePipelineLatency(stage string, fetchedAt time.Time) {
+	if fetchedAt.IsZero() {
+		return
+	}
+	pipelineLatency.Observe(time.Since(fetchedAt).Seconds(), stage)
+}
+
+// PipelineLatencyHandler serves p50/p95 latency in seconds per pipeline stage
+// over the last hour. Stages without observations report null quantiles.
+func PipelineLatencyHandler(c echo.Context) error {
+	summary := pipelineLatency.Quantiles(0.5, 0.95)
+
+	stages := make(map[string]interface{}, 3)
+	for _, stage := range []string{StageAnalysis, StageFavorites, StageNotification} {
+		s, ok := summary[stage]
+		if !ok || s.Count == 0 {
+			stages[stage] = map[string]interface{}{"count": 0, "p50_seconds": nil, "p95_seconds": nil}
+			continue
+		}
+		stages[stage] = map[string]interface{}{
+			"count":       s.Count,
+			"p50_seconds": s.Quantiles["p50"],
+			"p95_seconds": s.Quantiles["p95"],
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"window": pipelineWindow.String(),
+		"stages": stages,
+	})
+}
@@ -8,6 +8,10 @@ import (
 	"gorm.io/gorm"
 )
 
+// SourceTrendyol is the marketplace every product came from before multi-source
+// crawling; it is the default Source for products and favorites
+const SourceTrendyol = "trendyol"
+
 // WebCategory represents a product category in the website's hierarchy
 type WebCategory struct {
 	Name  string `json:"name"`  // Display name of the category
@@ -99,12 +103,46 @@ type Root struct {
 // PriceStockLog tracks historical changes in product price and stock levels
 type PriceStockLog struct {
 	gorm.Model           // Includes ID, created_at, updated_at, deleted_at
-	ProductID  uint      // Reference to the product
+	ProductID  uint      `gorm:"index:idx_price_stock_logs_product_time,priority:1"` // Reference to the product
+	Source     string    `gorm:"index:idx_price_stock_logs_product_time,priority:2;not null;default:trendyol"` // Marketplace of the product
 	OldPrice   string    // Previous price before change
 	NewPrice   string    // New price after change
 	OldStock   string    // Previous stock level
 	NewStock   string    // New stock level
-	ChangeTime time.Time // Exact time when change was detected
+	PriceValue *float64  `gorm:"type:decimal(10,2)"` // NewPrice as a number for aggregation; nil if unknown
+	StockValue *float64  // NewStock as a number for aggregation; nil if unknown
+	ChangeTime time.Time `gorm:"index:idx_price_stock_logs_product_time,priority:3;index:idx_price_stock_logs_change_time"` // Exact time when change was detected
+}
+
+// PriceHistory records price changes made through the API, such as
+// simulated drops, with the price the product had before. Crawled changes
+// are logged in PriceStockLog.
+type PriceHistory struct {
+	ID        uint      `gorm:"primaryKey"`
+	ProductID uint      `gorm:"not null;index:idx_price_history_product,priority:1"` // Product whose price changed
+	Source    string    `gorm:"not null;default:trendyol;index:idx_price_history_product,priority:2"` // Marketplace of the product
+	OldPrice  float64   `gorm:"type:decimal(10,2);not null"` // Price before the change
+	NewPrice  float64   `gorm:"type:decimal(10,2);not null"` // Price after the change
+	CreatedAt time.Time // When the change was made
+}
+
+// TableName stores price changes in the price_history table.
+func (PriceHistory) TableName() string {
+	return "price_history"
+}
+
+// RatingLog tracks historical changes in a product's average rating and
+// review count, so rating manipulation around sales can be analyzed like
+// price history
+type RatingLog struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	ProductID        uint      `gorm:"index:idx_rating_log_product;not null" json:"product_id"` // Product whose rating changed
+	Source           string    `gorm:"index:idx_rating_log_product;not null;default:trendyol" json:"source"` // Marketplace of the product
+	OldAverage       float64   `json:"old_average"`       // Average rating before the change
+	NewAverage       float64   `json:"new_average"`       // Average rating after the change
+	OldCommentCount  int       `json:"old_comment_count"` // Review count before the change
+	NewCommentCount  int       `json:"new_comment_count"` // Review count after the change
+	ChangeTime       time.Time `gorm:"index" json:"change_time"` // When the change was detected
 }
 
 // User represents a registered user in the system
@@ -112,10 +150,16 @@ type User struct {
 	gorm.Model           // Includes ID, created_at, updated_at, deleted_at
 	Email       string    `gorm:"uniqueIndex;not null"` // Unique email address
 	Username    string    // Display name
-	Password    string    // Hashed password
+	Password    string    `json:"-"` // Hashed password; never sent in responses
 	Name        string    // Full name
 	IsActive    bool      `gorm:"default:true"` // Account status
 	LastLoginAt time.Time // Most recent login timestamp
+	UnlimitedFavorites bool `gorm:"default:false"` // Admin override exempting the user from FAVORITES_LIMIT
+	NotificationsSnoozedUntil *time.Time // Notifications are held back until this time; nil when not snoozed
+	DigestGroupByCollection   bool `gorm:"default:false"` // Add favorite price drops to the daily digest, grouped by collection
+	MinDealScore              *float64 `gorm:"type:decimal(4,1)"` // Only notify about price drops with at least this deal score; nil notifies about every drop
+	IsAdmin                   bool `gorm:"default:false"` // Login tokens of the user carry the admin claim and may act on every user's data
+	Verified                  bool `gorm:"not null;default:false"` // The user opened the verification link of POST /users; only verified users get price drop notifications
 }
 
 // Favorite represents a product favorited by a user (legacy model)
@@ -132,20 +176,317 @@ type UserFavorite struct {
 	gorm.Model           // Includes ID, created_at, updated_at, deleted_at
 	UserID    uint       `gorm:"index:idx_user_product,unique"` // Reference to the user
 	ProductID uint       `gorm:"index:idx_user_product,unique"` // Reference to the product
+	Source    string     `gorm:"index:idx_user_product,unique;not null;default:trendyol"` // Marketplace of the referenced product
 	AddedAt   time.Time  // When the product was favorited
+	PriceWhenAdded *float64 `gorm:"type:decimal(10,2)"` // Price at AddedAt, cached once resolved from the price history
+	CollectionID   *uint    `gorm:"index"`              // Collection the favorite is filed under; nil when uncategorized
+	Muted          bool     `gorm:"not null;default:false"` // No notifications about the product; its price history is still recorded
+	MutedUntil     *time.Time                           // When a mute ends by itself; nil mutes until unmuted
+	TargetPrice    *float64 `gorm:"type:decimal(10,2)"` // Only drops to this price or below notify; nil notifies about every drop
+	Note           string                               // The user's free-text note, e.g. "gift idea"
+	Tags           datatypes.JSON `gorm:"type:jsonb;not null;default:'[]';index:,type:gin"` // Lower-case string array the favorites list can be filtered by
+}
+
+// PasswordResetToken is a one-time token from POST /password-reset/request.
+// Only the token's SHA-256 is stored, so the table cannot be used to reset
+// passwords.
+type PasswordResetToken struct {
+	ID        uint       `gorm:"primaryKey"`
+	UserID    uint       `gorm:"index;not null"`       // User whose password the token resets
+	TokenHash string     `gorm:"uniqueIndex;not null"` // Hex SHA-256 of the token
+	ExpiresAt time.Time  `gorm:"not null"`             // The token is rejected from then on
+	UsedAt    *time.Time // When the token reset the password or was replaced; nil while usable
+	CreatedAt time.Time  // When the reset was requested
+}
+
+// FavoriteCollection is a user-defined folder for organizing favorites, such
+// as "Gifts". Deleting a collection leaves its favorites uncategorized.
+type FavoriteCollection struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index:idx_user_collection_name,unique;not null" json:"user_id"` // Owner of the collection
+	Name      string    `gorm:"index:idx_user_collection_name,unique;size:100;not null" json:"name"` // Unique per user
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SellerWatch represents a user following every product of a specific seller
+type SellerWatch struct {
+	gorm.Model           // Includes ID, created_at, updated_at, deleted_at
+	UserID    uint       `gorm:"index:idx_user_seller,unique"` // Reference to the user
+	SellerID  uint       `gorm:"index:idx_user_seller,unique"` // Trendyol merchant ID being watched
+}
+
+// BrandWatch represents a user subscribed to a brand's daily digest
+type BrandWatch struct {
+	gorm.Model           // Includes ID, created_at, updated_at, deleted_at
+	UserID    uint       `gorm:"index:idx_user_brand,unique"` // Reference to the user
+	BrandID   uint       `gorm:"index:idx_user_brand,unique"` // Trendyol brand ID being watched
+}
+
+// SchedulerState holds the operator controlled state of a background
+// scheduler. It lives in the database so pausing survives restarts and can be
+// changed through any service's API.
+type SchedulerState struct {
+	Name         string     `gorm:"primaryKey" json:"name"`  // Scheduler name, e.g. "favorites"
+	Paused       bool       `json:"paused"`                  // Whether scheduled runs are skipped
+	UpdatedAt    time.Time  `json:"updated_at"`              // When the state last changed
+	LastRunAt    *time.Time `json:"last_run_at"`             // When the scheduler last ran, nil if never
+	LastRunCount int        `json:"last_run_count"`          // Products handled by the last run
+}
+
+// SchedulerRun is one cycle of a scheduler: the products it considered and
+// what happened to each of them, so a stale price can be traced to the runs
+// that skipped or failed the product. Runs are kept for
+// SCHEDULER_RUN_RETENTION.
+type SchedulerRun struct {
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	Scheduler  string         `gorm:"index:idx_scheduler_runs_started,priority:1;not null" json:"scheduler"` // Scheduler name, e.g. "favorites"
+	StartedAt  time.Time      `gorm:"index:idx_scheduler_runs_started,priority:2" json:"started_at"`         // When the cycle started
+	FinishedAt time.Time      `json:"finished_at"`                                                           // When the cycle ended
+	Considered int            `json:"considered"`                                                            // Products picked for the cycle
+	Fetched    int            `json:"fetched"`                                                               // Products fetched
+	Skipped    int            `json:"skipped"`                                                               // Products skipped for the request budget
+	Failed     int            `json:"failed"`                                                                // Products that failed to fetch
+	Outcomes   datatypes.JSON `gorm:"type:jsonb" json:"outcomes"`                                            // Per-product outcomes, see crawler.SchedulerOutcome
+}
+
+// RequestBudget counts outbound requests to a marketplace per UTC day. It
+// lives in the database so the daily cap is shared by every service and
+// survives restarts.
+type RequestBudget struct {
+	Day       string    `gorm:"primaryKey;size:10" json:"day"`  // UTC day, e.g. "2024-01-31"
+	Source    string    `gorm:"primaryKey" json:"source"`       // Marketplace the requests went to
+	Requests  int       `gorm:"not null;default:0" json:"requests"` // Requests issued so far that day
+	UpdatedAt time.Time `json:"updated_at"`                     // When the counter last changed
+}
+
+// ReconciliationReport summarizes one nightly reconciliation run, which
+// refetches a sample of products and compares them with the stored rows to
+// catch upsert bugs
+type ReconciliationReport struct {
+	ID           uint           `gorm:"primaryKey" json:"id"`
+	Sampled      int            `json:"sampled"`              // Products selected for the run
+	Checked      int            `json:"checked"`              // Products refetched and compared
+	FetchFailed  int            `json:"fetch_failed"`         // Products that could not be refetched
+	Mismatched   int            `json:"mismatched"`           // Checked products that differ from the database
+	MismatchRate float64        `json:"mismatch_rate"`        // Mismatched / Checked, 0 when nothing was checked
+	Alerted      bool           `json:"alerted"`              // Whether the run raised a Slack alert
+	Mismatches   datatypes.JSON `gorm:"type:jsonb" json:"mismatches"` // Field differences of each mismatched product
+	StartedAt    time.Time      `gorm:"index" json:"started_at"` // When the run started
+	FinishedAt   time.Time      `json:"finished_at"`          // When the run finished
+}
+
+// CrawlReport summarizes one live crawl. The crawl loop updates it as it
+// goes, so a running crawl can be inspected.
+type CrawlReport struct {
+	ID                  uint           `gorm:"primaryKey" json:"id"`
+	CorrelationID       string         `json:"correlation_id"`                // Correlation ID of the crawl's Trendyol requests
+	Status              string         `gorm:"index" json:"status"`           // "running", "completed", "budget_exhausted", "cancelled" or "failed"
+	CategoriesAttempted int            `json:"categories_attempted"`          // Web categories the crawl started on
+	ProductsFetched     int            `json:"products_fetched"`              // Product details fetched and written
+	DetailFailures      int            `json:"detail_failures"`               // Product detail fetches that failed
+	ConversionFailures  int            `json:"conversion_failures"`           // Fetched details that did not convert into a product
+	Deduplicated        int            `json:"deduplicated"`                  // Products skipped because an earlier category listed them
+	BatchesPublished    int            `json:"batches_published"`             // Kafka batches published
+	BatchesFailed       int            `json:"batches_failed"`                // Kafka batches that could not be published
+	BytesWritten        int64          `json:"bytes_written"`                 // Bytes written to data.json
+	Error               string         `json:"error,omitempty"`               // Why a failed crawl stopped
+	Categories          datatypes.JSON `gorm:"type:jsonb" json:"categories,omitempty"` // Per-category breakdown
+	StartedAt           time.Time      `gorm:"index" json:"started_at"`       // When the crawl started
+	FinishedAt          *time.Time     `json:"finished_at"`                   // When the crawl ended, null while running
+	UpdatedAt           time.Time      `json:"updated_at"`                    // Last progress update
+}
+
+// PendingNotification is a price drop notification that did not fit into the
+// favorites service's send queue. The queue drains these rows, oldest first,
+// once it has room again.
+type PendingNotification struct {
+	ID        uint64    `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null"` // User to notify
+	Event     []byte    `gorm:"not null"` // The price_change event, a JSON-encoded events.PriceChange
+	Message   string    // Notification text
+	CreatedAt time.Time // When the notification was spilled
+}
+
+// FanOutCheckpoint records how far the favorites service got notifying the
+// watchers of a price change, page by page in user ID order, so a redelivered
+// event resumes after the last completed page instead of notifying everyone
+// again. The event is identified by the Kafka message it was read from.
+type FanOutCheckpoint struct {
+	Topic       string     `gorm:"primaryKey"`                     // Topic of the price_change event
+	Partition   int32      `gorm:"primaryKey;autoIncrement:false"` // Partition of the event
+	Offset      int64      `gorm:"primaryKey;autoIncrement:false"` // Offset of the event in its partition
+	ProductID   uint       `gorm:"not null"`                       // Product whose price changed
+	Source      string     `gorm:"not null"`                       // Marketplace of the product
+	LastUserID  uint       // Watchers up to this user ID are done
+	Watchers    int        // Watchers paged through so far
+	Queued      int        // Notifications queued so far
+	Overflow    int        // Watchers left out because the fan-out hit NOTIFICATION_MAX_FANOUT
+	CompletedAt *time.Time `gorm:"index"` // When the last page was done; nil while in progress
+	CreatedAt   time.Time  // When the fan-out started
+	UpdatedAt   time.Time  // When the last page was done
+}
+
+// OutboxEvent is a Kafka message written in the same transaction as the data
+// change it announces, so the change and the event are stored together or
+// not at all. The outbox relay publishes pending events in ID order and marks
+// them delivered.
+type OutboxEvent struct {
+	ID          uint64     `gorm:"primaryKey"`
+	Topic       string     `gorm:"not null"` // Kafka topic
+	Key         string     `gorm:"index"`    // Message key; events with the same key are published in order
+	Payload     []byte     `gorm:"not null"` // Message value
+	Attempts    int        // Failed publish attempts
+	LastError   string     // Error of the last failed attempt
+	CreatedAt   time.Time  // When the event was written
+	DeliveredAt *time.Time // When Kafka acknowledged the event, null while pending
+}
+
+// TableName stores outbox events in the outbox table.
+func (OutboxEvent) TableName() string {
+	return "outbox"
+}
+
+// SuppressedNotification is a notification held back while its user had
+// notifications snoozed. The rows are summarized in one email once the snooze
+// ends and then deleted.
+type SuppressedNotification struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"` // User the notification was for
+	ProductID uint      // Product the notification is about
+	Source    string    `gorm:"not null;default:trendyol"` // Marketplace of the product
+	Type      string    // Notification type, e.g. "price_drop" or "discontinued"
+	OldPrice  float64   `gorm:"type:decimal(10,2)"` // Price before the drop, 0 for other types
+	NewPrice  float64   `gorm:"type:decimal(10,2)"` // Price after the drop, 0 for other types
+	CreatedAt time.Time // When the notification was suppressed
+}
+
+// NotificationHistory records notifications that must reach a user at most
+// once per product, such as "discontinued". The unique index is what enforces
+// the guarantee: the notification service claims a row before sending.
+type NotificationHistory struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index:idx_notification_once,unique"` // Notified user
+	ProductID uint      `gorm:"index:idx_notification_once,unique"` // Product the notification is about
+	Source    string    `gorm:"index:idx_notification_once,unique;not null;default:trendyol"` // Marketplace of the product
+	Type      string    `gorm:"index:idx_notification_once,unique"` // Notification type, e.g. "discontinued"
+	SentAt    time.Time // When the notification was claimed for sending
+}
+
+// NotificationLog records every outgoing email with the outcome of its
+// delivery, including the ones a dry run kept from leaving the system
+type NotificationLog struct {
+	ID        uint      `gorm:"primaryKey"`
+	Recipient string    `gorm:"index"` // Email address
+	Subject   string    // Email subject
+	Status    string    `gorm:"index"` // "sent", "failed" or "dry_run"
+	Error     string    // Delivery error of failed notifications
+	CreatedAt time.Time `gorm:"index"` // When delivery was attempted
+	NotificationID string     `gorm:"index"` // ID carried by the email's links; empty for emails sent before links were tracked
+	Clicks         int        `gorm:"not null;default:0"` // Attributed clicks on the email's links
+	FirstClickedAt *time.Time // First attributed click
+	LastClickedAt  *time.Time // Latest attributed click
+}
+
+// ProductRelisting records an inactive product that the weekly relisting
+// check found listed and in stock again
+type ProductRelisting struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	ProductID     uint       `gorm:"index:idx_relisting_product" json:"product_id"`                       // Relisted product
+	Source        string     `gorm:"index:idx_relisting_product;not null;default:trendyol" json:"source"` // Marketplace of the product
+	InactiveSince *time.Time `json:"inactive_since"`                                                      // DiscontinuedAt before the check; nil if the product was only out of stock
+	Price         float64    `gorm:"type:decimal(10,2)" json:"price"`                                     // Price the product came back at
+	CreatedAt     time.Time  `gorm:"index" json:"created_at"`                                             // When the check found the product again
+}
+
+// PriceDropStat is one brand or seller of the price drop leaderboard. The
+// crawler's price drop stats job replaces the rows of a grouping and window
+// (period) on every run, so GET /stats/price-drops reads them instead of scanning
+// price_stock_logs.
+type PriceDropStat struct {
+	ID             uint    `gorm:"primaryKey"`
+	GroupBy        string  `gorm:"not null;index:idx_price_drop_stats_group,priority:1"` // "brand" or "seller"
+	Period         string  `gorm:"not null;index:idx_price_drop_stats_group,priority:2"` // Window the drops were counted in, e.g. "24h"
+	GroupID        uint    `gorm:"not null"`                                             // Brand or seller ID
+	Name           string  // Brand or seller name of one of its products
+	Drops          int     `gorm:"not null;index"` // Price drops in the window
+	Products       int     `gorm:"not null"`       // Distinct products that dropped
+	AvgDropPercent float64 `gorm:"not null"`       // Mean drop in percent of the old price
+	MaxDropPercent float64 `gorm:"not null"`       // Largest drop in percent of the old price
+}
+
+// PriceDropStatsRun records when the price drop leaderboard of a grouping and
+// window was last computed, also when no group had a drop.
+type PriceDropStatsRun struct {
+	GroupBy    string    `gorm:"primaryKey"` // "brand" or "seller"
+	Period     string    `gorm:"primaryKey"` // Window the drops were counted in, e.g. "24h"
+	Groups     int       // Groups with at least one drop
+	ComputedAt time.Time `gorm:"not null"` // When the rows were computed
+}
+
+// BrandEvent records a new arrival or notable price drop for a watched brand.
+// Events are collected by the analysis service and summarized in the daily digest.
+type BrandEvent struct {
+	gorm.Model           // Includes ID, created_at, updated_at, deleted_at
+	BrandID   uint       `gorm:"index"` // Brand the product belongs to
+	ProductID uint       `gorm:"index"` // Product the event is about
+	Type      string     // "new_arrival" or "price_drop"
+	OldPrice  float64    `gorm:"type:decimal(10,2)"` // Price before a drop (zero for arrivals)
+	NewPrice  float64    `gorm:"type:decimal(10,2)"` // Current price
+}
+
+// IngestSubmission is a product payload accepted by POST /ingest/product,
+// keyed by the hash of its content, so a payload submitted again within
+// INGEST_DEDUP_WINDOW is not stored twice. Rows older than the window are
+// removed.
+type IngestSubmission struct {
+	ContentHash string    `gorm:"primaryKey;size:64"` // Hex SHA-256 of the compacted payload
+	ProductID   uint      `gorm:"not null"`           // Product the payload described
+	Source      string    `gorm:"not null"`           // Marketplace of the product
+	CreatedAt   time.Time `gorm:"index"`              // When the payload was accepted
+}
+
+// IngestError is a payload POST /ingest/product rejected as malformed, kept
+// so operators can see what the browser extension sends. Rows are kept for
+// INGEST_ERROR_RETENTION.
+type IngestError struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	ContentHash string    `gorm:"index;size:64;not null" json:"content_hash"` // Hex SHA-256 of the payload as received
+	KeyID       string    `json:"key_id"`                                     // ID of the API key that submitted it
+	UserID      *uint     `json:"user_id"`                                    // User the product was to be favorited for, if any
+	Error       string    `gorm:"not null" json:"error"`                      // Why the payload was rejected
+	Payload     string    `gorm:"type:text" json:"payload"`                   // The payload as received
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`                    // When the payload was rejected
+}
+
+// FetchRetry records a product whose detail request failed with a transient
+// error so it can be retried with backoff instead of waiting for the next crawl
+type FetchRetry struct {
+	gorm.Model              // Includes ID, created_at, updated_at, deleted_at
+	ProductID     uint      `gorm:"index:idx_fetch_retry_product,unique"` // Product that failed to fetch
+	ProductSource string    `gorm:"index:idx_fetch_retry_product,unique;not null;default:trendyol"` // Marketplace of the product
+	Source        string    // Where the failure happened: "crawl" or "scheduler"
+	Error         string    // Last error message
+	Attempts      int       // Number of failed attempts so far
+	StatusCode    int       // HTTP status of the last failure, 0 if no response was received
+	Status        string    `gorm:"index"` // "pending" or "failed" once the attempt cap is reached
+	NextAttemptAt time.Time `gorm:"index"` // Earliest time of the next retry
 }
 
 // Product represents a detailed product listing with various attributes
 // Product represents a detailed product listing with various attributes stored in our database
 type Product struct {
 	gorm.Model           // Includes ID, created_at, updated_at, deleted_at
-	ID                 uint           `gorm:"primaryKey"`       // Unique product identifier
+	ID                 uint           `gorm:"primaryKey;autoIncrement:false"` // Product identifier within its source
+	Source             string         `gorm:"primaryKey;default:trendyol"`    // Marketplace the product was crawled from
 	CategoryPath       string                                  // Full category hierarchy path
 	Name               string                                  // Product name/title
 	Images             datatypes.JSON `gorm:"type:jsonb"`     // Product images in different sizes
 	Video              string                                  // Product video URL if available
 	Seller             datatypes.JSON `gorm:"type:jsonb"`     // Seller/merchant information
+	SellerID           uint           `gorm:"index"`          // Trendyol merchant ID of the winning listing
 	Brand              datatypes.JSON `gorm:"type:jsonb"`     // Brand details
+	BrandID            uint           `gorm:"index"`          // Trendyol brand ID
 	RatingScore        datatypes.JSON `gorm:"type:jsonb"`     // Product rating statistics
 	FavoritesCount     string                                  // Number of users who favorited
 	CommentsCount      string                                  // Number of user reviews
@@ -162,7 +503,16 @@ type Product struct {
 	OtherSellers       datatypes.JSON `gorm:"type:jsonb"`     // Other merchants selling same product
 	IsActive           bool           `gorm:"default:true"`   // Product availability status
 	IsFavorite         bool           `gorm:"default:false"` // Whether product is favorited
+	LocalFavoritesCount int           `gorm:"not null;default:0"` // Users of this service who favorited the product; kept in step with user_favorites
 	Price              float64        `gorm:"type:decimal(10,2)"` // Current price
+	DealScore          *float64       `gorm:"type:decimal(4,1);index"` // Percentile of the price in its trailing history (0-100, higher is cheaper); nil for sparse history
+	LastSeenAt         *time.Time                              // Last time the product was seen in a crawl
+	DiscontinuedAt     *time.Time                              // When the last-seen job marked the product discontinued; cleared on reactivation
+	MergedInto         *uint                                   // Product of the same source this duplicate was merged into; set on soft-deleted products only
+	RefreshBoost       bool           `gorm:"not null;default:false"` // Set by an operator to refresh the product first in the favorites scheduler
+	PayloadTruncated   bool           `gorm:"not null;default:false"` // A JSONB field was over its size limit and shortened when the product was last converted
+	FetchedAt          *time.Time     `gorm:"-"`              // When this copy was fetched from Trendyol; carried in messages only
+	UpdatedFields      []string       `gorm:"-" json:",omitempty"` // Fields a partial update carries, e.g. ["Price", "PriceInfo"]; carried in messages only, empty for full products
 }
 
 // TrendyolResponse represents the raw API response from Trendyol's product detail endpoint
@@ -217,12 +567,14 @@ type TrendyolResponse struct {
 		} `json:"stock"`
 	} `json:"winnerVariant"`
 
-	// Best merchant information
+	// Best merchant information and its delivery window
 	WinnerMerchantListing struct {
 		Merchant struct {
 			ID   int    `json:"id"`   // Merchant identifier
 			Name string `json:"name"` // Merchant name
 		} `json:"merchant"`
+		DeliveryEndDate   string `json:"deliveryEndDate"`   // Latest delivery date
+		DeliveryStartDate string `json:"deliveryStartDate"` // Earliest delivery date
 	} `json:"winnerMerchantListing"`
 
 	// Product images in different sizes
@@ -245,12 +597,6 @@ type TrendyolResponse struct {
 		TaxOffice              string `json:"taxOffice"`              // Tax office
 	} `json:"sellerInfo"`
 
-	// Delivery information
-	Delivery struct {
-		DeliveryEndDate   string `json:"deliveryEndDate"`   // Latest delivery date
-		DeliveryStartDate string `json:"deliveryStartDate"` // Earliest delivery date
-	} `json:"winnerMerchantListing"` // Note: This tag appears to be incorrect, should be "delivery"
-
 	// Product specifications
 	Attributes []struct {
 		Key   string `json:"key"`   // Attribute name
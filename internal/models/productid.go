@@ -0,0 +1,43 @@
+// Package models validates product IDs at the API boundaries
+package models
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MaxProductID is the largest product ID. Trendyol IDs exceed 32 bits, so
+// product IDs are 64-bit everywhere: uint and int in Go, uint64 in the gRPC
+// messages and bigint in the database, which is signed.
+const MaxProductID = math.MaxInt64
+
+// Product IDs are held in uint and int, which must be 64 bits wide; these
+// fail to compile on 32-bit platforms
+const (
+	_ uint = MaxProductID
+	_ int  = MaxProductID
+)
+
+// ErrInvalidProductID is returned for a product ID outside 1 to MaxProductID
+var ErrInvalidProductID = errors.New("product ID must be between 1 and 9223372036854775807")
+
+// ValidProductID reports whether id is a storable product ID.
+func ValidProductID(id uint64) bool {
+	return id > 0 && id <= MaxProductID
+}
+
+// ParseProductID parses a product ID from a path or query parameter,
+// ignoring surrounding whitespace.
+//
+// Returns:
+//   - uint: The product ID
+//   - error: ErrInvalidProductID if s is not a number from 1 to MaxProductID
+func ParseProductID(s string) (uint, error) {
+	id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil || !ValidProductID(id) {
+		return 0, ErrInvalidProductID
+	}
+	return uint(id), nil
+}
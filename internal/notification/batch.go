@@ -0,0 +1,140 @@
+// Package notification implements the notification service for sending price drop alerts to users
+package notification
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"scraper/internal/proto"
+)
+
+var (
+	// errInvalidUserID is returned when a request carries a non-numeric user ID
+	errInvalidUserID = errors.New("invalid user ID")
+	// errPasswordNotConfigured is returned when SMTP credentials are missing
+	errPasswordNotConfigured = errors.New("email password not configured")
+	// errUserNotVerified is returned when a price drop is addressed to a user
+	// who has not verified their email address
+	errUserNotVerified = errors.New("user email address not verified")
+)
+
+// sendLimiter is shared by every notification path so the unary and batch
+// RPCs together never exceed the configured SMTP send rate. It is created on
+// first use so configuration has been loaded by then.
+//
+// Environment Variables:
+//   - NOTIFICATION_RATE_PER_SECOND: Maximum emails sent per second (default: 5)
+var (
+	sendLimiterOnce sync.Once
+	sendLimiterInst *rateLimiter
+)
+
+// sendLimiter returns the process-wide notification rate limiter.
+func sendLimiter() *rateLimiter {
+	sendLimiterOnce.Do(func() {
+		sendLimiterInst = newRateLimiter(viper.GetInt("NOTIFICATION_RATE_PER_SECOND"))
+	})
+	return sendLimiterInst
+}
+
+// rateLimiter is a minimal token dispenser allowing at most perSecond
+// operations per second. A zero or negative rate disables limiting.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter creates a limiter for the given number of operations per second.
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		perSecond = 5 // Default send rate
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// Wait blocks until the caller is allowed to perform one operation.
+func (l *rateLimiter) Wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// SendNotifications implements the batch gRPC endpoint. Items are delivered
+// concurrently by a bounded pool of workers that share the global send rate
+// limiter, and one result is returned per item in request order.
+//
+// Environment Variables:
+//   - NOTIFICATION_BATCH_CONCURRENCY: Number of concurrent senders (default: 4)
+//
+// Parameters:
+//   - ctx: Request context; cancelled items are reported as failures
+//   - in: Batch of notification requests
+//
+// Returns:
+//   - *proto.BatchNotificationResponse: Per-item success/failure
+//   - error: Always nil; failures are reported per item
+func (s *NotificationServer) SendNotifications(ctx context.Context, in *proto.BatchNotificationRequest) (*proto.BatchNotificationResponse, error) {
+	logrus.WithField("count", len(in.Items)).Info("Received batch notification request")
+
+	concurrency := viper.GetInt("NOTIFICATION_BATCH_CONCURRENCY")
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	results := make([]*proto.NotificationResult, len(in.Items))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, item := range in.Items {
+		result := &proto.NotificationResult{Index: int32(i)}
+		results[i] = result
+
+		// Stop scheduling new work once the caller has gone away
+		if err := ctx.Err(); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item *proto.NotificationRequest, result *proto.NotificationResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := s.deliver(item); err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.Success = true
+		}(item, result)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if !r.Success {
+			failed++
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"count":  len(in.Items),
+		"failed": failed,
+	}).Info("Processed batch notification request")
+
+	return &proto.BatchNotificationResponse{Results: results}, nil
+}
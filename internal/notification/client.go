@@ -0,0 +1,128 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"scraper/internal/proto"
+)
+
+// reachableTimeout is how long a client waits at startup for the
+// notification service before reporting it unreachable
+const reachableTimeout = 5 * time.Second
+
+// GRPCPort returns the port the notification gRPC server binds to.
+//
+// Environment Variables:
+//   - NOTIFICATION_GRPC_PORT: gRPC bind port (default: 8083)
+func GRPCPort() string {
+	if port := viper.GetString("NOTIFICATION_GRPC_PORT"); port != "" {
+		return port
+	}
+	return "8083"
+}
+
+// GRPCAddr returns the address clients use to reach the notification service.
+//
+// Environment Variables:
+//   - NOTIFICATION_GRPC_ADDR: host:port of the notification gRPC server
+//     (default: localhost:$NOTIFICATION_GRPC_PORT)
+func GRPCAddr() string {
+	if addr := viper.GetString("NOTIFICATION_GRPC_ADDR"); addr != "" {
+		return addr
+	}
+	return "localhost:" + GRPCPort()
+}
+
+// Dial creates a long-lived client for the notification service. The
+// connection is established lazily and re-established by gRPC after failures;
+// a background goroutine logs a startup error when the service is not
+// reachable and logs again once it becomes available.
+//
+// Parameters:
+//   - caller: Name of the calling service for logging
+//
+// Returns:
+//   - proto.NotificationServiceClient: Client sharing a single connection
+//   - error: If the target address is invalid
+func Dial(caller string) (proto.NotificationServiceClient, error) {
+	addr := GRPCAddr()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification service address %q: %w", addr, err)
+	}
+
+	go watchConnection(conn, caller, addr)
+	return proto.NewNotificationServiceClient(conn), nil
+}
+
+// WaitReachable blocks until the notification service at GRPCAddr accepts
+// connections or the timeout expires. It is used when the service runs in
+// another process, where there is no in-process Ready channel to wait on;
+// gRPC keeps retrying the connection with backoff until then.
+//
+// Parameters:
+//   - timeout: How long to keep retrying
+//
+// Returns:
+//   - error: If the address is invalid or the service stayed unreachable
+func WaitReachable(timeout time.Duration) error {
+	addr := GRPCAddr()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("invalid notification service address %q: %w", addr, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if !waitReady(ctx, conn) {
+		return fmt.Errorf("notification service at %s unreachable after %s", addr, timeout)
+	}
+	return nil
+}
+
+// watchConnection triggers the first connection attempt and reports whether
+// the notification service is reachable. gRPC keeps retrying with backoff in
+// the background; this only logs the transitions.
+func watchConnection(conn *grpc.ClientConn, caller, addr string) {
+	fields := logrus.Fields{"service": caller, "target": addr}
+	conn.Connect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reachableTimeout)
+	defer cancel()
+	if waitReady(ctx, conn) {
+		logrus.WithFields(fields).Info("Connected to notification service")
+		return
+	}
+	logrus.WithFields(fields).Error("Notification service unreachable, retrying in background")
+
+	if waitReady(context.Background(), conn) {
+		logrus.WithFields(fields).Info("Notification service became reachable")
+	}
+}
+
+// waitReady blocks until the connection is ready or ctx is done.
+func waitReady(ctx context.Context, conn *grpc.ClientConn) bool {
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return true
+		case connectivity.Idle:
+			conn.Connect()
+		case connectivity.Shutdown:
+			return false
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return false
+		}
+	}
+}
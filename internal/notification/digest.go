@@ -0,0 +1,348 @@
+// Package notification implements the daily digest email job
+package notification
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/deeplink"
+	"scraper/internal/models"
+)
+
+// digestItem is a single product line in the digest email
+type digestItem struct {
+	ProductID   uint
+	Source      string
+	ProductName string
+	OldPrice    float64
+	NewPrice    float64
+}
+
+// collectionGroup is the favorite price drops of one collection in the digest
+type collectionGroup struct {
+	Name  string       // Collection name, "Uncategorized" for favorites outside any
+	Drops []digestItem // Price drops on the collection's favorites
+}
+
+// uncategorizedName labels favorites outside any collection in the digest
+const uncategorizedName = "Uncategorized"
+
+// startDigestJob schedules the daily digest email. Each run emails every user
+// with brand watches a summary of the last 24 hours:
+//   - Brand arrivals: products newly ingested for watched brands
+//   - Brand price drops: notable drops on watched brands' products, excluding
+//     products the user has favorited since those already triggered an alert
+//
+// Users who turned on the digest's group_by_collection preference also get
+// the price drops on their favorites, grouped by collection.
+//
+// Environment Variables:
+//   - DIGEST_CRON: Cron expression for the digest (default: 0 8 * * *)
+//
+// Parameters:
+//   - db: Database connection
+//   - emailService: Service used to send the digest emails
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startDigestJob(db *gorm.DB, emailService *EmailService) *cron.Cron {
+	spec := viper.GetString("DIGEST_CRON")
+	if spec == "" {
+		spec = "0 8 * * *" // Every day at 08:00
+	}
+
+	c := cron.New()
+	if _, err := c.AddFunc(spec, func() {
+		runDigest(db, emailService, time.Now().Add(-24*time.Hour))
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid digest cron expression")
+	}
+	c.Start()
+
+	logrus.WithField("schedule", spec).Info("Digest job scheduled")
+	return c
+}
+
+// runDigest sends the digest for all events created after since.
+//
+// Parameters:
+//   - db: Database connection
+//   - emailService: Service used to send the digest emails
+//   - since: Start of the digest window
+func runDigest(db *gorm.DB, emailService *EmailService, since time.Time) {
+	var userIDs []uint
+	err := db.Raw(`SELECT user_id FROM brand_watches WHERE deleted_at IS NULL
+		UNION SELECT id FROM users WHERE digest_group_by_collection AND deleted_at IS NULL`).
+		Scan(&userIDs).Error
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load digest recipients")
+		return
+	}
+	var grouped []uint
+	if err := db.Model(&models.User{}).Where("digest_group_by_collection = ?", true).Pluck("id", &grouped).Error; err != nil {
+		logrus.WithError(err).Error("Failed to load digest preferences")
+		return
+	}
+	groupByCollection := make(map[uint]bool, len(grouped))
+	for _, id := range grouped {
+		groupByCollection[id] = true
+	}
+
+	sent := 0
+	for _, userID := range userIDs {
+		arrivals, drops, err := brandDigestItems(db, userID, since)
+		if err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to build brand digest")
+			continue
+		}
+		var groups []collectionGroup
+		if groupByCollection[userID] {
+			if groups, err = favoriteDigestGroups(db, userID, since); err != nil {
+				logrus.WithError(err).WithField("user_id", userID).Error("Failed to build favorites digest")
+				continue
+			}
+		}
+		if len(arrivals) == 0 && len(drops) == 0 && len(groups) == 0 {
+			continue
+		}
+		// Snoozed users get the brand drops in their summary instead; arrivals
+		// are only interesting on the day they happen, and favorite drops were
+		// already held back when they happened
+		if until, err := snoozedUntil(db, userID); err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to check notification snooze")
+		} else if until != nil {
+			holdBackDigestDrops(db, userID, drops)
+			continue
+		}
+		if err := emailService.SendDigest(userID, arrivals, drops, groups); err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to send digest")
+			continue
+		}
+		sent++
+	}
+
+	logrus.WithFields(logrus.Fields{"recipients": len(userIDs), "sent": sent}).Info("Digest run completed")
+}
+
+// holdBackDigestDrops stores a snoozed user's brand price drops for the
+// missed notifications summary.
+func holdBackDigestDrops(db *gorm.DB, userID uint, drops []digestItem) {
+	if len(drops) == 0 {
+		return
+	}
+	missed := make([]models.SuppressedNotification, 0, len(drops))
+	for _, drop := range drops {
+		missed = append(missed, models.SuppressedNotification{
+			UserID:    userID,
+			ProductID: drop.ProductID,
+			Source:    models.SourceTrendyol,
+			Type:      missedTypeBrandPriceDrop,
+			OldPrice:  drop.OldPrice,
+			NewPrice:  drop.NewPrice,
+		})
+	}
+	if err := db.Create(&missed).Error; err != nil {
+		logrus.WithError(err).WithField("user_id", userID).Error("Failed to hold back digest drops")
+	}
+}
+
+// favoriteDigestGroups collects the latest price drop of each of a user's
+// favorites since the start of the window, grouped by collection. Groups are
+// sorted by name with uncategorized favorites last.
+//
+// Returns:
+//   - []collectionGroup: Collections with at least one drop
+//   - error: Any database error
+func favoriteDigestGroups(db *gorm.DB, userID uint, since time.Time) ([]collectionGroup, error) {
+	var rows []struct {
+		ProductID      uint
+		Source         string
+		Name           string
+		OldPrice       string
+		NewPrice       string
+		CollectionName *string
+	}
+	err := db.Raw(`SELECT DISTINCT ON (f.id) f.product_id, f.source, p.name, l.old_price, l.new_price, c.name AS collection_name
+		FROM user_favorites f
+		JOIN price_stock_logs l ON l.product_id = f.product_id AND l.source = f.source AND l.change_time >= ? AND l.deleted_at IS NULL
+		JOIN products p ON p.id = f.product_id AND p.source = f.source
+		LEFT JOIN favorite_collections c ON c.id = f.collection_id
+		WHERE f.user_id = ? AND f.deleted_at IS NULL
+		ORDER BY f.id, l.change_time DESC`, since, userID).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*collectionGroup)
+	for _, row := range rows {
+		oldPrice, errOld := strconv.ParseFloat(row.OldPrice, 64)
+		newPrice, errNew := strconv.ParseFloat(row.NewPrice, 64)
+		if errOld != nil || errNew != nil || newPrice >= oldPrice {
+			continue
+		}
+		name := uncategorizedName
+		if row.CollectionName != nil {
+			name = *row.CollectionName
+		}
+		group, ok := byName[name]
+		if !ok {
+			group = &collectionGroup{Name: name}
+			byName[name] = group
+		}
+		group.Drops = append(group.Drops, digestItem{ProductID: row.ProductID, Source: row.Source, ProductName: row.Name, OldPrice: oldPrice, NewPrice: newPrice})
+	}
+
+	groups := make([]collectionGroup, 0, len(byName))
+	for _, group := range byName {
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if (groups[i].Name == uncategorizedName) != (groups[j].Name == uncategorizedName) {
+			return groups[j].Name == uncategorizedName
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+// brandDigestItems collects the brand arrivals and price drops for a user.
+// Only the latest event per product and type is kept.
+//
+// Returns:
+//   - []digestItem: New arrivals
+//   - []digestItem: Price drops on products the user has not favorited
+//   - error: Any database error
+func brandDigestItems(db *gorm.DB, userID uint, since time.Time) ([]digestItem, []digestItem, error) {
+	var rows []struct {
+		ProductID uint
+		Name      string
+		Type      string
+		OldPrice  float64
+		NewPrice  float64
+	}
+	err := db.Table("brand_events").
+		Select("brand_events.product_id, products.name, brand_events.type, brand_events.old_price, brand_events.new_price").
+		Joins("JOIN brand_watches ON brand_watches.brand_id = brand_events.brand_id AND brand_watches.user_id = ? AND brand_watches.deleted_at IS NULL", userID).
+		Joins("JOIN products ON products.id = brand_events.product_id AND products.source = ?", models.SourceTrendyol). // Brand IDs are Trendyol's
+		Where("brand_events.created_at >= ? AND brand_events.deleted_at IS NULL", since).
+		Order("brand_events.created_at DESC").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Products the user already gets direct alerts for
+	var favoriteIDs []uint
+	if err := db.Model(&models.UserFavorite{}).Where("user_id = ?", userID).Pluck("product_id", &favoriteIDs).Error; err != nil {
+		return nil, nil, err
+	}
+	favorited := make(map[uint]bool, len(favoriteIDs))
+	for _, id := range favoriteIDs {
+		favorited[id] = true
+	}
+
+	var arrivals, drops []digestItem
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		key := fmt.Sprintf("%s:%d", row.Type, row.ProductID)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		item := digestItem{ProductID: row.ProductID, Source: models.SourceTrendyol, ProductName: row.Name, OldPrice: row.OldPrice, NewPrice: row.NewPrice}
+		switch row.Type {
+		case "new_arrival":
+			arrivals = append(arrivals, item)
+		case "price_drop":
+			if !favorited[row.ProductID] {
+				drops = append(drops, item)
+			}
+		}
+	}
+	return arrivals, drops, nil
+}
+
+// SendDigest emails a user their daily digest.
+//
+// Parameters:
+//   - userID: ID of the user to notify
+//   - arrivals: New arrivals from watched brands
+//   - drops: Notable price drops from watched brands
+//   - groups: Favorite price drops by collection; empty unless the user
+//     asked for them
+//
+// Returns:
+//   - error: Any error that occurred while rendering or sending the email
+func (es *EmailService) SendDigest(userID uint, arrivals, drops []digestItem, groups []collectionGroup) error {
+	// Retrieve user information
+	var user models.User
+	if err := es.db.First(&user, userID).Error; err != nil {
+		return fmt.Errorf("failed to find user: %w", err)
+	}
+
+	// HTML email template with styling
+	tmpl := `
+	<html>
+	<body style="font-family: Arial, sans-serif; color: #333; line-height: 1.6;">
+		<div style="max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #eee; border-radius: 10px;">
+			<h2 style="color: #e91e63; margin-bottom: 20px;">Your Daily Digest</h2>
+			<p>Hi <b>{{.UserName}}</b>, here is what happened in the last day:</p>
+			{{if .Arrivals}}
+			<h3>Brand Arrivals</h3>
+			<ul>
+				{{range .Arrivals}}<li><a href="{{productLink .ProductID .Source}}">{{.ProductName}}</a> &mdash; {{printf "%.2f" .NewPrice}}</li>{{end}}
+			</ul>
+			{{end}}
+			{{if .Drops}}
+			<h3>Brand Price Drops</h3>
+			<ul>
+				{{range .Drops}}<li><a href="{{productLink .ProductID .Source}}">{{.ProductName}}</a> &mdash; <span style="text-decoration: line-through;">{{printf "%.2f" .OldPrice}}</span> <b style="color: #e91e63;">{{printf "%.2f" .NewPrice}}</b></li>{{end}}
+			</ul>
+			{{end}}
+			{{range .Groups}}
+			<h3>Your Favorites: {{.Name}}</h3>
+			<ul>
+				{{range .Drops}}<li><a href="{{productLink .ProductID .Source}}">{{.ProductName}}</a> &mdash; <span style="text-decoration: line-through;">{{printf "%.2f" .OldPrice}}</span> <b style="color: #e91e63;">{{printf "%.2f" .NewPrice}}</b></li>{{end}}
+			</ul>
+			{{end}}
+			<p style="margin-top: 30px; font-size: 0.9em; color: #777;">
+				This digest was sent because you follow brands or asked for your favorites by collection.
+				<br>Happy Shopping!
+			</p>
+		</div>
+	</body>
+	</html>`
+
+	notificationID := deeplink.NewNotificationID()
+	t, err := template.New("digestEmail").Funcs(es.productLinks(notificationID, userID)).Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to parse email template: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		UserName string
+		Arrivals []digestItem
+		Drops    []digestItem
+		Groups   []collectionGroup
+	}{
+		UserName: user.Name,
+		Arrivals: arrivals,
+		Drops:    drops,
+		Groups:   groups,
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	return es.SendMail(user.Email, buf.String(), "Your daily digest", notificationID)
+}
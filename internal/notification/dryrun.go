@@ -0,0 +1,102 @@
+// Package notification implements the dry-run mode that keeps notifications
+// from reaching real recipients outside production
+package notification
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+// Delivery statuses recorded in models.NotificationLog
+const (
+	deliverySent   = "sent"
+	deliveryFailed = "failed"
+	deliveryDryRun = "dry_run"
+)
+
+// DryRun reports whether notifications are kept from leaving the system.
+//
+// Environment Variables:
+//   - NOTIFICATIONS_DRY_RUN: Render and record notifications without sending
+//     them, except to allowlisted recipients (default: false)
+func DryRun() bool {
+	return viper.GetBool("NOTIFICATIONS_DRY_RUN")
+}
+
+// allowlisted reports whether an address may receive real notifications in
+// dry-run mode. Entries containing "@" followed by a local part match that
+// address; other entries, with or without a leading "@", match every address
+// of the domain. Matching ignores case.
+//
+// Environment Variables:
+//   - NOTIFICATIONS_ALLOWLIST: Comma-separated addresses and domains, e.g.
+//     "qa@example.com,@tester.example.com"
+//
+// Parameters:
+//   - address: Recipient email address
+//
+// Returns:
+//   - bool: True if the address is allowlisted
+func allowlisted(address string) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return false
+	}
+	domain := address[at+1:]
+
+	for _, entry := range strings.Split(viper.GetString("NOTIFICATIONS_ALLOWLIST"), ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.Index(entry, "@") > 0:
+			if entry == address {
+				return true
+			}
+		case strings.TrimPrefix(entry, "@") == domain:
+			return true
+		}
+	}
+	return false
+}
+
+// HoldBackInDryRun reports whether an email to address must not be sent:
+// dry-run mode is on and the address is not allowlisted.
+//
+// Parameters:
+//   - address: Recipient email address
+//
+// Returns:
+//   - bool: True if the email is only rendered and recorded
+func HoldBackInDryRun(address string) bool {
+	return DryRun() && !allowlisted(address)
+}
+
+// recordDelivery stores the outcome of an email in the notification log.
+// Logging failures are only reported, they never fail the notification.
+//
+// Parameters:
+//   - db: Database connection, nothing is recorded if nil
+//   - to: Recipient address
+//   - subject: Email subject
+//   - notificationID: ID carried by the email's links
+//   - status: deliverySent, deliveryFailed or deliveryDryRun
+//   - sendErr: Delivery error of failed emails
+func recordDelivery(db *gorm.DB, to, subject, notificationID, status string, sendErr error) {
+	if db == nil {
+		return
+	}
+	entry := models.NotificationLog{NotificationID: notificationID, Recipient: to, Subject: subject, Status: status}
+	if sendErr != nil {
+		entry.Error = sendErr.Error()
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		logrus.WithError(err).WithField("to", to).Error("Failed to record notification delivery")
+	}
+}
@@ -6,26 +6,39 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/smtp"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/gorm"
 
+	"scraper/internal/deeplink"
+	"scraper/internal/emailaddr"
+	"scraper/internal/faults"
+	"scraper/internal/metrics"
 	"scraper/internal/models"
+	"scraper/internal/pricealert"
+	"scraper/internal/productdiff"
 	"scraper/internal/proto"
 )
 
 // EmailService handles sending email notifications to users.
 // It requires a database connection to look up user and product information.
 type EmailService struct {
-	db *gorm.DB // Database connection for user/product lookups
+	db     *gorm.DB         // Database connection for user/product lookups
+	sender EmailSender      // Delivers the rendered emails
+	links  *deeplink.Signer // Builds the product links
 }
 
-// NewEmailService creates a new email service instance.
+// NewEmailService creates a new email service instance that sends through
+// SMTP, with smtp faults injected when FAULT_INJECTION is set.
 //
 // Parameters:
 //   - db: Database connection for user/product lookups
@@ -33,7 +46,16 @@ type EmailService struct {
 // Returns:
 //   - *EmailService: Configured email service
 func NewEmailService(db *gorm.DB) *EmailService {
-	return &EmailService{db: db}
+	links, err := deeplink.FromEnv()
+	if err != nil {
+		logrus.WithError(err).Warn("Notification emails link to products without click tracking")
+	}
+	es := &EmailService{db: db, links: links}
+	es.sender = smtpSender{es}
+	if faults.Enabled() {
+		es.sender = faultySender{es.sender}
+	}
+	return es
 }
 
 // SendNotification implements the gRPC NotificationService interface.
@@ -56,23 +78,149 @@ func (s *NotificationServer) SendNotification(ctx context.Context, in *proto.Not
 		"product_id": in.ProductId,
 	}).Info("Received notification request")
 
+	// Deliver the notification. Email failures are logged by deliver and
+	// still reported as handled so the caller does not retry indefinitely.
+	err := s.deliver(in)
+	switch err {
+	case errPasswordNotConfigured:
+		return nil, err
+	case errInvalidUserID:
+		return &proto.NotificationResponse{Success: false}, nil
+	}
+
+	// Test notifications are sent by an operator who needs to see failures
+	if err != nil && in.Type == "test" {
+		return nil, status.Errorf(codes.Unavailable, "failed to send test notification: %v", err)
+	}
+
+	return &proto.NotificationResponse{Success: true}, nil
+}
+
+// aboutFavorite reports whether a notification type is about a favorited
+// product, which the user can mute. Seller and brand watches are not.
+func aboutFavorite(notificationType string) bool {
+	switch notificationType {
+	case "", "discontinued", "back_in_stock":
+		return true
+	}
+	return false
+}
+
+// deliver sends a single notification request as an email. It is shared by
+// the unary and batch RPCs so both paths apply the same parsing, rate
+// limiting and error handling.
+//
+// Parameters:
+//   - in: Notification request containing user ID, product ID, and message
+//
+// Returns:
+//   - error: Any error that prevented the email from being sent
+func (s *NotificationServer) deliver(in *proto.NotificationRequest) error {
 	// Initialize email service if needed
-	if s.emailService == nil {
-		s.emailService = NewEmailService(s.db)
+	s.init.Do(func() {
+		if s.emailService == nil {
+			s.emailService = NewEmailService(s.db)
+		}
+	})
+
+	// Parse and validate user ID; test notifications go to an address instead
+	var userID uint64
+	var err error
+	if in.Type != "test" {
+		userID, err = strconv.ParseUint(in.UserId, 10, 32)
+		if err != nil {
+			logrus.WithError(err).Error("Error parsing user ID")
+			return errInvalidUserID
+		}
+	} else if in.Email == "" {
+		logrus.Error("Test notification without an email address")
+		return errInvalidUserID
 	}
 
-	// Parse and validate user ID
-	userID, err := strconv.ParseUint(in.UserId, 10, 32)
-	if err != nil {
-		logrus.WithError(err).Error("Error parsing user ID")
-		return &proto.NotificationResponse{Success: false}, nil
+	// Deleted and deactivated users are skipped rather than failing the send,
+	// which would requeue the notification for a user who is gone
+	if in.Type != "test" {
+		users, err := pricealert.LoadUsers(s.db, []uint{uint(userID)})
+		if err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to look up user")
+			return err
+		}
+		if reason := pricealert.UserReason(users[0]); reason != "" {
+			logrus.WithFields(logrus.Fields{"user_id": userID, "type": in.Type, "reason": reason}).Info("User deleted or inactive, skipping notification")
+			return nil
+		}
+
+		// Muted favorites notify nothing, not even after the mute ends
+		if aboutFavorite(in.Type) {
+			source := in.Source
+			if source == "" {
+				source = models.SourceTrendyol
+			}
+			if err := pricealert.MarkFavorites(s.db, users, uint(in.ProductId), source, time.Now()); err != nil {
+				logrus.WithError(err).WithField("user_id", userID).Error("Failed to look up muted favorite")
+				return err
+			}
+			if users[0].Muted {
+				logrus.WithFields(logrus.Fields{"user_id": userID, "product_id": in.ProductId, "type": in.Type}).Info("Favorite muted, skipping notification")
+				return nil
+			}
+		}
+
+		// Hold back notifications while the user has them snoozed. If the
+		// snooze cannot be stored the notification is sent rather than lost.
+		suppressed, err := s.suppressIfSnoozed(users[0], in)
+		if err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to hold back snoozed notification")
+		} else if suppressed {
+			return nil
+		}
 	}
 
-	// Check email credentials
+	// Check email credentials; a dry run renders emails without them
 	password := os.Getenv("EMAIL_APP_PASSWORD")
-	if password == "" {
+	if password == "" && !DryRun() {
 		logrus.Error("EMAIL_APP_PASSWORD not set")
-		return nil, fmt.Errorf("email password not configured")
+		return errPasswordNotConfigured
+	}
+
+	// Respect the shared send rate before talking to SMTP
+	sendLimiter().Wait()
+
+	// Test notifications preview a product without a user
+	if in.Type == "test" {
+		_, err = s.emailService.SendTestNotification(in.Email, uint(in.ProductId), in.Source)
+		if err != nil {
+			logrus.WithError(err).Error("Error sending test notification")
+		}
+		return err
+	}
+
+	// The first email after a snooze is the summary of what was missed
+	if err := sendMissedSummary(s.db, s.emailService, uint(userID)); err != nil {
+		logrus.WithError(err).WithField("user_id", userID).Error("Failed to send missed notifications summary")
+	}
+
+	// New products from followed sellers use their own template
+	if in.Type == "new_seller_product" {
+		_, err = s.emailService.SendNewSellerProductNotification(uint(userID), uint(in.ProductId), in.Source)
+		if err != nil {
+			logrus.WithError(err).Error("Error sending email notification")
+		}
+		return err
+	}
+
+	// Discontinued products are announced at most once per user
+	if in.Type == "discontinued" {
+		return s.deliverDiscontinued(uint(userID), uint(in.ProductId), in.Source)
+	}
+
+	// Discontinued products that are listed again
+	if in.Type == "back_in_stock" {
+		_, err = s.emailService.SendBackInStockNotification(uint(userID), uint(in.ProductId), in.Source)
+		if err != nil {
+			logrus.WithError(err).Error("Error sending email notification")
+		}
+		return err
 	}
 
 	// Extract price information from message
@@ -80,20 +228,69 @@ func (s *NotificationServer) SendNotification(ctx context.Context, in *proto.Not
 	_, err = fmt.Sscanf(in.Message, "Price dropped from %f to %f for", &oldPrice, &newPrice)
 	if err != nil {
 		logrus.WithError(err).Error("Error parsing price info")
-		_, err = s.emailService.SendPriceDropNotification(uint(userID), uint(in.ProductId), 0, 0)
+		_, err = s.emailService.SendPriceDropNotification(uint(userID), uint(in.ProductId), in.Source, 0, 0, in.Changes)
 	} else {
-		_, err = s.emailService.SendPriceDropNotification(uint(userID), uint(in.ProductId), oldPrice, newPrice)
+		_, err = s.emailService.SendPriceDropNotification(uint(userID), uint(in.ProductId), in.Source, oldPrice, newPrice, in.Changes)
+	}
+
+	// Price drops only go to verified addresses; the consumer filters
+	// unverified users, this catches notifications queued before
+	if errors.Is(err, errUserNotVerified) {
+		logrus.WithField("user_id", userID).Info("User email address not verified, skipping notification")
+		return nil
 	}
 
 	// Log any email sending errors
 	if err != nil {
 		logrus.WithError(err).Error("Error sending email notification")
+		return err
 	}
 
-	return &proto.NotificationResponse{Success: true}, nil
+	// Record end-to-end latency for price drops that came from a fetch
+	if in.FetchedAt > 0 {
+		metrics.ObservePipelineLatency(metrics.StageNotification, time.UnixMilli(in.FetchedAt))
+	}
+	return nil
 }
 
-// SendMail sends an HTML email using the configured SMTP server.
+// SendMail sends an HTML email and records the outcome in the notification
+// log. Every notification email goes through it, so this is where the
+// dry-run mode is enforced: with NOTIFICATIONS_DRY_RUN set, emails to
+// recipients outside NOTIFICATIONS_ALLOWLIST are rendered, logged and
+// recorded with status dry_run, but not sent. The address is normalized
+// first, so addresses stored before normalization, with stray whitespace or
+// an upper-case domain, are delivered and logged in their normalized form.
+//
+// Parameters:
+//   - toEmail: Recipient's email address
+//   - htmlContent: HTML content of the email
+//   - subject: Email subject line
+//   - notificationID: ID carried by the email's links, recorded in the log
+//
+// Returns:
+//   - error: Any error that occurred while sending the email
+func (es *EmailService) SendMail(toEmail string, htmlContent, subject, notificationID string) error {
+	toEmail = emailaddr.Normalize(toEmail)
+	if HoldBackInDryRun(toEmail) {
+		logrus.WithFields(logrus.Fields{
+			"to":      toEmail,
+			"subject": subject,
+			"bytes":   len(htmlContent),
+		}).Info("Dry run, email not sent")
+		recordDelivery(es.db, toEmail, subject, notificationID, deliveryDryRun, nil)
+		return nil
+	}
+
+	err := es.sender.Send(toEmail, htmlContent, subject)
+	if err != nil {
+		recordDelivery(es.db, toEmail, subject, notificationID, deliveryFailed, err)
+		return err
+	}
+	recordDelivery(es.db, toEmail, subject, notificationID, deliverySent, nil)
+	return nil
+}
+
+// sendSMTP sends an HTML email using the configured SMTP server.
 // It supports TLS encryption and authentication.
 //
 // The function performs the following steps:
@@ -115,7 +312,7 @@ func (s *NotificationServer) SendNotification(ctx context.Context, in *proto.Not
 //
 // Returns:
 //   - error: Any error that occurred while sending the email
-func (es *EmailService) SendMail(toEmail string, htmlContent, subject string) error {
+func (es *EmailService) sendSMTP(toEmail string, htmlContent, subject string) error {
 	// Log attempt to send email
 	logrus.WithFields(logrus.Fields{
 		"to":      toEmail,
@@ -208,16 +405,70 @@ func (es *EmailService) SendMail(toEmail string, htmlContent, subject string) er
 	return nil
 }
 
+// otherChange is a row of the "What else changed" section of the price drop
+// email
+type otherChange struct {
+	Label string
+	Old   string
+	New   string
+}
+
+// changeLabels and changeValues word the product changes for the email
+var (
+	changeLabels = map[string]string{
+		productdiff.FieldSeller:   "Seller",
+		productdiff.FieldStock:    "Stock",
+		productdiff.FieldRating:   "Rating",
+		productdiff.FieldDiscount: "Discount",
+	}
+	changeValues = map[string]string{
+		productdiff.StockInStock:    "In stock",
+		productdiff.StockLow:        "Only a few left",
+		productdiff.StockOutOfStock: "Out of stock",
+		productdiff.NoDiscount:      "No discount",
+	}
+)
+
+// otherChanges words the changes a price drop came with. Changes of unknown
+// fields are left out.
+//
+// Parameters:
+//   - changes: Changes from the notification request
+//
+// Returns:
+//   - []otherChange: Rows of the "What else changed" section
+func otherChanges(changes []*proto.ProductChange) []otherChange {
+	var rows []otherChange
+	for _, change := range changes {
+		label, ok := changeLabels[change.GetField()]
+		if !ok {
+			continue
+		}
+		row := otherChange{Label: label, Old: change.GetOldValue(), New: change.GetNewValue()}
+		if change.GetField() != productdiff.FieldSeller {
+			if text, ok := changeValues[row.Old]; ok {
+				row.Old = text
+			}
+			if text, ok := changeValues[row.New]; ok {
+				row.New = text
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
 // SendPriceDropNotification sends an email notification to a user when a product's price drops.
 // The email includes:
 // - Product name and price change details
 // - Amount saved and savings percentage
+// - What else changed about the product, such as its seller or stock, if anything did
 // - Link to view the product
 // - Styled HTML template with a professional layout
 //
 // The function performs these steps:
 // 1. Validates database connection
-// 2. Retrieves user and product information
+// 2. Retrieves user and product information; unverified users are refused
 // 3. Extracts price and currency information
 // 4. Generates a styled HTML email using a template
 // 5. Sends the email using the SendMail function
@@ -225,18 +476,23 @@ func (es *EmailService) SendMail(toEmail string, htmlContent, subject string) er
 // Parameters:
 //   - userID: ID of the user to notify
 //   - productID: ID of the product with price drop
+//   - source: Marketplace of the product; empty means trendyol
 //   - oldPrice: Previous price of the product
 //   - newPrice: New reduced price of the product
+//   - changes: What else changed about the product; may be empty
 //
 // Returns:
 //   - bool: True if notification was sent successfully
 //   - error: Any error that occurred during the process
-func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, oldPrice, newPrice float64) (bool, error) {
+func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, source string, oldPrice, newPrice float64, changes []*proto.ProductChange) (bool, error) {
 	// Validate database connection
 	if es.db == nil {
 		logrus.Error("Database connection is nil")
 		return false, fmt.Errorf("database connection is nil")
 	}
+	if source == "" {
+		source = models.SourceTrendyol
+	}
 
 	// Retrieve user information
 	var user models.User
@@ -244,10 +500,13 @@ func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, o
 		logrus.WithError(err).Error("Failed to find user")
 		return false, fmt.Errorf("failed to find user: %w", err)
 	}
+	if !user.Verified {
+		return false, errUserNotVerified
+	}
 
 	// Retrieve product information
 	var product models.Product
-	if err := es.db.First(&product, productID).Error; err != nil {
+	if err := es.db.Where("id = ? AND source = ?", productID, source).First(&product).Error; err != nil {
 		logrus.WithError(err).Error("Failed to find product")
 		return false, fmt.Errorf("failed to find product: %w", err)
 	}
@@ -266,6 +525,16 @@ func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, o
 		currency = curr
 	}
 
+	// Favorites with a target price say it was reached
+	var favorite models.UserFavorite
+	targetReached := false
+	err := es.db.Select("target_price").
+		Where("user_id = ? AND product_id = ? AND source = ?", userID, productID, product.Source).
+		First(&favorite).Error
+	if err == nil && favorite.TargetPrice != nil && newPrice > 0 && newPrice <= *favorite.TargetPrice {
+		targetReached = true
+	}
+
 	// HTML email template with styling
 	tmpl := `
 	<html>
@@ -276,12 +545,21 @@ func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, o
 			<p>Good news! A product you've favorited has dropped in price:</p>
 			<div style="background-color: #f9f9f9; padding: 15px; border-radius: 5px; margin: 20px 0;">
 				<h3 style="margin-top: 0; color: #333;">{{.ProductName}}</h3>
+				{{if .TargetReached}}<p style="color: #4caf50; font-weight: bold;">Your target price of {{printf "%.2f" .TargetPrice}} {{.Currency}} was reached!</p>{{end}}
 				<p><b>Price dropped from:</b> <span style="text-decoration: line-through;">{{.OldPrice}} {{.Currency}}</span></p>
 				<p><b>New price:</b> <span style="color:Nimble, sans-serif; color: #e91e63; font-weight: bold; font-size: 1.2em;">{{.NewPrice}} {{.Currency}}</span></p>
 				<p><b>You save:</b> <span style="color: #4caf50;">{{.Savings}} {{.Currency}} ({{.SavingsPercent}}%)</span></p>
 			</div>
+			{{if .Changes}}
+			<div style="padding: 0 15px; margin: 20px 0;">
+				<h4 style="margin-bottom: 10px;">What else changed</h4>
+				<ul style="padding-left: 20px; margin: 0;">
+					{{range .Changes}}<li><b>{{.Label}}:</b> {{.Old}} &rarr; {{.New}}</li>{{end}}
+				</ul>
+			</div>
+			{{end}}
 			<p>Don't miss out on this great deal!</p>
-			<a href="http://localhost:8080/products/{{.ProductID}}" style="display: inline-block; background-color: #e91e63; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; margin-top: 15px;">View Product</a>
+			<a href="{{productLink .ProductID .Source}}" style="display: inline-block; background-color: #e91e63; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; margin-top: 15px;">View Product</a>
 			<p style="margin-top: 30px; font-size: 0.9em; color: #777;">
 				This notification was sent because you've favorited this product.
 				<br>Happy Shopping!
@@ -291,7 +569,8 @@ func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, o
 	</html>`
 
 	// Parse email template
-	t, err := template.New("priceDropEmail").Parse(tmpl)
+	notificationID := deeplink.NewNotificationID()
+	t, err := template.New("priceDropEmail").Funcs(es.productLinks(notificationID, userID)).Parse(tmpl)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to parse email template")
 		return false, fmt.Errorf("failed to parse email template: %w", err)
@@ -312,6 +591,10 @@ func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, o
 		Savings        float64
 		SavingsPercent float64
 		ProductID      uint
+		Source         string
+		TargetReached  bool
+		TargetPrice    float64
+		Changes        []otherChange
 	}{
 		UserName:       user.Name,
 		ProductName:    name,
@@ -321,6 +604,12 @@ func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, o
 		Savings:        savings,
 		SavingsPercent: float64(int(savingsPercent*100)) / 100, // Round to 2 decimal places
 		ProductID:      productID,
+		Source:         product.Source,
+		TargetReached:  targetReached,
+		Changes:        otherChanges(changes),
+	}
+	if targetReached {
+		data.TargetPrice = *favorite.TargetPrice
 	}
 
 	// Execute template with data
@@ -333,11 +622,481 @@ func (es *EmailService) SendPriceDropNotification(userID uint, productID uint, o
 	// Prepare email content
 	htmlContent := buf.String()
 	subject := fmt.Sprintf("Price Drop Alert! %s is now cheaper", name)
-	err = es.SendMail(user.Email, htmlContent, subject)
+	if targetReached {
+		subject = fmt.Sprintf("Target price reached! %s is now %.2f %s", name, newPrice, currency)
+	}
+	err = es.SendMail(user.Email, htmlContent, subject, notificationID)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to send email")
 		return false, err
 	}
 
 	return true, nil
-}
\ No newline at end of file
+}
+
+// SendNewSellerProductNotification emails a user about a new product listed by
+// a seller they follow.
+//
+// Parameters:
+//   - userID: ID of the user to notify
+//   - productID: ID of the newly listed product
+//   - source: Marketplace of the product; empty means trendyol
+//
+// Returns:
+//   - bool: True if notification was sent successfully
+//   - error: Any error that occurred during the process
+func (es *EmailService) SendNewSellerProductNotification(userID uint, productID uint, source string) (bool, error) {
+	// Validate database connection
+	if es.db == nil {
+		logrus.Error("Database connection is nil")
+		return false, fmt.Errorf("database connection is nil")
+	}
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+
+	// Retrieve user and product information
+	var user models.User
+	if err := es.db.First(&user, userID).Error; err != nil {
+		logrus.WithError(err).Error("Failed to find user")
+		return false, fmt.Errorf("failed to find user: %w", err)
+	}
+	var product models.Product
+	if err := es.db.Where("id = ? AND source = ?", productID, source).First(&product).Error; err != nil {
+		logrus.WithError(err).Error("Failed to find product")
+		return false, fmt.Errorf("failed to find product: %w", err)
+	}
+
+	// Get seller name and currency from the stored JSON
+	var seller map[string]interface{}
+	json.Unmarshal(product.Seller, &seller)
+	sellerName, _ := seller["officialName"].(string)
+	if sellerName == "" {
+		sellerName = "A seller you follow"
+	}
+	currency := "AED"
+	var priceInfo map[string]interface{}
+	if err := json.Unmarshal(product.PriceInfo, &priceInfo); err == nil {
+		if curr, ok := priceInfo["currency"].(string); ok {
+			currency = curr
+		}
+	}
+
+	// HTML email template with styling
+	tmpl := `
+	<html>
+	<body style="font-family: Arial, sans-serif; color: #333; line-height: 1.6;">
+		<div style="max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #eee; border-radius: 10px;">
+			<h2 style="color: #e91e63; margin-bottom: 20px;">New Product Listed!</h2>
+			<p>Hi <b>{{.UserName}}</b>,</p>
+			<p><b>{{.SellerName}}</b> just listed a new product:</p>
+			<div style="background-color: #f9f9f9; padding: 15px; border-radius: 5px; margin: 20px 0;">
+				<h3 style="margin-top: 0; color: #333;">{{.ProductName}}</h3>
+				<p><b>Price:</b> <span style="color: #e91e63; font-weight: bold; font-size: 1.2em;">{{.Price}} {{.Currency}}</span></p>
+			</div>
+			<a href="{{productLink .ProductID .Source}}" style="display: inline-block; background-color: #e91e63; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; margin-top: 15px;">View Product</a>
+			<p style="margin-top: 30px; font-size: 0.9em; color: #777;">
+				This notification was sent because you follow this seller.
+				<br>Happy Shopping!
+			</p>
+		</div>
+	</body>
+	</html>`
+
+	// Parse and execute email template
+	notificationID := deeplink.NewNotificationID()
+	t, err := template.New("newSellerProductEmail").Funcs(es.productLinks(notificationID, userID)).Parse(tmpl)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse email template")
+		return false, fmt.Errorf("failed to parse email template: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		UserName    string
+		SellerName  string
+		ProductName string
+		Price       float64
+		Currency    string
+		ProductID   uint
+		Source      string
+	}{
+		UserName:    user.Name,
+		SellerName:  sellerName,
+		ProductName: product.Name,
+		Price:       product.Price,
+		Currency:    currency,
+		ProductID:   productID,
+		Source:      product.Source,
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		logrus.WithError(err).Error("Failed to execute email template")
+		return false, fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	subject := fmt.Sprintf("New from %s: %s", sellerName, product.Name)
+	if err := es.SendMail(user.Email, buf.String(), subject, notificationID); err != nil {
+		logrus.WithError(err).Error("Failed to send email")
+		return false, err
+	}
+
+	return true, nil
+}
+
+// deliverDiscontinued sends the one-time discontinued email. The notification
+// is claimed in the notification history first; if it was already claimed the
+// request succeeds without sending, and a failed send releases the claim.
+//
+// Parameters:
+//   - userID: ID of the user to notify
+//   - productID: ID of the discontinued product
+//   - source: Marketplace of the product
+//
+// Returns:
+//   - error: Any error that prevented the email from being sent
+func (s *NotificationServer) deliverDiscontinued(userID, productID uint, source string) error {
+	fields := logrus.Fields{"user_id": userID, "product_id": productID, "source": source}
+
+	claimed, err := claimNotification(s.db, userID, productID, source, "discontinued")
+	if err != nil {
+		logrus.WithError(err).WithFields(fields).Error("Failed to record discontinued notification")
+		return err
+	}
+	if !claimed {
+		logrus.WithFields(fields).Info("Discontinued notification already sent, skipping")
+		return nil
+	}
+
+	if _, err := s.emailService.SendDiscontinuedNotification(userID, productID, source); err != nil {
+		logrus.WithError(err).WithFields(fields).Error("Error sending email notification")
+		if err := releaseNotification(s.db, userID, productID, source, "discontinued"); err != nil {
+			logrus.WithError(err).WithFields(fields).Error("Failed to release discontinued notification")
+		}
+		return err
+	}
+	return nil
+}
+
+// productLinks returns the template function linking products in an email,
+// used as {{productLink .ProductID .Source}}. The links of one email share
+// its notification ID.
+//
+// Parameters:
+//   - notificationID: ID of the email, from deeplink.NewNotificationID
+//   - userID: Notified user; 0 when the email is not for a user
+//
+// Returns:
+//   - template.FuncMap: The productLink function
+func (es *EmailService) productLinks(notificationID string, userID uint) template.FuncMap {
+	now := time.Now()
+	return template.FuncMap{
+		"productLink": func(productID uint, source string) string {
+			return es.links.Link(notificationID, userID, productID, source, now)
+		},
+	}
+}
+
+// similarProduct is a suggestion shown in the discontinued email
+type similarProduct struct {
+	Name string
+	URL  string
+}
+
+// maxSimilarProducts caps the suggestions in the discontinued email
+const maxSimilarProducts = 3
+
+// SendDiscontinuedNotification emails a user that a favorited product appears
+// to be discontinued, suggesting similar products when the product has any.
+//
+// Parameters:
+//   - userID: ID of the user to notify
+//   - productID: ID of the discontinued product
+//   - source: Marketplace of the product; empty means trendyol
+//
+// Returns:
+//   - bool: True if notification was sent successfully
+//   - error: Any error that occurred during the process
+func (es *EmailService) SendDiscontinuedNotification(userID uint, productID uint, source string) (bool, error) {
+	// Validate database connection
+	if es.db == nil {
+		logrus.Error("Database connection is nil")
+		return false, fmt.Errorf("database connection is nil")
+	}
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+
+	// Retrieve user and product information
+	var user models.User
+	if err := es.db.First(&user, userID).Error; err != nil {
+		logrus.WithError(err).Error("Failed to find user")
+		return false, fmt.Errorf("failed to find user: %w", err)
+	}
+	var product models.Product
+	if err := es.db.Where("id = ? AND source = ?", productID, source).First(&product).Error; err != nil {
+		logrus.WithError(err).Error("Failed to find product")
+		return false, fmt.Errorf("failed to find product: %w", err)
+	}
+
+	// Collect suggestions from the stored similar products, if any
+	notificationID := deeplink.NewNotificationID()
+	now := time.Now()
+	var similar []similarProduct
+	var suggestions []map[string]interface{}
+	if err := json.Unmarshal(product.SimilarProducts, &suggestions); err == nil {
+		for _, suggestion := range suggestions {
+			name, _ := suggestion["name"].(string)
+			if name == "" {
+				continue
+			}
+			url, _ := suggestion["url"].(string)
+			if url == "" {
+				if id, ok := suggestion["id"].(float64); ok {
+					url = es.links.Link(notificationID, userID, uint(id), source, now)
+				}
+			}
+			similar = append(similar, similarProduct{Name: name, URL: url})
+			if len(similar) == maxSimilarProducts {
+				break
+			}
+		}
+	}
+
+	// HTML email template with styling
+	tmpl := `
+	<html>
+	<body style="font-family: Arial, sans-serif; color: #333; line-height: 1.6;">
+		<div style="max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #eee; border-radius: 10px;">
+			<h2 style="color: #e91e63; margin-bottom: 20px;">Product Discontinued</h2>
+			<p>Hi <b>{{.UserName}}</b>,</p>
+			<p>A product you've favorited appears to be discontinued:</p>
+			<div style="background-color: #f9f9f9; padding: 15px; border-radius: 5px; margin: 20px 0;">
+				<h3 style="margin-top: 0; color: #333;">{{.ProductName}}</h3>
+				<p>It is no longer available from the seller. We'll let you know if it is listed again.</p>
+			</div>
+			{{if .Similar}}
+			<p>You might like these similar products instead:</p>
+			<ul>
+				{{range .Similar}}<li>{{if .URL}}<a href="{{.URL}}" style="color: #e91e63;">{{.Name}}</a>{{else}}{{.Name}}{{end}}</li>{{end}}
+			</ul>
+			{{end}}
+			<p style="margin-top: 30px; font-size: 0.9em; color: #777;">
+				This notification was sent because you've favorited this product.
+				<br>Happy Shopping!
+			</p>
+		</div>
+	</body>
+	</html>`
+
+	// Parse and execute email template
+	t, err := template.New("discontinuedEmail").Parse(tmpl)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse email template")
+		return false, fmt.Errorf("failed to parse email template: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		UserName    string
+		ProductName string
+		Similar     []similarProduct
+	}{
+		UserName:    user.Name,
+		ProductName: product.Name,
+		Similar:     similar,
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		logrus.WithError(err).Error("Failed to execute email template")
+		return false, fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	subject := fmt.Sprintf("%s appears to be discontinued", product.Name)
+	if err := es.SendMail(user.Email, buf.String(), subject, notificationID); err != nil {
+		logrus.WithError(err).Error("Failed to send email")
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SendBackInStockNotification emails a user that a product they were told
+// is discontinued is listed again.
+//
+// Parameters:
+//   - userID: ID of the user to notify
+//   - productID: ID of the relisted product
+//   - source: Marketplace of the product; empty means trendyol
+//
+// Returns:
+//   - bool: True if notification was sent successfully
+//   - error: Any error that occurred during the process
+func (es *EmailService) SendBackInStockNotification(userID uint, productID uint, source string) (bool, error) {
+	// Validate database connection
+	if es.db == nil {
+		logrus.Error("Database connection is nil")
+		return false, fmt.Errorf("database connection is nil")
+	}
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+
+	// Retrieve user and product information
+	var user models.User
+	if err := es.db.First(&user, userID).Error; err != nil {
+		logrus.WithError(err).Error("Failed to find user")
+		return false, fmt.Errorf("failed to find user: %w", err)
+	}
+	var product models.Product
+	if err := es.db.Where("id = ? AND source = ?", productID, source).First(&product).Error; err != nil {
+		logrus.WithError(err).Error("Failed to find product")
+		return false, fmt.Errorf("failed to find product: %w", err)
+	}
+	currency := "AED"
+	var priceInfo map[string]interface{}
+	if err := json.Unmarshal(product.PriceInfo, &priceInfo); err == nil {
+		if curr, ok := priceInfo["currency"].(string); ok {
+			currency = curr
+		}
+	}
+
+	// HTML email template with styling
+	tmpl := `
+	<html>
+	<body style="font-family: Arial, sans-serif; color: #333; line-height: 1.6;">
+		<div style="max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #eee; border-radius: 10px;">
+			<h2 style="color: #e91e63; margin-bottom: 20px;">Back in Stock</h2>
+			<p>Hi <b>{{.UserName}}</b>,</p>
+			<p>A product you've favorited that appeared to be discontinued is available again:</p>
+			<div style="background-color: #f9f9f9; padding: 15px; border-radius: 5px; margin: 20px 0;">
+				<h3 style="margin-top: 0; color: #333;">{{.ProductName}}</h3>
+				<p><b>Price:</b> <span style="color: #e91e63; font-weight: bold; font-size: 1.2em;">{{printf "%.2f" .Price}} {{.Currency}}</span></p>
+			</div>
+			<a href="{{productLink .ProductID .Source}}" style="display: inline-block; background-color: #e91e63; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; margin-top: 15px;">View Product</a>
+			<p style="margin-top: 30px; font-size: 0.9em; color: #777;">
+				This notification was sent because you've favorited this product.
+				<br>Happy Shopping!
+			</p>
+		</div>
+	</body>
+	</html>`
+
+	// Parse and execute email template
+	notificationID := deeplink.NewNotificationID()
+	t, err := template.New("backInStockEmail").Funcs(es.productLinks(notificationID, userID)).Parse(tmpl)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse email template")
+		return false, fmt.Errorf("failed to parse email template: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		UserName    string
+		ProductName string
+		Price       float64
+		Currency    string
+		ProductID   uint
+		Source      string
+	}{
+		UserName:    user.Name,
+		ProductName: product.Name,
+		Price:       product.Price,
+		Currency:    currency,
+		ProductID:   productID,
+		Source:      source,
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		logrus.WithError(err).Error("Failed to execute email template")
+		return false, fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	subject := fmt.Sprintf("%s is available again", product.Name)
+	if err := es.SendMail(user.Email, buf.String(), subject, notificationID); err != nil {
+		logrus.WithError(err).Error("Failed to send email")
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SendTestNotification sends a sample email about a product to an arbitrary
+// address so operators can verify SMTP delivery and rendering end to end.
+//
+// Parameters:
+//   - email: Recipient address
+//   - productID: ID of the product to show
+//   - source: Marketplace of the product; empty means trendyol
+//
+// Returns:
+//   - bool: True if notification was sent successfully
+//   - error: Any error that occurred during the process
+func (es *EmailService) SendTestNotification(email string, productID uint, source string) (bool, error) {
+	// Validate database connection
+	if es.db == nil {
+		logrus.Error("Database connection is nil")
+		return false, fmt.Errorf("database connection is nil")
+	}
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+
+	// Retrieve product information
+	var product models.Product
+	if err := es.db.Where("id = ? AND source = ?", productID, source).First(&product).Error; err != nil {
+		logrus.WithError(err).Error("Failed to find product")
+		return false, fmt.Errorf("failed to find product: %w", err)
+	}
+	currency := "AED"
+	var priceInfo map[string]interface{}
+	if err := json.Unmarshal(product.PriceInfo, &priceInfo); err == nil {
+		if curr, ok := priceInfo["currency"].(string); ok {
+			currency = curr
+		}
+	}
+
+	// HTML email template with styling
+	tmpl := `
+	<html>
+	<body style="font-family: Arial, sans-serif; color: #333; line-height: 1.6;">
+		<div style="max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #eee; border-radius: 10px;">
+			<h2 style="color: #e91e63; margin-bottom: 20px;">Test Notification</h2>
+			<p>This is a test notification. Your email settings are working.</p>
+			<div style="background-color: #f9f9f9; padding: 15px; border-radius: 5px; margin: 20px 0;">
+				<h3 style="margin-top: 0; color: #333;">{{.ProductName}}</h3>
+				<p><b>Price:</b> <span style="color: #e91e63; font-weight: bold; font-size: 1.2em;">{{.Price}} {{.Currency}}</span></p>
+			</div>
+			<a href="{{productLink .ProductID .Source}}" style="display: inline-block; background-color: #e91e63; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; margin-top: 15px;">View Product</a>
+		</div>
+	</body>
+	</html>`
+
+	// Parse and execute email template
+	notificationID := deeplink.NewNotificationID()
+	t, err := template.New("testEmail").Funcs(es.productLinks(notificationID, 0)).Parse(tmpl)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse email template")
+		return false, fmt.Errorf("failed to parse email template: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		ProductName string
+		Price       float64
+		Currency    string
+		ProductID   uint
+		Source      string
+	}{
+		ProductName: product.Name,
+		Price:       product.Price,
+		Currency:    currency,
+		ProductID:   productID,
+		Source:      source,
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		logrus.WithError(err).Error("Failed to execute email template")
+		return false, fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	subject := fmt.Sprintf("Test notification: %s", product.Name)
+	if err := es.SendMail(email, buf.String(), subject, notificationID); err != nil {
+		logrus.WithError(err).Error("Failed to send email")
+		return false, err
+	}
+
+	return true, nil
+}
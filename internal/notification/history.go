@@ -0,0 +1,62 @@
+// Package notification implements the history of one-time notifications
+package notification
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/models"
+)
+
+// claimNotification records that a one-time notification is about to be sent.
+// The unique index on models.NotificationHistory makes concurrent and repeated
+// claims for the same (user, product, source, type) lose.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to notify
+//   - productID: Product the notification is about
+//   - source: Marketplace of the product; empty means trendyol
+//   - notificationType: Notification type, e.g. "discontinued"
+//
+// Returns:
+//   - bool: True if this call claimed the notification and should send it
+//   - error: Any database error
+func claimNotification(db *gorm.DB, userID, productID uint, source, notificationType string) (bool, error) {
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.NotificationHistory{
+		UserID:    userID,
+		ProductID: productID,
+		Source:    source,
+		Type:      notificationType,
+		SentAt:    time.Now(),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// releaseNotification removes a claim whose email could not be sent so a
+// later attempt can deliver it.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User that was to be notified
+//   - productID: Product the notification is about
+//   - source: Marketplace of the product; empty means trendyol
+//   - notificationType: Notification type, e.g. "discontinued"
+//
+// Returns:
+//   - error: Any database error
+func releaseNotification(db *gorm.DB, userID, productID uint, source, notificationType string) error {
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+	return db.Where("user_id = ? AND product_id = ? AND source = ? AND type = ?", userID, productID, source, notificationType).
+		Delete(&models.NotificationHistory{}).Error
+}
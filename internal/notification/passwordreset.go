@@ -0,0 +1,60 @@
+// Package notification implements the password reset email
+package notification
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"time"
+
+	"scraper/internal/deeplink"
+	"scraper/internal/models"
+)
+
+// SendPasswordReset emails a user the link to set a new password.
+//
+// Parameters:
+//   - user: The user who asked for the reset
+//   - link: The reset link, carrying the token
+//   - expiresAt: When the link stops working
+//
+// Returns:
+//   - error: Any error that occurred while rendering or sending the email
+func (es *EmailService) SendPasswordReset(user models.User, link string, expiresAt time.Time) error {
+	// HTML email template with styling
+	tmpl := `
+	<html>
+	<body style="font-family: Arial, sans-serif; color: #333; line-height: 1.6;">
+		<div style="max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #eee; border-radius: 10px;">
+			<h2 style="color: #e91e63; margin-bottom: 20px;">Reset Your Password</h2>
+			<p>Hi <b>{{.UserName}}</b>, we received a request to reset your password.</p>
+			<a href="{{.Link}}" style="display: inline-block; background-color: #e91e63; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; margin-top: 15px;">Choose a New Password</a>
+			<p style="margin-top: 30px; font-size: 0.9em; color: #777;">
+				The link works once and expires at {{.ExpiresAt}}.
+				<br>If you did not ask for a reset, you can ignore this email; your password stays the same.
+			</p>
+		</div>
+	</body>
+	</html>`
+
+	notificationID := deeplink.NewNotificationID()
+	t, err := template.New("passwordResetEmail").Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to parse email template: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		UserName  string
+		Link      string
+		ExpiresAt string
+	}{
+		UserName:  user.Name,
+		Link:      link,
+		ExpiresAt: expiresAt.UTC().Format("2006-01-02 15:04 UTC"),
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	return es.SendMail(user.Email, buf.String(), "Reset your password", notificationID)
+}
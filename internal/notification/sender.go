@@ -0,0 +1,37 @@
+// Package notification implements the seam between rendered emails and SMTP
+package notification
+
+import (
+	"scraper/internal/faults"
+)
+
+// EmailSender delivers a rendered email. SendMail hands every email that
+// passes the dry-run check to the service's sender.
+type EmailSender interface {
+	// Send delivers htmlContent to toEmail with the given subject
+	Send(toEmail, htmlContent, subject string) error
+}
+
+// smtpSender sends emails through the configured SMTP server
+type smtpSender struct {
+	es *EmailService
+}
+
+// Send implements EmailSender.
+func (s smtpSender) Send(toEmail, htmlContent, subject string) error {
+	return s.es.sendSMTP(toEmail, htmlContent, subject)
+}
+
+// faultySender injects the smtp faults of internal/faults before handing
+// emails to the real sender
+type faultySender struct {
+	EmailSender
+}
+
+// Send implements EmailSender.
+func (s faultySender) Send(toEmail, htmlContent, subject string) error {
+	if err := faults.Inject(faults.TargetSMTP, faults.Scope{Recipient: toEmail}); err != nil {
+		return err
+	}
+	return s.EmailSender.Send(toEmail, htmlContent, subject)
+}
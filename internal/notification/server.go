@@ -2,20 +2,42 @@
 package notification
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
 	"net"
+	"net/http"
+	"sync"
 
 	"github.com/labstack/echo/v4"
 	"google.golang.org/grpc"
 	"gorm.io/gorm"
 
+	"scraper/internal/apierror"
+	"scraper/internal/cors"
 	"scraper/internal/db"
+	"scraper/internal/health"
+	"scraper/internal/profiling"
 	"scraper/internal/proto"
+	"scraper/internal/timeout"
+	"scraper/pkg/listen"
+	"scraper/pkg/readiness"
+	"scraper/pkg/shutdown"
 
 	"github.com/sirupsen/logrus"
 )
 
+// ready is marked once the gRPC listener is bound
+var ready = readiness.New()
+
+// Ready returns a channel that is closed once the notification gRPC server
+// accepts connections. In-process clients wait for it before dialing.
+func Ready() <-chan struct{} {
+	return ready.Ready()
+}
+
+// stopping holds what Start started, stopped by Shutdown
+var stopping = shutdown.New("notification")
+
 // NotificationServer implements the gRPC notification service.
 // It handles sending notifications to users about price changes in their
 // favorited products.
@@ -23,6 +45,7 @@ type NotificationServer struct {
 	proto.UnimplementedNotificationServiceServer
 	emailService *EmailService // Service for sending email notifications
 	db          *gorm.DB      // Database connection
+	init        sync.Once     // Guards lazy email service initialization
 }
 
 // Start initializes and runs the notification service.
@@ -33,39 +56,81 @@ type NotificationServer struct {
 // The service performs the following setup:
 // 1. Initializes database connection
 // 2. Creates email notification service
-// 3. Starts HTTP server on first available port starting from 8082
-// 4. Starts gRPC server on first available port starting from 8083
+// 3. Starts HTTP server on NOTIFICATION_PORT (default 8082)
+// 4. Starts gRPC server on NOTIFICATION_GRPC_PORT (default 8083)
+//
+// A busy port stops the service so clients never dial the wrong address,
+// unless PORT_AUTO is set (see pkg/listen).
+// 5. Schedules the daily digest email job
+// 6. Schedules the missed notifications summary for ended snoozes
+// 7. Marks the service ready once the gRPC listener is bound
 //
 // Both servers are started in separate goroutines to run concurrently.
-func Start() {
+// Shutdown stops them; the service has no consumers to stop with ctx.
+func Start(ctx context.Context) {
 	// Initialize dependencies
 	dbConn := db.Setup()
 	emailService := NewEmailService(dbConn)
 
+	// Schedule the daily digest email
+	stopping.Add("digest job", shutdown.Cron(startDigestJob(dbConn, emailService)))
+
+	// Summarize held back notifications once a snooze ends
+	stopping.Add("snooze summary job", shutdown.Cron(startSnoozeSummaryJob(dbConn, emailService)))
+
 	// Start HTTP server for health checks
 	e := echo.New()
-	port := findAvailablePort(8082, "Notification HTTP")
+	e.HTTPErrorHandler = apierror.NewHandler()
+	e.Pre(cors.Middleware(cors.FromConfig()))
+	e.Use(timeout.Middleware(timeout.Routes{profiling.Route: timeout.Exempt}))
+	e.GET("/version", listen.VersionHandler)
+	// The notification service does not use Kafka; it is ready once
+	// Postgres is reachable
+	health.New().Add("postgres", health.Database(dbConn)).Register(e)
+	// Profiling endpoints when DEBUG_PPROF is set
+	profiling.Register(e, "notification")
+	httpListener, err := listen.TCP("Notification HTTP", "NOTIFICATION_PORT", 8082)
+	if err != nil {
+		logrus.WithError(err).Fatal("Notification HTTP port unavailable")
+	}
+	e.Listener = httpListener
 	go func() {
-		logrus.WithField("port", port).Info("Starting Notification HTTP server")
-		if err := e.Start(fmt.Sprintf(":%d", port)); err != nil {
+		logrus.WithField("addr", httpListener.Addr().String()).Info("Starting Notification HTTP server")
+		if err := e.Start(""); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logrus.WithError(err).Fatal("Notification HTTP server failed")
 		}
 	}()
+	stopping.Add("HTTP server", shutdown.HTTP(e))
 
 	// Start gRPC server for notification requests
 	s, lis := startGRPCServer(emailService, dbConn)
 	go func() {
-		logrus.WithField("port", port+1).Info("Starting Notification gRPC server")
-		log.Fatal(s.Serve(lis))
+		logrus.WithField("addr", lis.Addr().String()).Info("Starting Notification gRPC server")
+		if err := s.Serve(lis); err != nil {
+			logrus.WithError(err).Fatal("Notification gRPC server failed")
+		}
 	}()
+	stopping.Add("gRPC server", shutdown.GRPC(s))
+
+	// Connections to the bound listener queue until Serve accepts them
+	ready.Mark()
+}
+
+// Shutdown stops what Start started: the gRPC and HTTP servers finish their
+// running calls and requests, and the jobs their running runs. Work still
+// running when ctx ends is cancelled.
+func Shutdown(ctx context.Context) error {
+	return stopping.Stop(ctx)
 }
 
 // startGRPCServer initializes and configures the gRPC server.
 // It performs the following steps:
-// 1. Finds an available port starting from 8083
-// 2. Creates a TCP listener on the port
-// 3. Creates a new gRPC server
-// 4. Registers the notification service
+// 1. Creates a TCP listener on the configured port, failing fast if it is taken
+// 2. Creates a new gRPC server
+// 3. Registers the notification service
+//
+// Environment Variables:
+//   - NOTIFICATION_GRPC_PORT: gRPC bind port (default: 8083)
 //
 // Parameters:
 //   - emailService: Service for sending email notifications
@@ -75,11 +140,10 @@ func Start() {
 //   - *grpc.Server: Configured gRPC server
 //   - net.Listener: TCP listener for the server
 func startGRPCServer(emailService *EmailService, db *gorm.DB) (*grpc.Server, net.Listener) {
-	// Find available port
-	port := findAvailablePort(8083, "Notification gRPC")
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	// Bind the configured port; clients are configured with this address
+	lis, err := listen.TCP("Notification gRPC", "NOTIFICATION_GRPC_PORT", 8083)
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to listen")
+		logrus.WithError(err).Fatal("Notification gRPC port unavailable")
 	}
 
 	// Create and configure gRPC server
@@ -87,48 +151,3 @@ func startGRPCServer(emailService *EmailService, db *gorm.DB) (*grpc.Server, net
 	proto.RegisterNotificationServiceServer(s, &NotificationServer{emailService: emailService, db: db})
 	return s, lis
 }
-
-// findAvailablePort attempts to find an available TCP port starting from basePort.
-// It will try up to maxAttempts times before falling back to the last attempted port.
-//
-// The function works by:
-// 1. Attempting to create a TCP listener on the current port
-// 2. If successful, closing the listener and returning that port
-// 3. If unsuccessful, incrementing the port number and trying again
-//
-// Parameters:
-//   - basePort: Starting port number to try
-//   - serviceName: Name of the service for logging purposes
-//
-// Returns:
-//   - int: Available port number, or last attempted port if none found
-func findAvailablePort(basePort int, serviceName string) int {
-	port := basePort
-	maxAttempts := 10
-
-	// Try ports until we find an available one
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		addr := fmt.Sprintf(":%d", port)
-		listener, err := net.Listen("tcp", addr)
-		if err == nil {
-			listener.Close()
-			logrus.WithFields(logrus.Fields{
-				"service": serviceName,
-				"port":    port,
-			}).Info("Found available port")
-			return port
-		}
-		logrus.WithFields(logrus.Fields{
-			"service": serviceName,
-			"port":    port,
-		}).Warn("Port in use, trying next port")
-		port++
-	}
-
-	// Fall back to last attempted port
-	logrus.WithFields(logrus.Fields{
-		"service": serviceName,
-		"port":    port,
-	}).Warn("Failed to find available port, using default")
-	return port
-}
\ No newline at end of file
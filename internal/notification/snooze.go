@@ -0,0 +1,313 @@
+// Package notification implements notification snoozing: notifications for a
+// snoozed user are stored instead of sent, and summarized in one email once
+// the snooze ends
+package notification
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"scraper/internal/deeplink"
+	"scraper/internal/models"
+	"scraper/internal/pricealert"
+	"scraper/internal/proto"
+)
+
+// Suppressed notification types besides the request types
+const (
+	missedTypePriceDrop      = "price_drop"       // Requests without a type are price drops
+	missedTypeBrandPriceDrop = "brand_price_drop" // Price drop from the brand digest
+)
+
+// missedItem is a single product line in the missed notifications summary
+type missedItem struct {
+	ProductID   uint
+	Source      string
+	ProductName string
+	OldPrice    float64
+	NewPrice    float64
+}
+
+// snoozedUntil returns when a user's snooze ends, or nil if the user does not
+// have notifications snoozed.
+//
+// Parameters:
+//   - db: Database connection
+//   - userID: User to check
+//
+// Returns:
+//   - *time.Time: End of the snooze, nil when not snoozed
+//   - error: Any database error
+func snoozedUntil(db *gorm.DB, userID uint) (*time.Time, error) {
+	var user models.User
+	if err := db.Select("id", "notifications_snoozed_until").First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	if until := user.NotificationsSnoozedUntil; until != nil && until.After(time.Now()) {
+		return until, nil
+	}
+	return nil, nil
+}
+
+// parsePriceDrop extracts the prices from a price drop message of the form
+// "Price dropped from X to Y for ...".
+func parsePriceDrop(message string) (oldPrice, newPrice float64, err error) {
+	_, err = fmt.Sscanf(message, "Price dropped from %f to %f for", &oldPrice, &newPrice)
+	return oldPrice, newPrice, err
+}
+
+// suppressIfSnoozed stores the notification instead of sending it when the
+// user has notifications snoozed, see pricealert.Snoozed.
+//
+// Parameters:
+//   - user: User the notification is for
+//   - in: The notification request
+//
+// Returns:
+//   - bool: True if the notification was stored and must not be sent
+//   - error: Any database error
+func (s *NotificationServer) suppressIfSnoozed(user pricealert.User, in *proto.NotificationRequest) (bool, error) {
+	until := pricealert.Snoozed(user, time.Now())
+	if until == nil {
+		return false, nil
+	}
+
+	missed := models.SuppressedNotification{
+		UserID:    user.ID,
+		ProductID: uint(in.ProductId),
+		Source:    in.Source,
+		Type:      in.Type,
+	}
+	if missed.Source == "" {
+		missed.Source = models.SourceTrendyol
+	}
+	if missed.Type == "" {
+		missed.Type = missedTypePriceDrop
+	}
+	if missed.Type == missedTypePriceDrop {
+		missed.OldPrice, missed.NewPrice, _ = parsePriceDrop(in.Message)
+	}
+	if err := s.db.Create(&missed).Error; err != nil {
+		return false, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"user_id":    user.ID,
+		"product_id": in.ProductId,
+		"type":       missed.Type,
+		"until":      until,
+	}).Info("Notification held back by snooze")
+	return true, nil
+}
+
+// sendMissedSummary emails a user everything held back during their snooze.
+// The stored notifications are removed in the same statement that reads them,
+// so concurrent callers cannot send the summary twice; they are restored if
+// the email fails. RETURNING gives the rows in no particular order, so they
+// are listed oldest first.
+//
+// Parameters:
+//   - db: Database connection
+//   - emailService: Service used to send the summary
+//   - userID: User whose snooze ended
+//
+// Returns:
+//   - error: Any database or email error
+func sendMissedSummary(db *gorm.DB, emailService *EmailService, userID uint) error {
+	var missed []models.SuppressedNotification
+	if err := db.Clauses(clause.Returning{}).Where("user_id = ?", userID).Delete(&missed).Error; err != nil {
+		return err
+	}
+	if len(missed) == 0 {
+		return nil
+	}
+	sort.SliceStable(missed, func(i, j int) bool {
+		if !missed[i].CreatedAt.Equal(missed[j].CreatedAt) {
+			return missed[i].CreatedAt.Before(missed[j].CreatedAt)
+		}
+		return missed[i].ID < missed[j].ID
+	})
+
+	sendLimiter().Wait()
+	if err := emailService.SendMissedSummary(userID, missed); err != nil {
+		if err := db.Create(&missed).Error; err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to restore missed notifications")
+		}
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{"user_id": userID, "missed": len(missed)}).Info("Missed notifications summary sent")
+	return nil
+}
+
+// startSnoozeSummaryJob schedules the job that sends the missed notifications
+// summary to users whose snooze ended or was cancelled, even if no new
+// notification arrives for them.
+//
+// Environment Variables:
+//   - SNOOZE_SUMMARY_CRON: Cron expression for the job (default: */5 * * * *)
+//
+// Parameters:
+//   - db: Database connection
+//   - emailService: Service used to send the summaries
+//
+// Returns:
+//   - *cron.Cron: The started scheduler
+func startSnoozeSummaryJob(db *gorm.DB, emailService *EmailService) *cron.Cron {
+	spec := viper.GetString("SNOOZE_SUMMARY_CRON")
+	if spec == "" {
+		spec = "*/5 * * * *" // Every 5 minutes
+	}
+
+	c := cron.New()
+	if _, err := c.AddFunc(spec, func() {
+		sendEndedSnoozeSummaries(db, emailService)
+	}); err != nil {
+		logrus.WithError(err).Fatal("Invalid snooze summary cron expression")
+	}
+	c.Start()
+
+	logrus.WithField("schedule", spec).Info("Snooze summary job scheduled")
+	return c
+}
+
+// sendEndedSnoozeSummaries sends the summary to every user with held back
+// notifications who is no longer snoozed.
+func sendEndedSnoozeSummaries(db *gorm.DB, emailService *EmailService) {
+	var userIDs []uint
+	err := db.Model(&models.SuppressedNotification{}).
+		Joins("JOIN users ON users.id = suppressed_notifications.user_id").
+		Where("users.notifications_snoozed_until IS NULL OR users.notifications_snoozed_until <= ?", time.Now()).
+		Distinct("suppressed_notifications.user_id").
+		Pluck("suppressed_notifications.user_id", &userIDs).Error
+	if err != nil {
+		logrus.WithError(err).Error("Failed to find ended snoozes")
+		return
+	}
+
+	for _, userID := range userIDs {
+		if err := sendMissedSummary(db, emailService, userID); err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to send missed notifications summary")
+		}
+	}
+}
+
+// SendMissedSummary emails a user what they missed while notifications were
+// snoozed. Repeated notifications for a product are collapsed: price drops
+// show the price before the first drop and after the last one.
+//
+// Parameters:
+//   - userID: ID of the user to notify
+//   - missed: Held back notifications, oldest first
+//
+// Returns:
+//   - error: Any error that occurred while rendering or sending the email
+func (es *EmailService) SendMissedSummary(userID uint, missed []models.SuppressedNotification) error {
+	// Retrieve user information
+	var user models.User
+	if err := es.db.First(&user, userID).Error; err != nil {
+		return fmt.Errorf("failed to find user: %w", err)
+	}
+
+	// Collapse notifications per type and product
+	sections := make(map[string][]*missedItem)
+	seen := make(map[string]*missedItem)
+	for _, m := range missed {
+		key := fmt.Sprintf("%s:%s:%d", m.Type, m.Source, m.ProductID)
+		if item, ok := seen[key]; ok {
+			item.NewPrice = m.NewPrice
+			continue
+		}
+		item := &missedItem{ProductID: m.ProductID, Source: m.Source, OldPrice: m.OldPrice, NewPrice: m.NewPrice}
+		var product models.Product
+		if err := es.db.Select("name").Where("id = ? AND source = ?", m.ProductID, m.Source).First(&product).Error; err == nil {
+			item.ProductName = product.Name
+		} else {
+			item.ProductName = fmt.Sprintf("Product %d", m.ProductID)
+		}
+		seen[key] = item
+		sections[m.Type] = append(sections[m.Type], item)
+	}
+
+	// HTML email template with styling
+	tmpl := `
+	<html>
+	<body style="font-family: Arial, sans-serif; color: #333; line-height: 1.6;">
+		<div style="max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #eee; border-radius: 10px;">
+			<h2 style="color: #e91e63; margin-bottom: 20px;">While You Were Away</h2>
+			<p>Hi <b>{{.UserName}}</b>, welcome back! Here is what happened while your notifications were paused:</p>
+			{{if .Drops}}
+			<h3>Price Drops</h3>
+			<ul>
+				{{range .Drops}}<li><a href="{{productLink .ProductID .Source}}">{{.ProductName}}</a> &mdash; <span style="text-decoration: line-through;">{{printf "%.2f" .OldPrice}}</span> <b style="color: #e91e63;">{{printf "%.2f" .NewPrice}}</b></li>{{end}}
+			</ul>
+			{{end}}
+			{{if .BrandDrops}}
+			<h3>Brand Price Drops</h3>
+			<ul>
+				{{range .BrandDrops}}<li><a href="{{productLink .ProductID .Source}}">{{.ProductName}}</a> &mdash; <span style="text-decoration: line-through;">{{printf "%.2f" .OldPrice}}</span> <b style="color: #e91e63;">{{printf "%.2f" .NewPrice}}</b></li>{{end}}
+			</ul>
+			{{end}}
+			{{if .SellerProducts}}
+			<h3>New From Sellers You Follow</h3>
+			<ul>
+				{{range .SellerProducts}}<li><a href="{{productLink .ProductID .Source}}">{{.ProductName}}</a></li>{{end}}
+			</ul>
+			{{end}}
+			{{if .BackInStock}}
+			<h3>Back in Stock</h3>
+			<ul>
+				{{range .BackInStock}}<li><a href="{{productLink .ProductID .Source}}">{{.ProductName}}</a></li>{{end}}
+			</ul>
+			{{end}}
+			{{if .Discontinued}}
+			<h3>Discontinued Favorites</h3>
+			<ul>
+				{{range .Discontinued}}<li>{{.ProductName}}</li>{{end}}
+			</ul>
+			{{end}}
+			<p style="margin-top: 30px; font-size: 0.9em; color: #777;">
+				You are receiving notifications again.
+				<br>Happy Shopping!
+			</p>
+		</div>
+	</body>
+	</html>`
+
+	notificationID := deeplink.NewNotificationID()
+	t, err := template.New("missedSummaryEmail").Funcs(es.productLinks(notificationID, userID)).Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to parse email template: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		UserName       string
+		Drops          []*missedItem
+		BrandDrops     []*missedItem
+		SellerProducts []*missedItem
+		Discontinued   []*missedItem
+		BackInStock    []*missedItem
+	}{
+		UserName:       user.Name,
+		Drops:          sections[missedTypePriceDrop],
+		BrandDrops:     sections[missedTypeBrandPriceDrop],
+		SellerProducts: sections["new_seller_product"],
+		Discontinued:   sections["discontinued"],
+		BackInStock:    sections["back_in_stock"],
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	subject := fmt.Sprintf("You missed %d notifications while away", len(seen))
+	return es.SendMail(user.Email, buf.String(), subject, notificationID)
+}
@@ -0,0 +1,61 @@
+// Package notification implements the email address verification email
+package notification
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"time"
+
+	"scraper/internal/deeplink"
+	"scraper/internal/models"
+)
+
+// SendEmailVerification emails a new user the link that verifies their
+// address.
+//
+// Parameters:
+//   - user: The new user
+//   - link: The verification link, carrying the signed token
+//   - expiresAt: When the link stops working
+//
+// Returns:
+//   - error: Any error that occurred while rendering or sending the email
+func (es *EmailService) SendEmailVerification(user models.User, link string, expiresAt time.Time) error {
+	// HTML email template with styling
+	tmpl := `
+	<html>
+	<body style="font-family: Arial, sans-serif; color: #333; line-height: 1.6;">
+		<div style="max-width: 600px; margin: 0 auto; padding: 20px; border: 1px solid #eee; border-radius: 10px;">
+			<h2 style="color: #e91e63; margin-bottom: 20px;">Verify Your Email Address</h2>
+			<p>Hi <b>{{.UserName}}</b>, welcome! Please confirm that this address is yours to start receiving price drop alerts.</p>
+			<a href="{{.Link}}" style="display: inline-block; background-color: #e91e63; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; margin-top: 15px;">Verify Email Address</a>
+			<p style="margin-top: 30px; font-size: 0.9em; color: #777;">
+				The link expires at {{.ExpiresAt}}. Accounts that are not verified are removed after a while.
+				<br>If you did not create an account, you can ignore this email.
+			</p>
+		</div>
+	</body>
+	</html>`
+
+	notificationID := deeplink.NewNotificationID()
+	t, err := template.New("emailVerificationEmail").Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to parse email template: %w", err)
+	}
+	var buf bytes.Buffer
+	data := struct {
+		UserName  string
+		Link      string
+		ExpiresAt string
+	}{
+		UserName:  user.Name,
+		Link:      link,
+		ExpiresAt: expiresAt.UTC().Format("2006-01-02 15:04 UTC"),
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to execute email template: %w", err)
+	}
+
+	return es.SendMail(user.Email, buf.String(), "Verify your email address", notificationID)
+}
@@ -0,0 +1,306 @@
+// Package outbox implements the transactional outbox. Handlers that change
+// data and announce the change on Kafka write the message with Add in the
+// same database transaction, and a Relay publishes it afterwards. A crash
+// between the commit and the publish then delays the event instead of losing
+// it. Delivery is at least once: a relay that stops after publishing but
+// before marking an event delivered publishes it again.
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/metrics"
+	"scraper/internal/models"
+)
+
+// relayLockID is the Postgres advisory lock held while relaying, so only one
+// relay across all services publishes at a time and key order is kept
+const relayLockID = 0x6f7574626f78 // "outbox"
+
+// cleanupInterval is how often delivered events are deleted
+const cleanupInterval = 10 * time.Minute
+
+// maxFailedKeys ends a relay round once events of this many keys failed;
+// Kafka is most likely unavailable and every further send would time out
+const maxFailedKeys = 3
+
+// maxRetryDelay caps the backoff between failed relay rounds
+const maxRetryDelay = time.Minute
+
+// Outbox metrics
+var (
+	publishedTotal = metrics.NewCounter(
+		"outbox_publish_total",
+		"Outbox events sent to Kafka by result (ok, failed)",
+		"result",
+	)
+	outboxLag = metrics.NewGauge(
+		"outbox_lag_seconds",
+		"Age of the oldest outbox event that is not yet published",
+	)
+	outboxPending = metrics.NewGauge(
+		"outbox_pending",
+		"Outbox events waiting to be published",
+	)
+)
+
+// Add writes a Kafka message to the outbox. Call it with the transaction
+// that changes the data the message announces.
+//
+// Parameters:
+//   - tx: Transaction of the data change
+//   - msg: Message to publish, built like one sent to the producer directly
+//
+// Returns:
+//   - error: If the message cannot be encoded or stored
+func Add(tx *gorm.DB, msg *sarama.ProducerMessage) error {
+	event := models.OutboxEvent{Topic: msg.Topic}
+	if msg.Key != nil {
+		key, err := msg.Key.Encode()
+		if err != nil {
+			return err
+		}
+		event.Key = string(key)
+	}
+	if msg.Value != nil {
+		payload, err := msg.Value.Encode()
+		if err != nil {
+			return err
+		}
+		event.Payload = payload
+	}
+	return tx.Create(&event).Error
+}
+
+// Relay publishes pending outbox events to Kafka. Every service with a Kafka
+// producer runs one; an advisory lock lets only one of them publish at a
+// time, so the others take over when it stops.
+type Relay struct {
+	db           *gorm.DB
+	producer     sarama.SyncProducer
+	pollInterval time.Duration
+	batchSize    int
+	retention    time.Duration
+	lastCleanup  time.Time
+	quit         chan struct{} // Closed by Stop
+	done         chan struct{} // Closed once run returned
+}
+
+// NewRelay creates a relay from the environment. Call Start to begin
+// publishing.
+//
+// Environment Variables:
+//   - OUTBOX_POLL_INTERVAL: How often pending events are read (default: 1s)
+//   - OUTBOX_BATCH_SIZE: Events published per round at most (default: 100)
+//   - OUTBOX_RETENTION: How long delivered events are kept (default: 24h)
+//
+// Parameters:
+//   - db: Database connection
+//   - producer: Producer the events are published with
+//
+// Returns:
+//   - *Relay: The configured relay
+func NewRelay(db *gorm.DB, producer sarama.SyncProducer) *Relay {
+	pollInterval := viper.GetDuration("OUTBOX_POLL_INTERVAL")
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	batchSize := viper.GetInt("OUTBOX_BATCH_SIZE")
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	retention := viper.GetDuration("OUTBOX_RETENTION")
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+
+	return &Relay{
+		db:           db,
+		producer:     producer,
+		pollInterval: pollInterval,
+		batchSize:    batchSize,
+		retention:    retention,
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start launches the background worker that publishes pending events.
+//
+// Parameters:
+//   - service: Name of the service running the relay, for logs
+func (r *Relay) Start(service string) {
+	logrus.WithFields(logrus.Fields{
+		"service":       service,
+		"poll_interval": r.pollInterval,
+	}).Info("Outbox relay started")
+	go r.run()
+}
+
+// Stop ends the background worker after the round it is publishing. Events
+// still pending are published by the relay of another service, or by this
+// one after a restart.
+//
+// Parameters:
+//   - ctx: Bounds the wait for the current round
+//
+// Returns:
+//   - error: ctx's error if the round did not finish in time
+func (r *Relay) Stop(ctx context.Context) error {
+	close(r.quit)
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run publishes pending events every poll interval, backing off
+// exponentially while Kafka or the database fail.
+func (r *Relay) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	var retryAt time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.quit:
+			return
+		}
+		if time.Now().Before(retryAt) {
+			continue
+		}
+		if err := r.relay(); err != nil {
+			failures++
+			delay := r.pollInterval << uint(failures)
+			if delay > maxRetryDelay || delay <= 0 {
+				delay = maxRetryDelay
+			}
+			retryAt = time.Now().Add(delay)
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"failures": failures,
+				"retry_in": delay,
+			}).Error("Outbox relay failed")
+		} else {
+			failures = 0
+		}
+		r.updateLag()
+	}
+}
+
+// relay publishes up to one batch of pending events, oldest first, while
+// holding the relay lock. When an event fails, later events with the same key
+// are held back until the next round so each key stays in order, and the
+// round ends once maxFailedKeys keys failed.
+//
+// Returns:
+//   - error: If the batch could not be read or an event could not be
+//     published; delivered events are still marked
+func (r *Relay) relay() error {
+	var locked bool
+	var publishErr error
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Another relay is publishing; the lock is released with its transaction
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", relayLockID).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+
+		var pending []models.OutboxEvent
+		if err := tx.Where("delivered_at IS NULL").Order("id").Limit(r.batchSize).Find(&pending).Error; err != nil {
+			return err
+		}
+
+		blocked := make(map[string]bool)
+		for _, event := range pending {
+			if blocked[event.Key] {
+				continue
+			}
+			msg := &sarama.ProducerMessage{Topic: event.Topic, Value: sarama.ByteEncoder(event.Payload)}
+			if event.Key != "" {
+				msg.Key = sarama.StringEncoder(event.Key)
+			}
+
+			if _, _, err := r.producer.SendMessage(msg); err != nil {
+				publishedTotal.Inc("failed")
+				blocked[event.Key] = true
+				publishErr = err
+				err = tx.Model(&event).Updates(map[string]interface{}{
+					"attempts":   gorm.Expr("attempts + 1"),
+					"last_error": err.Error(),
+				}).Error
+				if err != nil {
+					return err
+				}
+				if len(blocked) >= maxFailedKeys {
+					break
+				}
+				continue
+			}
+
+			publishedTotal.Inc("ok")
+			if err := tx.Model(&event).Update("delivered_at", time.Now()).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Outside the transaction, so a failed cleanup cannot undo the deliveries
+	if locked && time.Since(r.lastCleanup) >= cleanupInterval {
+		r.cleanup()
+	}
+	return publishErr
+}
+
+// cleanup deletes events delivered longer than the retention ago. Failures
+// are logged and retried on the next cleanup.
+func (r *Relay) cleanup() {
+	result := r.db.Where("delivered_at < ?", time.Now().Add(-r.retention)).Delete(&models.OutboxEvent{})
+	if result.Error != nil {
+		logrus.WithError(result.Error).Error("Failed to clean up outbox")
+		return
+	}
+	r.lastCleanup = time.Now()
+	if result.RowsAffected > 0 {
+		logrus.WithField("deleted", result.RowsAffected).Info("Cleaned up delivered outbox events")
+	}
+}
+
+// updateLag refreshes the pending and lag gauges.
+func (r *Relay) updateLag() {
+	var stats struct {
+		Pending int64
+		Oldest  *time.Time
+	}
+	err := r.db.Model(&models.OutboxEvent{}).
+		Select("count(*) AS pending, min(created_at) AS oldest").
+		Where("delivered_at IS NULL").
+		Scan(&stats).Error
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to read outbox lag")
+		return
+	}
+
+	outboxPending.Set(float64(stats.Pending))
+	lag := 0.0
+	if stats.Oldest != nil {
+		lag = time.Since(*stats.Oldest).Seconds()
+	}
+	outboxLag.Set(lag)
+}
@@ -0,0 +1,296 @@
+// Package pricealert implements the decision of whether, and how, a user is
+// notified about a price drop. The favorites consumer and the notification
+// service make their part of the decision through it, and the notification
+// preview runs all of it, so a preview cannot drift from what is sent.
+//
+// The decision runs in stages, in this order:
+//  1. The drop passes the system-wide floors, unless the change bypasses them
+//  2. The user exists, is not deleted and is active
+//  3. The user has not muted their favorite of the product
+//  4. The new price is at or below the favorite's target price, if it has one
+//  5. The user verified their email address
+//  6. The product's deal score meets the user's minimum, if they set one
+//  7. Snoozed users get the notification in their snooze summary instead
+//  8. In dry-run mode, addresses outside the allowlist are only logged
+//
+// The favorites consumer applies stages 1-6 before queueing a notification,
+// the notification service stages 2, 3, 7 and 8 when delivering it.
+package pricealert
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+	"scraper/internal/pricing"
+)
+
+// Decision statuses
+const (
+	StatusSend    = "send"    // Emailed
+	StatusDryRun  = "dry_run" // Rendered and logged but not sent, see NOTIFICATIONS_DRY_RUN
+	StatusSnoozed = "snoozed" // Held back for the summary sent when the snooze ends
+	StatusSkipped = "skipped" // Not notified, see Decision.Reason
+)
+
+// Channels a notification reaches the user through
+const (
+	ChannelEmail         = "email"          // Sent right away
+	ChannelDeliveryLog   = "delivery_log"   // Recorded in notification_logs only
+	ChannelSnoozeSummary = "snooze_summary" // Part of the missed notifications summary
+)
+
+// Reasons a user is skipped
+const (
+	ReasonNotADrop        = "not_a_drop"               // The price did not decrease
+	ReasonBelowAbsolute   = "below_min_drop_absolute"  // The drop is under MIN_DROP_ABSOLUTE
+	ReasonBelowPercent    = "below_min_drop_percent"   // The drop is under MIN_DROP_PERCENT
+	ReasonUserNotFound    = "user_not_found"           // The user does not exist or was deleted
+	ReasonUserInactive    = "user_inactive"            // The account is deactivated
+	ReasonFavoriteMuted   = "favorite_muted"           // The user muted their favorite of the product
+	ReasonAboveTarget     = "above_target_price"       // The new price is above the favorite's target price
+	ReasonEmailUnverified = "email_not_verified"       // The user never opened the verification link
+	ReasonDealScore       = "deal_score_below_minimum" // The product's deal score is under the user's minimum
+)
+
+// floorReasons maps pricing floors to skip reasons
+var floorReasons = map[string]string{
+	pricing.FloorNotADrop: ReasonNotADrop,
+	pricing.FloorAbsolute: ReasonBelowAbsolute,
+	pricing.FloorPercent:  ReasonBelowPercent,
+}
+
+// Change is a price change of a product
+type Change struct {
+	OldPrice      float64
+	NewPrice      float64
+	BypassMinDrop bool     // Notify regardless of the floors, e.g. simulated drops
+	DealScore     *float64 // Deal score of the new price; nil for sparse history
+}
+
+// User is what the decision needs to know about a user
+type User struct {
+	ID           uint
+	Email        string
+	Found        bool // Exists and is not deleted
+	Active       bool
+	Verified     bool
+	MinDealScore *float64   // nil notifies about every drop
+	SnoozedUntil *time.Time // nil when notifications were never snoozed
+	Muted        bool       // Muted their favorite of the product, see MarkFavorites
+	TargetPrice  *float64   // Target price of their favorite; nil notifies about every drop, see MarkFavorites
+}
+
+// Decision is the outcome for one user
+type Decision struct {
+	UserID  uint   `json:"user_id"`
+	Status  string `json:"status"`            // One of the Status constants
+	Channel string `json:"channel,omitempty"` // One of the Channel constants; empty when skipped
+	Reason  string `json:"reason,omitempty"`  // One of the Reason constants; skipped users only
+}
+
+// Decide runs every stage for one user.
+//
+// Parameters:
+//   - change: The price change
+//   - user: The user who favorited the product
+//   - now: Time of the decision, compared with the end of a snooze
+//   - holdBack: Reports whether dry-run mode keeps an email to an address
+//     from being sent
+//
+// Returns:
+//   - Decision: Whether and how the user is notified
+func Decide(change Change, user User, now time.Time, holdBack func(address string) bool) Decision {
+	if reason := Eligible(change, user); reason != "" {
+		return Decision{UserID: user.ID, Status: StatusSkipped, Reason: reason}
+	}
+	status, channel := Route(user, now, holdBack)
+	return Decision{UserID: user.ID, Status: status, Channel: channel}
+}
+
+// DropReason returns why a change notifies nobody, whoever favorited it.
+//
+// Parameters:
+//   - change: The price change
+//
+// Returns:
+//   - string: A floor Reason constant; empty if the change may notify
+func DropReason(change Change) string {
+	if change.BypassMinDrop {
+		return ""
+	}
+	return floorReasons[pricing.FloorReason(change.OldPrice, change.NewPrice)]
+}
+
+// UserReason returns why a user gets no notification of any kind.
+//
+// Parameters:
+//   - user: The user to notify
+//
+// Returns:
+//   - string: ReasonUserNotFound or ReasonUserInactive; empty if the user
+//     may be notified
+func UserReason(user User) string {
+	switch {
+	case !user.Found:
+		return ReasonUserNotFound
+	case !user.Active:
+		return ReasonUserInactive
+	}
+	return ""
+}
+
+// Eligible runs the stages that decide whether a user is notified about a
+// price change at all, the ones the favorites consumer applies.
+//
+// Parameters:
+//   - change: The price change
+//   - user: The user who favorited the product
+//
+// Returns:
+//   - string: The Reason the user is skipped; empty if they are notified
+func Eligible(change Change, user User) string {
+	if reason := DropReason(change); reason != "" {
+		return reason
+	}
+	if reason := UserReason(user); reason != "" {
+		return reason
+	}
+	if user.Muted {
+		return ReasonFavoriteMuted
+	}
+	if user.TargetPrice != nil && change.NewPrice > *user.TargetPrice {
+		return ReasonAboveTarget
+	}
+	if !user.Verified {
+		return ReasonEmailUnverified
+	}
+	if !pricing.MeetsDealScore(user.MinDealScore, change.DealScore) {
+		return ReasonDealScore
+	}
+	return ""
+}
+
+// Snoozed returns the end of the user's snooze if it is still running.
+//
+// Parameters:
+//   - user: The user to notify
+//   - now: Time of the decision
+//
+// Returns:
+//   - *time.Time: End of the snooze; nil when notifications are not held back
+func Snoozed(user User, now time.Time) *time.Time {
+	if until := user.SnoozedUntil; until != nil && until.After(now) {
+		return until
+	}
+	return nil
+}
+
+// Route decides how an eligible user is notified, the stages the
+// notification service applies.
+//
+// Parameters:
+//   - user: The user to notify
+//   - now: Time of the decision
+//   - holdBack: Reports whether dry-run mode keeps an email to an address
+//     from being sent
+//
+// Returns:
+//   - string: StatusSend, StatusDryRun or StatusSnoozed
+//   - string: The matching Channel constant
+func Route(user User, now time.Time, holdBack func(address string) bool) (string, string) {
+	switch {
+	case Snoozed(user, now) != nil:
+		return StatusSnoozed, ChannelSnoozeSummary
+	case holdBack(user.Email):
+		return StatusDryRun, ChannelDeliveryLog
+	}
+	return StatusSend, ChannelEmail
+}
+
+// LoadUsers loads what the decision needs to know about users. Users that do
+// not exist or are deleted are returned with Found unset.
+//
+// Parameters:
+//   - db: Database connection
+//   - userIDs: Users to load
+//
+// Returns:
+//   - []User: One per ID, in order
+//   - error: Any database error
+func LoadUsers(db *gorm.DB, userIDs []uint) ([]User, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+	var rows []models.User
+	err := db.Select("id", "email", "is_active", "verified", "min_deal_score", "notifications_snoozed_until").
+		Where("id IN ?", userIDs).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.User, len(rows))
+	for _, row := range rows {
+		byID[row.ID] = row
+	}
+
+	users := make([]User, len(userIDs))
+	for i, id := range userIDs {
+		row, ok := byID[id]
+		if !ok {
+			users[i] = User{ID: id}
+			continue
+		}
+		users[i] = User{
+			ID:           id,
+			Email:        row.Email,
+			Found:        true,
+			Active:       row.IsActive,
+			Verified:     row.Verified,
+			MinDealScore: row.MinDealScore,
+			SnoozedUntil: row.NotificationsSnoozedUntil,
+		}
+	}
+	return users, nil
+}
+
+// MarkFavorites sets what the users' favorites of a product add to the
+// decision: Muted if the favorite is muted at a time, where a mute with a
+// MutedUntil in the past has ended, and TargetPrice.
+//
+// Parameters:
+//   - db: Database connection
+//   - users: Users loaded by LoadUsers; updated in place
+//   - productID: Product the notification is about
+//   - source: Marketplace of the product
+//   - now: Time of the decision
+//
+// Returns:
+//   - error: Any database error
+func MarkFavorites(db *gorm.DB, users []User, productID uint, source string, now time.Time) error {
+	if len(users) == 0 {
+		return nil
+	}
+	userIDs := make([]uint, len(users))
+	for i, user := range users {
+		userIDs[i] = user.ID
+	}
+	var favorites []models.UserFavorite
+	err := db.Select("user_id", "muted", "muted_until", "target_price").
+		Where("product_id = ? AND source = ? AND user_id IN ?", productID, source, userIDs).
+		Find(&favorites).Error
+	if err != nil {
+		return err
+	}
+	byUser := make(map[uint]models.UserFavorite, len(favorites))
+	for _, favorite := range favorites {
+		byUser[favorite.UserID] = favorite
+	}
+	for i := range users {
+		favorite := byUser[users[i].ID]
+		users[i].Muted = favorite.Muted && (favorite.MutedUntil == nil || favorite.MutedUntil.After(now))
+		users[i].TargetPrice = favorite.TargetPrice
+	}
+	return nil
+}
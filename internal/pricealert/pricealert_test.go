@@ -0,0 +1,47 @@
+package pricealert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecide(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+	score, minimum, target := 40.0, 60.0, 79.0
+	drop := Change{OldPrice: 100, NewPrice: 80, DealScore: &score}
+	user := User{ID: 1, Email: "user@example.com", Found: true, Active: true, Verified: true}
+	holdBack := func(address string) bool { return address == "held@example.com" }
+
+	tests := []struct {
+		name   string
+		change Change
+		user   func(User) User
+		want   Decision
+	}{
+		{"sent", drop, nil, Decision{Status: StatusSend, Channel: ChannelEmail}},
+		{"price increase", Change{OldPrice: 80, NewPrice: 100}, nil, Decision{Status: StatusSkipped, Reason: ReasonNotADrop}},
+		{"under the floor", Change{OldPrice: 100, NewPrice: 99.5}, nil, Decision{Status: StatusSkipped, Reason: ReasonBelowAbsolute}},
+		{"floor bypassed", Change{OldPrice: 100, NewPrice: 99.5, BypassMinDrop: true}, nil, Decision{Status: StatusSend, Channel: ChannelEmail}},
+		{"deleted", drop, func(u User) User { u.Found = false; return u }, Decision{Status: StatusSkipped, Reason: ReasonUserNotFound}},
+		{"inactive", drop, func(u User) User { u.Active = false; return u }, Decision{Status: StatusSkipped, Reason: ReasonUserInactive}},
+		{"muted", drop, func(u User) User { u.Muted = true; u.Verified = false; return u }, Decision{Status: StatusSkipped, Reason: ReasonFavoriteMuted}},
+		{"above target", drop, func(u User) User { u.TargetPrice = &target; return u }, Decision{Status: StatusSkipped, Reason: ReasonAboveTarget}},
+		{"target reached", Change{OldPrice: 100, NewPrice: 79}, func(u User) User { u.TargetPrice = &target; return u }, Decision{Status: StatusSend, Channel: ChannelEmail}},
+		{"unverified", drop, func(u User) User { u.Verified = false; return u }, Decision{Status: StatusSkipped, Reason: ReasonEmailUnverified}},
+		{"deal score", drop, func(u User) User { u.MinDealScore = &minimum; return u }, Decision{Status: StatusSkipped, Reason: ReasonDealScore}},
+		{"snoozed", drop, func(u User) User { u.SnoozedUntil = &later; return u }, Decision{Status: StatusSnoozed, Channel: ChannelSnoozeSummary}},
+		{"snooze ended", drop, func(u User) User { u.SnoozedUntil = &earlier; return u }, Decision{Status: StatusSend, Channel: ChannelEmail}},
+		{"dry run", drop, func(u User) User { u.Email = "held@example.com"; return u }, Decision{Status: StatusDryRun, Channel: ChannelDeliveryLog}},
+	}
+	for _, tt := range tests {
+		u := user
+		if tt.user != nil {
+			u = tt.user(u)
+		}
+		tt.want.UserID = u.ID
+		if got := Decide(tt.change, u, now, holdBack); got != tt.want {
+			t.Errorf("%s: Decide = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package pricing
+
+import (
+	"math"
+	"time"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/models"
+)
+
+// dealScoreWindow returns how far back the deal score looks.
+//
+// Environment Variables:
+//   - DEAL_SCORE_WINDOW: Trailing price history compared against (default: 2160h, 90 days)
+func dealScoreWindow() time.Duration {
+	if window := viper.GetDuration("DEAL_SCORE_WINDOW"); window > 0 {
+		return window
+	}
+	return 90 * 24 * time.Hour
+}
+
+// dealScoreMinPoints returns how many logged prices a deal score needs.
+//
+// Environment Variables:
+//   - DEAL_SCORE_MIN_POINTS: Logged prices required in the window (default: 5)
+func dealScoreMinPoints() int64 {
+	if points := viper.GetInt64("DEAL_SCORE_MIN_POINTS"); points > 0 {
+		return points
+	}
+	return 5
+}
+
+// DealScore rates a price against the prices a product had in the trailing
+// DEAL_SCORE_WINDOW: the percentage of logged prices that were higher, with
+// equal prices counting half. 100 means the product was never this cheap, 0
+// that it was never more expensive. The percentile is computed in SQL over
+// price_stock_logs.
+//
+// Parameters:
+//   - db: Database connection
+//   - productID: Product the price belongs to
+//   - source: Marketplace of the product
+//   - price: Price to rate, usually the new current price
+//
+// Returns:
+//   - *float64: Score from 0 to 100 rounded to one decimal, nil when fewer
+//     than DEAL_SCORE_MIN_POINTS prices were logged in the window
+//   - error: Any database error
+func DealScore(db *gorm.DB, productID uint, source string, price float64) (*float64, error) {
+	var stats struct {
+		Total  int64
+		Higher int64
+		Equal  int64
+	}
+	err := db.Model(&models.PriceStockLog{}).
+		Select("count(*) AS total, count(*) FILTER (WHERE price_value > ?) AS higher, count(*) FILTER (WHERE price_value = ?) AS equal", price, price).
+		Where("product_id = ? AND source = ? AND price_value IS NOT NULL AND change_time >= ?", productID, source, time.Now().Add(-dealScoreWindow())).
+		Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	if stats.Total < dealScoreMinPoints() {
+		return nil, nil
+	}
+
+	score := math.Round((float64(stats.Higher)+float64(stats.Equal)/2)/float64(stats.Total)*1000) / 10
+	return &score, nil
+}
+
+// RefreshDealScore recomputes and stores the deal score of a product after
+// its price changed.
+//
+// Parameters:
+//   - db: Database connection
+//   - productID: Product whose price changed
+//   - source: Marketplace of the product
+//   - price: New current price
+//
+// Returns:
+//   - *float64: The stored score, nil for sparse history
+//   - error: Any database error; the stored score is then unchanged
+func RefreshDealScore(db *gorm.DB, productID uint, source string, price float64) (*float64, error) {
+	score, err := DealScore(db, productID, source, price)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Model(&models.Product{}).
+		Where("id = ? AND source = ?", productID, source).
+		Update("deal_score", score).Error
+	return score, err
+}
+
+// MeetsDealScore reports whether a product's deal score satisfies a user's
+// minimum. Without a minimum every product qualifies; with one, a product
+// without a score never does.
+//
+// Parameters:
+//   - minimum: The user's minimum deal score, nil when not set
+//   - score: The product's deal score, nil for sparse history
+func MeetsDealScore(minimum, score *float64) bool {
+	if minimum == nil {
+		return true
+	}
+	return score != nil && *score >= *minimum
+}
@@ -0,0 +1,90 @@
+// Package pricing contains price change rules shared by every service that
+// detects price drops.
+package pricing
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"scraper/internal/metrics"
+)
+
+// suppressedDrops counts drops ignored because they fall under a global floor
+var suppressedDrops = metrics.NewCounter(
+	"price_drops_suppressed_total",
+	"Price drops ignored because they are below the global minimum-drop floor",
+	"reason",
+)
+
+// Floors a price change can fall under, as reported by FloorReason
+const (
+	FloorNotADrop = "not_a_drop" // The price did not decrease, or there was no old price
+	FloorAbsolute = "absolute"   // The drop is under MIN_DROP_ABSOLUTE
+	FloorPercent  = "percent"    // The drop is under MIN_DROP_PERCENT
+)
+
+// FloorReason returns which system-wide minimum-drop floor a price change
+// falls under, without counting it. Decisions that are only previewed use it
+// directly; the notification path goes through IsSignificantDrop.
+//
+// Environment Variables:
+//   - MIN_DROP_ABSOLUTE: Smallest absolute drop worth notifying (default: 1)
+//   - MIN_DROP_PERCENT: Smallest relative drop in percent (default: 1)
+//
+// Parameters:
+//   - oldPrice: Price before the change
+//   - newPrice: Price after the change
+//
+// Returns:
+//   - string: One of the Floor constants; empty if the drop passes
+func FloorReason(oldPrice, newPrice float64) string {
+	if oldPrice <= 0 || newPrice >= oldPrice {
+		return FloorNotADrop
+	}
+
+	minAbsolute := 1.0
+	if viper.IsSet("MIN_DROP_ABSOLUTE") {
+		minAbsolute = viper.GetFloat64("MIN_DROP_ABSOLUTE")
+	}
+	minPercent := 1.0
+	if viper.IsSet("MIN_DROP_PERCENT") {
+		minPercent = viper.GetFloat64("MIN_DROP_PERCENT")
+	}
+
+	drop := oldPrice - newPrice
+	switch {
+	case drop < minAbsolute:
+		return FloorAbsolute
+	case drop/oldPrice*100 < minPercent:
+		return FloorPercent
+	}
+	return ""
+}
+
+// IsSignificantDrop reports whether a price decrease passes the system-wide
+// minimum-drop floors, see FloorReason. It protects users from noise caused
+// by float jitter in scraped prices and runs before any per-user notification
+// logic. Drops under a floor are counted in price_drops_suppressed_total.
+//
+// Parameters:
+//   - oldPrice: Price before the change
+//   - newPrice: Price after the change
+//
+// Returns:
+//   - bool: true if the drop should be acted upon
+func IsSignificantDrop(oldPrice, newPrice float64) bool {
+	reason := FloorReason(oldPrice, newPrice)
+	switch reason {
+	case "":
+		return true
+	case FloorNotADrop:
+		return false
+	}
+	suppressedDrops.Inc(reason)
+	logrus.WithFields(logrus.Fields{
+		"old_price": oldPrice,
+		"new_price": newPrice,
+		"reason":    reason,
+	}).Debug("Suppressed price drop below global floor")
+	return false
+}
@@ -0,0 +1,194 @@
+// Package productdiff describes how a product changed between two crawls
+// besides its price: another seller winning the listing, the stock moving
+// into another band, the rating moving, or a discount starting or ending.
+// The analysis consumer computes the changes when it applies a product, and
+// price drop emails list them under "What else changed".
+package productdiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/spf13/viper"
+	"gorm.io/datatypes"
+
+	"scraper/internal/models"
+)
+
+// Fields a Change can report, in the order Diff returns them
+const (
+	FieldSeller   = "seller"   // Another seller wins the listing
+	FieldStock    = "stock"    // The stock moved into another band
+	FieldRating   = "rating"   // The average rating moved by at least 0.1
+	FieldDiscount = "discount" // A discount started or ended
+)
+
+// Stock bands
+const (
+	StockInStock    = "in_stock"     // More than LOW_STOCK_THRESHOLD units
+	StockLow        = "low"          // LOW_STOCK_THRESHOLD units or fewer
+	StockOutOfStock = "out_of_stock" // No units left
+)
+
+// NoDiscount is the value of a discount change when the product is sold at
+// its original price
+const NoDiscount = "none"
+
+// Change is one field of a product that changed, with both values formatted
+// for display
+type Change struct {
+	Field string `json:"field"` // One of the Field* constants
+	Old   string `json:"old"`   // Value before the change
+	New   string `json:"new"`   // Value after the change
+}
+
+// Valid reports whether the change names a known field and actually changed.
+func (c Change) Valid() bool {
+	switch c.Field {
+	case FieldSeller, FieldStock, FieldRating, FieldDiscount:
+		return c.Old != c.New
+	}
+	return false
+}
+
+// lowStockThreshold returns the number of units at or below which stock is
+// reported as low.
+//
+// Environment Variables:
+//   - LOW_STOCK_THRESHOLD: Units at or below which stock is low (default: 5)
+func lowStockThreshold() float64 {
+	if threshold := viper.GetInt("LOW_STOCK_THRESHOLD"); threshold > 0 {
+		return float64(threshold)
+	}
+	return 5
+}
+
+// StockBand returns the band of a stock quantity.
+//
+// Parameters:
+//   - quantity: Units in stock
+//
+// Returns:
+//   - string: StockOutOfStock, StockLow or StockInStock
+func StockBand(quantity float64) string {
+	switch {
+	case quantity <= 0:
+		return StockOutOfStock
+	case quantity <= lowStockThreshold():
+		return StockLow
+	}
+	return StockInStock
+}
+
+// Diff compares two copies of a product. Fields missing or malformed in
+// either copy are not compared, so a partial update never reports a change
+// of a field it does not carry.
+//
+// Parameters:
+//   - before: Product as stored before the update
+//   - after: Product being applied
+//
+// Returns:
+//   - []Change: The changes in field order; nil if nothing else changed
+func Diff(before, after models.Product) []Change {
+	var changes []Change
+	if before.SellerID != 0 && after.SellerID != 0 && before.SellerID != after.SellerID {
+		old, current := sellerName(before.Seller, before.SellerID), sellerName(after.Seller, after.SellerID)
+		if old == current {
+			// Both seller details name the same company; tell the listings
+			// apart by ID
+			old, current = fmt.Sprintf("seller %d", before.SellerID), fmt.Sprintf("seller %d", after.SellerID)
+		}
+		changes = append(changes, Change{Field: FieldSeller, Old: old, New: current})
+	}
+
+	if old, ok := stockQuantity(before.StockInfo); ok {
+		if current, ok := stockQuantity(after.StockInfo); ok {
+			if oldBand, newBand := StockBand(old), StockBand(current); oldBand != newBand {
+				changes = append(changes, Change{Field: FieldStock, Old: oldBand, New: newBand})
+			}
+		}
+	}
+
+	if old, ok := averageRating(before.RatingScore); ok {
+		if current, ok := averageRating(after.RatingScore); ok {
+			// Compare in tenths, as displayed, so float drift is not a change
+			if math.Round(current*10) != math.Round(old*10) {
+				changes = append(changes, Change{
+					Field: FieldRating,
+					Old:   fmt.Sprintf("%.1f", old),
+					New:   fmt.Sprintf("%.1f", current),
+				})
+			}
+		}
+	}
+
+	if old, ok := discountPercent(before.PriceInfo); ok {
+		// A deeper discount is the price drop itself; only report campaigns
+		// starting or ending
+		if current, ok := discountPercent(after.PriceInfo); ok && (old > 0) != (current > 0) {
+			changes = append(changes, Change{Field: FieldDiscount, Old: formatDiscount(old), New: formatDiscount(current)})
+		}
+	}
+	return changes
+}
+
+// sellerName returns the seller's official name, or its ID when the Seller
+// column has no name.
+func sellerName(raw datatypes.JSON, id uint) string {
+	var seller struct {
+		OfficialName string `json:"officialName"`
+	}
+	if len(raw) > 0 && json.Unmarshal(raw, &seller) == nil && seller.OfficialName != "" {
+		return seller.OfficialName
+	}
+	return fmt.Sprintf("seller %d", id)
+}
+
+// stockQuantity decodes the quantity of a StockInfo column.
+func stockQuantity(raw datatypes.JSON) (float64, bool) {
+	var stock struct {
+		Stock *float64 `json:"stock"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &stock) != nil || stock.Stock == nil {
+		return 0, false
+	}
+	return *stock.Stock, true
+}
+
+// averageRating decodes the average of a RatingScore column. Products
+// without ratings report 0, which is not compared.
+func averageRating(raw datatypes.JSON) (float64, bool) {
+	var rating struct {
+		AverageRating float64 `json:"averageRating"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &rating) != nil || rating.AverageRating <= 0 {
+		return 0, false
+	}
+	return rating.AverageRating, true
+}
+
+// discountPercent decodes the discount of a PriceInfo column in whole
+// percent of the original price.
+func discountPercent(raw datatypes.JSON) (int, bool) {
+	var pricing struct {
+		Price         *float64 `json:"price"`
+		OriginalPrice *float64 `json:"originalPrice"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &pricing) != nil || pricing.Price == nil || pricing.OriginalPrice == nil {
+		return 0, false
+	}
+	if *pricing.OriginalPrice <= 0 || *pricing.Price >= *pricing.OriginalPrice {
+		return 0, true
+	}
+	return int(math.Round((1 - *pricing.Price / *pricing.OriginalPrice) * 100)), true
+}
+
+// formatDiscount formats a discount percentage for display.
+func formatDiscount(percent int) string {
+	if percent == 0 {
+		return NoDiscount
+	}
+	return fmt.Sprintf("%d%% off", percent)
+}
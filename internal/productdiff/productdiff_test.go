@@ -0,0 +1,110 @@
+package productdiff
+
+import (
+	"reflect"
+	"testing"
+
+	"gorm.io/datatypes"
+
+	"scraper/internal/models"
+)
+
+func TestDiff(t *testing.T) {
+	base := models.Product{
+		SellerID:    1,
+		Seller:      datatypes.JSON(`{"officialName": "Acme Ltd"}`),
+		StockInfo:   datatypes.JSON(`{"stock": 40, "disabled": false}`),
+		RatingScore: datatypes.JSON(`{"averageRating": 4.21, "commentCount": 10}`),
+		PriceInfo:   datatypes.JSON(`{"price": 80, "originalPrice": 100, "currency": "TRY"}`),
+	}
+
+	tests := []struct {
+		name   string
+		change func(p models.Product) models.Product
+		want   []Change
+	}{
+		{"unchanged", func(p models.Product) models.Product { return p }, nil},
+		{"seller", func(p models.Product) models.Product {
+			p.SellerID, p.Seller = 2, datatypes.JSON(`{"officialName": "Bolt Inc"}`)
+			return p
+		}, []Change{{FieldSeller, "Acme Ltd", "Bolt Inc"}}},
+		{"seller without a name", func(p models.Product) models.Product {
+			p.SellerID, p.Seller = 2, nil
+			return p
+		}, []Change{{FieldSeller, "Acme Ltd", "seller 2"}}},
+		{"seller unknown", func(p models.Product) models.Product { p.SellerID = 0; return p }, nil},
+		{"stock low", func(p models.Product) models.Product {
+			p.StockInfo = datatypes.JSON(`{"stock": 3}`)
+			return p
+		}, []Change{{FieldStock, StockInStock, StockLow}}},
+		{"stock out", func(p models.Product) models.Product {
+			p.StockInfo = datatypes.JSON(`{"stock": 0}`)
+			return p
+		}, []Change{{FieldStock, StockInStock, StockOutOfStock}}},
+		{"stock in the same band", func(p models.Product) models.Product {
+			p.StockInfo = datatypes.JSON(`{"stock": 12}`)
+			return p
+		}, nil},
+		{"stock missing", func(p models.Product) models.Product { p.StockInfo = nil; return p }, nil},
+		{"rating", func(p models.Product) models.Product {
+			p.RatingScore = datatypes.JSON(`{"averageRating": 3.9}`)
+			return p
+		}, []Change{{FieldRating, "4.2", "3.9"}}},
+		{"rating drift", func(p models.Product) models.Product {
+			p.RatingScore = datatypes.JSON(`{"averageRating": 4.24}`)
+			return p
+		}, nil},
+		{"rating malformed", func(p models.Product) models.Product {
+			p.RatingScore = datatypes.JSON(`"n/a"`)
+			return p
+		}, nil},
+		{"discount ended", func(p models.Product) models.Product {
+			p.PriceInfo = datatypes.JSON(`{"price": 100, "originalPrice": 100}`)
+			return p
+		}, []Change{{FieldDiscount, "20% off", NoDiscount}}},
+		{"discount deepened", func(p models.Product) models.Product {
+			p.PriceInfo = datatypes.JSON(`{"price": 70, "originalPrice": 100}`)
+			return p
+		}, nil},
+		{"several", func(p models.Product) models.Product {
+			p.SellerID = 2
+			p.StockInfo = datatypes.JSON(`{"stock": 1}`)
+			p.PriceInfo = datatypes.JSON(`{"price": 100, "originalPrice": 100}`)
+			return p
+		}, []Change{
+			{FieldSeller, "seller 1", "seller 2"},
+			{FieldStock, StockInStock, StockLow},
+			{FieldDiscount, "20% off", NoDiscount},
+		}},
+	}
+	for _, tt := range tests {
+		if got := Diff(base, tt.change(base)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Diff = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	// A discount starting is reported the other way round
+	noDiscount := base
+	noDiscount.PriceInfo = datatypes.JSON(`{"price": 100, "originalPrice": 100}`)
+	if got := Diff(noDiscount, base); !reflect.DeepEqual(got, []Change{{FieldDiscount, NoDiscount, "20% off"}}) {
+		t.Errorf("discount started: Diff = %+v", got)
+	}
+}
+
+func TestStockBand(t *testing.T) {
+	tests := []struct {
+		quantity float64
+		want     string
+	}{
+		{0, StockOutOfStock},
+		{-1, StockOutOfStock},
+		{1, StockLow},
+		{5, StockLow},
+		{6, StockInStock},
+	}
+	for _, tt := range tests {
+		if got := StockBand(tt.quantity); got != tt.want {
+			t.Errorf("StockBand(%v) = %q, want %q", tt.quantity, got, tt.want)
+		}
+	}
+}
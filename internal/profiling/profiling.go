@@ -0,0 +1,98 @@
+// Package profiling serves the net/http/pprof endpoints of a running service
+// under /debug/pprof when DEBUG_PPROF is set, so CPU and heap use can be
+// profiled with `go tool pprof` without a rebuild. With DEBUG_PPROF_PORT set
+// the endpoints get a listener of their own, shared by every service in the
+// process, instead of being mounted on the services' public HTTP ports.
+package profiling
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"scraper/pkg/listen"
+)
+
+// Route is the profiling route as registered. Services exempt it from their
+// request deadline, since CPU profiles and traces run for as long as asked.
+const Route = "GET /debug/pprof/*"
+
+// prefix is the path of the endpoints
+const prefix = "/debug/pprof/"
+
+// serveOnce starts the separate profiling listener once per process
+var serveOnce sync.Once
+
+// Enabled reports whether the profiling endpoints are served.
+//
+// Environment Variables:
+//   - DEBUG_PPROF: Serve /debug/pprof (default: false)
+func Enabled() bool {
+	return viper.GetBool("DEBUG_PPROF")
+}
+
+// Register serves the profiling endpoints of a service when DEBUG_PPROF is
+// set: on their own port when DEBUG_PPROF_PORT is set, started by the first
+// service to register, and on the service's own server otherwise.
+//
+// Environment Variables:
+//   - DEBUG_PPROF_PORT: Separate port of the endpoints (optional)
+//
+// Parameters:
+//   - e: Echo instance of the service
+//   - service: Name of the service for logs, e.g. "crawler"
+func Register(e *echo.Echo, service string) {
+	if !Enabled() {
+		return
+	}
+	if viper.GetString("DEBUG_PPROF_PORT") == "" {
+		mount(e)
+		logrus.WithField("service", service).Warn("Profiling endpoints served on the public HTTP port; set DEBUG_PPROF_PORT to move them")
+		return
+	}
+	serveOnce.Do(serve)
+}
+
+// serve starts the separate profiling server on DEBUG_PPROF_PORT.
+func serve() {
+	lis, err := listen.TCP("Debug pprof", "DEBUG_PPROF_PORT", 0)
+	if err != nil {
+		logrus.WithError(err).Error("Profiling port unavailable, profiling disabled")
+		return
+	}
+	e := echo.New()
+	mount(e)
+	e.Listener = lis
+	go func() {
+		logrus.WithField("addr", lis.Addr().String()).Info("Starting profiling server")
+		if err := e.Start(""); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Profiling server failed")
+		}
+	}()
+}
+
+// mount adds the endpoints to e. /debug/pprof/ lists the profiles and
+// /debug/pprof/<name>, e.g. heap or goroutine, serves one.
+func mount(e *echo.Echo) {
+	handler := echo.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, prefix) {
+		case "cmdline":
+			pprof.Cmdline(w, r)
+		case "profile":
+			pprof.Profile(w, r)
+		case "symbol":
+			pprof.Symbol(w, r)
+		case "trace":
+			pprof.Trace(w, r)
+		default:
+			pprof.Index(w, r)
+		}
+	}))
+	e.GET(prefix+"*", handler)
+	e.POST(prefix+"symbol", handler)
+}
@@ -0,0 +1,84 @@
+package profiling
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+
+	"scraper/pkg/listen"
+)
+
+func setConfig(t *testing.T, enabled bool, port string) {
+	t.Helper()
+	viper.Set("DEBUG_PPROF", enabled)
+	viper.Set("DEBUG_PPROF_PORT", port)
+	t.Cleanup(func() {
+		viper.Set("DEBUG_PPROF", nil)
+		viper.Set("DEBUG_PPROF_PORT", nil)
+	})
+}
+
+// get serves a GET request through e.
+func get(e *echo.Echo, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestDisabled(t *testing.T) {
+	setConfig(t, false, "")
+	e := echo.New()
+	Register(e, "crawler")
+	if rec := get(e, "/debug/pprof/heap"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/pprof/heap = %d, want 404 without DEBUG_PPROF", rec.Code)
+	}
+}
+
+func TestHeapOnServicePort(t *testing.T) {
+	setConfig(t, true, "")
+	e := echo.New()
+	Register(e, "crawler")
+
+	rec := get(e, "/debug/pprof/heap")
+	if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Fatalf("GET /debug/pprof/heap = %d with %d bytes, want a profile", rec.Code, rec.Body.Len())
+	}
+	if rec := get(e, "/debug/pprof/"); rec.Code != http.StatusOK {
+		t.Errorf("GET /debug/pprof/ = %d, want the index", rec.Code)
+	}
+}
+
+func TestHeapOnSeparatePort(t *testing.T) {
+	setConfig(t, true, "0")
+	e := echo.New()
+	Register(e, "crawler")
+	Register(echo.New(), "analysis") // Shares the listener
+
+	if rec := get(e, "/debug/pprof/heap"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/pprof/heap on the service = %d, want 404", rec.Code)
+	}
+
+	var port int
+	for _, bound := range listen.Bound() {
+		if bound.Name == "Debug pprof" {
+			port = bound.Port
+		}
+	}
+	if port == 0 {
+		t.Fatal("profiling port not bound")
+	}
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/debug/pprof/heap", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Errorf("GET /debug/pprof/heap on port %d = %d with %d bytes, want a profile", port, resp.StatusCode, len(body))
+	}
+}
@@ -101,6 +101,118 @@ func (x *FetchResponse) GetProducts() []byte {
 	return nil
 }
 
+type GetProductRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ProductId     uint64                 `protobuf:"varint,1,opt,name=product_id,json=productId,proto3" json:"product_id,omitempty"`
+	ForceRefresh  bool                   `protobuf:"varint,2,opt,name=force_refresh,json=forceRefresh,proto3" json:"force_refresh,omitempty"`
+	Source        string                 `protobuf:"bytes,3,opt,name=source,proto3" json:"source,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetProductRequest) Reset() {
+	*x = GetProductRequest{}
+	mi := &file_internal_proto_crawler_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetProductRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetProductRequest) ProtoMessage() {}
+
+func (x *GetProductRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_crawler_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetProductRequest.ProtoReflect.Descriptor instead.
+func (*GetProductRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_crawler_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *GetProductRequest) GetProductId() uint64 {
+	if x != nil {
+		return x.ProductId
+	}
+	return 0
+}
+
+func (x *GetProductRequest) GetForceRefresh() bool {
+	if x != nil {
+		return x.ForceRefresh
+	}
+	return false
+}
+
+func (x *GetProductRequest) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+type GetProductResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Product       []byte                 `protobuf:"bytes,1,opt,name=product,proto3" json:"product,omitempty"`
+	Refreshed     bool                   `protobuf:"varint,2,opt,name=refreshed,proto3" json:"refreshed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetProductResponse) Reset() {
+	*x = GetProductResponse{}
+	mi := &file_internal_proto_crawler_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetProductResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetProductResponse) ProtoMessage() {}
+
+func (x *GetProductResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_crawler_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetProductResponse.ProtoReflect.Descriptor instead.
+func (*GetProductResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_crawler_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GetProductResponse) GetProduct() []byte {
+	if x != nil {
+		return x.Product
+	}
+	return nil
+}
+
+func (x *GetProductResponse) GetRefreshed() bool {
+	if x != nil {
+		return x.Refreshed
+	}
+	return false
+}
+
 var File_internal_proto_crawler_proto protoreflect.FileDescriptor
 
 const file_internal_proto_crawler_proto_rawDesc = "" +
@@ -108,9 +220,19 @@ const file_internal_proto_crawler_proto_rawDesc = "" +
 	"\x1cinternal/proto/crawler.proto\x12\x05proto\"\x0e\n" +
 	"\fFetchRequest\"+\n" +
 	"\rFetchResponse\x12\x1a\n" +
-	"\bproducts\x18\x01 \x01(\fR\bproducts2L\n" +
+	"\bproducts\x18\x01 \x01(\fR\bproducts\"o\n" +
+	"\x11GetProductRequest\x12\x1d\n" +
+	"\n" +
+	"product_id\x18\x01 \x01(\x04R\tproductId\x12#\n" +
+	"\rforce_refresh\x18\x02 \x01(\bR\fforceRefresh\x12\x16\n" +
+	"\x06source\x18\x03 \x01(\tR\x06source\"L\n" +
+	"\x12GetProductResponse\x12\x18\n" +
+	"\aproduct\x18\x01 \x01(\fR\aproduct\x12\x1c\n" +
+	"\trefreshed\x18\x02 \x01(\bR\trefreshed2\x8f\x01\n" +
 	"\x0eCrawlerService\x12:\n" +
-	"\rFetchProducts\x12\x13.proto.FetchRequest\x1a\x14.proto.FetchResponseB\x18Z\x16scraper/internal/protob\x06proto3"
+	"\rFetchProducts\x12\x13.proto.FetchRequest\x1a\x14.proto.FetchResponse\x12A\n" +
+	"\n" +
+	"GetProduct\x12\x18.proto.GetProductRequest\x1a\x19.proto.GetProductResponseB\x18Z\x16scraper/internal/protob\x06proto3"
 
 var (
 	file_internal_proto_crawler_proto_rawDescOnce sync.Once
@@ -124,16 +246,20 @@ func file_internal_proto_crawler_proto_rawDescGZIP() []byte {
 	return file_internal_proto_crawler_proto_rawDescData
 }
 
-var file_internal_proto_crawler_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_internal_proto_crawler_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_internal_proto_crawler_proto_goTypes = []any{
-	(*FetchRequest)(nil),  // 0: proto.FetchRequest
-	(*FetchResponse)(nil), // 1: proto.FetchResponse
+	(*FetchRequest)(nil),       // 0: proto.FetchRequest
+	(*FetchResponse)(nil),      // 1: proto.FetchResponse
+	(*GetProductRequest)(nil),  // 2: proto.GetProductRequest
+	(*GetProductResponse)(nil), // 3: proto.GetProductResponse
 }
 var file_internal_proto_crawler_proto_depIdxs = []int32{
 	0, // 0: proto.CrawlerService.FetchProducts:input_type -> proto.FetchRequest
-	1, // 1: proto.CrawlerService.FetchProducts:output_type -> proto.FetchResponse
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
+	2, // 1: proto.CrawlerService.GetProduct:input_type -> proto.GetProductRequest
+	1, // 2: proto.CrawlerService.FetchProducts:output_type -> proto.FetchResponse
+	3, // 3: proto.CrawlerService.GetProduct:output_type -> proto.GetProductResponse
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
 	0, // [0:0] is the sub-list for extension type_name
 	0, // [0:0] is the sub-list for extension extendee
 	0, // [0:0] is the sub-list for field type_name
@@ -150,7 +276,7 @@ func file_internal_proto_crawler_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_internal_proto_crawler_proto_rawDesc), len(file_internal_proto_crawler_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
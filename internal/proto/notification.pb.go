@@ -24,8 +24,13 @@ const (
 type NotificationRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	UserId        string                 `protobuf:"bytes,1,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
-	ProductId     uint32                 `protobuf:"varint,2,opt,name=product_id,json=productId,proto3" json:"product_id,omitempty"`
+	ProductId     uint64                 `protobuf:"varint,2,opt,name=product_id,json=productId,proto3" json:"product_id,omitempty"`
 	Message       string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	Type          string                 `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
+	FetchedAt     int64                  `protobuf:"varint,5,opt,name=fetched_at,json=fetchedAt,proto3" json:"fetched_at,omitempty"`
+	Source        string                 `protobuf:"bytes,6,opt,name=source,proto3" json:"source,omitempty"`
+	Email         string                 `protobuf:"bytes,7,opt,name=email,proto3" json:"email,omitempty"`
+	Changes       []*ProductChange       `protobuf:"bytes,8,rep,name=changes,proto3" json:"changes,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -67,7 +72,7 @@ func (x *NotificationRequest) GetUserId() string {
 	return ""
 }
 
-func (x *NotificationRequest) GetProductId() uint32 {
+func (x *NotificationRequest) GetProductId() uint64 {
 	if x != nil {
 		return x.ProductId
 	}
@@ -81,6 +86,41 @@ func (x *NotificationRequest) GetMessage() string {
 	return ""
 }
 
+func (x *NotificationRequest) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *NotificationRequest) GetFetchedAt() int64 {
+	if x != nil {
+		return x.FetchedAt
+	}
+	return 0
+}
+
+func (x *NotificationRequest) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *NotificationRequest) GetEmail() string {
+	if x != nil {
+		return x.Email
+	}
+	return ""
+}
+
+func (x *NotificationRequest) GetChanges() []*ProductChange {
+	if x != nil {
+		return x.Changes
+	}
+	return nil
+}
+
 type NotificationResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
@@ -125,20 +165,247 @@ func (x *NotificationResponse) GetSuccess() bool {
 	return false
 }
 
+type BatchNotificationRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Items         []*NotificationRequest `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchNotificationRequest) Reset() {
+	*x = BatchNotificationRequest{}
+	mi := &file_internal_proto_notification_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchNotificationRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchNotificationRequest) ProtoMessage() {}
+
+func (x *BatchNotificationRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_notification_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchNotificationRequest.ProtoReflect.Descriptor instead.
+func (*BatchNotificationRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_notification_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *BatchNotificationRequest) GetItems() []*NotificationRequest {
+	if x != nil {
+		return x.Items
+	}
+	return nil
+}
+
+type NotificationResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Index         int32                  `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Success       bool                   `protobuf:"varint,2,opt,name=success,proto3" json:"success,omitempty"`
+	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NotificationResult) Reset() {
+	*x = NotificationResult{}
+	mi := &file_internal_proto_notification_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NotificationResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NotificationResult) ProtoMessage() {}
+
+func (x *NotificationResult) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_notification_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NotificationResult.ProtoReflect.Descriptor instead.
+func (*NotificationResult) Descriptor() ([]byte, []int) {
+	return file_internal_proto_notification_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *NotificationResult) GetIndex() int32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *NotificationResult) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *NotificationResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type BatchNotificationResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Results       []*NotificationResult  `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchNotificationResponse) Reset() {
+	*x = BatchNotificationResponse{}
+	mi := &file_internal_proto_notification_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchNotificationResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchNotificationResponse) ProtoMessage() {}
+
+func (x *BatchNotificationResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_notification_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchNotificationResponse.ProtoReflect.Descriptor instead.
+func (*BatchNotificationResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_notification_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *BatchNotificationResponse) GetResults() []*NotificationResult {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+type ProductChange struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Field         string                 `protobuf:"bytes,1,opt,name=field,proto3" json:"field,omitempty"`
+	OldValue      string                 `protobuf:"bytes,2,opt,name=old_value,json=oldValue,proto3" json:"old_value,omitempty"`
+	NewValue      string                 `protobuf:"bytes,3,opt,name=new_value,json=newValue,proto3" json:"new_value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProductChange) Reset() {
+	*x = ProductChange{}
+	mi := &file_internal_proto_notification_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProductChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProductChange) ProtoMessage() {}
+
+func (x *ProductChange) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_notification_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProductChange.ProtoReflect.Descriptor instead.
+func (*ProductChange) Descriptor() ([]byte, []int) {
+	return file_internal_proto_notification_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ProductChange) GetField() string {
+	if x != nil {
+		return x.Field
+	}
+	return ""
+}
+
+func (x *ProductChange) GetOldValue() string {
+	if x != nil {
+		return x.OldValue
+	}
+	return ""
+}
+
+func (x *ProductChange) GetNewValue() string {
+	if x != nil {
+		return x.NewValue
+	}
+	return ""
+}
+
 var File_internal_proto_notification_proto protoreflect.FileDescriptor
 
 const file_internal_proto_notification_proto_rawDesc = "" +
 	"\n" +
-	"!internal/proto/notification.proto\x12\x05proto\"g\n" +
+	"!internal/proto/notification.proto\x12\x05proto\"\xf8\x01\n" +
 	"\x13NotificationRequest\x12\x17\n" +
 	"\auser_id\x18\x01 \x01(\tR\x06userId\x12\x1d\n" +
 	"\n" +
-	"product_id\x18\x02 \x01(\rR\tproductId\x12\x18\n" +
-	"\amessage\x18\x03 \x01(\tR\amessage\"0\n" +
+	"product_id\x18\x02 \x01(\x04R\tproductId\x12\x18\n" +
+	"\amessage\x18\x03 \x01(\tR\amessage\x12\x12\n" +
+	"\x04type\x18\x04 \x01(\tR\x04type\x12\x1d\n" +
+	"\n" +
+	"fetched_at\x18\x05 \x01(\x03R\tfetchedAt\x12\x16\n" +
+	"\x06source\x18\x06 \x01(\tR\x06source\x12\x14\n" +
+	"\x05email\x18\a \x01(\tR\x05email\x12.\n" +
+	"\achanges\x18\b \x03(\v2\x14.proto.ProductChangeR\achanges\"0\n" +
 	"\x14NotificationResponse\x12\x18\n" +
-	"\asuccess\x18\x01 \x01(\bR\asuccess2b\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\"L\n" +
+	"\x18BatchNotificationRequest\x120\n" +
+	"\x05items\x18\x01 \x03(\v2\x1a.proto.NotificationRequestR\x05items\"Z\n" +
+	"\x12NotificationResult\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x05R\x05index\x12\x18\n" +
+	"\asuccess\x18\x02 \x01(\bR\asuccess\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\"P\n" +
+	"\x19BatchNotificationResponse\x123\n" +
+	"\aresults\x18\x01 \x03(\v2\x19.proto.NotificationResultR\aresults\"_\n" +
+	"\rProductChange\x12\x14\n" +
+	"\x05field\x18\x01 \x01(\tR\x05field\x12\x1b\n" +
+	"\told_value\x18\x02 \x01(\tR\boldValue\x12\x1b\n" +
+	"\tnew_value\x18\x03 \x01(\tR\bnewValue2\xba\x01\n" +
 	"\x13NotificationService\x12K\n" +
-	"\x10SendNotification\x12\x1a.proto.NotificationRequest\x1a\x1b.proto.NotificationResponseB\x18Z\x16scraper/internal/protob\x06proto3"
+	"\x10SendNotification\x12\x1a.proto.NotificationRequest\x1a\x1b.proto.NotificationResponse\x12V\n" +
+	"\x11SendNotifications\x12\x1f.proto.BatchNotificationRequest\x1a .proto.BatchNotificationResponseB\x18Z\x16scraper/internal/protob\x06proto3"
 
 var (
 	file_internal_proto_notification_proto_rawDescOnce sync.Once
@@ -152,19 +419,28 @@ func file_internal_proto_notification_proto_rawDescGZIP() []byte {
 	return file_internal_proto_notification_proto_rawDescData
 }
 
-var file_internal_proto_notification_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_internal_proto_notification_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
 var file_internal_proto_notification_proto_goTypes = []any{
-	(*NotificationRequest)(nil),  // 0: proto.NotificationRequest
-	(*NotificationResponse)(nil), // 1: proto.NotificationResponse
+	(*NotificationRequest)(nil),       // 0: proto.NotificationRequest
+	(*NotificationResponse)(nil),      // 1: proto.NotificationResponse
+	(*BatchNotificationRequest)(nil),  // 2: proto.BatchNotificationRequest
+	(*NotificationResult)(nil),        // 3: proto.NotificationResult
+	(*BatchNotificationResponse)(nil), // 4: proto.BatchNotificationResponse
+	(*ProductChange)(nil),             // 5: proto.ProductChange
 }
 var file_internal_proto_notification_proto_depIdxs = []int32{
-	0, // 0: proto.NotificationService.SendNotification:input_type -> proto.NotificationRequest
-	1, // 1: proto.NotificationService.SendNotification:output_type -> proto.NotificationResponse
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	5, // 0: proto.NotificationRequest.changes:type_name -> proto.ProductChange
+	0, // 1: proto.BatchNotificationRequest.items:type_name -> proto.NotificationRequest
+	3, // 2: proto.BatchNotificationResponse.results:type_name -> proto.NotificationResult
+	0, // 3: proto.NotificationService.SendNotification:input_type -> proto.NotificationRequest
+	2, // 4: proto.NotificationService.SendNotifications:input_type -> proto.BatchNotificationRequest
+	1, // 5: proto.NotificationService.SendNotification:output_type -> proto.NotificationResponse
+	4, // 6: proto.NotificationService.SendNotifications:output_type -> proto.BatchNotificationResponse
+	5, // [5:7] is the sub-list for method output_type
+	3, // [3:5] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_internal_proto_notification_proto_init() }
@@ -178,7 +454,7 @@ func file_internal_proto_notification_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_internal_proto_notification_proto_rawDesc), len(file_internal_proto_notification_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   6,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
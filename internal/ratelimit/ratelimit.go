@@ -0,0 +1,279 @@
+// Package ratelimit implements per-client request rate limits for the HTTP
+// APIs. Every client gets a token bucket that refills at a steady rate up to
+// a burst; a request takes one token, and a request finding the bucket
+// empty is answered with 429 rate_limited and a Retry-After header. A client
+// is the API key of the request when it carries a valid one, and its IP
+// otherwise. Routes that are expensive or easy to abuse get their own,
+// stricter buckets, so they cannot drain the budget of ordinary requests and
+// vice versa. Every response reports the client's quota in X-RateLimit-*
+// headers.
+//
+// Buckets live in Redis when REDIS_ADDR is set, so the limits hold across
+// replicas, and in memory otherwise, where every instance counts on its own.
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+)
+
+// Quota headers set on every response
+const (
+	HeaderLimit     = "X-RateLimit-Limit"     // Burst of the client's bucket
+	HeaderRemaining = "X-RateLimit-Remaining" // Requests left in the bucket
+	HeaderReset     = "X-RateLimit-Reset"     // Seconds until the bucket is full again
+)
+
+// Client scopes in the details of a 429 response
+const (
+	ScopeAPIKey = "api_key"
+	ScopeIP     = "ip"
+)
+
+// sweepInterval is how often idle buckets are looked for
+const sweepInterval = time.Minute
+
+// Limit is the token bucket of a client
+type Limit struct {
+	Rate  float64 // Tokens added per second
+	Burst int     // Bucket size: requests a client may make at once
+}
+
+// Routes maps "METHOD /path" to a stricter limit. The path is the route as
+// registered, e.g. "POST /users". Routes that are not listed share the
+// default limit.
+type Routes map[string]Limit
+
+// Limits returns the default and the strict limit.
+//
+// Environment Variables:
+//   - RATE_LIMIT_RPS: Requests per second of a client (default: 10)
+//   - RATE_LIMIT_BURST: Requests a client may make at once (default: 20)
+//   - RATE_LIMIT_STRICT_RPS: Requests per second of a client on strict
+//     routes (default: 1)
+//   - RATE_LIMIT_STRICT_BURST: Requests a client may make at once on strict
+//     routes (default: 5)
+//
+// Returns:
+//   - Limit: Limit of routes that are not listed
+//   - Limit: Limit of the routes a service lists as strict
+func Limits() (Limit, Limit) {
+	return limitFromConfig("RATE_LIMIT", Limit{Rate: 10, Burst: 20}),
+		limitFromConfig("RATE_LIMIT_STRICT", Limit{Rate: 1, Burst: 5})
+}
+
+// KeyLimit returns the limit of API keys without a limit of their own in
+// API_KEY_LIMITS.
+//
+// Environment Variables:
+//   - RATE_LIMIT_KEY_RPS: Requests per second of an API key (default: 50)
+//   - RATE_LIMIT_KEY_BURST: Requests an API key may make at once
+//     (default: 100)
+func KeyLimit() Limit {
+	return limitFromConfig("RATE_LIMIT_KEY", Limit{Rate: 50, Burst: 100})
+}
+
+// limitFromConfig reads prefix_RPS and prefix_BURST, keeping the default of
+// each one that is unset or not positive.
+func limitFromConfig(prefix string, def Limit) Limit {
+	if rate := viper.GetFloat64(prefix + "_RPS"); rate > 0 {
+		def.Rate = rate
+	}
+	if burst := viper.GetInt(prefix + "_BURST"); burst > 0 {
+		def.Burst = burst
+	}
+	return def
+}
+
+// Result is the state of a client's bucket after a request
+type Result struct {
+	Allowed    bool          // Whether the request may proceed
+	Limit      int           // Burst of the bucket
+	Remaining  int           // Whole tokens left
+	Reset      time.Duration // Until the bucket is full again
+	RetryAfter time.Duration // Until a token is available if not allowed
+}
+
+// newResult describes a bucket holding tokens after a request.
+func newResult(limit Limit, tokens float64, allowed bool) Result {
+	r := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		r.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	return r
+}
+
+// bucket is the token bucket of one client
+type bucket struct {
+	tokens float64   // Tokens left at last
+	last   time.Time // When tokens was last brought up to date
+}
+
+// Limiter keeps the buckets of one limit, keyed by client. Buckets that have
+// refilled completely are dropped, since a new bucket is the same.
+type Limiter struct {
+	limit Limit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewLimiter creates a limiter.
+//
+// Parameters:
+//   - limit: Rate and burst of every client
+//   - now: Clock; time.Now outside tests
+//
+// Returns:
+//   - *Limiter: Limiter without buckets
+func NewLimiter(limit Limit, now func() time.Time) *Limiter {
+	return &Limiter{limit: limit, now: now, buckets: make(map[string]*bucket), lastSweep: now()}
+}
+
+// Allow takes a token from the bucket of key.
+//
+// Parameters:
+//   - key: Client the request is from
+//
+// Returns:
+//   - bool: Whether the request may proceed
+//   - time.Duration: How long until a token is available if it may not
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	r := l.Take(key)
+	return r.Allowed, r.RetryAfter
+}
+
+// Take takes a token from the bucket of key and reports what is left.
+//
+// Parameters:
+//   - key: Client the request is from
+//
+// Returns:
+//   - Result: Whether the request may proceed and the bucket's state
+func (l *Limiter) Take(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return newResult(l.limit, b.tokens, allowed)
+}
+
+// Len returns the number of clients with a bucket.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// sweep drops the buckets that have refilled completely by now. The caller
+// holds mu.
+func (l *Limiter) sweep(now time.Time) {
+	full := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Middleware limits requests per API key or, without a valid key, per
+// client IP, in the buckets of StoreFromConfig. It must be added with e.Use,
+// which runs after routing, so the route is known. A key gets its limit from
+// API_KEY_LIMITS or KeyLimit on ordinary routes; strict routes apply the
+// same strict limit to keys and IPs. An invalid key is limited by IP and
+// left for the route's key check to reject.
+//
+// Parameters:
+//   - routes: The service's strict routes, each with its own buckets
+//   - keys: Accepted API keys; nil limits every request by IP
+//
+// Returns:
+//   - echo.MiddlewareFunc: Middleware setting the X-RateLimit-* headers and
+//     answering 429 when a client is over its limit
+func Middleware(routes Routes, keys *apikey.Ring) echo.MiddlewareFunc {
+	def, _ := Limits()
+	return middleware(def, KeyLimit(), routes, keys, StoreFromConfig())
+}
+
+// middleware is Middleware with the limits and the store given.
+func middleware(def, keyLimit Limit, routes Routes, keys *apikey.Ring, store Store) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			route := c.Request().Method + " " + c.Path()
+			scope, client, limit := ScopeIP, c.RealIP(), def
+			if presented := c.Request().Header.Get(apikey.HeaderName); presented != "" && keys != nil {
+				if id, quota, ok := keys.Lookup(presented); ok {
+					scope, client, limit = ScopeAPIKey, id, keyLimit
+					if quota != (apikey.Quota{}) {
+						limit = Limit{Rate: quota.Rate, Burst: quota.Burst}
+					}
+				}
+			}
+			bucket := "default"
+			if strict, ok := routes[route]; ok {
+				bucket, limit = route, strict
+			}
+
+			result := store.Take(bucket+"|"+scope+":"+client, limit)
+			header := c.Response().Header()
+			header.Set(HeaderLimit, strconv.Itoa(result.Limit))
+			header.Set(HeaderRemaining, strconv.Itoa(result.Remaining))
+			header.Set(HeaderReset, strconv.Itoa(ceilSeconds(result.Reset)))
+			if result.Allowed {
+				return next(c)
+			}
+
+			seconds := ceilSeconds(result.RetryAfter)
+			if seconds < 1 {
+				seconds = 1
+			}
+			header.Set("Retry-After", strconv.Itoa(seconds))
+			return apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many requests").
+				WithDetails(map[string]interface{}{
+					"retry_after_seconds": seconds,
+					"limit":               result.Limit,
+					"remaining":           result.Remaining,
+					"reset_seconds":       ceilSeconds(result.Reset),
+					"scope":               scope,
+				})
+		}
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+
+	"scraper/internal/apierror"
+	"scraper/internal/apikey"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLimiterRefills(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := NewLimiter(Limit{Rate: 2, Burst: 3}, clock.now)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d of the burst denied", i+1)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("request over the burst: allowed %v, wait %v; want denied, 500ms", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("another client shares the bucket")
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("request denied after the bucket refilled a token")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Error("refill added more than one token")
+	}
+}
+
+func TestLimiterDropsIdleBuckets(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := NewLimiter(Limit{Rate: 1, Burst: 120}, clock.now)
+	l.Allow("idle")
+	clock.advance(30 * time.Second)
+	l.Allow("active")
+
+	// Not refilled yet: the idle bucket still holds fewer tokens than a new one
+	clock.advance(sweepInterval)
+	l.Allow("active")
+	if n := l.Len(); n != 2 {
+		t.Errorf("%d buckets after the first sweep, want 2", n)
+	}
+
+	clock.advance(sweepInterval)
+	l.Allow("active")
+	if n := l.Len(); n != 1 {
+		t.Errorf("%d buckets after the idle one refilled, want 1", n)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler()
+	e.Use(middleware(Limit{Rate: 10, Burst: 2}, KeyLimit(), Routes{"POST /users": {Rate: 0.5, Burst: 1}}, nil, NewMemoryStore(clock.now)))
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.GET("/products", ok)
+	e.POST("/users", ok)
+
+	do := func(method, target, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/users", "10.0.0.1"); rec.Code != http.StatusOK {
+		t.Fatalf("first POST /users: status %d", rec.Code)
+	}
+	rec := do(http.MethodPost, "/users", "10.0.0.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("second POST /users: status %d, Retry-After %q; want 429 and 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// The strict route has its own buckets and other clients are not affected
+	for i := 0; i < 2; i++ {
+		if rec := do(http.MethodGet, "/products", "10.0.0.1"); rec.Code != http.StatusOK {
+			t.Errorf("GET /products %d: status %d", i+1, rec.Code)
+		}
+	}
+	rec = do(http.MethodGet, "/products", "10.0.0.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("GET /products over the burst: status %d, Retry-After %q; want 429 and 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := do(http.MethodPost, "/users", "10.0.0.2"); rec.Code != http.StatusOK {
+		t.Errorf("POST /users from another IP: status %d", rec.Code)
+	}
+
+	clock.advance(2 * time.Second)
+	if rec := do(http.MethodPost, "/users", "10.0.0.1"); rec.Code != http.StatusOK {
+		t.Errorf("POST /users after Retry-After: status %d", rec.Code)
+	}
+}
+
+func TestMiddlewareAPIKeys(t *testing.T) {
+	viper.Set("API_KEYS", "partner-key,other-key")
+	viper.Set("API_KEY_LIMITS", apikey.ID("partner-key")+"=1/3")
+	t.Cleanup(func() {
+		viper.Set("API_KEYS", nil)
+		viper.Set("API_KEY_LIMITS", nil)
+	})
+	keys := &apikey.Ring{}
+	keys.Reload()
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	e := echo.New()
+	e.HTTPErrorHandler = apierror.NewHandler()
+	e.Use(middleware(Limit{Rate: 1, Burst: 1}, Limit{Rate: 1, Burst: 2}, nil, keys, NewMemoryStore(clock.now)))
+	e.GET("/products", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	do := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/products", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if key != "" {
+			req.Header.Set(apikey.HeaderName, key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	quota := func(rec *httptest.ResponseRecorder) string {
+		return rec.Header().Get(HeaderLimit) + "/" + rec.Header().Get(HeaderRemaining) + "/" + rec.Header().Get(HeaderReset)
+	}
+
+	// The key's own limit applies, and every response reports the quota
+	for i, want := range []string{"3/2/1", "3/1/2", "3/0/3"} {
+		rec := do("partner-key")
+		if rec.Code != http.StatusOK || quota(rec) != want {
+			t.Errorf("partner request %d: status %d, quota %s; want 200 and %s", i+1, rec.Code, quota(rec), want)
+		}
+	}
+	rec := do("partner-key")
+	if rec.Code != http.StatusTooManyRequests || quota(rec) != "3/0/3" || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("partner over its limit: status %d, quota %s, Retry-After %q; want 429, 3/0/3, 1", rec.Code, quota(rec), rec.Header().Get("Retry-After"))
+	}
+	var body apierror.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	details, _ := body.Details.(map[string]interface{})
+	if body.Code != apierror.CodeRateLimited || details["scope"] != ScopeAPIKey || details["limit"] != float64(3) || details["reset_seconds"] != float64(3) {
+		t.Errorf("429 body = %s, want rate_limited with the key's quota", rec.Body.String())
+	}
+
+	// Keys without a limit of their own get the key default, and the IP
+	// they share keeps its own bucket; an unknown key is limited by IP
+	if rec := do("other-key"); rec.Code != http.StatusOK || rec.Header().Get(HeaderLimit) != "2" {
+		t.Errorf("other key: status %d, limit %s; want 200 and 2", rec.Code, rec.Header().Get(HeaderLimit))
+	}
+	if rec := do(""); rec.Code != http.StatusOK || rec.Header().Get(HeaderLimit) != "1" {
+		t.Errorf("no key: status %d, limit %s; want 200 and 1", rec.Code, rec.Header().Get(HeaderLimit))
+	}
+	rec = do("unknown-key")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("unknown key after the IP's request: status %d, want 429", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"scope":"ip"`) {
+		t.Errorf("unknown key 429 body = %s, want the ip scope", rec.Body.String())
+	}
+}
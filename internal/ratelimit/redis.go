@@ -0,0 +1,242 @@
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"scraper/internal/metrics"
+)
+
+// Redis connection settings
+const (
+	redisTimeout   = 250 * time.Millisecond // Dial and round trip limit of a Take
+	redisIdleConns = 16                     // Connections kept open between requests
+	redisKeyPrefix = "ratelimit:"           // Prefix of the bucket keys
+)
+
+// redisErrors counts the requests limited in memory because Redis failed
+var redisErrors = metrics.NewCounter(
+	"rate_limit_redis_errors_total",
+	"Requests rate limited in memory because the Redis store failed",
+)
+
+// takeScript refills and takes from a bucket stored as a hash of its tokens
+// and the time they were counted, in one atomic step. The bucket expires
+// once it would have refilled completely, since a new bucket is the same.
+// Tokens are returned as a string, as Lua numbers become Redis integers.
+//
+// KEYS[1]: bucket; ARGV: rate per second, burst, now in milliseconds
+const takeScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+  tokens, ts = burst, now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil(burst / rate * 1000)))
+return {allowed, tostring(tokens)}
+`
+
+// RedisStore keeps the buckets in Redis, so every replica draws from the same
+// ones. It speaks the Redis protocol itself, which only takes EVAL and AUTH.
+// While Redis cannot be reached, requests are limited in a MemoryStore, per
+// instance, rather than failing or passing unchecked.
+type RedisStore struct {
+	addr     string
+	password string
+	now      func() time.Time
+	conns    chan *redisConn // Idle connections
+	local    *MemoryStore    // Buckets used while Redis fails
+	failing  atomic.Bool     // Whether the last Take fell back to local
+}
+
+// redisConn is a connection with its read buffer
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// NewRedisStore creates a Redis store. Connections are opened on demand.
+//
+// Parameters:
+//   - addr: host:port of the server
+//   - password: Password sent with AUTH; empty to skip it
+//
+// Returns:
+//   - *RedisStore: The store
+func NewRedisStore(addr, password string) *RedisStore {
+	return &RedisStore{
+		addr:     addr,
+		password: password,
+		now:      time.Now,
+		conns:    make(chan *redisConn, redisIdleConns),
+		local:    NewMemoryStore(time.Now),
+	}
+}
+
+// Take implements Store.
+func (s *RedisStore) Take(key string, limit Limit) Result {
+	result, err := s.take(key, limit)
+	if err != nil {
+		redisErrors.Inc()
+		if !s.failing.Swap(true) {
+			logrus.WithError(err).WithField("addr", s.addr).
+				Warn("Redis rate limit store failed, limiting per instance in memory")
+		}
+		return s.local.Take(key, limit)
+	}
+	if s.failing.Swap(false) {
+		logrus.WithField("addr", s.addr).Info("Redis rate limit store recovered")
+	}
+	return result
+}
+
+// take runs takeScript on a bucket.
+func (s *RedisStore) take(key string, limit Limit) (Result, error) {
+	reply, err := s.do("EVAL", takeScript, "1", redisKeyPrefix+key,
+		strconv.FormatFloat(limit.Rate, 'g', -1, 64),
+		strconv.Itoa(limit.Burst),
+		strconv.FormatInt(s.now().UnixMilli(), 10))
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return Result{}, fmt.Errorf("redis: unexpected script reply %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	raw, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(tokens) {
+		return Result{}, fmt.Errorf("redis: unexpected token count %v", values[1])
+	}
+	return newResult(limit, tokens, allowed == 1), nil
+}
+
+// do sends a command on an idle or new connection and reads its reply. The
+// connection is kept for reuse unless the exchange failed.
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case s.conns <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection or dials a new one.
+func (s *RedisStore) conn() (*redisConn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	default:
+	}
+
+	c, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+	if s.password != "" {
+		if _, err := conn.do("AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// do writes a command as an array of bulk strings and reads the reply.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// readReply reads one reply: a string, an int64, nil, a redisError or a
+// []interface{} of replies.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
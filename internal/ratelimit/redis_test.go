@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRedis accepts connections and answers every command with reply,
+// recording the commands it received.
+func fakeRedis(t *testing.T, reply string) (string, <-chan []string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	commands := make(chan []string, 16)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := readReply(r)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, arg := range cmd.([]interface{}) {
+						args = append(args, arg.(string))
+					}
+					commands <- args
+					fmt.Fprint(conn, reply)
+				}
+			}()
+		}
+	}()
+	return lis.Addr().String(), commands
+}
+
+func TestRedisStoreProtocol(t *testing.T) {
+	addr, commands := fakeRedis(t, "*2\r\n:1\r\n$3\r\n4.5\r\n")
+	s := NewRedisStore(addr, "")
+	s.now = func() time.Time { return time.UnixMilli(1700000000000) }
+
+	for i := 0; i < 2; i++ {
+		got := s.Take("default|ip:10.0.0.1", Limit{Rate: 0.5, Burst: 10})
+		if !got.Allowed || got.Limit != 10 || got.Remaining != 4 || got.Reset != 11*time.Second {
+			t.Errorf("take %d = %+v, want allowed with 4 of 10 left, full in 11s", i+1, got)
+		}
+	}
+
+	cmd := <-commands
+	if len(cmd) != 7 || cmd[0] != "EVAL" || cmd[2] != "1" || cmd[3] != "ratelimit:default|ip:10.0.0.1" ||
+		cmd[4] != "0.5" || cmd[5] != "10" || cmd[6] != "1700000000000" {
+		t.Errorf("command = %q, want EVAL of the bucket with rate, burst and now", cmd)
+	}
+	if s.failing.Load() || redisErrors.Value() != 0 {
+		t.Error("store fell back to memory against a working server")
+	}
+}
+
+func TestRedisStoreFallsBackToMemory(t *testing.T) {
+	// A port that was free a moment ago refuses connections
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	s := NewRedisStore(addr, "")
+	before := redisErrors.Value()
+	if got := s.Take("default|ip:10.0.0.1", Limit{Rate: 1, Burst: 1}); !got.Allowed {
+		t.Errorf("first take = %+v, want allowed by the memory bucket", got)
+	}
+	if got := s.Take("default|ip:10.0.0.1", Limit{Rate: 1, Burst: 1}); got.Allowed {
+		t.Errorf("second take = %+v, want the memory bucket to limit it", got)
+	}
+	if n := redisErrors.Value() - before; n != 2 {
+		t.Errorf("rate_limit_redis_errors_total increased by %g, want 2", n)
+	}
+}
+
+func TestRedisStoreErrorReply(t *testing.T) {
+	addr, _ := fakeRedis(t, "-NOPERM this user has no permissions to run the 'eval' command\r\n")
+	s := NewRedisStore(addr, "")
+	if _, err := s.take("default|ip:10.0.0.1", Limit{Rate: 1, Burst: 1}); err == nil || !strings.Contains(err.Error(), "NOPERM") {
+		t.Errorf("err = %v, want the server's error", err)
+	}
+	// The connection is still usable after an error reply
+	if n := len(s.conns); n != 1 {
+		t.Errorf("%d idle connections, want the connection kept", n)
+	}
+}
+
+// TestRedisStore runs the bucket script on a real server. Set
+// TEST_REDIS_ADDR to run it, e.g. TEST_REDIS_ADDR=localhost:6379.
+func TestRedisStore(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	clock := &fakeClock{t: time.Now()}
+	s := NewRedisStore(addr, os.Getenv("TEST_REDIS_PASSWORD"))
+	s.now = clock.now
+	key := fmt.Sprintf("test|%s:%d", t.Name(), clock.t.UnixNano())
+	limit := Limit{Rate: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		if got := s.Take(key, limit); !got.Allowed || got.Remaining != 2-i {
+			t.Fatalf("take %d = %+v, want allowed with %d left", i+1, got, 2-i)
+		}
+	}
+	if got := s.Take(key, limit); got.Allowed || got.RetryAfter != 500*time.Millisecond {
+		t.Errorf("take over the burst = %+v, want denied for 500ms", got)
+	}
+	clock.advance(500 * time.Millisecond)
+	if got := s.Take(key, limit); !got.Allowed {
+		t.Errorf("take after the refill = %+v, want allowed", got)
+	}
+	if s.failing.Load() {
+		t.Error("store fell back to memory")
+	}
+}
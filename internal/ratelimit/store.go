@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Store keeps the token buckets of the clients
+type Store interface {
+	// Take takes a token from the bucket of key, creating a full bucket of
+	// limit if there is none.
+	Take(key string, limit Limit) Result
+}
+
+// StoreFromConfig returns the Redis store when REDIS_ADDR is set and the
+// memory store otherwise.
+//
+// Environment Variables:
+//   - REDIS_ADDR: host:port of the Redis server shared by the replicas
+//     (optional)
+//   - REDIS_PASSWORD: Password sent with AUTH (optional)
+//
+// Returns:
+//   - Store: The store
+func StoreFromConfig() Store {
+	addr := viper.GetString("REDIS_ADDR")
+	if addr == "" {
+		logrus.Info("Rate limits are kept in memory and apply per instance")
+		return NewMemoryStore(time.Now)
+	}
+	logrus.WithField("addr", addr).Info("Rate limits are kept in Redis")
+	return NewRedisStore(addr, viper.GetString("REDIS_PASSWORD"))
+}
+
+// MemoryStore keeps the buckets in this process, one Limiter per limit. Its
+// counts are per instance: behind a load balancer with n replicas a client
+// may make up to n times its limit.
+type MemoryStore struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	limiters map[Limit]*Limiter
+}
+
+// NewMemoryStore creates a memory store.
+//
+// Parameters:
+//   - now: Clock; time.Now outside tests
+//
+// Returns:
+//   - *MemoryStore: Store without buckets
+func NewMemoryStore(now func() time.Time) *MemoryStore {
+	return &MemoryStore{now: now, limiters: make(map[Limit]*Limiter)}
+}
+
+// Take implements Store.
+func (s *MemoryStore) Take(key string, limit Limit) Result {
+	s.mu.Lock()
+	l, ok := s.limiters[limit]
+	if !ok {
+		l = NewLimiter(limit, s.now)
+		s.limiters[limit] = l
+	}
+	s.mu.Unlock()
+	return l.Take(key)
+}
@@ -0,0 +1,295 @@
+// Package redact implements the masking of personal data in seller and user
+// records before it leaves the system through API responses and logs. The
+// rules are kept here, keyed by field name, so a new endpoint or log line
+// inherits them instead of masking values itself.
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// fullKey is the echo.Context key set by AllowFull
+const fullKey = "redact.full"
+
+// taxNumberVisible is how many trailing characters a masked number keeps
+const taxNumberVisible = 3
+
+// Rule turns a sensitive value into its redacted form
+type Rule func(string) string
+
+// fieldRules are the rules of stored JSON, by key. Seller JSON of every
+// marketplace carries these keys, at any depth of an API response.
+var fieldRules = map[string]Rule{
+	"taxNumber":              TaxNumber,
+	"registrationNumber":     TaxNumber,
+	"registeredEmailAddress": Email,
+}
+
+// logRules are the rules of log fields: the seller keys, and the fields log
+// lines carry user addresses under.
+var logRules = map[string]Rule{
+	"email":     Email,
+	"to":        Email,
+	"recipient": Email,
+}
+
+func init() {
+	for key, rule := range fieldRules {
+		logRules[key] = rule
+	}
+}
+
+// TaxNumber masks a tax or registration number except its last three
+// characters, which is enough to tell numbers apart. Numbers too short to
+// keep anything are masked entirely.
+//
+// Parameters:
+//   - s: The number
+//
+// Returns:
+//   - string: The masked number, e.g. "*******789"; empty stays empty
+func TaxNumber(s string) string {
+	n := utf8.RuneCountInString(s)
+	if n == 0 {
+		return ""
+	}
+	if n <= 2*taxNumberVisible {
+		return strings.Repeat("*", n)
+	}
+	runes := []rune(s)
+	return strings.Repeat("*", n-taxNumberVisible) + string(runes[n-taxNumberVisible:])
+}
+
+// Email replaces an email address with a hash prefix. The same address
+// always gives the same hash, ignoring case and surrounding whitespace, so
+// log lines about one address can still be correlated.
+//
+// Parameters:
+//   - s: The address
+//
+// Returns:
+//   - string: "sha256:" and 12 hex characters; empty stays empty
+func Email(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return ""
+	}
+	digest := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(digest[:6])
+}
+
+// JSON applies the field rules to a JSON document. Keys and their order are
+// kept; string values under a redacted key are replaced, other values under
+// it are left alone.
+//
+// Parameters:
+//   - raw: The document
+//
+// Returns:
+//   - []byte: The redacted document, raw itself if no rule applies
+//   - error: A malformed document
+func JSON(raw []byte) ([]byte, error) {
+	if !mentionsField(raw) {
+		return raw, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var out bytes.Buffer
+	out.Grow(len(raw))
+	if err := rewriteValue(dec, &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// mentionsField reports whether a document may contain a redacted key, so
+// documents that cannot are returned without decoding them.
+func mentionsField(raw []byte) bool {
+	for key := range fieldRules {
+		if bytes.Contains(raw, []byte(`"`+key+`"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteValue copies the next value of dec to out, applying the field rules
+// to the objects in it.
+func rewriteValue(dec *json.Decoder, out *bytes.Buffer) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return writeScalar(out, tok)
+	}
+
+	out.WriteRune(rune(delim))
+	for first := true; dec.More(); first = false {
+		if !first {
+			out.WriteByte(',')
+		}
+		if delim == '[' {
+			if err := rewriteValue(dec, out); err != nil {
+				return err
+			}
+			continue
+		}
+
+		keyTok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := keyTok.(string)
+		if err := writeScalar(out, key); err != nil {
+			return err
+		}
+		out.WriteByte(':')
+		rule, ok := fieldRules[key]
+		if !ok {
+			if err := rewriteValue(dec, out); err != nil {
+				return err
+			}
+			continue
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		// Unmarshal accepts null into a string, so check for a string first
+		var s string
+		if len(value) == 0 || value[0] != '"' || json.Unmarshal(value, &s) != nil {
+			out.Write(value)
+			continue
+		}
+		if err := writeScalar(out, rule(s)); err != nil {
+			return err
+		}
+	}
+
+	// The closing delimiter
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if delim == '{' {
+		out.WriteByte('}')
+	} else {
+		out.WriteByte(']')
+	}
+	return nil
+}
+
+// writeScalar writes a string, number, boolean or null token.
+func writeScalar(out *bytes.Buffer, tok json.Token) error {
+	if number, ok := tok.(json.Number); ok {
+		out.WriteString(number.String())
+		return nil
+	}
+	encoded, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	out.Write(encoded)
+	return nil
+}
+
+// AllowFull lets the response of a request carry the full values. Only
+// admin-scoped endpoints may call it, and only when the caller asked.
+//
+// Parameters:
+//   - c: Request context
+func AllowFull(c echo.Context) {
+	c.Set(fullKey, true)
+}
+
+// Full reports whether AllowFull was called for the request.
+//
+// Parameters:
+//   - c: Request context
+//
+// Returns:
+//   - bool: True if the response may carry the full values
+func Full(c echo.Context) bool {
+	full, _ := c.Get(fullKey).(bool)
+	return full
+}
+
+// Serializer is the echo JSON serializer of services whose responses may
+// carry seller data. Every c.JSON response goes through the field rules
+// unless AllowFull was called for the request.
+type Serializer struct {
+	echo.DefaultJSONSerializer
+}
+
+// Serialize encodes i as the response body, redacted unless Full.
+//
+// Parameters:
+//   - c: Request context
+//   - i: The response value
+//   - indent: Indentation of pretty-printed responses, empty for compact ones
+//
+// Returns:
+//   - error: Any encoding or write error
+func (s Serializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	if Full(c) {
+		return s.DefaultJSONSerializer.Serialize(c, i, indent)
+	}
+	raw, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	redacted, err := JSON(raw)
+	if err != nil {
+		return err
+	}
+	if indent != "" {
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, redacted, "", indent); err != nil {
+			return err
+		}
+		redacted = pretty.Bytes()
+	}
+	// json.Encoder, which echo uses otherwise, ends the body with a newline
+	_, err = io.Copy(c.Response(), io.MultiReader(bytes.NewReader(redacted), strings.NewReader("\n")))
+	return err
+}
+
+// LogHook is a logrus hook applying the rules to the fields of every log
+// entry, so addresses and tax numbers are never written to the logs.
+type LogHook struct{}
+
+// Levels returns every level; the hook applies to all of them.
+func (LogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire redacts the string fields of an entry that have a rule. logrus fires
+// hooks on a copy of the entry, so the caller's fields are not changed.
+//
+// Parameters:
+//   - entry: The entry about to be written
+//
+// Returns:
+//   - error: Always nil
+func (LogHook) Fire(entry *logrus.Entry) error {
+	for key, value := range entry.Data {
+		rule, ok := logRules[key]
+		if !ok {
+			continue
+		}
+		if s, ok := value.(string); ok {
+			entry.Data[key] = rule(s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package redact
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRules(t *testing.T) {
+	for in, want := range map[string]string{"": "", "12": "**", "123456": "******", "1234567890": "*******890"} {
+		if got := TaxNumber(in); got != want {
+			t.Errorf("TaxNumber(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if Email("") != "" {
+		t.Error("empty address was not kept empty")
+	}
+	hashed := Email("Seller@Example.com ")
+	if !strings.HasPrefix(hashed, "sha256:") || strings.Contains(hashed, "example") {
+		t.Errorf("Email = %q, want a hash", hashed)
+	}
+	if Email("seller@example.com") != hashed {
+		t.Error("the same address hashed differently")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	raw := `{"id":7,"price":12.50,"Seller":{"taxNumber":"1234567890","officialName":"Acme","registeredEmailAddress":"a@b.com"},` +
+		`"items":[{"registrationNumber":"ABC123456"},{"taxNumber":null}]}`
+	got, err := JSON([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":7,"price":12.50,"Seller":{"taxNumber":"*******890","officialName":"Acme","registeredEmailAddress":"` + Email("a@b.com") + `"},` +
+		`"items":[{"registrationNumber":"******456"},{"taxNumber":null}]}`
+	if string(got) != want {
+		t.Errorf("JSON =\n%s\nwant\n%s", got, want)
+	}
+
+	untouched := []byte(`{"name":"no seller data"}`)
+	if got, err := JSON(untouched); err != nil || string(got) != string(untouched) {
+		t.Errorf("JSON = %s, %v; want the document unchanged", got, err)
+	}
+	if _, err := JSON([]byte(`{"taxNumber":`)); err == nil {
+		t.Error("malformed document was accepted")
+	}
+}
+
+func TestSerializer(t *testing.T) {
+	e := echo.New()
+	e.JSONSerializer = Serializer{}
+	body := map[string]string{"taxNumber": "1234567890"}
+	e.GET("/public", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, body)
+	})
+	e.GET("/admin", func(c echo.Context) error {
+		AllowFull(c)
+		return c.JSON(http.StatusOK, body)
+	})
+
+	for path, want := range map[string]string{"/public": `{"taxNumber":"*******890"}`, "/admin": `{"taxNumber":"1234567890"}`} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Errorf("%s: body = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestLogHook(t *testing.T) {
+	entry := logrus.WithFields(logrus.Fields{"email": "user@example.com", "user_id": 4, "to": 12})
+	if err := (LogHook{}).Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Data["email"] != Email("user@example.com") {
+		t.Errorf("email = %v, want it hashed", entry.Data["email"])
+	}
+	if entry.Data["user_id"] != 4 || entry.Data["to"] != 12 {
+		t.Errorf("fields without a rule or a string value changed: %v", entry.Data)
+	}
+}
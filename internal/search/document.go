@@ -0,0 +1,107 @@
+// Package search mirrors the product catalog into an Elasticsearch/OpenSearch
+// index for the search team
+package search
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"scraper/internal/models"
+)
+
+// Document is the indexed representation of a product
+type Document struct {
+	ProductID       uint      `json:"product_id"`       // Product identifier within its source
+	Source          string    `json:"source"`           // Marketplace of the product
+	Name            string    `json:"name"`             // Product name
+	Brand           string    `json:"brand"`            // Brand name
+	CategoryPath    string    `json:"category_path"`    // Full category hierarchy path
+	Price           float64   `json:"price"`            // Current price
+	DiscountPercent float64   `json:"discount_percent"` // Discount off the original price
+	Rating          float64   `json:"rating"`           // Average rating
+	Stock           int       `json:"stock"`            // Units in stock
+	IsActive        bool      `json:"is_active"`        // Whether the product is available
+	UpdatedAt       time.Time `json:"updated_at"`       // When the product last changed
+}
+
+// indexMapping is used when creating the index
+const indexMapping = `{
+  "mappings": {
+    "properties": {
+      "product_id":       {"type": "long"},
+      "source":           {"type": "keyword"},
+      "name":             {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+      "brand":            {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+      "category_path":    {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 512}}},
+      "price":            {"type": "scaled_float", "scaling_factor": 100},
+      "discount_percent": {"type": "float"},
+      "rating":           {"type": "float"},
+      "stock":            {"type": "integer"},
+      "is_active":        {"type": "boolean"},
+      "updated_at":       {"type": "date"}
+    }
+  }
+}`
+
+// documentID returns the index document ID of a product. Products are keyed
+// on (source, id) like in the database.
+func documentID(source string, productID uint) string {
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+	return source + ":" + strconv.FormatUint(uint64(productID), 10)
+}
+
+// newDocument extracts the indexed fields from a product. Values missing from
+// the stored JSON are left at zero.
+//
+// Parameters:
+//   - p: Product to index
+//
+// Returns:
+//   - Document: The search document
+func newDocument(p models.Product) Document {
+	doc := Document{
+		ProductID:    p.ID,
+		Source:       p.Source,
+		Name:         p.Name,
+		CategoryPath: p.CategoryPath,
+		Price:        p.Price,
+		IsActive:     p.IsActive,
+		UpdatedAt:    p.UpdatedAt,
+	}
+	if doc.Source == "" {
+		doc.Source = models.SourceTrendyol
+	}
+
+	var brand struct {
+		Name string `json:"name"`
+	}
+	if json.Unmarshal(p.Brand, &brand) == nil {
+		doc.Brand = brand.Name
+	}
+
+	var rating struct {
+		AverageRating float64 `json:"averageRating"`
+	}
+	if json.Unmarshal(p.RatingScore, &rating) == nil {
+		doc.Rating = rating.AverageRating
+	}
+
+	var stock struct {
+		Stock float64 `json:"stock"`
+	}
+	if json.Unmarshal(p.StockInfo, &stock) == nil {
+		doc.Stock = int(stock.Stock)
+	}
+
+	var price struct {
+		Price         float64 `json:"price"`
+		OriginalPrice float64 `json:"originalPrice"`
+	}
+	if json.Unmarshal(p.PriceInfo, &price) == nil && price.OriginalPrice > price.Price && price.Price > 0 {
+		doc.DiscountPercent = (price.OriginalPrice - price.Price) / price.OriginalPrice * 100
+	}
+	return doc
+}
@@ -0,0 +1,527 @@
+// Package search implements the asynchronous product indexer
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+
+	"scraper/internal/metrics"
+	"scraper/internal/models"
+	"scraper/pkg/httpclient"
+)
+
+// maxRetryDelay caps the backoff between failed flushes
+const maxRetryDelay = time.Minute
+
+// reindexAttempts is how many times a reindex batch is sent before giving up
+const reindexAttempts = 3
+
+// ErrReindexRunning is returned when a full reindex is already in progress
+var ErrReindexRunning = errors.New("reindex already running")
+
+// Indexing metrics
+var (
+	operationsTotal = metrics.NewCounter(
+		"search_index_operations_total",
+		"Search index writes by operation (index, delete) and result (ok, retry, failed)",
+		"operation", "result",
+	)
+	indexLag = metrics.NewGauge(
+		"search_index_lag_seconds",
+		"Age of the oldest product change that is not yet in the search index",
+	)
+	indexPending = metrics.NewGauge(
+		"search_index_pending",
+		"Product changes waiting to be written to the search index",
+	)
+)
+
+// productKey identifies a product across marketplaces
+type productKey struct {
+	Source string
+	ID     uint
+}
+
+// bulkOp is a single index or delete action in a bulk request
+type bulkOp struct {
+	key productKey
+	doc *Document // nil deletes the document
+}
+
+// Indexer mirrors product changes into a search index. Changes are queued by
+// product key without blocking the caller and written by a background worker
+// with the bulk API. The product is loaded from the database when it is
+// flushed, so repeated changes collapse into one write and products that no
+// longer exist are deleted from the index. Failed writes stay queued and are
+// retried with backoff.
+type Indexer struct {
+	db            *gorm.DB
+	client        *http.Client
+	baseURL       string
+	index         string
+	username      string
+	password      string
+	bulkSize      int
+	flushInterval time.Duration
+
+	mu         sync.Mutex
+	pending    map[productKey]time.Time // Product -> when its oldest unindexed change was queued
+	wake       chan struct{}            // Signals a full batch is waiting
+	indexReady atomic.Bool              // Whether the index is known to exist
+	reindexing atomic.Bool              // Whether a full reindex is running
+}
+
+// NewIndexer creates an indexer from the environment. Call Start to begin
+// flushing queued changes.
+//
+// Environment Variables:
+//   - SEARCH_URL: Elasticsearch/OpenSearch base URL (default: http://localhost:9200)
+//   - SEARCH_INDEX: Index name (default: products)
+//   - SEARCH_USERNAME, SEARCH_PASSWORD: Basic auth credentials (optional)
+//   - SEARCH_BULK_SIZE: Maximum products per bulk request (default: 500)
+//   - SEARCH_FLUSH_INTERVAL: How often queued changes are flushed (default: 1s)
+//
+// Parameters:
+//   - db: Database connection used to load products
+//
+// Returns:
+//   - *Indexer: The configured indexer
+func NewIndexer(db *gorm.DB) *Indexer {
+	baseURL := viper.GetString("SEARCH_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:9200"
+	}
+	index := viper.GetString("SEARCH_INDEX")
+	if index == "" {
+		index = "products"
+	}
+	bulkSize := viper.GetInt("SEARCH_BULK_SIZE")
+	if bulkSize <= 0 {
+		bulkSize = 500
+	}
+	flushInterval := viper.GetDuration("SEARCH_FLUSH_INTERVAL")
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	return &Indexer{
+		db:            db,
+		client:        httpclient.MustNew(httpclient.Options{Name: "search", Timeout: 30 * time.Second}),
+		baseURL:       strings.TrimRight(baseURL, "/"),
+		index:         index,
+		username:      viper.GetString("SEARCH_USERNAME"),
+		password:      viper.GetString("SEARCH_PASSWORD"),
+		bulkSize:      bulkSize,
+		flushInterval: flushInterval,
+		pending:       make(map[productKey]time.Time),
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// Start launches the background worker that flushes queued changes.
+func (ix *Indexer) Start() {
+	logrus.WithFields(logrus.Fields{
+		"url":   ix.baseURL,
+		"index": ix.index,
+	}).Info("Search indexer started")
+	go ix.run()
+}
+
+// Enqueue queues a product to be written to the index. It never blocks on
+// the search cluster; an empty source means trendyol.
+//
+// Parameters:
+//   - source: Marketplace of the product
+//   - productID: Product that was created, updated or deleted
+func (ix *Indexer) Enqueue(source string, productID uint) {
+	if source == "" {
+		source = models.SourceTrendyol
+	}
+	key := productKey{Source: source, ID: productID}
+
+	ix.mu.Lock()
+	if _, ok := ix.pending[key]; !ok {
+		ix.pending[key] = time.Now()
+	}
+	full := len(ix.pending) >= ix.bulkSize
+	ix.mu.Unlock()
+
+	if full {
+		select {
+		case ix.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run flushes queued changes every flush interval, or sooner once a full
+// batch is waiting, backing off exponentially while the cluster fails.
+func (ix *Indexer) run() {
+	ticker := time.NewTicker(ix.flushInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	var retryAt time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-ix.wake:
+		}
+
+		if time.Now().Before(retryAt) {
+			ix.updateLag()
+			continue
+		}
+		if err := ix.flush(); err != nil {
+			failures++
+			delay := ix.flushInterval << uint(failures)
+			if delay > maxRetryDelay || delay <= 0 {
+				delay = maxRetryDelay
+			}
+			retryAt = time.Now().Add(delay)
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"failures": failures,
+				"retry_in": delay,
+			}).Error("Search index flush failed")
+		} else {
+			failures = 0
+		}
+		ix.updateLag()
+	}
+}
+
+// flush writes up to one bulk request worth of the oldest queued changes.
+// Changes that fail with a transient error are queued again.
+//
+// Returns:
+//   - error: If the batch could not be written; its changes are requeued
+func (ix *Indexer) flush() error {
+	batch := ix.take()
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := ix.ensureIndex(); err != nil {
+		ix.requeue(batch)
+		return err
+	}
+
+	ops, err := ix.loadOps(batch)
+	if err != nil {
+		ix.requeue(batch)
+		return fmt.Errorf("load products: %w", err)
+	}
+
+	retry, err := ix.bulk(ops)
+	if err != nil {
+		ix.requeue(batch)
+		return err
+	}
+	if len(retry) > 0 {
+		failed := make(map[productKey]time.Time, len(retry))
+		for _, key := range retry {
+			failed[key] = batch[key]
+		}
+		ix.requeue(failed)
+		return fmt.Errorf("%d documents were rejected with a transient error", len(retry))
+	}
+	return nil
+}
+
+// take removes the oldest queued changes, up to the bulk size, from the queue.
+func (ix *Indexer) take() map[productKey]time.Time {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	keys := make([]productKey, 0, len(ix.pending))
+	for key := range ix.pending {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return ix.pending[keys[i]].Before(ix.pending[keys[j]]) })
+	if len(keys) > ix.bulkSize {
+		keys = keys[:ix.bulkSize]
+	}
+
+	batch := make(map[productKey]time.Time, len(keys))
+	for _, key := range keys {
+		batch[key] = ix.pending[key]
+		delete(ix.pending, key)
+	}
+	return batch
+}
+
+// requeue puts changes back on the queue, keeping the older queue time when
+// the product changed again in the meantime.
+func (ix *Indexer) requeue(batch map[productKey]time.Time) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for key, queuedAt := range batch {
+		if existing, ok := ix.pending[key]; !ok || queuedAt.Before(existing) {
+			ix.pending[key] = queuedAt
+		}
+	}
+}
+
+// updateLag publishes the queue size and the age of its oldest change.
+func (ix *Indexer) updateLag() {
+	ix.mu.Lock()
+	var oldest time.Time
+	for _, queuedAt := range ix.pending {
+		if oldest.IsZero() || queuedAt.Before(oldest) {
+			oldest = queuedAt
+		}
+	}
+	pending := len(ix.pending)
+	ix.mu.Unlock()
+
+	lag := 0.0
+	if !oldest.IsZero() {
+		lag = time.Since(oldest).Seconds()
+	}
+	indexLag.Set(lag)
+	indexPending.Set(float64(pending))
+}
+
+// loadOps loads the current state of queued products. Products that exist
+// are indexed and products that are gone are deleted from the index.
+func (ix *Indexer) loadOps(batch map[productKey]time.Time) ([]bulkOp, error) {
+	pairs := make([][]interface{}, 0, len(batch))
+	for key := range batch {
+		pairs = append(pairs, []interface{}{key.ID, key.Source})
+	}
+
+	var products []models.Product
+	if err := ix.db.Where("(id, source) IN ?", pairs).Find(&products).Error; err != nil {
+		return nil, err
+	}
+
+	ops := make([]bulkOp, 0, len(batch))
+	found := make(map[productKey]bool, len(products))
+	for _, p := range products {
+		doc := newDocument(p)
+		key := productKey{Source: doc.Source, ID: p.ID}
+		found[key] = true
+		ops = append(ops, bulkOp{key: key, doc: &doc})
+	}
+	for key := range batch {
+		if !found[key] {
+			ops = append(ops, bulkOp{key: key})
+		}
+	}
+	return ops, nil
+}
+
+// StartReindex writes every product in the database to the index in the
+// background. Only one reindex runs at a time; the outcome is logged.
+//
+// Returns:
+//   - error: ErrReindexRunning, or why the index could not be prepared
+func (ix *Indexer) StartReindex() error {
+	if !ix.reindexing.CompareAndSwap(false, true) {
+		return ErrReindexRunning
+	}
+	if err := ix.ensureIndex(); err != nil {
+		ix.reindexing.Store(false)
+		return err
+	}
+
+	go func() {
+		defer ix.reindexing.Store(false)
+		written, err := ix.reindex()
+		if err != nil {
+			logrus.WithError(err).WithField("written", written).Error("Search reindex failed")
+			return
+		}
+		logrus.WithField("written", written).Info("Search reindex finished")
+	}()
+	return nil
+}
+
+// reindex streams every product from the database to the index in bulk-size
+// batches. Batches are retried a few times before the reindex is aborted.
+//
+// Returns:
+//   - int: Number of products written
+//   - error: The first batch that could not be written
+func (ix *Indexer) reindex() (int, error) {
+	written := 0
+	var products []models.Product
+	err := ix.db.FindInBatches(&products, ix.bulkSize, func(tx *gorm.DB, batch int) error {
+		ops := make([]bulkOp, len(products))
+		for i, p := range products {
+			doc := newDocument(p)
+			ops[i] = bulkOp{key: productKey{Source: doc.Source, ID: p.ID}, doc: &doc}
+		}
+
+		for attempt := 1; ; attempt++ {
+			retry, err := ix.bulk(ops)
+			if err == nil && len(retry) == 0 {
+				break
+			}
+			if attempt == reindexAttempts {
+				if err == nil {
+					err = fmt.Errorf("%d documents were rejected with a transient error", len(retry))
+				}
+				return fmt.Errorf("batch %d: %w", batch, err)
+			}
+			time.Sleep(ix.flushInterval << uint(attempt))
+
+			// Only resend what failed
+			if err == nil {
+				retrySet := make(map[productKey]bool, len(retry))
+				for _, key := range retry {
+					retrySet[key] = true
+				}
+				remaining := ops[:0]
+				for _, op := range ops {
+					if retrySet[op.key] {
+						remaining = append(remaining, op)
+					}
+				}
+				ops = remaining
+			}
+		}
+
+		written += len(products)
+		logrus.WithFields(logrus.Fields{"batch": batch, "written": written}).Info("Reindexed product batch")
+		return nil
+	}).Error
+	return written, err
+}
+
+// ensureIndex creates the index with its mapping if it does not exist yet.
+func (ix *Indexer) ensureIndex() error {
+	if ix.indexReady.Load() {
+		return nil
+	}
+
+	resp, err := ix.do(http.MethodHead, "/"+ix.index, nil, "")
+	if err != nil {
+		return fmt.Errorf("check index: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp, err := ix.do(http.MethodPut, "/"+ix.index, []byte(indexMapping), "application/json")
+		if err != nil {
+			return fmt.Errorf("create index: %w", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// Another instance may have created it concurrently
+		if resp.StatusCode != http.StatusOK && !strings.Contains(string(body), "resource_already_exists_exception") {
+			return fmt.Errorf("create index: HTTP %d: %s", resp.StatusCode, body)
+		}
+		logrus.WithField("index", ix.index).Info("Created search index")
+	default:
+		return fmt.Errorf("check index: HTTP %d", resp.StatusCode)
+	}
+
+	ix.indexReady.Store(true)
+	return nil
+}
+
+// bulk sends index and delete actions in one bulk request.
+//
+// Returns:
+//   - []productKey: Products rejected with a transient error (429 or 5xx)
+//   - error: If the request as a whole failed
+func (ix *Indexer) bulk(ops []bulkOp) ([]productKey, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, op := range ops {
+		meta := map[string]string{"_index": ix.index, "_id": documentID(op.key.Source, op.key.ID)}
+		if op.doc == nil {
+			enc.Encode(map[string]interface{}{"delete": meta})
+			continue
+		}
+		enc.Encode(map[string]interface{}{"index": meta})
+		if err := enc.Encode(op.doc); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := ix.do(http.MethodPost, "/_bulk", body.Bytes(), "application/x-ndjson")
+	if err != nil {
+		return nil, fmt.Errorf("bulk request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read bulk response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bulk request: HTTP %d: %s", resp.StatusCode, data)
+	}
+
+	var result struct {
+		Items []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decode bulk response: %w", err)
+	}
+
+	// Items are reported in request order
+	var retry []productKey
+	for i, item := range result.Items {
+		if i >= len(ops) {
+			break
+		}
+		op := ops[i]
+		for operation, status := range item {
+			switch {
+			case status.Status < 300 || (operation == "delete" && status.Status == http.StatusNotFound):
+				operationsTotal.Inc(operation, "ok")
+			case status.Status == http.StatusTooManyRequests || status.Status >= 500:
+				operationsTotal.Inc(operation, "retry")
+				retry = append(retry, op.key)
+			default:
+				// Mapping and validation errors will not succeed on retry
+				operationsTotal.Inc(operation, "failed")
+				logrus.WithFields(logrus.Fields{
+					"product_id": op.key.ID,
+					"source":     op.key.Source,
+					"status":     status.Status,
+					"error":      string(status.Error),
+				}).Error("Search index rejected product")
+			}
+		}
+	}
+	return retry, nil
+}
+
+// do sends a request to the search cluster with the configured credentials.
+func (ix *Indexer) do(method, path string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, ix.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if ix.username != "" {
+		req.SetBasicAuth(ix.username, ix.password)
+	}
+	return ix.client.Do(req)
+}
@@ -0,0 +1,103 @@
+// Package timeout implements per-route request deadlines for the HTTP APIs.
+// Every request gets a deadline on its context; handlers pass that context to
+// their database queries and outbound requests, which then fail with
+// context.DeadlineExceeded once it passes. apierror reports that as a 503
+// timeout response. Routes are short unless they are listed as long or
+// exempt, so a route can only run without a deadline if its service says so.
+package timeout
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// Policy selects the deadline of a route
+type Policy int
+
+// Route policies
+const (
+	Short  Policy = iota // CRUD and lookups: HTTP_REQUEST_TIMEOUT
+	Long                 // Work done within the request, such as inline crawls: HTTP_LONG_REQUEST_TIMEOUT
+	Exempt               // No deadline; only for responses streamed to the client
+)
+
+// Routes maps "METHOD /path" to a policy. The path is the route as
+// registered, e.g. "GET /favorites/:user_id/export". Routes that are not
+// listed are Short.
+type Routes map[string]Policy
+
+// Deadlines returns the short and long request deadlines.
+//
+// Environment Variables:
+//   - HTTP_REQUEST_TIMEOUT: Deadline of short routes (default: 30s)
+//   - HTTP_LONG_REQUEST_TIMEOUT: Deadline of long routes (default: 5m)
+//
+// Returns:
+//   - time.Duration: Deadline of short routes
+//   - time.Duration: Deadline of long routes
+func Deadlines() (time.Duration, time.Duration) {
+	short := viper.GetDuration("HTTP_REQUEST_TIMEOUT")
+	if short <= 0 {
+		short = 30 * time.Second
+	}
+	long := viper.GetDuration("HTTP_LONG_REQUEST_TIMEOUT")
+	if long <= 0 {
+		long = 5 * time.Minute
+	}
+	return short, long
+}
+
+// Middleware gives every request the deadline of its route. It must be
+// added with e.Use, which runs after routing, so the route is known.
+//
+// Parameters:
+//   - routes: The service's long and exempt routes
+//
+// Returns:
+//   - echo.MiddlewareFunc: Middleware setting the request context's deadline
+func Middleware(routes Routes) echo.MiddlewareFunc {
+	short, long := Deadlines()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var deadline time.Duration
+			switch routes[c.Request().Method+" "+c.Path()] {
+			case Short:
+				deadline = short
+			case Long:
+				deadline = long
+			case Exempt:
+				return next(c)
+			}
+
+			ctx, cancel := context.WithTimeout(c.Request().Context(), deadline)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			// Report errors while the context still tells whether the
+			// deadline passed
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+			return nil
+		}
+	}
+}
+
+// Sleep waits for d or until ctx is done, for pauses between requests in
+// loops that run within a request.
+//
+// Returns:
+//   - error: ctx.Err() if ctx ended first, nil otherwise
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
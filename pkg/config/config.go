@@ -1,11 +1,41 @@
 package config
 
 import (
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// changeHandlers are called after the .env file was read again
+var (
+	changeMu       sync.Mutex
+	changeHandlers []func()
+)
+
+// OnChange registers a function to call after the .env file changed and was
+// read again. Environment variables take precedence over the file, so only
+// settings made in the file can change this way.
+func OnChange(fn func()) {
+	changeMu.Lock()
+	defer changeMu.Unlock()
+	changeHandlers = append(changeHandlers, fn)
+}
+
+// configChanged runs the OnChange handlers.
+func configChanged(event fsnotify.Event) {
+	logrus.WithField("file", event.Name).Info("Configuration file changed, reloading")
+	changeMu.Lock()
+	handlers := append([]func(){}, changeHandlers...)
+	changeMu.Unlock()
+	for _, fn := range handlers {
+		fn()
+	}
+}
+
 // Load initializes configuration from environment variables and .env file.
+// The .env file is watched; OnChange handlers run when it changes.
 func Load() error {
 	viper.SetConfigName(".env")
 	viper.SetConfigType("env")
@@ -19,6 +49,10 @@ func Load() error {
 
 	if err := viper.ReadInConfig(); err != nil {
 		logrus.WithError(err).Warn("Failed to read .env file, using environment variables")
+	} else {
+		// Settings read per use, such as the API keys, follow the file
+		viper.OnConfigChange(configChanged)
+		viper.WatchConfig()
 	}
 
 	logrus.Info("Configuration loaded successfully")
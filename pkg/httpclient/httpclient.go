@@ -0,0 +1,181 @@
+// Package httpclient builds the HTTP clients used for every outbound request.
+// Clients get bounded timeouts, pooled connections, optional proxying and
+// transparent gzip, and each request is counted per host and tagged with a
+// correlation ID so it can be traced across services and logs.
+//
+// Create clients with New instead of &http.Client{}: the zero client has no
+// timeout and a hung upstream would block its caller forever.
+package httpclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"scraper/internal/metrics"
+)
+
+// HeaderCorrelationID carries the correlation ID on outbound requests
+const HeaderCorrelationID = "X-Correlation-ID"
+
+// Defaults applied to zero Options fields
+const (
+	defaultTimeout             = 30 * time.Second
+	defaultDialTimeout         = 5 * time.Second
+	defaultTLSHandshakeTimeout = 5 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// Options configures a client. Zero values use the defaults.
+type Options struct {
+	Name                string        // Client name, the "client" label of the metrics, e.g. "trendyol"
+	Timeout             time.Duration // Whole request including reading the body (default: 30s)
+	DialTimeout         time.Duration // TCP connect timeout (default: 5s)
+	TLSHandshakeTimeout time.Duration // TLS handshake timeout (default: 5s)
+	MaxIdleConns        int           // Idle connections kept across all hosts (default: 100)
+	MaxIdleConnsPerHost int           // Idle connections kept per host (default: 10)
+	MaxConnsPerHost     int           // Connections per host including active ones (default: unlimited)
+	IdleConnTimeout     time.Duration // How long an idle connection is kept (default: 90s)
+	Proxy               string        // Proxy URL; empty uses HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+}
+
+// Outbound request metrics, shared by every client
+var (
+	requestsTotal = metrics.NewCounter(
+		"http_client_requests_total",
+		"Outbound HTTP requests by client, host and response status (\"error\" when no response was received)",
+		"client", "host", "status",
+	)
+	requestDuration = metrics.NewHistogram(
+		"http_client_request_duration_seconds",
+		"Seconds until the response headers of an outbound HTTP request were received",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		time.Hour,
+		"client", "host",
+	)
+)
+
+// New creates an HTTP client.
+//
+// Parameters:
+//   - opts: Client settings; zero fields use the defaults
+//
+// Returns:
+//   - *http.Client: The configured client
+//   - error: If opts.Proxy is not a valid URL
+func New(opts Options) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   withDefault(opts.DialTimeout, defaultDialTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: withDefault(opts.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		MaxIdleConns:        withDefault(opts.MaxIdleConns, defaultMaxIdleConns),
+		MaxIdleConnsPerHost: withDefault(opts.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:     opts.MaxConnsPerHost,
+		IdleConnTimeout:     withDefault(opts.IdleConnTimeout, defaultIdleConnTimeout),
+		ForceAttemptHTTP2:   true,
+		// Requests without their own Accept-Encoding ask for gzip and get the
+		// body decompressed
+		DisableCompression: false,
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = "default"
+	}
+	return &http.Client{
+		Timeout:   withDefault(opts.Timeout, defaultTimeout),
+		Transport: &instrumentedTransport{name: name, next: transport},
+	}, nil
+}
+
+// MustNew is New for options without a proxy, which cannot fail.
+func MustNew(opts Options) *http.Client {
+	client, err := New(opts)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// withDefault returns value, or def if value is zero.
+func withDefault[T time.Duration | int](value, def T) T {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// correlationKey is the context key of the correlation ID
+type correlationKey struct{}
+
+// WithCorrelationID returns a context whose outbound requests carry id.
+// Use it to tie the requests of one operation, such as a crawl, together.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID stored in ctx, or "".
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// NewCorrelationID returns a random correlation ID.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// instrumentedTransport records request metrics and sets the correlation ID
+// header
+type instrumentedTransport struct {
+	name string
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper. A request without a correlation ID
+// in its header or context gets a new one.
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(HeaderCorrelationID) == "" {
+		id := CorrelationID(req.Context())
+		if id == "" {
+			id = NewCorrelationID()
+		}
+		// RoundTrippers must not modify the caller's request
+		req = req.Clone(req.Context())
+		req.Header.Set(HeaderCorrelationID, id)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	requestDuration.Observe(time.Since(start).Seconds(), t.name, req.URL.Host)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	requestsTotal.Inc(t.name, req.URL.Host, status)
+	return resp, err
+}
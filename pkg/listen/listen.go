@@ -0,0 +1,164 @@
+// Package listen binds the TCP ports of the HTTP and gRPC servers.
+//
+// Ports come from configuration and a busy port is an error, so a server
+// never ends up on a port its clients do not know about. For local
+// development PORT_AUTO=true scans upward from the configured port instead;
+// the bound port is then logged, reported by GET /version and written back to
+// the port's environment variable so services in the same process find it.
+package listen
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// maxAutoAttempts is how many ports PORT_AUTO tries, starting at the
+// configured one
+const maxAutoAttempts = 10
+
+// BoundPort is a port bound by this process
+type BoundPort struct {
+	Name   string `json:"name"`  // Server name, e.g. "Crawler HTTP"
+	EnvVar string `json:"env"`   // Variable configuring the port
+	Port   int    `json:"port"`  // Port that was bound
+	Auto   bool   `json:"auto"`  // Whether PORT_AUTO picked the port
+	Moved  bool   `json:"moved"` // Whether the port differs from the configured one
+}
+
+// bound records the ports bound by this process for GET /version
+var (
+	boundMu sync.Mutex
+	bound   []BoundPort
+)
+
+// AutoMode reports whether busy ports are skipped instead of failing.
+//
+// Environment Variables:
+//   - PORT_AUTO: Scan for a free port from the configured one (default: false)
+func AutoMode() bool {
+	return viper.GetBool("PORT_AUTO")
+}
+
+// configuredPort returns the port set in envVar, or defaultPort.
+func configuredPort(envVar string, defaultPort int) (int, error) {
+	raw := viper.GetString(envVar)
+	if raw == "" {
+		return defaultPort, nil
+	}
+	port, err := strconv.Atoi(raw)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("%s=%q is not a valid port", envVar, raw)
+	}
+	return port, nil
+}
+
+// TCP binds the port of a server and returns the listener, so the port cannot
+// be taken between checking and serving. The port is read from envVar. If it
+// is busy, TCP fails unless PORT_AUTO is set, in which case the next
+// maxAutoAttempts-1 ports are tried too.
+//
+// The bound port is recorded for GET /version and written to envVar, which
+// lets services in the same process, like clients of the notification gRPC
+// server, find a port chosen by PORT_AUTO or by configuring port 0.
+//
+// Parameters:
+//   - name: Server name for logs and errors, e.g. "Crawler HTTP"
+//   - envVar: Environment variable configuring the port
+//   - defaultPort: Port used when envVar is unset
+//
+// Returns:
+//   - net.Listener: The bound listener
+//   - error: If envVar is invalid or no port could be bound
+func TCP(name, envVar string, defaultPort int) (net.Listener, error) {
+	port, err := configuredPort(envVar, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+
+	auto := AutoMode()
+	attempts := 1
+	if auto && port != 0 {
+		attempts = maxAutoAttempts
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port+attempt))
+		if err != nil {
+			lastErr = err
+			if auto {
+				logrus.WithFields(logrus.Fields{"server": name, "port": port + attempt}).Warn("Port in use, trying next port")
+			}
+			continue
+		}
+
+		boundPort := lis.Addr().(*net.TCPAddr).Port
+		record(BoundPort{Name: name, EnvVar: envVar, Port: boundPort, Auto: auto, Moved: boundPort != port})
+		os.Setenv(envVar, strconv.Itoa(boundPort))
+		logrus.WithFields(logrus.Fields{
+			"server":     name,
+			"port":       boundPort,
+			"configured": port,
+			"env":        envVar,
+		}).Info("Bound server port")
+		return lis, nil
+	}
+
+	if auto {
+		return nil, fmt.Errorf("%s: no free port in %d-%d: %w", name, port, port+attempts-1, lastErr)
+	}
+	return nil, fmt.Errorf("%s: port %d is unavailable, set %s to a free port: %w", name, port, envVar, lastErr)
+}
+
+// record stores a bound port, replacing an earlier entry of the same server.
+func record(port BoundPort) {
+	boundMu.Lock()
+	defer boundMu.Unlock()
+	for i := range bound {
+		if bound[i].Name == port.Name {
+			bound[i] = port
+			return
+		}
+	}
+	bound = append(bound, port)
+}
+
+// Bound returns the ports bound by this process, sorted by server name.
+func Bound() []BoundPort {
+	boundMu.Lock()
+	defer boundMu.Unlock()
+	ports := append([]BoundPort(nil), bound...)
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return ports
+}
+
+// VersionHandler serves GET /version: the build's module version and VCS
+// revision when known, and the ports bound by this process.
+func VersionHandler(c echo.Context) error {
+	version := "unknown"
+	revision := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"version":   version,
+		"revision":  revision,
+		"port_auto": AutoMode(),
+		"ports":     Bound(),
+	})
+}
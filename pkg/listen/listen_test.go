@@ -0,0 +1,97 @@
+package listen
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// busyPort occupies a free port for the duration of the test.
+func busyPort(t *testing.T) int {
+	t.Helper()
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+// configure sets the port variable and PORT_AUTO for one test.
+func configure(t *testing.T, envVar, port string, auto bool) {
+	t.Helper()
+	viper.Set(envVar, port)
+	viper.Set("PORT_AUTO", auto)
+	t.Cleanup(func() {
+		viper.Set(envVar, nil)
+		viper.Set("PORT_AUTO", nil)
+		os.Unsetenv(envVar)
+	})
+}
+
+func TestTCPFailsFastOnBusyPort(t *testing.T) {
+	port := busyPort(t)
+	configure(t, "LISTEN_TEST_BUSY_PORT", strconv.Itoa(port), false)
+
+	lis, err := TCP("Busy", "LISTEN_TEST_BUSY_PORT", 1)
+	if err == nil {
+		lis.Close()
+		t.Fatalf("expected an error for busy port %d", port)
+	}
+}
+
+func TestTCPRejectsInvalidPort(t *testing.T) {
+	configure(t, "LISTEN_TEST_INVALID_PORT", "http", false)
+
+	if _, err := TCP("Invalid", "LISTEN_TEST_INVALID_PORT", 1); err == nil {
+		t.Fatal("expected an error for an invalid port")
+	}
+}
+
+func TestTCPRecordsBoundPort(t *testing.T) {
+	configure(t, "LISTEN_TEST_ZERO_PORT", "0", false)
+
+	lis, err := TCP("Zero", "LISTEN_TEST_ZERO_PORT", 1)
+	if err != nil {
+		t.Fatalf("TCP: %v", err)
+	}
+	defer lis.Close()
+
+	port := lis.Addr().(*net.TCPAddr).Port
+	if got := os.Getenv("LISTEN_TEST_ZERO_PORT"); got != strconv.Itoa(port) {
+		t.Errorf("env = %q, want %d", got, port)
+	}
+
+	var found bool
+	for _, b := range Bound() {
+		if b.Name == "Zero" {
+			found = true
+			if b.Port != port || b.EnvVar != "LISTEN_TEST_ZERO_PORT" || !b.Moved {
+				t.Errorf("bound = %+v, want port %d moved from 0", b, port)
+			}
+		}
+	}
+	if !found {
+		t.Error("bound port not recorded")
+	}
+}
+
+func TestTCPAutoSkipsBusyPort(t *testing.T) {
+	port := busyPort(t)
+	configure(t, "LISTEN_TEST_AUTO_PORT", strconv.Itoa(port), true)
+
+	lis, err := TCP("Auto", "LISTEN_TEST_AUTO_PORT", 1)
+	if err != nil {
+		// The following ports may be taken by other processes as well
+		t.Skipf("no free port after %d: %v", port, err)
+	}
+	defer lis.Close()
+
+	got := lis.Addr().(*net.TCPAddr).Port
+	if got <= port || got >= port+maxAutoAttempts {
+		t.Errorf("bound port %d, want one in %d-%d", got, port+1, port+maxAutoAttempts-1)
+	}
+}
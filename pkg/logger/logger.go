@@ -2,11 +2,15 @@ package logger
 
 import (
 	"github.com/sirupsen/logrus"
+
+	"scraper/internal/redact"
 )
 
-// Init initializes the structured logger.
+// Init initializes the structured logger. Email addresses and seller tax
+// numbers in log fields are redacted.
 func Init() {
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 	logrus.SetLevel(logrus.InfoLevel)
+	logrus.AddHook(redact.LogHook{})
 	logrus.Info("Logger initialized")
 }
\ No newline at end of file
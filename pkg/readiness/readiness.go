@@ -0,0 +1,59 @@
+// Package readiness coordinates startup between services running in the same
+// process. A service marks its Signal once it can serve requests, and the
+// services depending on it wait for that signal before wiring their clients.
+package readiness
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Signal is closed once when a service becomes ready. The zero value is not
+// usable; create signals with New.
+type Signal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+// New creates a signal that is not ready yet.
+func New() *Signal {
+	return &Signal{ch: make(chan struct{})}
+}
+
+// Mark reports the service as ready. Calling it again has no effect.
+func (s *Signal) Mark() {
+	s.once.Do(func() { close(s.ch) })
+}
+
+// Ready returns a channel that is closed once Mark has been called.
+func (s *Signal) Ready() <-chan struct{} {
+	return s.ch
+}
+
+// Wait blocks until ready is closed or the timeout expires.
+//
+// Parameters:
+//   - name: Name of the awaited dependency for the error message
+//   - ready: Channel closed by the dependency once it is ready
+//   - timeout: How long to wait
+//
+// Returns:
+//   - error: If the dependency was not ready within timeout
+func Wait(name string, ready <-chan struct{}, timeout time.Duration) error {
+	// Check first so an already ready dependency never loses to a zero timeout
+	select {
+	case <-ready:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%s not ready after %s", name, timeout)
+	}
+}
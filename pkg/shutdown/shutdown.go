@@ -0,0 +1,159 @@
+// Package shutdown stops the servers and workers of a service once the
+// process is told to stop. A service adds a step for every part it starts;
+// the steps run in the reverse order they were added, like deferred calls,
+// so the servers started last stop taking work before the producers and
+// connections they use are closed.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+)
+
+// Step stops one part of a service. It should return once the part's
+// in-flight work is done, and cancel that work and return ctx's error once
+// ctx is done.
+type Step func(ctx context.Context) error
+
+// Timeout returns the grace period of a shutdown: how long the services may
+// take to finish their in-flight work before it is cancelled.
+//
+// Environment Variables:
+//   - SHUTDOWN_TIMEOUT: Grace period for running work (default: 30s)
+func Timeout() time.Duration {
+	if timeout := viper.GetDuration("SHUTDOWN_TIMEOUT"); timeout > 0 {
+		return timeout
+	}
+	return 30 * time.Second
+}
+
+// step is a Step with its name for logs
+type step struct {
+	name string
+	stop Step
+}
+
+// Group holds the steps of a service. The zero value is not usable; create
+// groups with New.
+type Group struct {
+	service string
+
+	mu    sync.Mutex
+	steps []step
+}
+
+// New creates a group without steps.
+//
+// Parameters:
+//   - service: Name of the service for logs, e.g. "crawler"
+func New(service string) *Group {
+	return &Group{service: service}
+}
+
+// Add registers a step.
+//
+// Parameters:
+//   - name: Name of the part for logs, e.g. "HTTP server"
+//   - stop: Stops the part
+func (g *Group) Add(name string, stop Step) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.steps = append(g.steps, step{name: name, stop: stop})
+}
+
+// Stop runs the steps in the reverse order they were added and removes them,
+// so a second Stop does nothing. Every step runs, even after an earlier one
+// failed or ctx ended; the later ones then only cancel their work.
+//
+// Parameters:
+//   - ctx: Bounds the wait for in-flight work
+//
+// Returns:
+//   - error: The failed steps, joined
+func (g *Group) Stop(ctx context.Context) error {
+	g.mu.Lock()
+	steps := g.steps
+	g.steps = nil
+	g.mu.Unlock()
+
+	var errs []error
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+		start := time.Now()
+		fields := logrus.Fields{"service": g.service, "step": s.name}
+		if err := s.stop(ctx); err != nil {
+			logrus.WithError(err).WithFields(fields).Error("Failed to stop cleanly")
+			errs = append(errs, fmt.Errorf("%s %s: %w", g.service, s.name, err))
+			continue
+		}
+		logrus.WithFields(fields).WithField("took", time.Since(start)).Debug("Stopped")
+	}
+	return errors.Join(errs...)
+}
+
+// HTTP stops an Echo server: it stops accepting connections and waits for
+// the running requests. Requests still running when ctx ends have their
+// connections closed, which cancels their request contexts.
+func HTTP(e *echo.Echo) Step {
+	return func(ctx context.Context) error {
+		if err := e.Shutdown(ctx); err != nil {
+			e.Close()
+			return err
+		}
+		return nil
+	}
+}
+
+// GRPC stops a gRPC server: it stops accepting connections and waits for
+// the running calls. Calls still running when ctx ends are cancelled.
+func GRPC(s *grpc.Server) Step {
+	return func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			s.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			s.Stop()
+			<-done
+			return ctx.Err()
+		}
+	}
+}
+
+// Cron stops a cron scheduler from starting jobs and waits for the running
+// ones. A nil scheduler, from a job that is turned off, is skipped.
+func Cron(c *cron.Cron) Step {
+	return func(ctx context.Context) error {
+		if c == nil {
+			return nil
+		}
+		select {
+		case <-c.Stop().Done():
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes a producer or connection. Add it before the parts using it,
+// so it is closed after they stopped.
+func Close(c io.Closer) Step {
+	return func(context.Context) error {
+		return c.Close()
+	}
+}
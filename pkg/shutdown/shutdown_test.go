@@ -0,0 +1,141 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+)
+
+func TestStopOrder(t *testing.T) {
+	var order []string
+	g := New("test")
+	for _, name := range []string{"producer", "consumer", "http"} {
+		name := name
+		g.Add(name, func(context.Context) error {
+			order = append(order, name)
+			if name == "consumer" {
+				return errors.New("session failed")
+			}
+			return nil
+		})
+	}
+
+	err := g.Stop(context.Background())
+	if got := strings.Join(order, ","); got != "http,consumer,producer" {
+		t.Errorf("steps ran as %s, want http,consumer,producer", got)
+	}
+	if err == nil || !strings.Contains(err.Error(), "test consumer: session failed") {
+		t.Errorf("err = %v, want the consumer's failure", err)
+	}
+
+	order = nil
+	if err := g.Stop(context.Background()); err != nil || len(order) != 0 {
+		t.Errorf("second Stop ran %v (%v), want nothing", order, err)
+	}
+}
+
+// serveSlow starts an Echo server whose GET /slow answers after delay, or
+// reports the cancellation of its request context on cancelled.
+func serveSlow(t *testing.T, delay time.Duration, cancelled chan<- error) (*echo.Echo, string) {
+	t.Helper()
+	e := echo.New()
+	e.GET("/slow", func(c echo.Context) error {
+		select {
+		case <-time.After(delay):
+			return c.String(http.StatusOK, "done")
+		case <-c.Request().Context().Done():
+			cancelled <- c.Request().Context().Err()
+			return c.Request().Context().Err()
+		}
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Listener = lis
+	go e.Start("")
+	return e, "http://" + lis.Addr().String() + "/slow"
+}
+
+func TestHTTPFinishesRunningRequests(t *testing.T) {
+	e, url := serveSlow(t, 100*time.Millisecond, make(chan error, 1))
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = errors.New(resp.Status)
+			}
+		}
+		result <- err
+	}()
+	time.Sleep(30 * time.Millisecond) // Let the request reach the handler
+
+	if err := HTTP(e)(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("running request failed: %v", err)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("server still accepts requests after the shutdown")
+	}
+}
+
+func TestHTTPCancelsRequestsAfterTimeout(t *testing.T) {
+	cancelled := make(chan error, 1)
+	e, url := serveSlow(t, time.Minute, cancelled)
+	go http.Get(url)
+	time.Sleep(30 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := HTTP(e)(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("running request was not cancelled")
+	}
+}
+
+func TestCronWaitsForRunningJob(t *testing.T) {
+	c := cron.New(cron.WithSeconds())
+	started := make(chan struct{})
+	finished := false
+	c.AddFunc("* * * * * *", func() {
+		select {
+		case <-started:
+			return
+		default:
+		}
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		finished = true
+	})
+	c.Start()
+	select {
+	case <-started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("job did not start")
+	}
+
+	if err := Cron(c)(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Error("Stop returned before the running job finished")
+	}
+	if err := Cron(nil)(context.Background()); err != nil {
+		t.Errorf("nil scheduler: %v", err)
+	}
+}